@@ -0,0 +1,29 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package checkpoint describes how far files have been read, in a form that
+// can seed the tailer's registry, and imports it from other log shippers.
+package checkpoint
+
+import (
+	"fmt"
+	"time"
+)
+
+// Fingerprint identifies a file.  It has the form of a key in the tailer's
+// registry: "device:inode" for files identified by inode, or the absolute
+// path for files identified by path.
+type Fingerprint string
+
+// InodeFingerprint returns the Fingerprint of the file with the given device
+// and inode numbers.
+func InodeFingerprint(dev, ino uint64) Fingerprint {
+	return Fingerprint(fmt.Sprintf("%d:%d", dev, ino))
+}
+
+// Offset is how far a file has been read.
+type Offset struct {
+	Path      string    // Absolute path the file was last read through
+	Offset    int64     // File offset of the first byte not yet read
+	Timestamp time.Time // When the file was last read, if known
+}
@@ -0,0 +1,371 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package checkpoint
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sgtsquiggs/tail/logger"
+
+	"github.com/pkg/errors"
+)
+
+// ImportFilebeatRegistry reads the offsets of the files recorded in a
+// Filebeat registry.  The path can be the registry file of Filebeat before
+// 6.3, or a registry directory in either the data.json layout of Filebeat
+// 6.3 to 7.8 or the log and checkpoint layout of later versions.  Files
+// identified by inode have inode Fingerprints, and files identified by path
+// have path Fingerprints.  Entries that can't be parsed, that use another
+// form of file identity, or that are superseded by a more recent entry for
+// the same file are skipped with a warning.
+func ImportFilebeatRegistry(path string) (map[Fingerprint]Offset, error) {
+	return importFilebeatRegistry(path, log.DefaultLogger)
+}
+
+// fbState is the state Filebeat records for a file, as written by either
+// the log input or the filestream input.
+type fbState struct {
+	Key            string          `json:"_key"` // Set in checkpoint files only
+	Source         string          `json:"source"`
+	Offset         *int64          `json:"offset"`
+	Timestamp      json.RawMessage `json:"timestamp"`
+	TTL            *int64          `json:"ttl"` // Nanoseconds; 0 once the file has been cleaned up
+	IdentifierName string          `json:"identifier_name"`
+	FileStateOS    *struct {
+		Inode  uint64 `json:"inode"`
+		Device uint64 `json:"device"`
+	} `json:"FileStateOS"`
+
+	// Set by the filestream input.
+	Cursor *struct {
+		Offset *int64 `json:"offset"`
+	} `json:"cursor"`
+	Meta *struct {
+		Source         string `json:"source"`
+		IdentifierName string `json:"identifier_name"`
+	} `json:"meta"`
+	Updated json.RawMessage `json:"updated"`
+}
+
+// fbEntry is a state with the store key it was recorded under, if any.
+type fbEntry struct {
+	key   string
+	state fbState
+}
+
+// fbOp is the header of an operation in a memlog store's log.
+type fbOp struct {
+	Op string `json:"op"`
+	ID uint64 `json:"id"`
+}
+
+// fbRecord is the body of an operation in a memlog store's log.
+type fbRecord struct {
+	K string  `json:"k"`
+	V fbState `json:"v"`
+}
+
+func importFilebeatRegistry(path string, logger log.Logger) (map[Fingerprint]Offset, error) {
+	entries, err := readFilebeatRegistry(path, logger)
+	if err != nil {
+		return nil, err
+	}
+	offsets := make(map[Fingerprint]Offset)
+	for _, e := range entries {
+		fp, off, err := e.state.convert(e.key)
+		if err != nil {
+			logger.Warningf("Skipping Filebeat registry entry %q: %s", e.describe(), err)
+			continue
+		}
+		if prev, ok := offsets[fp]; ok {
+			if prev.Timestamp.After(off.Timestamp) {
+				logger.Warningf("Skipping Filebeat registry entry %q for %s, superseded by the entry for %s", e.describe(), off.Path, prev.Path)
+				continue
+			}
+			logger.Warningf("Skipping Filebeat registry entry for %s, superseded by %q", prev.Path, e.describe())
+		}
+		offsets[fp] = off
+	}
+	return offsets, nil
+}
+
+// readFilebeatRegistry returns the entries in the registry at path, in
+// whichever layout it has.
+func readFilebeatRegistry(path string, logger log.Logger) ([]fbEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Filebeat registry %q", path)
+	}
+	if !fi.IsDir() {
+		return readFilebeatStates(path)
+	}
+	// Accept the registry directory, or the filebeat store within it.
+	if sub := filepath.Join(path, "filebeat"); isDir(sub) {
+		path = sub
+	}
+	b, err := ioutil.ReadFile(filepath.Join(path, "meta.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Filebeat registry %q", path)
+	}
+	var meta struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse Filebeat registry metadata in %q", path)
+	}
+	switch meta.Version {
+	case "0":
+		return readFilebeatStates(filepath.Join(path, "data.json"))
+	case "1":
+		return readFilebeatMemlog(path, logger)
+	}
+	return nil, errors.Errorf("Filebeat registry %q has unsupported version %q", path, meta.Version)
+}
+
+// readFilebeatStates reads a JSON array of states, as written by Filebeat
+// before the memlog store.
+func readFilebeatStates(path string) ([]fbEntry, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Filebeat registry %q", path)
+	}
+	var states []fbState
+	if err := json.Unmarshal(b, &states); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse Filebeat registry %q", path)
+	}
+	entries := make([]fbEntry, 0, len(states))
+	for _, s := range states {
+		entries = append(entries, fbEntry{key: s.Key, state: s})
+	}
+	return entries, nil
+}
+
+// readFilebeatMemlog reads a memlog store: the latest checkpoint, with the
+// operations logged since it was written replayed on top.
+func readFilebeatMemlog(dir string, logger log.Logger) ([]fbEntry, error) {
+	store := make(map[string]fbState)
+	known := make(map[string]bool)
+	var order []string // keys in the order first set, for stable output
+	set := func(key string, s fbState) {
+		if !known[key] {
+			known[key] = true
+			order = append(order, key)
+		}
+		store[key] = s
+	}
+
+	checkpoint, id, err := filebeatCheckpoint(dir)
+	if err != nil {
+		return nil, err
+	}
+	if checkpoint != "" {
+		entries, err := readFilebeatStates(checkpoint)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			set(e.key, e.state)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "log.json"))
+	if os.IsNotExist(err) {
+		return memlogEntries(store, order), nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read Filebeat registry log in %q", dir)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64<<10), 16<<20)
+	line := 0
+	for s.Scan() {
+		line++
+		var op fbOp
+		if err := json.Unmarshal(s.Bytes(), &op); err != nil || op.Op == "" {
+			logger.Warningf("Skipping unparseable line %d of Filebeat registry log in %q", line, dir)
+			continue
+		}
+		if !s.Scan() {
+			logger.Warningf("Skipping %q operation at the end of Filebeat registry log in %q without its record", op.Op, dir)
+			break
+		}
+		line++
+		var r fbRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			logger.Warningf("Skipping unparseable line %d of Filebeat registry log in %q: %s", line, dir, err)
+			continue
+		}
+		if op.ID <= id {
+			// Already included in the checkpoint.
+			continue
+		}
+		switch op.Op {
+		case "set":
+			set(r.K, r.V)
+		case "remove":
+			delete(store, r.K)
+		default:
+			logger.Warningf("Skipping unknown operation %q on line %d of Filebeat registry log in %q", op.Op, line-1, dir)
+		}
+	}
+	if err := s.Err(); err != nil {
+		logger.Warningf("Stopped reading Filebeat registry log in %q: %s", dir, err)
+	}
+	return memlogEntries(store, order), nil
+}
+
+// filebeatCheckpoint returns the path of the active checkpoint file in a
+// memlog store, and the ID of the last operation it includes.  It returns
+// "" if there's no checkpoint yet.
+func filebeatCheckpoint(dir string) (string, uint64, error) {
+	var name string
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "active.dat")); err == nil {
+		// active.dat holds the path on the host that wrote it; the file is
+		// looked for alongside it, in case the registry has been copied.
+		name = filepath.Base(strings.TrimSpace(string(b)))
+	} else {
+		matches, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return "", 0, err
+		}
+		var last uint64
+		for _, m := range matches {
+			if id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(m), ".json"), 10, 64); err == nil && (name == "" || id > last) {
+				name, last = filepath.Base(m), id
+			}
+		}
+	}
+	if name == "" {
+		return "", 0, nil
+	}
+	id, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+	if err != nil {
+		return "", 0, errors.Errorf("Filebeat registry checkpoint %q in %q isn't named by an operation ID", name, dir)
+	}
+	return filepath.Join(dir, name), id, nil
+}
+
+// memlogEntries returns the states in store, in order.
+func memlogEntries(store map[string]fbState, order []string) []fbEntry {
+	var entries []fbEntry
+	for _, key := range order {
+		if s, ok := store[key]; ok {
+			entries = append(entries, fbEntry{key: key, state: s})
+		}
+	}
+	return entries
+}
+
+// describe returns something to identify e by in warnings.
+func (e fbEntry) describe() string {
+	if e.key != "" {
+		return e.key
+	}
+	return e.state.Source
+}
+
+// convert returns the Fingerprint and Offset of the file s is the state of,
+// given the store key it was recorded under.
+func (s fbState) convert(key string) (Fingerprint, Offset, error) {
+	if key != "" && !strings.HasPrefix(key, "filebeat::logs::") && !strings.HasPrefix(key, "filestream::") {
+		return "", Offset{}, errors.New("not the state of a file")
+	}
+	if s.TTL != nil && *s.TTL == 0 {
+		return "", Offset{}, errors.New("file has been cleaned up")
+	}
+	var off Offset
+	var identifier string
+	offset := s.Offset
+	off.Path, identifier = s.Source, s.IdentifierName
+	if s.Meta != nil {
+		if off.Path == "" {
+			off.Path = s.Meta.Source
+		}
+		if identifier == "" {
+			identifier = s.Meta.IdentifierName
+		}
+	}
+	if s.Cursor != nil && offset == nil {
+		offset = s.Cursor.Offset
+	}
+	if offset == nil {
+		return "", Offset{}, errors.New("no offset")
+	}
+	off.Offset = *offset
+	ts := s.Timestamp
+	if len(ts) == 0 {
+		ts = s.Updated
+	}
+	t, err := filebeatTime(ts)
+	if err != nil {
+		return "", Offset{}, err
+	}
+	off.Timestamp = t
+
+	// The identity is the last part of the key, such as
+	// "filestream::my-input::native::1234-2049".
+	var id string
+	if i := strings.Index(key, "::"+identifier+"::"); identifier != "" && i >= 0 {
+		id = key[i+len(identifier)+4:]
+	}
+	switch identifier {
+	case "", "native":
+		if s.FileStateOS != nil {
+			return InodeFingerprint(s.FileStateOS.Device, s.FileStateOS.Inode), off, nil
+		}
+		// Filestream keys hold the inode and device as "inode-device".
+		parts := strings.Split(id, "-")
+		if len(parts) == 2 {
+			ino, err1 := strconv.ParseUint(parts[0], 10, 64)
+			dev, err2 := strconv.ParseUint(parts[1], 10, 64)
+			if err1 == nil && err2 == nil {
+				return InodeFingerprint(dev, ino), off, nil
+			}
+		}
+		return "", Offset{}, errors.New("no inode and device")
+	case "path":
+		if off.Path == "" {
+			off.Path = id
+		}
+		if off.Path == "" {
+			return "", Offset{}, errors.New("no path")
+		}
+		return Fingerprint(off.Path), off, nil
+	}
+	return "", Offset{}, errors.Errorf("unsupported file identity %q", identifier)
+}
+
+// filebeatTime parses a timestamp in a Filebeat registry: an RFC 3339 string
+// in the older layouts, or a pair of numbers in the memlog store, the second
+// of which is the time in Unix seconds.
+func filebeatTime(b json.RawMessage) (time.Time, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		return time.Time{}, nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		t, err := time.Parse(time.RFC3339Nano, s)
+		return t, errors.Wrap(err, "bad timestamp")
+	}
+	var pair []int64
+	if err := json.Unmarshal(b, &pair); err != nil || len(pair) != 2 {
+		return time.Time{}, errors.Errorf("bad timestamp %s", b)
+	}
+	return time.Unix(pair[1], 0).UTC(), nil
+}
+
+func isDir(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package checkpoint
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sgtsquiggs/tail/testutil"
+)
+
+func TestImportFilebeatRegistry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		path     string
+		warnings int
+	}{
+		// The registry file, with an entry that has been cleaned up.
+		{"filebeat-6.2", "registry", 1},
+		// The data.json layout, with an entry superseded after a rotation and
+		// an entry without an offset.
+		{"filebeat-7.5", "registry", 2},
+		// The log and checkpoint layout, with an unsupported file identity,
+		// a removed entry, and a log cut short by a crash.
+		{"filebeat-7.17", "registry/filebeat", 2},
+		// Filestream inputs, without active.dat, with an entry not yet read,
+		// a line that isn't JSON, and a key that isn't a file.
+		{"filebeat-8.11", "registry", 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			logger := testutil.NewCaptureLogger()
+			offsets, err := importFilebeatRegistry(filepath.Join("testdata", tc.name, tc.path), logger)
+			testutil.FatalIfErr(t, err)
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", tc.name+".golden.json"))
+			testutil.FatalIfErr(t, err)
+			var expected map[Fingerprint]Offset
+			testutil.FatalIfErr(t, json.Unmarshal(golden, &expected))
+			if diff := testutil.Diff(expected, offsets); diff != "" {
+				t.Errorf("offsets didn't match golden file:\n%s", diff)
+			}
+			var warnings []string
+			for _, e := range logger.Entries() {
+				if e.Level == "warning" {
+					warnings = append(warnings, e.Message)
+				}
+			}
+			if len(warnings) != tc.warnings {
+				t.Errorf("expected %d warnings, got %q", tc.warnings, warnings)
+			}
+		})
+	}
+}
+
+func TestImportFilebeatRegistryErrors(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	for _, tc := range []struct {
+		name string
+		meta string
+	}{
+		{"no metadata", ""},
+		{"bad metadata", "{"},
+		{"unsupported version", `{"version":"2"}`},
+		{"missing data", `{"version":"0"}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(tmpDir, tc.name)
+			testutil.FatalIfErr(t, os.Mkdir(dir, 0700))
+			if tc.meta != "" {
+				testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(dir, "meta.json"), []byte(tc.meta), 0600))
+			}
+			if _, err := ImportFilebeatRegistry(dir); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
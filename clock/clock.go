@@ -0,0 +1,50 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package clock provides an interface over the passage of time, so that
+// time-dependent behaviour can be tested deterministically.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	After(d time.Duration) <-chan time.Time
+}
+
+// Ticker delivers ticks on a channel at intervals, like time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Real is the Clock that uses the time package.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (r realTicker) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTicker) Stop() {
+	r.t.Stop()
+}
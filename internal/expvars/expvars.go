@@ -0,0 +1,34 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package expvars publishes the metrics of the tailer and watcher in expvar.
+package expvars
+
+import (
+	"expvar"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// publishMu serialises publishing, so that a name can't be taken between
+// checking that it's free and publishing under it.
+var publishMu sync.Mutex
+
+// Publish publishes vars in expvar, each under its name with prefix added,
+// or returns an error without publishing any if a name is already taken.
+// expvar has no way to unpublish, so the names stay taken for the life of
+// the process.
+func Publish(prefix string, vars map[string]expvar.Var) error {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	for name := range vars {
+		if expvar.Get(prefix+name) != nil {
+			return errors.Errorf("expvar %q is already published", prefix+name)
+		}
+	}
+	for name, v := range vars {
+		expvar.Publish(prefix+name, v)
+	}
+	return nil
+}
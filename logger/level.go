@@ -0,0 +1,114 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logger
+
+import "sync/atomic"
+
+// Level is a logging verbosity.  Messages more verbose than the configured
+// Level are discarded.
+type Level int32
+
+const (
+	ErrorLevel Level = iota
+	WarningLevel
+	InfoLevel
+	DebugLevel
+)
+
+// Leveled wraps a Logger, discarding messages more verbose than its level.
+// The level may be changed while the Logger is in use; Loggers derived from
+// it with With or WithFields share its level.
+type Leveled struct {
+	inner Logger
+	level *int32
+}
+
+// NewLeveled returns a Leveled logger writing to l at the given level.
+func NewLeveled(l Logger, level Level) *Leveled {
+	v := int32(level)
+	return &Leveled{inner: l, level: &v}
+}
+
+// Level returns the current level.
+func (l *Leveled) Level() Level {
+	return Level(atomic.LoadInt32(l.level))
+}
+
+// SetLevel changes the level.
+func (l *Leveled) SetLevel(level Level) {
+	atomic.StoreInt32(l.level, int32(level))
+}
+
+// Enabled indicates if messages at level will be logged.
+func (l *Leveled) Enabled(level Level) bool {
+	return level <= l.Level()
+}
+
+// With returns a Leveled logger sharing this level that attaches fields to
+// each message, if the wrapped Logger supports fields.
+func (l *Leveled) With(fields map[string]interface{}) *Leveled {
+	return &Leveled{inner: WithFields(l.inner, fields), level: l.level}
+}
+
+func (l *Leveled) WithFields(fields map[string]interface{}) Logger {
+	return l.With(fields)
+}
+
+// Debugf logs at Debug level.  Wrapped Loggers that don't have a Debug level
+// receive the message at Info level.
+func (l *Leveled) Debugf(format string, args ...interface{}) {
+	if !l.Enabled(DebugLevel) {
+		return
+	}
+	if fl, ok := l.inner.(FieldLogger); ok {
+		fl.Debugf(format, args...)
+		return
+	}
+	l.inner.Infof(format, args...)
+}
+
+func (l *Leveled) Infof(format string, args ...interface{}) {
+	if l.Enabled(InfoLevel) {
+		l.inner.Infof(format, args...)
+	}
+}
+func (l *Leveled) Warningf(format string, args ...interface{}) {
+	if l.Enabled(WarningLevel) {
+		l.inner.Warningf(format, args...)
+	}
+}
+func (l *Leveled) Errorf(format string, args ...interface{}) {
+	if l.Enabled(ErrorLevel) {
+		l.inner.Errorf(format, args...)
+	}
+}
+
+// Debug logs at Debug level.  Wrapped Loggers that don't have a Debug level
+// receive the message at Info level.
+func (l *Leveled) Debug(args ...interface{}) {
+	if !l.Enabled(DebugLevel) {
+		return
+	}
+	if fl, ok := l.inner.(FieldLogger); ok {
+		fl.Debug(args...)
+		return
+	}
+	l.inner.Info(args...)
+}
+
+func (l *Leveled) Info(args ...interface{}) {
+	if l.Enabled(InfoLevel) {
+		l.inner.Info(args...)
+	}
+}
+func (l *Leveled) Warning(args ...interface{}) {
+	if l.Enabled(WarningLevel) {
+		l.inner.Warning(args...)
+	}
+}
+func (l *Leveled) Error(args ...interface{}) {
+	if l.Enabled(ErrorLevel) {
+		l.inner.Error(args...)
+	}
+}
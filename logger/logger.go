@@ -8,6 +8,8 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
+	"strings"
 )
 
 var (
@@ -27,10 +29,48 @@ type Logger interface {
 	Error(args ...interface{})
 }
 
+// FieldLogger is a Logger that can attach structured fields to its messages
+// and log below Info level.  Implementations of Logger may optionally
+// satisfy it; callers should use WithFields rather than asserting it
+// themselves.
+type FieldLogger interface {
+	Logger
+	WithFields(fields map[string]interface{}) Logger
+	Debugf(format string, args ...interface{})
+	Debug(args ...interface{})
+}
+
+// WithFields returns a Logger that attaches fields to every message if l is
+// a FieldLogger, otherwise it returns l unchanged.
+func WithFields(l Logger, fields map[string]interface{}) Logger {
+	if fl, ok := l.(FieldLogger); ok {
+		return fl.WithFields(fields)
+	}
+	return l
+}
+
 type internalLogger struct {
-	log *log.Logger
+	log    *log.Logger
+	fields string // preformatted fields appended to each message
 }
 
+func (i *internalLogger) WithFields(fields map[string]interface{}) Logger {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(i.fields)
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, fields[k])
+	}
+	return &internalLogger{log: i.log, fields: b.String()}
+}
+
+func (i *internalLogger) Debugf(format string, args ...interface{}) {
+	i.Debug(fmt.Sprintf(format, args...))
+}
 func (i *internalLogger) Infof(format string, args ...interface{}) {
 	i.Info(fmt.Sprintf(format, args...))
 }
@@ -40,12 +80,15 @@ func (i *internalLogger) Warningf(format string, args ...interface{}) {
 func (i *internalLogger) Errorf(format string, args ...interface{}) {
 	i.Error(fmt.Sprintf(format, args...))
 }
+func (i *internalLogger) Debug(args ...interface{}) {
+	i.log.Println("D!", fmt.Sprint(args...)+i.fields)
+}
 func (i *internalLogger) Info(args ...interface{}) {
-	i.log.Println("I!", fmt.Sprint(args...))
+	i.log.Println("I!", fmt.Sprint(args...)+i.fields)
 }
 func (i *internalLogger) Warning(args ...interface{}) {
-	i.log.Println("W!", fmt.Sprint(args...))
+	i.log.Println("W!", fmt.Sprint(args...)+i.fields)
 }
 func (i *internalLogger) Error(args ...interface{}) {
-	i.log.Println("E!", fmt.Sprint(args...))
+	i.log.Println("E!", fmt.Sprint(args...)+i.fields)
 }
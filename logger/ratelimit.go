@@ -0,0 +1,281 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logger
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSummaryInterval is how often a RateLimitedLogger logs how many
+	// messages it has suppressed.
+	defaultSummaryInterval = time.Minute
+	// defaultMaxRateKeys is the number of keys a RateLimitedLogger remembers
+	// the rate of, the least recently used being forgotten first.
+	defaultMaxRateKeys = 1024
+	// maxSummaryKeys is the number of keys named in a summary, those with
+	// the most messages suppressed; the rest are only counted.
+	maxSummaryKeys = 10
+)
+
+// RateLimitedLogger wraps a Logger, logging at most burst messages with the
+// same key at once and then one every interval, for messages that a failure
+// may repeat for every event.  A message's key is its level and either the
+// key given to Key or, without one, its format string, or its text for the
+// methods without a format.  The next message logged with a key says how
+// many were suppressed since the last, and a summary of the messages
+// suppressed since the last summary is logged at Info level once a minute,
+// when a message is next logged.  Only the 1024 most recently used keys are
+// remembered.  It's safe for concurrent use, and the Loggers derived from it
+// with Key, With or WithFields share its limits.
+type RateLimitedLogger struct {
+	inner  Logger
+	limits *rateLimits
+	key    string // Key of every message, or "" to key them by format
+}
+
+// rateLimits is the state shared by a RateLimitedLogger and those derived
+// from it.
+type rateLimits struct {
+	interval        time.Duration
+	burst           int
+	summaryInterval time.Duration
+	maxKeys         int
+	now             func() time.Time
+
+	mu          sync.Mutex
+	keys        map[rateKeyID]*list.Element // of *rateKey
+	lru         *list.List                  // most recently used first
+	lastSummary time.Time
+	evicted     int64 // Messages suppressed under forgotten keys since the last summary
+}
+
+// rateKeyID is what the messages limited together have in common.
+type rateKeyID struct {
+	level Level
+	key   string
+}
+
+// rateKey is the rate of the messages with one key.
+type rateKey struct {
+	id         rateKeyID
+	tokens     float64   // Messages that may be logged now
+	last       time.Time // When tokens was last topped up
+	suppressed int64     // Messages suppressed since one was logged
+	unreported int64     // Messages suppressed since the last summary
+}
+
+// RateLimited returns a RateLimitedLogger writing to inner at most burst
+// messages with the same key at once, and then one every interval.
+func RateLimited(inner Logger, interval time.Duration, burst int) *RateLimitedLogger {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &rateLimits{
+		interval:        interval,
+		burst:           burst,
+		summaryInterval: defaultSummaryInterval,
+		maxKeys:         defaultMaxRateKeys,
+		now:             time.Now,
+		keys:            make(map[rateKeyID]*list.Element),
+		lru:             list.New(),
+	}
+	l.lastSummary = l.now()
+	return &RateLimitedLogger{inner: inner, limits: l}
+}
+
+// Key returns a Logger sharing these limits that limits all its messages
+// at each level under key, such as an operation and the path it failed on.
+func (r *RateLimitedLogger) Key(key string) *RateLimitedLogger {
+	return &RateLimitedLogger{inner: r.inner, limits: r.limits, key: key}
+}
+
+// With returns a Logger sharing these limits that attaches fields to each
+// message, if the wrapped Logger supports fields.
+func (r *RateLimitedLogger) With(fields map[string]interface{}) *RateLimitedLogger {
+	return &RateLimitedLogger{inner: WithFields(r.inner, fields), limits: r.limits, key: r.key}
+}
+
+func (r *RateLimitedLogger) WithFields(fields map[string]interface{}) Logger {
+	return r.With(fields)
+}
+
+// allow indicates if a message with key may be logged at now, and how many
+// with it were suppressed since the last was.  It also returns a summary to
+// log first, if one is due.
+func (l *rateLimits) allow(id rateKeyID) (ok bool, suppressed int64, summary string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSummary) >= l.summaryInterval {
+		summary = l.summaryLocked(now)
+	}
+	var k *rateKey
+	if e, found := l.keys[id]; found {
+		l.lru.MoveToFront(e)
+		k = e.Value.(*rateKey)
+		if l.interval > 0 {
+			k.tokens += float64(now.Sub(k.last)) / float64(l.interval)
+		} else {
+			k.tokens = float64(l.burst)
+		}
+		if k.tokens > float64(l.burst) {
+			k.tokens = float64(l.burst)
+		}
+		k.last = now
+	} else {
+		k = &rateKey{id: id, tokens: float64(l.burst), last: now}
+		l.keys[id] = l.lru.PushFront(k)
+		for l.lru.Len() > l.maxKeys {
+			oldest := l.lru.Remove(l.lru.Back()).(*rateKey)
+			delete(l.keys, oldest.id)
+			l.evicted += oldest.unreported
+		}
+	}
+	if k.tokens < 1 {
+		k.suppressed++
+		k.unreported++
+		return false, 0, summary
+	}
+	k.tokens--
+	suppressed = k.suppressed
+	k.suppressed = 0
+	return true, suppressed, summary
+}
+
+// summaryLocked returns a summary of the messages suppressed since the last
+// summary, or "" if there were none.  l.mu must be locked when called.
+func (l *rateLimits) summaryLocked(now time.Time) string {
+	since := now.Sub(l.lastSummary)
+	l.lastSummary = now
+	var keys []*rateKey
+	total := l.evicted
+	for e := l.lru.Front(); e != nil; e = e.Next() {
+		if k := e.Value.(*rateKey); k.unreported > 0 {
+			keys = append(keys, k)
+			total += k.unreported
+		}
+	}
+	if total == 0 {
+		return ""
+	}
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].unreported > keys[j].unreported })
+	var b strings.Builder
+	fmt.Fprintf(&b, "Suppressed %d log messages in the last %s:", total, since.Round(time.Second))
+	for i, k := range keys {
+		if i < maxSummaryKeys {
+			fmt.Fprintf(&b, " %d of %q;", k.unreported, k.id.key)
+		}
+		k.unreported = 0
+	}
+	if len(keys) > maxSummaryKeys {
+		fmt.Fprintf(&b, " and %d other keys;", len(keys)-maxSummaryKeys)
+	}
+	if l.evicted > 0 {
+		fmt.Fprintf(&b, " %d under keys since forgotten;", l.evicted)
+		l.evicted = 0
+	}
+	return strings.TrimSuffix(b.String(), ";")
+}
+
+// enabled indicates if the wrapped Logger logs messages at level, so that
+// messages it would discard aren't counted.
+func (r *RateLimitedLogger) enabled(level Level) bool {
+	if l, ok := r.inner.(interface{ Enabled(Level) bool }); ok {
+		return l.Enabled(level)
+	}
+	return true
+}
+
+// logf logs the message from format and args at level with out, if its key
+// allows.
+func (r *RateLimitedLogger) logf(level Level, format string, args []interface{}, out func(string, ...interface{})) {
+	if !r.enabled(level) {
+		return
+	}
+	key := r.key
+	if key == "" {
+		key = format
+	}
+	ok, suppressed, summary := r.limits.allow(rateKeyID{level, key})
+	if summary != "" {
+		r.inner.Info(summary)
+	}
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		format += " (%d similar messages suppressed)"
+		args = append(args[:len(args):len(args)], suppressed)
+	}
+	out(format, args...)
+}
+
+// log logs the message from args at level with out, if its key allows.
+func (r *RateLimitedLogger) log(level Level, args []interface{}, out func(...interface{})) {
+	if !r.enabled(level) {
+		return
+	}
+	msg := fmt.Sprint(args...)
+	key := r.key
+	if key == "" {
+		key = msg
+	}
+	ok, suppressed, summary := r.limits.allow(rateKeyID{level, key})
+	if summary != "" {
+		r.inner.Info(summary)
+	}
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		msg += fmt.Sprintf(" (%d similar messages suppressed)", suppressed)
+	}
+	out(msg)
+}
+
+// Debugf logs at Debug level.  Wrapped Loggers that don't have a Debug level
+// receive the message at Info level.
+func (r *RateLimitedLogger) Debugf(format string, args ...interface{}) {
+	if fl, ok := r.inner.(FieldLogger); ok {
+		r.logf(DebugLevel, format, args, fl.Debugf)
+		return
+	}
+	r.logf(DebugLevel, format, args, r.inner.Infof)
+}
+
+func (r *RateLimitedLogger) Infof(format string, args ...interface{}) {
+	r.logf(InfoLevel, format, args, r.inner.Infof)
+}
+func (r *RateLimitedLogger) Warningf(format string, args ...interface{}) {
+	r.logf(WarningLevel, format, args, r.inner.Warningf)
+}
+func (r *RateLimitedLogger) Errorf(format string, args ...interface{}) {
+	r.logf(ErrorLevel, format, args, r.inner.Errorf)
+}
+
+// Debug logs at Debug level.  Wrapped Loggers that don't have a Debug level
+// receive the message at Info level.
+func (r *RateLimitedLogger) Debug(args ...interface{}) {
+	if fl, ok := r.inner.(FieldLogger); ok {
+		r.log(DebugLevel, args, fl.Debug)
+		return
+	}
+	r.log(DebugLevel, args, r.inner.Info)
+}
+
+func (r *RateLimitedLogger) Info(args ...interface{}) {
+	r.log(InfoLevel, args, r.inner.Info)
+}
+func (r *RateLimitedLogger) Warning(args ...interface{}) {
+	r.log(WarningLevel, args, r.inner.Warning)
+}
+func (r *RateLimitedLogger) Error(args ...interface{}) {
+	r.log(ErrorLevel, args, r.inner.Error)
+}
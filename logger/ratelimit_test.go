@@ -0,0 +1,197 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logger
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a Logger that records each message with its level.
+type recorder struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (r *recorder) add(level, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.msgs = append(r.msgs, level+" "+msg)
+}
+
+func (r *recorder) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.msgs
+	r.msgs = nil
+	return msgs
+}
+
+func (r *recorder) Infof(format string, args ...interface{}) {
+	r.add("I", fmt.Sprintf(format, args...))
+}
+func (r *recorder) Warningf(format string, args ...interface{}) {
+	r.add("W", fmt.Sprintf(format, args...))
+}
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.add("E", fmt.Sprintf(format, args...))
+}
+func (r *recorder) Info(args ...interface{})    { r.add("I", fmt.Sprint(args...)) }
+func (r *recorder) Warning(args ...interface{}) { r.add("W", fmt.Sprint(args...)) }
+func (r *recorder) Error(args ...interface{})   { r.add("E", fmt.Sprint(args...)) }
+
+// newTestRateLimited returns a RateLimitedLogger writing to a recorder, with
+// a clock that the returned function advances.
+func newTestRateLimited(interval time.Duration, burst int) (*RateLimitedLogger, *recorder, func(time.Duration)) {
+	rec := &recorder{}
+	now := time.Unix(0, 0)
+	r := RateLimited(rec, interval, burst)
+	r.limits.now = func() time.Time { return now }
+	r.limits.lastSummary = now
+	return r, rec, func(d time.Duration) { now = now.Add(d) }
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRateLimitedBurstAndSuppressedCount(t *testing.T) {
+	r, rec, advance := newTestRateLimited(10*time.Second, 2)
+
+	for i := 0; i < 5; i++ {
+		r.Infof("Failed to read %s: %d", "/log", i)
+	}
+	// Different format strings and levels are limited separately.
+	r.Warningf("Something else")
+	r.Errorf("Failed to read %s: %d", "/log", 9)
+	want := []string{"I Failed to read /log: 0", "I Failed to read /log: 1", "W Something else", "E Failed to read /log: 9"}
+	if got := rec.take(); !equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	advance(10 * time.Second)
+	r.Infof("Failed to read %s: %d", "/log", 5)
+	want = []string{"I Failed to read /log: 5 (3 similar messages suppressed)"}
+	if got := rec.take(); !equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRateLimitedKey(t *testing.T) {
+	r, rec, _ := newTestRateLimited(time.Minute, 1)
+
+	// Messages with different formats share an explicit key.
+	a := r.Key("read /a")
+	a.Infof("Read failed on %s", "/a")
+	a.Info("Reopening /a")
+	r.Key("read /b").Infof("Read failed on %s", "/b")
+	// Without a format, the text is the key.
+	r.Info("one")
+	r.Info("one")
+	r.Info("two")
+	want := []string{"I Read failed on /a", "I Read failed on /b", "I one", "I two"}
+	if got := rec.take(); !equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRateLimitedSummary(t *testing.T) {
+	r, rec, advance := newTestRateLimited(time.Hour, 1)
+
+	for i := 0; i < 3; i++ {
+		r.Key("open /a").Infof("Failed to open /a")
+	}
+	r.Key("open /b").Infof("Failed to open /b")
+	r.Key("open /b").Infof("Failed to open /b")
+	rec.take()
+
+	advance(time.Minute)
+	r.Key("open /c").Infof("Failed to open /c")
+	want := []string{
+		`I Suppressed 3 log messages in the last 1m0s: 2 of "open /a"; 1 of "open /b"`,
+		"I Failed to open /c",
+	}
+	if got := rec.take(); !equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// Nothing more suppressed, so no summary.
+	advance(time.Minute)
+	r.Key("open /d").Infof("Failed to open /d")
+	want = []string{"I Failed to open /d"}
+	if got := rec.take(); !equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRateLimitedBoundedKeys(t *testing.T) {
+	r, rec, advance := newTestRateLimited(time.Hour, 1)
+	r.limits.maxKeys = 4
+
+	for i := 0; i < 100; i++ {
+		key := r.Key(fmt.Sprintf("read /%d", i))
+		key.Infof("Failed")
+		key.Infof("Failed")
+	}
+	if n := r.limits.lru.Len(); n != 4 {
+		t.Errorf("remembering the rates of %d keys, want 4", n)
+	}
+	if n := len(r.limits.keys); n != 4 {
+		t.Errorf("%d keys in the map, want 4", n)
+	}
+	rec.take()
+
+	advance(time.Minute)
+	r.Info("next")
+	got := rec.take()
+	if len(got) != 2 || !strings.HasPrefix(got[0], "I Suppressed 100 log messages") || !strings.Contains(got[0], "96 under keys since forgotten") {
+		t.Errorf("unexpected summary %q", got)
+	}
+}
+
+func TestRateLimitedLevel(t *testing.T) {
+	rec := &recorder{}
+	r := RateLimited(NewLeveled(rec, InfoLevel), time.Hour, 1)
+
+	// Messages discarded by the level aren't counted as suppressed.
+	for i := 0; i < 3; i++ {
+		r.Debugf("Event for %s", "/a")
+	}
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("debug messages logged: %q", got)
+	}
+	if n := r.limits.lru.Len(); n != 0 {
+		t.Errorf("%d keys remembered for discarded messages", n)
+	}
+}
+
+func TestRateLimitedConcurrent(t *testing.T) {
+	r, rec, _ := newTestRateLimited(time.Hour, 5)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				r.Key(fmt.Sprintf("key %d", i%4)).With(map[string]interface{}{"g": g}).Infof("message %d", i)
+			}
+		}(g)
+	}
+	wg.Wait()
+	if n := len(rec.take()); n != 20 {
+		t.Errorf("%d messages logged, want 20", n)
+	}
+}
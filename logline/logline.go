@@ -3,13 +3,196 @@
 
 package logline
 
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONVersion is the version of the JSON wire format written by MarshalJSON.
+const JSONVersion = 1
+
+// Source describes the kind of source a line was read from.
+type Source int
+
+const (
+	// File is a regular file, which has rotation and truncation semantics.
+	File Source = iota
+	// Pipe is a named pipe; the filename is its path but it can't be seeked.
+	Pipe
+	// Socket is a socket; the filename is an identifier rather than a path.
+	Socket
+	// Stdin is the standard input of the process.
+	Stdin
+)
+
+var sourceNames = []string{"file", "pipe", "socket", "stdin"}
+
+func (s Source) String() string {
+	if s < 0 || int(s) >= len(sourceNames) {
+		return fmt.Sprintf("Source(%d)", int(s))
+	}
+	return sourceNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Source) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(sourceNames) {
+		return nil, fmt.Errorf("unknown source %d", int(s))
+	}
+	return []byte(sourceNames[s]), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Source) UnmarshalText(b []byte) error {
+	for i, name := range sourceNames {
+		if name == string(b) {
+			*s = Source(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown source %q", b)
+}
+
 // LogLine contains all the information about a line just read from a log.
 type LogLine struct {
-	Filename string // The log filename that this line was read from
-	Line     string // The text of the log line itself up to the newline.
+	Filename string `json:"filename"` // The log filename that this line was read from, as valid UTF-8; see SafeFilename
+	Line     string `json:"line"`     // The text of the log line itself up to the newline.
+
+	RawFilename []byte `json:"raw_filename,omitempty"` // The bytes of the filename, if they aren't valid UTF-8 and so Filename isn't them; see RawName
+
+	// Position of the line within the file.  These are only populated when
+	// the tailer is tracking positions; otherwise they are zero.
+	Offset     int64 `json:"offset,omitempty"`      // Byte offset of the start of the line within the file
+	EndOffset  int64 `json:"end_offset,omitempty"`  // Byte offset just after the line's newline, where reading would resume after it
+	LineNumber int64 `json:"line_number,omitempty"` // 1-based line number of lines read from the current file generation
+
+	Generation int `json:"generation,omitempty"` // Number of rotations or truncations seen on this file before this line was read
+
+	Truncated bool `json:"truncated,omitempty"` // The line was cut short before its newline
+
+	Source Source `json:"source,omitempty"` // The kind of source this line was read from
+
+	Seq uint64 `json:"seq,omitempty"` // Position of the line in the order lines were emitted, if the tailer numbers them
+
+	Labels map[string]string `json:"labels,omitempty"` // Fields extracted from the line, if the tailer is asked to extract them
+
+	Repeat int `json:"repeat,omitempty"` // Number of consecutive copies of the line collapsed into this one, if the tailer collapses them
+
+	OpenPath string `json:"open_path,omitempty"` // Where the file was when the line was read, if it had been moved from Filename and the tailer reports it
+
+	Ack func() `json:"-"` // Acknowledges that the line has been handled, if the tailer waits for lines to be before recording them as read; safe to call more than once, from any goroutine
 }
 
 // NewLogLine creates a new LogLine object.
 func NewLogLine(filename string, line string) *LogLine {
-	return &LogLine{filename, line}
+	return &LogLine{Filename: filename, Line: line}
+}
+
+// RawName returns the name of the file the line was read from as it is on
+// the filesystem, which may not be valid UTF-8.
+func (l *LogLine) RawName() string {
+	if l.RawFilename != nil {
+		return string(l.RawFilename)
+	}
+	return l.Filename
+}
+
+// SafeFilename returns name if it is valid UTF-8.  Otherwise each byte of
+// name that isn't part of a valid UTF-8 sequence, and each '%', is replaced
+// by '%' and its value in two hexadecimal digits, so that names that differ
+// in their invalid bytes stay distinct.
+func SafeFilename(name string) string {
+	if utf8.ValidString(name) {
+		return name
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, width := utf8.DecodeRuneInString(name[i:])
+		switch {
+		case r == utf8.RuneError && width == 1, r == '%':
+			fmt.Fprintf(&b, "%%%02X", name[i])
+		default:
+			b.WriteString(name[i : i+width])
+		}
+		i += width
+	}
+	return b.String()
+}
+
+// jsonLogLine is the wire format of a LogLine, which carries the format
+// version alongside the LogLine's own fields.
+type jsonLogLine struct {
+	Version int `json:"v"`
+	*logLineFields
+}
+
+// logLineFields has the fields of LogLine but none of its methods, to avoid
+// recursing into MarshalJSON.
+type logLineFields LogLine
+
+// MarshalJSON implements json.Marshaler.
+func (l *LogLine) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonLogLine{JSONVersion, (*logLineFields)(l)})
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Lines written by a newer
+// version of the format are rejected.
+func (l *LogLine) UnmarshalJSON(b []byte) error {
+	j := jsonLogLine{logLineFields: (*logLineFields)(l)}
+	if err := json.Unmarshal(b, &j); err != nil {
+		return err
+	}
+	if j.Version > JSONVersion {
+		return fmt.Errorf("unsupported LogLine JSON version %d", j.Version)
+	}
+	return nil
+}
+
+// String returns a compact human-readable form of the LogLine.
+func (l *LogLine) String() string {
+	var pos []string
+	if l.Generation != 0 {
+		pos = append(pos, fmt.Sprintf("gen %d", l.Generation))
+	}
+	if l.LineNumber != 0 {
+		pos = append(pos, fmt.Sprintf("line %d", l.LineNumber))
+	}
+	if l.Offset != 0 {
+		pos = append(pos, fmt.Sprintf("offset %d", l.Offset))
+	}
+	if l.EndOffset != 0 {
+		pos = append(pos, fmt.Sprintf("end %d", l.EndOffset))
+	}
+	if l.Truncated {
+		pos = append(pos, "truncated")
+	}
+	if l.Source != File {
+		pos = append(pos, l.Source.String())
+	}
+	if l.Seq != 0 {
+		pos = append(pos, fmt.Sprintf("seq %d", l.Seq))
+	}
+	if l.Repeat != 0 {
+		pos = append(pos, fmt.Sprintf("repeat %d", l.Repeat))
+	}
+	if l.OpenPath != "" {
+		pos = append(pos, "open as "+l.OpenPath)
+	}
+	if len(l.Labels) > 0 {
+		keys := make([]string, 0, len(l.Labels))
+		for k := range l.Labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			pos = append(pos, fmt.Sprintf("%s=%q", k, l.Labels[k]))
+		}
+	}
+	if len(pos) == 0 {
+		return fmt.Sprintf("%s: %q", l.Filename, l.Line)
+	}
+	return fmt.Sprintf("%s (%s): %q", l.Filename, strings.Join(pos, ", "), l.Line)
 }
@@ -0,0 +1,151 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package logline
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var jsonTests = []struct {
+	name string
+	line *LogLine
+}{
+	{"minimal", &LogLine{Filename: "/var/log/app.log", Line: "hello"}},
+	{"full", &LogLine{
+		Filename:   "/var/log/app.log",
+		Line:       "hello \"world\"",
+		Offset:     1024,
+		EndOffset:  1038,
+		LineNumber: 17,
+		Generation: 2,
+		Truncated:  true,
+		Source:     Pipe,
+		Seq:        42,
+		Labels:     map[string]string{"level": "warn", "app": "web"},
+		Repeat:     3,
+		OpenPath:   "/var/log/app.log.1",
+	}},
+}
+
+func TestLogLineJSONRoundTrip(t *testing.T) {
+	for _, tc := range jsonTests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := json.Marshal(tc.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got LogLine
+			if err := json.Unmarshal(b, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.line, &got) {
+				t.Errorf("round trip didn't match: want %v, got %v", tc.line, &got)
+			}
+		})
+	}
+}
+
+func TestLogLineJSONGolden(t *testing.T) {
+	for _, tc := range jsonTests {
+		t.Run(tc.name, func(t *testing.T) {
+			golden, err := ioutil.ReadFile(filepath.Join("testdata", tc.name+".json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := json.Marshal(tc.line)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(bytes.TrimSpace(golden), b) {
+				t.Errorf("JSON didn't match golden file:\nwant %s\ngot  %s", golden, b)
+			}
+		})
+	}
+}
+
+func TestLogLineJSONFutureVersion(t *testing.T) {
+	var l LogLine
+	if err := json.Unmarshal([]byte(`{"v":99,"filename":"f","line":"l"}`), &l); err == nil {
+		t.Error("expected error for unsupported version")
+	}
+}
+
+func TestSourceText(t *testing.T) {
+	for _, s := range []Source{File, Pipe, Socket, Stdin} {
+		b, err := s.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Source
+		if err := got.UnmarshalText(b); err != nil {
+			t.Fatal(err)
+		}
+		if got != s {
+			t.Errorf("round trip didn't match: want %v, got %v", s, got)
+		}
+	}
+	var s Source
+	if err := s.UnmarshalText([]byte("tape")); err == nil {
+		t.Error("expected error for unknown source")
+	}
+}
+
+func TestLogLineString(t *testing.T) {
+	for _, tc := range []struct {
+		line     *LogLine
+		expected string
+	}{
+		{jsonTests[0].line, `/var/log/app.log: "hello"`},
+		{jsonTests[1].line, `/var/log/app.log (gen 2, line 17, offset 1024, end 1038, truncated, pipe, seq 42, repeat 3, open as /var/log/app.log.1, app="web", level="warn"): "hello \"world\""`},
+	} {
+		if got := tc.line.String(); got != tc.expected {
+			t.Errorf("String didn't match: want %s, got %s", tc.expected, got)
+		}
+	}
+}
+
+func TestSafeFilename(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		expected string
+	}{
+		{"/var/log/syslog", "/var/log/syslog"},
+		{"/var/log/café.log", "/var/log/café.log"},
+		{"/var/log/100%.log", "/var/log/100%.log"},
+		{"/var/log/caf\xe9.log", "/var/log/caf%E9.log"},
+		{"/var/log/100%\xff.log", "/var/log/100%25%FF.log"},
+		{"\xc3", "%C3"},
+	} {
+		if got := SafeFilename(tc.name); got != tc.expected {
+			t.Errorf("SafeFilename(%q) = %q, expected %q", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestRawName(t *testing.T) {
+	l := NewLogLine("/var/log/syslog", "line")
+	if got := l.RawName(); got != "/var/log/syslog" {
+		t.Errorf("RawName = %q, expected the Filename", got)
+	}
+	l = &LogLine{Filename: "caf%E9.log", RawFilename: []byte("caf\xe9.log")}
+	if got := l.RawName(); got != "caf\xe9.log" {
+		t.Errorf("RawName = %q, expected the raw filename", got)
+	}
+	b, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got LogLine
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.RawName() != "caf\xe9.log" || got.Filename != "caf%E9.log" {
+		t.Errorf("raw filename didn't round trip through %s: %+v", b, got)
+	}
+}
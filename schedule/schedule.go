@@ -0,0 +1,286 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+// Package schedule calls functions at deadlines, for many deadlines at once,
+// from one goroutine waiting on one timer.
+package schedule
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+)
+
+// Scheduler calls functions at the times they're scheduled for, one at a
+// time, from its own goroutine.  However many are scheduled, it waits on a
+// single timer of its clock, for the earliest, so each of tens of thousands
+// of paths can have its own deadlines without a runtime timer for each.
+// Functions are called in the order of their deadlines, and must not block,
+// as they hold back the rest.
+//
+// A Scheduler is also a clock.Clock, whose tickers and timers are scheduled
+// on it.
+type Scheduler struct {
+	clock clock.Clock
+
+	mu     sync.Mutex // protects the fields below
+	heap   timerHeap
+	wait   <-chan time.Time // Fires at waitAt, if there are timers
+	waitAt time.Time
+	closed bool
+
+	kick      chan struct{} // Signalled when wait changes
+	stop      chan struct{} // Closed by Close
+	done      chan struct{} // Closed when run exits
+	closeOnce sync.Once
+}
+
+// New returns a Scheduler using clk, and starts it.
+func New(clk clock.Clock) *Scheduler {
+	s := &Scheduler{
+		clock: clk,
+		kick:  make(chan struct{}, 1),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Timer is a function scheduled on a Scheduler.
+type Timer struct {
+	s      *Scheduler
+	fn     func()
+	at     time.Time     // When fn is next called
+	period time.Duration // How often fn is called, if > 0
+	index  int           // Position in the heap, or -1 if not scheduled
+}
+
+// At schedules fn to be called at at, or as soon as possible if at has
+// passed.
+func (s *Scheduler) At(at time.Time, fn func()) *Timer {
+	t := &Timer{s: s, fn: fn, index: -1}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduleLocked(t, at)
+	return t
+}
+
+// AfterFunc schedules fn to be called once d has passed.
+func (s *Scheduler) AfterFunc(d time.Duration, fn func()) *Timer {
+	return s.At(s.clock.Now().Add(d), fn)
+}
+
+// Every schedules fn to be called every d, starting once d has passed.  The
+// calls keep in step with the first, however late each one is, and calls
+// that would be missed while the Scheduler is behind are dropped, like
+// time.Ticker's ticks.  It panics if d isn't positive.
+func (s *Scheduler) Every(d time.Duration, fn func()) *Timer {
+	if d <= 0 {
+		panic("non-positive interval for Scheduler.Every")
+	}
+	t := &Timer{s: s, fn: fn, period: d, index: -1}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scheduleLocked(t, s.clock.Now().Add(d))
+	return t
+}
+
+// Stop unschedules the Timer, and returns false if it wasn't scheduled,
+// because it had been stopped or had already fired.  It doesn't wait for a
+// call under way to return.
+func (t *Timer) Stop() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	if t.index < 0 {
+		return false
+	}
+	heap.Remove(&t.s.heap, t.index)
+	return true
+}
+
+// Reset reschedules the Timer for at, whether or not it has fired or been
+// stopped, and returns true if it was still scheduled.  A Timer from Every
+// is called every period from at.
+func (t *Timer) Reset(at time.Time) bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	scheduled := t.index >= 0
+	t.s.scheduleLocked(t, at)
+	return scheduled
+}
+
+// Pending indicates if the Timer is scheduled to be called.
+func (t *Timer) Pending() bool {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	return t.index >= 0
+}
+
+// Len returns the number of Timers scheduled.
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.heap)
+}
+
+// Close stops the Scheduler.  The Timers scheduled are never called, and
+// those scheduled later are ignored.
+func (s *Scheduler) Close() {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		s.closed = true
+		for _, t := range s.heap {
+			t.index = -1
+		}
+		s.heap = nil
+		s.mu.Unlock()
+		close(s.stop)
+		<-s.done
+	})
+}
+
+// scheduleLocked schedules t for at.  s.mu must be locked when called.
+func (s *Scheduler) scheduleLocked(t *Timer, at time.Time) {
+	if s.closed {
+		return
+	}
+	t.at = at
+	if t.index < 0 {
+		heap.Push(&s.heap, t)
+	} else {
+		heap.Fix(&s.heap, t.index)
+	}
+	s.armLocked()
+}
+
+// armLocked starts waiting for the earliest Timer, unless the wait under way
+// ends no later.  A wait for a Timer since stopped or rescheduled ends early,
+// and finds nothing due.  The wait starts here rather than in run, so that
+// it has started by the time the Timer is returned, for tests whose fake
+// clock is advanced straight after.  s.mu must be locked when called.
+func (s *Scheduler) armLocked() {
+	if len(s.heap) == 0 {
+		return
+	}
+	at := s.heap[0].at
+	if s.wait != nil && !at.Before(s.waitAt) {
+		return
+	}
+	s.waitAt = at
+	s.wait = s.clock.After(at.Sub(s.clock.Now()))
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+// run calls the Timers as they fall due, until Close is called.
+func (s *Scheduler) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		wait := s.wait
+		s.mu.Unlock()
+		select {
+		case <-wait:
+			s.fire()
+		case <-s.kick:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// fire calls the Timers that are due, and waits for the next.
+func (s *Scheduler) fire() {
+	s.mu.Lock()
+	s.wait = nil
+	due := s.dueLocked(s.clock.Now())
+	s.armLocked()
+	s.mu.Unlock()
+	for _, fn := range due {
+		fn()
+	}
+}
+
+// dueLocked returns the functions of the Timers due at now, in the order of
+// their deadlines, and reschedules or removes the Timers.  s.mu must be
+// locked when called.
+func (s *Scheduler) dueLocked(now time.Time) []func() {
+	var due []func()
+	for len(s.heap) > 0 && !s.heap[0].at.After(now) {
+		t := s.heap[0]
+		due = append(due, t.fn)
+		if t.period > 0 {
+			t.at = t.at.Add((now.Sub(t.at)/t.period + 1) * t.period)
+			heap.Fix(&s.heap, 0)
+		} else {
+			heap.Pop(&s.heap)
+		}
+	}
+	return due
+}
+
+// Now returns the time of the Scheduler's clock.
+func (s *Scheduler) Now() time.Time {
+	return s.clock.Now()
+}
+
+// After returns a channel that receives the time once d has passed.
+func (s *Scheduler) After(d time.Duration) <-chan time.Time {
+	c := make(chan time.Time, 1)
+	s.AfterFunc(d, func() { c <- s.clock.Now() })
+	return c
+}
+
+// NewTicker returns a Ticker that ticks every d.  Like time.Ticker, ticks are
+// dropped if the receiver falls behind.
+func (s *Scheduler) NewTicker(d time.Duration) clock.Ticker {
+	c := make(chan time.Time, 1)
+	t := s.Every(d, func() {
+		select {
+		case c <- s.clock.Now():
+		default:
+		}
+	})
+	return ticker{t, c}
+}
+
+type ticker struct {
+	t *Timer
+	c chan time.Time
+}
+
+func (t ticker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t ticker) Stop() {
+	t.t.Stop()
+}
+
+// timerHeap orders Timers by their deadlines.
+type timerHeap []*Timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*Timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	t.index = -1
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return t
+}
@@ -0,0 +1,250 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package schedule
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+	"github.com/sgtsquiggs/tail/testutil"
+)
+
+var _ clock.Clock = (*Scheduler)(nil)
+
+const timeout = 5 * time.Second
+
+// receive returns the next n values from c.
+func receive(t *testing.T, c <-chan int, n int) []int {
+	t.Helper()
+	var result []int
+	for len(result) < n {
+		select {
+		case i := <-c:
+			result = append(result, i)
+		case <-time.After(timeout):
+			t.Fatalf("received %v, expected %d values", result, n)
+		}
+	}
+	return result
+}
+
+// expectNothing fails if a value is received from c soon.
+func expectNothing(t *testing.T, c <-chan int) {
+	t.Helper()
+	select {
+	case i := <-c:
+		t.Errorf("unexpected call %d", i)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+
+	called := make(chan int, 3)
+	for _, i := range []int{3, 1, 2} {
+		i := i
+		s.AfterFunc(time.Duration(i)*time.Second, func() { called <- i })
+	}
+	if s.Len() != 3 {
+		t.Errorf("expected 3 timers, got %d", s.Len())
+	}
+	clk.Advance(1500 * time.Millisecond)
+	result := receive(t, called, 1)
+	expectNothing(t, called)
+	clk.Advance(2 * time.Second)
+	result = append(result, receive(t, called, 2)...)
+	if diff := testutil.Diff([]int{1, 2, 3}, result); diff != "" {
+		t.Errorf("calls didn't match:\n%s", diff)
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected no timers, got %d", s.Len())
+	}
+}
+
+func TestSchedulerStopReset(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+
+	called := make(chan int, 2)
+	stopped := s.AfterFunc(time.Second, func() { called <- 1 })
+	reset := s.AfterFunc(time.Hour, func() { called <- 2 })
+	if !stopped.Stop() {
+		t.Error("expected Stop of a scheduled timer to return true")
+	}
+	if stopped.Stop() {
+		t.Error("expected a second Stop to return false")
+	}
+	if !reset.Reset(clk.Now().Add(2 * time.Second)) {
+		t.Error("expected Reset of a scheduled timer to return true")
+	}
+	clk.Advance(2 * time.Second)
+	if diff := testutil.Diff([]int{2}, receive(t, called, 1)); diff != "" {
+		t.Errorf("calls didn't match:\n%s", diff)
+	}
+	expectNothing(t, called)
+	if reset.Pending() {
+		t.Error("expected the timer to have fired")
+	}
+
+	// A timer that has fired can be scheduled again.
+	if reset.Reset(clk.Now().Add(time.Second)) {
+		t.Error("expected Reset of a fired timer to return false")
+	}
+	clk.Advance(time.Second)
+	if diff := testutil.Diff([]int{2}, receive(t, called, 1)); diff != "" {
+		t.Errorf("calls didn't match:\n%s", diff)
+	}
+}
+
+func TestSchedulerEvery(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+
+	called := make(chan int, 10)
+	n := 0
+	every := s.Every(time.Second, func() { n++; called <- n })
+	clk.Advance(time.Second)
+	receive(t, called, 1)
+
+	// Calls missed while behind are dropped, and the next is still on the
+	// second.
+	clk.Advance(3500 * time.Millisecond)
+	receive(t, called, 1)
+	expectNothing(t, called)
+	clk.Advance(500 * time.Millisecond)
+	if diff := testutil.Diff([]int{3}, receive(t, called, 1)); diff != "" {
+		t.Errorf("calls didn't match:\n%s", diff)
+	}
+
+	every.Stop()
+	clk.Advance(time.Second)
+	expectNothing(t, called)
+}
+
+func TestSchedulerClock(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+
+	ticker := s.NewTicker(time.Second)
+	after := s.After(1500 * time.Millisecond)
+	clk.Advance(time.Second)
+	select {
+	case <-ticker.C():
+	case <-time.After(timeout):
+		t.Fatal("no tick")
+	}
+	clk.Advance(time.Second)
+	select {
+	case <-after:
+	case <-time.After(timeout):
+		t.Fatal("After didn't fire")
+	}
+	ticker.Stop()
+	if s.Len() != 0 {
+		t.Errorf("expected no timers, got %d", s.Len())
+	}
+}
+
+func TestSchedulerClose(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+
+	called := make(chan int, 2)
+	before := s.AfterFunc(time.Second, func() { called <- 1 })
+	s.Close()
+	s.AfterFunc(time.Second, func() { called <- 2 })
+	clk.Advance(time.Second)
+	expectNothing(t, called)
+	if before.Stop() {
+		t.Error("expected Stop after Close to return false")
+	}
+	if s.Len() != 0 {
+		t.Errorf("expected no timers, got %d", s.Len())
+	}
+	s.Close()
+}
+
+func TestSchedulerConcurrent(t *testing.T) {
+	s := New(clock.Real)
+	defer s.Close()
+
+	var fired, stopped int64
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				tm := s.AfterFunc(time.Duration(i%10)*time.Millisecond, func() { atomic.AddInt64(&fired, 1) })
+				switch i % 3 {
+				case 1:
+					if tm.Stop() {
+						atomic.AddInt64(&stopped, 1)
+					}
+				case 2:
+					tm.Reset(time.Now().Add(time.Millisecond))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt64(&fired)+atomic.LoadInt64(&stopped) != 8*500 {
+		if time.Now().After(deadline) {
+			t.Fatalf("fired %d and stopped %d of %d", atomic.LoadInt64(&fired), atomic.LoadInt64(&stopped), 8*500)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// benchmarkPaths is the number of paths scheduled in the benchmarks.
+const benchmarkPaths = 50000
+
+// BenchmarkReschedule measures moving the deadline of one of 50k paths, as
+// each read of a throttled file does.
+func BenchmarkReschedule(b *testing.B) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+	timers := make([]*Timer, benchmarkPaths)
+	for i := range timers {
+		timers[i] = s.AfterFunc(time.Hour+time.Duration(i)*time.Millisecond, func() {})
+	}
+	now := clk.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		timers[i%benchmarkPaths].Reset(now.Add(time.Hour + time.Duration(i*7919%benchmarkPaths)*time.Millisecond))
+	}
+}
+
+// BenchmarkFire measures finding the due calls each second, of 50k paths
+// polled every 1 to 50 seconds.
+func BenchmarkFire(b *testing.B) {
+	clk := testutil.NewFakeClock(time.Now())
+	s := New(clk)
+	defer s.Close()
+	for i := 0; i < benchmarkPaths; i++ {
+		s.Every(time.Duration(i%50+1)*time.Second, func() {})
+	}
+	now := clk.Now()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		now = now.Add(time.Second)
+		s.mu.Lock()
+		due := s.dueLocked(now)
+		s.mu.Unlock()
+		for _, fn := range due {
+			fn()
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ack records that another event from the watcher has been handled, and
+// acknowledges it to the watcher if it counts its events.
+func (t *Tailer) ack() {
+	t.ackMu.Lock()
+	t.acked++
+	acked := t.acked
+	close(t.ackCh)
+	t.ackCh = make(chan struct{})
+	t.ackMu.Unlock()
+	if t.sequencer != nil {
+		t.sequencer.AckEvents(t.eventsHandle, acked)
+	}
+}
+
+// WaitForEvents blocks until the Tailer has handled every event its watcher
+// had sent it when called, including the reads the events caused, so that
+// tests and embedders can wait for a change to be processed without
+// sleeping.  Reads left for later, by WithMaxBytesPerRead, a rate limit or a
+// backfill worker, may still be to come.  It returns an error if the watcher
+// isn't a watcher.EventSequencer or the Tailer shuts down first, and
+// ctx.Err() if ctx is done first.
+func (t *Tailer) WaitForEvents(ctx context.Context) error {
+	if t.sequencer == nil {
+		return errors.New("watcher doesn't count the events it sends")
+	}
+	sent := t.sequencer.EventsSent(t.eventsHandle)
+	closed := false
+	for {
+		t.ackMu.Lock()
+		acked, ch := t.acked, t.ackCh
+		t.ackMu.Unlock()
+		if acked >= sent {
+			return nil
+		}
+		if closed {
+			return errors.New("tailer is closed")
+		}
+		select {
+		case <-ch:
+		case <-t.runDone:
+			// Check the events handled before run exited.
+			closed = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
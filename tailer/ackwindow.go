@@ -0,0 +1,137 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync"
+)
+
+// ackWindow holds the lines of a File sent but not yet acknowledged, with
+// WithAckedOffsets, so that the offset recorded in the registry only covers
+// lines that have been.
+type ackWindow struct {
+	max     int             // Lines that may be waiting to be acknowledged before sending blocks
+	release <-chan struct{} // Closed when sending should no longer wait, as the Tailer is shutting down
+
+	mu      sync.Mutex
+	changed chan struct{} // Closed when lines are acknowledged or forgotten
+	epoch   int           // Incremented on each reset, so acks for lines from before are ignored
+	base    uint64        // Sequence number of pending[0]
+	pending []bool        // Whether each line sent since base has been acknowledged
+	starts  []int64       // Offset of the start of each line in pending
+	read    int64         // Offset up to which the file had been read at the last checkpoint
+}
+
+func newAckWindow(max int, release <-chan struct{}) *ackWindow {
+	return &ackWindow{max: max, release: release, changed: make(chan struct{})}
+}
+
+// add records a line starting at start that's about to be sent, waiting
+// until fewer than max lines are waiting to be acknowledged, and returns how
+// it's acknowledged.  commit is called with the offset recorded once
+// acknowledging a line advances it.
+func (a *ackWindow) add(start int64, commit func(int64)) func() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+wait:
+	for len(a.pending) >= a.max {
+		changed := a.changed
+		a.mu.Unlock()
+		select {
+		case <-changed:
+		case <-a.release:
+			// Still held back from the offset, but not from being sent.
+			a.mu.Lock()
+			break wait
+		}
+		a.mu.Lock()
+	}
+	epoch, seq := a.epoch, a.base+uint64(len(a.pending))
+	a.pending = append(a.pending, false)
+	a.starts = append(a.starts, start)
+	var once sync.Once
+	return func() {
+		once.Do(func() { a.ack(epoch, seq, commit) })
+	}
+}
+
+// ack records that the line with seq has been acknowledged.  commit is
+// called with a.mu locked, so that it can't race with a reset.
+func (a *ackWindow) ack(epoch int, seq uint64, commit func(int64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if epoch != a.epoch || seq < a.base {
+		return
+	}
+	a.pending[seq-a.base] = true
+	n := 0
+	for n < len(a.pending) && a.pending[n] {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	a.pending = a.pending[n:]
+	a.starts = a.starts[n:]
+	a.base += uint64(n)
+	a.changedLocked()
+	commit(a.committedLocked())
+}
+
+// checkpoint records that the file has been read up to read, and calls
+// commit with the offset to record in the registry, with a.mu locked so that
+// it's ordered with the commits of acks.
+func (a *ackWindow) checkpoint(read int64, commit func(int64)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.read = read
+	commit(a.committedLocked())
+}
+
+// committedLocked returns the start of the first line not acknowledged, or
+// where the file had been read up to if every line has been.  a.mu must be
+// locked when called.
+func (a *ackWindow) committedLocked() int64 {
+	if len(a.starts) > 0 {
+		return a.starts[0]
+	}
+	return a.read
+}
+
+// reset forgets the lines waiting to be acknowledged, when the file starts a
+// new generation whose offsets they don't apply to.
+func (a *ackWindow) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.epoch++
+	a.base += uint64(len(a.pending))
+	a.pending, a.starts = nil, nil
+	a.read = 0
+	a.changedLocked()
+}
+
+// changedLocked wakes the sender waiting for room.  a.mu must be locked when
+// called.
+func (a *ackWindow) changedLocked() {
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// unacked returns the number of lines waiting to be acknowledged.
+func (a *ackWindow) unacked() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.pending)
+}
+
+// commitAcked records in the registry the offset up to which f's lines have
+// been acknowledged.
+func (f *File) commitAcked(offset int64) {
+	if f.registry == nil || !f.regular {
+		return
+	}
+	if key, ok := f.registry.keyOf(f); ok {
+		f.registry.update(key, f.Pathname, offset, f.clock.Now())
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "strings"
+
+const (
+	asciiBEL = 0x07
+	asciiESC = 0x1b
+)
+
+// ansiState is where an ansiStripper is in an escape sequence.
+type ansiState int
+
+const (
+	ansiGround             ansiState = iota // Not in an escape sequence
+	ansiEscape                              // After an ESC
+	ansiEscapeIntermediate                  // In the intermediate bytes of a two-character sequence, such as ESC ( B
+	ansiCSI                                 // In a control sequence, after ESC [
+	ansiString                              // In an OSC, DCS, SOS, PM or APC string, ended by BEL or ESC \
+	ansiStringEscape                        // After an ESC in a string, which may be the start of ESC \
+)
+
+// ansiStripper removes ANSI escape sequences from lines, for WithStripANSI.
+// It's a state machine rather than a regular expression, so that a sequence
+// split between the pieces of a line sent separately, as when a partial line
+// is flushed early, is still removed.
+type ansiStripper struct {
+	state ansiState
+}
+
+// strip returns line without its escape sequences.  If carry is true, the
+// rest of the line is yet to come, so a sequence left incomplete at its end
+// carries on into the next piece; otherwise an incomplete sequence is
+// dropped with the line.
+func (a *ansiStripper) strip(line string, carry bool) string {
+	if a.state == ansiGround && strings.IndexByte(line, asciiESC) < 0 {
+		return line
+	}
+	var b strings.Builder
+	b.Grow(len(line))
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch a.state {
+		case ansiGround:
+			if c == asciiESC {
+				a.state = ansiEscape
+			} else {
+				b.WriteByte(c)
+			}
+		case ansiEscape:
+			switch {
+			case c == '[':
+				a.state = ansiCSI
+			case c == ']', c == 'P', c == 'X', c == '^', c == '_':
+				a.state = ansiString
+			case c >= 0x20 && c <= 0x2f:
+				a.state = ansiEscapeIntermediate
+			case c == asciiESC:
+			case c >= 0x30 && c <= 0x7e:
+				// The final byte of a two-character sequence, such as ESC 7.
+				a.state = ansiGround
+			default:
+				// Not a sequence after all.
+				a.state = ansiGround
+				i--
+			}
+		case ansiEscapeIntermediate:
+			switch {
+			case c >= 0x20 && c <= 0x2f:
+			case c >= 0x30 && c <= 0x7e:
+				a.state = ansiGround
+			default:
+				a.state = ansiGround
+				i--
+			}
+		case ansiCSI:
+			switch {
+			case c >= 0x20 && c <= 0x3f:
+				// Parameter and intermediate bytes.
+			case c >= 0x40 && c <= 0x7e:
+				a.state = ansiGround
+			case c == asciiESC:
+				a.state = ansiEscape
+			default:
+				a.state = ansiGround
+				i--
+			}
+		case ansiString:
+			switch c {
+			case asciiBEL:
+				a.state = ansiGround
+			case asciiESC:
+				a.state = ansiStringEscape
+			}
+		case ansiStringEscape:
+			if c == '\\' {
+				a.state = ansiGround
+			} else {
+				// The string ended without its terminator, and this is
+				// another sequence.
+				a.state = ansiEscape
+				i--
+			}
+		}
+	}
+	if !carry {
+		a.state = ansiGround
+	}
+	return b.String()
+}
+
+// stripANSI removes the escape sequences from line, which is the rest of the
+// line so far if carry is true, if WithStripANSI was given.
+func (f *File) stripANSI(line string, carry bool) string {
+	if f.ansi == nil {
+		return line
+	}
+	return f.ansi.strip(line, carry)
+}
+
+// resetANSI forgets any escape sequence the line being read was in, when the
+// rest of the line is discarded.
+func (f *File) resetANSI() {
+	if f.ansi != nil {
+		f.ansi.state = ansiGround
+	}
+}
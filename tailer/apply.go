@@ -0,0 +1,237 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TailConfig is the set of patterns and paths for ApplyConfig to make a
+// Tailer tail, such as read from an agent's config file.
+type TailConfig struct {
+	Patterns []TailEntry // Tailed as by AddPatternWithPolicy
+	Paths    []TailEntry // Tailed as by TailPathWithPolicy
+}
+
+// TailEntry is a pattern or path of a TailConfig.
+type TailEntry struct {
+	Path    string       // The pattern or path
+	Policy  StartPolicy  // Where the files already there are read from when it's added
+	Options []PathOption // Its options, such as WithWatchMode and WithArchiveSkip
+}
+
+// ChangeSummary lists what ApplyConfig changed, by absolute pattern or path,
+// in the order they're given in the TailConfig, for logging.
+type ChangeSummary struct {
+	Added   []string // Newly tailed
+	Removed []string // No longer tailed, as they've been dropped from the config
+	Updated []string // Whose options were changed in place
+	Failed  []string // Not applied, for the reasons given by the *ErrApplyConfig returned
+}
+
+// Empty indicates if nothing was changed or failed.
+func (s ChangeSummary) Empty() bool {
+	return len(s.Added) == 0 && len(s.Removed) == 0 && len(s.Updated) == 0 && len(s.Failed) == 0
+}
+
+// ErrApplyConfig is returned by ApplyConfig if some of the patterns or paths
+// couldn't be applied.  The rest have been.
+type ErrApplyConfig struct {
+	Errors map[string]error // Why each failed, by the absolute pattern or path
+}
+
+func (e *ErrApplyConfig) Error() string {
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e.Errors[name]))
+	}
+	return fmt.Sprintf("failed to apply %d entries of the config: %s", len(names), strings.Join(msgs, "; "))
+}
+
+// appliedKey names a pattern or path applied by ApplyConfig.
+type appliedKey struct {
+	path    string // Absolute pattern or path
+	pattern bool
+}
+
+// wantedEntry is an entry of a TailConfig being applied.
+type wantedEntry struct {
+	key   appliedKey
+	entry TailEntry
+	opts  *pathOptions
+}
+
+// ApplyConfig makes the Tailer tail the patterns and paths of cfg, rather
+// than those of the config it was given last, without disturbing the files
+// tailed by both: new patterns and paths are added, those dropped are
+// removed, untailing the files that only they matched, as RemovePattern and
+// Untail do, and those whose options have changed are updated in place.
+// The policy of an entry is only used when it's added.  Of the options,
+// WithArchiveSkip can be changed, after which the files the pattern now
+// matches are tailed, though those it now skips stay tailed until they go;
+// WithArchiveBackfill only applies when a pattern is added; and the watch
+// mode can't be changed without removing the entry first.  Patterns and
+// paths given to the Tailer other than by ApplyConfig are left alone, but
+// taken over if cfg names them.
+//
+// Applying the same config again changes nothing.  An entry that can't be
+// applied, such as a pattern that isn't valid, doesn't stop the others
+// being applied; it's listed in the summary's Failed, and an
+// *ErrApplyConfig saying why each failed is returned.  One already applied
+// that fails to be updated keeps its options.
+func (t *Tailer) ApplyConfig(cfg TailConfig) (ChangeSummary, error) {
+	t.appliedMu.Lock()
+	defer t.appliedMu.Unlock()
+	var summary ChangeSummary
+	errs := make(map[string]error)
+	fail := func(name string, err error) {
+		if _, ok := errs[name]; !ok {
+			summary.Failed = append(summary.Failed, name)
+		}
+		errs[name] = err
+	}
+
+	wanted := make(map[appliedKey]bool)
+	var entries []wantedEntry
+	want := func(e TailEntry, pattern bool) {
+		absPath, err := filepath.Abs(e.Path)
+		if err != nil {
+			fail(e.Path, err)
+			return
+		}
+		key := appliedKey{absPath, pattern}
+		if wanted[key] {
+			fail(absPath, errors.Errorf("%q is given more than once", e.Path))
+			return
+		}
+		// An entry that fails is kept as it was, rather than removed.
+		wanted[key] = true
+		var o *pathOptions
+		if pattern {
+			o, err = newPatternOptions(e.Options)
+		} else {
+			o, err = newPathOptions(e.Options)
+		}
+		if err != nil {
+			fail(absPath, err)
+			return
+		}
+		entries = append(entries, wantedEntry{key, e, o})
+	}
+	for _, e := range cfg.Patterns {
+		want(e, true)
+	}
+	for _, e := range cfg.Paths {
+		want(e, false)
+	}
+
+	// New entries are added before the dropped ones are removed, so that a
+	// file matched by both stays tailed.
+	for _, w := range entries {
+		old, ok := t.applied[w.key]
+		if !ok {
+			if err := t.applyAdd(w); err != nil {
+				fail(w.key.path, err)
+				continue
+			}
+			t.applied[w.key] = w.opts
+			summary.Added = append(summary.Added, w.key.path)
+			continue
+		}
+		if old.mode == w.opts.mode && reflect.DeepEqual(old.skip, w.opts.skip) {
+			continue
+		}
+		if err := t.applyUpdate(w, old); err != nil {
+			fail(w.key.path, err)
+			continue
+		}
+		t.applied[w.key] = w.opts
+		summary.Updated = append(summary.Updated, w.key.path)
+	}
+	var dropped []appliedKey
+	for key := range t.applied {
+		if !wanted[key] {
+			dropped = append(dropped, key)
+		}
+	}
+	sort.Slice(dropped, func(i, j int) bool {
+		if dropped[i].pattern != dropped[j].pattern {
+			return dropped[i].pattern
+		}
+		return dropped[i].path < dropped[j].path
+	})
+	for _, key := range dropped {
+		var err error
+		if key.pattern {
+			err = t.RemovePattern(key.path)
+		} else {
+			err = t.Untail(key.path)
+		}
+		if err != nil {
+			fail(key.path, err)
+			continue
+		}
+		delete(t.applied, key)
+		summary.Removed = append(summary.Removed, key.path)
+	}
+
+	if !summary.Empty() {
+		t.logger.Infof("Applied config: %d added, %d removed, %d updated, %d failed", len(summary.Added), len(summary.Removed), len(summary.Updated), len(summary.Failed))
+	}
+	if len(errs) > 0 {
+		return summary, &ErrApplyConfig{Errors: errs}
+	}
+	return summary, nil
+}
+
+// applyAdd tails a pattern or path newly given to ApplyConfig.  A pattern
+// that fails is removed again.
+func (t *Tailer) applyAdd(w wantedEntry) error {
+	if !w.key.pattern {
+		err := t.TailPathWithPolicy(w.entry.Path, w.entry.Policy, w.entry.Options...)
+		if _, ok := err.(*ErrAlreadyTailed); ok {
+			// Given to TailPath before; it's taken over.
+			return nil
+		}
+		return err
+	}
+	if err := t.AddPatternWithPolicy(w.entry.Path, w.entry.Policy, w.entry.Options...); err != nil {
+		if rerr := t.RemovePattern(w.key.path); rerr != nil {
+			t.logger.Info(rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+// applyUpdate changes the options of a pattern or path already applied,
+// from old.
+func (t *Tailer) applyUpdate(w wantedEntry, old *pathOptions) error {
+	if old.mode != w.opts.mode {
+		return errors.Errorf("the watch mode of %q can't be changed while it's tailed", w.entry.Path)
+	}
+	// Only a pattern's archive skip can differ.
+	t.globPatternsMu.Lock()
+	delete(t.archiveSkips, w.key.path)
+	t.globPatternsMu.Unlock()
+	// Tail the files now matching, without reading their archives again.
+	o := *w.opts
+	o.archives = nil
+	matches, err := t.watchPattern(w.key.path, &o)
+	if err != nil {
+		return err
+	}
+	return t.tailMatches(w.key.path, matches, w.entry.Policy, &o)
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// defaultArchiveSuffixes match the names logrotate gives rotated files, such
+// as app.log.1, app.log.2.gz and app.log-20240601.gz.
+var defaultArchiveSuffixes = []string{".[0-9]*", "-[0-9]*"}
+
+// PatternOption is a PathOption, such as WithArchiveBackfill, that only
+// applies to the patterns given to TailPattern and AddPatternWithPolicy.
+type PatternOption = PathOption
+
+// archiveBackfill is the setting of WithArchiveBackfill.
+type archiveBackfill struct {
+	maxAge   time.Duration // Oldest archive read, by modification time, if > 0
+	maxFiles int           // Most archives read, the newest, if > 0
+	suffixes []string
+}
+
+// WithArchiveBackfill reads the archives of each file that already matches
+// the pattern, oldest first, before the file itself is tailed, so that its
+// recent history is sent too.  An archive is a file in the same directory
+// whose name is the file's followed by one of the suffixes given to
+// WithArchiveSuffixes, by default those of logrotate: "." or "-" and a
+// digit, then anything, such as app.log.1 and app.log-20240601.gz.  Archives
+// ending in .gz are decompressed.  Those modified more than maxAge ago, if
+// it's not 0, aren't read, nor more than the newest maxFiles, if it's not
+// 0.  The lines of the archives are sent under the file's name, each
+// archive a generation, and the file's own lines continue from the next.
+// Once the archives of a file have been read, an ArchivesRead FileEvent is
+// sent and the file is tailed from where the pattern's policy says, usually
+// Beginning.  Archives are read each time the pattern is given, as what's
+// read from them isn't recorded.
+func WithArchiveBackfill(maxAge time.Duration, maxFiles int) PatternOption {
+	return func(o *pathOptions) error {
+		if maxAge < 0 {
+			return errors.Errorf("invalid archive backfill age %s", maxAge)
+		}
+		if maxFiles < 0 {
+			return errors.Errorf("invalid archive backfill file count %d", maxFiles)
+		}
+		o.archives = &archiveBackfill{maxAge: maxAge, maxFiles: maxFiles}
+		return nil
+	}
+}
+
+// WithArchiveSuffixes finds the archives read by WithArchiveBackfill by the
+// glob patterns in suffixes instead of the defaults, matched against what
+// follows the file's name in the names of the files beside it, such as
+// ".[0-9]*.gz".
+func WithArchiveSuffixes(suffixes ...string) PatternOption {
+	return func(o *pathOptions) error {
+		if len(suffixes) == 0 {
+			return errors.New("no archive suffixes")
+		}
+		for _, s := range suffixes {
+			if _, err := filepath.Match(s, ""); err != nil || s == "" {
+				return errors.Errorf("invalid archive suffix %q", s)
+			}
+		}
+		o.suffixes = suffixes
+		return nil
+	}
+}
+
+// newPatternOptions applies opts, given for a pattern.
+func newPatternOptions(opts []PatternOption) (*pathOptions, error) {
+	o := &pathOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.archives != nil {
+		o.archives.suffixes = defaultArchiveSuffixes
+		if o.suffixes != nil {
+			o.archives.suffixes = o.suffixes
+		}
+	} else if o.suffixes != nil {
+		return nil, errors.New("archive suffixes given without WithArchiveBackfill")
+	}
+	return o, nil
+}
+
+// archivedFile is an archive of a file, found by archivesOf.
+type archivedFile struct {
+	pathname string
+	modTime  time.Time
+}
+
+// archivesOf returns the archives of pathname to read, oldest first.
+func (t *Tailer) archivesOf(pathname string, a *archiveBackfill) ([]archivedFile, error) {
+	dir, base := filepath.Split(pathname)
+	entries, err := ioutil.ReadDir(watcher.ExtendPath(dir))
+	if err != nil {
+		return nil, err
+	}
+	cutoff := t.clock.Now().Add(-a.maxAge)
+	var archives []archivedFile
+	for _, fi := range entries {
+		name := fi.Name()
+		if !fi.Mode().IsRegular() || len(name) <= len(base) || !strings.HasPrefix(name, base) {
+			continue
+		}
+		if a.maxAge > 0 && fi.ModTime().Before(cutoff) {
+			continue
+		}
+		for _, s := range a.suffixes {
+			if ok, _ := filepath.Match(s, name[len(base):]); ok {
+				archives = append(archives, archivedFile{filepath.Join(dir, name), fi.ModTime()})
+				break
+			}
+		}
+	}
+	// Newest first, with the higher numbered of those rotated at once older.
+	sort.Slice(archives, func(i, j int) bool {
+		if !archives[i].modTime.Equal(archives[j].modTime) {
+			return archives[i].modTime.After(archives[j].modTime)
+		}
+		return archives[i].pathname < archives[j].pathname
+	})
+	if a.maxFiles > 0 && len(archives) > a.maxFiles {
+		archives = archives[:a.maxFiles]
+	}
+	for i, j := 0, len(archives)-1; i < j; i, j = i+1, j-1 {
+		archives[i], archives[j] = archives[j], archives[i]
+	}
+	return archives, nil
+}
+
+// backfillArchives reads the archives of pathname, a match of a pattern
+// given WithArchiveBackfill, and sends the ArchivesRead event, before it's
+// tailed.  The file is tailed as the generation after the archives'.  An
+// archive that can't be read is logged and skipped.
+func (t *Tailer) backfillArchives(pathname string, a *archiveBackfill) error {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return err
+	}
+	if t.hasHandle(absPath) || t.isBackfilling(absPath) {
+		return nil
+	}
+	archives, err := t.archivesOf(absPath, a)
+	if err != nil {
+		return err
+	}
+	name := t.reportedName(pathname, absPath)
+	var lines int64
+	for gen, archive := range archives {
+		n, err := t.readArchive(archive.pathname, name, gen)
+		lines += n
+		if err != nil {
+			t.logger.With(map[string]interface{}{"path": archive.pathname}).Infof("Failed to read archive %s of %s: %s", archive.pathname, absPath, err)
+		}
+	}
+	if len(archives) > 0 {
+		t.deletedMu.Lock()
+		t.deleted[absPath] = deletedPath{len(archives), t.clock.Now()}
+		t.deletedMu.Unlock()
+	}
+	t.logger.With(map[string]interface{}{"path": absPath}).Infof("Read %d lines from %d archives of %s", lines, len(archives), absPath)
+	t.sendEvent(FileEvent{Type: ArchivesRead, Name: name, Pathname: absPath, Lines: lines, Archives: len(archives)})
+	return nil
+}
+
+// readArchive sends the lines of the archive at pathname under name, as
+// generation gen, and returns how many were sent.
+func (t *Tailer) readArchive(pathname, name string, gen int) (int64, error) {
+	if strings.HasSuffix(pathname, ".gz") {
+		tmp, err := decompressArchive(pathname)
+		if err != nil {
+			return 0, err
+		}
+		defer os.Remove(tmp)
+		pathname = tmp
+	}
+	f, err := newFile(pathname, t.lines, true, t.logger, t.clock, t.metrics)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	f.setName(name)
+	f.generation = gen
+	if t.ackWindow > 0 {
+		f.acks = newAckWindow(t.ackWindow, t.acksReleased)
+	}
+	f.seq = t.seq
+	f.consumer = t.consumer
+	f.mirror = t.mirror
+	f.redactors = t.redactors
+	f.transform = t.transform
+	f.jsonFields = t.jsonFields
+	if t.kubernetesLabels {
+		// Labelled as the file they're archives of.
+		f.kubernetesLabels, _ = KubernetesLabels(name)
+	}
+	f.maxLineLength = t.maxLineLength
+	f.crMode = t.crMode
+	if t.stripANSI {
+		f.ansi = &ansiStripper{}
+	}
+	f.nulSkip = t.nulSkip
+	// An archive is complete, so its last line is sent even without a
+	// newline.
+	err = f.drain(true)
+	return f.sent, err
+}
+
+// decompressArchive writes the contents of the gzipped archive at pathname
+// to a temporary file, and returns its path.
+func decompressArchive(pathname string) (string, error) {
+	in, err := openFile(pathname)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	z, err := gzip.NewReader(in)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to decompress %q", pathname)
+	}
+	defer z.Close()
+	out, err := ioutil.TempFile("", "tail-archive-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(out, z); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return "", errors.Wrapf(err, "Failed to decompress %q", pathname)
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(out.Name())
+		return "", err
+	}
+	return out.Name(), nil
+}
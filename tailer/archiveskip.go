@@ -0,0 +1,123 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// defaultArchiveSkip matches the names of compressed and rotated files,
+// which patterns don't tail unless told otherwise.
+var defaultArchiveSkip = []string{"*.gz", "*.zst", "*.bz2", "*.[0-9]"}
+
+// validArchiveSkip returns an error if any of globs isn't a valid pattern.
+func validArchiveSkip(globs []string) error {
+	for _, g := range globs {
+		if _, err := filepath.Match(g, ""); err != nil || g == "" {
+			return errors.Errorf("invalid archive skip pattern %q", g)
+		}
+	}
+	return nil
+}
+
+// WithDefaultArchiveSkip replaces the glob patterns of the files that
+// patterns don't tail because they look like archives, which by default are
+// *.gz, *.zst, *.bz2 and *.[0-9].  They're matched against the base names of
+// the files that match a pattern, both those found when it's given and
+// those created later.  With no globs, nothing is skipped.  Files given to
+// TailPath, or as a pattern that's just their name, are always tailed.
+func WithDefaultArchiveSkip(globs ...string) Option {
+	return func(t *Tailer) error {
+		if err := validArchiveSkip(globs); err != nil {
+			return err
+		}
+		t.archiveSkip = append([]string{}, globs...)
+		return nil
+	}
+}
+
+// WithArchiveSkip replaces the default glob patterns of the files the
+// pattern doesn't tail because they look like archives, set by
+// WithDefaultArchiveSkip.  With no globs, the pattern tails every match.
+func WithArchiveSkip(globs ...string) PatternOption {
+	return func(o *pathOptions) error {
+		if err := validArchiveSkip(globs); err != nil {
+			return err
+		}
+		o.skip = append([]string{}, globs...)
+		return nil
+	}
+}
+
+// archiveSkipLocked returns the globs of the archives absPattern skips.
+// t.globPatternsMu must be held when called.
+func (t *Tailer) archiveSkipLocked(absPattern string) []string {
+	if skip, ok := t.archiveSkips[absPattern]; ok {
+		return skip
+	}
+	if t.archiveSkip != nil {
+		return t.archiveSkip
+	}
+	return defaultArchiveSkip
+}
+
+// skipArchive indicates if pathname, a match of absPattern skipping the
+// archives matching globs, looks like an archive, and records it if so.  A
+// pattern naming just one file always tails it.
+func (t *Tailer) skipArchive(pathname, absPattern string, globs []string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	if absPath == absPattern {
+		t.forgetArchive(absPath)
+		return false
+	}
+	name := filepath.Base(absPath)
+	for _, g := range globs {
+		if ok, _ := filepath.Match(g, name); !ok {
+			continue
+		}
+		t.skippedMu.Lock()
+		_, found := t.skippedArchives[absPath]
+		t.skippedArchives[absPath] = struct{}{}
+		t.skippedMu.Unlock()
+		if !found {
+			t.logger.With(map[string]interface{}{"path": absPath}).Infof("Not tailing %s, which looks like an archive", absPath)
+			t.metrics.archivesSkipped.Add(1)
+		}
+		return true
+	}
+	return false
+}
+
+// forgetArchive forgets that pathname was skipped as an archive, as it's
+// gone.
+func (t *Tailer) forgetArchive(pathname string) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return
+	}
+	t.skippedMu.Lock()
+	delete(t.skippedArchives, absPath)
+	t.skippedMu.Unlock()
+}
+
+// skippedArchiveList returns the paths skipped as archives, sorted.
+func (t *Tailer) skippedArchiveList() []string {
+	t.skippedMu.Lock()
+	defer t.skippedMu.Unlock()
+	if len(t.skippedArchives) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(t.skippedArchives))
+	for p := range t.skippedArchives {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
@@ -0,0 +1,260 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// backfillQueue holds the files given to TailPath that are waiting to be
+// opened and read up to their current end by one of a fixed number of
+// workers.
+type backfillQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	paths   []backfillItem         // absolute paths waiting for a worker
+	pending map[string]struct{}    // canonical paths queued or not yet handed over to run
+	retail  map[string]StartPolicy // canonical paths being read by workers to be read again from a new policy
+	active  int                    // number of paths being read by workers
+	closed  bool
+	wg      sync.WaitGroup
+}
+
+// backfillItem is a path waiting to be backfilled, and where to start.
+type backfillItem struct {
+	pathname string
+	key      string // canonical path
+	policy   StartPolicy
+}
+
+// startBackfill starts the backfill workers.
+func (t *Tailer) startBackfill() {
+	q := &backfillQueue{pending: make(map[string]struct{}), retail: make(map[string]StartPolicy)}
+	q.cond = sync.NewCond(&q.mu)
+	t.queue = q
+	t.backfilled = make(chan *File)
+	t.backfillQuit = make(chan struct{})
+	for i := 0; i < t.backfillConcurrency; i++ {
+		q.wg.Add(1)
+		go t.backfillWorker()
+	}
+}
+
+// stopBackfill stops the backfill workers and waits for them to exit.  In
+// OneShot mode the files still queued are read first, otherwise they're
+// abandoned.
+func (t *Tailer) stopBackfill() {
+	q := t.queue
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	q.closed = true
+	if !t.oneShot {
+		q.paths = nil
+	}
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	close(t.backfillQuit)
+	q.wg.Wait()
+}
+
+// enqueueBackfill queues pathname to be opened by a backfill worker,
+// starting where policy says.
+func (t *Tailer) enqueueBackfill(pathname string, policy StartPolicy) error {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return err
+	}
+	key, err := t.pathKey(absPath)
+	if err != nil {
+		return err
+	}
+	// Watch the directory now, so the file is found if it doesn't exist yet.
+	if err := t.watchDirname(absPath); err != nil {
+		return err
+	}
+	q := t.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[key]; ok {
+		return nil
+	}
+	q.pending[key] = struct{}{}
+	q.paths = append(q.paths, backfillItem{absPath, key, policy})
+	q.cond.Signal()
+	t.mergePending(absPath)
+	return nil
+}
+
+// isBackfilling indicates if pathname is queued for or being read by a
+// backfill worker.
+func (t *Tailer) isBackfilling(pathname string) bool {
+	q := t.queue
+	if q == nil {
+		return false
+	}
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, ok := q.pending[key]
+	return ok
+}
+
+// next blocks until there's a path to backfill, and returns it.  It returns
+// false once the queue is closed and empty.
+func (q *backfillQueue) next() (backfillItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.paths) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.paths) == 0 {
+		return backfillItem{}, false
+	}
+	item := q.paths[0]
+	q.paths = q.paths[1:]
+	q.active++
+	return item, true
+}
+
+// done records that a worker has finished reading the file with canonical
+// path key.  If handedOver
+// is false the file wasn't opened, and the path is no longer pending.
+func (q *backfillQueue) done(key string, handedOver bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.active--
+	if !handedOver {
+		delete(q.pending, key)
+		delete(q.retail, key)
+	}
+}
+
+// remove records that run has taken over the file with canonical path key,
+// and returns the policy to read it again from if it was given to TailPath
+// again while it was being read.
+func (q *backfillQueue) remove(key string) (StartPolicy, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pending, key)
+	policy, ok := q.retail[key]
+	delete(q.retail, key)
+	return policy, ok
+}
+
+// replace makes the file with canonical path key be read from where policy
+// says, if it's pending.  A file still queued starts there when a worker
+// takes it; one a worker has already started on is opened again once it's
+// handed over.  It returns false if the file isn't pending.
+func (q *backfillQueue) replace(key string, policy StartPolicy) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[key]; !ok {
+		return false
+	}
+	for i := range q.paths {
+		if q.paths[i].key == key {
+			q.paths[i].policy = policy
+			return true
+		}
+	}
+	q.retail[key] = policy
+	return true
+}
+
+// backfillWorker opens and reads queued files until the queue is closed.
+// Each File is then handed over to run, which tails it from then on.
+func (t *Tailer) backfillWorker() {
+	defer t.queue.wg.Done()
+	for {
+		item, ok := t.queue.next()
+		if !ok {
+			return
+		}
+		f := t.backfillPath(item.pathname, item.policy)
+		t.queue.done(item.key, f != nil)
+		if f == nil {
+			t.merge.reading(t.reportedName(item.pathname, item.pathname), false)
+			continue
+		}
+		select {
+		case t.backfilled <- f:
+		case <-t.backfillQuit:
+			if err := f.Close(); err != nil {
+				t.logger.Info(err)
+			}
+		}
+	}
+}
+
+// backfillPath opens pathname, starting where policy says, and reads it up
+// to its current end.  It returns nil if the file couldn't be opened.
+func (t *Tailer) backfillPath(pathname string, policy StartPolicy) *File {
+	t.logger.With(map[string]interface{}{"path": pathname}).Debugf("Backfilling %s", pathname)
+	f, err := t.newFile(pathname, policy)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// The directory is watched, so it'll be picked up on create.
+			t.logger.Infof("pathname %q doesn't exist (yet?)", pathname)
+		} else if err != errLinked && err != errBinary && err != errTooLarge {
+			t.logger.Infof("Failed to backfill %q: %s", pathname, err)
+		}
+		return nil
+	}
+	if err := t.addWatch(f.Pathname); err != nil {
+		t.logger.Infof("Failed to watch %q: %s", f.Pathname, err)
+		if err := f.Close(); err != nil {
+			t.logger.Info(err)
+		}
+		return nil
+	}
+	if err := t.catchUp(f); err != nil {
+		t.logger.Infof("Failed to backfill %q: %s", f.Pathname, err)
+	}
+	return f
+}
+
+// finishBackfill starts tailing a File that a backfill worker has read up to
+// its end.  Anything written since is read now, as events for the file were
+// ignored while it was pending.
+func (t *Tailer) finishBackfill(f *File) {
+	if err := t.setHandle(f.Pathname, f); err != nil {
+		t.logger.Info(err)
+		return
+	}
+	if policy, ok := t.queue.remove(f.handleKey); ok {
+		// It was given to TailPath again while it was being read.
+		t.handles.Delete(f.handleKey)
+		if err := f.Close(); err != nil {
+			t.logger.Info(err)
+		}
+		if err := t.tailPath(f.Pathname, policy); err != nil {
+			t.logger.Infof("Failed to tail %q again: %s", f.Pathname, err)
+		}
+		return
+	}
+	// Another worker may have opened a link to the same file.
+	if err := t.checkLink(f); err != nil {
+		t.handles.Delete(f.handleKey)
+		if err := f.Close(); err != nil {
+			t.logger.Info(err)
+		}
+		return
+	}
+	t.follow(f)
+	t.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("Tailing %s", f.Pathname)
+	t.metrics.logCount.Add(1)
+	// Its delete event was ignored while it was pending.
+	if _, err := watcher.StatExtended(f.Pathname); os.IsNotExist(err) {
+		t.removeDeleted(f)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"io"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// binarySample is the number of bytes at the start of a file given to the
+// BinaryHeuristic.
+const binarySample = 4096
+
+// DefaultBinaryRatio is the ratio of control characters above which the
+// heuristic used by WithBinaryDetection with a nil heuristic decides a file
+// is binary.
+const DefaultBinaryRatio = 0.3
+
+// errBinary is returned when opening a path that looks like a binary file.
+var errBinary = errors.New("looks like a binary file")
+
+// BinaryHeuristic decides if sample, the first bytes of a file, is binary
+// data rather than text.
+type BinaryHeuristic func(sample []byte) bool
+
+// ControlRatio returns a BinaryHeuristic that decides a sample is binary if
+// more than ratio of its bytes are NUL or other control characters.  Tabs,
+// line endings, form feeds and escapes, which start terminal colour codes,
+// are counted as text.
+func ControlRatio(ratio float64) BinaryHeuristic {
+	return func(sample []byte) bool {
+		if len(sample) == 0 {
+			return false
+		}
+		control := 0
+		for _, b := range sample {
+			switch {
+			case b == '\t', b == '\n', b == '\v', b == '\f', b == '\r', b == 0x1b:
+			case b < 0x20, b == 0x7f:
+				control++
+			}
+		}
+		return float64(control)/float64(len(sample)) > ratio
+	}
+}
+
+// checkBinary returns errBinary if f looks like a binary file to the
+// Tailer's heuristic, recording the path to be checked again when it
+// changes, for example by being truncated and rewritten with text.
+func (t *Tailer) checkBinary(f *File) error {
+	if t.binary == nil || !f.regular || t.binaryAllowed[f.Pathname] {
+		return nil
+	}
+	sample := make([]byte, binarySample)
+	n, err := f.file.ReadAt(sample, 0)
+	if err != nil && err != io.EOF {
+		t.logger.Debugf("Failed to sample %q: %s", f.Pathname, err)
+		return nil
+	}
+	t.skippedMu.Lock()
+	_, wasSkipped := t.skipped[f.Pathname]
+	if !t.binary(sample[:n]) {
+		delete(t.skipped, f.Pathname)
+		t.skippedMu.Unlock()
+		if wasSkipped {
+			t.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("%s no longer looks like a binary file", f.Pathname)
+		}
+		return nil
+	}
+	t.skipped[f.Pathname] = struct{}{}
+	t.skippedMu.Unlock()
+	if wasSkipped {
+		t.logger.Debugf("%s still looks like a binary file", f.Pathname)
+	} else {
+		t.logger.With(map[string]interface{}{"path": f.Pathname}).Warningf("Not tailing %s, which looks like a binary file", f.Pathname)
+		t.metrics.binarySkipped.Add(f.safePath, 1)
+	}
+	// Watch it so that it's checked again when it changes.
+	if err := t.addWatch(f.Pathname); err != nil {
+		t.logger.Debug(err)
+	}
+	return errBinary
+}
+
+// wasSkipped indicates if pathname was skipped as a binary file, and is
+// still tailed for a pattern or TailPath.
+func (t *Tailer) wasSkipped(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.skippedMu.Lock()
+	_, ok := t.skipped[absPath]
+	t.skippedMu.Unlock()
+	return ok && t.isRegistered(absPath)
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CircuitState is the position of a file's circuit breaker, set by
+// WithCircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed is the normal state, in which the file is read on every
+	// event.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen is the state after too many failures in a row, in which
+	// events for the file are skipped until its cool-off has passed.
+	CircuitOpen
+	// CircuitHalfOpen is the state once the cool-off has passed, in which
+	// the file is tried once more: success closes the breaker, and failure
+	// opens it again for twice as long.
+	CircuitHalfOpen
+)
+
+var circuitStateNames = []string{"closed", "open", "half-open"}
+
+func (s CircuitState) String() string {
+	if s < 0 || int(s) >= len(circuitStateNames) {
+		return fmt.Sprintf("CircuitState(%d)", int(s))
+	}
+	return circuitStateNames[s]
+}
+
+// BreakerState is a snapshot of a file's circuit breaker.
+type BreakerState struct {
+	State    CircuitState
+	Op       string        // Operation that failed last, "read" or "reopen"
+	Failures int           // Failures of Op in a row
+	Trips    int           // Times the breaker has opened since it was last closed
+	CoolOff  time.Duration // How long the breaker stays open this time, if it's open
+	Retry    time.Time     // When the file will be tried again, if the breaker is open
+	Skipped  int64         // Reads skipped while the breaker was open, since it was created
+	Err      error         // The last failure
+}
+
+// breakerConfig is the configuration of the breakers of a Tailer's files.
+type breakerConfig struct {
+	failures   int           // Failures in a row of one operation that open a breaker
+	coolOff    time.Duration // How long a breaker first stays open
+	maxCoolOff time.Duration // Longest a breaker stays open
+}
+
+// breaker stops a File being read over and over when every attempt fails,
+// as on a flaky mount.  It's used by run, and read by Stats.
+type breaker struct {
+	config breakerConfig
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures map[string]int // Failures in a row, by operation
+	op       string         // Operation that failed last
+	trips    int
+	coolOff  time.Duration
+	retry    time.Time
+	skipped  int64
+	err      error
+}
+
+func newBreaker(c breakerConfig) *breaker {
+	return &breaker{config: c, failures: make(map[string]int)}
+}
+
+// allow indicates if the file may be tried at now, moving an open breaker
+// whose cool-off has passed to half-open, which is returned as changed.
+func (b *breaker) allow(now time.Time) (ok, changed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != CircuitOpen {
+		return true, false
+	}
+	if now.Before(b.retry) {
+		b.skipped++
+		return false, false
+	}
+	b.state = CircuitHalfOpen
+	return true, true
+}
+
+// fail records a failure of op with err at now, and returns true if it
+// opened the breaker.
+func (b *breaker) fail(op string, err error, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[op]++
+	b.op, b.err = op, err
+	switch b.state {
+	case CircuitClosed:
+		if b.failures[op] < b.config.failures {
+			return false
+		}
+		b.coolOff = b.config.coolOff
+	case CircuitHalfOpen:
+		b.coolOff *= 2
+		if b.coolOff > b.config.maxCoolOff {
+			b.coolOff = b.config.maxCoolOff
+		}
+	default:
+		// Already open, as when reopening fails after the read that opened
+		// it.
+		return false
+	}
+	b.state = CircuitOpen
+	b.trips++
+	b.retry = now.Add(b.coolOff)
+	return true
+}
+
+// succeed records a success of op, and returns true if it closed the
+// breaker.
+func (b *breaker) succeed(op string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.failures, op)
+	if b.state != CircuitHalfOpen {
+		// An open breaker is closed only by the retry after its cool-off.
+		return false
+	}
+	b.state = CircuitClosed
+	b.failures = make(map[string]int)
+	b.trips, b.coolOff, b.retry = 0, 0, time.Time{}
+	return true
+}
+
+// snapshot returns the breaker's state, and whether it's worth reporting:
+// it's not closed, or has failures counted toward opening it.
+func (b *breaker) snapshot() (BreakerState, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := BreakerState{State: b.state, Op: b.op, Failures: b.failures[b.op], Trips: b.trips, CoolOff: b.coolOff, Retry: b.retry, Skipped: b.skipped, Err: b.err}
+	return s, b.state != CircuitClosed || len(b.failures) > 0
+}
+
+// breakerAllows indicates if fd may be read now, rather than skipped while
+// its breaker is open.
+func (t *Tailer) breakerAllows(fd *File) bool {
+	if fd.breaker == nil {
+		return true
+	}
+	ok, changed := fd.breaker.allow(t.clock.Now())
+	if !ok {
+		t.metrics.breakerSkipped.Add(fd.safePath, 1)
+		return false
+	}
+	if changed {
+		t.logger.Infof("Trying %s again after its cool-off", fd.Pathname)
+		t.sendEvent(FileEvent{Type: BreakerHalfOpen, Name: fd.name(), Pathname: fd.Pathname})
+	}
+	return true
+}
+
+// breakerFailed records that op failed on fd with err, opening its breaker
+// if that's one failure too many.
+func (t *Tailer) breakerFailed(fd *File, op string, err error) {
+	if fd.breaker == nil || !fd.breaker.fail(op, err, t.clock.Now()) {
+		return
+	}
+	s, _ := fd.breaker.snapshot()
+	t.metrics.breakerTrips.Add(fd.safePath, 1)
+	t.logger.Infof("Not reading %s for %s, after %d failures to %s: %s", fd.Pathname, s.CoolOff, s.Failures, op, err)
+	t.sendEvent(FileEvent{Type: BreakerOpen, Name: fd.name(), Pathname: fd.Pathname, Err: err, Retry: s.Retry})
+}
+
+// breakerSucceeded records that op succeeded on fd, closing its breaker if
+// it was open.
+func (t *Tailer) breakerSucceeded(fd *File, op string) {
+	if fd.breaker == nil || !fd.breaker.succeed(op) {
+		return
+	}
+	t.logger.Infof("Reading %s again", fd.Pathname)
+	t.sendEvent(FileEvent{Type: BreakerClosed, Name: fd.name(), Pathname: fd.Pathname})
+}
+
+// breakerRetry schedules fd to be tried again once its cool-off has passed,
+// if its breaker is open, in place of any earlier retry.
+func (t *Tailer) breakerRetry(fd *File) {
+	if fd.breaker == nil {
+		return
+	}
+	if s, _ := fd.breaker.snapshot(); s.State == CircuitOpen {
+		t.throttle(fd, s.Retry)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "sync"
+
+// partialBudget limits the total size of the partial lines held by a set of
+// Files.  When the limit is exceeded the largest partial lines are flushed.
+// Each File's partial buffer is guarded by its own partialMu, so that
+// flushing one, which sends the line on, doesn't hold up the others.
+type partialBudget struct {
+	mu       sync.Mutex // protects the fields below
+	limit    int64
+	used     int64
+	files    map[*File]int64 // Size of the partial buffer of each File
+	flushing map[*File]int64 // Files being flushed by enforce, by the size they had when picked
+	pending  int64           // Total size of the Files being flushed
+}
+
+func newPartialBudget(limit int64) *partialBudget {
+	return &partialBudget{limit: limit, files: make(map[*File]int64), flushing: make(map[*File]int64)}
+}
+
+func (b *partialBudget) add(f *File) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files[f] = 0
+}
+
+func (b *partialBudget) remove(f *File) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if n, ok := b.files[f]; ok {
+		b.used -= n
+		delete(b.files, f)
+	}
+}
+
+// charge accounts for n bytes added to the partial buffer of f, or removed
+// from it if n is negative.  f.partialMu must be held.
+func (b *partialBudget) charge(f *File, n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[f]; ok {
+		b.files[f] += n
+		b.used += n
+	}
+}
+
+// pick returns the File with the largest partial line not already being
+// flushed, and marks it as being flushed, if the budget is exceeded once the
+// Files being flushed are.  It returns nil if there's no need to flush
+// another.
+func (b *partialBudget) pick() *File {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used-b.pending <= b.limit {
+		return nil
+	}
+	var largest *File
+	for f, n := range b.files {
+		if _, ok := b.flushing[f]; ok {
+			continue
+		}
+		if largest == nil || n > b.files[largest] {
+			largest = f
+		}
+	}
+	if largest == nil || b.files[largest] == 0 {
+		return nil
+	}
+	b.flushing[largest] = b.files[largest]
+	b.pending += b.files[largest]
+	return largest
+}
+
+// flushed marks f as no longer being flushed.
+func (b *partialBudget) flushed(f *File) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending -= b.flushing[f]
+	delete(b.flushing, f)
+}
+
+// enforce flushes the largest partial lines until the budget is met.  No
+// File's partialMu may be held, as each is flushed under its own; a File
+// another call is flushing, which may be held up sending its line, is left
+// to that call.
+func (b *partialBudget) enforce() {
+	for {
+		f := b.pick()
+		if f == nil {
+			return
+		}
+		f.flushBudgeted()
+	}
+}
+
+// flushBudgeted sends the partial line of f to bring its budget back under
+// the limit.
+func (f *File) flushBudgeted() {
+	defer f.budget.flushed(f)
+	f.lockPartial()
+	defer f.unlockPartial()
+	if f.partial.Len() > 0 {
+		f.flushPartial()
+	}
+}
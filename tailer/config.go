@@ -0,0 +1,82 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// Config holds the settings of a Tailer created by NewFromConfig.  The zero
+// value of each field other than Watcher leaves that setting at its default.
+// Settings without a field are given as Options, which are applied after the
+// fields.
+type Config struct {
+	Lines   chan<- *logline.LogLine // Logfile lines are emitted here; if nil, they're read with Tailer.Lines
+	Watcher watcher.Watcher         // Notifies the Tailer of changes to files; required
+
+	FanOut bool // Return every line from each LineIterator, rather than each line from one; needs Lines to be nil
+
+	OneShot bool // Read files to their end once, as the OneShot option
+
+	MaxLineLength       int   // Truncate lines longer than this, as WithMaxLineLength, if > 0
+	MaxBytesPerRead     int64 // Bytes read from a file per event, as WithMaxBytesPerRead, if > 0
+	PartialBufferBudget int64 // Bytes of partial lines held across all files, as WithPartialBufferBudget, if > 0
+
+	ExpiryInterval time.Duration // Run Gc this often, as WithExpiryInterval, if > 0
+
+	Options []Option
+}
+
+// Validate returns an error naming the first field of c that's missing, out
+// of range or inconsistent with another.  It doesn't use the Watcher or
+// apply the Options, so it can be called before either is ready.
+func (c Config) Validate() error {
+	switch {
+	case c.Watcher == nil:
+		return errors.New("tailer.Config.Watcher: watcher is required")
+	case c.FanOut && c.Lines != nil:
+		return errors.New("tailer.Config.FanOut: can't fan out lines sent to the Lines channel")
+	case c.MaxLineLength < 0:
+		return errors.Errorf("tailer.Config.MaxLineLength: can't be negative, got %d", c.MaxLineLength)
+	case c.MaxBytesPerRead < 0:
+		return errors.Errorf("tailer.Config.MaxBytesPerRead: can't be negative, got %d", c.MaxBytesPerRead)
+	case c.PartialBufferBudget < 0:
+		return errors.Errorf("tailer.Config.PartialBufferBudget: can't be negative, got %d", c.PartialBufferBudget)
+	case c.ExpiryInterval < 0:
+		return errors.Errorf("tailer.Config.ExpiryInterval: can't be negative, got %s", c.ExpiryInterval)
+	}
+	for i, o := range c.Options {
+		if o == nil {
+			return errors.Errorf("tailer.Config.Options[%d]: option is nil", i)
+		}
+	}
+	return nil
+}
+
+// options returns the Options that set the fields of c, followed by
+// c.Options.
+func (c Config) options() []Option {
+	var options []Option
+	if c.OneShot {
+		options = append(options, OneShot)
+	}
+	if c.MaxLineLength > 0 {
+		options = append(options, WithMaxLineLength(c.MaxLineLength))
+	}
+	if c.MaxBytesPerRead > 0 {
+		options = append(options, WithMaxBytesPerRead(c.MaxBytesPerRead))
+	}
+	if c.PartialBufferBudget > 0 {
+		options = append(options, WithPartialBufferBudget(c.PartialBufferBudget))
+	}
+	if c.ExpiryInterval > 0 {
+		options = append(options, WithExpiryInterval(c.ExpiryInterval))
+	}
+	return append(options, c.Options...)
+}
@@ -0,0 +1,167 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/clock"
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// ErrLinesClosed is returned by reads once the lines channel has been closed
+// by its consumer.  No more lines can be sent, so files are no longer read,
+// and Healthy returns the error.
+var ErrLinesClosed = errors.New("lines channel closed by its consumer")
+
+// ErrConsumerStalled is the Err of a ConsumerStalled FileEvent, and is
+// returned by Healthy while the consumer of the lines channel is stalled.
+type ErrConsumerStalled struct {
+	Waiting time.Duration // How long no send had completed for
+}
+
+func (e *ErrConsumerStalled) Error() string {
+	return "no line has been taken from the lines channel for " + e.Waiting.String()
+}
+
+// ConsumerState is how the consumer of the lines channel is keeping up.
+type ConsumerState struct {
+	Pending int           // Sends waiting for the consumer
+	Waiting time.Duration // How long since a send last completed, or the pending sends began, if any are pending
+	Stalled bool          // Waiting is longer than WithStallThreshold
+	Closed  bool          // The consumer has closed the channel
+}
+
+// WithStallThreshold flags the consumer of the lines channel as stalled when
+// a line has been waiting to be sent and no send has completed for longer
+// than d.  A ConsumerStalled FileEvent is sent, Health and Stats report it,
+// and Healthy returns an *ErrConsumerStalled, until a send completes, when a
+// ConsumerResumed FileEvent is sent.  Without it, a consumer that stops
+// receiving holds up every read without a trace.
+func WithStallThreshold(d time.Duration) Option {
+	return func(t *Tailer) error {
+		if d <= 0 {
+			return errors.Errorf("invalid stall threshold %s", d)
+		}
+		t.stallThreshold = d
+		return nil
+	}
+}
+
+// consumer tracks the sends on a Tailer's lines channel.
+type consumer struct {
+	pending      int64 // Sends in progress; accessed atomically
+	pendingBytes int64 // Size of the lines being sent; accessed atomically
+	since        int64 // When a send last completed, or the pending sends began if later, in Unix nanoseconds; accessed atomically
+	closed       int32 // The channel has been found closed; accessed atomically
+	stalled      int32 // The watchdog has reported a stall; accessed atomically
+	drain        int32 // Drain has been called, so nothing new is read; accessed atomically
+
+	threshold time.Duration // Pending sends are stalled after this long, if > 0
+	clock     clock.Clock
+}
+
+func newConsumer(threshold time.Duration, clk clock.Clock) *consumer {
+	return &consumer{since: clk.Now().UnixNano(), threshold: threshold, clock: clk}
+}
+
+// send sends l on lines, or returns ErrLinesClosed if the channel has been
+// closed.  It's safe to call on a nil consumer, which just sends.
+func (c *consumer) send(lines chan<- *logline.LogLine, l *logline.LogLine) (err error) {
+	if c == nil {
+		lines <- l
+		return nil
+	}
+	if atomic.LoadInt32(&c.closed) != 0 {
+		return ErrLinesClosed
+	}
+	if atomic.AddInt64(&c.pending, 1) == 1 {
+		atomic.StoreInt64(&c.since, c.clock.Now().UnixNano())
+	}
+	atomic.AddInt64(&c.pendingBytes, int64(len(l.Line)))
+	defer func() {
+		atomic.AddInt64(&c.pending, -1)
+		atomic.AddInt64(&c.pendingBytes, -int64(len(l.Line)))
+		if r := recover(); r != nil {
+			if e, ok := r.(runtime.Error); !ok || e.Error() != "send on closed channel" {
+				panic(r)
+			}
+			atomic.StoreInt32(&c.closed, 1)
+			err = ErrLinesClosed
+			return
+		}
+		atomic.StoreInt64(&c.since, c.clock.Now().UnixNano())
+	}()
+	lines <- l
+	return nil
+}
+
+// err returns ErrLinesClosed if the channel has been found closed.  It's
+// safe to call on a nil consumer.
+func (c *consumer) err() error {
+	if c != nil && atomic.LoadInt32(&c.closed) != 0 {
+		return ErrLinesClosed
+	}
+	return nil
+}
+
+// draining indicates if Drain has been called, so that the reads in progress
+// stop and no more are started.  It's safe to call on a nil consumer.
+func (c *consumer) draining() bool {
+	return c != nil && atomic.LoadInt32(&c.drain) != 0
+}
+
+// closeLines closes lines, unless its consumer already has.
+func closeLines(lines chan<- *logline.LogLine) {
+	defer func() {
+		if r := recover(); r != nil {
+			if e, ok := r.(runtime.Error); !ok || e.Error() != "close of closed channel" {
+				panic(r)
+			}
+		}
+	}()
+	close(lines)
+}
+
+// state returns how the consumer is keeping up at now.
+func (c *consumer) state(now time.Time) ConsumerState {
+	s := ConsumerState{
+		Pending: int(atomic.LoadInt64(&c.pending)),
+		Closed:  atomic.LoadInt32(&c.closed) != 0,
+	}
+	if s.Pending > 0 {
+		s.Waiting = now.Sub(time.Unix(0, atomic.LoadInt64(&c.since)))
+		s.Stalled = c.threshold > 0 && s.Waiting > c.threshold
+	}
+	return s
+}
+
+// runStallWatchdog checks whether the consumer has stalled or resumed every
+// quarter of the stall threshold, until the Tailer is closed.
+func (t *Tailer) runStallWatchdog() {
+	c := t.consumer
+	ticker := t.sched.NewTicker(c.threshold / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-t.runDone:
+			return
+		}
+		s := c.state(t.clock.Now())
+		switch {
+		case s.Stalled && atomic.CompareAndSwapInt32(&c.stalled, 0, 1):
+			t.metrics.consumerStalls.Add(1)
+			t.logger.Warningf("Lines channel consumer stalled: %d lines waiting, none taken for %s", s.Pending, s.Waiting)
+			t.sendEvent(FileEvent{Type: ConsumerStalled, Err: &ErrConsumerStalled{Waiting: s.Waiting}})
+		case !s.Stalled && atomic.CompareAndSwapInt32(&c.stalled, 1, 0):
+			t.logger.Info("Lines channel consumer resumed")
+			t.sendEvent(FileEvent{Type: ConsumerResumed})
+		}
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// CarriageReturnMode says what a carriage return that isn't followed by a
+// newline does to the line being read, as written by tools that redraw a
+// progress bar with `\rprogress 42%`.
+type CarriageReturnMode int
+
+const (
+	// KeepCarriageReturns leaves carriage returns in the line, so every
+	// frame of a progress bar is sent as part of one line.
+	KeepCarriageReturns CarriageReturnMode = iota
+	// ReplaceOnCarriageReturn discards the line read so far at a carriage
+	// return, so only the last frame before the newline is sent.
+	ReplaceOnCarriageReturn
+	// SplitOnCarriageReturn ends a line at a carriage return, so each frame
+	// is sent as its own line.
+	SplitOnCarriageReturn
+)
+
+func (m CarriageReturnMode) String() string {
+	switch m {
+	case KeepCarriageReturns:
+		return "keep"
+	case ReplaceOnCarriageReturn:
+		return "replace"
+	case SplitOnCarriageReturn:
+		return "split"
+	}
+	return fmt.Sprintf("CarriageReturnMode(%d)", int(m))
+}
+
+// lineEnd returns the index in b of the byte ending the next line, and
+// whether it's a bare carriage return rather than a newline, or -1 if the
+// line doesn't end in b.  A carriage return that is the last byte of b may
+// be followed by a newline in the next read, so doesn't end the line yet and
+// sets f.pendingCR.
+func (f *File) lineEnd(b []byte) (int, bool) {
+	if f.crMode == KeepCarriageReturns {
+		return bytes.IndexByte(b, '\n'), false
+	}
+	for i := 0; ; i++ {
+		j := bytes.IndexAny(b[i:], "\r\n")
+		if j < 0 {
+			return -1, false
+		}
+		i += j
+		if b[i] == '\n' {
+			return i, false
+		}
+		if i+1 == len(b) {
+			f.pendingCR = true
+			return -1, false
+		}
+		if b[i+1] != '\n' {
+			return i, true
+		}
+		// A CRLF ends the line at its newline.
+	}
+}
+
+// endPendingCR ends the partial line at the carriage return that ended the
+// last read, now that the next byte is known not to be a newline.
+func (f *File) endPendingCR() {
+	f.pendingCR = false
+	if f.discarding {
+		// The frame was cut short, which is all that's sent of it.
+		f.discarding = false
+		f.lineStart = f.offset
+		return
+	}
+	f.truncatePartial(f.partial.Len() - 1)
+	if f.crMode == SplitOnCarriageReturn && f.partial.Len() > 0 {
+		f.sendLineTo(f.offset)
+	} else {
+		f.resetPartial()
+	}
+	f.lineStart = f.offset
+}
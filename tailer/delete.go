@@ -0,0 +1,124 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"time"
+
+	log "github.com/sgtsquiggs/tail/logger"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// deletedPath records a tailed path that has been removed, so that if it's
+// created again the new file's lines are marked as a new generation.
+type deletedPath struct {
+	generation int       // Generation of the next file at the path
+	at         time.Time // When the path was removed
+}
+
+// handleDelete handles the removal of pathname.  If the path has already been
+// replaced by a new file, this is a rotation, which Follow handles.
+// Otherwise the open File is read up to its end and then closed, and the
+// handle removed.
+func (t *Tailer) handleDelete(pathname string) {
+	if t.logger.Enabled(log.DebugLevel) {
+		t.logger.With(map[string]interface{}{"path": pathname}).Debugf("handleDelete %s", pathname)
+	}
+	fd, ok := t.handleForPath(pathname)
+	if !ok {
+		t.forgetArchive(pathname)
+		if t.buried(pathname) {
+			return
+		}
+		// A pending backfill is checked for deletion when it's handed over.
+		t.logger.Debugf("No file handle found for deleted %q", pathname)
+		t.removeLiveDir(pathname)
+		t.forgetSpooled(pathname)
+		return
+	}
+	if _, err := watcher.StatExtended(fd.Pathname); err == nil {
+		t.follow(fd)
+		return
+	}
+	t.removeDeleted(fd)
+	// If the path was created again while the old file was being read, the
+	// create event may already have been handled when there was a handle.
+	if _, err := watcher.StatExtended(fd.Pathname); err == nil {
+		t.handleLogEvent(fd.Pathname)
+	}
+}
+
+// removeDeleted reads fd, whose path has been removed, to its end, then
+// removes its handle and closes it.
+func (t *Tailer) removeDeleted(fd *File) {
+	fd.refreshOpenPath()
+	if err := fd.drain(t.flushOnDelete); err != nil {
+		t.logger.Info(err)
+	}
+	t.deletedMu.Lock()
+	t.deleted[fd.Pathname] = deletedPath{fd.generation + 1, t.clock.Now()}
+	t.deletedMu.Unlock()
+	t.closeHandle(fd)
+	t.logger.With(map[string]interface{}{"path": fd.Pathname}).Infof("Stopped tailing deleted %s", fd.Pathname)
+	fd.sendEvent(Deleted)
+}
+
+// closeHandle stops tailing fd, removing its handle and watch.  If it's
+// waiting to be read again, it's skipped as it no longer has a handle.
+func (t *Tailer) closeHandle(fd *File) {
+	if cur, ok := t.handles.Load(fd.handleKey); ok && cur.(*File) == fd {
+		t.handles.Delete(fd.handleKey)
+	}
+	t.aliases.Range(func(k, v interface{}) bool {
+		if v.(string) == fd.handleKey {
+			t.aliases.Delete(k)
+		}
+		return true
+	})
+	if err := t.w.Remove(fd.Pathname); err != nil {
+		t.logger.Debug(err)
+	}
+	if err := fd.Close(); err != nil {
+		t.logger.Info(err)
+	}
+	t.metrics.logCount.Add(-1)
+	t.retryLinks(fd.handleKey)
+}
+
+// wasDeleted indicates if pathname is a tailed path that has been removed.
+func (t *Tailer) wasDeleted(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.deletedMu.Lock()
+	defer t.deletedMu.Unlock()
+	_, ok := t.deleted[absPath]
+	return ok
+}
+
+// deletedGeneration returns the generation for a new file at absPath, which
+// follows on from that of the last file there if it was deleted.
+func (t *Tailer) deletedGeneration(absPath string) int {
+	t.deletedMu.Lock()
+	defer t.deletedMu.Unlock()
+	d, ok := t.deleted[absPath]
+	if !ok {
+		return 0
+	}
+	delete(t.deleted, absPath)
+	return d.generation
+}
+
+// expireDeleted forgets the paths deleted before cutoff.
+func (t *Tailer) expireDeleted(cutoff time.Time) {
+	t.deletedMu.Lock()
+	defer t.deletedMu.Unlock()
+	for p, d := range t.deleted {
+		if d.at.Before(cutoff) {
+			delete(t.deleted, p)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// DeliveryMode says what a Tailer guarantees about the lines of the files
+// recorded in its registry if the process dies.
+type DeliveryMode int
+
+const (
+	// BestEffort records a file as read up to the lines that have been sent
+	// and saves the registry periodically and on Close.  If the process dies,
+	// lines sent since the last save are sent again, and lines sent but not
+	// yet handled by the consumer are lost.
+	BestEffort DeliveryMode = iota
+	// AtMostOnce saves the registry before each read's lines are sent, with
+	// the file recorded as read past them, so a line is never sent twice but
+	// those not yet handled when the process dies are lost.  The registry is
+	// written once for every read.
+	AtMostOnce
+	// AtLeastOnce records a file as read up to the lines that have been
+	// acknowledged, as WithAckedOffsets does, so lines not acknowledged when
+	// the process dies are sent again when it restarts.
+	AtLeastOnce
+)
+
+func (m DeliveryMode) String() string {
+	switch m {
+	case BestEffort:
+		return "best-effort"
+	case AtMostOnce:
+		return "at-most-once"
+	case AtLeastOnce:
+		return "at-least-once"
+	}
+	return fmt.Sprintf("DeliveryMode(%d)", int(m))
+}
+
+// defaultAckWindow is the number of lines of each file that may wait to be
+// acknowledged with AtLeastOnce, unless WithAckedOffsets says otherwise.
+const defaultAckWindow = 1024
+
+// validateDelivery rejects the options that can't give t's delivery mode,
+// and settles the mode and ack window from WithDeliveryMode and
+// WithAckedOffsets.
+func (t *Tailer) validateDelivery(fanOut bool) error {
+	if t.ackWindow > 0 {
+		if t.deliveryModeSet && t.deliveryMode != AtLeastOnce {
+			return errors.Errorf("acknowledged offsets can't be used with %s delivery", t.deliveryMode)
+		}
+		t.deliveryMode = AtLeastOnce
+	}
+	switch t.deliveryMode {
+	case BestEffort:
+		return nil
+	case AtLeastOnce:
+		if fanOut {
+			// Every iterator gets the same line, so the first ack would
+			// count for all of them.
+			return errors.New("at-least-once delivery can't be used with FanOut")
+		}
+		if t.ackWindow == 0 {
+			t.ackWindow = defaultAckWindow
+		}
+	}
+	if t.registryPath == "" {
+		return errors.Errorf("%s delivery needs a registry", t.deliveryMode)
+	}
+	return nil
+}
+
+// commitAhead saves the registry with f recorded as read past the last
+// complete line of b, read at f.offset, before its lines are sent, for
+// AtMostOnce.
+func (f *File) commitAhead(b []byte) {
+	i := bytes.LastIndexByte(b, '\n')
+	if i < 0 {
+		return
+	}
+	key, ok := f.registryKey()
+	if !ok {
+		return
+	}
+	f.registry.update(key, f.Pathname, f.offset+int64(i)+1, f.clock.Now())
+	if err := f.registry.save(); err != nil {
+		f.logger.Warningf("%s: %s", f.Name, err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// DiscoveryState is the progress of tailing the files that already match
+// the patterns given to TailPattern and AddPatternWithPolicy, when
+// WithDiscoveryConcurrency is given.
+type DiscoveryState struct {
+	Found     int64 // Matches found
+	Opened    int64 // Matches tailed, or found to be tailed already
+	Remaining int64 // Matches not yet tailed, including those that failed and those abandoned on Close
+}
+
+// discovery counts the matches found and tailed by discover, across all
+// patterns, and lets Close stop it.
+type discovery struct {
+	workers int
+	found   int64 // accessed atomically
+	opened  int64 // accessed atomically
+
+	mu      sync.Mutex // protects stopped, and active from being added to once it is
+	stopped bool
+	stop    chan struct{}  // Closed when stopped
+	active  sync.WaitGroup // Calls of discover running
+}
+
+func newDiscovery(workers int) *discovery {
+	return &discovery{workers: workers, stop: make(chan struct{})}
+}
+
+// begin records that discover is running, or returns false if it mustn't
+// as discovery has been stopped.
+func (d *discovery) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return false
+	}
+	d.active.Add(1)
+	return true
+}
+
+// close stops discovery, abandoning the matches not yet tailed, and returns
+// once those being tailed have been.
+func (d *discovery) close() {
+	d.mu.Lock()
+	if !d.stopped {
+		d.stopped = true
+		close(d.stop)
+	}
+	d.mu.Unlock()
+	d.active.Wait()
+}
+
+func (d *discovery) state() DiscoveryState {
+	found, opened := atomic.LoadInt64(&d.found), atomic.LoadInt64(&d.opened)
+	return DiscoveryState{Found: found, Opened: opened, Remaining: found - opened}
+}
+
+// WithDiscoveryConcurrency tails the files that already match a pattern
+// given to TailPattern or AddPatternWithPolicy with n workers rather than
+// one after another, for trees with so many files that discovering them in
+// turn makes startup slow.  The matches are all stat'd first, and the most
+// recently modified are tailed first, so that fresh lines flow while older
+// files are still being opened.  The progress is in Stats.  Close abandons
+// the matches not yet tailed, and the pattern's call returns an error.
+func WithDiscoveryConcurrency(n int) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid discovery concurrency %d", n)
+		}
+		t.discovery = newDiscovery(n)
+		return nil
+	}
+}
+
+// discoveredPath is a match, with when it was last modified.
+type discoveredPath struct {
+	pathname string
+	modTime  time.Time
+}
+
+// discover tails matches of absPattern in order of recency, with the
+// Tailer's discovery workers.  It returns the first error from tailing a
+// match, after which no more are started.
+func (t *Tailer) discover(absPattern string, matches []string, policy StartPolicy, o *pathOptions) error {
+	d := t.discovery
+	if !d.begin() {
+		return errors.New("tailer closed while discovering files")
+	}
+	defer d.active.Done()
+	atomic.AddInt64(&d.found, int64(len(matches)))
+	found := make([]discoveredPath, len(matches))
+	if !d.inParallel(len(matches), func(i int) bool {
+		found[i].pathname = matches[i]
+		// A match that's gone is tailed last, and found to be gone then.
+		if fi, err := watcher.StatExtended(matches[i]); err == nil {
+			found[i].modTime = fi.ModTime()
+		}
+		return true
+	}) {
+		return errors.New("tailer closed while discovering files")
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+	)
+	if !d.inParallel(len(found), func(i int) bool {
+		pathname := found[i].pathname
+		err := t.register(pathname, absPattern)
+		if err == nil {
+			err = t.tailMatch(pathname, policy, o)
+		}
+		if err != nil {
+			mu.Lock()
+			if firstErr == nil {
+				firstErr = errors.Wrapf(err, "attempting to tail %q", pathname)
+			}
+			mu.Unlock()
+			return false
+		}
+		atomic.AddInt64(&d.opened, 1)
+		return true
+	}) && firstErr == nil {
+		return errors.New("tailer closed while discovering files")
+	}
+	return firstErr
+}
+
+// inParallel calls fn for each index below n, in order of index as workers
+// become free, with up to d.workers calls at once.  It stops starting calls
+// once one returns false or discovery is stopped, and returns true if every
+// call was made and returned true.  It returns once the calls made have.
+func (d *discovery) inParallel(n int, fn func(i int) bool) bool {
+	var (
+		next    int64 = -1
+		stopped int32
+		wg      sync.WaitGroup
+	)
+	workers := d.workers
+	if workers > n {
+		workers = n
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&stopped) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				select {
+				case <-d.stop:
+					atomic.StoreInt32(&stopped, 1)
+					return
+				default:
+				}
+				if !fn(i) {
+					atomic.StoreInt32(&stopped, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return stopped == 0
+}
@@ -0,0 +1,144 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// ErrDrainTimeout is returned by Drain if its context is done before the
+// consumer has taken every line read.
+type ErrDrainTimeout struct {
+	Lines int   // Lines read but not yet taken by the consumer
+	Bytes int64 // Size of those of the Lines still being sent or held, rather than in the buffer of the Lines channel
+	Err   error // The context's error
+}
+
+func (e *ErrDrainTimeout) Error() string {
+	return fmt.Sprintf("drain stopped with %d lines not taken by the consumer: %s", e.Lines, e.Err)
+}
+
+// Cause returns the context's error.
+func (e *ErrDrainTimeout) Cause() error {
+	return e.Err
+}
+
+// drainPoll is how often Drain checks whether the consumer has taken every
+// line.
+const drainPoll = 10 * time.Millisecond
+
+// inFlight counts the lines held between the lines channel and the consumer,
+// by an ordered merge, the shards or the LineIterators.
+type inFlight struct {
+	n     int64 // Lines held; accessed atomically
+	bytes int64 // Their size; accessed atomically
+}
+
+// add records that l is held.  It's safe to call on a nil inFlight.
+func (h *inFlight) add(l *logline.LogLine) {
+	if h != nil {
+		atomic.AddInt64(&h.n, 1)
+		atomic.AddInt64(&h.bytes, int64(len(l.Line)))
+	}
+}
+
+// done records that l has been passed on.  It's safe to call on a nil
+// inFlight.
+func (h *inFlight) done(l *logline.LogLine) {
+	if h != nil {
+		atomic.AddInt64(&h.n, -1)
+		atomic.AddInt64(&h.bytes, -int64(len(l.Line)))
+	}
+}
+
+// Drain stops the Tailer taking in anything new, and waits for the consumer
+// to take the lines already read, so that Close can be called straight after
+// without losing any.  Events from the watcher are ignored from now on, and
+// reads stop at the end of the block they're reading; with WithFlushOnDelete
+// the partial lines are sent too.  Once the lines channel, and the ordered
+// merge, shards or LineIterators it feeds, are empty, the files' offsets are
+// checkpointed and the registry, if there is one, is saved.
+//
+// If ctx is done first, the registry is saved as it is and an
+// *ErrDrainTimeout saying how much is left is returned.  Drain returns
+// ErrLinesClosed if the consumer has closed the lines channel.  A Tailer
+// can't be resumed once drained.
+func (t *Tailer) Drain(ctx context.Context) error {
+	if atomic.CompareAndSwapInt32(&t.consumer.drain, 0, 1) {
+		t.logger.Info("Draining tailer")
+	}
+	// Wait for the read in progress in run, which won't start another.
+	err := t.inRunContext(ctx, func() error {
+		if t.flushOnDelete {
+			t.flushPartials()
+		}
+		return nil
+	})
+	for err == nil {
+		if err = t.consumer.err(); err != nil {
+			return err
+		}
+		if n, _ := t.unflushed(); n == 0 {
+			break
+		}
+		select {
+		case <-t.clock.After(drainPoll):
+		case <-t.runDone:
+			return errors.New("tailer is closed")
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err != nil && err == ctx.Err() {
+		n, bytes := t.unflushed()
+		t.logger.Warningf("Drain stopped with %d lines not taken by the consumer: %s", n, err)
+		if serr := t.saveRegistry(); serr != nil {
+			t.logger.Info(serr)
+		}
+		return &ErrDrainTimeout{Lines: n, Bytes: bytes, Err: err}
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.inRunContext(ctx, func() error {
+		t.handles.Range(func(_, v interface{}) bool {
+			v.(*File).checkpoint()
+			return true
+		})
+		return nil
+	}); err != nil {
+		return err
+	}
+	t.logger.Info("Drained tailer")
+	return t.saveRegistry()
+}
+
+// unflushed returns the number and size of the lines read that the consumer
+// hasn't taken.  The size of those in the buffer of the Lines channel isn't
+// known, so isn't counted.
+func (t *Tailer) unflushed() (int, int64) {
+	c := t.consumer
+	n := atomic.LoadInt64(&c.pending) + atomic.LoadInt64(&t.held.n)
+	bytes := atomic.LoadInt64(&c.pendingBytes) + atomic.LoadInt64(&t.held.bytes)
+	out := t.lines
+	if t.merge != nil {
+		out = t.merge.out
+	}
+	return int(n) + len(out), bytes
+}
+
+// saveRegistry saves the registry, if there is one.
+func (t *Tailer) saveRegistry() error {
+	if t.registry == nil {
+		return nil
+	}
+	return t.registry.save()
+}
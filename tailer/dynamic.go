@@ -0,0 +1,127 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// Once a Tailer is running, SetOption only accepts the options that can be
+// changed safely under it: WithLogLevel, the byte rates, sampling,
+// WithMaxBytesPerRead, WithLagWarning and WithExpiryInterval.  The rest, such
+// as WithFileEvents, WithClock and Logger, shape how it's built and are
+// rejected with an *ErrStaticOption.  Each option given to a running Tailer
+// is first applied to a probe, a Tailer that is never started, which passes
+// those that can be changed on to the running one.
+//
+// The settings read as files are read are kept in a settings snapshot, which
+// is replaced rather than changed.  Each file picks up the latest at the
+// start of each read, so a read never sees half of an update.
+
+// ErrStaticOption is returned by SetOption for an option that can only be
+// given when the Tailer is created.  The options before it have been
+// applied.
+type ErrStaticOption struct {
+	Index int // Position of the option in the call
+}
+
+func (e *ErrStaticOption) Error() string {
+	return fmt.Sprintf("option %d can only be given when the tailer is created", e.Index)
+}
+
+// update applies fn, which sets an option that can be changed while the
+// Tailer is running, to the Tailer being created or, if t is a probe, to the
+// running Tailer.  fn must then be safe to call while it runs.
+func (t *Tailer) update(fn func(t *Tailer) error) error {
+	if t.probeOf == nil {
+		return fn(t)
+	}
+	t.dynamic = true
+	return fn(t.probeOf)
+}
+
+// setOptionRunning applies options to the running Tailer, or returns an
+// *ErrStaticOption for the first that can't be.
+func (t *Tailer) setOptionRunning(options []Option) error {
+	t.optionsMu.Lock()
+	defer t.optionsMu.Unlock()
+	for i, option := range options {
+		probe := newTailer(nil, nil)
+		probe.probeOf = t
+		if err := option(probe); err != nil {
+			return err
+		}
+		if !probe.dynamic {
+			return &ErrStaticOption{Index: i}
+		}
+	}
+	return nil
+}
+
+// settings are those of a Tailer's options that its files read as they're
+// read.
+type settings struct {
+	sampleRate      float64            // Keep lines with this probability, if > 0
+	pathSamples     map[string]float64 // Sampling rates of absolute paths, overriding sampleRate
+	lagThreshold    lagThreshold       // Lag of a file above which a warning is logged
+	maxBytesPerRead int64              // Bytes read from a file per event, if > 0
+}
+
+// samplingRate returns the rate at which lines of absPath are kept, or 0 if
+// they aren't sampled.
+func (s *settings) samplingRate(absPath string) float64 {
+	if rate, ok := s.pathSamples[absPath]; ok {
+		return rate
+	}
+	return s.sampleRate
+}
+
+// liveSettings holds the latest settings snapshot.
+type liveSettings struct {
+	mu sync.Mutex   // serialises changes
+	v  atomic.Value // *settings
+}
+
+func (l *liveSettings) load() *settings {
+	s, _ := l.v.Load().(*settings)
+	if s == nil {
+		return &settings{}
+	}
+	return s
+}
+
+// change replaces the snapshot with a copy changed by fn.
+func (l *liveSettings) change(fn func(s *settings)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cur := l.load()
+	s := *cur
+	s.pathSamples = make(map[string]float64, len(cur.pathSamples))
+	for p, rate := range cur.pathSamples {
+		s.pathSamples[p] = rate
+	}
+	fn(&s)
+	l.v.Store(&s)
+}
+
+// refreshSettings applies the latest settings to fd, if they've changed since
+// it was last read.  It's called in run before each read.
+func (t *Tailer) refreshSettings(fd *File) {
+	s := t.settings.load()
+	if fd.settings == s {
+		return
+	}
+	fd.settings = s
+	fd.maxBytesPerRead = s.maxBytesPerRead
+	fd.lagThreshold = s.lagThreshold
+	rate := s.samplingRate(fd.Pathname)
+	switch {
+	case rate <= 0 || rate >= 1:
+		fd.sampler = nil
+	case fd.sampler == nil || fd.sampler.rate != rate:
+		fd.sampler = newSampler(rate, t.sampleSeed, fd.Pathname, t.sampleMarker, t.clock.Now())
+	}
+}
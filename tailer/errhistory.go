@@ -0,0 +1,111 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultErrorHistory is how many of the latest failures of each file are
+// kept, unless WithErrorHistory says otherwise.
+const defaultErrorHistory = 10
+
+// FileError is a failure of a file being tailed, kept in its error history.
+type FileError struct {
+	Time time.Time
+	Op   string // Operation that failed, "read" or "reopen"
+	Err  error
+}
+
+// WithErrorHistory keeps the last n failures of each file being tailed, when
+// and what failed, for Stats and WriteStatusHTML to show, rather than the
+// last 10.  If n is 0 none are kept.  A file's history is cleared when it's
+// rotated or truncated, and by ResetErrors.
+func WithErrorHistory(n int) Option {
+	return func(t *Tailer) error {
+		if n < 0 {
+			return errors.Errorf("error history size must not be negative, got %d", n)
+		}
+		t.errorHistory = n
+		return nil
+	}
+}
+
+// errorHistory is a ring of the latest failures of a File.  Its buffer is
+// only allocated when the first failure is added, and never grows past size.
+type errorHistory struct {
+	size int
+
+	mu   sync.Mutex  // protects `errs' and `next'
+	errs []FileError // Up to size failures; once full, the oldest is at next
+	next int         // Where the next failure goes once errs is full
+}
+
+// add records e, in place of the oldest failure if the history is full.
+// It's safe to call on a nil errorHistory.
+func (h *errorHistory) add(e FileError) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.errs) < h.size {
+		if h.errs == nil {
+			h.errs = make([]FileError, 0, h.size)
+		}
+		h.errs = append(h.errs, e)
+		return
+	}
+	h.errs[h.next] = e
+	h.next = (h.next + 1) % h.size
+}
+
+// snapshot returns the failures recorded, oldest first, or nil if there are
+// none.  It's safe to call on a nil errorHistory.
+func (h *errorHistory) snapshot() []FileError {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.errs) == 0 {
+		return nil
+	}
+	s := make([]FileError, 0, len(h.errs))
+	s = append(s, h.errs[h.next:]...)
+	return append(s, h.errs[:h.next]...)
+}
+
+// reset forgets the failures recorded, keeping the buffer.  It's safe to
+// call on a nil errorHistory.
+func (h *errorHistory) reset() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	h.errs = h.errs[:0]
+	h.next = 0
+	h.mu.Unlock()
+}
+
+// fileFailed records that op failed on fd with err, in its error history
+// and its circuit breaker.
+func (t *Tailer) fileFailed(fd *File, op string, err error) {
+	fd.errors.add(FileError{Time: t.clock.Now(), Op: op, Err: err})
+	t.breakerFailed(fd, op, err)
+}
+
+// ResetErrors clears the error history of pathname, which is being tailed,
+// such as once the cause of its failures has been fixed.
+func (t *Tailer) ResetErrors(pathname string) error {
+	fd, ok := t.handleForPath(pathname)
+	if !ok {
+		return errors.Errorf("%q isn't being tailed", pathname)
+	}
+	fd.errors.reset()
+	return nil
+}
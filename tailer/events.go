@@ -0,0 +1,101 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"time"
+)
+
+// FileEventType is the kind of change in the state of a tailed file.
+type FileEventType int
+
+const (
+	// CaughtUp is sent when a file that had existing contents to read when
+	// it was opened has been read up to its end.
+	CaughtUp FileEventType = iota
+	// Deleted is sent when a file has been read up to its end after its
+	// path was removed, and is no longer tailed.
+	Deleted
+	// Rotated is sent when a pattern given to TailLatest has a new live
+	// match, or ReopenAll finds a new file at a path, after the previous one
+	// has been read up to its end.
+	Rotated
+	// EOF is sent in OneShot mode, or for a file in a directory given to
+	// AddSpoolDir, when a file has been read up to its end, once every line
+	// read from it has been sent.
+	EOF
+	// Failed is sent instead of EOF when reading a file fails before its
+	// end, once every line read from it has been sent.
+	Failed
+	// QuotaReached is sent when a file has sent as many lines or bytes as
+	// WithMaxLines or WithMaxBytes allow, and is no longer read, or not
+	// until its next generation if WithQuotaReset is given.
+	QuotaReached
+	// WatchLimit is sent when a path can't be watched because the system's
+	// limit on inotify watches or instances has been reached, whether the
+	// watch was added for TailPath, which also returns the error, or by the
+	// Tailer itself, such as for a backfill or a new live directory.
+	WatchLimit
+	// BreakerOpen is sent when a file's circuit breaker, set by
+	// WithCircuitBreaker, opens after too many failures in a row, and the
+	// file isn't read until Retry.
+	BreakerOpen
+	// BreakerHalfOpen is sent when a file's circuit breaker has cooled off,
+	// and the file is tried again.
+	BreakerHalfOpen
+	// BreakerClosed is sent when a file is read again after its circuit
+	// breaker was opened.
+	BreakerClosed
+	// Renamed is sent when WithFollowRenames is given and a tailed file is
+	// renamed, once it's tailed at its new path.
+	Renamed
+	// ArchivesRead is sent when the archives of a file matching a pattern
+	// given WithArchiveBackfill have been read, before the file is tailed.
+	ArchivesRead
+	// ConsumerStalled is sent when WithStallThreshold is given and no line
+	// has been taken from the lines channel for longer than the threshold
+	// while lines are waiting to be sent.  It has no file.
+	ConsumerStalled
+	// ConsumerResumed is sent when a line is taken from the lines channel
+	// after ConsumerStalled was sent.
+	ConsumerResumed
+	// MirrorFailed is sent when a write to the writer given to
+	// WithMirrorWriter fails, after which no more lines are copied to it.  It
+	// has no file.
+	MirrorFailed
+	// ReadPanicked is sent when reading the file panicked.  The line being
+	// read is skipped and the file read again after a delay, unless it has
+	// panicked too many times in a row, when it stops being tailed.
+	ReadPanicked
+	// WrongType is sent when a tailed file's path is found to have been
+	// replaced by something that isn't a file, such as a directory, once
+	// the file has been read up to its end.  Its Err is an
+	// *ErrNotRegularFile.  The path isn't tailed again until it's a file.
+	WrongType
+)
+
+var fileEventNames = []string{"caught up", "deleted", "rotated", "EOF", "failed", "quota reached", "watch limit", "breaker open", "breaker half-open", "breaker closed", "renamed", "archives read", "consumer stalled", "consumer resumed", "mirror failed", "read panicked", "wrong type"}
+
+func (t FileEventType) String() string {
+	if t < 0 || int(t) >= len(fileEventNames) {
+		return fmt.Sprintf("FileEventType(%d)", int(t))
+	}
+	return fileEventNames[t]
+}
+
+// FileEvent describes a change in the state of a tailed file.
+type FileEvent struct {
+	Type     FileEventType
+	Name     string // Name of the file reported on its LogLines
+	Pathname string // Absolute path of the file
+	Previous string // For Rotated, the absolute path of the previous file; for Renamed, the path the file was renamed from
+
+	Lines int64     // For EOF and Failed, the number of lines sent from the file; for ArchivesRead, from its archives
+	Bytes int64     // For EOF and Failed, the number of bytes read from the file
+	Err   error     // For Failed, why reading the file failed; for WatchLimit, a watcher.WatchLimitError naming the sysctl to raise; for BreakerOpen, the last failure; for ConsumerStalled, an *ErrConsumerStalled; for MirrorFailed, the write error; for ReadPanicked, an *ErrReadPanic; for WrongType, an *ErrNotRegularFile
+	Retry time.Time // For BreakerOpen, when the file will be tried again
+
+	Archives int // For ArchivesRead, the number of archives read
+}
@@ -0,0 +1,52 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.23
+// +build go1.23
+
+package tailer_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sgtsquiggs/tail/tailer"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// A Tailer created without a Lines channel is read with a range loop over
+// a LineIterator, which ends when the Tailer is closed.
+func ExampleTailer_Lines() {
+	dir, err := ioutil.TempDir("", "example")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	logfile := filepath.Join(dir, "log")
+	if err := ioutil.WriteFile(logfile, []byte("first\nsecond\n"), 0600); err != nil {
+		panic(err)
+	}
+
+	t, err := tailer.NewFromConfig(tailer.Config{Watcher: watcher.NewFakeWatcher(), OneShot: true})
+	if err != nil {
+		panic(err)
+	}
+	it := t.Lines()
+	go func() {
+		if err := t.TailPath(logfile); err != nil {
+			panic(err)
+		}
+		t.Close()
+	}()
+	for l, err := range it.All() {
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println(l.Line)
+	}
+	// Output:
+	// first
+	// second
+}
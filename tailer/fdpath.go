@@ -0,0 +1,72 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+const (
+	// DescriptorDeleted is reported as the path of an open file that has
+	// been removed from every directory it was in.
+	DescriptorDeleted = "(deleted)"
+	// DescriptorUnknown is reported as the path of an open file on platforms
+	// where it can't be found from the descriptor.
+	DescriptorUnknown = "unknown"
+)
+
+// refreshOpenPath finds where the file open on f's descriptor is now, which
+// differs from its Pathname once it has been renamed.
+func (f *File) refreshOpenPath() {
+	p := descriptorPath(f.file)
+	f.openMu.Lock()
+	f.openPath = p
+	f.openMu.Unlock()
+}
+
+// currentPath returns where the file open on f's descriptor was when last
+// checked.
+func (f *File) currentPath() string {
+	f.openMu.Lock()
+	defer f.openMu.Unlock()
+	return f.openPath
+}
+
+// movedPath returns where the file has been moved to, or DescriptorDeleted,
+// for reporting on lines, and "" if it's still where it was opened or it's
+// unknown.
+func (f *File) movedPath() string {
+	p := f.currentPath()
+	if p == DescriptorUnknown || p == f.Pathname || p == f.handleKey {
+		return ""
+	}
+	return p
+}
+
+// retireDeleted stops tailing the files whose descriptors show they've been
+// removed, once they've been read to their end, rather than waiting for them
+// to expire.  Their delete events may have been missed, as they would have
+// been retired then.  It runs in run, which replaces descriptors on
+// rotation.
+func (t *Tailer) retireDeleted() {
+	if !descriptorPathsSupported {
+		return
+	}
+	err := t.inRun(func() error {
+		var deleted []*File
+		t.handles.Range(func(_, v interface{}) bool {
+			if f := v.(*File); f.regular {
+				f.refreshOpenPath()
+				if f.currentPath() == DescriptorDeleted {
+					deleted = append(deleted, f)
+				}
+			}
+			return true
+		})
+		for _, f := range deleted {
+			t.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("The file open for %s has been deleted", f.Pathname)
+			t.removeDeleted(f)
+		}
+		return nil
+	})
+	if err != nil {
+		t.logger.Debug(err)
+	}
+}
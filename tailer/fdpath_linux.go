@@ -0,0 +1,37 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux
+// +build linux
+
+package tailer
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// descriptorPathsSupported says if descriptorPath can find where open files
+// are on this platform.
+const descriptorPathsSupported = true
+
+// descriptorPath returns where the file open on f is now, from its link in
+// /proc/self/fd, or DescriptorDeleted if it has been removed.
+func descriptorPath(f *os.File) string {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return DescriptorUnknown
+	}
+	var target string
+	// Control rather than Fd, which would make the descriptor blocking.
+	if cerr := rc.Control(func(fd uintptr) {
+		target, err = os.Readlink("/proc/self/fd/" + strconv.FormatUint(uint64(fd), 10))
+	}); cerr != nil || err != nil {
+		return DescriptorUnknown
+	}
+	if strings.HasSuffix(target, " (deleted)") {
+		return DescriptorDeleted
+	}
+	return target
+}
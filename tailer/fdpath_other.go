@@ -0,0 +1,19 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux
+// +build !linux
+
+package tailer
+
+import "os"
+
+// descriptorPathsSupported says if descriptorPath can find where open files
+// are on this platform.
+const descriptorPathsSupported = false
+
+// descriptorPath returns DescriptorUnknown, as open files can't be found from
+// their descriptors here.
+func descriptorPath(f *os.File) string {
+	return DescriptorUnknown
+}
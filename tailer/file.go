@@ -5,44 +5,126 @@ package tailer
 
 import (
 	"bytes"
-	"expvar"
 	"io"
 	"os"
 	"path/filepath"
-	"syscall"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
+	"github.com/sgtsquiggs/tail/clock"
 	log "github.com/sgtsquiggs/tail/logger"
 	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/watcher"
 
 	"github.com/pkg/errors"
 )
 
-var (
-	// logErrors counts the number of IO errors per log file
-	logErrors = expvar.NewMap("log_errors_total")
-	// logRotations counts the number of rotations per log file
-	logRotations = expvar.NewMap("log_rotations_total")
-	// logTruncs counts the number of log truncation events per log
-	logTruncs = expvar.NewMap("log_truncates_total")
-	// lineCount counts the numbre of lines read per log file
-	lineCount = expvar.NewMap("log_lines_total")
-)
-
 // File provides an abstraction over files and named pipes being tailed
 // by `mtail`.
 type File struct {
-	Name     string    // Given name for the file (possibly relative, used for displau)
-	Pathname string    // Full absolute path of the file used internally
-	LastRead time.Time // time of the last read received on this handle
-	regular  bool      // Remember if this is a regular file (or a pipe)
+	Name     string // Given name for the file (possibly relative, used for displau), as valid UTF-8; see RawName
+	Pathname string // Full absolute path of the file used internally
+	rawName  string // Name as given, which may not be valid UTF-8
+	safePath string // Pathname as valid UTF-8, the key of its counters
+	lastRead int64  // time of the last read received on this handle, in Unix nanoseconds; accessed atomically
+	regular  bool   // Remember if this is a regular file (or a pipe)
+	source   logline.Source
 	file     *os.File
-	partial  *bytes.Buffer
+	partial  *bytes.Buffer           // the line being accumulated across reads
+	buf      []byte                  // read buffer, reused across reads
 	lines    chan<- *logline.LogLine // output channel for lines read
-	logger   log.Logger
+	logger   *log.Leveled
+	clock    clock.Clock
+	metrics  *metrics // Counters of the Tailer reading the file
+
+	crMode    CarriageReturnMode // What a carriage return not followed by a newline does
+	ansi      *ansiStripper      // Removes escape sequences from lines, if not nil
+	pendingCR bool               // The last byte read is a carriage return that may be followed by a newline
+
+	positions bool  // Track offsets and line numbers of lines read
+	offset    int64 // File offset of the next byte to be split into lines
+	lineStart int64 // File offset of the first byte in the partial buffer
+	lineNum   int64 // Number of lines sent from the current file generation
+	sent      int64 // Number of lines sent from the File
+	readFrom  int64 // File offset reading started from, for the EOF event
+	ended     bool  // The EOF or Failed event has been sent
+
+	readFailures int           // Number of reads in a row that have failed
+	panics       int           // Number of reads in a row that have panicked
+	breaker      *breaker      // Stops the file being read after failing over and over, if not nil
+	errors       *errorHistory // The latest failures, if they're kept
+
+	seq *sequencer // Numbers the lines sent, if not nil
+
+	repeats *repeats       // Collapses consecutive duplicate lines, if not nil
+	sampler *sampler       // Decides which lines to send, if not nil
+	merge   *orderedMerge  // Told when the File starts and stops being read, if not nil
+	quota   *quota         // Limits the lines and bytes sent, if not nil
+	quiet   *quietShutdown // Told when lines are sent, if not nil
+
+	consumer *consumer // Tracks the sends of lines, if not nil
+	mirror   *mirror   // Copies the lines sent, if not nil
+
+	redactors  []redactor             // Rules applied to each line before it's sent
+	jsonFields []string               // Top-level fields of JSON lines to set as labels, if not empty
+	transform  func(*logline.LogLine) // Applied to each line before it's sent, if not nil; set by tests
+
+	kubernetesLabels map[string]string // Labels from the path, if it's a Kubernetes log
+
+	stop    *stopPattern // Stops the File being read at a matching line, if not nil
+	stopped bool         // The stop line has been read, so nothing more is sent
+
+	registry   *registry  // Records how far the file has been read, if not nil
+	acks       *ackWindow // Lines sent and not yet acknowledged, if lines are acknowledged
+	atMostOnce bool       // Save the registry before sending each read's lines
+
+	generation int // Incremented on each rotation or truncation of the file
+
+	maxLineLength int  // Lines longer than this many bytes are truncated, if > 0
+	discarding    bool // Discarding the remainder of a truncated line
+
+	nulSkip int   // Runs of at least this many NUL bytes are skipped, if > 0
+	nulRun  int64 // Length of the run of NUL bytes just before offset that hasn't been split yet
+
+	budget        *partialBudget // Limits the size of partial buffers across Files, if not nil
+	partialMu     sync.Mutex     // Held while the partial buffer changes, if budget isn't nil, as another File may flush it
+	partialLocked bool           // lockPartial has locked partialMu, which a panic may have left locked
+	partialStats  partialStats   // Size of the partial buffer, for Stats
+
+	maxBytesPerRead int64         // Follow reads at most this many bytes, if > 0
+	settings        *settings     // The Tailer's settings last applied by refreshSettings
+	more            bool          // The last Follow stopped at maxBytesPerRead, or was throttled, before EOF
+	rate            *byteRate     // Limits the rate of reads, if not nil
+	global          *sharedRate   // Limits the rate of reads across Files, if not nil
+	throttledFor    time.Duration // How long until the last Follow's throttled read may continue
+
+	progress     progress         // Progress of reading the file up to its end when it was opened
+	lag          lag              // How far reads are behind the end of the file
+	lagThreshold lagThreshold     // Lag above which a warning is logged
+	fileEvents   chan<- FileEvent // Changes in the state of the file are sent here, if not nil
+
+	handleKey string // Canonical path the Tailer's handle for this file is stored under
+
+	openMu    sync.Mutex // protects `openPath'
+	openPath  string     // Where the open file was last found, from its descriptor
+	openPaths bool       // Report openPath on lines once the file has moved
+
+	nameFunc func() string // Returns the raw name for each new generation, if not nil
+	nameMu   sync.Mutex    // protects Name and rawName from being read while they're changed on rotation
 }
 
+const (
+	// partialMinGrow is the smallest step the partial buffer grows by.
+	partialMinGrow = 4096
+	// partialMaxIdle is the largest partial buffer kept after a line is
+	// sent; larger buffers are released.
+	partialMaxIdle = 64 << 10
+)
+
 // NewFile returns a new File named by the given pathname.  `seenBefore` indicates
 // that mtail believes it's seen this pathname before, indicating we should
 // retry on error to open the file. `seekToStart` indicates that the file
@@ -52,22 +134,40 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool, l
 	if logger == nil {
 		logger = log.DefaultLogger
 	}
-	logger.Infof("file.New(%s, %v)", pathname, seekToStart)
+	return newFile(pathname, lines, seekToStart, leveled(logger), clock.Real, &metrics{})
+}
+
+// leveled returns l as a Leveled logger, wrapping it at InfoLevel if it
+// isn't one already.
+func leveled(l log.Logger) *log.Leveled {
+	if ll, ok := l.(*log.Leveled); ok {
+		return ll
+	}
+	return log.NewLeveled(l, log.InfoLevel)
+}
+
+func newFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool, logger *log.Leveled, clk clock.Clock, m *metrics) (*File, error) {
+	logger.Debugf("file.New(%s, %v)", pathname, seekToStart)
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
 		return nil, err
 	}
-	f, err := open(absPath, false, logger)
+	f, err := open(absPath, false, logger, clk, m)
 	if err != nil {
 		return nil, err
 	}
 	fi, err := f.Stat()
 	if err != nil {
 		// Stat failed, log error and return.
-		logErrors.Add(absPath, 1)
+		m.logErrors.Add(absPath, 1)
 		return nil, errors.Wrapf(err, "Failed to stat %q", absPath)
 	}
 	regular := false
+	source := logline.File
+	if absPath == "/dev/stdin" {
+		source = logline.Stdin
+	}
+	var offset int64
 	switch m := fi.Mode(); {
 	case m.IsRegular():
 		regular = true
@@ -75,7 +175,7 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool, l
 		if seekToStart {
 			seekWhence = io.SeekCurrent
 		}
-		if _, err := f.Seek(0, seekWhence); err != nil {
+		if offset, err = f.Seek(0, seekWhence); err != nil {
 			return nil, errors.Wrapf(err, "Seek failed on %q", absPath)
 		}
 		// Named pipes are the same as far as we're concerned, but we can't seek them.
@@ -84,27 +184,57 @@ func NewFile(pathname string, lines chan<- *logline.LogLine, seekToStart bool, l
 	default:
 		return nil, errors.Errorf("Can't open files with mode %v: %s", m&os.ModeType, absPath)
 	}
-	return &File{pathname, absPath, time.Now(), regular, f, bytes.NewBufferString(""), lines, logger}, nil
+	if !regular && source == logline.File {
+		source = logline.Pipe
+	}
+	fd := &File{
+		Name:      logline.SafeFilename(pathname),
+		Pathname:  absPath,
+		rawName:   pathname,
+		safePath:  logline.SafeFilename(absPath),
+		lastRead:  clk.Now().UnixNano(),
+		regular:   regular,
+		source:    source,
+		file:      f,
+		partial:   bytes.NewBufferString(""),
+		lines:     lines,
+		logger:    logger,
+		clock:     clk,
+		metrics:   m,
+		offset:    offset,
+		lineStart: offset,
+	}
+	fd.refreshOpenPath()
+	return fd, nil
 }
 
-func open(pathname string, seenBefore bool, logger log.Logger) (*os.File, error) {
+// openFile opens a file to be read, and retryableOpen indicates if an open
+// that failed may succeed if tried again.  They're replaced by tests.
+var (
+	openFile      = openForRead
+	retryableOpen = isRetryableOpen
+)
+
+func open(pathname string, seenBefore bool, logger *log.Leveled, clk clock.Clock, m *metrics) (*os.File, error) {
 	retries := 3
 	retryDelay := 1 * time.Millisecond
-	shouldRetry := func() bool {
-		// seenBefore indicates also that we're rotating a file that previously worked, so retry.
-		if !seenBefore {
+	shouldRetry := func(err error) bool {
+		// seenBefore indicates also that we're rotating a file that previously
+		// worked, so retry.  So is an open refused while another process has the
+		// file open, on Windows.
+		if !seenBefore && !retryableOpen(err) {
 			return false
 		}
 		return retries > 0
 	}
 	var f *os.File
 Retry:
-	f, err := os.OpenFile(pathname, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
+	f, err := openFile(pathname)
 	if err != nil {
-		logErrors.Add(pathname, 1)
-		if shouldRetry() {
+		m.logErrors.Add(pathname, 1)
+		if shouldRetry(err) {
 			retries--
-			time.Sleep(retryDelay)
+			<-clk.After(retryDelay)
 			retryDelay += 1
 			goto Retry
 		}
@@ -113,12 +243,62 @@ Retry:
 		logger.Infof("open failed all retries")
 		return nil, err
 	}
-	logger.Infof("open succeeded %s", pathname)
+	logger.Debugf("open succeeded %s", pathname)
 	return f, nil
 }
 
-// Follow reads from the file until EOF.  It tracks log rotations (i.e new inode or device).
+// startLastN moves the start of reading back to n bytes before the current
+// offset, skipping forward to the start of the first complete line.
+func (f *File) startLastN(n int64) error {
+	if !f.regular || n <= 0 {
+		return nil
+	}
+	start := f.offset - n
+	if start < 0 {
+		start = 0
+	}
+	if start > 0 {
+		b := make([]byte, 1)
+		if _, err := f.file.ReadAt(b, start-1); err != nil {
+			return errors.Wrapf(err, "Failed to read %q", f.Pathname)
+		}
+		f.discarding = b[0] != '\n'
+	}
+	if _, err := f.file.Seek(start, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.Pathname)
+	}
+	f.offset = start
+	f.lineStart = start
+	return nil
+}
+
+// seekTo starts reading the file at offset, which is the start of a line.
+func (f *File) seekTo(offset int64) error {
+	if _, err := f.file.Seek(offset, io.SeekStart); err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.Pathname)
+	}
+	f.offset = offset
+	f.lineStart = offset
+	return nil
+}
+
+// seekEnd starts reading the file from its current end.
+func (f *File) seekEnd() error {
+	offset, err := f.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "Seek failed on %q", f.Pathname)
+	}
+	f.offset = offset
+	f.lineStart = offset
+	return nil
+}
+
+// Follow reads from the file until EOF, or until maxBytesPerRead bytes have
+// been read, in which case More reports true.  It tracks log rotations (i.e
+// new inode or device).
 func (f *File) Follow() error {
+	f.more = false
+	f.throttledFor = 0
 	s1, err := f.file.Stat()
 	if err != nil {
 		f.logger.Infof("Stat failed on %q: %s", f.Name, err)
@@ -127,65 +307,209 @@ func (f *File) Follow() error {
 		if err != nil {
 			return err
 		}
+		if s1, err = f.file.Stat(); err != nil {
+			return err
+		}
 	}
-	s2, err := os.Stat(f.Pathname)
+	s2, err := watcher.StatExtended(f.Pathname)
 	if err != nil {
-		f.logger.Infof("Stat failed on %q: %s", f.Pathname, err)
+		f.logger.Debugf("Stat failed on %q: %s", f.Pathname, err)
+		if isDeletePending(err) {
+			// On Windows, until this handle lets go of it.
+			return errors.Wrapf(err, "%q is being deleted", f.Pathname)
+		}
 		return nil
 	}
 	if !os.SameFile(s1, s2) {
-		f.logger.Infof("New inode detected for %s, treating as rotation", f.Pathname)
+		f.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("New inode detected for %s, treating as rotation", f.Pathname)
 		err = f.doRotation()
 		if err != nil {
 			return err
 		}
+		s1 = s2
 	} else {
-		f.logger.Infof("Path %s already being watched, and inode not changed.",
+		f.logger.Debugf("Path %s already being watched, and inode not changed.",
 			f.Pathname)
 	}
+	if f.regular {
+		f.lag.sized(s1.Size(), f.clock.Now())
+	}
 
-	f.logger.Info("doing the normal read")
-	return f.Read()
+	f.logger.Debug("doing the normal read")
+	return f.read(f.maxBytesPerRead, false)
+}
+
+// More indicates if the last Follow stopped before reaching EOF.
+func (f *File) More() bool {
+	return f.more
 }
 
 // doRotation reads the remaining content of the currently opened file, then reopens the new one.
 func (f *File) doRotation() error {
-	f.logger.Info("doing the rotation flush read")
+	f.logger.With(map[string]interface{}{"path": f.Pathname, "offset": f.offset}).Debug("doing the rotation flush read")
+	f.refreshOpenPath()
 	if err := f.Read(); err != nil {
-		f.logger.Infof("%s: %s", f.Name, err)
+		f.logger.Debugf("%s: %s", f.Name, err)
 	}
-	logRotations.Add(f.Name, 1)
-	newFile, err := open(f.Pathname, true /*seenBefore*/, f.logger)
+	f.metrics.logRotations.Add(f.Name, 1)
+	newFile, err := open(f.Pathname, true /*seenBefore*/, f.logger, f.clock, f.metrics)
 	if err != nil {
 		return err
 	}
+	if fi, err := newFile.Stat(); err == nil && fi.IsDir() {
+		// Replaced by a directory, which can't be read as the file was; the
+		// Tailer decides what to do with it.
+		if err := newFile.Close(); err != nil {
+			f.logger.Info(err)
+		}
+		return &ErrNotRegularFile{Pathname: f.Pathname, Mode: fi.Mode() & os.ModeType}
+	}
 	f.file = newFile
+	f.refreshOpenPath()
+	f.resetPosition()
+	if f.nameFunc != nil {
+		f.setName(f.nameFunc())
+	}
 	return nil
 }
 
+// reopen opens the file's path again.  If it's still the same file, reading
+// continues at the same offset through the new descriptor.  Otherwise it's
+// handled as a rotation, and reopen returns true.
+func (f *File) reopen() (bool, error) {
+	if !f.regular {
+		return false, nil
+	}
+	newFile, err := open(f.Pathname, false, f.logger, f.clock, f.metrics)
+	if err != nil {
+		return false, err
+	}
+	s1, err1 := f.file.Stat()
+	s2, err2 := newFile.Stat()
+	if err1 != nil || err2 != nil || !os.SameFile(s1, s2) {
+		if err := newFile.Close(); err != nil {
+			f.logger.Info(err)
+		}
+		f.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("New file found on reopening %s, treating as rotation", f.Pathname)
+		return true, f.doRotation()
+	}
+	if _, err := newFile.Seek(f.offset, io.SeekStart); err != nil {
+		newFile.Close()
+		return false, errors.Wrapf(err, "Seek failed on %q", f.Pathname)
+	}
+	if err := f.file.Close(); err != nil {
+		f.logger.Info(err)
+	}
+	f.file = newFile
+	f.refreshOpenPath()
+	return false, nil
+}
+
 // Read blocks of 4096 bytes from the File, sending LogLines to the given
 // channel as newlines are encountered.  If EOF is read, the partial line is
 // stored to be concatenated to on the next call.  At EOF, checks for
 // truncation and resets the file offset if so.
 func (f *File) Read() error {
-	b := make([]byte, 0, 4096)
+	return f.read(0, true)
+}
+
+// read is Read, except that if limit is > 0 it returns nil after reading
+// limit bytes, setting f.more.  If the read is throttled and wait is false,
+// it also returns nil, setting f.more and f.throttledFor, rather than waiting.
+func (f *File) read(limit int64, wait bool) error {
+	err := f.readLoop(limit, wait)
+	// A File that has reached its quota or stop line hasn't caught up.
+	f.updateProgress(err == io.EOF && !f.quotaReached() && !f.stopped)
+	f.updateLag(err == io.EOF)
+	f.checkpoint()
+	return err
+}
+
+func (f *File) readLoop(limit int64, wait bool) error {
+	if f.buf == nil {
+		f.buf = make([]byte, 4096)
+	}
+	b := f.buf
 	totalBytes := 0
+	var globalBytes int64 // taken from the shared rate limit by this call
 	for {
-		if err := f.file.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
-			f.logger.Infof("%s: %s", f.Name, err)
+		if err := f.consumer.err(); err != nil {
+			return err
+		}
+		if f.consumer.draining() {
+			f.more = true
+			f.setLastRead(f.clock.Now())
+			return nil
+		}
+		if f.quotaReached() {
+			// Nothing more is sent, so there's no point reading on, unless a
+			// truncation starts the quota again.
+			if f.quota.reset && f.regular {
+				if truncated, _ := f.checkForTruncate(); truncated {
+					continue
+				}
+			}
+			return io.EOF
+		}
+		if f.stopped {
+			return io.EOF
+		}
+		if limit > 0 && int64(totalBytes) >= limit {
+			f.more = true
+			f.setLastRead(f.clock.Now())
+			return nil
+		}
+		b = b[:cap(b)]
+		if limit > 0 && limit-int64(totalBytes) < int64(len(b)) {
+			b = b[:limit-int64(totalBytes)]
+		}
+		if f.rate != nil || f.global != nil {
+			if f.global != nil && !wait {
+				// Yield once this File has had its share of the shared limit.
+				left := f.global.share() - globalBytes
+				if left <= 0 {
+					f.more = true
+					f.setLastRead(f.clock.Now())
+					return nil
+				}
+				if left < int64(len(b)) {
+					b = b[:left]
+				}
+			}
+			grant := f.takeBytes(int64(len(b)), wait)
+			if grant == 0 {
+				f.more = true
+				if totalBytes > 0 {
+					f.setLastRead(f.clock.Now())
+				}
+				return nil
+			}
+			b = b[:grant]
+			globalBytes += grant
+		}
+		var n int
+		var err error
+		if f.regular {
+			n, err = f.file.Read(b)
+		} else {
+			n, err = f.readPipe(b)
+		}
+		if n < len(b) {
+			f.giveBytes(int64(len(b) - n))
+		}
+		if f.logger.Enabled(log.DebugLevel) {
+			f.logger.With(map[string]interface{}{"path": f.Pathname, "offset": f.offset}).Debugf("Read count %v err %v", n, err)
 		}
-		n, err := f.file.Read(b[:cap(b)])
-		f.logger.Infof("Read count %v err %v", n, err)
 		totalBytes += n
 		b = b[:n]
 
 		// If this time we've read no bytes at all and then hit an EOF, and
 		// we're a regular file, check for truncation.
 		if err == io.EOF && totalBytes == 0 && f.regular {
-			f.logger.Info("Suspected truncation.")
+			f.logger.Debug("Suspected truncation.")
 			truncated, terr := f.checkForTruncate()
 			if terr != nil {
-				f.logger.Infof("checkForTruncate returned with error '%v'", terr)
+				f.logger.Debugf("checkForTruncate returned with error '%v'", terr)
 			}
 			if truncated {
 				// Try again: offset was greater than filesize and now we've seeked to start.
@@ -193,37 +517,392 @@ func (f *File) Read() error {
 			}
 		}
 
-		var (
-			rune  rune
-			width int
-		)
-		for i := 0; i < len(b) && i < n; i += width {
-			rune, width = utf8.DecodeRune(b[i:])
-			switch {
-			case rune != '\n':
-				f.partial.WriteRune(rune)
-			default:
-				f.sendLine()
-			}
-		}
+		f.consume(b)
 
 		// Return on any error, including EOF.
 		if err != nil {
 			// Update the last read time if we were able to read anything.
 			if totalBytes > 0 {
-				f.LastRead = time.Now()
+				f.setLastRead(f.clock.Now())
 			}
 			return err
 		}
 	}
 }
 
-// sendLine sends the contents of the partial buffer off for processing.
+// mmapChunk is how many bytes of a mapping are split between checks that the
+// file hasn't been truncated underneath it.
+const mmapChunk = 1 << 20
+
+// backfill reads the file from the current offset up to its current size
+// through a read-only memory mapping, rather than through the read loop.
+// Subsequent growth of the file is left for Read.  If the file is truncated
+// while it's mapped, backfill stops and leaves the truncation for Read to
+// detect.
+func (f *File) backfill() (err error) {
+	if !f.regular {
+		return nil
+	}
+	fi, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+	start, end := f.offset, fi.Size()
+	if end <= start {
+		return nil
+	}
+	pageStart := start &^ int64(os.Getpagesize()-1)
+	data, err := mmap(f.file, pageStart, int(end-pageStart))
+	if err != nil {
+		return errors.Wrapf(err, "Failed to mmap %q", f.Pathname)
+	}
+	defer func() {
+		if uerr := munmap(data); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+
+	// Touching pages past the end of a truncated file faults; turn that into
+	// a panic rather than a crash.  Only a fault's panic has the address that
+	// faulted; any other, such as from a hook the lines are sent through, is
+	// left for guard.
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(interface{ Addr() uintptr }); !ok {
+				panic(r)
+			}
+			// The rest of the mapping has gone, so skip to its end, past the
+			// new end of the file.
+			f.lockPartial()
+			f.resetPartial()
+			f.unlockPartial()
+			f.offset = end
+			err = errors.Errorf("Fault reading mapping of %q: %v", f.Pathname, r)
+		}
+		if _, serr := f.file.Seek(f.offset, io.SeekStart); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	for f.offset < end && !f.quotaReached() && !f.stopped {
+		if cerr := f.consumer.err(); cerr != nil {
+			return cerr
+		}
+		if f.consumer.draining() {
+			break
+		}
+		if fi, serr := f.file.Stat(); serr != nil || fi.Size() < end {
+			break
+		}
+		n := end - f.offset
+		if n > mmapChunk {
+			n = mmapChunk
+		}
+		if f.rate != nil || f.global != nil {
+			n = f.takeBytes(n, true)
+		}
+		f.consume(data[f.offset-pageStart : f.offset-pageStart+n])
+	}
+	f.setLastRead(f.clock.Now())
+	return nil
+}
+
+// takeBytes returns how many of n bytes may be read under the rate limits.
+// If none may be read yet, it either waits until some may, or returns zero
+// and sets f.throttledFor.
+func (f *File) takeBytes(n int64, wait bool) int64 {
+	for {
+		grant, d := f.tryTakeBytes(n)
+		if grant > 0 {
+			return grant
+		}
+		if !wait {
+			f.throttledFor = d
+			return 0
+		}
+		<-f.clock.After(d)
+	}
+}
+
+// tryTakeBytes takes up to n bytes from the per-file limit and then the
+// shared one.  If it can't take any, it returns how long to wait.
+func (f *File) tryTakeBytes(n int64) (int64, time.Duration) {
+	if f.rate != nil {
+		var d time.Duration
+		if n, d = f.rate.take(n); n == 0 {
+			return 0, d
+		}
+	}
+	if f.global == nil {
+		return n, 0
+	}
+	grant, d := f.global.take(n)
+	if f.rate != nil && grant < n {
+		f.rate.give(n - grant)
+	}
+	return grant, d
+}
+
+// giveBytes returns n bytes taken but not read to the rate limits.
+func (f *File) giveBytes(n int64) {
+	if f.rate != nil {
+		f.rate.give(n)
+	}
+	if f.global != nil {
+		f.global.give(n)
+	}
+}
+
+// split sends each newline-terminated line in b off for processing.  Bytes
+// after the last newline are accumulated in the partial buffer, to be
+// completed by a later read.
+func (f *File) split(b []byte) {
+	if f.budget != nil {
+		// The budget is enforced once the partial buffer is unlocked.
+		defer f.budget.enforce()
+		f.lockPartial()
+		defer f.unlockPartial()
+	}
+	if f.pendingCR && len(b) > 0 && b[0] != '\n' {
+		f.endPendingCR()
+	}
+	start := 0
+	for start < len(b) {
+		i, bareCR := f.lineEnd(b[start:])
+		if i < 0 {
+			f.accumulate(b[start:])
+			return
+		}
+		line := b[start : start+i]
+		switch {
+		case bareCR && f.crMode == ReplaceOnCarriageReturn:
+			// The next frame replaces this one.
+			f.discarding = false
+			if f.partial.Len() > 0 {
+				f.resetPartial()
+			}
+		case bareCR && len(line) == 0 && f.partial.Len() == 0 && !f.discarding:
+			// An empty frame, such as before the first.
+		case f.discarding:
+			f.discarding = false
+		case f.partial.Len() == 0 && (f.maxLineLength <= 0 || len(line) <= f.maxLineLength):
+			// The whole line is in b, so don't copy it through the partial buffer.
+			f.send(lineString(line), f.offset+int64(start+i+1), false)
+		default:
+			f.accumulate(line)
+			if f.discarding {
+				f.discarding = false
+			} else {
+				f.sendLineTo(f.offset + int64(start+i+1))
+			}
+		}
+		start += i + 1
+		f.lineStart = f.offset + int64(start)
+	}
+}
+
+// accumulate appends p to the partial buffer.  If that would make the line
+// longer than maxLineLength, the line is sent truncated and the rest of it
+// is discarded.
+func (f *File) accumulate(p []byte) {
+	if f.discarding {
+		return
+	}
+	if f.maxLineLength > 0 && f.partial.Len()+len(p) > f.maxLineLength {
+		n := f.maxLineLength - f.partial.Len()
+		// Don't cut a rune in half.
+		for n > 0 && !utf8.RuneStart(p[n]) {
+			n--
+		}
+		f.writePartial(p[:n])
+		f.sendTruncatedLine()
+		f.resetANSI()
+		f.discarding = true
+		return
+	}
+	f.writePartial(p)
+}
+
+// writePartial appends p to the partial buffer.  The buffer grows by a
+// quarter of its size at a time rather than doubling, so one long line
+// doesn't hold on to much more memory than it needs.
+func (f *File) writePartial(p []byte) {
+	if need := f.partial.Len() + len(p); need > f.partial.Cap() {
+		size := f.partial.Cap() + f.partial.Cap()/4
+		if size < f.partial.Cap()+partialMinGrow {
+			size = f.partial.Cap() + partialMinGrow
+		}
+		if size < need {
+			size = need
+		}
+		b := make([]byte, f.partial.Len(), size)
+		copy(b, f.partial.Bytes())
+		f.partial = bytes.NewBuffer(b)
+	}
+	f.partial.Write(p)
+	if f.budget != nil {
+		f.budget.charge(f, int64(len(p)))
+	}
+	f.notePartial()
+}
+
+// truncatePartial discards all but the first n bytes of the partial buffer.
+func (f *File) truncatePartial(n int) {
+	if f.budget != nil {
+		f.budget.charge(f, int64(n-f.partial.Len()))
+	}
+	f.partial.Truncate(n)
+	f.notePartial()
+}
+
+// resetPartial empties the partial buffer, releasing it if it grew large.
+func (f *File) resetPartial() {
+	// A carriage return held back from the last read has gone with the line.
+	f.pendingCR = false
+	if f.budget != nil {
+		f.budget.charge(f, -int64(f.partial.Len()))
+	}
+	if f.partial.Cap() > partialMaxIdle {
+		f.partial = bytes.NewBufferString("")
+	} else {
+		f.partial.Reset()
+	}
+	f.notePartial()
+}
+
+// flushPartial sends the partial line off for processing, marked as cut
+// short.  Unlike truncation at the maximum line length, the rest of the line
+// isn't discarded but is sent as a new line.
+func (f *File) flushPartial() {
+	f.noteFlush()
+	n := int64(f.partial.Len())
+	f.sendTruncatedLine()
+	f.lineStart += n
+}
+
+// lockPartial locks the partial buffer against being flushed by another
+// File sharing its budget.
+func (f *File) lockPartial() {
+	if f.budget != nil {
+		f.partialMu.Lock()
+		f.partialLocked = true
+	}
+}
+
+func (f *File) unlockPartial() {
+	if f.budget != nil {
+		f.partialLocked = false
+		f.partialMu.Unlock()
+	}
+}
+
+// lineString returns b as a string.  Bytes that aren't part of a valid UTF-8
+// sequence are replaced with utf8.RuneError, so lines are always valid UTF-8.
+func lineString(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	var s strings.Builder
+	s.Grow(len(b))
+	for len(b) > 0 {
+		r, width := utf8.DecodeRune(b)
+		s.WriteRune(r)
+		b = b[width:]
+	}
+	return s.String()
+}
+
+// sendLine sends the contents of the partial buffer off for processing,
+// without a newline after it.
 func (f *File) sendLine() {
-	f.lines <- logline.NewLogLine(f.Name, f.partial.String())
-	lineCount.Add(f.Name, 1)
+	f.sendLineTo(f.partialEnd())
+}
+
+// sendLineTo sends the contents of the partial buffer off for processing, as
+// a line whose newline, if any, ends just before end.
+func (f *File) sendLineTo(end int64) {
+	f.send(lineString(f.partial.Bytes()), end, false)
+}
+
+// sendTruncatedLine sends the contents of the partial buffer off for
+// processing, marking the line as cut short.
+func (f *File) sendTruncatedLine() {
+	f.metrics.lineTruncs.Add(f.Name, 1)
+	f.send(lineString(f.partial.Bytes()), f.partialEnd(), true)
+}
+
+// partialEnd returns the file offset just after the partial buffer.
+func (f *File) partialEnd() int64 {
+	return f.lineStart + int64(f.partial.Len())
+}
+
+// send sends line, which ends at the file offset end, including its
+// newline if it has one.
+func (f *File) send(line string, end int64, truncated bool) {
+	if f.stopped {
+		// Nothing after the stop line is sent.
+		f.resetPartial()
+		return
+	}
+	line = f.stripANSI(line, truncated)
+	stop := f.matchStop(line)
+	if f.positions {
+		f.lineNum++
+	}
+	if (!stop || f.stop.inclusive) && f.takeQuota(line) && !f.collapse(line) && !f.sampledOut() {
+		l := logline.NewLogLine(f.Name, f.redact(line))
+		l.Generation = f.generation
+		l.Truncated = truncated
+		l.Source = f.source
+		if f.openPaths {
+			l.OpenPath = f.movedPath()
+		}
+		if f.positions {
+			l.Offset = f.lineStart
+			l.EndOffset = end
+			l.LineNumber = f.lineNum
+		}
+		f.extractJSONFields(l)
+		f.addKubernetesLabels(l)
+		if f.transform != nil {
+			f.transform(l)
+		}
+		if stop {
+			f.stop.notify(l)
+		}
+		f.emit(l)
+	}
+	f.sendSampleMarker()
 	// reset partial accumulator
-	f.partial.Reset()
+	f.resetPartial()
+}
+
+// emit sends l on the lines channel.
+func (f *File) emit(l *logline.LogLine) {
+	f.setRawFilename(l)
+	if f.acks != nil {
+		l.Ack = f.acks.add(f.lineStart, f.commitAcked)
+	}
+	c := f.consumer
+	if f.merge != nil {
+		// The merge sends the lines on to the consumer, and numbers them.
+		c = nil
+	}
+	var err error
+	if f.seq != nil && f.merge == nil {
+		err = f.seq.send(c, f.lines, l)
+	} else {
+		err = c.send(f.lines, l)
+	}
+	if err != nil {
+		// Read stops once it sees the consumer has gone.
+		return
+	}
+	f.sent++
+	f.mirror.add(l)
+	f.quiet.touch(f.clock.Now())
+	f.metrics.lineCount.Add(f.Name, 1)
 }
 
 // checkForTruncate checks to see if the current offset into the file
@@ -231,7 +910,7 @@ func (f *File) sendLine() {
 // the start again.
 func (f *File) checkForTruncate() (bool, error) {
 	currentOffset, err := f.file.Seek(0, io.SeekCurrent)
-	f.logger.Infof("current seek position at %d", currentOffset)
+	f.logger.Debugf("current seek position at %d", currentOffset)
 	if err != nil {
 		return false, err
 	}
@@ -241,28 +920,125 @@ func (f *File) checkForTruncate() (bool, error) {
 		return false, err
 	}
 
-	f.logger.Infof("File size is %d", fi.Size())
+	f.logger.Debugf("File size is %d", fi.Size())
 	if currentOffset == 0 || fi.Size() >= currentOffset {
-		f.logger.Info("no truncate appears to have occurred")
+		f.logger.Debug("no truncate appears to have occurred")
 		return false, nil
 	}
 
 	// We're about to lose all data because of the truncate so if there's
 	// anything in the buffer, send it out.
+	f.lockPartial()
 	if f.partial.Len() > 0 {
 		f.sendLine()
 	}
+	f.unlockPartial()
 
 	p, serr := f.file.Seek(0, io.SeekStart)
-	f.logger.Infof("Truncated?  Seeked to %d: %v", p, serr)
-	logTruncs.Add(f.Name, 1)
+	f.logger.With(map[string]interface{}{"path": f.Pathname, "offset": p}).Infof("Truncated?  Seeked to %d: %v", p, serr)
+	f.resetPosition()
+	f.metrics.logTruncs.Add(f.Name, 1)
 	return true, serr
 }
 
+// resetPosition starts a new file generation after a rotation or truncation.
+func (f *File) resetPosition() {
+	f.endRepeats()
+	f.generation++
+	f.resetHighWater()
+	f.discarding = false
+	f.pendingCR = false
+	f.resetANSI()
+	f.offset = 0
+	f.lineStart = 0
+	f.lineNum = 0
+	f.nulRun = 0
+	f.lag.reset(f.clock.Now())
+	if f.acks != nil {
+		f.acks.reset()
+	}
+	f.releaseRegistryKey()
+	f.resetQuota()
+	f.errors.reset()
+}
+
+// updateProgress records the progress of the backfill after a read, sending
+// a CaughtUp event if it has reached EOF.
+func (f *File) updateProgress(eof bool) {
+	if f.progress.update(f.offset, eof, f.clock.Now()) {
+		f.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("Caught up with %s", f.Pathname)
+		f.sendEvent(CaughtUp)
+	}
+}
+
+// drain reads the file up to EOF before it's closed.  If flush is true, a
+// final line without a newline is sent too, marked truncated.
+func (f *File) drain(flush bool) error {
+	err := f.Read()
+	if flush {
+		f.lockPartial()
+		if f.partial.Len() > 0 {
+			f.flushPartial()
+		}
+		f.unlockPartial()
+		f.endRepeats()
+	}
+	if err == io.EOF {
+		return nil
+	}
+	return err
+}
+
+// sendEvent sends a FileEvent of type typ for this file, if events are
+// wanted.
+func (f *File) sendEvent(typ FileEventType) {
+	if f.fileEvents != nil {
+		f.fileEvents <- FileEvent{Type: typ, Name: f.Name, Pathname: f.Pathname}
+	}
+}
+
+// endEvent returns the EOF event for the File, or the Failed event if err
+// is not nil.
+func (f *File) endEvent(err error) FileEvent {
+	e := FileEvent{Type: EOF, Name: f.Name, Pathname: f.Pathname, Lines: f.sent, Bytes: f.offset - f.readFrom}
+	if err != nil {
+		e.Type, e.Err = Failed, err
+	}
+	return e
+}
+
+// name returns Name, for reading from outside the goroutine tailing the file.
+func (f *File) name() string {
+	f.nameMu.Lock()
+	defer f.nameMu.Unlock()
+	return f.Name
+}
+
+// LastRead returns the time of the last read received on this handle.  It
+// is safe to call while the File is being read.
+func (f *File) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&f.lastRead))
+}
+
+func (f *File) setLastRead(t time.Time) {
+	atomic.StoreInt64(&f.lastRead, t.UnixNano())
+}
+
 func (f *File) Stat() (os.FileInfo, error) {
 	return f.file.Stat()
 }
 
 func (f *File) Close() error {
+	f.merge.reading(f.Name, false)
+	f.unexportLag()
+	f.releaseRegistryKey()
+	f.forgetPartial()
+	f.stopRepeats()
+	if f.budget != nil {
+		f.budget.remove(f)
+	}
+	if f.global != nil {
+		f.global.remove()
+	}
 	return f.file.Close()
 }
@@ -4,15 +4,23 @@
 package tailer
 
 import (
+	"bytes"
+	"errors"
+	"expvar"
 	"fmt"
 	"io"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"regexp"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/sgtsquiggs/tail/clock"
+	log "github.com/sgtsquiggs/tail/logger"
 	"github.com/sgtsquiggs/tail/logline"
 	"github.com/sgtsquiggs/tail/testutil"
 )
@@ -31,17 +39,6 @@ func TestReadPartial(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	var result []*logline.LogLine
-	go func() {
-		for line := range lines {
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
 	err = f.Read()
 	if err != io.EOF {
 		t.Errorf("error returned not EOF: %v", err)
@@ -71,14 +68,13 @@ func TestReadPartial(t *testing.T) {
 	if err != io.EOF {
 		t.Errorf("error returned not EOF: %v", err)
 	}
-	// sync with reader goroutine
 	close(lines)
-	<-done
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
 	if f.partial.String() != "" {
 		t.Errorf("partial line not empty: %q", f.partial)
 	}
 	expected := []*logline.LogLine{
-		{logfile, "ohi"},
+		{Filename: logfile, Line: "ohi"},
 	}
 	diff := testutil.Diff(expected, result)
 	if diff != "" {
@@ -108,3 +104,948 @@ func TestOpenRetries(t *testing.T) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
 }
+
+// refuseOpens makes the next n opens fail as if another process had the
+// file open without sharing it, until the returned function is called.
+func refuseOpens(n int) func() {
+	var mu sync.Mutex
+	refused := errors.New("sharing violation")
+	openFile = func(pathname string) (*os.File, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if n > 0 {
+			n--
+			return nil, &os.PathError{Op: "open", Path: pathname, Err: refused}
+		}
+		return openForRead(pathname)
+	}
+	retryableOpen = func(err error) bool {
+		pe, ok := err.(*os.PathError)
+		return ok && pe.Err == refused
+	}
+	return func() {
+		openFile = openForRead
+		retryableOpen = isRetryableOpen
+	}
+}
+
+func TestOpenRetriesSharingViolation(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	testutil.TestOpenFile(t, logfile).Close()
+
+	// A file the writer has open for a moment is opened once it lets go.
+	restore := refuseOpens(2)
+	defer restore()
+	f, err := NewFile(logfile, nil, false, nil)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+
+	// One it holds on to fails once the retries run out.
+	refuseOpens(4)
+	if _, err := NewFile(logfile, nil, false, nil); err == nil || !retryableOpen(err) {
+		t.Errorf("expected the open to be refused, got %v", err)
+	}
+}
+
+func TestReadPositions(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+
+	fd := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, fd, "x\n")
+	f, err := NewFile(logfile, lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.positions = true
+
+	testutil.WriteString(t, fd, "a\nbc")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	testutil.WriteString(t, fd, "d\n")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+
+	// Truncate and write a shorter file; positions start again from zero.
+	testutil.FatalIfErr(t, fd.Truncate(0))
+	_, err = fd.Seek(0, io.SeekStart)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, fd, "e\n")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a", Offset: 2, EndOffset: 4, LineNumber: 1},
+		{Filename: logfile, Line: "bcd", Offset: 4, EndOffset: 8, LineNumber: 2},
+		{Filename: logfile, Line: "e", Offset: 0, EndOffset: 2, LineNumber: 1, Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestReadEndOffsets(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+
+	fd := testutil.TestOpenFile(t, logfile)
+	f, err := NewFile(logfile, lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.positions = true
+	f.maxLineLength = 4
+
+	// A CRLF line, one carried over between reads, one cut short, and an
+	// unterminated one flushed at the end.
+	testutil.WriteString(t, fd, "ab\r\ncd")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	testutil.WriteString(t, fd, "e\nfghijk\nlm")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	f.lockPartial()
+	f.sendLine()
+	f.unlockPartial()
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "ab\r", Offset: 0, EndOffset: 4, LineNumber: 1},
+		{Filename: logfile, Line: "cde", Offset: 4, EndOffset: 8, LineNumber: 2},
+		{Filename: logfile, Line: "fghi", Offset: 8, EndOffset: 12, LineNumber: 3, Truncated: true},
+		{Filename: logfile, Line: "lm", Offset: 15, EndOffset: 17, LineNumber: 4},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestReadCarriageReturns(t *testing.T) {
+	// A progress bar redrawn in place, with carriage returns at the ends of
+	// reads, then a CRLF line split between reads.
+	stream := []string{"start\n", "\rprogress 10%", "\rprogress 50%\r", "progress 100%\n", "done\r", "\n"}
+	for _, tc := range []struct {
+		mode     CarriageReturnMode
+		expected []string
+	}{
+		{KeepCarriageReturns, []string{"start", "\rprogress 10%\rprogress 50%\rprogress 100%", "done\r"}},
+		{ReplaceOnCarriageReturn, []string{"start", "progress 100%", "done\r"}},
+		{SplitOnCarriageReturn, []string{"start", "progress 10%", "progress 50%", "progress 100%", "done\r"}},
+	} {
+		t.Run(tc.mode.String(), func(t *testing.T) {
+			lines := make(chan *logline.LogLine, 10)
+
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			logfile := path.Join(tmpDir, "t")
+			fd := testutil.TestOpenFile(t, logfile)
+			f, err := NewFile(logfile, lines, false, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.crMode = tc.mode
+			for _, s := range stream {
+				testutil.WriteString(t, fd, s)
+				if err := f.Read(); err != io.EOF {
+					t.Errorf("error returned not EOF: %v", err)
+				}
+			}
+			close(lines)
+
+			var result []string
+			for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+				result = append(result, l.Line)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStripANSI(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		pieces   []string // Pieces of one line, all but the last sent early
+		expected []string
+	}{
+		{"plain", []string{"no escapes"}, []string{"no escapes"}},
+		{"sgr", []string{"\x1b[1;31mERROR\x1b[0m: failed"}, []string{"ERROR: failed"}},
+		{"truecolor", []string{"\x1b[38;2;255;100;0morange\x1b[48;5;236m on grey\x1b[m"}, []string{"orange on grey"}},
+		{"cursor", []string{"\x1b[2K\x1b[1G\x1b[?25lprogress\x1b[?25h"}, []string{"progress"}},
+		{"charset", []string{"\x1b(Bbox\x1b7\x1b8"}, []string{"box"}},
+		{"osc title", []string{"\x1b]0;user@host: ~\x07prompt"}, []string{"prompt"}},
+		{"osc hyperlink", []string{"see \x1b]8;;https://example.com\x1b\\docs\x1b]8;;\x1b\\ here"}, []string{"see docs here"}},
+		{"only escapes", []string{"\x1b[0m\x1b[K"}, []string{""}},
+		{"incomplete csi", []string{"done\x1b[38;2;1"}, []string{"done"}},
+		{"incomplete osc", []string{"done\x1b]0;tit"}, []string{"done"}},
+		{"trailing esc", []string{"done\x1b"}, []string{"done"}},
+		{"split csi", []string{"a\x1b[3", "1mb"}, []string{"a", "b"}},
+		{"split osc", []string{"a\x1b]0;ti", "tle\x1b", "\\b"}, []string{"a", "", "b"}},
+		{"aborted csi", []string{"a\x1b[1\tb"}, []string{"a\tb"}},
+		{"utf-8", []string{"\x1b[32m✓\x1b[0m passed"}, []string{"✓ passed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var a ansiStripper
+			var result []string
+			for i, p := range tc.pieces {
+				result = append(result, a.strip(p, i < len(tc.pieces)-1))
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+			if a.state != ansiGround {
+				t.Errorf("still in state %d after the end of the line", a.state)
+			}
+		})
+	}
+}
+
+func TestReadStripANSIAcrossFlush(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	f, err := NewFile(logfile, lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.ansi = &ansiStripper{}
+
+	testutil.WriteString(t, fd, "\x1b[31mred\x1b[38;2")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	// The partial line is flushed in the middle of a sequence.
+	f.flushPartial()
+	testutil.WriteString(t, fd, ";0;0;255mblue\x1b[0m\n\x1b[1mbold\n")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "red", Truncated: true},
+		{Filename: logfile, Line: "blue"},
+		{Filename: logfile, Line: "bold"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestReadMaxLineLength(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+
+	fd := testutil.TestOpenFile(t, logfile)
+	f, err := NewFile(logfile, lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.maxLineLength = 4
+
+	testutil.WriteString(t, fd, "abc\nabcdefg")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	testutil.WriteString(t, fd, "hij\nabcd\nx\n")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "abc"},
+		{Filename: logfile, Line: "abcd", Truncated: true},
+		{Filename: logfile, Line: "abcd"},
+		{Filename: logfile, Line: "x"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestBackfill(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, fd, "a\nb\nc")
+
+	f, err := NewFile(logfile, lines, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.positions = true
+	testutil.FatalIfErr(t, f.backfill())
+	// The partial line carries over into the read loop.
+	testutil.WriteString(t, fd, "d\ne\n")
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a", Offset: 0, EndOffset: 2, LineNumber: 1},
+		{Filename: logfile, Line: "b", Offset: 2, EndOffset: 4, LineNumber: 2},
+		{Filename: logfile, Line: "cd", Offset: 4, EndOffset: 7, LineNumber: 3},
+		{Filename: logfile, Line: "e", Offset: 7, EndOffset: 9, LineNumber: 4},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestBackfillEmpty(t *testing.T) {
+	lines := make(chan *logline.LogLine, 1)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+
+	f, err := NewFile(logfile, lines, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.FatalIfErr(t, f.backfill())
+	if len(lines) != 0 {
+		t.Errorf("unexpected line %v", <-lines)
+	}
+}
+
+func TestBackfillHookPanic(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "t")
+	fd := testutil.TestOpenFile(t, logfile)
+	defer fd.Close()
+	testutil.WriteString(t, fd, "a\nb\n")
+
+	f, err := NewFile(logfile, lines, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A panic that isn't a fault on the mapping is left to guard, rather
+	// than skipping the rest of the file.
+	f.transform = func(l *logline.LogLine) {
+		var fields []string
+		l.Line = fields[len(l.Line)]
+	}
+	err = f.guard(f.backfill)
+	if _, ok := err.(*ErrReadPanic); !ok {
+		t.Fatalf("expected an ErrReadPanic, got %v", err)
+	}
+	if f.offset == 4 {
+		t.Error("expected the rest of the file not to be skipped")
+	}
+}
+
+func TestPartialBufferShrinks(t *testing.T) {
+	lines := make(chan *logline.LogLine, 1)
+	f := newSplitFile(lines)
+
+	f.split(bytes.Repeat([]byte("x"), 2*partialMaxIdle))
+	if f.partial.Cap() >= 4*partialMaxIdle {
+		t.Errorf("partial buffer grew to %d for a %d byte line", f.partial.Cap(), 2*partialMaxIdle)
+	}
+	f.split([]byte("\n"))
+	<-lines
+	if f.partial.Cap() > partialMaxIdle {
+		t.Errorf("partial buffer of %d bytes kept after the line was sent", f.partial.Cap())
+	}
+}
+
+func TestBackfillProgress(t *testing.T) {
+	start := time.Now()
+	var p progress
+	p.begin(100, 1100, start)
+
+	p.update(600, false, start.Add(time.Second))
+	s, ok := p.state(start.Add(time.Second))
+	if !ok {
+		t.Fatal("expected a backfill in progress")
+	}
+	expected := BackfillProgress{BytesRead: 500, Target: 1000, Percent: 50, ETA: time.Second}
+	if diff := testutil.Diff(expected, s); diff != "" {
+		t.Errorf("progress didn't match:\n%s", diff)
+	}
+
+	// Growth during the backfill extends the target.
+	p.update(1600, false, start.Add(2*time.Second))
+	s, _ = p.state(start.Add(2 * time.Second))
+	expected = BackfillProgress{BytesRead: 1500, Target: 1500, Percent: 100}
+	if diff := testutil.Diff(expected, s); diff != "" {
+		t.Errorf("progress didn't match:\n%s", diff)
+	}
+
+	if !p.update(1600, true, start.Add(3*time.Second)) {
+		t.Error("expected EOF to complete the backfill")
+	}
+	if s, ok := p.state(start.Add(3 * time.Second)); ok {
+		t.Errorf("expected no backfill in progress, got %v", s)
+	}
+	if p.update(1700, true, start.Add(4*time.Second)) {
+		t.Error("backfill completed twice")
+	}
+}
+
+func TestLag(t *testing.T) {
+	start := time.Now()
+	threshold := lagThreshold{bytes: 100, behind: time.Minute}
+	var l lag
+	l.start(0, 50, start)
+	if diff := testutil.Diff(Lag{Bytes: 50}, l.state(start)); diff != "" {
+		t.Errorf("lag didn't match:\n%s", diff)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		size     int64 // size seen before the read, if > 0
+		offset   int64
+		eof      bool
+		at       time.Duration
+		expected Lag
+		crossed  bool
+	}{
+		{"under threshold", 0, 10, false, time.Second, Lag{40, time.Second}, false},
+		{"falling behind", 500, 20, false, 2 * time.Second, Lag{480, 2 * time.Second}, true},
+		{"still behind", 0, 30, false, 3 * time.Second, Lag{470, 3 * time.Second}, false},
+		{"caught up", 0, 500, true, 4 * time.Second, Lag{}, false},
+		{"new writes", 550, 500, false, 5 * time.Second, Lag{50, 0}, false},
+		{"behind for too long", 0, 510, false, 66 * time.Second, Lag{40, time.Minute + time.Second}, true},
+	} {
+		if tc.size > 0 {
+			l.sized(tc.size, start.Add(tc.at))
+		}
+		got, crossed := l.read(tc.offset, tc.eof, threshold, start.Add(tc.at))
+		if diff := testutil.Diff(tc.expected, got); diff != "" {
+			t.Errorf("%s: lag didn't match:\n%s", tc.name, diff)
+		}
+		if crossed != tc.crossed {
+			t.Errorf("%s: crossed = %v, expected %v", tc.name, crossed, tc.crossed)
+		}
+	}
+
+	// A truncated or rotated file has no lag until it's seen again.
+	l.reset(start.Add(70 * time.Second))
+	if diff := testutil.Diff(Lag{}, l.state(start.Add(70*time.Second))); diff != "" {
+		t.Errorf("lag after reset didn't match:\n%s", diff)
+	}
+}
+
+func TestLagAfterTruncate(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "aaaaaaaa\nbbbbbbbb\n")
+
+	lines := make(chan *logline.LogLine, 3)
+	fd, err := NewFile(logfile, lines, true, log.DiscardingLogger)
+	testutil.FatalIfErr(t, err)
+	defer fd.Close()
+	fd.lag.start(0, 18, time.Now())
+	fd.maxBytesPerRead = 9
+	testutil.FatalIfErr(t, fd.Follow())
+	if l := fd.lag.state(time.Now()); l.Bytes != 9 {
+		t.Errorf("expected 9 bytes of lag, got %d", l.Bytes)
+	}
+
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err = f.Seek(0, io.SeekStart)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "c\n")
+	fd.maxBytesPerRead = 0
+	for i := 0; i < 2; i++ {
+		// The first read after the truncation finds it, and the second reads the new line.
+		if err := fd.Follow(); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+	}
+	if l := fd.lag.state(time.Now()); l.Bytes != 0 {
+		t.Errorf("expected no lag after the truncation, got %d", l.Bytes)
+	}
+	testutil.CollectLines(t, lines, 2, time.Second)
+}
+
+func TestSkipNULRuns(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// Extending the file leaves a hole that reads as NUL bytes.
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\npart")
+	testutil.FatalIfErr(t, f.Truncate(1<<20))
+	_, err := f.Seek(0, io.SeekEnd)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "b\nc\x00\x00d\n")
+
+	lines := make(chan *logline.LogLine, 4)
+	fd, err := NewFile(logfile, lines, true, log.DiscardingLogger)
+	testutil.FatalIfErr(t, err)
+	defer fd.Close()
+	fd.nulSkip = 64
+	before := expvarInt(&fd.metrics.nulSkipped, logfile)
+	if err := fd.Read(); err != io.EOF {
+		t.Fatal(err)
+	}
+	var result []string
+	for _, l := range testutil.CollectLines(t, lines, 4, time.Second) {
+		result = append(result, l.Line)
+	}
+	if diff := testutil.Diff([]string{"a", "part", "b", "c\x00\x00d"}, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if got := expvarInt(&fd.metrics.nulSkipped, logfile) - before; got != 1<<20-6 {
+		t.Errorf("expected %d NUL bytes skipped, got %d", 1<<20-6, got)
+	}
+}
+
+// expvarInt returns the value of key in m, or 0 if it isn't set.
+func expvarInt(m *expvar.Map, key string) int64 {
+	if v, ok := m.Get(key).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestSkipNULRunsAcrossReads(t *testing.T) {
+	lines := make(chan *logline.LogLine, 4)
+	f := newSplitFile(lines)
+	f.nulSkip = 64
+	nuls := bytes.Repeat([]byte{0}, 40)
+	for _, c := range [][]byte{
+		[]byte("x\n"), nuls, nuls, []byte("y\nz\x00"), []byte("\x00w\n"),
+	} {
+		f.consume(c)
+	}
+	var result []string
+	for _, l := range testutil.CollectLines(t, lines, 3, time.Second) {
+		result = append(result, l.Line)
+	}
+	if diff := testutil.Diff([]string{"x", "y", "z\x00\x00w"}, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if f.offset != 2+80+4+3 {
+		t.Errorf("expected offset %d, got %d", 2+80+4+3, f.offset)
+	}
+}
+
+func TestPartialBudgetFlushDoesntBlock(t *testing.T) {
+	budget := newPartialBudget(4)
+	aLines := make(chan *logline.LogLine, 1)
+	var files []*File
+	for _, lines := range []chan *logline.LogLine{aLines, make(chan *logline.LogLine, 1), make(chan *logline.LogLine, 1)} {
+		f := newSplitFile(lines)
+		f.budget = budget
+		budget.add(f)
+		files = append(files, f)
+	}
+	a, b, c := files[0], files[1], files[2]
+
+	// The flush of a is held up sending its line.
+	release := make(chan struct{})
+	a.transform = func(*logline.LogLine) { <-release }
+	a.split([]byte("aaaa"))
+	done := make(chan struct{})
+	go func() {
+		b.split([]byte("bb"))
+		close(done)
+	}()
+	deadline := time.Now().Add(collectTimeout)
+	for {
+		budget.mu.Lock()
+		n := len(budget.flushing)
+		budget.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("a isn't being flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Which doesn't hold up another File.
+	split := make(chan struct{})
+	go func() {
+		c.split([]byte("c\n"))
+		close(split)
+	}()
+	select {
+	case <-split:
+	case <-time.After(collectTimeout):
+		t.Fatal("split waited for another File's flush")
+	}
+	close(release)
+	<-done
+	if l := <-aLines; l.Line != "aaaa" || !l.Truncated {
+		t.Errorf("expected a's partial line flushed, got %+v", l)
+	}
+	if budget.used != 2 || budget.pending != 0 {
+		t.Errorf("expected 2 bytes used and none pending, got %d and %d", budget.used, budget.pending)
+	}
+}
+
+// newSplitFile returns a File suitable for calling split on, without a file
+// behind it.
+func newSplitFile(lines chan<- *logline.LogLine) *File {
+	return &File{
+		Name:    "split",
+		partial: bytes.NewBufferString(""),
+		lines:   lines,
+		logger:  log.NewLeveled(log.DiscardingLogger, log.InfoLevel),
+		clock:   clock.Real,
+		metrics: &metrics{},
+	}
+}
+
+// chunk breaks b into pieces of at most size bytes, as successive reads would.
+func chunk(b []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(b) > size {
+		chunks = append(chunks, b[:size])
+		b = b[size:]
+	}
+	return append(chunks, b)
+}
+
+var splitTests = []struct {
+	name   string
+	chunks [][]byte
+	lines  int
+}{
+	{"short", [][]byte{[]byte(strings.Repeat("short line\n", 100))}, 100},
+	{"long", [][]byte{[]byte(strings.Repeat(strings.Repeat("x", 1000)+"\n", 4))}, 4},
+	{"spanning", chunk([]byte(strings.Repeat(strings.Repeat("y", 99)+"\n", 100)), 4096), 100},
+}
+
+func TestSplitAllocs(t *testing.T) {
+	for _, tc := range splitTests {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := make(chan *logline.LogLine, tc.lines)
+			f := newSplitFile(lines)
+			allocs := testing.AllocsPerRun(100, func() {
+				for _, c := range tc.chunks {
+					f.split(c)
+				}
+				for len(lines) > 0 {
+					<-lines
+				}
+			})
+			// One for the string and one for the LogLine.
+			if max := float64(2 * tc.lines); allocs > max {
+				t.Errorf("split allocated %v times, want at most %v", allocs, max)
+			}
+		})
+	}
+}
+
+func TestSplitUTF8(t *testing.T) {
+	lines := make(chan *logline.LogLine, 2)
+	f := newSplitFile(lines)
+
+	f.split([]byte("ab\xffc\nx\xe2\x82"))
+	f.split([]byte("\xac\n"))
+	close(lines)
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: "split", Line: "ab\uFFFDc"},
+		{Filename: "split", Line: "x€"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func BenchmarkTailSplit(b *testing.B) {
+	for _, tc := range splitTests {
+		b.Run(tc.name, func(b *testing.B) {
+			lines := make(chan *logline.LogLine, tc.lines)
+			f := newSplitFile(lines)
+			var n int64
+			for _, c := range tc.chunks {
+				n += int64(len(c))
+			}
+			b.SetBytes(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for _, c := range tc.chunks {
+					f.split(c)
+				}
+				for len(lines) > 0 {
+					<-lines
+				}
+			}
+		})
+	}
+}
+
+func TestJSONFields(t *testing.T) {
+	fields := []string{"level", "app"}
+	for _, tc := range []struct {
+		line     string
+		expected map[string]string
+		ok       bool
+	}{
+		{`{"level":"info","app":"web","msg":"hi"}`, map[string]string{"level": "info", "app": "web"}, true},
+		{` { "app" : "web\n", "n": 1.5e3, "level": "warn" } `, map[string]string{"level": "warn", "app": "web\n"}, true},
+		{`{"nested":{"level":"no","a":["}",{"b":null}]},"level":"debug"}`, map[string]string{"level": "debug"}, true},
+		{`{"level":3,"app":true}`, nil, true},
+		{`{}`, nil, true},
+		// Scanning stops once the fields are found, so what follows isn't checked.
+		{`{"level":"info","app":"web",garbage`, map[string]string{"level": "info", "app": "web"}, true},
+		{`{"level":"info"`, nil, false},
+		{`{"level":"info"} trailing`, nil, false},
+		{`[{"level":"info"}]`, nil, false},
+		{`level=info app=web`, nil, false},
+		{``, nil, false},
+	} {
+		labels, ok := jsonFields(tc.line, fields)
+		if ok != tc.ok {
+			t.Errorf("%q: expected ok %v, got %v", tc.line, tc.ok, ok)
+		}
+		if diff := testutil.Diff(tc.expected, labels); diff != "" {
+			t.Errorf("%q: labels didn't match:\n%s", tc.line, diff)
+		}
+	}
+}
+
+func TestJSONFieldsOnLines(t *testing.T) {
+	lines := make(chan *logline.LogLine, 2)
+	f := newSplitFile(lines)
+	f.Name = "json"
+	f.jsonFields = []string{"level"}
+	before := expvarInt(&f.metrics.jsonParseErrors, f.Name)
+	line := `{"level":"error","msg":"x"}`
+	f.split([]byte(line + "\nnot json\n"))
+	if l := <-lines; l.Line != line || l.Labels["level"] != "error" {
+		t.Errorf("unexpected line %s", l)
+	}
+	if l := <-lines; l.Labels != nil {
+		t.Errorf("unexpected labels on %s", l)
+	}
+	if got := expvarInt(&f.metrics.jsonParseErrors, f.Name) - before; got != 1 {
+		t.Errorf("expected 1 parse error, got %d", got)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	bearer := regexp.MustCompile(`Bearer [A-Za-z0-9._~+/-]+=*`)
+	card := regexp.MustCompile(`\b(\d{4})[ -]?\d{4}[ -]?\d{4}[ -]?(\d{4})\b`)
+	lines := make(chan *logline.LogLine, 4)
+	f := newSplitFile(lines)
+	for _, r := range []RedactRule{
+		{bearer, "Bearer [REDACTED]"},
+		{card, "$1-XXXX-XXXX-$2"},
+	} {
+		f.redactors = append(f.redactors, newRedactor(r))
+	}
+	beforeBearer := expvarInt(&f.metrics.redactions, bearer.String())
+	beforeCard := expvarInt(&f.metrics.redactions, card.String())
+	f.split([]byte("Authorization: Bearer abc.def-123==\n" +
+		"paid with 4111 1111 1111 1234 then 5500-0000-0000-0004\n" +
+		"nothing to see\n" +
+		"no token after Bearer\n"))
+	var result []string
+	for _, l := range testutil.CollectLines(t, lines, 4, time.Second) {
+		result = append(result, l.Line)
+	}
+	expected := []string{
+		"Authorization: Bearer [REDACTED]",
+		"paid with 4111-XXXX-XXXX-1234 then 5500-XXXX-XXXX-0004",
+		"nothing to see",
+		"no token after Bearer",
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if got := expvarInt(&f.metrics.redactions, bearer.String()) - beforeBearer; got != 1 {
+		t.Errorf("expected 1 bearer redaction, got %d", got)
+	}
+	if got := expvarInt(&f.metrics.redactions, card.String()) - beforeCard; got != 2 {
+		t.Errorf("expected 2 card redactions, got %d", got)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	input := []byte("0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n")
+	lines := make(chan *logline.LogLine, 10)
+	f := newSplitFile(lines)
+	f.Name = "sampled"
+	f.sampler = newSampler(0.4, 0, f.Name, 0, time.Now())
+	before := expvarInt(&f.metrics.sampledOut, f.Name)
+	f.split(input)
+	close(lines)
+	var result []string
+	for l := range lines {
+		result = append(result, l.Line)
+	}
+	// Two lines of every five are kept, spread out.
+	if diff := testutil.Diff([]string{"0", "3", "5", "8"}, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if got := expvarInt(&f.metrics.sampledOut, f.Name) - before; got != 6 {
+		t.Errorf("expected 6 lines sampled out, got %d", got)
+	}
+}
+
+func TestSamplingRandom(t *testing.T) {
+	const n = 10000
+	sample := func(seed int64) []bool {
+		s := newSampler(0.3137, seed, "log", 0, time.Now())
+		if s.q != 0 {
+			t.Fatalf("expected random sampling, got %d of every %d", s.p, s.q)
+		}
+		kept := make([]bool, n)
+		for i := range kept {
+			kept[i] = s.keep()
+		}
+		return kept
+	}
+	a := sample(1)
+	if diff := testutil.Diff(a, sample(1)); diff != "" {
+		t.Errorf("sampling with the same seed differed:\n%s", diff)
+	}
+	count := 0
+	for _, k := range a {
+		if k {
+			count++
+		}
+	}
+	if count < n*0.29 || count > n*0.34 {
+		t.Errorf("expected about %d lines kept, got %d", n*3137/10000, count)
+	}
+}
+
+func TestSamplingMarker(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+	clk := testutil.NewFakeClock(time.Now())
+	f := newSplitFile(lines)
+	f.clock = clk
+	f.sampler = newSampler(0.5, 0, f.Name, time.Minute, clk.Now())
+	f.split([]byte("a\nb\nc\n"))
+	clk.Advance(time.Minute)
+	f.split([]byte("d\ne\n"))
+	close(lines)
+	var result []string
+	for l := range lines {
+		result = append(result, l.Line)
+	}
+	if diff := testutil.Diff([]string{"a", "c", "sampled: kept 2 of 4", "e"}, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
+
+func TestDuplicateCollapse(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		repeats  repeats
+		input    string
+		next     string // Read in the next generation, if not empty
+		expected []string
+		repeat   []int
+	}{
+		{"summary", repeats{}, "a\na\na\nb\nb\nc\n", "",
+			[]string{"a", "last message repeated 2 times", "b", "last message repeated 1 times", "c"}, nil},
+		{"max", repeats{max: 2}, "a\na\na\na\na\n", "",
+			[]string{"a", "last message repeated 2 times", "last message repeated 2 times"}, nil},
+		{"field", repeats{field: true}, "a\na\na\nb\n", "",
+			[]string{"a", "a", "b"}, []int{0, 2, 0}},
+		// The generation ends with a truncation, which sends the summary.
+		{"truncated", repeats{}, "a\na\n", "a\n",
+			[]string{"a", "last message repeated 1 times", "a"}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := make(chan *logline.LogLine, 10)
+			f := newSplitFile(lines)
+			r := tc.repeats
+			f.repeats = &r
+			f.split([]byte(tc.input))
+			if tc.next != "" {
+				f.resetPosition()
+				f.split([]byte(tc.next))
+			}
+			close(lines)
+			var result []string
+			var repeat []int
+			for l := range lines {
+				result = append(result, l.Line)
+				repeat = append(repeat, l.Repeat)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+			if tc.repeat != nil {
+				if diff := testutil.Diff(tc.repeat, repeat); diff != "" {
+					t.Errorf("repeat counts didn't match:\n%s", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestDuplicateCollapseWindow(t *testing.T) {
+	lines := make(chan *logline.LogLine, 10)
+	clk := testutil.NewFakeClock(time.Now())
+	f := newSplitFile(lines)
+	f.clock = clk
+	f.repeats = &repeats{window: time.Minute}
+	f.split([]byte("a\na\n"))
+	clk.Advance(time.Minute)
+	f.split([]byte("a\nb\n"))
+	close(lines)
+	var result []string
+	for l := range lines {
+		result = append(result, l.Line)
+	}
+	expected := []string{"a", "last message repeated 1 times", "last message repeated 1 times", "b"}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "github.com/sgtsquiggs/tail/logline"
+
+// Filenames on most filesystems are bytes, not text, and needn't be valid
+// UTF-8.  Files are opened, watched and matched against patterns by their
+// names as they are, but the names are reported on LogLines, in Stats and
+// as counter keys as valid UTF-8, by logline.SafeFilename, so that they can
+// be encoded as JSON.  Names that are already valid UTF-8 are unchanged.
+
+// setName sets the name the File is reported under from raw, its reported
+// name as it is on the filesystem.
+func (f *File) setName(raw string) {
+	f.nameMu.Lock()
+	f.rawName = raw
+	f.Name = logline.SafeFilename(raw)
+	f.nameMu.Unlock()
+}
+
+// RawName returns the File's Name as it is on the filesystem, which may not
+// be valid UTF-8.
+func (f *File) RawName() string {
+	f.nameMu.Lock()
+	defer f.nameMu.Unlock()
+	if f.rawName == "" {
+		return f.Name
+	}
+	return f.rawName
+}
+
+// setRawFilename records the File's raw name on l if it differs from the
+// Name l carries.
+func (f *File) setRawFilename(l *logline.LogLine) {
+	if f.rawName != "" && f.rawName != f.Name {
+		l.RawFilename = []byte(f.rawName)
+	}
+}
+
+// RawPath returns the path as it is on the filesystem of the file that key,
+// a path from one of the Stats' maps or lists, names.  Keys are paths made
+// valid UTF-8 by logline.SafeFilename, so differ from the paths only if
+// those aren't.
+func (s Stats) RawPath(key string) string {
+	if raw, ok := s.rawPaths[key]; ok {
+		return raw
+	}
+	return key
+}
+
+// safeKey returns path as a key of the Stats' maps, remembering its raw form
+// if that differs.
+func (s *Stats) safeKey(path string) string {
+	key := logline.SafeFilename(path)
+	if key != path {
+		if s.rawPaths == nil {
+			s.rawPaths = make(map[string]string)
+		}
+		s.rawPaths[key] = path
+	}
+	return key
+}
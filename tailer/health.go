@@ -0,0 +1,77 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// Health describes whether a Tailer is still reading its files.
+type Health struct {
+	Running   bool            // The event loop is running
+	LastEvent time.Time       // When the last watcher event was handled, if any
+	Handles   int             // The number of files being tailed
+	Watcher   *watcher.Health // The watcher's health, if it reports it
+
+	// WatcherIdle is how long it has been since the watcher last completed
+	// a poll or processed an fsnotify event, if it reports its health.  A
+	// watcher that's idle for long is either finding no changes or wedged.
+	WatcherIdle time.Duration
+
+	Consumer ConsumerState // How the consumer of the lines channel is keeping up
+}
+
+// Health returns a snapshot of the health of the Tailer and its watcher.  It
+// is safe to call while the Tailer is running.
+func (t *Tailer) Health() Health {
+	var h Health
+	select {
+	case <-t.runDone:
+	default:
+		h.Running = true
+	}
+	if n := atomic.LoadInt64(&t.lastEvent); n != 0 {
+		h.LastEvent = time.Unix(0, n)
+	}
+	t.handles.Range(func(_, _ interface{}) bool {
+		h.Handles++
+		return true
+	})
+	if r, ok := t.w.(watcher.HealthReporter); ok {
+		wh := r.Health()
+		h.Watcher = &wh
+		if last := wh.LastActive(); !last.IsZero() {
+			h.WatcherIdle = t.clock.Now().Sub(last)
+		}
+	}
+	h.Consumer = t.consumer.state(t.clock.Now())
+	return h
+}
+
+// Healthy returns an error if the Tailer has stopped, if the consumer of the
+// lines channel has closed it or stalled, or if its watcher reports that it
+// has stopped finding changes.
+func (t *Tailer) Healthy() error {
+	select {
+	case <-t.runDone:
+		return errors.New("tailer is closed")
+	default:
+	}
+	if s := t.consumer.state(t.clock.Now()); s.Closed {
+		return ErrLinesClosed
+	} else if s.Stalled {
+		return &ErrConsumerStalled{Waiting: s.Waiting}
+	}
+	if r, ok := t.w.(watcher.HealthReporter); ok {
+		if err := r.Healthy(); err != nil {
+			return errors.Wrap(err, "watcher is unhealthy")
+		}
+	}
+	return nil
+}
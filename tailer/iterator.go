@@ -0,0 +1,152 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// ErrClosed is returned by LineIterator.Next once the Tailer has shut down
+// and every line sent before then has been returned, or once the
+// LineIterator has been closed.
+var ErrClosed = errors.New("tailer closed")
+
+// errNotIterable is returned by LineIterator.Next for a Tailer that sends its
+// lines to a channel given by the caller.
+var errNotIterable = errors.New("tailer sends lines to a channel, so they can't be iterated")
+
+// LineIterator returns the lines read by a Tailer one at a time, as an
+// alternative to receiving them from a channel.
+type LineIterator struct {
+	lines <-chan *logline.LogLine
+	err   error // Returned by Next instead of a line, if set
+
+	done      chan struct{} // Closed by Close
+	closeOnce sync.Once
+	fanOut    *fanOut // The fanOut lines is subscribed to, if not nil
+}
+
+// Lines returns a LineIterator over the lines read by t, which must have
+// been created by NewFromConfig without a Lines channel.  Each line is
+// returned by only one of the LineIterators of a Tailer, unless the Config
+// set FanOut, in which case each LineIterator returns every line read after
+// it was created.
+func (t *Tailer) Lines() *LineIterator {
+	it := &LineIterator{done: make(chan struct{})}
+	switch {
+	case t.fanOut != nil:
+		it.lines = t.fanOut.subscribe(it.done)
+		it.fanOut = t.fanOut
+	case t.pull != nil:
+		it.lines = t.pull
+	default:
+		it.err = errNotIterable
+	}
+	return it
+}
+
+// Next returns the next line, blocking until one is read.  It returns
+// ErrClosed once the Tailer has shut down and its remaining lines have been
+// returned, and ctx.Err() if ctx is done first.
+func (it *LineIterator) Next(ctx context.Context) (*logline.LogLine, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	select {
+	case <-it.done:
+		return nil, ErrClosed
+	default:
+	}
+	select {
+	case l, ok := <-it.lines:
+		if !ok {
+			return nil, ErrClosed
+		}
+		return l, nil
+	case <-it.done:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the LineIterator without stopping the Tailer.  With FanOut,
+// lines are no longer held back waiting for it.  Later calls to Next return
+// ErrClosed.
+func (it *LineIterator) Close() error {
+	it.closeOnce.Do(func() {
+		close(it.done)
+		if it.fanOut != nil {
+			it.fanOut.unsubscribe(it.done)
+		}
+	})
+	return nil
+}
+
+// fanOut copies each line from a Tailer to every subscribed LineIterator.
+// A LineIterator that isn't keeping up holds back the rest, and the Tailer.
+type fanOut struct {
+	mu     sync.Mutex
+	subs   map[chan struct{}]chan *logline.LogLine // Lines for each LineIterator, by its done channel
+	closed bool                                    // The Tailer has shut down
+	held   *inFlight                               // Counts the line being sent to the subscribers
+}
+
+func newFanOut(lines <-chan *logline.LogLine, held *inFlight) *fanOut {
+	o := &fanOut{subs: make(map[chan struct{}]chan *logline.LogLine), held: held}
+	go o.run(lines)
+	return o
+}
+
+// subscribe returns the channel on which the LineIterator with done receives
+// lines.
+func (o *fanOut) subscribe(done chan struct{}) <-chan *logline.LogLine {
+	ch := make(chan *logline.LogLine)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed {
+		close(ch)
+		return ch
+	}
+	o.subs[done] = ch
+	return ch
+}
+
+func (o *fanOut) unsubscribe(done chan struct{}) {
+	o.mu.Lock()
+	delete(o.subs, done)
+	o.mu.Unlock()
+}
+
+// run sends each line to every subscriber, until lines is closed.
+func (o *fanOut) run(lines <-chan *logline.LogLine) {
+	for l := range lines {
+		o.held.add(l)
+		o.mu.Lock()
+		subs := make(map[chan struct{}]chan *logline.LogLine, len(o.subs))
+		for done, ch := range o.subs {
+			subs[done] = ch
+		}
+		o.mu.Unlock()
+		for done, ch := range subs {
+			select {
+			case ch <- l:
+			case <-done:
+			}
+		}
+		o.held.done(l)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.closed = true
+	for done, ch := range o.subs {
+		close(ch)
+		delete(o.subs, done)
+	}
+}
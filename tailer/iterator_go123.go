@@ -0,0 +1,31 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build go1.23
+// +build go1.23
+
+package tailer
+
+import (
+	"context"
+	"iter"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// All returns an iterator over the lines from it, for use in a range loop.
+// The loop ends once the Tailer has shut down and its remaining lines have
+// been returned, or with the error from Next if there's any other.
+func (it *LineIterator) All() iter.Seq2[*logline.LogLine, error] {
+	return func(yield func(*logline.LogLine, error) bool) {
+		for {
+			l, err := it.Next(context.Background())
+			if err == ErrClosed {
+				return
+			}
+			if !yield(l, err) || err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// jsonFields returns the values of the named top-level string fields of the
+// JSON object in line, and false if line isn't a JSON object.  Other values
+// are skipped over without being decoded, and scanning stops once all the
+// fields have been found, so the rest of a large object isn't checked.
+func jsonFields(line string, fields []string) (map[string]string, bool) {
+	s := jsonScanner{s: line}
+	if !s.expect('{') {
+		return nil, false
+	}
+	var labels map[string]string
+	if s.expect('}') {
+		return nil, s.end()
+	}
+	for {
+		s.space()
+		key, ok := s.str()
+		if !ok || !s.expect(':') {
+			return nil, false
+		}
+		s.space()
+		if _, seen := labels[key]; !seen && wanted(key, fields) && s.peek() == '"' {
+			v, ok := s.str()
+			if !ok {
+				return nil, false
+			}
+			if labels == nil {
+				labels = make(map[string]string, len(fields))
+			}
+			labels[key] = v
+			if len(labels) == len(fields) {
+				return labels, true
+			}
+		} else if !s.skipValue() {
+			return nil, false
+		}
+		if s.expect(',') {
+			continue
+		}
+		if s.expect('}') && s.end() {
+			return labels, true
+		}
+		return nil, false
+	}
+}
+
+func wanted(key string, fields []string) bool {
+	for _, f := range fields {
+		if f == key {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonScanner steps through a JSON text without decoding it.
+type jsonScanner struct {
+	s string
+	i int
+}
+
+func (s *jsonScanner) peek() byte {
+	if s.i < len(s.s) {
+		return s.s[s.i]
+	}
+	return 0
+}
+
+// space skips over whitespace.
+func (s *jsonScanner) space() {
+	for s.i < len(s.s) {
+		switch s.s[s.i] {
+		case ' ', '\t', '\n', '\r':
+			s.i++
+		default:
+			return
+		}
+	}
+}
+
+// expect skips over whitespace and c, returning false if the next byte
+// isn't c.
+func (s *jsonScanner) expect(c byte) bool {
+	s.space()
+	if s.peek() != c {
+		return false
+	}
+	s.i++
+	return true
+}
+
+// end returns true if there's nothing but whitespace left.
+func (s *jsonScanner) end() bool {
+	s.space()
+	return s.i == len(s.s)
+}
+
+// str reads a string, decoding it only if it has escapes.
+func (s *jsonScanner) str() (string, bool) {
+	start, escaped, ok := s.skipString()
+	if !ok {
+		return "", false
+	}
+	if !escaped {
+		return s.s[start+1 : s.i-1], true
+	}
+	var v string
+	if err := json.Unmarshal([]byte(s.s[start:s.i]), &v); err != nil {
+		return "", false
+	}
+	return v, true
+}
+
+// skipString skips over a string, returning its start and whether it has
+// any escapes.
+func (s *jsonScanner) skipString() (start int, escaped, ok bool) {
+	start = s.i
+	if s.peek() != '"' {
+		return start, false, false
+	}
+	for s.i++; s.i < len(s.s); s.i++ {
+		switch s.s[s.i] {
+		case '\\':
+			escaped = true
+			s.i++
+		case '"':
+			s.i++
+			return start, escaped, true
+		}
+	}
+	return start, false, false
+}
+
+// skipValue skips over a value of any type.  Nested objects and arrays are
+// only checked for balanced brackets outside strings.
+func (s *jsonScanner) skipValue() bool {
+	switch s.peek() {
+	case '"':
+		_, _, ok := s.skipString()
+		return ok
+	case '{', '[':
+		depth := 0
+		for s.i < len(s.s) {
+			switch s.s[s.i] {
+			case '"':
+				if _, _, ok := s.skipString(); !ok {
+					return false
+				}
+				continue
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+			}
+			s.i++
+			if depth == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	// A number, true, false or null.
+	start := s.i
+	for s.i < len(s.s) && !strings.ContainsRune(",}] \t\n\r", rune(s.s[s.i])) {
+		s.i++
+	}
+	return s.i > start
+}
+
+// extractJSONFields sets the labels of l from the fields of its line, if
+// the File extracts them.
+func (f *File) extractJSONFields(l *logline.LogLine) {
+	if len(f.jsonFields) == 0 {
+		return
+	}
+	labels, ok := jsonFields(l.Line, f.jsonFields)
+	if !ok {
+		f.metrics.jsonParseErrors.Add(f.Name, 1)
+		return
+	}
+	l.Labels = labels
+}
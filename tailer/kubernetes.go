@@ -0,0 +1,142 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// KubernetesContainerLogs is the pattern of the container logs on a
+// Kubernetes node.  Each is a symbolic link, named for the pod, namespace
+// and container, to the file the kubelet writes under /var/log/pods.
+//
+// Tailing the pattern with WithKubernetesLabels handles the whole chain: the
+// lines of the file each link points to are read, reported under the name of
+// the link, and labelled with the names it's made of.  When the link is
+// pointed at a new file, as when the container restarts, it's a rotation:
+// the rest of the old file is read, then the new one from its start, as the
+// next generation.  A link created for a new container is tailed from its
+// start, and one the kubelet removes is read up to its end and untailed.
+const KubernetesContainerLogs = "/var/log/containers/*.log"
+
+// Labels set on lines by WithKubernetesLabels.
+const (
+	KubernetesNamespace   = "namespace"
+	KubernetesPod         = "pod"
+	KubernetesPodUID      = "pod_uid"
+	KubernetesContainer   = "container"
+	KubernetesContainerID = "container_id"
+)
+
+// KubernetesLabels returns the labels the names in the Kubernetes log path
+// pathname stand for, or false if it isn't one.  Both the links in
+// /var/log/containers, named <pod>_<namespace>_<container>-<container id>.log,
+// and the files in /var/log/pods, at
+// <namespace>_<pod>_<pod uid>/<container>/<restart count>.log, are understood;
+// the container's ID is only in the first, and the pod's UID the second.
+func KubernetesLabels(pathname string) (map[string]string, bool) {
+	if labels, ok := containerLogLabels(pathname); ok {
+		return labels, true
+	}
+	return podLogLabels(pathname)
+}
+
+// containerLogLabels returns the labels of a link in /var/log/containers.
+func containerLogLabels(pathname string) (map[string]string, bool) {
+	base := filepath.Base(pathname)
+	if !strings.HasSuffix(base, ".log") {
+		return nil, false
+	}
+	// Names of pods, namespaces and containers can't have underscores.
+	parts := strings.Split(strings.TrimSuffix(base, ".log"), "_")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return nil, false
+	}
+	i := strings.LastIndex(parts[2], "-")
+	if i < 1 || !isHex(parts[2][i+1:]) {
+		return nil, false
+	}
+	return map[string]string{
+		KubernetesPod:         parts[0],
+		KubernetesNamespace:   parts[1],
+		KubernetesContainer:   parts[2][:i],
+		KubernetesContainerID: parts[2][i+1:],
+	}, true
+}
+
+// podLogLabels returns the labels of a file in /var/log/pods.
+func podLogLabels(pathname string) (map[string]string, bool) {
+	base := filepath.Base(pathname)
+	if !strings.HasSuffix(base, ".log") || !isDigits(strings.TrimSuffix(base, ".log")) {
+		return nil, false
+	}
+	dir := filepath.Dir(pathname)
+	container := filepath.Base(dir)
+	parts := strings.Split(filepath.Base(filepath.Dir(dir)), "_")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" || container == "" || container == string(filepath.Separator) {
+		return nil, false
+	}
+	return map[string]string{
+		KubernetesNamespace: parts[0],
+		KubernetesPod:       parts[1],
+		KubernetesPodUID:    parts[2],
+		KubernetesContainer: container,
+	}, true
+}
+
+func isHex(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// WithKubernetesLabels sets the Labels of lines read from Kubernetes logs,
+// such as those matching KubernetesContainerLogs, to the names of the pod,
+// namespace and container the path of the file tailed is made of, as
+// KubernetesLabels returns them.  The labels come from the path given to
+// the Tailer, so a link's name is used rather than its target's, and a
+// label extracted from the line by WithJSONFields is kept.  Lines of files
+// whose paths aren't Kubernetes logs have no labels added.
+func WithKubernetesLabels() Option {
+	return func(t *Tailer) error {
+		t.kubernetesLabels = true
+		return nil
+	}
+}
+
+// addKubernetesLabels adds the File's Kubernetes labels to those of l.
+func (f *File) addKubernetesLabels(l *logline.LogLine) {
+	if len(f.kubernetesLabels) == 0 {
+		return
+	}
+	labels := make(map[string]string, len(f.kubernetesLabels)+len(l.Labels))
+	for k, v := range f.kubernetesLabels {
+		labels[k] = v
+	}
+	for k, v := range l.Labels {
+		labels[k] = v
+	}
+	l.Labels = labels
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Lag describes how far reading a file is behind its writer.
+type Lag struct {
+	Bytes  int64         // The size of the file less the offset read up to
+	Behind time.Duration // How long there has been unread data, or 0 if caught up
+}
+
+// lagThreshold is the lag above which a warning is logged, when either
+// limit is > 0.
+type lagThreshold struct {
+	bytes  int64
+	behind time.Duration
+}
+
+// exceeded indicates if l is above the threshold.
+func (t lagThreshold) exceeded(l Lag) bool {
+	return (t.bytes > 0 && l.Bytes > t.bytes) || (t.behind > 0 && l.Behind > t.behind)
+}
+
+// lag tracks how far a File's reads are behind the end of the file.
+type lag struct {
+	mu     sync.Mutex
+	size   int64     // size of the file when it was last seen
+	offset int64     // offset read up to
+	since  time.Time // when unread data was first seen, if there is any
+	over   bool      // the lag is above the threshold
+	gauge  *expvar.Int
+}
+
+// start begins tracking the lag of a file size bytes long, opened at offset.
+func (l *lag) start(offset, size int64, now time.Time) {
+	l.mu.Lock()
+	l.offset, l.size = offset, size
+	l.updateLocked(now)
+	l.mu.Unlock()
+}
+
+// sized records that the file was size bytes long at now.
+func (l *lag) sized(size int64, now time.Time) {
+	l.mu.Lock()
+	l.size = size
+	l.updateLocked(now)
+	l.mu.Unlock()
+}
+
+// read records that the file has been read up to offset at now, and the end
+// of the file if eof is true.  It returns the lag, and true if it has just
+// gone above threshold.
+func (l *lag) read(offset int64, eof bool, threshold lagThreshold, now time.Time) (Lag, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.offset = offset
+	if eof || offset > l.size {
+		l.size = offset
+	}
+	l.updateLocked(now)
+	s := l.stateLocked(now)
+	over := threshold.exceeded(s)
+	crossed := over && !l.over
+	l.over = over
+	return s, crossed
+}
+
+// reset records that the file has been truncated or rotated, so it's read
+// from the start again.
+func (l *lag) reset(now time.Time) {
+	l.mu.Lock()
+	l.size, l.offset = 0, 0
+	l.updateLocked(now)
+	l.mu.Unlock()
+}
+
+// updateLocked starts or stops timing the lag.  l.mu must be locked when
+// called.
+func (l *lag) updateLocked(now time.Time) {
+	switch {
+	case l.size <= l.offset:
+		l.since = time.Time{}
+	case l.since.IsZero():
+		l.since = now
+	}
+	if l.gauge != nil {
+		l.gauge.Set(l.size - l.offset)
+	}
+}
+
+// stateLocked returns the lag at now.  l.mu must be locked when called.
+func (l *lag) stateLocked(now time.Time) Lag {
+	if l.size <= l.offset {
+		return Lag{}
+	}
+	return Lag{Bytes: l.size - l.offset, Behind: now.Sub(l.since)}
+}
+
+// state returns the lag at now.
+func (l *lag) state(now time.Time) Lag {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stateLocked(now)
+}
+
+// exportLag publishes the lag of f in the log_lag_bytes expvar.
+func (f *File) exportLag() {
+	f.lag.mu.Lock()
+	defer f.lag.mu.Unlock()
+	f.lag.gauge = new(expvar.Int)
+	f.lag.updateLocked(f.clock.Now())
+	f.metrics.lagBytes.Set(f.safePath, f.lag.gauge)
+}
+
+// unexportLag removes the lag of f from the log_lag_bytes expvar, unless
+// another File for the same path has replaced it.
+func (f *File) unexportLag() {
+	f.lag.mu.Lock()
+	defer f.lag.mu.Unlock()
+	if f.lag.gauge != nil && f.metrics.lagBytes.Get(f.safePath) == f.lag.gauge {
+		f.metrics.lagBytes.Delete(f.safePath)
+	}
+}
+
+// updateLag records how far behind the end of the file a read has left f,
+// logging a warning if it has just fallen further behind than the
+// threshold.
+func (f *File) updateLag(eof bool) {
+	if !f.regular {
+		return
+	}
+	l, crossed := f.lag.read(f.offset, eof, f.lagThreshold, f.clock.Now())
+	if crossed {
+		f.logger.With(map[string]interface{}{"path": f.Pathname, "lag": l.Bytes}).Warningf("Falling behind %s: %d bytes unread for %s", f.Pathname, l.Bytes, l.Behind)
+		f.metrics.lagWarnings.Add(f.safePath, 1)
+	}
+}
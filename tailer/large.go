@@ -0,0 +1,47 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"github.com/pkg/errors"
+)
+
+// errTooLarge is returned when opening a file that is larger than the
+// initial size limit, if such files are skipped.
+var errTooLarge = errors.New("larger than the initial size limit")
+
+// LargeFile records a file that was larger than the size given to
+// WithMaxInitialFileSize when it was first opened.
+type LargeFile struct {
+	Size    int64 // The size of the file when it was opened
+	Skipped bool  // The file isn't tailed, rather than being read from its end
+}
+
+// checkSize reads f from its end, or returns errTooLarge if such files are
+// skipped, if it's to be read from the beginning with policy and is larger
+// than the Tailer's initial size limit.
+func (t *Tailer) checkSize(f *File, policy StartPolicy) error {
+	if t.maxInitialSize <= 0 || policy.kind != startBeginning || policy.force || !f.regular {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil || fi.Size() <= t.maxInitialSize {
+		return nil
+	}
+	t.largeMu.Lock()
+	_, seen := t.large[f.Pathname]
+	t.large[f.Pathname] = LargeFile{Size: fi.Size(), Skipped: t.skipLarge}
+	t.largeMu.Unlock()
+	logger := t.logger.With(map[string]interface{}{"path": f.Pathname, "size": fi.Size()})
+	if t.skipLarge {
+		if seen {
+			logger.Debugf("Still not tailing %s, %d bytes", f.Pathname, fi.Size())
+		} else {
+			logger.Infof("Not tailing %s, %d bytes is larger than the limit of %d", f.Pathname, fi.Size(), t.maxInitialSize)
+		}
+		return errTooLarge
+	}
+	logger.Infof("Reading %s from its end, %d bytes is larger than the limit of %d", f.Pathname, fi.Size(), t.maxInitialSize)
+	return f.seekEnd()
+}
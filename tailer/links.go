@@ -0,0 +1,113 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// errLinked is returned when opening a path that is a hard link to a file
+// already being tailed.
+var errLinked = errors.New("hard link to a file already being tailed")
+
+// checkLink returns errLinked if f is the same file as another that is
+// already being tailed, and hard links aren't being tailed, recording the
+// path to be checked again if that file is rotated or closed.
+func (t *Tailer) checkLink(f *File) error {
+	if t.hardLinks {
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return nil
+	}
+	var dup *File
+	t.handles.Range(func(_, v interface{}) bool {
+		other := v.(*File)
+		if other == f {
+			return true
+		}
+		if ofi, err := other.Stat(); err == nil && os.SameFile(fi, ofi) {
+			dup = other
+			return false
+		}
+		return true
+	})
+	if dup == nil {
+		return nil
+	}
+	t.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("Not tailing %s, a hard link to %s which is already being tailed", f.Pathname, dup.Pathname)
+	t.metrics.linksSkipped.Add(f.safePath, 1)
+	// Writes through the other path are seen on its watch.
+	if err := t.w.Remove(f.Pathname); err != nil {
+		t.logger.Debug(err)
+	}
+	t.linkedMu.Lock()
+	t.linked[f.Pathname] = dup.handleKey
+	t.linkedMu.Unlock()
+	return errLinked
+}
+
+// wasLinked indicates if pathname was skipped as a hard link.
+func (t *Tailer) wasLinked(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.linkedMu.Lock()
+	defer t.linkedMu.Unlock()
+	_, ok := t.linked[absPath]
+	return ok
+}
+
+// recheckLink checks if fd has become a hard link to another file being
+// tailed after a rotation, and if so stops tailing it.  The paths skipped as
+// links to the old file, whose handle key was oldKey, are then checked again.
+// It returns false if fd is no longer tailed.
+func (t *Tailer) recheckLink(fd *File, oldKey string) bool {
+	if err := t.checkLink(fd); err == errLinked {
+		t.closeHandle(fd)
+		return false
+	}
+	t.retryLinks(oldKey)
+	return true
+}
+
+// retryLinks tails the paths skipped as hard links to the file with
+// canonical path key, if they are still registered and are no longer links
+// to a file being tailed.  They're read from the end, as the file they
+// linked to has been read.
+func (t *Tailer) retryLinks(key string) {
+	var paths []string
+	t.linkedMu.Lock()
+	for p, k := range t.linked {
+		if k == key {
+			paths = append(paths, p)
+			delete(t.linked, p)
+		}
+	}
+	t.linkedMu.Unlock()
+	for _, p := range paths {
+		if !t.isRegistered(p) {
+			continue
+		}
+		if err := t.openLogPath(p, End); err != nil {
+			t.logger.Infof("Failed to tail %q: %s", p, err)
+		}
+	}
+}
+
+// isRegistered indicates if pathname is tailed for any pattern or TailPath.
+func (t *Tailer) isRegistered(pathname string) bool {
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return false
+	}
+	t.refsMu.Lock()
+	defer t.refsMu.Unlock()
+	return len(t.refs[key]) > 0
+}
@@ -0,0 +1,213 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// MatchOrder chooses which of the paths matching a pattern given to
+// TailLatest is live.
+type MatchOrder int
+
+const (
+	// LexicalOrder makes the lexically greatest match live, as for
+	// directories named by date.
+	LexicalOrder MatchOrder = iota
+	// ModTimeOrder makes the most recently modified match live.
+	ModTimeOrder
+)
+
+// livePattern is a pattern of which only the latest match is tailed.
+type livePattern struct {
+	pattern string // absolute pattern matching the files
+	dirs    string // pattern matching the directories containing them
+	order   MatchOrder
+	retain  int      // number of the latest directories to watch
+	watched []string // directories being watched, oldest first
+	live    string   // path of the live match, if any
+}
+
+// TailLatest tails only the latest of the files matching pattern, as chosen
+// by order, for logs that are written to a new directory each day such as
+// /logs/*/app.log.  When a later match appears, the live one is read up to
+// its end and closed, a Rotated FileEvent is sent, and the new one is read
+// from the start.  Only the retain latest matching directories are
+// watched.  Wildcards may only be used in the last two elements of pattern.
+func (t *Tailer) TailLatest(pattern string, order MatchOrder, retain int) error {
+	if retain < 1 {
+		return errors.Errorf("invalid number of directories to retain %d", retain)
+	}
+	absPattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return err
+	}
+	if _, err := filepath.Match(absPattern, ""); err != nil {
+		return errors.Wrapf(err, "bad pattern %q", pattern)
+	}
+	dirs := filepath.Dir(absPattern)
+	root := filepath.Dir(dirs)
+	if hasMeta(root) {
+		return errors.Errorf("pattern %q has wildcards above the directory containing the files", pattern)
+	}
+	if hasMeta(filepath.Base(dirs)) {
+		// Watch for new directories being created.
+		if err := t.addWatch(root); err != nil {
+			return err
+		}
+	}
+	lp := &livePattern{pattern: absPattern, dirs: dirs, order: order, retain: retain}
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	t.livePatterns[absPattern] = lp
+	if err := t.updateLiveDirs(lp); err != nil {
+		return err
+	}
+	return t.updateLive(lp, StartPolicy{})
+}
+
+// hasMeta indicates if path contains any of the characters special to
+// filepath.Match.
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, `*?[\`)
+}
+
+// handleLiveEvent checks if pathname is a new directory or file matching a
+// pattern given to TailLatest, and if so updates it.  It returns false if
+// pathname matches none of them.
+func (t *Tailer) handleLiveEvent(pathname string) bool {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	for _, lp := range t.livePatterns {
+		if matched, _ := filepath.Match(lp.dirs, pathname); matched {
+			if err := t.updateLiveDirs(lp); err != nil {
+				t.logger.Infof("Failed to watch directories matching %q: %s", lp.dirs, err)
+			}
+		} else if matched, _ := filepath.Match(lp.pattern, pathname); !matched {
+			continue
+		}
+		if err := t.updateLive(lp, Beginning); err != nil {
+			t.logger.Infof("Failed to tail latest match of %q: %s", lp.pattern, err)
+		}
+		return true
+	}
+	return false
+}
+
+// updateLiveDirs watches the latest directories matching lp, and stops
+// watching older ones.  t.liveMu must be locked when called.
+func (t *Tailer) updateLiveDirs(lp *livePattern) error {
+	matches, err := watcher.GlobExtended(lp.dirs)
+	if err != nil {
+		return err
+	}
+	var dirs []string
+	for _, m := range matches {
+		if fi, err := watcher.StatExtended(m); err == nil && fi.IsDir() {
+			dirs = append(dirs, m)
+		}
+	}
+	dirs = sortMatches(dirs, lp.order)
+	if len(dirs) > lp.retain {
+		dirs = dirs[len(dirs)-lp.retain:]
+	}
+	keep := make(map[string]bool, len(dirs))
+	for _, d := range dirs {
+		keep[d] = true
+	}
+	for _, d := range lp.watched {
+		if keep[d] {
+			continue
+		}
+		t.logger.Infof("No longer watching %q, older than the latest %d matching %q", d, lp.retain, lp.dirs)
+		if err := t.w.Remove(d); err != nil {
+			t.logger.Debug(err)
+		}
+	}
+	for _, d := range dirs {
+		if err := t.addWatch(d); err != nil {
+			return err
+		}
+	}
+	lp.watched = dirs
+	return nil
+}
+
+// removeLiveDir forgets about a watched directory that has been removed.
+func (t *Tailer) removeLiveDir(pathname string) {
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	for _, lp := range t.livePatterns {
+		for i, d := range lp.watched {
+			if d == pathname {
+				lp.watched = append(lp.watched[:i:i], lp.watched[i+1:]...)
+				if err := t.w.Remove(d); err != nil {
+					t.logger.Debug(err)
+				}
+				break
+			}
+		}
+	}
+}
+
+// updateLive tails the latest match of lp, starting where policy says, if
+// it isn't already.  The previous live match is read up to its end and
+// closed first.  t.liveMu must be locked when called.
+func (t *Tailer) updateLive(lp *livePattern, policy StartPolicy) error {
+	matches, err := watcher.GlobExtended(lp.pattern)
+	if err != nil {
+		return err
+	}
+	matches = sortMatches(matches, lp.order)
+	if len(matches) == 0 || matches[len(matches)-1] == lp.live {
+		return nil
+	}
+	next, prev := matches[len(matches)-1], lp.live
+	if fd, ok := t.handleForPath(prev); ok && prev != "" {
+		if err := fd.drain(false); err != nil {
+			t.logger.Info(err)
+		}
+		t.closeHandle(fd)
+		t.refsMu.Lock()
+		delete(t.refs[fd.handleKey], lp.pattern)
+		t.refsMu.Unlock()
+		t.logger.With(map[string]interface{}{"path": prev}).Infof("Stopped tailing %s, %s is now the latest", prev, next)
+	}
+	lp.live = next
+	if prev != "" {
+		t.sendEvent(FileEvent{Type: Rotated, Name: t.reportedName(next, next), Pathname: next, Previous: prev})
+	}
+	if err := t.register(next, lp.pattern); err != nil {
+		return err
+	}
+	return t.tailPath(next, policy)
+}
+
+// sortMatches sorts paths into order, latest last.
+func sortMatches(paths []string, order MatchOrder) []string {
+	switch order {
+	case ModTimeOrder:
+		modTimes := make(map[string]int64, len(paths))
+		for _, p := range paths {
+			if fi, err := watcher.StatExtended(p); err == nil {
+				modTimes[p] = fi.ModTime().UnixNano()
+			}
+		}
+		sort.Slice(paths, func(i, j int) bool {
+			if modTimes[paths[i]] != modTimes[paths[j]] {
+				return modTimes[paths[i]] < modTimes[paths[j]]
+			}
+			return paths[i] < paths[j]
+		})
+	default:
+		sort.Strings(paths)
+	}
+	return paths
+}
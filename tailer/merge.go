@@ -0,0 +1,284 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"container/heap"
+	"path/filepath"
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// mergeLine is a line held by an orderedMerge.
+type mergeLine struct {
+	l       *logline.LogLine
+	ts      time.Time // Timestamp the line is ordered by
+	arrived time.Time // When the line was received
+	seq     uint64    // Order the line was received in, to break ties
+}
+
+// mergeFile is the state of one file's lines in an orderedMerge.
+type mergeFile struct {
+	name    string
+	queue   []mergeLine // Lines held, in the order they were read
+	newest  time.Time   // Latest timestamp seen from the file
+	last    time.Time   // Timestamp of the last line, inherited by lines without one
+	reading bool        // The file is being read, so older lines may still come from it
+	end     *FileEvent  // Sent once the lines held have been, if the file has finished
+	index   int         // Position in the heap, or -1 if queue is empty
+}
+
+// mergeHeap orders the files with lines held by the timestamp of their first
+// line.
+type mergeHeap []*mergeFile
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	a, b := h[i].queue[0], h[j].queue[0]
+	if a.ts.Equal(b.ts) {
+		return a.seq < b.seq
+	}
+	return a.ts.Before(b.ts)
+}
+func (h mergeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *mergeHeap) Push(x interface{}) {
+	f := x.(*mergeFile)
+	f.index = len(*h)
+	*h = append(*h, f)
+}
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	f := old[len(old)-1]
+	f.index = -1
+	*h = old[:len(old)-1]
+	return f
+}
+
+// mergeSignal tells an orderedMerge that a file has started or stopped being
+// read.
+type mergeSignal struct {
+	name    string
+	reading bool
+	end     *FileEvent // Sent after the file's lines, if not nil
+}
+
+// orderedMerge reorders the lines from several files by the timestamps
+// parsed from them, merging the files' lines, which are each in order
+// already.  A line is held until every file being read has reached its
+// timestamp, so that no earlier line can still come, unless it's more than
+// skew older than the newest line seen or it's been held for skew.
+type orderedMerge struct {
+	in      <-chan *logline.LogLine
+	out     chan<- *logline.LogLine
+	signals chan mergeSignal
+	done    chan struct{} // Closed when run exits
+
+	parse func(string) (time.Time, bool)
+	skew  time.Duration
+	clock clock.Clock
+	event func(FileEvent) // Sends the events given to finish
+
+	consumer *consumer  // Tracks the sends on out, if not nil
+	held     *inFlight  // Counts the lines held, if not nil
+	numbers  *sequencer // Numbers the lines as they're sent on out, if not nil
+
+	files  map[string]*mergeFile
+	heap   mergeHeap
+	newest time.Time // Latest timestamp seen from any file
+	seq    uint64
+}
+
+// newOrderedMerge returns an orderedMerge that sends the lines received on
+// in to out, and starts it.  It closes out once in is closed.
+func newOrderedMerge(in <-chan *logline.LogLine, out chan<- *logline.LogLine, parse func(string) (time.Time, bool), skew time.Duration, clk clock.Clock, event func(FileEvent)) *orderedMerge {
+	m := &orderedMerge{
+		in:      in,
+		out:     out,
+		signals: make(chan mergeSignal),
+		done:    make(chan struct{}),
+		parse:   parse,
+		skew:    skew,
+		clock:   clk,
+		event:   event,
+		files:   make(map[string]*mergeFile),
+	}
+	go m.run()
+	return m
+}
+
+// reading records that the file with name has started or stopped being read.
+// Lines are sent before the file is stopped, so the merge has received them
+// all by the time it's told.
+func (m *orderedMerge) reading(name string, reading bool) {
+	if m == nil {
+		return
+	}
+	m.signal(mergeSignal{name: name, reading: reading})
+}
+
+// finish records that the file with name has stopped being read, and sends
+// e once every line held from it has been sent.
+func (m *orderedMerge) finish(name string, e FileEvent) {
+	m.signal(mergeSignal{name: name, end: &e})
+}
+
+func (m *orderedMerge) signal(s mergeSignal) {
+	select {
+	case m.signals <- s:
+	case <-m.done:
+	}
+}
+
+func (m *orderedMerge) file(name string) *mergeFile {
+	f, ok := m.files[name]
+	if !ok {
+		f = &mergeFile{name: name, index: -1}
+		m.files[name] = f
+	}
+	return f
+}
+
+// run merges lines until in is closed, then sends the lines still held.
+func (m *orderedMerge) run() {
+	defer close(m.done)
+	defer closeLines(m.out)
+	for {
+		var timeout <-chan time.Time
+		if d, ok := m.nextTimeout(); ok {
+			timeout = m.clock.After(d)
+		}
+		select {
+		case l, ok := <-m.in:
+			if !ok {
+				for m.heap.Len() > 0 {
+					m.send()
+				}
+				return
+			}
+			m.held.add(l)
+			m.add(l)
+		case s := <-m.signals:
+			f := m.file(s.name)
+			f.reading = s.reading
+			if s.end != nil {
+				f.end = s.end
+			}
+			if !f.reading && f.index < 0 {
+				m.finished(f)
+			}
+		case <-timeout:
+		}
+		m.release()
+	}
+}
+
+// add holds l in its file's queue.
+func (m *orderedMerge) add(l *logline.LogLine) {
+	f := m.file(l.Filename)
+	ts, ok := m.parse(l.Line)
+	if !ok {
+		ts = f.last
+	}
+	f.last = ts
+	if ts.After(f.newest) {
+		f.newest = ts
+	}
+	if ts.After(m.newest) {
+		m.newest = ts
+	}
+	m.seq++
+	f.queue = append(f.queue, mergeLine{l, ts, m.clock.Now(), m.seq})
+	if f.index < 0 {
+		heap.Push(&m.heap, f)
+	}
+}
+
+// send sends the earliest line held.
+func (m *orderedMerge) send() {
+	f := m.heap[0]
+	ml := f.queue[0]
+	f.queue = f.queue[1:]
+	if len(f.queue) > 0 {
+		heap.Fix(&m.heap, 0)
+	} else {
+		heap.Pop(&m.heap)
+	}
+	m.held.done(ml.l)
+	// Once the consumer has gone, the files stop being read.
+	if m.numbers != nil {
+		_ = m.numbers.send(m.consumer, m.out, ml.l)
+	} else {
+		_ = m.consumer.send(m.out, ml.l)
+	}
+	if len(f.queue) == 0 && !f.reading {
+		m.finished(f)
+	}
+}
+
+// finished forgets f, which has stopped being read and has no lines held,
+// and sends its end event if it has one.
+func (m *orderedMerge) finished(f *mergeFile) {
+	delete(m.files, f.name)
+	if f.end != nil && m.event != nil {
+		m.event(*f.end)
+	}
+}
+
+// release sends the lines that can't be preceded by any still to come, in
+// timestamp order.
+func (m *orderedMerge) release() {
+	for m.heap.Len() > 0 && m.due(m.heap[0].queue[0]) {
+		m.send()
+	}
+}
+
+// due returns true if ml, the earliest line held, can be sent.
+func (m *orderedMerge) due(ml mergeLine) bool {
+	if !m.newest.Add(-m.skew).Before(ml.ts) {
+		return true
+	}
+	if d, _ := m.nextTimeout(); d <= 0 {
+		return true
+	}
+	for _, f := range m.files {
+		if f.reading && f.newest.Before(ml.ts) {
+			return false
+		}
+	}
+	return true
+}
+
+// nextTimeout returns how long until the line held longest has been held for
+// the skew, if there are lines held.
+func (m *orderedMerge) nextTimeout() (time.Duration, bool) {
+	if m.heap.Len() == 0 {
+		return 0, false
+	}
+	var oldest time.Time
+	for _, f := range m.heap {
+		if a := f.queue[0].arrived; oldest.IsZero() || a.Before(oldest) {
+			oldest = a
+		}
+	}
+	return oldest.Add(m.skew).Sub(m.clock.Now()), true
+}
+
+// mergePending tells the ordered merge, if there is one, to wait for the
+// lines of pathname, which is queued for a backfill worker and so is read at
+// the same time as the others queued.
+func (t *Tailer) mergePending(pathname string) {
+	if t.merge == nil {
+		return
+	}
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return
+	}
+	t.merge.reading(t.reportedName(absPath, absPath), true)
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "expvar"
+
+// metrics are the counters of a Tailer and its Files.  They belong to the
+// Tailer rather than the package, so that each Tailer in a process counts
+// its own, and are only published to expvar by WithExpvar.  The counters of
+// each log file are keyed by its name.
+type metrics struct {
+	// logCount records the number of logs that are being tailed
+	logCount expvar.Int
+	// linksSkipped counts the number of times each path wasn't tailed because
+	// it is a hard link to a file already being tailed
+	linksSkipped expvar.Map
+	// binarySkipped counts the number of times each path wasn't tailed
+	// because it looks like a binary file
+	binarySkipped expvar.Map
+	// wrongType counts the number of times each tailed path was found to have
+	// been replaced by something that isn't a file, such as a directory
+	wrongType expvar.Map
+
+	// logErrors counts the number of IO errors per log file
+	logErrors expvar.Map
+	// logRotations counts the number of rotations per log file
+	logRotations expvar.Map
+	// logTruncs counts the number of log truncation events per log
+	logTruncs expvar.Map
+	// lineCount counts the number of lines read per log file
+	lineCount expvar.Map
+	// lineTruncs counts the number of lines cut short per log file
+	lineTruncs expvar.Map
+	// partialFlushes counts the number of partial lines flushed early to stay
+	// within the partial buffer budget, or on a quiet shutdown, per log file
+	partialFlushes expvar.Map
+	// partialBytes is the total size of the partial lines held by all files
+	partialBytes expvar.Int
+
+	// nulSkipped counts the number of NUL bytes skipped per log file
+	nulSkipped expvar.Map
+	// sampledOut counts the lines dropped by sampling, per log file.
+	sampledOut expvar.Map
+	// linesCollapsed counts the duplicate lines not emitted because they
+	// repeated the line before them, per log file.
+	linesCollapsed expvar.Map
+	// quotasReached counts the number of times each log file stopped being
+	// read because it reached its quota of lines or bytes.
+	quotasReached expvar.Map
+	// jsonParseErrors counts the lines that weren't JSON objects, per log
+	// file, when fields are extracted from lines.
+	jsonParseErrors expvar.Map
+	// redactions counts the substitutions made by each redaction rule, by
+	// the rule's regular expression.
+	redactions expvar.Map
+
+	// lagBytes is the number of bytes written to each log file that haven't
+	// been read yet
+	lagBytes expvar.Map
+	// lagWarnings counts the number of times each log file has fallen
+	// further behind than the lag threshold
+	lagWarnings expvar.Map
+
+	// readErrorDeleted counts the read errors on files found to be gone,
+	// per log file
+	readErrorDeleted expvar.Map
+	// readErrorRotated counts the read errors on files found to have been
+	// replaced, per log file
+	readErrorRotated expvar.Map
+	// readErrorRetried counts the read errors on files that look fine, which
+	// are read again after a delay, per log file
+	readErrorRetried expvar.Map
+	// readErrorReopened counts the files reopened after failing to be read
+	// maxReadFailures times in a row, per log file
+	readErrorReopened expvar.Map
+	// readPanics counts the panics recovered from while reading, per log
+	// file
+	readPanics expvar.Map
+	// breakerTrips counts the times each log file's circuit breaker opened
+	breakerTrips expvar.Map
+	// breakerSkipped counts the reads skipped while each log file's circuit
+	// breaker was open
+	breakerSkipped expvar.Map
+
+	// globalRateRequested counts the bytes asked of the Tailer-wide rate limit
+	globalRateRequested expvar.Int
+	// globalRateGranted counts the bytes granted by the Tailer-wide rate limit
+	globalRateGranted expvar.Int
+	// readerDropped counts the lines dropped by readers from NewReader whose
+	// buffer was full.
+	readerDropped expvar.Int
+	// readerDroppedBytes counts the bytes of the lines dropped by readers
+	// from NewReader, as they'd have been read from the stream.
+	readerDroppedBytes expvar.Int
+	// untailedDropped counts the events dropped because they were for files
+	// that had stopped being tailed by Untail or RemovePattern.
+	untailedDropped expvar.Int
+	// consumerStalls counts the times the consumer of the lines channel was
+	// found stalled, with WithStallThreshold.
+	consumerStalls expvar.Int
+	// mirrorDropped counts the lines not copied by WithMirrorWriter because
+	// its buffer was full.
+	mirrorDropped expvar.Int
+	// archivesSkipped counts the files matching a pattern that weren't
+	// tailed because they look like archives.
+	archivesSkipped expvar.Int
+
+	// spoolProcessed counts the files read, per spool directory.
+	spoolProcessed expvar.Map
+	// spoolRenamed counts the files marked done by WithDoneDir or
+	// WithDoneSuffix, per spool directory.
+	spoolRenamed expvar.Map
+	// spoolSkippedDone counts the times files weren't read because they had
+	// already been marked done or recorded as read, per spool directory.
+	spoolSkippedDone expvar.Map
+}
+
+// vars returns the counters by the names they're published under.
+func (m *metrics) vars() map[string]expvar.Var {
+	return map[string]expvar.Var{
+		"log_count":                             &m.logCount,
+		"log_hard_links_skipped_total":          &m.linksSkipped,
+		"log_binary_files_skipped_total":        &m.binarySkipped,
+		"log_wrong_type_total":                  &m.wrongType,
+		"log_errors_total":                      &m.logErrors,
+		"log_rotations_total":                   &m.logRotations,
+		"log_truncates_total":                   &m.logTruncs,
+		"log_lines_total":                       &m.lineCount,
+		"log_lines_truncated_total":             &m.lineTruncs,
+		"log_partial_flushes_total":             &m.partialFlushes,
+		"log_partial_bytes":                     &m.partialBytes,
+		"log_nul_bytes_skipped_total":           &m.nulSkipped,
+		"log_lines_sampled_out_total":           &m.sampledOut,
+		"log_lines_collapsed_total":             &m.linesCollapsed,
+		"log_quotas_reached_total":              &m.quotasReached,
+		"log_json_parse_errors_total":           &m.jsonParseErrors,
+		"log_redactions_total":                  &m.redactions,
+		"log_lag_bytes":                         &m.lagBytes,
+		"log_lag_warnings_total":                &m.lagWarnings,
+		"log_read_errors_deleted_total":         &m.readErrorDeleted,
+		"log_read_errors_rotated_total":         &m.readErrorRotated,
+		"log_read_errors_retried_total":         &m.readErrorRetried,
+		"log_read_errors_reopened_total":        &m.readErrorReopened,
+		"log_read_panics_total":                 &m.readPanics,
+		"log_breaker_trips_total":               &m.breakerTrips,
+		"log_breaker_skipped_total":             &m.breakerSkipped,
+		"log_read_global_bytes_requested_total": &m.globalRateRequested,
+		"log_read_global_bytes_granted_total":   &m.globalRateGranted,
+		"log_reader_lines_dropped_total":        &m.readerDropped,
+		"log_reader_bytes_dropped_total":        &m.readerDroppedBytes,
+		"log_untailed_events_dropped_total":     &m.untailedDropped,
+		"log_consumer_stalls_total":             &m.consumerStalls,
+		"log_archives_skipped_total":            &m.archivesSkipped,
+		"log_mirror_lines_dropped_total":        &m.mirrorDropped,
+		"log_spool_files_processed_total":       &m.spoolProcessed,
+		"log_spool_files_renamed_total":         &m.spoolRenamed,
+		"log_spool_files_skipped_done_total":    &m.spoolSkippedDone,
+	}
+}
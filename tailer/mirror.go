@@ -0,0 +1,148 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"expvar"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+
+	log "github.com/sgtsquiggs/tail/logger"
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+const defaultMirrorBufferSize = 64 * 1024
+
+// WithMirrorWriter copies every line sent to w, followed by a newline, such
+// as to tee the lines to a local file while they're processed.  A line that
+// ended in a CRLF keeps its carriage return, so it's written as it was read.
+// The lines are buffered, up to 64KiB, and written by a goroutine of their
+// own, so a slow w never holds up reading; lines that don't fit are dropped
+// and counted in log_mirror_lines_dropped_total.  If a write fails, a
+// MirrorFailed FileEvent is sent and nothing more is written.  Close writes
+// the lines still buffered before returning.
+func WithMirrorWriter(w io.Writer) Option {
+	return func(t *Tailer) error {
+		if w == nil {
+			return errors.New("mirror writer must not be nil")
+		}
+		t.mirrorWriter = w
+		return nil
+	}
+}
+
+// WithMirrorFilename prefixes each line written by WithMirrorWriter with the
+// name of the file it was read from and ": ".
+func WithMirrorFilename() Option {
+	return func(t *Tailer) error {
+		t.mirrorFilename = true
+		return nil
+	}
+}
+
+// mirror copies lines to a writer, from a buffer of its own.
+type mirror struct {
+	w        io.Writer
+	filename bool
+	size     int
+	dropped  *expvar.Int     // Counts the lines dropped because the buffer was full
+	event    func(FileEvent) // Sends the MirrorFailed event
+	logger   *log.Leveled
+
+	mu     sync.Mutex
+	cond   *sync.Cond // Signalled when lines are added, or the mirror is closed
+	buf    []byte     // Lines not yet written
+	closed bool       // close has been called
+	failed bool       // A write has failed, so nothing more is written
+	done   chan struct{}
+}
+
+func newMirror(w io.Writer, filename bool, dropped *expvar.Int, event func(FileEvent), logger *log.Leveled) *mirror {
+	m := &mirror{
+		w:        w,
+		filename: filename,
+		size:     defaultMirrorBufferSize,
+		dropped:  dropped,
+		event:    event,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+	m.cond = sync.NewCond(&m.mu)
+	go m.run()
+	return m
+}
+
+// add buffers l to be written, or drops it if the buffer is full.  A line
+// longer than the buffer is buffered once the buffer is empty.  It's safe to
+// call on a nil mirror.
+func (m *mirror) add(l *logline.LogLine) {
+	if m == nil {
+		return
+	}
+	n := len(l.Line) + 1
+	if m.filename {
+		n += len(l.Filename) + 2
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failed || m.closed {
+		return
+	}
+	if len(m.buf) > 0 && len(m.buf)+n > m.size {
+		m.dropped.Add(1)
+		return
+	}
+	if m.filename {
+		m.buf = append(m.buf, l.Filename...)
+		m.buf = append(m.buf, ": "...)
+	}
+	m.buf = append(m.buf, l.Line...)
+	m.buf = append(m.buf, '\n')
+	m.cond.Signal()
+}
+
+// run writes the buffered lines until the mirror is closed and they've all
+// been written, or a write fails.
+func (m *mirror) run() {
+	defer close(m.done)
+	var b []byte
+	for {
+		m.mu.Lock()
+		for len(m.buf) == 0 && !m.closed {
+			m.cond.Wait()
+		}
+		if len(m.buf) == 0 {
+			m.mu.Unlock()
+			return
+		}
+		// Swap buffers, so lines can be added while these are written.
+		b, m.buf = m.buf, b[:0]
+		m.mu.Unlock()
+		if _, err := m.w.Write(b); err != nil {
+			m.mu.Lock()
+			m.failed = true
+			m.buf = nil
+			m.mu.Unlock()
+			err = errors.Wrap(err, "Failed to write to the mirror")
+			m.logger.Warning(err)
+			m.event(FileEvent{Type: MirrorFailed, Err: err})
+			return
+		}
+	}
+}
+
+// close writes the lines still buffered, and stops the mirror.  It's safe to
+// call on a nil mirror.
+func (m *mirror) close() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	m.closed = true
+	m.cond.Signal()
+	m.mu.Unlock()
+	<-m.done
+}
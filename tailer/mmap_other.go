@@ -0,0 +1,21 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package tailer
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+func mmap(f *os.File, offset int64, length int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmap(b []byte) error {
+	return nil
+}
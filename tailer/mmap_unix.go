@@ -0,0 +1,22 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tailer
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmap maps length bytes of f starting at offset, which must be a multiple
+// of the page size, read-only into memory.
+func mmap(f *os.File, offset int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), offset, length, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
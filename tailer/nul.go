@@ -0,0 +1,77 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+)
+
+// consume splits b, read from the file at f.offset, into lines, and
+// advances f.offset past it.
+func (f *File) consume(b []byte) {
+	end := f.offset + int64(len(b))
+	if f.atMostOnce {
+		f.commitAhead(b)
+	}
+	if f.nulSkip > 0 {
+		f.splitSkippingNULs(b)
+	} else {
+		f.split(b)
+	}
+	f.offset = end
+}
+
+// splitSkippingNULs splits b into lines like split, except that runs of at
+// least f.nulSkip NUL bytes, such as preallocated space or a hole left by a
+// crash, are skipped.  A run reaching the end of b may continue in the next
+// read, so whether it's skipped is decided once it ends.
+func (f *File) splitSkippingNULs(b []byte) {
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, 0)
+		if i != 0 {
+			if i < 0 {
+				i = len(b)
+			}
+			f.endNULRun()
+			f.split(b[:i])
+			f.offset += int64(i)
+			b = b[i:]
+			continue
+		}
+		n := 0
+		for n < len(b) && b[n] == 0 {
+			n++
+		}
+		f.nulRun += int64(n)
+		f.offset += int64(n)
+		b = b[n:]
+	}
+}
+
+// endNULRun handles the run of NUL bytes just before f.offset, now that
+// it's followed by other data.  A short run is split into lines like any
+// other data; a long one is skipped, ending the partial line before it.
+func (f *File) endNULRun() {
+	if f.nulRun == 0 {
+		return
+	}
+	run := f.nulRun
+	f.nulRun = 0
+	if run < int64(f.nulSkip) {
+		end := f.offset
+		f.offset -= run
+		f.split(make([]byte, run))
+		f.offset = end
+		return
+	}
+	f.logger.With(map[string]interface{}{"path": f.Pathname, "offset": f.offset - run}).Infof("Skipped %d NUL bytes in %s", run, f.Pathname)
+	f.metrics.nulSkipped.Add(f.Name, run)
+	f.lockPartial()
+	if f.partial.Len() > 0 {
+		f.sendLine()
+	}
+	f.unlockPartial()
+	f.discarding = false
+	f.lineStart = f.offset
+}
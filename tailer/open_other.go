@@ -0,0 +1,30 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package tailer
+
+import (
+	"os"
+	"syscall"
+)
+
+// openForRead opens pathname to be read.  O_NONBLOCK stops the open of a
+// FIFO waiting for a writer; pipes are then read without waiting for data,
+// by readPipe.
+func openForRead(pathname string) (*os.File, error) {
+	return os.OpenFile(pathname, os.O_RDONLY|syscall.O_NONBLOCK, 0600)
+}
+
+// isRetryableOpen returns false, as only Windows has opens that fail while
+// another process has the file open.
+func isRetryableOpen(err error) bool {
+	return false
+}
+
+// isDeletePending returns false, as a deleted file's name goes at once here.
+func isDeletePending(err error) bool {
+	return false
+}
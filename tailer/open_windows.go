@@ -0,0 +1,103 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package tailer
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// openShareMode lets other processes read and write a file while it's open,
+// and delete or rename it, so that tailing a log doesn't stop the
+// application writing it from rotating it.
+const openShareMode = syscall.FILE_SHARE_READ | syscall.FILE_SHARE_WRITE | syscall.FILE_SHARE_DELETE
+
+// Windows system error codes missing from syscall.
+const (
+	errorSharingViolation syscall.Errno = 32  // ERROR_SHARING_VIOLATION
+	errorDeletePending    syscall.Errno = 303 // ERROR_DELETE_PENDING
+)
+
+// createFile is syscall.CreateFile, replaced by tests.
+var createFile = syscall.CreateFile
+
+// openForRead opens pathname to be read, sharing it with other processes as
+// openShareMode says.  It's opened by its extended-length form, so that it
+// may be longer than MAX_PATH.
+func openForRead(pathname string) (*os.File, error) {
+	p, err := syscall.UTF16PtrFromString(watcher.ExtendPath(pathname))
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: pathname, Err: err}
+	}
+	h, err := createFile(p, syscall.GENERIC_READ, openShareMode, nil, syscall.OPEN_EXISTING, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: pathname, Err: err}
+	}
+	return os.NewFile(uintptr(h), pathname), nil
+}
+
+// errno returns the system error code err was caused by, if any.
+func errno(err error) (syscall.Errno, bool) {
+	err = errors.Cause(err)
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	e, ok := err.(syscall.Errno)
+	return e, ok
+}
+
+// isRetryableOpen indicates if an open failed with err because another
+// process, such as the application writing the file, has it open without
+// sharing it, which it usually does only for a moment.
+func isRetryableOpen(err error) bool {
+	e, ok := errno(err)
+	return ok && (e == errorSharingViolation || isDeletePending(err))
+}
+
+// isDeletePending indicates if err comes from a file that has been deleted
+// while it's still open.  Its name stays until the last handle on it is
+// closed, and opening or looking it up in the meantime is refused, mostly as
+// access denied, which is only taken to mean a deletion is pending if
+// deletePending finds one.
+func isDeletePending(err error) bool {
+	e, ok := errno(err)
+	if !ok {
+		return false
+	}
+	if e == errorDeletePending {
+		return true
+	}
+	pe, ok := errors.Cause(err).(*os.PathError)
+	return ok && e == syscall.ERROR_ACCESS_DENIED && deletePending(pe.Path)
+}
+
+// deletePending indicates if the file at pathname, which access has been
+// denied to, is waiting to be deleted.  Looking up its attributes is denied
+// too, though its name is still listed in its directory; a file that's only
+// denied by its permissions lets its attributes be read.
+func deletePending(pathname string) bool {
+	p, err := syscall.UTF16PtrFromString(watcher.ExtendPath(pathname))
+	if err != nil {
+		return false
+	}
+	var attrs syscall.Win32FileAttributeData
+	if err := syscall.GetFileAttributesEx(p, syscall.GetFileExInfoStandard, (*byte)(unsafe.Pointer(&attrs))); err != syscall.ERROR_ACCESS_DENIED {
+		return false
+	}
+	var data syscall.Win32finddata
+	h, err := syscall.FindFirstFile(p, &data)
+	if err != nil {
+		return false
+	}
+	syscall.FindClose(h)
+	return true
+}
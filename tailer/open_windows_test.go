@@ -0,0 +1,54 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows
+// +build windows
+
+package tailer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/sgtsquiggs/tail/testutil"
+)
+
+func TestOpenForReadShareMode(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("line\n"), 0600))
+
+	var (
+		opened string
+		access uint32
+		mode   uint32
+	)
+	orig := createFile
+	defer func() { createFile = orig }()
+	createFile = func(name *uint16, acc, share uint32, sa *syscall.SecurityAttributes, disp, attrs uint32, tmpl int32) (syscall.Handle, error) {
+		opened, access, mode = syscall.UTF16ToString((*[syscall.MAX_LONG_PATH]uint16)(unsafe.Pointer(name))[:]), acc, share
+		return syscall.CreateFile(name, acc, share, sa, disp, attrs, tmpl)
+	}
+
+	f, err := openForRead(logfile)
+	testutil.FatalIfErr(t, err)
+	defer f.Close()
+	if !strings.HasPrefix(opened, `\\?\`) {
+		t.Errorf("expected the extended-length path to be opened, got %q", opened)
+	}
+	if access != syscall.GENERIC_READ {
+		t.Errorf("expected read access, got %#x", access)
+	}
+	if mode != openShareMode || mode&syscall.FILE_SHARE_DELETE == 0 {
+		t.Errorf("expected share mode %#x including FILE_SHARE_DELETE, got %#x", openShareMode, mode)
+	}
+
+	// The writer can rotate the file while it's open.
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+const (
+	// panicRetryDelay is how long to wait before reading a file again after
+	// a read panicked, doubling with each further panic in a row up to
+	// maxPanicRetryDelay.
+	panicRetryDelay    = 100 * time.Millisecond
+	maxPanicRetryDelay = 30 * time.Second
+	// maxReadPanics is how many reads of a file in a row may panic before it
+	// stops being tailed.
+	maxReadPanics = 5
+)
+
+// ErrReadPanic is the Err of a ReadPanicked FileEvent.
+type ErrReadPanic struct {
+	Value  interface{} // What the read panicked with
+	Stack  []byte      // The stack of the read when it panicked
+	Panics int         // Reads of the file in a row that have panicked
+	GaveUp bool        // The file has stopped being tailed
+}
+
+func (e *ErrReadPanic) Error() string {
+	return fmt.Sprintf("read panicked: %v", e.Value)
+}
+
+// guard calls read, which reads f, and returns an *ErrReadPanic if it
+// panics rather than letting the panic kill the goroutine.  The partial line
+// is dropped, and the line being read when it panicked is skipped by the
+// next read, so that a line that makes every read panic doesn't stop the
+// rest of the file being read.
+func (f *File) guard(read func() error) (err error) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		err = &ErrReadPanic{Value: r, Stack: debug.Stack()}
+		if !f.partialLocked {
+			// Otherwise the panic left it locked.
+			f.lockPartial()
+		}
+		f.resetPartial()
+		f.unlockPartial()
+		if serr := f.seekTo(f.lineStart); serr != nil {
+			f.logger.Info(serr)
+		}
+		f.discarding = true
+	}()
+	return read()
+}
+
+// readPanicked reports that reading f panicked with p, logging its stack,
+// counting it and sending a ReadPanicked event.  It returns how long to
+// wait before reading f again, or false if f has panicked too many times in
+// a row and is no longer to be read.
+func (t *Tailer) readPanicked(f *File, p *ErrReadPanic) (time.Duration, bool) {
+	f.panics++
+	p.Panics = f.panics
+	p.GaveUp = f.panics >= maxReadPanics
+	t.metrics.readPanics.Add(f.safePath, 1)
+	f.errors.add(FileError{Time: t.clock.Now(), Op: "read", Err: p})
+	logger := t.logger.With(map[string]interface{}{"path": f.Pathname})
+	logger.Errorf("Read of %s panicked: %v\n%s", f.Pathname, p.Value, p.Stack)
+	if p.GaveUp {
+		logger.Errorf("Not tailing %s after %d reads in a row panicked", f.Pathname, f.panics)
+	}
+	t.sendEvent(FileEvent{Type: ReadPanicked, Name: f.Name, Pathname: f.Pathname, Err: p})
+	if p.GaveUp {
+		return 0, false
+	}
+	delay := panicRetryDelay
+	for i := 1; i < f.panics && delay < maxPanicRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxPanicRetryDelay {
+		delay = maxPanicRetryDelay
+	}
+	return delay, true
+}
+
+// followPanicked handles a panic while following fd, by reading it again
+// after a delay, or giving up on it.
+func (t *Tailer) followPanicked(fd *File, p *ErrReadPanic) {
+	delay, ok := t.readPanicked(fd, p)
+	if !ok {
+		t.bury(fd)
+		t.closeHandle(fd)
+		return
+	}
+	t.throttle(fd, t.clock.Now().Add(delay))
+}
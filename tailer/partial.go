@@ -0,0 +1,62 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "sync/atomic"
+
+// PartialState describes the partial line held by a file, which is read but
+// not yet sent because its newline hasn't been read.
+type PartialState struct {
+	Bytes     int64 // Size of the partial line
+	HighWater int64 // Largest size of the partial line in this generation of the file
+	Flushes   int64 // Partial lines sent early, to stay within the budget or on a quiet shutdown
+}
+
+// partialStats is a File's record of its partial line, kept atomically so
+// Stats can read it while the file is being read.  It's updated each time
+// the partial buffer is appended to or emptied, not for every byte.
+type partialStats struct {
+	bytes     int64 // accessed atomically
+	highWater int64 // accessed atomically
+	flushes   int64 // accessed atomically
+}
+
+// notePartial records the size of the partial buffer after it changed, and
+// adds the change to the Tailer's total.
+func (f *File) notePartial() {
+	n := int64(f.partial.Len())
+	if old := atomic.SwapInt64(&f.partialStats.bytes, n); old != n {
+		f.metrics.partialBytes.Add(n - old)
+	}
+	if n > atomic.LoadInt64(&f.partialStats.highWater) {
+		atomic.StoreInt64(&f.partialStats.highWater, n)
+	}
+}
+
+// noteFlush records that the partial line was sent early.
+func (f *File) noteFlush() {
+	f.metrics.partialFlushes.Add(f.Name, 1)
+	atomic.AddInt64(&f.partialStats.flushes, 1)
+}
+
+// resetHighWater starts the partial buffer's high water mark again for a new
+// generation of the file.
+func (f *File) resetHighWater() {
+	atomic.StoreInt64(&f.partialStats.highWater, atomic.LoadInt64(&f.partialStats.bytes))
+}
+
+// forgetPartial takes the partial line out of the Tailer's total when the
+// File is closed.
+func (f *File) forgetPartial() {
+	f.metrics.partialBytes.Add(-atomic.SwapInt64(&f.partialStats.bytes, 0))
+}
+
+// partialState returns the state of the File's partial line.
+func (f *File) partialState() PartialState {
+	return PartialState{
+		Bytes:     atomic.LoadInt64(&f.partialStats.bytes),
+		HighWater: atomic.LoadInt64(&f.partialStats.highWater),
+		Flushes:   atomic.LoadInt64(&f.partialStats.flushes),
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// WithCaseFolding identifies the files tailed by their paths without regard
+// to case if fold is true, so that two spellings of the same file, such as
+// one given to TailPath and another in an event from the watcher, share one
+// handle, and patterns match names whatever their case.  The lines read keep
+// the name as it was given.  By default paths are folded when
+// watcher.CaseInsensitivePaths is true, as on Windows and macOS; it should
+// match the watcher's own WithCaseFolding.
+func WithCaseFolding(fold bool) Option {
+	return func(t *Tailer) error {
+		t.foldCase = fold
+		return nil
+	}
+}
+
+// fold returns the form of the absolute path pathname that it's compared by.
+func (t *Tailer) fold(pathname string) string {
+	return watcher.PathKey(pathname, t.foldCase)
+}
+
+// pathKey returns the canonical path of pathname, as compared by: the key of
+// its handle and registrations.
+func (t *Tailer) pathKey(pathname string) (string, error) {
+	key, err := canonicalPath(pathname)
+	if err != nil {
+		return "", err
+	}
+	return t.fold(key), nil
+}
+
+// matchPattern reports whether pathname matches the glob pattern, without
+// regard to case if paths are folded.
+func (t *Tailer) matchPattern(pattern, pathname string) (bool, error) {
+	return filepath.Match(t.fold(pattern), t.fold(pathname))
+}
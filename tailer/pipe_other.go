@@ -0,0 +1,13 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package tailer
+
+// readPipe reads from the pipe into b.  There are no FIFOs here, so it's an
+// ordinary read.
+func (f *File) readPipe(b []byte) (int, error) {
+	return f.file.Read(b)
+}
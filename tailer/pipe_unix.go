@@ -0,0 +1,43 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tailer
+
+import (
+	"io"
+	"syscall"
+)
+
+// readPipe reads what is in the pipe now into b, without waiting for more.
+// It returns io.EOF when the pipe is empty, whether or not a writer has it
+// open, so that a read never parks the goroutine and Close can't hang on a
+// FIFO nobody writes to.  The next event for the pipe reads on.
+func (f *File) readPipe(b []byte) (int, error) {
+	rc, err := f.file.SyscallConn()
+	if err != nil {
+		return f.file.Read(b)
+	}
+	var n int
+	var rerr error
+	// Returning true stops the runtime from waiting for the pipe to be
+	// readable when the read would block.
+	if err := rc.Read(func(fd uintptr) bool {
+		n, rerr = syscall.Read(int(fd), b)
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	switch {
+	case rerr == syscall.EAGAIN || rerr == syscall.EINTR:
+		return 0, io.EOF
+	case rerr != nil:
+		return 0, rerr
+	case n == 0:
+		// No writer has the pipe open.
+		return 0, io.EOF
+	}
+	return n, nil
+}
@@ -0,0 +1,177 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tailer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/testutil"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+func TestTailPathSpecialFiles(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	dir := filepath.Join(tmpDir, "dir")
+	testutil.FatalIfErr(t, os.Mkdir(dir, 0700))
+	fifo := filepath.Join(tmpDir, "fifo")
+	testutil.FatalIfErr(t, syscall.Mkfifo(fifo, 0600))
+	sock := filepath.Join(tmpDir, "sock")
+	l, err := net.Listen("unix", sock)
+	testutil.FatalIfErr(t, err)
+	defer l.Close()
+
+	for _, tc := range []struct {
+		pathname string
+		mode     os.FileMode
+		special  bool // Tailed when WithSpecialFiles is given
+	}{
+		{dir, os.ModeDir, true},
+		{fifo, os.ModeNamedPipe, true},
+		{sock, os.ModeSocket, false},
+		{"/dev/null", os.ModeDevice | os.ModeCharDevice, false},
+	} {
+		t.Run(filepath.Base(tc.pathname), func(t *testing.T) {
+			ta, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher())
+			testutil.FatalIfErr(t, err)
+			defer ta.Close()
+			err = ta.TailPath(tc.pathname)
+			e, ok := err.(*ErrNotRegularFile)
+			if !ok {
+				t.Fatalf("expected an ErrNotRegularFile, got %v", err)
+			}
+			if e.Mode != tc.mode {
+				t.Errorf("expected mode %v, got %v", tc.mode, e.Mode)
+			}
+
+			special, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithSpecialFiles())
+			testutil.FatalIfErr(t, err)
+			defer special.Close()
+			err = special.TailPath(tc.pathname)
+			if _, ok := err.(*ErrNotRegularFile); ok == tc.special {
+				t.Errorf("WithSpecialFiles: unexpected result %v", err)
+			}
+		})
+	}
+}
+
+func TestTailPathSpecialFilesRead(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	dir := filepath.Join(tmpDir, "dir")
+	testutil.FatalIfErr(t, os.Mkdir(dir, 0700))
+	testutil.FatalIfErr(t, os.Mkdir(filepath.Join(dir, "subdir"), 0700))
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	fifo := filepath.Join(tmpDir, "fifo")
+	testutil.FatalIfErr(t, syscall.Mkfifo(fifo, 0600))
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, WithSpecialFiles())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(dir))
+	testutil.FatalIfErr(t, ta.TailPath(fifo))
+
+	testutil.WriteString(t, f, "from dir\n")
+	w.InjectUpdate(logfile)
+	p, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+	testutil.FatalIfErr(t, err)
+	defer p.Close()
+	testutil.WriteString(t, p, "from fifo\n")
+	w.InjectUpdate(fifo)
+
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+	sort.Slice(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "from dir"},
+		{Filename: fifo, Line: "from fifo", Source: logline.Pipe},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailFIFOClose(t *testing.T) {
+	for _, writer := range []bool{false, true} {
+		t.Run(fmt.Sprintf("writer=%v", writer), func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+			fifo := filepath.Join(tmpDir, "fifo")
+			testutil.FatalIfErr(t, syscall.Mkfifo(fifo, 0600))
+
+			w := watcher.NewFakeWatcher()
+			ta, err := New(make(chan *logline.LogLine), w, WithSpecialFiles())
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, ta.TailPath(fifo))
+			if writer {
+				// Connected but never writing.  It can be opened without
+				// blocking now that the FIFO is open for reading.
+				p, err := os.OpenFile(fifo, os.O_WRONLY|syscall.O_NONBLOCK, 0)
+				testutil.FatalIfErr(t, err)
+				defer p.Close()
+			}
+			w.InjectUpdateAndWait(fifo)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- ta.Close()
+			}()
+			select {
+			case err := <-done:
+				testutil.FatalIfErr(t, err)
+			case <-time.After(time.Second):
+				t.Fatal("Close didn't return for a FIFO with no data")
+			}
+		})
+	}
+}
+
+func TestReadPipeSource(t *testing.T) {
+	lines := make(chan *logline.LogLine, 1)
+
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := path.Join(tmpDir, "fifo")
+	testutil.FatalIfErr(t, syscall.Mkfifo(logfile, 0600))
+
+	f, err := NewFile(logfile, lines, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	fd, err := os.OpenFile(logfile, os.O_WRONLY, 0600)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, fd, "a\n")
+	testutil.FatalIfErr(t, fd.Close())
+
+	if err := f.Read(); err != io.EOF {
+		t.Errorf("error returned not EOF: %v", err)
+	}
+	close(lines)
+
+	expected := &logline.LogLine{Filename: logfile, Line: "a", Source: logline.Pipe}
+	if diff := testutil.Diff(expected, <-lines); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import "fmt"
+
+// StartPolicy says where to start reading a file that already exists when
+// it's first tailed.  Files that are created while their pattern is being
+// watched, and the new file after a rotation, are always read from the
+// beginning.  The zero StartPolicy starts at the end, or at the beginning in
+// OneShot mode.
+type StartPolicy struct {
+	kind  startKind
+	n     int64
+	force bool // Read from the beginning even if larger than the initial size limit
+}
+
+type startKind int
+
+const (
+	startDefault startKind = iota
+	startBeginning
+	startEnd
+	startLastN
+	startOffset // Used for a renamed file, to continue where it was read up to
+)
+
+var (
+	// Beginning reads the whole of the file.
+	Beginning = StartPolicy{kind: startBeginning}
+	// End reads only what's written to the file from now on.
+	End = StartPolicy{kind: startEnd}
+	// Full reads the whole of the file, even if it's larger than the size
+	// given to WithMaxInitialFileSize.
+	Full = StartPolicy{kind: startBeginning, force: true}
+)
+
+// LastNBytes reads what's written to the file from now on, plus the complete
+// lines in its last n bytes.
+func LastNBytes(n int64) StartPolicy {
+	return StartPolicy{kind: startLastN, n: n}
+}
+
+func (p StartPolicy) String() string {
+	switch p.kind {
+	case startDefault:
+		return "default"
+	case startBeginning:
+		if p.force {
+			return "full"
+		}
+		return "beginning"
+	case startEnd:
+		return "end"
+	case startLastN:
+		return fmt.Sprintf("last %d bytes", p.n)
+	case startOffset:
+		return fmt.Sprintf("offset %d", p.n)
+	}
+	return fmt.Sprintf("StartPolicy(%d)", p.kind)
+}
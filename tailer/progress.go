@@ -0,0 +1,93 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync"
+	"time"
+)
+
+// BackfillProgress describes how far through reading its existing contents
+// a file is.
+type BackfillProgress struct {
+	BytesRead int64         // Bytes read since the file was opened
+	Target    int64         // Bytes to read to catch up, including growth since the file was opened
+	Percent   float64       // BytesRead as a percentage of Target
+	ETA       time.Duration // Estimated time to catch up at the recent rate of reading, or 0 if unknown
+}
+
+// progressSample is how often the rate of reading is measured.
+const progressSample = time.Second
+
+// progress tracks a File's backfill, from the offset it was opened at to the
+// end of the file.
+type progress struct {
+	mu           sync.Mutex
+	active       bool
+	start        int64     // offset the backfill started at
+	target       int64     // offset the backfill is complete at
+	offset       int64     // offset read up to
+	begun        time.Time // when the backfill started
+	sampleTime   time.Time // start of the current rate sample
+	sampleOffset int64     // offset at sampleTime
+	throughput   float64   // bytes per second in the last complete sample
+}
+
+// begin starts tracking a backfill from offset up to size.
+func (p *progress) begin(offset, size int64, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.active = true
+	p.start, p.target, p.offset = offset, size, offset
+	p.begun, p.sampleTime, p.sampleOffset = now, now, offset
+}
+
+// update records that the file has been read up to offset, and returns true
+// if the backfill has just completed because the read reached EOF.
+func (p *progress) update(offset int64, eof bool, now time.Time) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active {
+		return false
+	}
+	p.offset = offset
+	if offset > p.target {
+		// The file has grown since it was opened.
+		p.target = offset
+	}
+	if dt := now.Sub(p.sampleTime); dt >= progressSample {
+		p.throughput = float64(offset-p.sampleOffset) / dt.Seconds()
+		p.sampleTime, p.sampleOffset = now, offset
+	}
+	if eof {
+		p.active = false
+		return true
+	}
+	return false
+}
+
+// state returns the progress of the backfill, and false if there isn't one
+// in progress.
+func (p *progress) state(now time.Time) (BackfillProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.active {
+		return BackfillProgress{}, false
+	}
+	s := BackfillProgress{BytesRead: p.offset - p.start, Target: p.target - p.start, Percent: 100}
+	if s.Target > 0 {
+		s.Percent = float64(s.BytesRead) / float64(s.Target) * 100
+	}
+	throughput := p.throughput
+	if throughput == 0 {
+		// Use the average until there's a complete sample.
+		if elapsed := now.Sub(p.begun).Seconds(); elapsed > 0 {
+			throughput = float64(s.BytesRead) / elapsed
+		}
+	}
+	if throughput > 0 {
+		s.ETA = time.Duration(float64(s.Target-s.BytesRead) / throughput * float64(time.Second))
+	}
+	return s, true
+}
@@ -0,0 +1,105 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// QuietState is the countdown to a Tailer shutting itself down because
+// nothing has been read.
+type QuietState struct {
+	Quiet     time.Duration // Time since a line was last sent or a file was last opened
+	Remaining time.Duration // Time left until the shutdown, or 0 if it's due
+	Waiting   bool          // The shutdown is due, but waiting for backfills to finish
+}
+
+// quietShutdown tracks the time since the last activity of a Tailer.
+type quietShutdown struct {
+	last    int64 // When a line was last sent or a file opened, in Unix nanoseconds; accessed atomically
+	waiting int32 // The shutdown is waiting for backfills; accessed atomically
+	d       time.Duration
+}
+
+// touch records activity at now.  It's safe to call on a nil quietShutdown.
+func (q *quietShutdown) touch(now time.Time) {
+	if q != nil {
+		atomic.StoreInt64(&q.last, now.UnixNano())
+	}
+}
+
+// state returns the countdown at now.
+func (q *quietShutdown) state(now time.Time) QuietState {
+	s := QuietState{Quiet: now.Sub(time.Unix(0, atomic.LoadInt64(&q.last)))}
+	if s.Quiet < q.d {
+		s.Remaining = q.d - s.Quiet
+	}
+	s.Waiting = atomic.LoadInt32(&q.waiting) != 0
+	return s
+}
+
+// backfilling returns true if there are files queued for or being read by
+// backfill workers.
+func (t *Tailer) backfilling() bool {
+	q := t.queue
+	if q == nil {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending) > 0
+}
+
+// runQuietShutdown closes the Tailer once nothing has been read for the
+// quiet period and no backfills are left.
+func (t *Tailer) runQuietShutdown() {
+	q := t.quiet
+	for {
+		wait := q.state(t.clock.Now()).Remaining
+		if wait == 0 {
+			if !t.backfilling() {
+				break
+			}
+			atomic.StoreInt32(&q.waiting, 1)
+			// Check again shortly; the backfills don't send lines until
+			// they have opened their files.
+			wait = q.d / 10
+		} else {
+			atomic.StoreInt32(&q.waiting, 0)
+		}
+		select {
+		case <-t.clock.After(wait):
+		case <-t.runDone:
+			return
+		}
+	}
+	t.logger.Infof("Nothing read for %s, shutting down tailer", q.d)
+	if t.flushOnDelete {
+		if err := t.inRun(func() error {
+			t.flushPartials()
+			return nil
+		}); err != nil {
+			return
+		}
+	}
+	if err := t.Close(); err != nil {
+		t.logger.Info(err)
+	}
+}
+
+// flushPartials sends the partial line of every file being tailed, marked
+// truncated.
+func (t *Tailer) flushPartials() {
+	t.handles.Range(func(_, v interface{}) bool {
+		f := v.(*File)
+		f.lockPartial()
+		if f.partial.Len() > 0 {
+			f.flushPartial()
+		}
+		f.unlockPartial()
+		f.endRepeats()
+		return true
+	})
+}
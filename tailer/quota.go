@@ -0,0 +1,61 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+// quota limits the lines and bytes sent from a File.
+type quota struct {
+	maxLines int64 // Lines to send before stopping, if > 0
+	maxBytes int64 // Bytes of lines, including their newlines, to send before stopping, if > 0
+	reset    bool  // Start again on each new generation of the file
+
+	lines, bytes int64 // Sent so far
+	reached      bool  // The quota has been used up, so the File isn't read any more
+}
+
+// take returns true if a line of n bytes, not counting its newline, fits in
+// the quota, and counts it if so.  Once a line doesn't fit the quota is
+// reached, so no later line is sent either.
+func (q *quota) take(n int) bool {
+	if q.reached {
+		return false
+	}
+	if (q.maxLines > 0 && q.lines >= q.maxLines) || (q.maxBytes > 0 && q.bytes+int64(n)+1 > q.maxBytes) {
+		q.reached = true
+		return false
+	}
+	q.lines++
+	q.bytes += int64(n) + 1
+	return true
+}
+
+// quotaReached returns true if the File has used up its quota.
+func (f *File) quotaReached() bool {
+	return f.quota != nil && f.quota.reached
+}
+
+// takeQuota returns true if line can be sent within the File's quota.  When
+// the quota is first found to be used up, a QuotaReached event is sent.
+func (f *File) takeQuota(line string) bool {
+	if f.quota == nil {
+		return true
+	}
+	if f.quota.reached {
+		return false
+	}
+	if f.quota.take(len(line)) {
+		return true
+	}
+	f.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("%s has reached its quota of %d lines, %d bytes, no longer reading it", f.Pathname, f.quota.lines, f.quota.bytes)
+	f.metrics.quotasReached.Add(f.Name, 1)
+	f.sendEvent(QuotaReached)
+	return false
+}
+
+// resetQuota starts the quota again for a new generation of the File, if
+// it's reset on rotation.
+func (f *File) resetQuota() {
+	if f.quota != nil && f.quota.reset {
+		f.quota.lines, f.quota.bytes, f.quota.reached = 0, 0, false
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+)
+
+// ThrottleState describes a byte rate limit on reads.
+type ThrottleState struct {
+	BytesPerSec int64 // The limit
+	Available   int64 // Bytes that may be read now
+	Throttled   bool  // Reads are waiting for the limit
+}
+
+// byteRate is a token bucket limiting the rate of reads from a file.  The
+// bucket holds up to one second's worth of bytes.  A rate of zero is
+// unlimited.
+type byteRate struct {
+	mu        sync.Mutex
+	clock     clock.Clock
+	rate      int64     // bytes per second, or 0 for no limit
+	tokens    float64   // bytes that may be read now
+	last      time.Time // when tokens was last refilled
+	throttled bool      // the last take granted nothing
+}
+
+func newByteRate(rate int64, clk clock.Clock) *byteRate {
+	return &byteRate{clock: clk, rate: rate, tokens: float64(rate), last: clk.Now()}
+}
+
+// refill adds the tokens accrued since the last refill.  r.mu must be held.
+func (r *byteRate) refill() {
+	now := r.clock.Now()
+	r.tokens += now.Sub(r.last).Seconds() * float64(r.rate)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+	r.last = now
+}
+
+// setRate changes the limit.  A rate of zero removes it.
+func (r *byteRate) setRate(rate int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		// Start a new limit with a full bucket.
+		r.tokens = float64(rate)
+		r.last = r.clock.Now()
+	} else {
+		r.refill()
+	}
+	r.rate = rate
+	if r.tokens > float64(rate) {
+		r.tokens = float64(rate)
+	}
+	if rate == 0 {
+		r.throttled = false
+	}
+}
+
+// take grants up to n bytes to be read now.  If nothing can be granted, it
+// returns how long until there's enough to be worth reading.
+func (r *byteRate) take(n int64) (int64, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		return n, 0
+	}
+	r.refill()
+	if r.tokens < 1 {
+		r.throttled = true
+		want := n
+		if want > r.rate {
+			want = r.rate
+		}
+		wait := time.Duration((float64(want) - r.tokens) / float64(r.rate) * float64(time.Second))
+		if wait <= 0 {
+			wait = time.Millisecond
+		}
+		return 0, wait
+	}
+	r.throttled = false
+	grant := int64(r.tokens)
+	if grant > n {
+		grant = n
+	}
+	r.tokens -= float64(grant)
+	return grant, 0
+}
+
+// give returns bytes that were granted but not read.
+func (r *byteRate) give(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate == 0 {
+		return
+	}
+	r.tokens += float64(n)
+	if r.tokens > float64(r.rate) {
+		r.tokens = float64(r.rate)
+	}
+}
+
+func (r *byteRate) state() ThrottleState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.rate != 0 {
+		r.refill()
+	}
+	return ThrottleState{BytesPerSec: r.rate, Available: int64(r.tokens), Throttled: r.throttled}
+}
+
+// minShare is the smallest share of a sharedRate given to each File.
+const minShare = 4096
+
+// sharedRate is a byteRate shared by many Files.  Each File reading in the
+// event loop takes at most an equal share of the limit before yielding to
+// the others.
+type sharedRate struct {
+	*byteRate
+	users   int64 // Files sharing the limit; accessed atomically
+	metrics *metrics
+}
+
+func newSharedRate(rate int64, clk clock.Clock, m *metrics) *sharedRate {
+	return &sharedRate{byteRate: newByteRate(rate, clk), metrics: m}
+}
+
+func (s *sharedRate) add()    { atomic.AddInt64(&s.users, 1) }
+func (s *sharedRate) remove() { atomic.AddInt64(&s.users, -1) }
+
+// share returns how many bytes each File may read per turn.
+func (s *sharedRate) share() int64 {
+	s.mu.Lock()
+	rate := s.rate
+	s.mu.Unlock()
+	users := atomic.LoadInt64(&s.users)
+	if users < 1 {
+		users = 1
+	}
+	share := rate / users
+	if share < minShare {
+		share = minShare
+	}
+	return share
+}
+
+func (s *sharedRate) take(n int64) (int64, time.Duration) {
+	grant, d := s.byteRate.take(n)
+	s.metrics.globalRateRequested.Add(n)
+	s.metrics.globalRateGranted.Add(grant)
+	return grant, d
+}
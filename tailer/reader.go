@@ -0,0 +1,299 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/clock"
+)
+
+const defaultReaderBufferSize = 64 * 1024
+
+// OverflowPolicy says what a reader from NewReader does with a line when
+// its buffer is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for Read to make room, which holds back the
+	// Tailer.
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest drops the line.
+	OverflowDropNewest
+	// OverflowDropOldest drops the oldest buffered lines to make room.  A
+	// line that's partly read is never dropped.
+	OverflowDropOldest
+)
+
+// ReaderOption configures the reader returned by NewReader.
+type ReaderOption func(*reader)
+
+// WithReaderFilename prefixes each line with the name of the file it was
+// read from and ": ", for a stream read from more than one file.
+func WithReaderFilename() ReaderOption {
+	return func(r *reader) {
+		r.filename = true
+	}
+}
+
+// WithReaderBuffer buffers up to size bytes of lines not yet read, rather
+// than 64KiB, and applies policy to lines that don't fit.  A line longer than
+// size is buffered once the buffer is empty.
+func WithReaderBuffer(size int, policy OverflowPolicy) ReaderOption {
+	return func(r *reader) {
+		if size > 0 {
+			r.size = size
+		}
+		r.overflow = policy
+	}
+}
+
+// WithReaderDropMarker adds a line to the stream for each file whose lines
+// the overflow policy has dropped, once it's buffering lines again, so that
+// consumers can tell where there are gaps.  The line is prefix followed by
+// "dropped N lines, M bytes from FILENAME between FIRST and LAST", the times
+// of the first and last lines dropped.  The marker is never dropped itself:
+// it's buffered beyond the size if need be, and if the reader ends first it's
+// added at the end.  The drops are counted whether or not there are
+// markers.
+func WithReaderDropMarker(prefix string) ReaderOption {
+	return func(r *reader) {
+		r.marker = prefix
+	}
+}
+
+// reader is the io.ReadCloser returned by NewReader.
+type reader struct {
+	it           *LineIterator
+	clock        clock.Clock
+	dropped      *expvar.Int // Counts the lines dropped because the buffer was full
+	droppedBytes *expvar.Int // Counts the bytes of those lines
+	filename     bool
+	size         int
+	overflow     OverflowPolicy
+	marker       string // Prefix of the lines saying what's been dropped, if not empty
+
+	mu      sync.Mutex
+	cond    *sync.Cond          // Signalled when lines are added or removed, or the reader ends
+	queue   []queuedLine        // Lines not yet read; the first may be partly read
+	n       int                 // Bytes in queue
+	partial bool                // The first line in queue has been partly read
+	gaps    map[string]*dropGap // Lines dropped since the last marker, by filename, if there are markers
+	err     error               // Why no more lines will be added, if not nil
+	closed  bool                // Close has been called
+}
+
+// queuedLine is a line buffered by a reader.
+type queuedLine struct {
+	b        []byte // The line as it's read, including its newline
+	ack      func() // Acknowledges the line once it's read, if not nil
+	filename string // The file the line was read from
+	marker   bool   // The line says what's been dropped
+}
+
+// dropGap is a run of lines from one file dropped by a reader.
+type dropGap struct {
+	lines       int
+	bytes       int
+	first, last time.Time
+}
+
+// NewReader returns a stream of the lines read by t, each ending with a
+// newline, for consumers that take an io.Reader.  It reads them through a
+// LineIterator, so t must have been created without a Lines channel, and
+// with FanOut to have more than one reader.  Read blocks until there's data,
+// and returns io.EOF once t has shut down and the lines sent before then
+// have been read.  Close detaches the Reader from t without stopping it.
+// With AtLeastOnce delivery, each line is acknowledged once it has been read
+// in full, and a reader that drops lines can't be used: its Read returns an
+// error.
+func NewReader(t *Tailer, opts ...ReaderOption) io.ReadCloser {
+	r := &reader{clock: t.clock, dropped: &t.metrics.readerDropped, droppedBytes: &t.metrics.readerDroppedBytes, size: defaultReaderBufferSize}
+	r.cond = sync.NewCond(&r.mu)
+	for _, opt := range opts {
+		opt(r)
+	}
+	if t.deliveryMode == AtLeastOnce && r.overflow != OverflowBlock {
+		r.err = errors.New("a reader that drops lines can't be used with at-least-once delivery")
+		return r
+	}
+	r.it = t.Lines()
+	go r.run()
+	return r
+}
+
+// run buffers lines from the iterator until it ends.
+func (r *reader) run() {
+	for {
+		l, err := r.it.Next(context.Background())
+		if err != nil {
+			r.mu.Lock()
+			if !r.closed {
+				r.addMarkers()
+			}
+			r.err = err
+			r.cond.Broadcast()
+			r.mu.Unlock()
+			return
+		}
+		b := make([]byte, 0, len(l.Filename)+len(l.Line)+3)
+		if r.filename {
+			b = append(b, l.Filename...)
+			b = append(b, ": "...)
+		}
+		b = append(b, l.Line...)
+		b = append(b, '\n')
+		if !r.add(queuedLine{b: b, ack: l.Ack, filename: l.Filename}) {
+			return
+		}
+	}
+}
+
+// add buffers q as the overflow policy says, and returns false if the
+// reader has been closed.
+func (r *reader) add(q queuedLine) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dropping := false
+full:
+	for r.n > 0 && r.n+len(q.b) > r.size && !r.closed {
+		switch r.overflow {
+		case OverflowDropNewest:
+			r.drop(q)
+			return true
+		case OverflowDropOldest:
+			i := 0
+			if r.partial {
+				i = 1
+			}
+			// Markers are never dropped.
+			for i < len(r.queue) && r.queue[i].marker {
+				i++
+			}
+			if i == len(r.queue) {
+				// Only the partly read line and markers are left, so q is
+				// buffered beyond the limit rather than drop any of them.
+				break full
+			}
+			r.n -= len(r.queue[i].b)
+			r.drop(r.queue[i])
+			r.queue = append(r.queue[:i], r.queue[i+1:]...)
+			dropping = true
+		default:
+			r.cond.Wait()
+		}
+	}
+	if r.closed {
+		return false
+	}
+	if !dropping {
+		// There's room again, so say what was dropped first.
+		r.addMarkers()
+	}
+	r.queue = append(r.queue, q)
+	r.n += len(q.b)
+	r.cond.Broadcast()
+	return true
+}
+
+// drop counts q as dropped, and adds it to the gap to report for its file
+// if there are markers.  r.mu must be held.
+func (r *reader) drop(q queuedLine) {
+	r.dropped.Add(1)
+	r.droppedBytes.Add(int64(len(q.b)))
+	if r.marker == "" {
+		return
+	}
+	now := r.clock.Now()
+	g, ok := r.gaps[q.filename]
+	if !ok {
+		if r.gaps == nil {
+			r.gaps = make(map[string]*dropGap)
+		}
+		g = &dropGap{first: now}
+		r.gaps[q.filename] = g
+	}
+	g.lines++
+	g.bytes += len(q.b)
+	g.last = now
+}
+
+// addMarkers buffers a marker for each file with lines dropped since the
+// last, in order of filename, beyond the size if need be.  r.mu must be
+// held.
+func (r *reader) addMarkers() {
+	if len(r.gaps) == 0 {
+		return
+	}
+	names := make([]string, 0, len(r.gaps))
+	for name := range r.gaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		g := r.gaps[name]
+		b := []byte(fmt.Sprintf("%sdropped %d lines, %d bytes from %s between %s and %s\n", r.marker, g.lines, g.bytes, name, g.first.Format(time.RFC3339Nano), g.last.Format(time.RFC3339Nano)))
+		r.queue = append(r.queue, queuedLine{b: b, marker: true})
+		r.n += len(b)
+	}
+	r.gaps = nil
+}
+
+// Read reads buffered lines into p, blocking until there are some.
+func (r *reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.queue) == 0 && r.err == nil && !r.closed {
+		r.cond.Wait()
+	}
+	if r.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(r.queue) == 0 {
+		if r.err == ErrClosed {
+			return 0, io.EOF
+		}
+		return 0, r.err
+	}
+	read := 0
+	for read < len(p) && len(r.queue) > 0 {
+		n := copy(p[read:], r.queue[0].b)
+		read += n
+		r.n -= n
+		if n < len(r.queue[0].b) {
+			r.queue[0].b = r.queue[0].b[n:]
+			r.partial = true
+			break
+		}
+		if ack := r.queue[0].ack; ack != nil {
+			ack()
+		}
+		r.queue = r.queue[1:]
+		r.partial = false
+	}
+	r.cond.Broadcast()
+	return read, nil
+}
+
+// Close detaches the Reader from its Tailer.  Lines not yet read are
+// discarded, and later calls to Read return io.ErrClosedPipe.
+func (r *reader) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.queue = nil
+	r.cond.Broadcast()
+	r.mu.Unlock()
+	if r.it == nil {
+		return nil
+	}
+	return r.it.Close()
+}
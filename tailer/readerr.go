@@ -0,0 +1,147 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"time"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+const (
+	// readRetryDelay is how long to wait before reading a file again after a
+	// read error, doubling with each further error in a row up to
+	// maxReadRetryDelay.
+	readRetryDelay    = 100 * time.Millisecond
+	maxReadRetryDelay = 30 * time.Second
+	// maxReadFailures is how many reads in a row may fail before the file is
+	// reopened.
+	maxReadFailures = 3
+	// maxOpenRetries is how many times opening a file is tried again, after
+	// the same delays as reads, while another process has it open without
+	// sharing it, on Windows.
+	maxOpenRetries = 8
+)
+
+// readFailed recovers fd after a read failed with err, rather than waiting
+// for an event that may never come: a file that is gone is handled as
+// deleted, one that has been replaced as rotated, and one that looks fine is
+// read again after a delay, and reopened if that keeps failing.
+func (t *Tailer) readFailed(fd *File, err error) {
+	logger := t.limitedLog("read", fd.Pathname).With(map[string]interface{}{"path": fd.Pathname})
+	fi, serr := watcher.StatExtended(fd.Pathname)
+	switch {
+	case os.IsNotExist(serr):
+		t.metrics.readErrorDeleted.Add(fd.safePath, 1)
+		logger.Infof("Read failed on %s, which is gone: %s", fd.Pathname, err)
+		fd.readFailures = 0
+		t.removeDeleted(fd)
+		return
+	case isDeletePending(serr):
+		// On Windows a deleted file's name stays until every handle on it is
+		// closed, ours included, so the Create for a new file at the path may
+		// already have been and gone.  Let go of this one, and look for the new
+		// one once the old has gone.
+		t.metrics.readErrorDeleted.Add(fd.safePath, 1)
+		logger.Infof("Read failed on %s, which is being deleted: %s", fd.Pathname, err)
+		fd.readFailures = 0
+		t.removeDeleted(fd)
+		t.retryOpen(fd.Pathname, Beginning, 1)
+		return
+	case serr == nil && fi.IsDir():
+		t.replaced(fd, fi.Mode())
+		return
+	case serr == nil && !fd.isFile(fi):
+		t.metrics.readErrorRotated.Add(fd.safePath, 1)
+		logger.Infof("Read failed on %s, which has been replaced: %s", fd.Pathname, err)
+		if err := fd.doRotation(); err != nil {
+			logger.Info(err)
+			t.fileFailed(fd, "reopen", err)
+			fd.readFailures++
+			t.retryRead(fd)
+			return
+		}
+		fd.readFailures = 0
+		t.breakerSucceeded(fd, "reopen")
+		if t.rotated(fd) {
+			t.readSoon(fd)
+		}
+		return
+	}
+	fd.readFailures++
+	if fd.readFailures < maxReadFailures {
+		t.metrics.readErrorRetried.Add(fd.safePath, 1)
+		t.retryRead(fd)
+		return
+	}
+	t.metrics.readErrorReopened.Add(fd.safePath, 1)
+	logger.Infof("Reopening %s after %d failed reads: %s", fd.Pathname, fd.readFailures, err)
+	rotated, err := fd.reopen()
+	if err != nil {
+		logger.Info(err)
+		t.fileFailed(fd, "reopen", err)
+		t.retryRead(fd)
+		return
+	}
+	fd.readFailures = 0
+	t.breakerSucceeded(fd, "reopen")
+	if !rotated || t.rotated(fd) {
+		t.readSoon(fd)
+	}
+}
+
+// isFile indicates if fi, from the File's path, is the file it has open.
+func (f *File) isFile(fi os.FileInfo) bool {
+	open, err := f.file.Stat()
+	return err == nil && os.SameFile(open, fi)
+}
+
+// retryRead schedules fd to be read again after a delay that grows with
+// the number of reads that have failed in a row.
+func (t *Tailer) retryRead(fd *File) {
+	delay := readRetryDelay
+	for i := 1; i < fd.readFailures && delay < maxReadRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReadRetryDelay {
+		delay = maxReadRetryDelay
+	}
+	t.throttle(fd, t.clock.Now().Add(delay))
+}
+
+// retryOpen tails pathname after a delay that grows with attempt, the
+// number of times opening it has been retried, unless it's being tailed by
+// then or has been untailed.
+func (t *Tailer) retryOpen(pathname string, policy StartPolicy, attempt int) {
+	delay := readRetryDelay
+	for i := 1; i < attempt && delay < maxReadRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxReadRetryDelay {
+		delay = maxReadRetryDelay
+	}
+	t.sched.At(t.clock.Now().Add(delay), func() {
+		// Called by the scheduler, which mustn't be held up by run.
+		go func() {
+			err := t.inRun(func() error {
+				if t.hasHandle(pathname) || t.buried(pathname) {
+					return nil
+				}
+				return t.openLogPathAttempt(pathname, policy, attempt)
+			})
+			if err != nil {
+				t.limitedLog("open", pathname).Infof("Failed to tail %q: %s", pathname, err)
+			}
+		}()
+	})
+}
+
+// readSoon queues fd to be read again once the other events are handled.
+func (t *Tailer) readSoon(fd *File) {
+	if _, ok := t.againSet[fd]; !ok {
+		t.againSet[fd] = struct{}{}
+		t.again = append(t.again, fd)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// RedactRule replaces the matches of Regexp in lines with Replacement, in
+// which $1 and ${name} stand for submatches as in regexp.Expand.
+type RedactRule struct {
+	Regexp      *regexp.Regexp
+	Replacement string
+}
+
+// redactor is a RedactRule with the literal that every match begins with.
+type redactor struct {
+	RedactRule
+	prefix string
+	name   string
+}
+
+func newRedactor(r RedactRule) redactor {
+	prefix, _ := r.Regexp.LiteralPrefix()
+	return redactor{RedactRule: r, prefix: prefix, name: r.Regexp.String()}
+}
+
+// apply returns line with the rule's substitutions made, and how many there
+// were.  Lines that don't contain the literal prefix are returned without
+// running the regular expression.
+func (r *redactor) apply(line string) (string, int) {
+	if r.prefix != "" && !strings.Contains(line, r.prefix) {
+		return line, 0
+	}
+	matches := r.Regexp.FindAllStringSubmatchIndex(line, -1)
+	if matches == nil {
+		return line, 0
+	}
+	b := make([]byte, 0, len(line))
+	last := 0
+	for _, m := range matches {
+		b = append(b, line[last:m[0]]...)
+		b = r.Regexp.ExpandString(b, r.Replacement, line, m)
+		last = m[1]
+	}
+	b = append(b, line[last:]...)
+	return string(b), len(matches)
+}
+
+// redact applies the File's redaction rules to line in order.
+func (f *File) redact(line string) string {
+	for i := range f.redactors {
+		var n int
+		if line, n = f.redactors[i].apply(line); n > 0 {
+			f.metrics.redactions.Add(f.redactors[i].name, int64(n))
+		}
+	}
+	return line
+}
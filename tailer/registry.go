@@ -0,0 +1,440 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sgtsquiggs/tail/checkpoint"
+	"github.com/sgtsquiggs/tail/clock"
+	log "github.com/sgtsquiggs/tail/logger"
+
+	"github.com/pkg/errors"
+)
+
+// RegistryKey says how the files recorded in a registry are identified.
+type RegistryKey int
+
+const (
+	// RegistryByInode identifies files by their device and inode numbers,
+	// so a file renamed while the Tailer wasn't running is still
+	// recognised.  Inode numbers are reused once a file is deleted, so a
+	// new file may be taken for a deleted one until the deleted file's
+	// entry expires.
+	RegistryByInode RegistryKey = iota
+	// RegistryByContent identifies files by a hash of their first
+	// registryBlock bytes, which survives the file being copied as well as
+	// renamed.  Files shorter than that aren't recorded until they've
+	// grown, and files that begin with the same bytes, such as a common
+	// header, can't be told apart.
+	RegistryByContent
+	// RegistryByPath identifies files by their absolute path.  It's the
+	// simplest checkpoint: a file renamed while the Tailer wasn't running
+	// is treated as a new file.
+	RegistryByPath
+)
+
+func (k RegistryKey) String() string {
+	switch k {
+	case RegistryByInode:
+		return "inode"
+	case RegistryByContent:
+		return "content"
+	case RegistryByPath:
+		return "path"
+	}
+	return fmt.Sprintf("RegistryKey(%d)", int(k))
+}
+
+const (
+	// registryBlock is the number of bytes at the start of a file hashed by
+	// RegistryByContent.
+	registryBlock = 1024
+	// registryVersion is the version of the registry file format.
+	registryVersion = 2
+
+	defaultRegistryInterval = 10 * time.Second
+	defaultRegistryTTL      = 7 * 24 * time.Hour
+)
+
+// RegistryEntry records how far a file has been read.
+type RegistryEntry struct {
+	Key       string    `json:"key"`        // Identity of the file, as given by the RegistryKey
+	Path      string    `json:"path"`       // Absolute path the file was last read through
+	Offset    int64     `json:"offset"`     // File offset of the first byte not yet sent in a line
+	FirstSeen time.Time `json:"first_seen"` // When the file was first recorded
+	LastSeen  time.Time `json:"last_seen"`  // When the file was last read, or last open when the registry was saved
+}
+
+// registry records the offsets of files being tailed, by file identity, and
+// saves them periodically so that reading can resume where it left off.
+type registry struct {
+	path     string
+	key      RegistryKey
+	interval time.Duration
+	ttl      time.Duration
+	clock    clock.Clock
+	logger   *log.Leveled
+
+	saveMu sync.Mutex // serialises saves, and protects `seq'
+	seq    uint64     // Of the snapshot last written
+
+	mu          sync.Mutex
+	entries     map[string]*RegistryEntry // by key
+	files       map[*File]string          // Key of the current generation of each open File
+	dirty       map[string]bool           // Keys of the entries changed or dropped since the last save
+	journaled   int                       // Records appended to the journal since the snapshot
+	snapshotDue bool                      // The next save writes a snapshot rather than to the journal
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// openRegistry loads the registry saved at path, if there is one, and starts
+// saving it every interval.
+func openRegistry(path string, key RegistryKey, interval, ttl time.Duration, clk clock.Clock, logger *log.Leveled) (*registry, error) {
+	if key == RegistryByInode && !inodesSupported {
+		return nil, errors.New("registry keyed by inode isn't supported on this platform")
+	}
+	r := &registry{
+		path:     path,
+		key:      key,
+		interval: interval,
+		ttl:      ttl,
+		clock:    clk,
+		logger:   logger,
+		entries:  make(map[string]*RegistryEntry),
+		files:    make(map[*File]string),
+		dirty:    make(map[string]bool),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	go r.run()
+	return r, nil
+}
+
+// load reads the entries saved in the registry's snapshot and journal, and
+// compacts them into a new snapshot.  Missing files are an empty registry.
+// What can be read of a damaged file is kept, and what was lost is logged.
+// Entries not seen for longer than the TTL before the registry was last
+// written are dropped; the time since doesn't count, as the files may not
+// have been opened again yet.
+func (r *registry) load() error {
+	c, err := readRegistry(r.path)
+	if err != nil {
+		return err
+	}
+	r.recover(c.damage)
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.seq = c.seq
+	r.mu.Lock()
+	r.entries = c.entries
+	r.compactLocked(c.lastWritten())
+	r.snapshotDue = true
+	r.mu.Unlock()
+	r.logger.With(map[string]interface{}{"path": r.path}).Infof("Loaded %d entries from registry %s, %d of them from its journal", len(r.entries), r.path, c.journal)
+	if c.upgraded {
+		r.logger.Infof("Upgrading registry %s to version %d", r.path, registryVersion)
+	}
+	if err := r.write(); err != nil {
+		// It's tried again at the next save.
+		r.logger.Warning(err)
+	}
+	return nil
+}
+
+// seed adds entries for the files in offsets that the registry doesn't
+// already have an entry for, so that an import is only ever applied once.
+func (r *registry) seed(offsets map[checkpoint.Fingerprint]checkpoint.Offset) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := r.clock.Now()
+	n := 0
+	for fp, off := range offsets {
+		key := string(fp)
+		if _, ok := r.entries[key]; ok {
+			continue
+		}
+		seen := off.Timestamp
+		if seen.IsZero() {
+			seen = now
+		}
+		r.entries[key] = &RegistryEntry{Key: key, Path: off.Path, Offset: off.Offset, FirstSeen: seen, LastSeen: seen}
+		r.dirty[key] = true
+		n++
+	}
+	r.logger.With(map[string]interface{}{"path": r.path}).Infof("Seeded registry %s with %d of %d imported entries", r.path, n, len(offsets))
+}
+
+// run saves the registry every interval until close is called.
+func (r *registry) run() {
+	defer close(r.done)
+	ticker := r.clock.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			if err := r.save(); err != nil {
+				r.logger.Warning(err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// close stops the periodic saving and saves the registry a final time, as
+// a snapshot.
+func (r *registry) close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.stop)
+		<-r.done
+		r.mu.Lock()
+		r.snapshotDue = true
+		r.mu.Unlock()
+		err = r.save()
+	})
+	return err
+}
+
+// save compacts the registry and writes what has changed since it was last
+// saved.
+func (r *registry) save() error {
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+	r.mu.Lock()
+	r.compactLocked(r.clock.Now())
+	r.mu.Unlock()
+	return r.write()
+}
+
+// write appends the entries changed or dropped since the last save to the
+// journal, or if a snapshot is due, or the journal would hold more records
+// than a snapshot would, writes a new snapshot instead, so that only the
+// changes are written each time.  The snapshot is replaced atomically, and
+// a journal record cut short by a crash is dropped when it's loaded, along
+// with any after it.  r.saveMu must be held.
+func (r *registry) write() error {
+	r.mu.Lock()
+	changed := len(r.dirty)
+	snapshot := r.snapshotDue || r.journaled+changed > len(r.entries)
+	if !snapshot && changed == 0 {
+		r.mu.Unlock()
+		return nil
+	}
+	var b []byte
+	var err error
+	if snapshot {
+		b, err = r.encodeSnapshotLocked(r.clock.Now())
+	} else {
+		b, err = r.encodeJournalLocked()
+	}
+	r.dirty = make(map[string]bool)
+	r.mu.Unlock()
+	if err == nil {
+		if snapshot {
+			err = r.writeSnapshot(b)
+		} else {
+			err = r.appendJournal(b)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case err != nil:
+		// The changes are in the next snapshot instead.
+		r.snapshotDue = true
+	case snapshot:
+		r.snapshotDue, r.journaled = false, 0
+	default:
+		r.journaled += changed
+	}
+	return err
+}
+
+// compactLocked marks the entries of open files as seen at now, and drops
+// the entries of files that haven't been seen for longer than the TTL.
+func (r *registry) compactLocked(now time.Time) {
+	open := make(map[string]bool, len(r.files))
+	for _, key := range r.files {
+		open[key] = true
+	}
+	for key, e := range r.entries {
+		switch {
+		case open[key]:
+			e.LastSeen = now
+		case r.ttl > 0 && now.Sub(e.LastSeen) > r.ttl:
+			r.logger.With(map[string]interface{}{"path": e.Path}).Debugf("Dropping registry entry for %s, not seen since %s", e.Path, e.LastSeen)
+			delete(r.entries, key)
+			r.dirty[key] = true
+		}
+	}
+}
+
+// fingerprint returns the key f is recorded under, or "" if it can't be
+// identified yet.
+func (r *registry) fingerprint(f *File) (string, error) {
+	switch r.key {
+	case RegistryByPath:
+		// The registry is saved as JSON, so paths must be valid UTF-8.
+		return f.safePath, nil
+	case RegistryByContent:
+		b := make([]byte, registryBlock)
+		if _, err := f.file.ReadAt(b, 0); err != nil {
+			if err == io.EOF {
+				return "", nil
+			}
+			return "", errors.Wrapf(err, "Failed to read %q", f.Pathname)
+		}
+		sum := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(sum[:]), nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	return inodeKey(fi), nil
+}
+
+// lookup returns the entry recorded for key.
+func (r *registry) lookup(key string) (RegistryEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		return RegistryEntry{}, false
+	}
+	return *e, true
+}
+
+// bind records that f's current generation is identified by key, so its
+// entry isn't dropped while f is open but idle.
+func (r *registry) bind(f *File, key string) {
+	r.mu.Lock()
+	r.files[f] = key
+	r.mu.Unlock()
+}
+
+// unbind forgets the key of f, because it's been closed or it has a new
+// generation to be identified again.
+func (r *registry) unbind(f *File) {
+	r.mu.Lock()
+	delete(r.files, f)
+	r.mu.Unlock()
+}
+
+// keyOf returns the key f's current generation is identified by.
+func (r *registry) keyOf(f *File) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.files[f]
+	return key, ok
+}
+
+// update records that the file with key, read through path, has been read
+// up to offset.
+func (r *registry) update(key, path string, offset int64, now time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.entries[key]
+	if !ok {
+		e = &RegistryEntry{Key: key, FirstSeen: now}
+		r.entries[key] = e
+	}
+	if !ok || e.Path != path || e.Offset != offset {
+		r.dirty[key] = true
+	}
+	e.Path, e.Offset, e.LastSeen = path, offset, now
+}
+
+// size returns the number of entries in the registry.
+func (r *registry) size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.entries)
+}
+
+// resume starts reading f where the registry says it was last read up to,
+// and returns true, if the registry has an entry for it.
+func (t *Tailer) resume(f *File) (bool, error) {
+	if t.registry == nil || !f.regular {
+		return false, nil
+	}
+	key, err := t.registry.fingerprint(f)
+	if err != nil || key == "" {
+		return false, err
+	}
+	t.registry.bind(f, key)
+	e, ok := t.registry.lookup(key)
+	if !ok {
+		return false, nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	logger := t.logger.With(map[string]interface{}{"path": f.Pathname, "offset": e.Offset})
+	offset := e.Offset
+	if offset > fi.Size() {
+		logger.Infof("%s is shorter than when last read as %s, reading from the start", f.Pathname, e.Path)
+		offset = 0
+	} else {
+		logger.Infof("Resuming %s at offset %d, last read as %s", f.Pathname, offset, e.Path)
+	}
+	return true, f.seekTo(offset)
+}
+
+// releaseRegistryKey forgets the key f was recorded under, so that it's
+// identified again, for example after a rotation.
+func (f *File) releaseRegistryKey() {
+	if f.registry != nil {
+		f.registry.unbind(f)
+	}
+}
+
+// checkpoint records in the registry how far f has been read.
+func (f *File) checkpoint() {
+	key, ok := f.registryKey()
+	if !ok {
+		return
+	}
+	if f.acks != nil {
+		f.acks.checkpoint(f.lineStart, func(offset int64) {
+			f.registry.update(key, f.safePath, offset, f.clock.Now())
+		})
+		return
+	}
+	f.registry.update(key, f.safePath, f.lineStart, f.clock.Now())
+}
+
+// registryKey returns the key f is recorded in the registry by, binding f to
+// it the first time, or false if f isn't recorded.
+func (f *File) registryKey() (string, bool) {
+	if f.registry == nil || !f.regular {
+		return "", false
+	}
+	key, ok := f.registry.keyOf(f)
+	if !ok {
+		var err error
+		if key, err = f.registry.fingerprint(f); err != nil {
+			f.logger.Debugf("%s: %s", f.Name, err)
+		}
+		if key == "" {
+			return "", false
+		}
+		f.registry.bind(f, key)
+	}
+	return key, true
+}
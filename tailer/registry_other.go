@@ -0,0 +1,17 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package tailer
+
+import "os"
+
+// inodesSupported says if files can be identified by inode on this platform.
+const inodesSupported = false
+
+// inodeKey returns "", as files can't be identified by inode here.
+func inodeKey(fi os.FileInfo) string {
+	return ""
+}
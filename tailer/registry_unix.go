@@ -0,0 +1,26 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package tailer
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/sgtsquiggs/tail/checkpoint"
+)
+
+// inodesSupported says if files can be identified by inode on this platform.
+const inodesSupported = true
+
+// inodeKey returns the device and inode numbers of fi as a registry key.
+func inodeKey(fi os.FileInfo) string {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return ""
+	}
+	return string(checkpoint.InodeFingerprint(uint64(st.Dev), uint64(st.Ino)))
+}
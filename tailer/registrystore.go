@@ -0,0 +1,361 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A registry is kept in two files: a snapshot of every entry at path, and a
+// journal at path + registryJournalSuffix of the entries changed or dropped
+// since the snapshot was written.  Each is a series of records, one per
+// line, of the CRC-32 of a JSON value in hex, a space, and the value.  The
+// first record of each is a registryHeader; the journal is only replayed if
+// its header has the same sequence number as the snapshot's, so a journal
+// left over from before a snapshot was written is ignored.  A record that's
+// incomplete or doesn't match its checksum, as after a crash during a write,
+// ends what's read of the file: the records before it are kept.
+
+// registryJournalSuffix is appended to the path of a registry to name its
+// journal.
+const registryJournalSuffix = ".journal"
+
+// registryCorruptSuffix is appended to the path of a damaged registry file
+// to name the copy of it kept when it's recovered.
+const registryCorruptSuffix = ".corrupt"
+
+// registryHeader is the first record of a registry's snapshot and journal.
+type registryHeader struct {
+	Version int       `json:"v"`
+	Seq     uint64    `json:"seq"`             // Number of the snapshot, and of the snapshot a journal follows
+	Saved   time.Time `json:"saved,omitempty"` // When the snapshot was written
+}
+
+// registryRecord is a record of the journal, of an entry changed, or if
+// Deleted, dropped.
+type registryRecord struct {
+	RegistryEntry
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// registryFile is the format of the file a registry was saved in before
+// version 2, as a single JSON object.
+type registryFile struct {
+	Version int             `json:"v"`
+	Entries []RegistryEntry `json:"entries"`
+}
+
+// registryDamage is a part of a registry file that couldn't be read, from
+// offset to the end, which was skipped.
+type registryDamage struct {
+	path   string
+	offset int
+	lost   int // Bytes skipped
+	err    error
+}
+
+// registryContents is what's read back from the files a registry is kept
+// in.
+type registryContents struct {
+	entries  map[string]*RegistryEntry // by key
+	seq      uint64                    // Of the snapshot
+	saved    time.Time                 // When the snapshot was written, if known
+	journal  int                       // Records replayed from the journal
+	upgraded bool                      // The snapshot was saved in the format before version 2
+	damage   []registryDamage
+}
+
+// lastWritten returns the latest time the registry is known to have been
+// written at: when its snapshot was, or the latest an entry was seen.
+func (c *registryContents) lastWritten() time.Time {
+	last := c.saved
+	for _, e := range c.entries {
+		if e.LastSeen.After(last) {
+			last = e.LastSeen
+		}
+	}
+	return last
+}
+
+// appendRecord appends v to b as a record.
+func appendRecord(b []byte, v interface{}) ([]byte, error) {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return b, err
+	}
+	b = append(b, fmt.Sprintf("%08x ", crc32.ChecksumIEEE(payload))...)
+	b = append(b, payload...)
+	return append(b, '\n'), nil
+}
+
+// parseRecords calls fn with the value of each record in b, in order, until
+// a record can't be read or fn returns an error.  It returns the number of
+// bytes of b read, and the error that stopped it, if any.
+func parseRecords(b []byte, fn func(payload []byte) error) (int, error) {
+	n := 0
+	for n < len(b) {
+		i := bytes.IndexByte(b[n:], '\n')
+		if i < 0 {
+			return n, errors.New("record is incomplete")
+		}
+		line := b[n : n+i]
+		if len(line) < 10 || line[8] != ' ' {
+			return n, errors.New("record is malformed")
+		}
+		sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+		if err != nil {
+			return n, errors.New("record is malformed")
+		}
+		payload := line[9:]
+		if crc32.ChecksumIEEE(payload) != uint32(sum) {
+			return n, errors.New("record doesn't match its checksum")
+		}
+		if err := fn(payload); err != nil {
+			return n, err
+		}
+		n += i + 1
+	}
+	return n, nil
+}
+
+// readRegistry reads the snapshot and journal of the registry at path.
+// Missing files are empty, and the readable part of a damaged file is kept,
+// the rest being listed in the damage.  It only returns an error if a file
+// can't be read at all, or is of a version it doesn't know.
+func readRegistry(path string) (*registryContents, error) {
+	c := &registryContents{entries: make(map[string]*RegistryEntry)}
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Failed to read registry %q", path)
+	}
+	if len(b) > 0 && b[0] == '{' {
+		return c, c.readFile(path, b)
+	}
+	if len(b) > 0 {
+		if err := c.readSnapshot(path, b); err != nil {
+			return nil, err
+		}
+	}
+	journal := path + registryJournalSuffix
+	b, err = ioutil.ReadFile(journal)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrapf(err, "Failed to read registry journal %q", journal)
+	}
+	if len(b) > 0 {
+		if err := c.readJournal(journal, b); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// readFile reads b, a registry saved in the format before version 2.  It
+// can't be partly read, so if it's damaged none of it is kept.
+func (c *registryContents) readFile(path string, b []byte) error {
+	c.upgraded = true
+	var rf registryFile
+	if err := json.Unmarshal(b, &rf); err != nil {
+		offset := 0
+		if serr, ok := err.(*json.SyntaxError); ok {
+			offset = int(serr.Offset)
+		}
+		c.damage = append(c.damage, registryDamage{path, offset, len(b), err})
+		return nil
+	}
+	if rf.Version != 1 {
+		return errors.Errorf("registry %q has unsupported version %d", path, rf.Version)
+	}
+	for i := range rf.Entries {
+		e := rf.Entries[i]
+		c.entries[e.Key] = &e
+	}
+	return nil
+}
+
+// readHeader returns a parser for the records of a registry file that reads
+// the header into h, and passes the records after it to fn.
+func readHeader(path string, h *registryHeader, fn func(payload []byte) error) func([]byte) error {
+	read := false
+	return func(payload []byte) error {
+		if read {
+			return fn(payload)
+		}
+		if err := json.Unmarshal(payload, h); err != nil {
+			return err
+		}
+		if h.Version != registryVersion {
+			return &errUnsupportedRegistry{path, h.Version}
+		}
+		read = true
+		return nil
+	}
+}
+
+// errUnsupportedRegistry is the error for a registry file of a version that
+// isn't known, which isn't recovered from as it may be valid.
+type errUnsupportedRegistry struct {
+	path    string
+	version int
+}
+
+func (e *errUnsupportedRegistry) Error() string {
+	return fmt.Sprintf("registry %q has unsupported version %d", e.path, e.version)
+}
+
+// readSnapshot reads b, the snapshot of a registry.
+func (c *registryContents) readSnapshot(path string, b []byte) error {
+	var h registryHeader
+	n, err := parseRecords(b, readHeader(path, &h, func(payload []byte) error {
+		var e RegistryEntry
+		if err := json.Unmarshal(payload, &e); err != nil {
+			return err
+		}
+		c.entries[e.Key] = &e
+		return nil
+	}))
+	if _, ok := err.(*errUnsupportedRegistry); ok {
+		return err
+	}
+	if err != nil {
+		c.damage = append(c.damage, registryDamage{path, n, len(b) - n, err})
+	}
+	c.seq, c.saved = h.Seq, h.Saved
+	return nil
+}
+
+// readJournal replays b, the journal of a registry, if it follows the
+// snapshot read.
+func (c *registryContents) readJournal(path string, b []byte) error {
+	var h registryHeader
+	stale := false
+	n, err := parseRecords(b, readHeader(path, &h, func(payload []byte) error {
+		if h.Seq != c.seq {
+			stale = true
+			return nil
+		}
+		var rec registryRecord
+		if err := json.Unmarshal(payload, &rec); err != nil {
+			return err
+		}
+		if rec.Deleted {
+			delete(c.entries, rec.Key)
+		} else {
+			e := rec.RegistryEntry
+			c.entries[e.Key] = &e
+		}
+		c.journal++
+		return nil
+	}))
+	if _, ok := err.(*errUnsupportedRegistry); ok {
+		return err
+	}
+	if err != nil && !stale {
+		c.damage = append(c.damage, registryDamage{path, n, len(b) - n, err})
+	}
+	return nil
+}
+
+// recover logs what was lost from the registry's damaged files, and keeps a
+// copy of each before it's replaced.
+func (r *registry) recover(damage []registryDamage) {
+	for _, d := range damage {
+		r.logger.With(map[string]interface{}{"path": d.path, "offset": d.offset}).Warningf("Registry file %s is damaged at byte %d: %s; kept what was before it, and lost the %d bytes from there", d.path, d.offset, d.err, d.lost)
+		b, err := ioutil.ReadFile(d.path)
+		if err == nil {
+			err = ioutil.WriteFile(d.path+registryCorruptSuffix, b, 0600)
+		}
+		if err != nil {
+			r.logger.Infof("Failed to keep a copy of damaged registry file %s: %s", d.path, err)
+		}
+	}
+}
+
+// encodeSnapshotLocked returns every entry as a snapshot to follow the
+// current one.  r.mu must be held.
+func (r *registry) encodeSnapshotLocked(now time.Time) ([]byte, error) {
+	b, err := appendRecord(nil, registryHeader{Version: registryVersion, Seq: r.seq + 1, Saved: now})
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(r.entries))
+	for key := range r.entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if b, err = appendRecord(b, r.entries[key]); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// encodeJournalLocked returns the records of the entries changed or dropped
+// since the last save, to append to the journal.  r.mu must be held.
+func (r *registry) encodeJournalLocked() ([]byte, error) {
+	keys := make([]string, 0, len(r.dirty))
+	for key := range r.dirty {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, key := range keys {
+		rec := registryRecord{RegistryEntry: RegistryEntry{Key: key}, Deleted: true}
+		if e, ok := r.entries[key]; ok {
+			rec = registryRecord{RegistryEntry: *e}
+		}
+		var err error
+		if b, err = appendRecord(b, rec); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// writeSnapshot replaces the snapshot with b atomically, and starts a new
+// journal to follow it.
+func (r *registry) writeSnapshot(b []byte) error {
+	tmp := r.path + ".new"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrapf(err, "Failed to write registry %q", r.path)
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return errors.Wrapf(err, "Failed to replace registry %q", r.path)
+	}
+	r.seq++
+	// A journal left half written has a damaged header, so isn't replayed.
+	h, err := appendRecord(nil, registryHeader{Version: registryVersion, Seq: r.seq})
+	if err != nil {
+		return err
+	}
+	journal := r.path + registryJournalSuffix
+	if err := ioutil.WriteFile(journal, h, 0600); err != nil {
+		return errors.Wrapf(err, "Failed to start registry journal %q", journal)
+	}
+	return nil
+}
+
+// appendJournal appends b to the journal.
+func (r *registry) appendJournal(b []byte) error {
+	journal := r.path + registryJournalSuffix
+	f, err := os.OpenFile(journal, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open registry journal %q", journal)
+	}
+	_, err = f.Write(b)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return errors.Wrapf(err, "Failed to write registry journal %q", journal)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	log "github.com/sgtsquiggs/tail/logger"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// handleRename handles the rename of a file from one path to another, as
+// reported by a watcher that pairs the halves of renames.  With
+// WithFollowRenames, a tailed file is tailed at its new path from where it
+// had been read up to, and its lines continue its generation.  Otherwise,
+// or if the file at the new path isn't the one that was open, it's handled
+// as the deletion of from and the creation of to.
+func (t *Tailer) handleRename(from, to string) {
+	if t.logger.Enabled(log.DebugLevel) {
+		t.logger.With(map[string]interface{}{"path": to, "from": from}).Debugf("handleRename %s to %s", from, to)
+	}
+	fd, ok := t.handleForPath(from)
+	if !ok {
+		t.handleDelete(from)
+		t.handleLogEvent(to)
+		return
+	}
+	if !t.followRenames || !t.canFollowRename(fd, to) {
+		t.handleDelete(from)
+		t.handleLogEvent(to)
+		if _, ok := t.handleForPath(to); !ok {
+			// The watch on the tailed file moved with it.
+			if err := t.w.Remove(to); err != nil {
+				t.logger.Debug(err)
+			}
+		}
+		return
+	}
+	if err := fd.drain(false); err != nil {
+		t.logger.Info(err)
+	}
+	offset := fd.lineStart
+	now := t.clock.Now()
+	t.deletedMu.Lock()
+	t.deleted[fd.Pathname] = deletedPath{fd.generation + 1, now}
+	t.deleted[to] = deletedPath{fd.generation, now}
+	t.deletedMu.Unlock()
+	t.closeHandle(fd)
+	if err := t.openLogPath(to, StartPolicy{kind: startOffset, n: offset}); err != nil {
+		t.logger.Infof("Failed to tail %s, renamed from %s: %s", to, from, err)
+		return
+	}
+	t.logger.With(map[string]interface{}{"path": to, "from": fd.Pathname}).Infof("Tailing %s at its new path %s", fd.Pathname, to)
+	if nfd, ok := t.handleForPath(to); ok {
+		t.sendEvent(FileEvent{Type: Renamed, Name: nfd.name(), Pathname: nfd.Pathname, Previous: fd.Pathname})
+	}
+	// A new file may already have been created at the old path.
+	if _, err := watcher.StatExtended(fd.Pathname); err == nil {
+		t.handleLogEvent(fd.Pathname)
+	}
+}
+
+// canFollowRename indicates if fd, renamed to to, can be tailed there: the
+// file at to is the one fd has open, and to isn't already tailed.
+func (t *Tailer) canFollowRename(fd *File, to string) bool {
+	fi, err := watcher.StatExtended(to)
+	if err != nil || !fd.isFile(fi) {
+		return false
+	}
+	_, tailed := t.handleForPath(to)
+	return !tailed
+}
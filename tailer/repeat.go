@@ -0,0 +1,147 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/schedule"
+)
+
+// repeats holds the last line sent from a File, and how many times it has
+// been repeated since.
+type repeats struct {
+	window time.Duration // Summarise a run of repeats once its first is this old, if > 0
+	max    int           // Summarise a run of repeats once it's this long, if > 0
+	field  bool          // Summarise with the Repeat field rather than a summary line
+
+	// arm schedules the summary of a run of repeats for once its window
+	// has passed, if not nil, so it's sent even if no other line is read.
+	arm   func(at time.Time) *schedule.Timer
+	timer *schedule.Timer // Fires when the window of the current run has passed
+
+	last  string
+	have  bool      // last holds a line
+	count int       // Copies of last not sent since the last summary
+	since time.Time // When the first of them was read
+}
+
+// collapse returns true if line repeats the line sent before it, and so
+// isn't to be sent.
+func (f *File) collapse(line string) bool {
+	r := f.repeats
+	if r == nil {
+		return false
+	}
+	if !r.have || line != r.last {
+		f.flushRepeats()
+		r.last, r.have = line, true
+		return false
+	}
+	now := f.clock.Now()
+	if r.count > 0 && r.window > 0 && now.Sub(r.since) >= r.window {
+		f.flushRepeats()
+	}
+	if r.count == 0 {
+		r.since = now
+		r.schedule(now.Add(r.window))
+	}
+	r.count++
+	f.metrics.linesCollapsed.Add(f.Name, 1)
+	if r.max > 0 && r.count >= r.max {
+		f.flushRepeats()
+	}
+	return true
+}
+
+// flushRepeats sends a summary of the repeats of the last line, if there
+// are any: either the line "last message repeated N times", or a copy of the
+// line with Repeat set to N.
+func (f *File) flushRepeats() {
+	r := f.repeats
+	if r == nil || r.count == 0 {
+		return
+	}
+	n := r.count
+	r.count = 0
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	var l *logline.LogLine
+	if r.field {
+		l = logline.NewLogLine(f.Name, f.redact(r.last))
+		l.Repeat = n
+		f.extractJSONFields(l)
+	} else {
+		l = logline.NewLogLine(f.Name, fmt.Sprintf("last message repeated %d times", n))
+	}
+	l.Generation = f.generation
+	l.Source = f.source
+	f.emit(l)
+}
+
+// repeatsDue sends the summary of the repeats of the last line if the
+// window has passed since the first of them, when no line has been read
+// since to send it.
+func (f *File) repeatsDue() {
+	r := f.repeats
+	if r == nil || r.count == 0 || f.clock.Now().Sub(r.since) < r.window {
+		return
+	}
+	f.flushRepeats()
+}
+
+// schedule arms the timer for the summary of the run of repeats due at at,
+// if there's a window.
+func (r *repeats) schedule(at time.Time) {
+	if r.window <= 0 || r.arm == nil {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Reset(at)
+		return
+	}
+	r.timer = r.arm(at)
+}
+
+// stopRepeats cancels the timer for the summary of any repeats, as f is
+// closed.
+func (f *File) stopRepeats() {
+	if f.repeats != nil && f.repeats.timer != nil {
+		f.repeats.timer.Stop()
+	}
+}
+
+// armRepeats has the summary of each run of repeats from f sent when its
+// window has passed, in run, as long as f is still tailed.
+func (t *Tailer) armRepeats(f *File) {
+	f.repeats.arm = func(at time.Time) *schedule.Timer {
+		return t.sched.At(at, func() {
+			// Called by the scheduler, which mustn't be held up by run.
+			go func() {
+				err := t.inRun(func() error {
+					if cur, ok := t.handles.Load(f.handleKey); ok && cur.(*File) == f {
+						f.repeatsDue()
+					}
+					return nil
+				})
+				if err != nil {
+					t.logger.Debug(err)
+				}
+			}()
+		})
+	}
+}
+
+// endRepeats sends the summary of any repeats, and forgets the last line so
+// that the next isn't compared with it, at the end of a file generation.
+func (f *File) endRepeats() {
+	if f.repeats == nil {
+		return
+	}
+	f.flushRepeats()
+	f.repeats.last, f.repeats.have = "", false
+}
@@ -0,0 +1,55 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+)
+
+// ErrAlreadyTailed is returned by TailPath for a path that was already given
+// to it, however it was spelled, unless WithReplaceOnRetail was given.
+type ErrAlreadyTailed struct {
+	Pathname string
+	Key      string // The canonical path that was already tailed
+}
+
+func (e *ErrAlreadyTailed) Error() string {
+	return fmt.Sprintf("already tailing %q as %q", e.Pathname, e.Key)
+}
+
+// registerPath records that pathname is tailed for TailPath, returning its
+// canonical path and whether it already was.
+func (t *Tailer) registerPath(pathname string) (string, bool, error) {
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return "", false, err
+	}
+	t.refsMu.Lock()
+	defer t.refsMu.Unlock()
+	if _, ok := t.refs[key][""]; ok {
+		return key, true, nil
+	}
+	if t.refs[key] == nil {
+		t.refs[key] = make(map[string]struct{})
+	}
+	t.refs[key][""] = struct{}{}
+	return key, false, nil
+}
+
+// retail tails pathname, whose canonical path is key and which was already
+// given to TailPath, again from where policy says.  The file is closed and
+// reopened, or if it's waiting for a backfill worker it's read from there
+// instead.  It runs in run, so that one being handed over by a worker is
+// either done first or sees the request.
+func (t *Tailer) retail(pathname, key string, policy StartPolicy) error {
+	return t.inRun(func() error {
+		if fd, ok := t.handleForPath(pathname); ok {
+			t.logger.With(map[string]interface{}{"path": fd.Pathname}).Infof("Tailing %s again", fd.Pathname)
+			t.closeHandle(fd)
+		} else if t.queue != nil && t.queue.replace(key, policy) {
+			return nil
+		}
+		return t.tailPath(pathname, policy)
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// maxSampleDenominator is the largest denominator of a sampling rate that is
+// sampled deterministically rather than at random.
+const maxSampleDenominator = 100
+
+// sampler decides which of a File's lines to keep.  A rate that is a
+// fraction p/q with a small denominator keeps p of every q lines, spread
+// evenly; other rates keep each line at random with that probability.
+type sampler struct {
+	rate float64
+	p, q int64      // Keep p of every q lines, if q > 0
+	rng  *rand.Rand // Decides which lines to keep, if q is 0
+	n    int64      // Lines seen in the current cycle of q
+
+	marker     time.Duration // How often to emit a marker line, if > 0
+	lastMarker time.Time
+	kept, seen int64 // Lines kept and seen since the last marker
+}
+
+// newSampler returns a sampler keeping lines at rate.  Random samplers for
+// different paths with the same seed make independent choices.
+func newSampler(rate float64, seed int64, path string, marker time.Duration, now time.Time) *sampler {
+	s := &sampler{rate: rate, marker: marker, lastMarker: now}
+	for q := int64(1); q <= maxSampleDenominator; q++ {
+		p := math.Round(rate * float64(q))
+		if p >= 1 && math.Abs(p/float64(q)-rate) < 1e-9 {
+			s.p, s.q = int64(p), q
+			return s
+		}
+	}
+	h := fnv.New64a()
+	h.Write([]byte(path))
+	s.rng = rand.New(rand.NewSource(seed ^ int64(h.Sum64())))
+	return s
+}
+
+// keep returns true if the next line is to be kept.
+func (s *sampler) keep() bool {
+	var keep bool
+	if s.q > 0 {
+		// With p/q in lowest terms, i*p mod q takes each value below q once
+		// per cycle, so p lines of every q are kept.
+		keep = s.n*s.p%s.q < s.p
+		s.n = (s.n + 1) % s.q
+	} else {
+		keep = s.rng.Float64() < s.rate
+	}
+	s.seen++
+	if keep {
+		s.kept++
+	}
+	return keep
+}
+
+// markerDue returns the text of a marker line and resets the counts, if one
+// is due at now.
+func (s *sampler) markerDue(now time.Time) (string, bool) {
+	if s.marker <= 0 || now.Sub(s.lastMarker) < s.marker {
+		return "", false
+	}
+	text := fmt.Sprintf("sampled: kept %d of %d", s.kept, s.seen)
+	s.lastMarker = now
+	s.kept, s.seen = 0, 0
+	return text, true
+}
+
+// sampledOut returns true if the next line is dropped by sampling.
+func (f *File) sampledOut() bool {
+	if f.sampler == nil || f.sampler.keep() {
+		return false
+	}
+	f.metrics.sampledOut.Add(f.Name, 1)
+	return true
+}
+
+// sendSampleMarker sends a marker line with the sampling counts, if one is
+// due.
+func (f *File) sendSampleMarker() {
+	if f.sampler == nil {
+		return
+	}
+	if text, ok := f.sampler.markerDue(f.clock.Now()); ok {
+		l := logline.NewLogLine(f.Name, text)
+		l.Generation = f.generation
+		l.Source = f.source
+		f.emit(l)
+	}
+}
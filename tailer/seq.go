@@ -0,0 +1,30 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// lastSeq is the sequence number most recently given to a line by any
+// Tailer in the process; accessed atomically.
+var lastSeq uint64
+
+// sequencer numbers the lines sent by a Tailer's Files in the order they're
+// sent.  The lock is held from numbering a line until it has been sent, so
+// that Files read by different goroutines can't send out of order.
+type sequencer struct {
+	mu sync.Mutex
+}
+
+// send numbers l and sends it on lines through c.
+func (s *sequencer) send(c *consumer, lines chan<- *logline.LogLine, l *logline.LogLine) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l.Seq = atomic.AddUint64(&lastSeq, 1)
+	return c.send(lines, l)
+}
@@ -0,0 +1,57 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"hash/fnv"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// shardedOutput splits the lines from a Tailer between several channels,
+// sending all the lines of a file to the same one.
+type shardedOutput struct {
+	shards []chan *logline.LogLine
+	held   *inFlight // Counts the line being sent to a shard
+}
+
+func newShardedOutput(lines <-chan *logline.LogLine, n int, held *inFlight) *shardedOutput {
+	o := &shardedOutput{shards: make([]chan *logline.LogLine, n), held: held}
+	for i := range o.shards {
+		o.shards[i] = make(chan *logline.LogLine)
+	}
+	go o.run(lines)
+	return o
+}
+
+// shardOf returns the shard for the lines of the file reported as name.
+func (o *shardedOutput) shardOf(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(len(o.shards)))
+}
+
+// run sends each line to its file's shard, until lines is closed, then
+// closes the shards.
+func (o *shardedOutput) run(lines <-chan *logline.LogLine) {
+	for l := range lines {
+		o.held.add(l)
+		o.shards[o.shardOf(l.Filename)] <- l
+		o.held.done(l)
+	}
+	for _, ch := range o.shards {
+		close(ch)
+	}
+}
+
+// Shard returns the ith of the channels the lines are sent to, with
+// WithShardedOutput.  It is closed once the Tailer has shut down and the
+// lines sent before then have been received.  It returns nil if the output
+// isn't sharded or i is out of range.
+func (t *Tailer) Shard(i int) <-chan *logline.LogLine {
+	if t.shards == nil || i < 0 || i >= len(t.shards.shards) {
+		return nil
+	}
+	return t.shards.shards[i]
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// ErrNotRegularFile is returned by TailPath for a path that isn't a regular
+// file, unless WithSpecialFiles says how to tail it.
+type ErrNotRegularFile struct {
+	Pathname string
+	Mode     os.FileMode // The type bits of the file's mode
+}
+
+func (e *ErrNotRegularFile) Error() string {
+	return fmt.Sprintf("can't tail %q: not a regular file (mode %v)", e.Pathname, e.Mode)
+}
+
+// tailSpecial tails pathname, which has mode and isn't a regular file, if
+// the Tailer is allowed to, and otherwise stops tailing it and returns an
+// ErrNotRegularFile.
+func (t *Tailer) tailSpecial(pathname string, mode os.FileMode) error {
+	switch {
+	case t.specialFiles && mode.IsDir():
+		return t.tailDirectory(pathname)
+	case t.specialFiles && mode&os.ModeType == os.ModeNamedPipe:
+		if err := t.register(pathname, ""); err != nil {
+			return err
+		}
+		return t.tailPath(pathname, StartPolicy{})
+	}
+	t.dropRejected(pathname)
+	return &ErrNotRegularFile{Pathname: pathname, Mode: mode & os.ModeType}
+}
+
+// tailDirectory tails the files in dir, and those created in it later, as
+// if they had matched a pattern.  Entries that can't be tailed are skipped.
+func (t *Tailer) tailDirectory(dir string) error {
+	pattern := filepath.Join(dir, "*")
+	matches, err := t.watchPattern(pattern, &pathOptions{})
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, m := range matches {
+		fi, err := watcher.StatExtended(m)
+		if err != nil {
+			continue
+		}
+		if mode := fi.Mode(); !mode.IsRegular() && mode&os.ModeType != os.ModeNamedPipe {
+			t.logger.Debugf("Skipping %q in %q with mode %v", m, dir, mode&os.ModeType)
+			continue
+		}
+		files = append(files, m)
+	}
+	return t.tailMatches(pattern, files, StartPolicy{}, nil)
+}
+
+// dropRejected stops tailing pathname if it was given to TailPath before it
+// became something that can't be tailed, and removes its watch unless the
+// watch is still needed for another path.
+func (t *Tailer) dropRejected(pathname string) {
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return
+	}
+	t.refsMu.Lock()
+	_, ok := t.refs[key][""]
+	t.refsMu.Unlock()
+	if !ok {
+		return
+	}
+	t.unregister(key, "")
+	absPath, err := filepath.Abs(pathname)
+	if err != nil || t.isRegistered(pathname) || t.dirInUse(absPath) {
+		return
+	}
+	if err := t.w.Remove(absPath); err != nil {
+		t.logger.Debugf("Failed to remove the watch on %q: %s", absPath, err)
+	}
+}
+
+// dirInUse indicates if the directory dir is watched for the files being
+// tailed in it, or for patterns matching files in it.
+func (t *Tailer) dirInUse(dir string) bool {
+	t.refsMu.Lock()
+	for key := range t.refs {
+		if filepath.Dir(key) == dir {
+			t.refsMu.Unlock()
+			return true
+		}
+	}
+	t.refsMu.Unlock()
+	t.globPatternsMu.RLock()
+	for pattern := range t.globPatterns {
+		if filepath.Dir(pattern) == dir {
+			t.globPatternsMu.RUnlock()
+			return true
+		}
+	}
+	t.globPatternsMu.RUnlock()
+	t.liveMu.Lock()
+	defer t.liveMu.Unlock()
+	for _, lp := range t.livePatterns {
+		if filepath.Dir(lp.dirs) == dir {
+			return true
+		}
+		for _, d := range lp.watched {
+			if d == dir {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,493 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sgtsquiggs/tail/schedule"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// defaultSpoolQuiescence is how long a spooled file must go unchanged before
+// it's taken to be complete, unless WithQuiescence says otherwise.
+const defaultSpoolQuiescence = 5 * time.Second
+
+// spoolJournalName is the file in a spool directory recording the files that
+// have been read but not yet deleted or moved.
+const spoolJournalName = ".spool-completed"
+
+// SpoolOption configures a spool directory given to AddSpoolDir.
+type SpoolOption func(*spool) error
+
+// WithQuiescence takes a spooled file to be complete once it hasn't changed
+// for d, rather than for 5 seconds.
+func WithQuiescence(d time.Duration) SpoolOption {
+	return func(s *spool) error {
+		if d <= 0 {
+			return errors.Errorf("invalid spool quiescence period %s", d)
+		}
+		s.quiescence = d
+		return nil
+	}
+}
+
+// WithTempSuffix ignores the spooled files whose names end in suffix, such as
+// ".tmp", and takes every other file to be complete as soon as it appears,
+// for writers that rename a file to its final name once it has been written.
+func WithTempSuffix(suffix string) SpoolOption {
+	return func(s *spool) error {
+		if suffix == "" {
+			return errors.New("empty spool temporary suffix")
+		}
+		s.tempSuffix = suffix
+		return nil
+	}
+}
+
+// WithDoneDir moves each spooled file into dir once it has been read, rather
+// than deleting it, for an archiver to sweep later.  A relative dir is in
+// the spool directory, such as "done", or "../done" for a sibling of it, and
+// is created if it doesn't exist.
+func WithDoneDir(dir string) SpoolOption {
+	return func(s *spool) error {
+		if dir == "" {
+			return errors.New("empty spool done directory")
+		}
+		s.doneDir = dir
+		return nil
+	}
+}
+
+// WithDoneSuffix marks each spooled file done once it has been read by
+// adding suffix to its name, such as ".done", rather than deleting it, for
+// an archiver to sweep later.  Files with the suffix aren't read by the
+// spool, nor tailed as matches of a pattern.
+func WithDoneSuffix(suffix string) SpoolOption {
+	return func(s *spool) error {
+		if suffix == "" {
+			return errors.New("empty spool done suffix")
+		}
+		s.doneSuffix = suffix
+		return nil
+	}
+}
+
+// spool is a directory given to AddSpoolDir, whose files are each read once
+// by a worker and then removed.
+type spool struct {
+	dir        string // absolute path of the directory
+	quiescence time.Duration
+	tempSuffix string
+	doneDir    string // absolute path files are moved to, or ""
+	doneSuffix string // added to the names of files read, or ""
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting map[string]*schedule.Timer // files not yet complete, by absolute path
+	sizes   map[string]int64           // size of each waiting file when it last changed
+	ready   []string                   // complete files waiting for the worker
+	queued  map[string]bool            // files in ready or being read
+	closed  bool
+
+	completed map[string]int64 // offset each file was read up to, until it's removed, by name; only used by the worker
+}
+
+// spoolJournal is the contents of a spool directory's journal.
+type spoolJournal struct {
+	Completed map[string]int64 `json:"completed"`
+}
+
+// AddSpoolDir reads each file that appears in dir once it's complete: when
+// it hasn't changed for the quiescence period, or as soon as it has its
+// final name if WithTempSuffix is given.  Its lines are sent, then an EOF
+// FileEvent, and the file is deleted, or moved by WithDoneDir or renamed by
+// WithDoneSuffix.  A file is only removed once it has gone unchanged for the
+// quiescence period, in case its writer is still writing it; until then
+// what's written to it is read on from where it was.  A file that fails to
+// be read is left in place, and a Failed FileEvent is sent.  Files already
+// in dir are read too, except those recorded in the journal .spool-completed
+// as read before the process stopped, which are only removed.  Hidden files
+// and directories are ignored.
+func (t *Tailer) AddSpoolDir(dir string, opts ...SpoolOption) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	s := &spool{
+		dir:        absDir,
+		quiescence: defaultSpoolQuiescence,
+		waiting:    make(map[string]*schedule.Timer),
+		sizes:      make(map[string]int64),
+		queued:     make(map[string]bool),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return err
+		}
+	}
+	if s.doneDir != "" && s.doneSuffix != "" {
+		return errors.New("spool done files can't be both moved and renamed")
+	}
+	if s.doneDir != "" {
+		if !filepath.IsAbs(s.doneDir) {
+			s.doneDir = filepath.Join(absDir, s.doneDir)
+		}
+		if err := os.MkdirAll(s.doneDir, 0700); err != nil {
+			return errors.Wrapf(err, "Failed to create spool done directory %q", s.doneDir)
+		}
+	}
+	if s.completed, err = s.loadJournal(); err != nil {
+		return err
+	}
+	t.spoolMu.Lock()
+	if t.spoolsClosed {
+		t.spoolMu.Unlock()
+		return errors.New("tailer is closed")
+	}
+	if _, ok := t.spools[absDir]; ok {
+		t.spoolMu.Unlock()
+		return errors.Errorf("%q is already a spool directory", dir)
+	}
+	t.spools[absDir] = s
+	t.spoolWG.Add(1)
+	t.spoolMu.Unlock()
+	go t.spoolWorker(s)
+
+	if err := t.addWatch(absDir); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(watcher.ExtendPath(absDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range entries {
+		t.noticeSpooled(s, filepath.Join(absDir, fi.Name()))
+	}
+	return nil
+}
+
+// spoolFor returns the spool directory pathname is in, if any.
+func (t *Tailer) spoolFor(pathname string) (*spool, bool) {
+	t.spoolMu.Lock()
+	defer t.spoolMu.Unlock()
+	s, ok := t.spools[filepath.Dir(pathname)]
+	return s, ok
+}
+
+// handleSpoolEvent notices a change to pathname if it's in a spool
+// directory.  It returns false if it isn't in one.
+func (t *Tailer) handleSpoolEvent(pathname string) bool {
+	s, ok := t.spoolFor(pathname)
+	if !ok {
+		return false
+	}
+	t.noticeSpooled(s, pathname)
+	return true
+}
+
+// forgetSpooled stops waiting for pathname to be complete after it has been
+// deleted or renamed away.
+func (t *Tailer) forgetSpooled(pathname string) {
+	s, ok := t.spoolFor(pathname)
+	if !ok {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if timer, ok := s.waiting[pathname]; ok {
+		timer.Stop()
+		delete(s.waiting, pathname)
+		delete(s.sizes, pathname)
+	}
+}
+
+// ignored indicates if the file named name in s isn't to be read.
+func (s *spool) ignored(name string) bool {
+	return strings.HasPrefix(name, ".") || (s.tempSuffix != "" && strings.HasSuffix(name, s.tempSuffix))
+}
+
+// markedDone indicates if the file named name in s has been renamed by
+// WithDoneSuffix.
+func (s *spool) markedDone(name string) bool {
+	return s.doneSuffix != "" && strings.HasSuffix(name, s.doneSuffix)
+}
+
+// spoolExcluded indicates if pathname is a file in a spool directory that
+// mustn't be tailed: one that has been read and marked done, or the
+// journal.
+func (t *Tailer) spoolExcluded(pathname string) bool {
+	s, ok := t.spoolFor(pathname)
+	if !ok {
+		return false
+	}
+	name := filepath.Base(pathname)
+	return s.markedDone(name) || strings.HasPrefix(name, spoolJournalName)
+}
+
+// noticeSpooled queues pathname to be read by s's worker once it's
+// complete.
+func (t *Tailer) noticeSpooled(s *spool, pathname string) {
+	name := filepath.Base(pathname)
+	if s.ignored(name) {
+		return
+	}
+	if s.markedDone(name) {
+		t.metrics.spoolSkippedDone.Add(s.dir, 1)
+		return
+	}
+	fi, err := watcher.StatExtended(pathname)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.queued[pathname] {
+		return
+	}
+	if _, waiting := s.waiting[pathname]; s.tempSuffix != "" && !waiting {
+		s.readyLocked(pathname)
+		return
+	}
+	t.waitSpooledLocked(s, pathname, fi.Size())
+}
+
+// waitSpooledLocked waits for pathname, which has changed to size, to go
+// unchanged for the quiescence period.  s.mu must be locked when called.
+func (t *Tailer) waitSpooledLocked(s *spool, pathname string, size int64) {
+	s.sizes[pathname] = size
+	at := t.clock.Now().Add(s.quiescence)
+	if timer, ok := s.waiting[pathname]; ok {
+		timer.Reset(at)
+		return
+	}
+	s.waiting[pathname] = t.sched.At(at, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.waiting[pathname] == nil || s.closed {
+			return
+		}
+		delete(s.waiting, pathname)
+		s.readyLocked(pathname)
+	})
+}
+
+// readyLocked queues pathname for the worker.  s.mu must be locked when
+// called.
+func (s *spool) readyLocked(pathname string) {
+	s.queued[pathname] = true
+	s.ready = append(s.ready, pathname)
+	s.cond.Signal()
+}
+
+// spoolWorker reads the complete files of s one at a time until the spools
+// are stopped.
+func (t *Tailer) spoolWorker(s *spool) {
+	defer t.spoolWG.Done()
+	for {
+		s.mu.Lock()
+		for len(s.ready) == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.closed {
+			s.mu.Unlock()
+			return
+		}
+		pathname := s.ready[0]
+		s.ready = s.ready[1:]
+		s.mu.Unlock()
+
+		t.spoolFile(s, pathname)
+	}
+}
+
+// spoolFile reads pathname, records it in the journal, and removes it.  A
+// file that has changed since it was queued, or since it was read, waits for
+// quiescence again.
+func (t *Tailer) spoolFile(s *spool, pathname string) {
+	logger := t.logger.With(map[string]interface{}{"path": pathname})
+	fi, err := watcher.StatExtended(pathname)
+	s.mu.Lock()
+	delete(s.queued, pathname)
+	if err != nil {
+		delete(s.sizes, pathname)
+		s.mu.Unlock()
+		logger.Debugf("Spooled file %q has gone: %s", pathname, err)
+		return
+	}
+	if s.tempSuffix == "" && fi.Size() != s.sizes[pathname] {
+		t.waitSpooledLocked(s, pathname, fi.Size())
+		s.mu.Unlock()
+		return
+	}
+	delete(s.sizes, pathname)
+	s.queued[pathname] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.queued, pathname)
+		s.mu.Unlock()
+	}()
+
+	name := filepath.Base(pathname)
+	read, ok := s.completed[name]
+	if ok && read == fi.Size() {
+		t.metrics.spoolSkippedDone.Add(s.dir, 1)
+	} else {
+		if read > fi.Size() {
+			// Not the file that was read, which has been replaced.
+			read = 0
+		}
+		offset, err := t.readSpooled(pathname, read)
+		if err != nil {
+			logger.Infof("Failed to read spooled file %q, leaving it in place: %s", pathname, err)
+			return
+		}
+		t.metrics.spoolProcessed.Add(s.dir, 1)
+		s.completed[name] = offset
+		if err := s.saveJournal(); err != nil {
+			logger.Warning(err)
+		}
+	}
+	if fi, err := watcher.StatExtended(pathname); err == nil && (fi.Size() != s.completed[name] || t.clock.Now().Sub(fi.ModTime()) < s.quiescence) {
+		// Its writer may still be writing it; what it writes is read on from
+		// the offset recorded once it has stopped.
+		logger.Infof("Not removing spooled file %q until it has gone unchanged for %s", pathname, s.quiescence)
+		s.mu.Lock()
+		if !s.closed {
+			t.waitSpooledLocked(s, pathname, fi.Size())
+		}
+		s.mu.Unlock()
+		return
+	}
+	if err := t.removeSpooled(s, pathname); err != nil {
+		// The record in the journal stops it being read again.
+		logger.Warningf("Failed to remove spooled file %q: %s", pathname, err)
+		return
+	}
+	delete(s.completed, name)
+	if err := s.saveJournal(); err != nil {
+		logger.Warning(err)
+	}
+}
+
+// readSpooled reads pathname from offset, which is the start of a line, to
+// its end, and sends its EOF or Failed event.  It returns the offset read up
+// to.  The last line is sent even if it has no newline, as the file is
+// complete.
+func (t *Tailer) readSpooled(pathname string, offset int64) (int64, error) {
+	f, err := t.newFile(pathname, Beginning)
+	if err != nil {
+		t.sendEvent(FileEvent{Type: Failed, Name: pathname, Pathname: pathname, Err: err})
+		return 0, err
+	}
+	defer f.Close()
+	if offset > 0 {
+		if err := f.seekTo(offset); err != nil {
+			t.sendEvent(f.endEvent(err))
+			return 0, err
+		}
+	}
+	t.merge.reading(f.Name, true)
+	f.readFrom = f.offset
+	err = f.guard(f.Read)
+	if p, ok := err.(*ErrReadPanic); ok {
+		// The file is kept, to be read again by a later scan.
+		t.readPanicked(f, p)
+	}
+	if err == io.EOF {
+		err = nil
+		f.lockPartial()
+		if f.partial.Len() > 0 {
+			f.flushPartial()
+		}
+		f.unlockPartial()
+		f.endRepeats()
+	}
+	t.endOneShot(f, err)
+	return f.offset, err
+}
+
+// removeSpooled deletes pathname, or moves or renames it to mark it done.
+func (t *Tailer) removeSpooled(s *spool, pathname string) error {
+	var err error
+	switch {
+	case s.doneDir != "":
+		err = os.Rename(pathname, filepath.Join(s.doneDir, filepath.Base(pathname)))
+	case s.doneSuffix != "":
+		err = os.Rename(pathname, pathname+s.doneSuffix)
+	default:
+		return os.Remove(pathname)
+	}
+	if err == nil {
+		t.metrics.spoolRenamed.Add(s.dir, 1)
+	}
+	return err
+}
+
+func (s *spool) journalPath() string {
+	return filepath.Join(s.dir, spoolJournalName)
+}
+
+// loadJournal reads the files recorded as read but not removed.
+func (s *spool) loadJournal() (map[string]int64, error) {
+	b, err := ioutil.ReadFile(s.journalPath())
+	if os.IsNotExist(err) {
+		return make(map[string]int64), nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read spool journal %q", s.journalPath())
+	}
+	var j spoolJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse spool journal %q", s.journalPath())
+	}
+	if j.Completed == nil {
+		j.Completed = make(map[string]int64)
+	}
+	return j.Completed, nil
+}
+
+// saveJournal replaces the journal with s.completed.
+func (s *spool) saveJournal() error {
+	b, err := json.Marshal(spoolJournal{Completed: s.completed})
+	if err != nil {
+		return err
+	}
+	tmp := s.journalPath() + ".new"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrapf(err, "Failed to write spool journal %q", s.journalPath())
+	}
+	if err := os.Rename(tmp, s.journalPath()); err != nil {
+		return errors.Wrapf(err, "Failed to replace spool journal %q", s.journalPath())
+	}
+	return nil
+}
+
+// stopSpools stops the spool workers and waits for them to exit.  Files
+// still waiting are left to be read when the process starts again.
+func (t *Tailer) stopSpools() {
+	t.spoolMu.Lock()
+	t.spoolsClosed = true
+	for _, s := range t.spools {
+		s.mu.Lock()
+		s.closed = true
+		for _, timer := range s.waiting {
+			timer.Stop()
+		}
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+	t.spoolMu.Unlock()
+	t.spoolWG.Wait()
+}
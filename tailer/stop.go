@@ -0,0 +1,138 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"context"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// stopPattern is the line given by WithStopPattern that a file stops being
+// tailed at.
+type stopPattern struct {
+	re        *regexp.Regexp
+	inclusive bool                  // The stop line is sent too
+	matched   chan *logline.LogLine // Given the stop line, if WaitForPattern is waiting for it
+}
+
+// notify hands l, the stop line, to WaitForPattern, if it's waiting for it.
+func (s *stopPattern) notify(l *logline.LogLine) {
+	if s.matched == nil {
+		return
+	}
+	select {
+	case s.matched <- l:
+	default:
+	}
+}
+
+// WithStopPattern stops tailing the path, or each file matching the
+// pattern, at the first line that re matches, such as the line a batch job
+// writes when it's finished.  The line is sent if inclusive is true, and
+// nothing after it is.  Then the file's EOF event is sent, which in OneShot
+// mode is the one that counts it as done, and it's closed.  Lines are
+// matched once they're complete, after escape sequences are stripped and
+// before they're redacted.  A new file at the path, such as after a
+// rotation, is tailed again as usual.
+func WithStopPattern(re *regexp.Regexp, inclusive bool) PathOption {
+	return func(o *pathOptions) error {
+		if re == nil {
+			return errors.New("stop pattern must not be nil")
+		}
+		o.stop = &stopPattern{re: re, inclusive: inclusive}
+		return nil
+	}
+}
+
+// setStopPattern records that files tailed for key, a folded absolute path
+// or an absolute pattern, stop at the line s matches, if s isn't nil.
+func (t *Tailer) setStopPattern(key string, s *stopPattern) {
+	if s == nil {
+		return
+	}
+	t.globPatternsMu.Lock()
+	t.stopPatterns[key] = s
+	t.globPatternsMu.Unlock()
+}
+
+// stopPatternFor returns the stop pattern given for pathname, or for a
+// pattern it matches, or nil if there's none.
+func (t *Tailer) stopPatternFor(pathname string) *stopPattern {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil
+	}
+	t.globPatternsMu.RLock()
+	defer t.globPatternsMu.RUnlock()
+	if len(t.stopPatterns) == 0 {
+		return nil
+	}
+	if s, ok := t.stopPatterns[t.fold(absPath)]; ok {
+		return s
+	}
+	for pattern, s := range t.stopPatterns {
+		if matched, err := t.matchPattern(pattern, absPath); err == nil && matched {
+			return s
+		}
+	}
+	return nil
+}
+
+// matchStop returns true if line is the File's stop line, after which
+// nothing more is read.
+func (f *File) matchStop(line string) bool {
+	if f.stop == nil || !f.stop.re.MatchString(line) {
+		return false
+	}
+	f.stopped = true
+	f.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("%s has reached its stop line, no longer reading it", f.Pathname)
+	return true
+}
+
+// stopTailing stops tailing fd, which has read its stop line.  Its EOF event
+// is sent, and it's closed, with a tombstone so that events for it already
+// on their way don't open it again.
+func (t *Tailer) stopTailing(fd *File) {
+	t.endOneShot(fd, nil)
+	t.bury(fd)
+	t.closeHandle(fd)
+}
+
+// WaitForPattern tails pathname from the beginning until a line matching re
+// is read, as TailPathWithPolicy with WithStopPattern would, and returns
+// that line, which is sent on the lines channel as well.  The lines before
+// it must still be read from the channel.  pathname is then untailed, as it
+// is if ctx is done first, when ctx's error is returned.  It returns an
+// *ErrAlreadyTailed if pathname is already given to TailPath.
+func (t *Tailer) WaitForPattern(ctx context.Context, pathname string, re *regexp.Regexp) (*logline.LogLine, error) {
+	if re == nil {
+		return nil, errors.New("stop pattern must not be nil")
+	}
+	s := &stopPattern{re: re, inclusive: true, matched: make(chan *logline.LogLine, 1)}
+	withStop := func(o *pathOptions) error {
+		o.stop = s
+		return nil
+	}
+	if err := t.TailPathWithPolicy(pathname, Beginning, withStop); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := t.Untail(pathname); err != nil {
+			t.logger.Info(err)
+		}
+	}()
+	select {
+	case l := <-s.matched:
+		return l, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-t.runDone:
+		return nil, errors.New("tailer is closed")
+	}
+}
@@ -11,92 +11,1180 @@ package tailer
 // directory.
 
 import (
+	"context"
 	"expvar"
 	"html/template"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pkg/errors"
 
+	"github.com/sgtsquiggs/tail/checkpoint"
+	"github.com/sgtsquiggs/tail/clock"
+	"github.com/sgtsquiggs/tail/internal/expvars"
 	log "github.com/sgtsquiggs/tail/logger"
 	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/schedule"
 	"github.com/sgtsquiggs/tail/watcher"
 )
 
-var (
-	// logCount records the number of logs that are being tailed
-	logCount = expvar.NewInt("log_count")
-)
+// Tailer receives notification of changes from a Watcher and extracts new log
+// lines from files. It also handles new log file creation events and log
+// rotations.
+type Tailer struct {
+	lastEvent int64 // time the last watcher event was handled, in Unix nanoseconds; accessed atomically
+
+	lines  chan<- *logline.LogLine // Logfile lines being emitted.
+	pull   <-chan *logline.LogLine // The receiving end of lines, for LineIterators, if created without a Lines channel
+	fanOut *fanOut                 // Copies lines to every LineIterator, if FanOut was set
+	shards *shardedOutput          // Splits lines between the shards, if WithShardedOutput was given
+	w      watcher.Watcher
+
+	handles sync.Map // File handles for each canonical pathname, as *File.
+	aliases sync.Map // Canonical pathname for absolute pathnames that are other spellings of a handle's, as string.
+
+	refsMu sync.Mutex                     // protects `refs'
+	refs   map[string]map[string]struct{} // Patterns, or "" for TailPath, that each canonical pathname is tailed for
+
+	hardLinks bool              // Tail paths that are hard links to files already being tailed
+	linkedMu  sync.Mutex        // protects `linked'
+	linked    map[string]string // Absolute paths skipped as hard links, to the handle key of the file they link to
+
+	globPatternsMu sync.RWMutex            // protects `globPatterns', `archiveSkips' and `stopPatterns'
+	globPatterns   map[string]struct{}     // glob patterns to match newly created files in dir paths against
+	archiveSkips   map[string][]string     // Globs of the archives each pattern skips, if not archiveSkip
+	archiveSkip    []string                // Globs of the archives patterns skip, if not defaultArchiveSkip
+	stopPatterns   map[string]*stopPattern // Given by WithStopPattern, by absolute pattern, or folded absolute path
+
+	liveMu       sync.Mutex              // protects `livePatterns'
+	livePatterns map[string]*livePattern // patterns of which only the latest match is tailed, by absolute pattern
+
+	spoolMu      sync.Mutex        // protects `spools' and `spoolsClosed'
+	spools       map[string]*spool // directories given to AddSpoolDir, by absolute path
+	spoolsClosed bool              // Set once the spool workers have been stopped
+	spoolWG      sync.WaitGroup    // Waits for the spool workers to exit
+
+	runDone chan struct{} // Signals termination of the run goroutine.
+
+	eventsHandle int // record the handle with which to add new log files to the watcher
+
+	oneShot   bool
+	positions bool       // Populate position fields on emitted lines
+	seq       *sequencer // Numbers emitted lines, if not nil
+
+	repeatWindow time.Duration // Summarise runs of duplicate lines once the first is this old, if > 0
+	repeatMax    int           // Summarise runs of duplicate lines once they're this long, if > 0
+	collapse     bool          // Collapse consecutive duplicate lines
+	repeatField  bool          // Summarise duplicates with the Repeat field rather than a line
+
+	sampleSeed   int64         // Seeds the random choice of lines to keep
+	sampleMarker time.Duration // How often to emit a line with the sampling counts, if > 0
+
+	timestampParser func(string) (time.Time, bool) // Parses the timestamps lines are merged by
+	mergeSkew       time.Duration                  // Merge lines from all files in timestamp order, holding them up to this long, if > 0
+	merge           *orderedMerge                  // Merges lines in timestamp order, if mergeSkew > 0
+
+	shardCount int // Number of channels lines are split between, if > 0
+
+	redactors  []redactor             // Rules applied to each line before it's emitted
+	transform  func(*logline.LogLine) // Applied to each line before it's emitted, if not nil; set by tests
+	jsonFields []string               // Top-level fields of JSON lines to set as labels, if not empty
+
+	kubernetesLabels bool // Label lines with the names in the paths of Kubernetes logs
+
+	maxLineLength int                // Truncate lines longer than this, if > 0
+	crMode        CarriageReturnMode // What a carriage return not followed by a newline does
+	stripANSI     bool               // Remove ANSI escape sequences from lines
+
+	maxLines   int64 // Stop reading each file after sending this many lines, if > 0
+	maxBytes   int64 // Stop reading each file after sending this many bytes of lines, if > 0
+	quotaReset bool  // Start the line and byte quotas again on each new generation of a file
+
+	nulSkip int // Skip runs of at least this many NUL bytes, if > 0
+
+	filenameBase    string // Report filenames relative to this absolute path, if set
+	resolveSymlinks bool   // Report filenames with symbolic links resolved
+
+	mmapBackfill bool // Read existing contents of newly opened files through mmap
+
+	specialFiles bool // Tail directories and named pipes given to TailPath
+
+	replaceOnRetail bool // Tail a path given to TailPath again from the start policy, rather than return ErrAlreadyTailed
+
+	openPaths bool // Report where each file is now on its lines, once it has been moved
+
+	binary        BinaryHeuristic     // Decides if newly opened files are binary, if not nil
+	binaryAllowed map[string]bool     // Absolute paths not checked by binary
+	skippedMu     sync.Mutex          // protects `skipped' and `skippedArchives'
+	skipped       map[string]struct{} // Absolute paths not tailed because they look binary
+
+	skippedArchives map[string]struct{} // Absolute paths matching a pattern not tailed because they look like archives
+
+	wrongTypeMu sync.Mutex             // protects `wrongType'
+	wrongType   map[string]os.FileMode // Absolute paths of tailed files replaced by something else, with its type
+
+	breaker      breakerConfig // Stops files being read for a while after failing over and over, if failures > 0
+	errorHistory int           // Failures of each file kept for Stats
+
+	registryPath     string                                       // Save the offsets of files read in this file, if set
+	registryKey      RegistryKey                                  // How files in the registry are identified
+	registryInterval time.Duration                                // How often the registry is saved
+	registryTTL      time.Duration                                // Drop registry entries for files not seen for this long, if > 0
+	registrySeed     map[checkpoint.Fingerprint]checkpoint.Offset // Offsets to add to the registry when it's opened
+	registry         *registry                                    // Records how far files have been read, if registryPath is set
+	ackWindow        int                                          // Lines of each file that may wait to be acknowledged, if > 0
+	deliveryMode     DeliveryMode                                 // What's guaranteed about lines if the process dies
+	deliveryModeSet  bool                                         // WithDeliveryMode was given
+	acksReleased     chan struct{}                                // Closed by Close, so that sending no longer waits for acknowledgments
+	releaseOnce      sync.Once
+
+	maxInitialSize int64                // Files larger than this aren't read from the beginning when first opened, if > 0
+	skipLarge      bool                 // Don't tail files larger than maxInitialSize, rather than reading from their end
+	largeMu        sync.Mutex           // protects `large'
+	large          map[string]LargeFile // Files found larger than maxInitialSize, by absolute path
+
+	budget *partialBudget // Limits the memory held by partial lines, if not nil
+
+	again    []*File // Files with more to read after their last event, in the order to read them
+	againSet map[*File]struct{}
+
+	ratesMu     sync.RWMutex     // protects `defaultRate' and `pathRates'
+	defaultRate int64            // Bytes per second read from each file, if > 0
+	pathRates   map[string]int64 // Bytes per second read from each absolute path, overriding defaultRate
+
+	globalRate int64       // Bytes per second read from all files, if > 0
+	global     *sharedRate // Limits the rate of reads across all files, if not nil
+
+	sched         *schedule.Scheduler      // Calls the functions timed for each file, and the periodic ones
+	throttled     map[*File]*throttledFile // Files waiting to be read again
+	throttleTurns uint64                   // Numbers the files as they're throttled, for the order they're read again in
+	wake          chan struct{}            // Signalled when the timer of a throttled file fires
+
+	backfillConcurrency int            // Number of workers opening files given to TailPath, if > 0
+	discovery           *discovery     // Tails the matches of new patterns in parallel, most recent first, if not nil
+	queue               *backfillQueue // Files waiting for a backfill worker
+	backfilled          chan *File     // Files read to their end by a worker, to be handed over to run
+	backfillQuit        chan struct{}  // Closed when run exits
+
+	processedHook func(watcher.Event) // Called after each event has been handled
+
+	sequencer watcher.EventSequencer // The watcher's count of the events it has sent, if it keeps one
+	ackMu     sync.Mutex             // protects `acked' and `ackCh'
+	acked     uint64                 // Number of events handled
+	ackCh     chan struct{}          // Closed when acked next changes
+
+	requests chan request // Functions to call in run, from methods that read files
+
+	fileEvents chan<- FileEvent // Changes in the state of tailed files are sent here, if not nil
+
+	mirrorWriter   io.Writer // Every line sent is copied here, if not nil
+	mirrorFilename bool      // Prefix the lines copied with their file's name
+	mirror         *mirror   // Copies the lines to mirrorWriter, if not nil
+
+	flushOnDelete bool                   // Send the final partial line of a deleted file, or of every file on a quiet shutdown
+	followRenames bool                   // Keep tailing a file renamed within the watched paths at its new path
+	deletedMu     sync.Mutex             // protects `deleted'
+	deleted       map[string]deletedPath // Generation to use if a deleted absolute path is created again
+
+	tombstonesMu sync.Mutex           // protects `tombstones'
+	tombstones   map[string]tombstone // Files untailed, by absolute path, whose queued events are dropped
+
+	watchModesMu sync.Mutex                   // protects `watchModes'
+	watchModes   map[string]watcher.WatchMode // Modes given by WithWatchMode, by absolute path of the file or the pattern's directory
+
+	appliedMu sync.Mutex                  // serialises ApplyConfig, and protects `applied'
+	applied   map[appliedKey]*pathOptions // Patterns and paths applied by ApplyConfig, with their options
+
+	foldCase bool // Paths are compared without regard to case
+
+	quiet *quietShutdown // Shuts the Tailer down when nothing has been read for a while, if not nil
+
+	stallThreshold time.Duration // Flag the consumer of lines as stalled after this long, if > 0
+	consumer       *consumer     // Tracks the sends on the lines channel the consumer receives from
+	held           *inFlight     // Counts the lines held between the lines channel and the consumer
+
+	clock clock.Clock
+
+	logger *log.Leveled
+	hotLog *log.RateLimitedLogger // Limits the messages a failing path may repeat for every event
+
+	metrics       *metrics // The Tailer's counters
+	expvarPrefix  string   // Prefix of the names metrics are published under
+	publishExpvar bool     // WithExpvar was given
+
+	settings liveSettings // The settings read by files as they're read, which SetOption may change
+
+	expiryInterval time.Duration   // How often Gc is run, if > 0
+	gcMu           sync.Mutex      // protects `gcTimer' and `gcDue'
+	gcTimer        *schedule.Timer // Tells the Gc loop to run Gc, if running
+	gcDue          chan struct{}   // Receives from gcTimer, once the Gc loop has started
+
+	started   bool       // NewFromConfig has returned, so SetOption only accepts dynamic options
+	optionsMu sync.Mutex // serialises SetOption once started
+	probeOf   *Tailer    // The running Tailer, if this is a probe of SetOption
+	dynamic   bool       // The option applied to this probe can be changed while running
+}
+
+// Option used to set tailer options.
+type Option func(*Tailer) error
+
+// OneShot puts the tailer in one-shot mode.
+func OneShot(t *Tailer) error {
+	t.oneShot = true
+	return nil
+}
+
+// WithPositions enables tracking of the byte offsets and line number of each
+// line read, which are then reported on the emitted LogLines.  A line's
+// EndOffset, just after its newline, is where to resume reading the file
+// once the line has been handled.
+func WithPositions() Option {
+	return func(t *Tailer) error {
+		t.positions = true
+		return nil
+	}
+}
+
+// WithSequenceNumbers numbers each emitted line in the Seq field, in the
+// order lines are sent on the lines channel.  Numbers increase across all
+// the Tailers in the process, so each Tailer's lines have gaps where
+// another Tailer sent lines; within a Tailer, the Seq of a line is greater
+// than that of every line sent before it.  Every line numbered is sent, so
+// the only gaps no other Tailer accounts for are lines dropped after they're
+// sent, such as by a reader from NewReader whose overflow policy drops
+// lines.
+func WithSequenceNumbers() Option {
+	return func(t *Tailer) error {
+		t.seq = &sequencer{}
+		return nil
+	}
+}
+
+// WithDuplicateCollapse emits only the first of a run of consecutive,
+// byte-identical lines from a file.  The rest are counted, and summarised
+// with the line "last message repeated N times" when a different line is
+// read, when the run reaches max repeats, once window has passed since the
+// first repeat in the summary, even if nothing more is read, and when the
+// file is rotated or truncated.  A window or max of zero has no limit.  Collapsed
+// lines are counted per file in log_lines_collapsed_total.
+func WithDuplicateCollapse(window time.Duration, max int) Option {
+	return func(t *Tailer) error {
+		if window < 0 || max < 0 {
+			return errors.Errorf("invalid duplicate collapse window %s or max %d", window, max)
+		}
+		t.collapse = true
+		t.repeatWindow = window
+		t.repeatMax = max
+		return nil
+	}
+}
+
+// WithRepeatField summarises the repeats collapsed by WithDuplicateCollapse
+// with a copy of the repeated line that has Repeat set to their number,
+// rather than a summary line.
+func WithRepeatField() Option {
+	return func(t *Tailer) error {
+		t.repeatField = true
+		return nil
+	}
+}
+
+// WithSampling keeps each line of each file with probability rate, unless
+// the file has its own rate set with WithPathSampling, and drops the rest.
+// Rates that are a fraction with a denominator of at most 100 keep that
+// fraction of lines deterministically; a rate of 0.01 keeps the first of
+// every 100 lines.  Dropped lines are counted per file in
+// log_lines_sampled_out_total.  Sampling applies to each line as it's
+// emitted, so a long line emitted in pieces is sampled piece by piece.
+func WithSampling(rate float64) Option {
+	return func(t *Tailer) error {
+		if rate <= 0 || rate > 1 {
+			return errors.Errorf("invalid sampling rate %g", rate)
+		}
+		return t.update(func(t *Tailer) error {
+			t.settings.change(func(s *settings) { s.sampleRate = rate })
+			return nil
+		})
+	}
+}
+
+// WithPathSampling keeps each line of path with probability rate, as
+// WithSampling does for all files.  A rate of 1 keeps every line.
+func WithPathSampling(path string, rate float64) Option {
+	return func(t *Tailer) error {
+		if rate <= 0 || rate > 1 {
+			return errors.Errorf("invalid sampling rate %g", rate)
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		return t.update(func(t *Tailer) error {
+			t.settings.change(func(s *settings) { s.pathSamples[absPath] = rate })
+			return nil
+		})
+	}
+}
+
+// WithSamplingMarker emits a line "sampled: kept X of Y" from each sampled
+// file, after the first line seen once interval has passed since the last
+// one, so that counts downstream can be scaled back up.
+func WithSamplingMarker(interval time.Duration) Option {
+	return func(t *Tailer) error {
+		if interval <= 0 {
+			return errors.Errorf("sampling marker interval must be positive, got %s", interval)
+		}
+		t.sampleMarker = interval
+		return nil
+	}
+}
+
+// WithSamplingSeed seeds the random choice of lines to keep, for
+// reproducible sampling.
+func WithSamplingSeed(seed int64) Option {
+	return func(t *Tailer) error {
+		t.sampleSeed = seed
+		return nil
+	}
+}
+
+// WithTimestampParser sets the function that parses the timestamp embedded
+// in a line, for WithOrderedMerge.  It returns false if the line has no
+// timestamp, in which case the line is ordered as if it had the timestamp
+// of the line before it in the same file.
+func WithTimestampParser(fn func(line string) (time.Time, bool)) Option {
+	return func(t *Tailer) error {
+		t.timestampParser = fn
+		return nil
+	}
+}
+
+// WithOrderedMerge emits the lines from all files in the order of their
+// timestamps, as parsed by the function given to WithTimestampParser, rather
+// than the order they're read in.  Each line is held until every file being
+// read has reached its timestamp, but not once it's more than maxSkew older
+// than the newest line seen, or has been held for maxSkew.
+//
+// It's intended for replaying history in OneShot mode, where a file stops
+// being read once it's been read to its end.  Files are only merged with
+// the others being read at the same time, so give WithBackfillConcurrency
+// at least as many workers as there are files.  In live mode a file that is
+// being followed is never finished, so lines are held for up to maxSkew;
+// this is the latency the merge adds.
+func WithOrderedMerge(maxSkew time.Duration) Option {
+	return func(t *Tailer) error {
+		if maxSkew <= 0 {
+			return errors.Errorf("ordered merge skew must be positive, got %s", maxSkew)
+		}
+		t.mergeSkew = maxSkew
+		return nil
+	}
+}
+
+// WithShardedOutput sends lines to n channels, read with Shard, rather than
+// one, so that they can be consumed by n goroutines.  Each file's lines all
+// go to the same shard, chosen by a hash of the name reported on them, so
+// they stay in order, and a file keeps its shard when it's rotated.  The
+// Tailer must be created by NewFromConfig without a Lines channel or
+// FanOut.  A shard that isn't read holds back the others.
+func WithShardedOutput(n int) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("sharded output needs at least one shard, got %d", n)
+		}
+		t.shardCount = n
+		return nil
+	}
+}
+
+// WithRedaction applies rules, in order, to every line before it's emitted,
+// so that what they match never reaches the lines channel.  Labels are
+// extracted from the redacted line.  The substitutions made by each rule are
+// counted in log_redactions_total, by the rule's regular expression.
+func WithRedaction(rules []RedactRule) Option {
+	return func(t *Tailer) error {
+		for i, r := range rules {
+			if r.Regexp == nil {
+				return errors.Errorf("redaction rule %d has no regexp", i)
+			}
+			t.redactors = append(t.redactors, newRedactor(r))
+		}
+		return nil
+	}
+}
+
+// WithJSONFields sets the Labels of lines that are JSON objects to the
+// values of the named top-level string fields, leaving the Line as it is.
+// Lines that aren't JSON objects are emitted without labels, and counted
+// per file in log_json_parse_errors_total.
+func WithJSONFields(fields ...string) Option {
+	return func(t *Tailer) error {
+		if len(fields) == 0 {
+			return errors.New("no JSON fields given")
+		}
+		t.jsonFields = fields
+		return nil
+	}
+}
+
+// WithMaxLineLength truncates lines longer than n bytes.  The first n bytes
+// are emitted with the Truncated flag set, and the rest of the line is
+// discarded.
+func WithMaxLineLength(n int) Option {
+	return func(t *Tailer) error {
+		if n < 0 {
+			return errors.Errorf("invalid max line length %d", n)
+		}
+		t.maxLineLength = n
+		return nil
+	}
+}
+
+// WithCarriageReturns says what a carriage return that isn't followed by a
+// newline does, for logs of progress bars redrawn with `\r`, rather than
+// KeepCarriageReturns.  A carriage return at the end of a read isn't acted
+// on until the next read shows it isn't the start of a CRLF.
+func WithCarriageReturns(mode CarriageReturnMode) Option {
+	return func(t *Tailer) error {
+		if mode < KeepCarriageReturns || mode > SplitOnCarriageReturn {
+			return errors.Errorf("unknown carriage return mode %s", mode)
+		}
+		t.crMode = mode
+		return nil
+	}
+}
+
+// WithStripANSI removes ANSI escape sequences, such as colours and cursor
+// movements, from lines before they're emitted, for logs captured from
+// terminals.  Control sequences and OSC strings are removed whole, and one
+// left incomplete at the end of a line is dropped.  A line that's left empty
+// is sent like any other empty line.
+func WithStripANSI() Option {
+	return func(t *Tailer) error {
+		t.stripANSI = true
+		return nil
+	}
+}
+
+// WithMaxLines stops reading each file once n lines have been sent from it,
+// for taking the first lines of each file.  Later events for the file are
+// ignored, and in OneShot mode the file is done.  A QuotaReached FileEvent
+// is sent when the file stops being read.
+func WithMaxLines(n int64) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid max lines %d", n)
+		}
+		t.maxLines = n
+		return nil
+	}
+}
+
+// WithMaxBytes stops reading each file once the lines sent from it, counting
+// their newlines, would exceed n bytes.  It's otherwise like WithMaxLines, and
+// the two can be given together.
+func WithMaxBytes(n int64) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid max bytes %d", n)
+		}
+		t.maxBytes = n
+		return nil
+	}
+}
+
+// WithQuotaReset starts the quotas of WithMaxLines and WithMaxBytes again
+// each time a file is rotated or truncated, such as for the first lines of
+// each day's log.  By default a file stops being read for good.
+func WithQuotaReset() Option {
+	return func(t *Tailer) error {
+		t.quotaReset = true
+		return nil
+	}
+}
+
+// WithSkipNULRuns skips runs of at least n NUL bytes in the files being
+// tailed, such as preallocated space or the hole left in a file by a crash,
+// rather than sending them as part of a line.  The line before a skipped
+// run is ended there.  Shorter runs are kept, so n should be larger than
+// any run of NULs expected in the logged data.
+func WithSkipNULRuns(n int) Option {
+	return func(t *Tailer) error {
+		if n < 0 {
+			return errors.Errorf("invalid NUL run length %d", n)
+		}
+		t.nulSkip = n
+		return nil
+	}
+}
+
+// WithFilenameBase reports the filename on LogLines, FileEvents and in Stats
+// relative to base, such as nginx/access.log for /mnt/host/logs/nginx/access.log
+// with a base of /mnt/host/logs.  Files outside base are reported by their
+// absolute path.
+func WithFilenameBase(base string) Option {
+	return func(t *Tailer) error {
+		absBase, err := filepath.Abs(base)
+		if err != nil {
+			return errors.Wrapf(err, "invalid filename base %q", base)
+		}
+		t.filenameBase = absBase
+		return nil
+	}
+}
+
+// WithResolveSymlinks reports the filename on LogLines with any symbolic
+// links resolved.  If a link is pointed at a new file, it's treated as a
+// rotation, and the new generation is reported under the new file's name.
+func WithResolveSymlinks() Option {
+	return func(t *Tailer) error {
+		t.resolveSymlinks = true
+		return nil
+	}
+}
+
+// reportedName returns the name to report for the file given as pathname,
+// whose absolute path is absPath.
+func (t *Tailer) reportedName(pathname, absPath string) string {
+	if t.resolveSymlinks {
+		if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+			pathname, absPath = resolved, resolved
+		}
+	}
+	if t.filenameBase == "" {
+		return pathname
+	}
+	rel, err := filepath.Rel(t.filenameBase, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return absPath
+	}
+	return rel
+}
+
+// WithSpecialFiles makes TailPath tail the files in a directory given to it,
+// and those created there later, as if they matched a pattern, and read a
+// named pipe given to it as a pipe, instead of returning ErrNotRegularFile.
+// A file given to TailPath that's replaced by a directory has the directory
+// tailed the same way, rather than being reported as a WrongType.
+func WithSpecialFiles() Option {
+	return func(t *Tailer) error {
+		t.specialFiles = true
+		return nil
+	}
+}
+
+// WithReplaceOnRetail makes TailPath, given a path it was already given,
+// close the file and tail it again from the start policy of the new call,
+// instead of returning an *ErrAlreadyTailed.
+func WithReplaceOnRetail() Option {
+	return func(t *Tailer) error {
+		t.replaceOnRetail = true
+		return nil
+	}
+}
+
+// WithOpenPaths sets OpenPath on the lines read from a file that is no
+// longer where it was opened, such as the rest of a log read after it was
+// rotated, to where it is now or DescriptorDeleted.  The file is found from
+// its descriptor, which is only possible on Linux.
+func WithOpenPaths() Option {
+	return func(t *Tailer) error {
+		t.openPaths = true
+		return nil
+	}
+}
+
+// WithBinaryDetection checks the first few KB of each file when it's opened
+// with heuristic, and doesn't tail those it decides are binary, such as
+// compressed rotated logs or core dumps matched by a pattern.  Skipped files
+// are checked again when they change.  A nil heuristic uses
+// ControlRatio(DefaultBinaryRatio).
+func WithBinaryDetection(heuristic BinaryHeuristic) Option {
+	return func(t *Tailer) error {
+		if heuristic == nil {
+			heuristic = ControlRatio(DefaultBinaryRatio)
+		}
+		t.binary = heuristic
+		return nil
+	}
+}
+
+// WithBinaryAllowed tails path even if it looks like a binary file to the
+// heuristic given to WithBinaryDetection.
+func WithBinaryAllowed(path string) Option {
+	return func(t *Tailer) error {
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return err
+		}
+		t.binaryAllowed[absPath] = true
+		return nil
+	}
+}
+
+// WithMaxInitialFileSize reads files that are larger than n bytes when
+// they're first opened from their end, rather than from the beginning as
+// for files created while a pattern is watched or in OneShot mode.  Files
+// that grow past n once they're being tailed are unaffected.  Use the Full
+// StartPolicy to read a file even if it's larger.
+func WithMaxInitialFileSize(n int64) Option {
+	return func(t *Tailer) error {
+		if n < 0 {
+			return errors.Errorf("invalid file size %d", n)
+		}
+		t.maxInitialSize = n
+		return nil
+	}
+}
+
+// WithSkipLargeFiles doesn't tail files that are larger than the size given
+// to WithMaxInitialFileSize, instead of reading them from their end.
+func WithSkipLargeFiles() Option {
+	return func(t *Tailer) error {
+		t.skipLarge = true
+		return nil
+	}
+}
+
+// WithLagWarning logs a warning when reading a file falls more than bytes
+// behind its end, or there has been unread data for longer than behind.  A
+// limit of 0 isn't checked.  The warning is logged once each time the lag
+// goes above the threshold.
+func WithLagWarning(bytes int64, behind time.Duration) Option {
+	return func(t *Tailer) error {
+		if bytes < 0 || behind < 0 {
+			return errors.Errorf("invalid lag threshold %d bytes or %s", bytes, behind)
+		}
+		return t.update(func(t *Tailer) error {
+			t.settings.change(func(s *settings) { s.lagThreshold = lagThreshold{bytes, behind} })
+			return nil
+		})
+	}
+}
+
+// WithRegistry records how far each file has been read in a registry saved
+// at path, and when a file is opened that the registry has an entry for,
+// reading resumes from there rather than where the StartPolicy says.  Files
+// are identified as key says, so that with RegistryByInode or
+// RegistryByContent a file renamed while the Tailer wasn't running is still
+// resumed at the right offset.  The registry is saved every 10 seconds, and
+// when the Tailer is closed.  Each save appends the entries that have
+// changed to a journal, path + ".journal", which is compacted into the
+// snapshot at path once it would be the larger, and when the registry is
+// opened or closed.  If either file is found damaged, as by a crash while
+// it was written, the entries before the damage are kept, what was lost is
+// logged, and a copy of the file is left at its path + ".corrupt".
+func WithRegistry(path string, key RegistryKey) Option {
+	return func(t *Tailer) error {
+		if path == "" {
+			return errors.New("registry path must not be empty")
+		}
+		t.registryPath = path
+		t.registryKey = key
+		return nil
+	}
+}
+
+// WithRegistryInterval saves the registry every d, rather than every 10
+// seconds.
+func WithRegistryInterval(d time.Duration) Option {
+	return func(t *Tailer) error {
+		if d <= 0 {
+			return errors.Errorf("registry interval must be positive, got %s", d)
+		}
+		t.registryInterval = d
+		return nil
+	}
+}
+
+// WithRegistryTTL drops the registry entries of files that haven't been seen
+// for longer than ttl, rather than 7 days, when the registry is opened and
+// saved.  The time the Tailer wasn't running doesn't count when it's opened.
+// A ttl of 0 keeps entries forever.
+func WithRegistryTTL(ttl time.Duration) Option {
+	return func(t *Tailer) error {
+		if ttl < 0 {
+			return errors.Errorf("registry TTL can't be negative, got %s", ttl)
+		}
+		t.registryTTL = ttl
+		return nil
+	}
+}
+
+// WithRegistrySeed adds the offsets of files, such as those imported by
+// checkpoint.ImportFilebeatRegistry, to the registry given to WithRegistry
+// before any files are opened.  Files the registry already has an entry for
+// keep theirs, so the seed only takes effect the first time.  The
+// Fingerprints must be of the kind that the registry's RegistryKey gives.
+func WithRegistrySeed(offsets map[checkpoint.Fingerprint]checkpoint.Offset) Option {
+	return func(t *Tailer) error {
+		t.registrySeed = offsets
+		return nil
+	}
+}
+
+// WithAckedOffsets records files in the registry as read only up to the
+// lines that have been acknowledged, by calling the Ack of each LogLine, for
+// consumers that must not lose a line sent before they've stored it.  Lines
+// not acknowledged when the process dies are read and sent again when it
+// restarts, so some may be sent twice.  Sending a line blocks while window
+// lines of its file are waiting to be acknowledged, holding back the Tailer.
+// Lines still waiting when a file is rotated or truncated are forgotten, as
+// its new contents are read from the start.  It needs WithRegistry, and
+// implies AtLeastOnce delivery.
+func WithAckedOffsets(window int) Option {
+	return func(t *Tailer) error {
+		if window < 1 {
+			return errors.Errorf("ack window must be at least 1 line, got %d", window)
+		}
+		t.ackWindow = window
+		return nil
+	}
+}
+
+// WithDeliveryMode chooses what's guaranteed about the lines of files
+// recorded in the registry if the process dies, rather than BestEffort.
+// AtMostOnce and AtLeastOnce need WithRegistry, and AtLeastOnce acknowledges
+// up to 1024 lines of each file at a time unless WithAckedOffsets gives
+// another window.  AtLeastOnce can't be used with FanOut, or with a reader
+// from NewReader that drops lines.  Close saves the registry in every mode;
+// with AtLeastOnce it only covers the lines acknowledged by then, as sending
+// stops waiting for acknowledgements once Close is called.
+func WithDeliveryMode(mode DeliveryMode) Option {
+	return func(t *Tailer) error {
+		if mode < BestEffort || mode > AtLeastOnce {
+			return errors.Errorf("unknown delivery mode %s", mode)
+		}
+		t.deliveryMode = mode
+		t.deliveryModeSet = true
+		return nil
+	}
+}
+
+// WithMmapBackfill reads the existing contents of regular files through a
+// memory mapping when they're first opened, which is faster than reading them
+// for large files, such as in OneShot mode.  Growth of the file after it's
+// opened is read normally.  Where mmap isn't supported files are read
+// normally.
+func WithMmapBackfill() Option {
+	return func(t *Tailer) error {
+		t.mmapBackfill = true
+		return nil
+	}
+}
+
+// WithBackfillConcurrency limits the number of files given to TailPath,
+// including the matches found by TailPattern, that are opened and read up to
+// their current end at once to n.  TailPath queues the file and returns
+// immediately; the file is tailed like any other once it has been read.
+// Files created while the Tailer is running aren't queued behind these.
+func WithBackfillConcurrency(n int) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid backfill concurrency %d", n)
+		}
+		t.backfillConcurrency = n
+		return nil
+	}
+}
+
+// WithPartialBufferBudget limits the total size of the partial lines, those
+// not yet ended by a newline, held across all files to n bytes.  When the
+// limit is exceeded the largest partial lines are sent early with the
+// Truncated flag set, and the rest of each is sent as a new line.
+func WithPartialBufferBudget(n int64) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid partial buffer budget %d", n)
+		}
+		t.budget = newPartialBudget(n)
+		return nil
+	}
+}
+
+// WithCircuitBreaker stops reading a file for coolOff once the same
+// operation on it, reading it or reopening it after failed reads, has failed
+// failures times in a row, as a file on a flaky mount may on every event.
+// Events for the file are skipped while its breaker is open and counted in
+// log_breaker_skipped_total.  After the cool-off the file is tried once
+// more: success closes the breaker, and failure opens it again for twice as
+// long, up to maxCoolOff.  The state of each breaker that isn't closed, or
+// has failures counted, is in Stats, and each change of state is sent as a
+// BreakerOpen, BreakerHalfOpen or BreakerClosed FileEvent.
+func WithCircuitBreaker(failures int, coolOff, maxCoolOff time.Duration) Option {
+	return func(t *Tailer) error {
+		if failures < 1 || coolOff <= 0 || maxCoolOff < coolOff {
+			return errors.Errorf("invalid circuit breaker failures %d, cool-off %s or max cool-off %s", failures, coolOff, maxCoolOff)
+		}
+		t.breaker = breakerConfig{failures: failures, coolOff: coolOff, maxCoolOff: maxCoolOff}
+		return nil
+	}
+}
+
+// WithMaxBytesPerRead limits the bytes read from a file in response to each
+// event to n.  If there's more to read, the file is read again once the
+// events already waiting and the other files with more to read have had a
+// turn, so that catching up on a large file doesn't hold up the rest.
+func WithMaxBytesPerRead(n int64) Option {
+	return func(t *Tailer) error {
+		if n < 1 {
+			return errors.Errorf("invalid max bytes per read %d", n)
+		}
+		return t.update(func(t *Tailer) error {
+			t.settings.change(func(s *settings) { s.maxBytesPerRead = n })
+			return nil
+		})
+	}
+}
+
+// WithDefaultByteRate limits the rate at which each file is read to
+// bytesPerSec, unless it has its own limit set with WithPathByteRate.  Reads
+// over the limit are delayed, not dropped.  A rate of zero is unlimited.
+func WithDefaultByteRate(bytesPerSec int64) Option {
+	return func(t *Tailer) error {
+		return t.update(func(t *Tailer) error { return t.SetDefaultByteRate(bytesPerSec) })
+	}
+}
+
+// WithGlobalByteRate limits the total rate at which all files are read to
+// bytesPerSec, on top of any limits on each file.  Each file read in response
+// to an event takes at most an equal share of the limit before the others
+// have a turn.  Files waiting for the limit take their turns in the order
+// they started waiting.
+func WithGlobalByteRate(bytesPerSec int64) Option {
+	return func(t *Tailer) error {
+		if bytesPerSec < 1 {
+			return errors.Errorf("invalid byte rate %d", bytesPerSec)
+		}
+		return t.update(func(t *Tailer) error {
+			if !t.started {
+				t.globalRate = bytesPerSec
+				return nil
+			}
+			if t.global == nil {
+				return errors.New("a global byte rate can only be added when the tailer is created")
+			}
+			t.global.setRate(bytesPerSec)
+			return nil
+		})
+	}
+}
 
-// Tailer receives notification of changes from a Watcher and extracts new log
-// lines from files. It also handles new log file creation events and log
-// rotations.
-type Tailer struct {
-	lines chan<- *logline.LogLine // Logfile lines being emitted.
-	w     watcher.Watcher
+// WithPathByteRate limits the rate at which path is read to bytesPerSec.
+// Reads over the limit are delayed, not dropped.  A rate of zero is
+// unlimited.
+func WithPathByteRate(path string, bytesPerSec int64) Option {
+	return func(t *Tailer) error {
+		return t.update(func(t *Tailer) error { return t.SetPathByteRate(path, bytesPerSec) })
+	}
+}
 
-	handlesMu sync.RWMutex     // protects `handles'
-	handles   map[string]*File // File handles for each pathname.
+// WithFileEvents sends changes in the state of tailed files, such as a
+// backfill catching up, on ch.  They're sent from the goroutine reading the
+// file, so ch must be received from promptly.
+func WithFileEvents(ch chan<- FileEvent) Option {
+	return func(t *Tailer) error {
+		t.fileEvents = ch
+		return nil
+	}
+}
 
-	globPatternsMu sync.RWMutex        // protects `globPatterns'
-	globPatterns   map[string]struct{} // glob patterns to match newly created files in dir paths against
+// WithFlushOnDelete sends the final line of a deleted file even if it
+// doesn't end in a newline, marked truncated.  By default it's dropped, as
+// the rest of the line will never be written.
+func WithFlushOnDelete() Option {
+	return func(t *Tailer) error {
+		t.flushOnDelete = true
+		return nil
+	}
+}
 
-	runDone chan struct{} // Signals termination of the run goroutine.
+// WithFollowRenames keeps tailing a file at its new path when the
+// watcher reports that it was renamed, as the LogWatcher does given
+// WithInotify, continuing from where it had been read up to.  By default a
+// rename is handled as the deletion of the old path and the creation of the
+// new one.  Either way, a new file at the old path is tailed from its
+// beginning.
+func WithFollowRenames() Option {
+	return func(t *Tailer) error {
+		t.followRenames = true
+		return nil
+	}
+}
 
-	eventsHandle int // record the handle with which to add new log files to the watcher
+// WithQuietShutdown closes the Tailer once no line has been sent and no file
+// opened for d, and no files are left waiting for backfill workers, such as
+// for a batch job over a directory that may still get a few trailing writes.
+// The partial lines of the files are sent first, marked truncated, if
+// WithFlushOnDelete is given.  The lines channel is closed as it is by Close.
+func WithQuietShutdown(d time.Duration) Option {
+	return func(t *Tailer) error {
+		if d <= 0 {
+			return errors.Errorf("quiet shutdown period must be positive, got %s", d)
+		}
+		t.quiet = &quietShutdown{d: d}
+		return nil
+	}
+}
 
-	oneShot bool
+// WithHardLinks tails every path, even those that are hard links to a file
+// already being tailed, so its lines are emitted once for each.  By default
+// they're skipped.
+func WithHardLinks() Option {
+	return func(t *Tailer) error {
+		t.hardLinks = true
+		return nil
+	}
+}
 
-	logger log.Logger
+// WithProcessedHook registers fn to be called by the event loop after each
+// event from the watcher has been handled, by which time all the reads it
+// caused are complete and their lines sent.  It's intended for tests that
+// need to know when the Tailer has quiesced.
+func WithProcessedHook(fn func(watcher.Event)) Option {
+	return func(t *Tailer) error {
+		t.processedHook = fn
+		return nil
+	}
 }
 
-// Option used to set tailer options.
-type Option func(*Tailer) error
+// WithExpvar publishes the Tailer's counters in expvar, such as log_lines_total
+// and log_errors_total, with their names prefixed by prefix, for example to
+// tell apart the Tailers of the tenants of an agent.  Without it they're
+// only counted.  NewFromConfig returns an error if any of the names are
+// already published, which they stay for the life of the process, so each
+// Tailer published needs a prefix of its own.
+func WithExpvar(prefix string) Option {
+	return func(t *Tailer) error {
+		t.expvarPrefix = prefix
+		t.publishExpvar = true
+		return nil
+	}
+}
 
-// OneShot puts the tailer in one-shot mode.
-func OneShot(t *Tailer) error {
-	t.oneShot = true
-	return nil
+// WithClock sets the clock used for timestamps and timers, instead of the
+// real clock.
+func WithClock(c clock.Clock) Option {
+	return func(t *Tailer) error {
+		t.clock = c
+		return nil
+	}
 }
 
 // Logger defines the logger.
 func Logger(l log.Logger) Option {
 	return func(t *Tailer) error {
-		t.logger = l
+		t.logger = log.NewLeveled(l, t.logger.Level())
+		t.hotLog = log.RateLimited(t.logger, logRateInterval, logRateBurst)
 		return nil
 	}
 }
 
+// WithLogLevel sets the verbosity of the Tailer's logging.  Per-event
+// messages are logged at DebugLevel, and changes in the state of tailed
+// files at InfoLevel.
+func WithLogLevel(level log.Level) Option {
+	return func(t *Tailer) error {
+		return t.update(func(t *Tailer) error {
+			t.SetLogLevel(level)
+			return nil
+		})
+	}
+}
+
+// WithExpiryInterval runs Gc every d, as Config.ExpiryInterval and
+// StartGcLoop do.  Given to a running Tailer it changes how often Gc is run,
+// from now, and an interval of 0 stops it being run.
+func WithExpiryInterval(d time.Duration) Option {
+	return func(t *Tailer) error {
+		if d < 0 {
+			return errors.Errorf("invalid expiry interval %s", d)
+		}
+		return t.update(func(t *Tailer) error {
+			if !t.started {
+				t.expiryInterval = d
+				return nil
+			}
+			t.setExpiryInterval(d)
+			return nil
+		})
+	}
+}
+
+const (
+	// logRateInterval and logRateBurst limit the messages about each
+	// operation on each path that may fail again on every event, such as
+	// opening or reading it: logRateBurst may be logged at once, and then
+	// one every logRateInterval.
+	logRateInterval = 10 * time.Second
+	logRateBurst    = 3
+)
+
+// limitedLog returns the logger for messages about op on pathname that may
+// be repeated for every event, which are rate limited.
+func (t *Tailer) limitedLog(op, pathname string) *log.RateLimitedLogger {
+	return t.hotLog.Key(op + " " + pathname)
+}
+
 // New creates a new Tailer.
 func New(lines chan<- *logline.LogLine, w watcher.Watcher, options ...Option) (*Tailer, error) {
 	if lines == nil {
 		return nil, errors.New("can't create tailer without lines channel")
 	}
-	if w == nil {
-		return nil, errors.New("can't create tailer without W")
+	return NewFromConfig(Config{Lines: lines, Watcher: w, Options: options})
+}
+
+// NewFromConfig creates a new Tailer with the settings in c, which is
+// validated first.
+func NewFromConfig(c Config) (*Tailer, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	var pull chan *logline.LogLine
+	if c.Lines == nil {
+		pull = make(chan *logline.LogLine)
+		c.Lines = pull
 	}
-	t := &Tailer{
-		lines:        lines,
-		w:            w,
-		handles:      make(map[string]*File),
-		globPatterns: make(map[string]struct{}),
-		runDone:      make(chan struct{}),
-		logger:       log.DefaultLogger,
-	}
-	if err := t.SetOption(options...); err != nil {
+	t := newTailer(c.Lines, c.Watcher)
+	if err := t.SetOption(c.options()...); err != nil {
 		return nil, err
 	}
+	if t.shardCount > 0 && (pull == nil || c.FanOut) {
+		return nil, errors.New("sharded output can't be used with a Lines channel or FanOut")
+	}
+	if err := t.validateDelivery(c.FanOut); err != nil {
+		return nil, err
+	}
+	t.sched = schedule.New(t.clock)
+	if t.registryPath != "" {
+		r, err := openRegistry(t.registryPath, t.registryKey, t.registryInterval, t.registryTTL, t.sched, t.logger)
+		if err != nil {
+			t.sched.Close()
+			return nil, err
+		}
+		t.registry = r
+		if t.registrySeed != nil {
+			r.seed(t.registrySeed)
+		}
+	} else if t.registrySeed != nil {
+		t.sched.Close()
+		return nil, errors.New("registry seed given without a registry")
+	}
+	if t.globalRate > 0 {
+		t.global = newSharedRate(t.globalRate, t.clock, t.metrics)
+	}
+	t.consumer = newConsumer(t.stallThreshold, t.clock)
+	t.held = &inFlight{}
+	if t.mergeSkew > 0 {
+		if t.timestampParser == nil {
+			t.sched.Close()
+			return nil, errors.New("ordered merge needs a timestamp parser")
+		}
+		in := make(chan *logline.LogLine)
+		t.merge = newOrderedMerge(in, t.lines, t.timestampParser, t.mergeSkew, t.clock, t.sendEvent)
+		t.merge.consumer = t.consumer
+		t.merge.held = t.held
+		t.merge.numbers = t.seq
+		t.lines = in
+	}
+	if t.publishExpvar {
+		if err := expvars.Publish(t.expvarPrefix, t.metrics.vars()); err != nil {
+			t.sched.Close()
+			return nil, err
+		}
+	}
+	if t.shardCount > 0 {
+		t.shards = newShardedOutput(pull, t.shardCount, t.held)
+	} else if c.FanOut {
+		t.fanOut = newFanOut(pull, t.held)
+	} else if pull != nil {
+		t.pull = pull
+	}
+	if t.mirrorWriter != nil {
+		t.mirror = newMirror(t.mirrorWriter, t.mirrorFilename, &t.metrics.mirrorDropped, t.sendEvent, t.logger)
+	}
 	handle, eventsChan := t.w.Events()
 	t.eventsHandle = handle
+	if s, ok := t.w.(watcher.EventSequencer); ok {
+		t.sequencer = s
+	}
+	if t.backfillConcurrency > 0 {
+		t.startBackfill()
+	}
 	go t.run(eventsChan)
+	if t.stallThreshold > 0 {
+		go t.runStallWatchdog()
+	}
+	if t.expiryInterval > 0 {
+		t.setExpiryInterval(t.expiryInterval)
+	}
+	if t.quiet != nil {
+		t.quiet.touch(t.clock.Now())
+		go t.runQuietShutdown()
+	}
+	t.started = true
 	return t, nil
 }
 
-// SetOption takes one or more option functions and applies them in order to Tailer.
+// newTailer returns a Tailer with the default settings, before options are
+// applied.
+func newTailer(lines chan<- *logline.LogLine, w watcher.Watcher) *Tailer {
+	t := &Tailer{
+		lines:           lines,
+		w:               w,
+		globPatterns:    make(map[string]struct{}),
+		archiveSkips:    make(map[string][]string),
+		stopPatterns:    make(map[string]*stopPattern),
+		livePatterns:    make(map[string]*livePattern),
+		spools:          make(map[string]*spool),
+		refs:            make(map[string]map[string]struct{}),
+		linked:          make(map[string]string),
+		binaryAllowed:   make(map[string]bool),
+		skipped:         make(map[string]struct{}),
+		skippedArchives: make(map[string]struct{}),
+		wrongType:       make(map[string]os.FileMode),
+		large:           make(map[string]LargeFile),
+		againSet:        make(map[*File]struct{}),
+		pathRates:       make(map[string]int64),
+		sampleSeed:      time.Now().UnixNano(),
+		throttled:       make(map[*File]*throttledFile),
+		wake:            make(chan struct{}, 1),
+		deleted:         make(map[string]deletedPath),
+		tombstones:      make(map[string]tombstone),
+		watchModes:      make(map[string]watcher.WatchMode),
+		applied:         make(map[appliedKey]*pathOptions),
+		foldCase:        watcher.CaseInsensitivePaths,
+		errorHistory:    defaultErrorHistory,
+		runDone:         make(chan struct{}),
+		ackCh:           make(chan struct{}),
+		acksReleased:    make(chan struct{}),
+		requests:        make(chan request),
+		logger:          log.NewLeveled(log.DefaultLogger, log.InfoLevel),
+		clock:           clock.Real,
+		metrics:         &metrics{},
+
+		registryInterval: defaultRegistryInterval,
+		registryTTL:      defaultRegistryTTL,
+	}
+	t.hotLog = log.RateLimited(t.logger, logRateInterval, logRateBurst)
+	return t
+}
+
+// SetOption takes one or more option functions and applies them in order to
+// Tailer.  Once the Tailer is running, only WithLogLevel, the byte rates,
+// WithSampling and WithPathSampling, WithMaxBytesPerRead, WithLagWarning and
+// WithExpiryInterval can be given; the first of any other options is
+// returned as an *ErrStaticOption.  Those before it are applied.
 func (t *Tailer) SetOption(options ...Option) error {
+	if t.started {
+		return t.setOptionRunning(options)
+	}
 	for _, option := range options {
 		if err := option(t); err != nil {
 			return err
@@ -105,92 +1193,434 @@ func (t *Tailer) SetOption(options ...Option) error {
 	return nil
 }
 
-// setHandle sets a file handle under it's pathname
+// SetLogLevel changes the verbosity of the Tailer's logging.  It is safe to
+// call while the Tailer is running.
+func (t *Tailer) SetLogLevel(level log.Level) {
+	t.logger.SetLevel(level)
+}
+
+// SetDefaultByteRate changes the limit set by WithDefaultByteRate, including
+// for files already being read.  It is safe to call while the Tailer is
+// running.
+func (t *Tailer) SetDefaultByteRate(bytesPerSec int64) error {
+	if bytesPerSec < 0 {
+		return errors.Errorf("invalid byte rate %d", bytesPerSec)
+	}
+	t.ratesMu.Lock()
+	t.defaultRate = bytesPerSec
+	t.ratesMu.Unlock()
+	t.handles.Range(func(_, v interface{}) bool {
+		f := v.(*File)
+		f.rate.setRate(t.byteRate(f.Pathname))
+		return true
+	})
+	return nil
+}
+
+// SetPathByteRate changes the limit set by WithPathByteRate, including if
+// path is already being read.  It is safe to call while the Tailer is
+// running.
+func (t *Tailer) SetPathByteRate(path string, bytesPerSec int64) error {
+	if bytesPerSec < 0 {
+		return errors.Errorf("invalid byte rate %d", bytesPerSec)
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	t.ratesMu.Lock()
+	t.pathRates[absPath] = bytesPerSec
+	t.ratesMu.Unlock()
+	if f, ok := t.handleForPath(absPath); ok {
+		f.rate.setRate(bytesPerSec)
+	}
+	return nil
+}
+
+// byteRate returns the read rate limit for the absolute path absPath.
+func (t *Tailer) byteRate(absPath string) int64 {
+	t.ratesMu.RLock()
+	defer t.ratesMu.RUnlock()
+	if rate, ok := t.pathRates[absPath]; ok {
+		return rate
+	}
+	return t.defaultRate
+}
+
+// sendEvent sends e, if events are wanted.
+func (t *Tailer) sendEvent(e FileEvent) {
+	if t.fileEvents != nil {
+		t.fileEvents <- e
+	}
+}
+
+// canonicalPath returns the absolute path of pathname with any symbolic
+// links resolved, which identifies the file however it's spelled.  If the
+// links can't be resolved, for example because the file doesn't exist yet,
+// it's the absolute path.
+func canonicalPath(pathname string) (string, error) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to lookup abspath of %q", pathname)
+	}
+	if resolved, err := filepath.EvalSymlinks(absPath); err == nil {
+		return resolved, nil
+	}
+	return absPath, nil
+}
+
+// setHandle sets a file handle under the canonical path of pathname.
 func (t *Tailer) setHandle(pathname string, f *File) error {
 	absPath, err := filepath.Abs(pathname)
 	if err != nil {
 		return errors.Wrapf(err, "Failed to lookup abspath of %q", pathname)
 	}
-	t.handlesMu.Lock()
-	defer t.handlesMu.Unlock()
-	t.handles[absPath] = f
+	key, err := t.pathKey(absPath)
+	if err != nil {
+		return err
+	}
+	absPath = t.fold(absPath)
+	f.handleKey = key
+	t.handles.Store(key, f)
+	if key != absPath {
+		t.aliases.Store(absPath, key)
+	}
+	return nil
+}
+
+// handleForPath retrives a file handle for a pathname, however it's spelled.
+func (t *Tailer) handleForPath(pathname string) (*File, bool) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		t.logger.Debugf("Couldn't resolve path %q: %s", pathname, err)
+		return nil, false
+	}
+	folded := t.fold(absPath)
+	if fd, ok := t.handles.Load(folded); ok {
+		return fd.(*File), true
+	}
+	var key string
+	if k, ok := t.aliases.Load(folded); ok {
+		key = k.(string)
+	} else if key, err = t.pathKey(absPath); err != nil || key == folded {
+		return nil, false
+	}
+	fd, ok := t.handles.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return fd.(*File), true
+}
+
+// register records that pathname is tailed for ref, a pattern or "" for
+// TailPath.
+func (t *Tailer) register(pathname, ref string) error {
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return err
+	}
+	t.refsMu.Lock()
+	defer t.refsMu.Unlock()
+	if t.refs[key] == nil {
+		t.refs[key] = make(map[string]struct{})
+	}
+	t.refs[key][ref] = struct{}{}
+	return nil
+}
+
+// unregister removes the record that the file with canonical path key is
+// tailed for ref, and stops tailing it if nothing else refers to it.
+func (t *Tailer) unregister(key, ref string) {
+	t.refsMu.Lock()
+	refs, ok := t.refs[key]
+	if ok {
+		delete(refs, ref)
+		if len(refs) > 0 {
+			t.refsMu.Unlock()
+			return
+		}
+		delete(t.refs, key)
+	}
+	t.refsMu.Unlock()
+	stop := func() error {
+		if fd, ok := t.handles.Load(key); ok {
+			t.bury(fd.(*File))
+			t.closeHandle(fd.(*File))
+			t.logger.With(map[string]interface{}{"path": key}).Infof("Stopped tailing %s", key)
+		}
+		return nil
+	}
+	// The file is closed in run, so that an event for it isn't handled as
+	// it's being closed, unless the Tailer has been closed and nothing is
+	// reading it.
+	if err := t.inRun(stop); err != nil {
+		_ = stop()
+	}
+}
+
+// Untail stops tailing pathname, which was given to TailPath, unless it's
+// also matched by a pattern that is being tailed.  Events for the file
+// already on their way are dropped, and counted, for a while; a new file
+// created at the path is handled as usual.
+func (t *Tailer) Untail(pathname string) error {
+	if fi, err := watcher.StatExtended(pathname); err == nil && fi.IsDir() {
+		return t.RemovePattern(filepath.Join(pathname, "*"))
+	}
+	key, err := t.pathKey(pathname)
+	if err != nil {
+		return err
+	}
+	if absPath, err := filepath.Abs(pathname); err == nil {
+		t.globPatternsMu.Lock()
+		delete(t.stopPatterns, t.fold(absPath))
+		t.globPatternsMu.Unlock()
+	}
+	t.unregister(key, "")
+	return nil
+}
+
+// RemovePattern stops matching new files against pattern, and stops tailing
+// the files it matched unless they're also given to TailPath or matched by
+// another pattern.
+func (t *Tailer) RemovePattern(pattern string) error {
+	absPattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return err
+	}
+	t.globPatternsMu.Lock()
+	delete(t.globPatterns, absPattern)
+	delete(t.archiveSkips, absPattern)
+	delete(t.stopPatterns, absPattern)
+	t.globPatternsMu.Unlock()
+	t.liveMu.Lock()
+	delete(t.livePatterns, absPattern)
+	t.liveMu.Unlock()
+	var keys []string
+	t.refsMu.Lock()
+	for key, refs := range t.refs {
+		if _, ok := refs[absPattern]; ok {
+			keys = append(keys, key)
+		}
+	}
+	t.refsMu.Unlock()
+	for _, key := range keys {
+		t.unregister(key, absPattern)
+	}
+	return nil
+}
+
+func (t *Tailer) hasHandle(pathname string) bool {
+	_, ok := t.handleForPath(pathname)
+	return ok
+}
+
+// AddPattern adds a pattern to the list of patterns to filter filenames
+// against.  opts configure the pattern, such as WithWatchMode and
+// WithArchiveSkip.
+func (t *Tailer) AddPattern(pattern string, opts ...PatternOption) error {
+	o, err := newPatternOptions(opts)
+	if err != nil {
+		return err
+	}
+	if o.archives != nil {
+		return errors.New("archive backfill can only be given to TailPattern and AddPatternWithPolicy")
+	}
+	return t.addPattern(pattern, o)
+}
+
+func (t *Tailer) addPattern(pattern string, o *pathOptions) error {
+	absPath, err := filepath.Abs(pattern)
+	if err != nil {
+		t.logger.Debugf("Couldn't canonicalize path %q: %s", pattern, err)
+		return err
+	}
+	t.logger.Infof("AddPattern: %s", absPath)
+	t.setWatchMode(filepath.Dir(absPath), o.mode)
+	t.globPatternsMu.Lock()
+	t.globPatterns[absPath] = struct{}{}
+	if o.skip != nil {
+		t.archiveSkips[absPath] = o.skip
+	}
+	if o.stop != nil {
+		t.stopPatterns[absPath] = o.stop
+	}
+	t.globPatternsMu.Unlock()
+	return nil
+}
+
+// TailPattern registers a pattern to be tailed.  If pattern is a plain
+// file then it is watched for updates and opened.  If pattern is a glob, then
+// all paths that match the glob are opened and watched, and the directories
+// containing those matches, if any, are watched.  opts configure the
+// pattern, such as WithArchiveBackfill and WithWatchMode.
+//
+// Each element of a glob matches one level of directories, so the pattern
+// is expanded without walking the tree, and a symbolic link back at an
+// ancestor can't make it loop.  A file matched through links as well as
+// by its own path is tailed once, by its canonical path.
+func (t *Tailer) TailPattern(pattern string, opts ...PatternOption) error {
+	o, err := newPatternOptions(opts)
+	if err != nil {
+		return err
+	}
+	matches, err := t.watchPattern(pattern, o)
+	if err != nil {
+		return err
+	}
+	// Error if there are no matches, but if they show up later, they'll get picked up by the directory watch set above.
+	if len(matches) == 0 {
+		return errors.Errorf("No matches for pattern %q", pattern)
+	}
+	return t.tailMatches(pattern, matches, StartPolicy{}, o)
+}
+
+// AddPatternWithPolicy registers a pattern to be tailed like TailPattern,
+// except that the files that already match it are read starting from where
+// policy says.  It isn't an error if nothing matches yet.
+func (t *Tailer) AddPatternWithPolicy(pattern string, policy StartPolicy, opts ...PatternOption) error {
+	o, err := newPatternOptions(opts)
+	if err != nil {
+		return err
+	}
+	matches, err := t.watchPattern(pattern, o)
+	if err != nil {
+		return err
+	}
+	return t.tailMatches(pattern, matches, policy, o)
+}
+
+// watchPattern adds pattern, with options o, to the patterns new files are
+// matched against, and watches the directory it's in.  It returns the paths
+// already matching it.
+func (t *Tailer) watchPattern(pattern string, o *pathOptions) ([]string, error) {
+	if err := t.addPattern(pattern, o); err != nil {
+		return nil, err
+	}
+	// Add a watch on the containing directory, so we know when a rotation
+	// occurs or something shows up that matches this pattern.
+	if err := t.watchDirname(pattern); err != nil {
+		return nil, err
+	}
+	globbed, err := watcher.GlobExtended(pattern)
+	if err != nil {
+		return nil, err
+	}
+	absPattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return nil, err
+	}
+	t.globPatternsMu.RLock()
+	skip := t.archiveSkipLocked(absPattern)
+	t.globPatternsMu.RUnlock()
+	var matches []string
+	for _, m := range globbed {
+		if !t.spoolExcluded(m) && !t.skipArchive(m, absPattern, skip) {
+			matches = append(matches, m)
+		}
+	}
+	t.logger.Debugf("glob matches: %v", matches)
+	return matches, nil
+}
+
+func (t *Tailer) tailMatches(pattern string, matches []string, policy StartPolicy, o *pathOptions) error {
+	absPattern, err := filepath.Abs(pattern)
+	if err != nil {
+		return err
+	}
+	if t.merge != nil && t.queue != nil {
+		// All the matches are merged with each other, however the workers
+		// get to them.
+		for _, pathname := range matches {
+			if !t.hasHandle(pathname) && !t.isBackfilling(pathname) {
+				t.mergePending(pathname)
+			}
+		}
+	}
+	if t.discovery != nil {
+		return t.discover(absPattern, matches, policy, o)
+	}
+	for _, pathname := range matches {
+		if err := t.register(pathname, absPattern); err != nil {
+			return err
+		}
+		err := t.tailMatch(pathname, policy, o)
+		if err != nil {
+			return errors.Wrapf(err, "attempting to tail %q", pathname)
+		}
+	}
 	return nil
 }
 
-// handleForPath retrives a file handle for a pathname.
-func (t *Tailer) handleForPath(pathname string) (*File, bool) {
-	absPath, err := filepath.Abs(pathname)
-	if err != nil {
-		t.logger.Infof("Couldn't resolve path %q: %s", pathname, err)
-		return nil, false
+// tailMatch tails pathname, a match of a pattern with options o, after
+// reading its archives if the pattern was given WithArchiveBackfill.
+func (t *Tailer) tailMatch(pathname string, policy StartPolicy, o *pathOptions) error {
+	if o != nil && o.archives != nil {
+		if err := t.backfillArchives(pathname, o.archives); err != nil {
+			return err
+		}
 	}
-	t.handlesMu.Lock()
-	defer t.handlesMu.Unlock()
-	fd, ok := t.handles[absPath]
-	return fd, ok
+	return t.tailPath(pathname, policy)
 }
 
-func (t *Tailer) hasHandle(pathname string) bool {
-	_, ok := t.handleForPath(pathname)
-	return ok
+// TailPath registers a filesystem pathname to be tailed.  If the file is
+// already being tailed under another name, for example through a pattern or
+// a hard link, it's not read again.  If its canonical path, with symbolic
+// links resolved, was already given to TailPath, an *ErrAlreadyTailed is
+// returned unless WithReplaceOnRetail was given.  If pathname exists and isn't a regular file, an
+// *ErrNotRegularFile is returned unless WithSpecialFiles was given.  opts
+// configure the path, such as WithWatchMode.
+func (t *Tailer) TailPath(pathname string, opts ...PathOption) error {
+	return t.TailPathWithPolicy(pathname, StartPolicy{}, opts...)
 }
 
-// AddPattern adds a pattern to the list of patterns to filter filenames against.
-func (t *Tailer) AddPattern(pattern string) error {
-	absPath, err := filepath.Abs(pattern)
+// TailPathWithPolicy registers a filesystem pathname to be tailed like
+// TailPath, except that if it already exists it's read starting from where
+// policy says.
+func (t *Tailer) TailPathWithPolicy(pathname string, policy StartPolicy, opts ...PathOption) error {
+	o, err := newPathOptions(opts)
 	if err != nil {
-		t.logger.Infof("Couldn't canonicalize path %q: %s", pattern, err)
 		return err
 	}
-	t.logger.Infof("AddPattern: %s", absPath)
-	t.globPatternsMu.Lock()
-	t.globPatterns[absPath] = struct{}{}
-	t.globPatternsMu.Unlock()
-	return nil
-}
-
-// TailPattern registers a pattern to be tailed.  If pattern is a plain
-// file then it is watched for updates and opened.  If pattern is a glob, then
-// all paths that match the glob are opened and watched, and the directories
-// containing those matches, if any, are watched.
-func (t *Tailer) TailPattern(pattern string) error {
-	if err := t.AddPattern(pattern); err != nil {
-		return err
+	if absPath, err := filepath.Abs(pathname); err == nil {
+		t.setWatchMode(absPath, o.mode)
 	}
-	// Add a watch on the containing directory, so we know when a rotation
-	// occurs or something shows up that matches this pattern.
-	if err := t.watchDirname(pattern); err != nil {
-		return err
+	if fi, err := watcher.StatExtended(pathname); err == nil && !fi.Mode().IsRegular() {
+		return t.tailSpecial(pathname, fi.Mode())
 	}
-	matches, err := filepath.Glob(pattern)
+	key, tailed, err := t.registerPath(pathname)
 	if err != nil {
 		return err
 	}
-	t.logger.Infof("glob matches: %v", matches)
-	// Error if there are no matches, but if they show up later, they'll get picked up by the directory watch set above.
-	if len(matches) == 0 {
-		return errors.Errorf("No matches for pattern %q", pattern)
+	if tailed && !t.replaceOnRetail {
+		return &ErrAlreadyTailed{Pathname: pathname, Key: key}
 	}
-	for _, pathname := range matches {
-		err := t.TailPath(pathname)
-		if err != nil {
-			return errors.Wrapf(err, "attempting to tail %q", pathname)
-		}
+	if absPath, err := filepath.Abs(pathname); err == nil {
+		t.setStopPattern(t.fold(absPath), o.stop)
+	}
+	if tailed {
+		return t.retail(pathname, key, policy)
+	}
+	if err := t.tailPath(pathname, policy); err != nil {
+		t.unregister(key, "")
+		return err
 	}
 	return nil
 }
 
-// TailPath registers a filesystem pathname to be tailed.
-func (t *Tailer) TailPath(pathname string) error {
-	if t.hasHandle(pathname) {
-		t.logger.Infof("already watching %q", pathname)
+func (t *Tailer) tailPath(pathname string, policy StartPolicy) error {
+	if t.hasHandle(pathname) || t.isBackfilling(pathname) {
+		t.logger.Debugf("already watching %q", pathname)
 		return nil
 	}
-	if err := t.w.Add(pathname, t.eventsHandle); err != nil {
+	t.exhume(pathname)
+	if err := t.addWatch(pathname); err != nil {
 		return err
 	}
-	// New file at start of program, seek to EOF.
-	return t.openLogPath(pathname, false)
+	if t.queue != nil {
+		return t.enqueueBackfill(pathname, policy)
+	}
+	// New file at start of program, seek to EOF unless the policy says otherwise.
+	return t.openLogPath(pathname, policy)
 }
 
 // handleLogEvent is dispatched when an Event is received, causing the tailer
@@ -199,10 +1629,56 @@ func (t *Tailer) TailPath(pathname string) error {
 // reaching EOF in the file reader itself, we don't care what the signal is
 // from the filewatcher.
 func (t *Tailer) handleLogEvent(pathname string) {
-	t.logger.Infof("handleLogUpdate %s", pathname)
+	if t.logger.Enabled(log.DebugLevel) {
+		t.logger.With(map[string]interface{}{"path": pathname}).Debugf("handleLogUpdate %s", pathname)
+	}
+	if t.handleSpoolEvent(pathname) {
+		return
+	}
 	fd, ok := t.handleForPath(pathname)
 	if !ok {
-		t.logger.Infof("No file handle found for %q, but is being watched", pathname)
+		if t.buried(pathname) {
+			t.logger.Debugf("Dropped event for untailed %q", pathname)
+			return
+		}
+		if t.isBackfilling(pathname) {
+			// The backfill worker reads up to the end after taking over the file.
+			t.logger.Debugf("%q is being backfilled", pathname)
+			return
+		}
+		t.limitedLog("unknown", pathname).Debugf("No file handle found for %q, but is being watched", pathname)
+		if t.wasReplaced(pathname) {
+			t.recheckType(pathname)
+			return
+		}
+		if t.wasDeleted(pathname) {
+			if fi, err := watcher.StatExtended(pathname); err == nil && fi.IsDir() {
+				t.markWrongType(pathname, fi.Mode())
+				return
+			}
+			// A tailed file that was deleted has been created again.
+			if err := t.openLogPath(pathname, Beginning); err != nil {
+				t.limitedLog("open", pathname).Infof("Failed to tail recreated file %q: %s", pathname, err)
+			}
+			return
+		}
+		if t.wasLinked(pathname) {
+			// It may no longer be a link to a file being tailed.
+			if err := t.openLogPath(pathname, Beginning); err != nil {
+				t.limitedLog("open", pathname).Infof("Failed to tail %q: %s", pathname, err)
+			}
+			return
+		}
+		if t.wasSkipped(pathname) {
+			// It may have been rewritten with text.
+			if err := t.openLogPath(pathname, Beginning); err != nil {
+				t.limitedLog("open", pathname).Infof("Failed to tail %q: %s", pathname, err)
+			}
+			return
+		}
+		if t.handleLiveEvent(pathname) {
+			return
+		}
 		// We want to open files we have watches on in case the file was
 		// unreadable before now; but we have to copmare against the glob to be
 		// sure we don't just add all the files in a watched directory as they
@@ -210,15 +1686,240 @@ func (t *Tailer) handleLogEvent(pathname string) {
 		t.handleCreateGlob(pathname)
 		return
 	}
-	doFollow(fd, t.logger)
+	t.follow(fd)
 }
 
-// doFollow performs the Follow on an existing file descriptor, logging any errors
-func doFollow(fd *File, logger log.Logger) {
-	err := fd.Follow()
+// follow performs the Follow on an existing File, queueing it to be read
+// again if it stopped before EOF.  If the read fails, the file is checked to
+// find out why.  Nothing is read while the file's circuit breaker is open.
+func (t *Tailer) follow(fd *File) {
+	if !t.breakerAllows(fd) {
+		return
+	}
+	t.refreshSettings(fd)
+	generation := fd.generation
+	err := fd.guard(fd.Follow)
+	if p, ok := err.(*ErrReadPanic); ok {
+		t.followPanicked(fd, p)
+		return
+	}
+	if e, ok := err.(*ErrNotRegularFile); ok {
+		t.replaced(fd, e.Mode)
+		return
+	}
+	if fd.generation != generation && !t.rotated(fd) {
+		return
+	}
+	if err == ErrLinesClosed {
+		// Nothing more can be sent, so there's no point retrying.
+		t.limitedLog("read", fd.Pathname).Infof("Not reading %s: %s", fd.Pathname, err)
+		return
+	}
 	if err != nil && err != io.EOF {
-		logger.Info(err)
+		t.logger.Info(err)
+		t.fileFailed(fd, "read", err)
+		t.readFailed(fd, err)
+		if cur, ok := t.handleForPath(fd.Pathname); ok && cur == fd {
+			t.breakerRetry(fd)
+		}
+		return
+	}
+	fd.readFailures = 0
+	fd.panics = 0
+	t.breakerSucceeded(fd, "read")
+	if fd.stopped {
+		t.stopTailing(fd)
+		return
+	}
+	if !fd.More() {
+		return
+	}
+	if fd.throttledFor > 0 {
+		t.throttle(fd, t.clock.Now().Add(fd.throttledFor))
+		return
+	}
+	t.readSoon(fd)
+}
+
+// rotated updates the handle for fd after it has been rotated or truncated.
+// It returns false if fd is no longer tailed, because it's now the same file
+// as another handle.
+func (t *Tailer) rotated(fd *File) bool {
+	oldKey := fd.handleKey
+	key, err := t.pathKey(fd.Pathname)
+	if err == nil && key != oldKey {
+		// A symbolic link has been pointed at a new file.
+		if cur, ok := t.handles.Load(key); ok && cur.(*File) != fd {
+			t.logger.Infof("Not tailing %s, now the same file as %s", fd.Pathname, cur.(*File).Pathname)
+			t.closeHandle(fd)
+			return false
+		}
+		if cur, ok := t.handles.Load(oldKey); ok && cur.(*File) == fd {
+			t.handles.Delete(oldKey)
+		}
+		if err := t.setHandle(fd.Pathname, fd); err != nil {
+			t.logger.Info(err)
+		}
+	}
+	return t.recheckLink(fd, oldKey)
+}
+
+// throttledFile is a file waiting for its rate limit.
+type throttledFile struct {
+	timer *schedule.Timer // Fires when it may be read again
+	turn  uint64          // When it was throttled, relative to the others
+}
+
+// throttle schedules fd to be read again at the given time, after waiting
+// for its rate limit.
+func (t *Tailer) throttle(fd *File, at time.Time) {
+	if w, ok := t.throttled[fd]; ok {
+		w.timer.Reset(at)
+		return
+	}
+	t.throttleTurns++
+	t.throttled[fd] = &throttledFile{
+		timer: t.sched.At(at, func() {
+			// Called by the scheduler, which mustn't be held up by run.
+			select {
+			case t.wake <- struct{}{}:
+			default:
+			}
+		}),
+		turn: t.throttleTurns,
+	}
+}
+
+// unthrottle queues the throttled files whose timers have fired to be read
+// again, in the order they were throttled.  The scheduler takes every timer
+// that's due at once, before calling them one at a time, so the files woken
+// by the same refill of a shared limit are all queued together, and take
+// their shares of it in turn, rather than the first woken taking it all.  A
+// file throttled again since its timer fired waits for the new time.
+func (t *Tailer) unthrottle() {
+	var due []*File
+	for fd, w := range t.throttled {
+		if !w.timer.Pending() {
+			due = append(due, fd)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return t.throttled[due[i]].turn < t.throttled[due[j]].turn
+	})
+	for _, fd := range due {
+		delete(t.throttled, fd)
+		t.readSoon(fd)
+	}
+}
+
+// readAgain continues reading the first File queued by follow.
+func (t *Tailer) readAgain() {
+	fd := t.again[0]
+	t.again = t.again[1:]
+	delete(t.againSet, fd)
+	// Skip it if it has been expired since.
+	if cur, ok := t.handleForPath(fd.Pathname); !ok || cur != fd {
+		return
+	}
+	t.follow(fd)
+}
+
+// request is a function to be called by run, whose result is sent on done.
+type request struct {
+	fn   func() error
+	done chan error
+}
+
+// inRun calls fn in the run goroutine, which reads the files, and returns its
+// result.  It returns an error if the Tailer has been closed.
+func (t *Tailer) inRun(fn func() error) error {
+	return t.inRunContext(context.Background(), fn)
+}
+
+// inRunContext is inRun, except that it returns ctx.Err() if ctx is done
+// before fn returns.
+func (t *Tailer) inRunContext(ctx context.Context, fn func() error) error {
+	r := request{fn, make(chan error, 1)}
+	select {
+	case t.requests <- r:
+	case <-t.runDone:
+		return errors.New("tailer is closed")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-r.done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ForceRead reads pathname immediately, as if the watcher had reported an
+// update to it.  It returns an error if pathname isn't being tailed, or if
+// the Tailer has been closed.  It is safe to call while the Tailer is
+// running.
+func (t *Tailer) ForceRead(pathname string) error {
+	return t.inRun(func() error {
+		fd, ok := t.handleForPath(pathname)
+		if !ok {
+			return errors.Errorf("not tailing %q", pathname)
+		}
+		t.logger.With(map[string]interface{}{"path": pathname}).Debugf("Forced read of %s", pathname)
+		t.follow(fd)
+		return nil
+	})
+}
+
+// ReopenAll reopens every file being tailed, to recover from rotations that
+// the watcher didn't report, for example on SIGHUP.  Files that are still at
+// their path are read on from where they were.  If a path has a new file,
+// the rest of the old one is read, a Rotated FileEvent is sent, and the new
+// one is read from the start.  Files that can't be reopened are tailed again
+// once their path is created.  It returns an error if the Tailer has been
+// closed.
+func (t *Tailer) ReopenAll() error {
+	return t.inRun(func() error {
+		var files []*File
+		t.handles.Range(func(_, v interface{}) bool {
+			files = append(files, v.(*File))
+			return true
+		})
+		for _, fd := range files {
+			rotated, err := fd.reopen()
+			if err != nil {
+				t.logger.Infof("Failed to reopen %q, waiting for it to be created: %s", fd.Pathname, err)
+				t.removeDeleted(fd)
+				continue
+			}
+			if rotated {
+				if !t.rotated(fd) {
+					continue
+				}
+				t.sendEvent(FileEvent{Type: Rotated, Name: fd.Name, Pathname: fd.Pathname, Previous: fd.Pathname})
+			}
+			t.follow(fd)
+		}
+		return nil
+	})
+}
+
+// addWatch watches pathname for t's events.  If the limit on inotify
+// watches has been reached a WatchLimit event is sent as well, as many
+// watches are added by the Tailer itself rather than by a call that can
+// return the error.
+func (t *Tailer) addWatch(pathname string) error {
+	return t.addWatchFor(pathname, pathname)
+}
+
+// addWatchFor watches pathname with the watch mode given for path, which is
+// pathname or a file in it.
+func (t *Tailer) addWatchFor(pathname, path string) error {
+	err := t.w.Add(pathname, t.eventsHandle, t.watchOptions(path)...)
+	if err != nil && watcher.IsWatchLimit(err) {
+		t.sendEvent(FileEvent{Type: WatchLimit, Name: pathname, Pathname: pathname, Err: err})
 	}
+	return err
 }
 
 // watchDirname adds the directory containing a path to be watched.
@@ -228,16 +1929,25 @@ func (t *Tailer) watchDirname(pathname string) error {
 		return err
 	}
 	d := filepath.Dir(absPath)
-	return t.w.Add(d, t.eventsHandle)
+	return t.addWatchFor(d, absPath)
 }
 
-// openLogPath opens a log file named by pathname.
-func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
-	t.logger.Infof("openlogPath %s %v", pathname, seekToStart)
+// openLogPath opens a log file named by pathname, starting where policy says.
+func (t *Tailer) openLogPath(pathname string, policy StartPolicy) error {
+	return t.openLogPathAttempt(pathname, policy, 0)
+}
+
+// openLogPathAttempt is openLogPath, after opening pathname has been retried
+// attempt times.  If it can't be opened as another process has it open
+// without sharing it, it's tried again later.
+func (t *Tailer) openLogPathAttempt(pathname string, policy StartPolicy, attempt int) error {
+	if t.logger.Enabled(log.DebugLevel) {
+		t.logger.With(map[string]interface{}{"path": pathname}).Debugf("openlogPath %s %v", pathname, policy)
+	}
 	if err := t.watchDirname(pathname); err != nil {
 		return err
 	}
-	f, err := NewFile(pathname, t.lines, seekToStart || t.oneShot, t.logger)
+	f, err := t.newFile(pathname, policy)
 	if err != nil {
 		// Doesn't exist yet. We're watching the directory, so we'll pick it up
 		// again on create; return successfully.
@@ -245,47 +1955,230 @@ func (t *Tailer) openLogPath(pathname string, seekToStart bool) error {
 			t.logger.Infof("pathname %q doesn't exist (yet?)", pathname)
 			return nil
 		}
+		if retryableOpen(err) && attempt < maxOpenRetries {
+			t.limitedLog("open", pathname).Infof("Can't open %q yet, trying again: %s", pathname, err)
+			t.retryOpen(pathname, policy, attempt+1)
+			return nil
+		}
+		if err == errLinked || err == errBinary || err == errTooLarge {
+			return nil
+		}
 		return err
 	}
-	t.logger.Infof("Adding a file watch on %q", f.Pathname)
-	if err := t.w.Add(f.Pathname, t.eventsHandle); err != nil {
+	t.logger.Debugf("Adding a file watch on %q", f.Pathname)
+	if err := t.addWatch(f.Pathname); err != nil {
 		return err
 	}
 	if err := t.setHandle(pathname, f); err != nil {
 		return err
 	}
-	if err := f.Read(); err != nil && err != io.EOF {
+	if err := t.catchUp(f); err != nil {
 		return err
 	}
-	t.logger.Infof("Tailing %s", f.Pathname)
-	logCount.Add(1)
+	t.logger.With(map[string]interface{}{"path": f.Pathname}).Infof("Tailing %s", f.Pathname)
+	t.metrics.logCount.Add(1)
+	if f.stopped {
+		t.stopTailing(f)
+	}
 	return nil
 }
 
+// catchUp reads a newly opened File up to its current end.  A read that
+// panics is tried again after a delay, skipping the line it panicked on,
+// until too many have panicked in a row.
+func (t *Tailer) catchUp(f *File) error {
+	t.merge.reading(f.Name, true)
+	f.readFrom = f.offset
+	if t.mmapBackfill {
+		if err := f.guard(f.backfill); err != nil {
+			if p, ok := err.(*ErrReadPanic); ok {
+				t.readPanicked(f, p)
+			}
+			t.logger.Debugf("Backfill of %q failed, reading instead: %s", f.Pathname, err)
+		}
+	}
+	err := f.guard(f.Read)
+	for {
+		p, ok := err.(*ErrReadPanic)
+		if !ok {
+			break
+		}
+		delay, ok := t.readPanicked(f, p)
+		if !ok {
+			break
+		}
+		<-t.clock.After(delay)
+		err = f.guard(f.Read)
+	}
+	if err == io.EOF {
+		err = nil
+		f.panics = 0
+	}
+	if t.oneShot {
+		t.endOneShot(f, err)
+	}
+	return err
+}
+
+// endOneShot sends the EOF or Failed event for f, which has been read up to
+// its end or failed, once all its lines have been sent.
+func (t *Tailer) endOneShot(f *File, err error) {
+	if f.ended {
+		return
+	}
+	f.ended = true
+	e := f.endEvent(err)
+	if t.merge != nil {
+		t.merge.finish(f.Name, e)
+		return
+	}
+	t.sendEvent(e)
+}
+
+// newFile opens a File, starting where policy says, and applies the Tailer's
+// settings to it.
+func (t *Tailer) newFile(pathname string, policy StartPolicy) (*File, error) {
+	if policy.kind == startDefault {
+		policy = End
+		if t.oneShot {
+			policy = Beginning
+		}
+	}
+	f, err := newFile(pathname, t.lines, policy.kind == startBeginning, t.logger, t.clock, t.metrics)
+	if err != nil {
+		return nil, err
+	}
+	s := t.settings.load()
+	f.settings = s
+	f.registry = t.registry
+	if t.ackWindow > 0 {
+		f.acks = newAckWindow(t.ackWindow, t.acksReleased)
+	}
+	f.atMostOnce = t.deliveryMode == AtMostOnce
+	resumed, err := t.resume(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if policy.kind == startLastN && !resumed {
+		if err := f.startLastN(policy.n); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if policy.kind == startOffset && !resumed {
+		if err := f.seekTo(policy.n); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if !resumed && policy.kind != startOffset {
+		if err := t.checkSize(f, policy); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	given := f.rawName
+	f.nameFunc = func() string { return t.reportedName(given, f.Pathname) }
+	f.setName(f.nameFunc())
+	f.fileEvents = t.fileEvents
+	f.generation = t.deletedGeneration(f.Pathname)
+	if fi, err := f.Stat(); err == nil && f.regular {
+		if fi.Size() > f.offset {
+			f.progress.begin(f.offset, fi.Size(), t.clock.Now())
+		}
+		f.lag.start(f.offset, fi.Size(), t.clock.Now())
+		f.lagThreshold = s.lagThreshold
+		f.exportLag()
+	}
+	f.positions = t.positions
+	f.seq = t.seq
+	if t.collapse {
+		f.repeats = &repeats{window: t.repeatWindow, max: t.repeatMax, field: t.repeatField}
+		t.armRepeats(f)
+	}
+	if rate := s.samplingRate(f.Pathname); rate > 0 && rate < 1 {
+		f.sampler = newSampler(rate, t.sampleSeed, f.Pathname, t.sampleMarker, t.clock.Now())
+	}
+	f.merge = t.merge
+	f.consumer = t.consumer
+	f.mirror = t.mirror
+	f.quiet = t.quiet
+	f.quiet.touch(t.clock.Now())
+	f.redactors = t.redactors
+	f.transform = t.transform
+	f.jsonFields = t.jsonFields
+	f.stop = t.stopPatternFor(f.Pathname)
+	if t.kubernetesLabels {
+		f.kubernetesLabels, _ = KubernetesLabels(f.Pathname)
+	}
+	f.openPaths = t.openPaths
+	f.maxLineLength = t.maxLineLength
+	if t.breaker.failures > 0 {
+		f.breaker = newBreaker(t.breaker)
+	}
+	if t.errorHistory > 0 {
+		f.errors = &errorHistory{size: t.errorHistory}
+	}
+	f.crMode = t.crMode
+	if t.stripANSI {
+		f.ansi = &ansiStripper{}
+	}
+	if t.maxLines > 0 || t.maxBytes > 0 {
+		f.quota = &quota{maxLines: t.maxLines, maxBytes: t.maxBytes, reset: t.quotaReset}
+	}
+	f.nulSkip = t.nulSkip
+	f.maxBytesPerRead = s.maxBytesPerRead
+	f.rate = newByteRate(t.byteRate(f.Pathname), t.clock)
+	if t.global != nil {
+		f.global = t.global
+		t.global.add()
+	}
+	if t.budget != nil {
+		f.budget = t.budget
+		t.budget.add(f)
+	}
+	if err := t.checkBinary(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := t.checkLink(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
 // handleCreateGlob matches the pathname against the glob patterns and starts tailing the file.
 func (t *Tailer) handleCreateGlob(pathname string) {
 	t.globPatternsMu.RLock()
 	defer t.globPatternsMu.RUnlock()
 
 	for pattern := range t.globPatterns {
-		matched, err := filepath.Match(pattern, pathname)
+		matched, err := t.matchPattern(pattern, pathname)
 		if err != nil {
 			t.logger.Warningf("Unexpected bad pattern %q not detected earlier", pattern)
 			continue
 		}
 		if !matched {
-			t.logger.Infof("%q did not match pattern %q", pathname, pattern)
+			t.logger.Debugf("%q did not match pattern %q", pathname, pattern)
 			continue
 		}
-		t.logger.Infof("New file %q matched existing glob %q", pathname, pattern)
+		if t.skipArchive(pathname, pattern, t.archiveSkipLocked(pattern)) {
+			continue
+		}
+		t.logger.Debugf("New file %q matched existing glob %q", pathname, pattern)
+		if err := t.register(pathname, pattern); err != nil {
+			t.logger.Info(err)
+		}
 		// If this file was just created, read from the start of the file.
-		if err := t.openLogPath(pathname, true); err != nil {
-			t.logger.Infof("Failed to tail new file %q: %s", pathname, err)
+		if err := t.openLogPath(pathname, Beginning); err != nil {
+			t.limitedLog("open", pathname).Infof("Failed to tail new file %q: %s", pathname, err)
 		}
 		t.logger.Infof("started tailing %q", pathname)
 		return
 	}
-	t.logger.Infof("did not start tailing %q", pathname)
+	t.logger.Debugf("did not start tailing %q", pathname)
 }
 
 // run the main event loop for the Tailer.  It receives notification of
@@ -293,21 +2186,71 @@ func (t *Tailer) handleCreateGlob(pathname string) {
 // handler.
 func (t *Tailer) run(events <-chan watcher.Event) {
 	defer close(t.runDone)
-	defer close(t.lines)
+	defer closeLines(t.lines)
+	defer t.stopBackfill()
+	defer t.stopSpools()
+	defer t.sched.Close()
 
-	for e := range events {
-		t.logger.Infof("Event type %#v", e)
-		t.handleLogEvent(e.Pathname)
+	// ready is always ready to receive, for when there are files to read again.
+	ready := make(chan struct{})
+	close(ready)
+	for {
+		var again <-chan struct{}
+		// Once draining, nothing more is read.
+		if len(t.again) > 0 && !t.consumer.draining() {
+			again = ready
+		}
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.logger.Infof("Shutting down tailer.")
+				return
+			}
+			if t.logger.Enabled(log.DebugLevel) {
+				t.logger.With(map[string]interface{}{"path": e.Pathname, "op": e.Op}).Debugf("Event type %#v", e)
+			}
+			switch {
+			case t.consumer.draining(), e.Op == watcher.Heartbeat:
+				// Events are ignored while draining.  Heartbeats are sent
+				// only if asked for, and say nothing about the files.
+			case e.Op == watcher.Delete:
+				t.handleDelete(e.Pathname)
+			case e.Op == watcher.Rename:
+				t.handleRename(e.From, e.Pathname)
+			default:
+				t.handleLogEvent(e.Pathname)
+			}
+			atomic.StoreInt64(&t.lastEvent, t.clock.Now().UnixNano())
+			if t.processedHook != nil {
+				t.processedHook(e)
+			}
+			t.ack()
+		case f := <-t.backfilled:
+			t.finishBackfill(f)
+		case <-again:
+			t.readAgain()
+		case <-t.wake:
+			t.unthrottle()
+		case r := <-t.requests:
+			r.done <- r.fn()
+		}
 	}
-	t.logger.Infof("Shutting down tailer.")
 }
 
 // Close signals termination to the watcher.
 func (t *Tailer) Close() error {
+	if t.discovery != nil {
+		t.discovery.close()
+	}
 	if err := t.w.Close(); err != nil {
 		return err
 	}
+	t.releaseOnce.Do(func() { close(t.acksReleased) })
 	<-t.runDone
+	t.mirror.close()
+	if t.registry != nil {
+		return t.registry.close()
+	}
 	return nil
 }
 
@@ -327,6 +2270,7 @@ const tailerTemplate = `
 <th>rotations</th>
 <th>truncations</th>
 <th>lines read</th>
+<th>recent errors</th>
 </tr>
 {{range $name, $val := $.Handles}}
 <tr>
@@ -335,6 +2279,7 @@ const tailerTemplate = `
 <td>{{index $.Rotations $name}}</td>
 <td>{{index $.Truncs $name}}</td>
 <td>{{index $.Lines $name}}</td>
+<td>{{range index $.History $name}}{{.Time.Format "2006-01-02T15:04:05Z07:00"}} {{.Op}}: {{.Err}}<br>{{end}}</td>
 </tr>
 {{end}}
 </table>
@@ -347,8 +2292,6 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	if err != nil {
 		return err
 	}
-	t.handlesMu.RLock()
-	defer t.handlesMu.RUnlock()
 	t.globPatternsMu.RLock()
 	defer t.globPatternsMu.RUnlock()
 	data := struct {
@@ -358,22 +2301,31 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 		Lines     map[string]string
 		Errors    map[string]string
 		Truncs    map[string]string
+		History   map[string][]FileError
 	}{
-		t.handles,
+		make(map[string]*File),
 		t.globPatterns,
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
 		make(map[string]string),
+		make(map[string][]FileError),
 	}
+	t.handles.Range(func(k, v interface{}) bool {
+		data.Handles[k.(string)] = v.(*File)
+		if errs := v.(*File).errors.snapshot(); errs != nil {
+			data.History[k.(string)] = errs
+		}
+		return true
+	})
 	for _, pair := range []struct {
 		v *expvar.Map
 		m map[string]string
 	}{
-		{logErrors, data.Errors},
-		{logRotations, data.Rotations},
-		{logTruncs, data.Truncs},
-		{lineCount, data.Lines},
+		{&t.metrics.logErrors, data.Errors},
+		{&t.metrics.logRotations, data.Rotations},
+		{&t.metrics.logTruncs, data.Truncs},
+		{&t.metrics.lineCount, data.Lines},
 	} {
 		pair.v.Do(func(kv expvar.KeyValue) {
 			pair.m[kv.Key] = kv.Value.String()
@@ -382,37 +2334,254 @@ func (t *Tailer) WriteStatusHTML(w io.Writer) error {
 	return tpl.Execute(w, data)
 }
 
-// Gc removes file handles that have had no reads for 24h or more.
-func (t *Tailer) Gc() error {
-	t.handlesMu.Lock()
-	defer t.handlesMu.Unlock()
-	for k, v := range t.handles {
-		if time.Since(v.LastRead) > (time.Hour * 24) {
-			if err := t.w.Remove(v.Pathname); err != nil {
-				t.logger.Info(err)
+// Stats is a snapshot of the state of a Tailer.  Paths in it are valid
+// UTF-8, made so by logline.SafeFilename if need be; RawPath returns them as
+// they are on the filesystem.
+type Stats struct {
+	Handles        int // Number of files being tailed
+	BackfillQueued int // Number of files waiting for a backfill worker
+	BackfillActive int // Number of files being read by backfill workers
+
+	PartialBytes int64                   // Total size of partial lines
+	Partials     map[string]PartialState // Partial lines of the files being tailed that have held one in this generation, by canonical path
+
+	Throttles map[string]ThrottleState // Rate limits on the files being tailed that have them
+	Global    ThrottleState            // The limit on all files, if set
+
+	Backfills map[string]BackfillProgress // Files still being read up to where their end was when they were opened
+
+	Lags map[string]Lag // How far behind the end of each regular file being tailed reads are, by canonical path
+
+	Names map[string]string // Name reported on LogLines for each file being tailed, by canonical path
+
+	OpenPaths map[string]string // Where each file being tailed is now, by canonical path; DescriptorDeleted or DescriptorUnknown if it has been removed or can't be found
+
+	Shards map[string]int // Shard each file being tailed sends its lines to, by canonical path, if WithShardedOutput is given
+
+	Unacked map[string]int // Lines sent and not yet acknowledged, by canonical path, if WithAckedOffsets is given
+
+	Binary []string // Absolute paths not tailed because they look like binary files, sorted
+
+	WrongType map[string]os.FileMode // Paths tailed as files that have been replaced by something else, such as a directory, and aren't tailed until they're files again, by absolute path, with the type bits of what's there
+
+	SkippedArchives []string // Absolute paths matching a pattern not tailed because they look like archives, sorted
+
+	LargeFiles map[string]LargeFile // Files larger than the initial size limit when opened, by absolute path
+
+	Registry int // Number of files recorded in the registry, if there is one
+
+	Quiet *QuietState // Countdown to shutting down for being quiet, if WithQuietShutdown is given
+
+	Discovery *DiscoveryState // Progress tailing the files that already matched patterns when given, if WithDiscoveryConcurrency is given
+
+	Breakers map[string]BreakerState // Circuit breakers that are open or counting failures, by canonical path, if WithCircuitBreaker is given
+
+	Errors map[string][]FileError // The latest failures of the files being tailed that have had any since they were opened, rotated or truncated, or reset by ResetErrors, oldest first, by canonical path
+
+	Consumer ConsumerState // How the consumer of the lines channel is keeping up
+
+	rawPaths map[string]string // Paths as they are on the filesystem, by their keys above, if they aren't valid UTF-8
+}
+
+// Stats returns a snapshot of the Tailer's state.
+func (t *Tailer) Stats() Stats {
+	var s Stats
+	now := t.clock.Now()
+	t.handles.Range(func(k, v interface{}) bool {
+		key := s.safeKey(k.(string))
+		s.Handles++
+		if s.Names == nil {
+			s.Names = make(map[string]string)
+		}
+		s.Names[key] = v.(*File).name()
+		if s.OpenPaths == nil {
+			s.OpenPaths = make(map[string]string)
+		}
+		s.OpenPaths[key] = logline.SafeFilename(v.(*File).currentPath())
+		if f := v.(*File); f.acks != nil {
+			if s.Unacked == nil {
+				s.Unacked = make(map[string]int)
 			}
-			if err := v.Close(); err != nil {
-				t.logger.Info(err)
+			s.Unacked[key] = f.acks.unacked()
+		}
+		if t.shards != nil {
+			if s.Shards == nil {
+				s.Shards = make(map[string]int)
+			}
+			s.Shards[key] = t.shards.shardOf(v.(*File).name())
+		}
+		if p, ok := v.(*File).progress.state(now); ok {
+			if s.Backfills == nil {
+				s.Backfills = make(map[string]BackfillProgress)
+			}
+			s.Backfills[key] = p
+		}
+		if f := v.(*File); f.regular {
+			if s.Lags == nil {
+				s.Lags = make(map[string]Lag)
+			}
+			s.Lags[key] = f.lag.state(now)
+		}
+		if p := v.(*File).partialState(); p.HighWater > 0 || p.Flushes > 0 {
+			if s.Partials == nil {
+				s.Partials = make(map[string]PartialState)
+			}
+			s.Partials[key] = p
+		}
+		if f := v.(*File); f.breaker != nil {
+			if b, ok := f.breaker.snapshot(); ok {
+				if s.Breakers == nil {
+					s.Breakers = make(map[string]BreakerState)
+				}
+				s.Breakers[key] = b
+			}
+		}
+		if errs := v.(*File).errors.snapshot(); errs != nil {
+			if s.Errors == nil {
+				s.Errors = make(map[string][]FileError)
+			}
+			s.Errors[key] = errs
+		}
+		if f := v.(*File); f.rate != nil {
+			if state := f.rate.state(); state.BytesPerSec > 0 {
+				if s.Throttles == nil {
+					s.Throttles = make(map[string]ThrottleState)
+				}
+				s.Throttles[key] = state
+			}
+		}
+		return true
+	})
+	s.PartialBytes = t.metrics.partialBytes.Value()
+	if t.global != nil {
+		s.Global = t.global.state()
+	}
+	if q := t.queue; q != nil {
+		q.mu.Lock()
+		s.BackfillQueued = len(q.paths)
+		s.BackfillActive = q.active
+		q.mu.Unlock()
+	}
+	t.largeMu.Lock()
+	for p, l := range t.large {
+		if s.LargeFiles == nil {
+			s.LargeFiles = make(map[string]LargeFile)
+		}
+		s.LargeFiles[s.safeKey(p)] = l
+	}
+	t.largeMu.Unlock()
+	t.skippedMu.Lock()
+	for p := range t.skipped {
+		s.Binary = append(s.Binary, s.safeKey(p))
+	}
+	t.skippedMu.Unlock()
+	sort.Strings(s.Binary)
+	t.wrongTypeMu.Lock()
+	for p, mode := range t.wrongType {
+		if s.WrongType == nil {
+			s.WrongType = make(map[string]os.FileMode)
+		}
+		s.WrongType[s.safeKey(p)] = mode
+	}
+	t.wrongTypeMu.Unlock()
+	for _, p := range t.skippedArchiveList() {
+		s.SkippedArchives = append(s.SkippedArchives, s.safeKey(p))
+	}
+	if t.registry != nil {
+		s.Registry = t.registry.size()
+	}
+	if t.quiet != nil {
+		q := t.quiet.state(now)
+		s.Quiet = &q
+	}
+	if t.discovery != nil {
+		d := t.discovery.state()
+		s.Discovery = &d
+	}
+	s.Consumer = t.consumer.state(now)
+	return s
+}
+
+// Gc removes file handles that have had no reads for 24h or more, and those
+// whose open file has been deleted, after reading them to their end, and
+// forgets paths deleted more than 24h ago and files untailed more than a
+// minute ago.
+func (t *Tailer) Gc() error {
+	t.expireDeleted(t.clock.Now().Add(-24 * time.Hour))
+	t.expireTombstones(t.clock.Now().Add(-tombstoneTTL))
+	t.retireDeleted()
+	err := t.inRun(func() error {
+		var expired []*File
+		t.handles.Range(func(_, v interface{}) bool {
+			if f := v.(*File); t.clock.Now().Sub(f.LastRead()) > (time.Hour * 24) {
+				expired = append(expired, f)
 			}
-			delete(t.handles, k)
+			return true
+		})
+		for _, f := range expired {
+			t.logger.Infof("Expiring handle for %q, no reads since %s", f.Pathname, f.LastRead())
+			t.expireHandle(f)
 		}
+		return nil
+	})
+	if err != nil {
+		t.logger.Debug(err)
 	}
 	return nil
 }
 
+// expireHandle stops tailing f, and forgets that its path was tailed so that
+// it can be given to TailPath again.
+func (t *Tailer) expireHandle(f *File) {
+	t.closeHandle(f)
+	t.refsMu.Lock()
+	delete(t.refs, f.handleKey)
+	t.refsMu.Unlock()
+}
+
 // StartExpiryLoop runs a permanent goroutine to expire metrics every duration.
 func (t *Tailer) StartGcLoop(duration time.Duration) {
-	if duration <= 0 {
+	t.setExpiryInterval(duration)
+}
+
+// setExpiryInterval runs Gc every d from now, instead of as before, or stops
+// running it if d isn't positive.
+func (t *Tailer) setExpiryInterval(d time.Duration) {
+	t.gcMu.Lock()
+	defer t.gcMu.Unlock()
+	if t.gcTimer != nil {
+		t.gcTimer.Stop()
+		t.gcTimer = nil
+	}
+	t.expiryInterval = d
+	if d <= 0 {
 		t.logger.Info("Log handle expiration disabled")
 		return
 	}
-	go func() {
-		t.logger.Infof("Starting log handle expiry loop every %s", duration.String())
-		ticker := time.NewTicker(duration)
-		for range ticker.C {
+	t.logger.Infof("Starting log handle expiry loop every %s", d.String())
+	if t.gcDue == nil {
+		t.gcDue = make(chan struct{}, 1)
+		go t.runGc(t.gcDue)
+	}
+	due := t.gcDue
+	t.gcTimer = t.sched.Every(d, func() {
+		select {
+		case due <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// runGc runs Gc each time it's due, until the Tailer is closed.
+func (t *Tailer) runGc(due <-chan struct{}) {
+	for {
+		select {
+		case <-due:
 			if err := t.Gc(); err != nil {
 				t.logger.Info(err)
 			}
+		case <-t.runDone:
+			return
 		}
-	}()
+	}
 }
@@ -0,0 +1,267 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sgtsquiggs/tail/logger"
+	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/testutil"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+var backfillSize = flag.Int64("backfill_size", 32<<20, "size in bytes of the file read by BenchmarkBackfill; use 1<<30 to compare on a 1 GB file")
+
+// benchLineSizes are the lengths of the lines written by the benchmarks,
+// including the newline.
+var benchLineSizes = []int{16, 256, 4096}
+
+// benchLines returns n lines of size bytes each.
+func benchLines(n, size int) string {
+	return strings.Repeat(strings.Repeat("x", size-1)+"\n", n)
+}
+
+// benchWrite appends s to f, without logging it like testutil.WriteString.
+func benchWrite(b *testing.B, f *os.File, s string) {
+	if _, err := f.WriteString(s); err != nil {
+		b.Fatal(err)
+	}
+}
+
+// drain receives lines until ch is closed, then sends the number received.
+func drain(ch <-chan *logline.LogLine) <-chan int {
+	count := make(chan int, 1)
+	go func() {
+		n := 0
+		for range ch {
+			n++
+		}
+		count <- n
+	}()
+	return count
+}
+
+// benchTailer is a Tailer driven by a FakeWatcher, whose lines are drained
+// in the background.
+type benchTailer struct {
+	*Tailer
+	w         *watcher.FakeWatcher
+	processed chan struct{}
+	count     <-chan int
+}
+
+func newBenchTailer(b *testing.B, options ...Option) *benchTailer {
+	b.Helper()
+	lines := make(chan *logline.LogLine, 1000)
+	bt := &benchTailer{
+		w:         watcher.NewFakeWatcher(),
+		processed: make(chan struct{}, 1000),
+		count:     drain(lines),
+	}
+	options = append([]Option{
+		Logger(log.DiscardingLogger),
+		WithProcessedHook(func(watcher.Event) { bt.processed <- struct{}{} }),
+	}, options...)
+	ta, err := New(lines, bt.w, options...)
+	if err != nil {
+		b.Fatal(err)
+	}
+	bt.Tailer = ta
+	return bt
+}
+
+// await blocks until n events have been handled.
+func (bt *benchTailer) await(n int) {
+	for i := 0; i < n; i++ {
+		<-bt.processed
+	}
+}
+
+// close shuts down the Tailer and returns the number of lines it emitted.
+func (bt *benchTailer) close(b *testing.B) int {
+	b.Helper()
+	if err := bt.Close(); err != nil {
+		b.Fatal(err)
+	}
+	return <-bt.count
+}
+
+// reportLines reports the rate at which lines were emitted since start.
+func reportLines(b *testing.B, lines int, start time.Time) {
+	b.ReportMetric(float64(lines)/time.Since(start).Seconds(), "lines/s")
+}
+
+func BenchmarkOneShotBackfill(b *testing.B) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(b)
+	defer rmTmpDir()
+
+	const n = 10000
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(b, logfile)
+	benchWrite(b, f, benchLines(n, 100))
+	f.Close()
+
+	b.SetBytes(n * 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	total := 0
+	for i := 0; i < b.N; i++ {
+		bt := newBenchTailer(b, OneShot)
+		if err := bt.TailPath(logfile); err != nil {
+			b.Fatal(err)
+		}
+		total += bt.close(b)
+	}
+	reportLines(b, total, start)
+}
+
+func BenchmarkBackfill(b *testing.B) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(b)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(b, logfile)
+	chunk := benchLines(1000, 100)
+	for size := int64(0); size < *backfillSize; size += int64(len(chunk)) {
+		benchWrite(b, f, chunk)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		b.Fatal(err)
+	}
+	f.Close()
+
+	for _, tc := range []struct {
+		name    string
+		options []Option
+	}{
+		{"read", []Option{OneShot}},
+		{"mmap", []Option{OneShot, WithMmapBackfill()}},
+	} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(fi.Size())
+			b.ReportAllocs()
+			start := time.Now()
+			total := 0
+			for i := 0; i < b.N; i++ {
+				bt := newBenchTailer(b, tc.options...)
+				if err := bt.TailPath(logfile); err != nil {
+					b.Fatal(err)
+				}
+				total += bt.close(b)
+			}
+			reportLines(b, total, start)
+		})
+	}
+}
+
+func BenchmarkTailUpdates(b *testing.B) {
+	for _, size := range benchLineSizes {
+		b.Run(fmt.Sprintf("%dB", size), func(b *testing.B) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(b)
+			defer rmTmpDir()
+
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(b, logfile)
+			defer f.Close()
+			bt := newBenchTailer(b)
+			if err := bt.TailPath(logfile); err != nil {
+				b.Fatal(err)
+			}
+
+			const n = 100
+			batch := benchLines(n, size)
+			b.SetBytes(int64(len(batch)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			start := time.Now()
+			for i := 0; i < b.N; i++ {
+				benchWrite(b, f, batch)
+				bt.w.InjectUpdate(logfile)
+				bt.await(1)
+			}
+			reportLines(b, bt.close(b), start)
+		})
+	}
+}
+
+func BenchmarkFanIn(b *testing.B) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(b)
+	defer rmTmpDir()
+
+	const files = 100
+	bt := newBenchTailer(b)
+	var (
+		names []string
+		fds   []*os.File
+	)
+	for i := 0; i < files; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log%d", i))
+		fds = append(fds, testutil.TestOpenFile(b, logfile))
+		names = append(names, logfile)
+		if err := bt.TailPath(logfile); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, f := range fds {
+			f.Close()
+		}
+	}()
+
+	batch := benchLines(10, 100)
+	b.SetBytes(int64(files * len(batch)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		for j, f := range fds {
+			benchWrite(b, f, batch)
+			bt.w.InjectUpdate(names[j])
+		}
+		bt.await(files)
+	}
+	reportLines(b, bt.close(b), start)
+}
+
+func BenchmarkRotationStorm(b *testing.B) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(b)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(b, logfile)
+	bt := newBenchTailer(b)
+	if err := bt.TailPath(logfile); err != nil {
+		b.Fatal(err)
+	}
+
+	batch := benchLines(10, 100)
+	b.SetBytes(int64(2 * len(batch)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	start := time.Now()
+	for i := 0; i < b.N; i++ {
+		// Lines written just before the rotation are read by the flush read.
+		benchWrite(b, f, batch)
+		f.Close()
+		if err := os.Rename(logfile, logfile+".1"); err != nil {
+			b.Fatal(err)
+		}
+		f = testutil.TestOpenFile(b, logfile)
+		benchWrite(b, f, batch)
+		bt.w.InjectUpdate(logfile)
+		bt.await(1)
+	}
+	b.StopTimer()
+	f.Close()
+	reportLines(b, bt.close(b), start)
+}
@@ -4,26 +4,46 @@
 package tailer
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/sgtsquiggs/tail/checkpoint"
+	"github.com/sgtsquiggs/tail/clock"
 	log "github.com/sgtsquiggs/tail/logger"
 	"github.com/sgtsquiggs/tail/logline"
 	"github.com/sgtsquiggs/tail/testutil"
 	"github.com/sgtsquiggs/tail/watcher"
+	"regexp"
 )
 
-func makeTestTail(t *testing.T) (*Tailer, chan *logline.LogLine, *watcher.FakeWatcher, string, func()) {
+// collectTimeout bounds how long tests wait for lines from the tailer.
+const collectTimeout = 5 * time.Second
+
+func makeTestTail(t *testing.T, options ...Option) (*Tailer, chan *logline.LogLine, *watcher.FakeWatcher, string, func()) {
 	tmpDir, rmTmpDir := testutil.TestTempDir(t)
 
 	w := watcher.NewFakeWatcher()
 	lines := make(chan *logline.LogLine, 1)
-	ta, err := New(lines, w)
+	ta, err := New(lines, w, options...)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -45,8 +65,8 @@ func TestTail(t *testing.T) {
 	}
 	// Tail also causes the log to be read, so no need to inject an event.
 
-	if _, ok := ta.handles[logfile]; !ok {
-		t.Errorf("path not found in files map: %+#v", ta.handles)
+	if !ta.hasHandle(logfile) {
+		t.Errorf("path not found in files map: %+#v", ta.Stats())
 	}
 }
 
@@ -57,39 +77,25 @@ func TestHandleLogUpdate(t *testing.T) {
 	logfile := filepath.Join(dir, "log")
 	f := testutil.TestOpenFile(t, logfile)
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	go func() {
-		for line := range lines {
-			log.DefaultLogger.Infof("line %v", line)
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
-
 	err := ta.TailPath(logfile)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	wg.Add(4)
 	testutil.WriteString(t, f, "a\nb\nc\nd\n")
-	// f.Seek(0, 0)
 	w.InjectUpdate(logfile)
 
-	wg.Wait()
+	result := testutil.CollectLines(t, lines, 4, collectTimeout)
 	if err := w.Close(); err != nil {
 		t.Log(err)
 	}
-	<-done
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
 
 	expected := []*logline.LogLine{
-		{logfile, "a"},
-		{logfile, "b"},
-		{logfile, "c"},
-		{logfile, "d"},
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+		{Filename: logfile, Line: "c"},
+		{Filename: logfile, Line: "d"},
 	}
 	if diff := testutil.Diff(expected, result); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -106,26 +112,13 @@ func TestHandleLogTruncate(t *testing.T) {
 	logfile := filepath.Join(dir, "log")
 	f := testutil.TestOpenFile(t, logfile)
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	go func() {
-		for line := range lines {
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
-
 	if err := ta.TailPath(logfile); err != nil {
 		t.Fatal(err)
 	}
 
-	wg.Add(3)
 	testutil.WriteString(t, f, "a\nb\nc\n")
-	//time.Sleep(10 * time.Millisecond)
 	w.InjectUpdate(logfile)
-	wg.Wait()
+	result := testutil.CollectLines(t, lines, 3, collectTimeout)
 
 	if err := f.Truncate(0); err != nil {
 		t.Fatal(err)
@@ -134,25 +127,22 @@ func TestHandleLogTruncate(t *testing.T) {
 	_, err := f.Seek(0, 0)
 	testutil.FatalIfErr(t, err)
 	w.InjectUpdate(logfile)
-	//time.Sleep(10 * time.Millisecond)
 
-	wg.Add(2)
 	testutil.WriteString(t, f, "d\ne\n")
 	w.InjectUpdate(logfile)
-	//time.Sleep(10 * time.Millisecond)
 
-	wg.Wait()
+	result = append(result, testutil.CollectLines(t, lines, 2, collectTimeout)...)
 	if err := w.Close(); err != nil {
 		t.Log(err)
 	}
-	<-done
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
 
 	expected := []*logline.LogLine{
-		{logfile, "a"},
-		{logfile, "b"},
-		{logfile, "c"},
-		{logfile, "d"},
-		{logfile, "e"},
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+		{Filename: logfile, Line: "c"},
+		{Filename: logfile, Line: "d", Generation: 1},
+		{Filename: logfile, Line: "e", Generation: 1},
 	}
 	if diff := testutil.Diff(expected, result); diff != "" {
 		t.Errorf("result didn't match:\n%s", diff)
@@ -166,43 +156,26 @@ func TestHandleLogUpdatePartialLine(t *testing.T) {
 	logfile := filepath.Join(dir, "log")
 	f := testutil.TestOpenFile(t, logfile)
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		for line := range lines {
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
-
 	err := ta.TailPath(logfile)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	testutil.WriteString(t, f, "a")
-	//f.Seek(0, 0)
 	w.InjectUpdate(logfile)
 
-	//f.Seek(1, 0)
 	testutil.WriteString(t, f, "b")
-	// f.Seek(1, 0)
 	w.InjectUpdate(logfile)
 
-	//f.Seek(2, 0)
 	testutil.WriteString(t, f, "\n")
-	//f.Seek(2, 0)
 	w.InjectUpdate(logfile)
 
-	wg.Wait()
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
 	w.Close()
-	<-done
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
 
 	expected := []*logline.LogLine{
-		{logfile, "ab"},
+		{Filename: logfile, Line: "ab"},
 	}
 	diff := testutil.Diff(expected, result)
 	if diff != "" {
@@ -228,50 +201,36 @@ func TestTailerOpenRetries(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	wg.Add(1) // lines written
-	go func() {
-		for range lines {
-			wg.Done()
-		}
-		close(done)
-	}()
 	testutil.FatalIfErr(t, ta.AddPattern(logfile))
 
 	if err := ta.TailPath(logfile); err == nil || !os.IsPermission(err) {
 		t.Fatalf("Expected a permission denied error here: %s", err)
 	}
-	//w.InjectUpdate(logfile)
-	//time.Sleep(10 * time.Millisecond)
 	log.DefaultLogger.Info("remove")
 	if err := os.Remove(logfile); err != nil {
 		t.Fatal(err)
 	}
 	w.InjectDelete(logfile)
-	//time.Sleep(10 * time.Millisecond)
 	log.DefaultLogger.Info("openfile")
 	f, err := os.OpenFile(logfile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
 	w.InjectCreate(logfile)
-	//	time.Sleep(10 * time.Millisecond)
 	log.DefaultLogger.Info("chmod")
 	if err := os.Chmod(logfile, 0666); err != nil {
 		t.Fatal(err)
 	}
 	w.InjectUpdate(logfile)
-	//time.Sleep(10 * time.Millisecond)
 	log.DefaultLogger.Info("write string")
 	testutil.WriteString(t, f, "\n")
 	w.InjectUpdate(logfile)
 
-	wg.Wait()
+	testutil.CollectLines(t, lines, 1, collectTimeout)
 	if err := w.Close(); err != nil {
 		t.Log(err)
 	}
-	<-done
+	testutil.CollectAllLines(t, lines, collectTimeout)
 }
 
 func TestTailerInitErrors(t *testing.T) {
@@ -299,6 +258,64 @@ func TestTailerInitErrors(t *testing.T) {
 	}
 }
 
+func TestConfigValidate(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	w := watcher.NewFakeWatcher()
+	for _, tc := range []struct {
+		name  string
+		c     Config
+		field string
+	}{
+		{"valid", Config{Lines: lines, Watcher: w, OneShot: true, MaxLineLength: 10, Options: []Option{WithPositions()}}, ""},
+		{"no lines", Config{Watcher: w}, ""},
+		{"fan out", Config{Watcher: w, FanOut: true}, ""},
+		{"fan out with lines", Config{Lines: lines, Watcher: w, FanOut: true}, "FanOut"},
+		{"no watcher", Config{Lines: lines}, "Watcher"},
+		{"max line length", Config{Lines: lines, Watcher: w, MaxLineLength: -1}, "MaxLineLength"},
+		{"max bytes per read", Config{Lines: lines, Watcher: w, MaxBytesPerRead: -1}, "MaxBytesPerRead"},
+		{"partial buffer budget", Config{Lines: lines, Watcher: w, PartialBufferBudget: -1}, "PartialBufferBudget"},
+		{"expiry interval", Config{Lines: lines, Watcher: w, ExpiryInterval: -time.Second}, "ExpiryInterval"},
+		{"nil option", Config{Lines: lines, Watcher: w, Options: []Option{OneShot, nil}}, "Options[1]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.c.Validate()
+			if tc.field == "" {
+				testutil.FatalIfErr(t, err)
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "tailer.Config."+tc.field+":") {
+				t.Errorf("expected an error naming %s, got %v", tc.field, err)
+			}
+		})
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "abcdef\n")
+
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := NewFromConfig(Config{Lines: lines, Watcher: watcher.NewFakeWatcher(), OneShot: true, MaxLineLength: 3})
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	testutil.FatalIfErr(t, ta.Close())
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "abc", Truncated: true}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+
+	if _, err := NewFromConfig(Config{Lines: lines}); err == nil {
+		t.Error("expected an error for a config without a watcher")
+	}
+}
+
 func TestHandleLogRotate(t *testing.T) {
 	ta, lines, w, dir, cleanup := makeTestTail(t)
 	defer cleanup()
@@ -306,21 +323,9 @@ func TestHandleLogRotate(t *testing.T) {
 	logfile := filepath.Join(dir, "log")
 	f := testutil.TestOpenFile(t, logfile)
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	go func() {
-		for line := range lines {
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
-
 	if err := ta.TailPath(logfile); err != nil {
 		t.Fatal(err)
 	}
-	wg.Add(2)
 	testutil.WriteString(t, f, "1\n")
 	log.DefaultLogger.Info("update")
 	w.InjectUpdate(logfile)
@@ -343,13 +348,13 @@ func TestHandleLogRotate(t *testing.T) {
 	log.DefaultLogger.Info("update")
 	w.InjectUpdate(logfile)
 
-	wg.Wait()
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
 	w.Close()
-	<-done
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
 
 	expected := []*logline.LogLine{
-		{logfile, "1"},
-		{logfile, "2"},
+		{Filename: logfile, Line: "1"},
+		{Filename: logfile, Line: "2", Generation: 1},
 	}
 	diff := testutil.Diff(expected, result)
 	if diff != "" {
@@ -366,21 +371,9 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	go func() {
-		for line := range lines {
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
-
 	if err := ta.TailPath(logfile); err != nil {
 		t.Fatal(err)
 	}
-	wg.Add(2)
 	testutil.WriteString(t, f, "1\n")
 	log.DefaultLogger.Info("update")
 	w.InjectUpdate(logfile)
@@ -393,23 +386,24 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 	// No delete signal yet
 	f = testutil.TestOpenFile(t, logfile)
 	log.DefaultLogger.Info("create")
-	w.InjectCreate(logfile)
-
-	time.Sleep(1 * time.Millisecond)
-	log.DefaultLogger.Info("delete")
-	w.InjectDelete(logfile)
+	w.InjectCreateAndWait(logfile)
 
+	// The update is sent while the path is still watched, as the delete
+	// removes the watch.
 	testutil.WriteString(t, f, "2\n")
 	log.DefaultLogger.Info("update")
 	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
 
-	wg.Wait()
+	log.DefaultLogger.Info("delete")
+	w.InjectDelete(logfile)
+	ta.WaitForEvents(context.Background())
 	w.Close()
-	<-done
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
 
 	expected := []*logline.LogLine{
-		{logfile, "1"},
-		{logfile, "2"},
+		{Filename: logfile, Line: "1"},
+		{Filename: logfile, Line: "2", Generation: 1},
 	}
 	diff := testutil.Diff(expected, result)
 	if diff != "" {
@@ -418,24 +412,19 @@ func TestHandleLogRotateSignalsWrong(t *testing.T) {
 }
 
 func TestTailExpireStaleHandles(t *testing.T) {
-	ta, lines, w, dir, cleanup := makeTestTail(t)
-	defer cleanup()
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
 
-	result := []*logline.LogLine{}
-	done := make(chan struct{})
-	wg := sync.WaitGroup{}
-	go func() {
-		for line := range lines {
-			log.DefaultLogger.Infof("line %v", line)
-			result = append(result, line)
-			wg.Done()
-		}
-		close(done)
-	}()
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	processed := make(chan struct{}, 2)
+	ta, err := New(lines, w, WithClock(clk), WithProcessedHook(func(watcher.Event) { processed <- struct{}{} }))
+	testutil.FatalIfErr(t, err)
 
-	log1 := filepath.Join(dir, "log1")
+	log1 := filepath.Join(tmpDir, "log1")
 	f1 := testutil.TestOpenFile(t, log1)
-	log2 := filepath.Join(dir, "log2")
+	log2 := filepath.Join(tmpDir, "log2")
 	f2 := testutil.TestOpenFile(t, log2)
 
 	if err := ta.TailPath(log1); err != nil {
@@ -444,45 +433,5304 @@ func TestTailExpireStaleHandles(t *testing.T) {
 	if err := ta.TailPath(log2); err != nil {
 		t.Fatal(err)
 	}
-	wg.Add(2)
 	testutil.WriteString(t, f1, "1\n")
 	testutil.WriteString(t, f2, "2\n")
 	w.InjectUpdate(log1)
 	w.InjectUpdate(log2)
-	wg.Wait()
-	if err := w.Close(); err != nil {
-		t.Log(err)
-	}
-	<-done
+	<-processed
+	<-processed
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
 	}
-	ta.handlesMu.RLock()
-	if len(ta.handles) != 2 {
-		t.Errorf("expecting 2 handles, got %v", ta.handles)
+	if s := ta.Stats(); s.Handles != 2 {
+		t.Errorf("expecting 2 handles, got %v", s)
 	}
-	ta.handlesMu.RUnlock()
-	ta.handlesMu.Lock()
-	ta.handles[log1].LastRead = time.Now().Add(-time.Hour*24 + time.Minute)
-	ta.handlesMu.Unlock()
+
+	// Read from log2 just before log1 would expire.
+	clk.Advance(time.Hour*24 - time.Minute)
+	testutil.WriteString(t, f2, "3\n")
+	w.InjectUpdate(log2)
+	<-processed
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
 	}
-	ta.handlesMu.RLock()
-	if len(ta.handles) != 2 {
-		t.Errorf("expecting 2 handles, got %v", ta.handles)
+	if s := ta.Stats(); s.Handles != 2 {
+		t.Errorf("expecting 2 handles, got %v", s)
 	}
-	ta.handlesMu.RUnlock()
-	ta.handlesMu.Lock()
-	ta.handles[log1].LastRead = time.Now().Add(-time.Hour*24 - time.Minute)
-	ta.handlesMu.Unlock()
+
+	clk.Advance(2 * time.Minute)
 	if err := ta.Gc(); err != nil {
 		t.Fatal(err)
 	}
-	ta.handlesMu.RLock()
-	if len(ta.handles) != 1 {
-		t.Errorf("expecting 1 handles, got %v", ta.handles)
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expecting 1 handles, got %v", s)
+	}
+	if !ta.hasHandle(log2) {
+		t.Errorf("expecting log2 to remain")
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	if len(lines) != 3 {
+		t.Errorf("expecting 3 lines, got %d", len(lines))
+	}
+}
+
+func TestTailPathAfterExpiry(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	ta, lines, w, dir, cleanup := makeTestTail(t, WithClock(clk))
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	clk.Advance(25 * time.Hour)
+	testutil.FatalIfErr(t, ta.Gc())
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Fatalf("expected the handle to expire, got %+v", s)
+	}
+	if n := ta.metrics.logCount.Value(); n != 0 {
+		t.Errorf("expected no logs counted after expiry, got %d", n)
+	}
+
+	// The expired path can be tailed again.
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "1\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	if n := ta.metrics.logCount.Value(); n != 1 {
+		t.Errorf("expected 1 log counted, got %d", n)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "1"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match expected:\n%s", diff)
+	}
+}
+
+func TestTailRetireDeletedDescriptor(t *testing.T) {
+	if !descriptorPathsSupported {
+		t.Skip("open files can't be found from their descriptors on this platform")
+	}
+	events := make(chan FileEvent, 1)
+	ta, lines, _, dir, cleanup := makeTestTail(t, WithFileEvents(events))
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	key, err := canonicalPath(logfile)
+	testutil.FatalIfErr(t, err)
+	if s := ta.Stats(); s.OpenPaths[key] != key {
+		t.Errorf("expected the open path %q, got %v", key, s.OpenPaths)
+	}
+
+	// Removed without an event, with a line still to read.
+	testutil.WriteString(t, f, "last\n")
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	testutil.FatalIfErr(t, ta.Gc())
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Errorf("expected the deleted file to be retired, got %+v", s)
+	}
+	if e := <-events; e.Type != Deleted || e.Pathname != logfile {
+		t.Errorf("expected a Deleted event for %q, got %+v", logfile, e)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "last"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailOpenPaths(t *testing.T) {
+	if !descriptorPathsSupported {
+		t.Skip("open files can't be found from their descriptors on this platform")
+	}
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, w, WithOpenPaths())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+
+	// Rotated by renaming, and written to after.
+	rotated := logfile + ".1"
+	testutil.FatalIfErr(t, os.Rename(logfile, rotated))
+	testutil.WriteString(t, f, "b\n")
+	g := testutil.TestOpenFile(t, logfile)
+	defer g.Close()
+	testutil.WriteString(t, g, "c\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+	key, err := canonicalPath(logfile)
+	testutil.FatalIfErr(t, err)
+	if s := ta.Stats(); s.OpenPaths[key] != key {
+		t.Errorf("expected the open path %q, got %v", key, s.OpenPaths)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+
+	rotatedKey, err := canonicalPath(rotated)
+	testutil.FatalIfErr(t, err)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b", OpenPath: rotatedKey},
+		{Filename: logfile, Line: "c", Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logger := testutil.NewCaptureLogger()
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w, Logger(logger), WithLogLevel(log.DebugLevel))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(logfile)
+	<-lines
+	testutil.FatalIfErr(t, ta.Close())
+
+	for _, c := range []struct {
+		prefix string
+		key    string
+		value  interface{}
+	}{
+		{"Event type", "op", watcher.Update},
+		{"handleLogUpdate", "path", logfile},
+		{"Tailing", "path", logfile},
+		{"Read count 2", "offset", int64(0)},
+	} {
+		if _, ok := logger.FindEntry(c.prefix, c.key, c.value); !ok {
+			t.Errorf("no %q message with field %s=%v in %v", c.prefix, c.key, c.value, logger.Entries())
+		}
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logger := testutil.NewCaptureLogger()
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w, Logger(logger))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(logfile)
+	<-lines
+	if _, ok := logger.FindEntry("handleLogUpdate", "path", logfile); ok {
+		t.Errorf("unexpected debug message at default level: %v", logger.Entries())
+	}
+	if _, ok := logger.FindEntry("Tailing", "path", logfile); !ok {
+		t.Errorf("expected info message at default level: %v", logger.Entries())
+	}
+
+	ta.SetLogLevel(log.DebugLevel)
+	testutil.WriteString(t, f, "b\n")
+	w.InjectUpdate(logfile)
+	<-lines
+	testutil.FatalIfErr(t, ta.Close())
+	e, ok := logger.FindEntry("handleLogUpdate", "path", logfile)
+	if !ok {
+		t.Errorf("expected debug message after SetLogLevel: %v", logger.Entries())
+	}
+	if e.Level != "debug" {
+		t.Errorf("expected debug level, got %q", e.Level)
+	}
+}
+
+func TestTailPathWatchFailure(t *testing.T) {
+	ta, _, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	w.FailNextAdd(syscall.ENOSPC)
+	if err := ta.TailPath(logfile); err == nil {
+		t.Error("expected error when the watch can't be added")
+	}
+	if ta.hasHandle(logfile) {
+		t.Errorf("handle created despite watch failure: %+#v", ta.Stats())
+	}
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	if !ta.hasHandle(logfile) {
+		t.Errorf("path not found in files map: %+#v", ta.Stats())
+	}
+}
+
+func TestWatchLimitEvent(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	events := make(chan FileEvent, 1)
+	ta, err := New(make(chan *logline.LogLine, 1), w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	w.FailNextAdd(&watcher.WatchLimitError{Path: logfile, Sysctl: "fs.inotify.max_user_watches", Limit: 8192, Err: syscall.ENOSPC})
+	err = ta.TailPath(logfile)
+	if !watcher.IsWatchLimit(err) {
+		t.Errorf("expected a watch limit error, got %v", err)
+	}
+	select {
+	case e := <-events:
+		if e.Type != WatchLimit || e.Pathname != logfile || !watcher.IsWatchLimit(e.Err) {
+			t.Errorf("unexpected event: %+v", e)
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("no watch limit event")
+	}
+}
+
+func TestProcessedHook(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	processed := make(chan watcher.Event, 1)
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, WithProcessedHook(func(e watcher.Event) { processed <- e }))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	testutil.WriteString(t, f, "a\nb\n")
+	w.InjectUpdateAndWait(logfile)
+	testutil.FatalIfErr(t, w.AwaitPending(time.Second))
+	e := <-processed
+	if e.Op != watcher.Update || e.Pathname != logfile {
+		t.Errorf("unexpected event processed: %v", e)
+	}
+	// Both lines have been sent by the time the hook is called.
+	if len(lines) != 2 {
+		t.Errorf("expected 2 lines sent, got %d", len(lines))
+	}
+}
+
+func TestTailMmapBackfill(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\n")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, OneShot, WithMmapBackfill())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.FatalIfErr(t, ta.Close())
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestBackfillConcurrency(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	var expected []*logline.LogLine
+	for i := 0; i < 5; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log%d", i))
+		f := testutil.TestOpenFile(t, logfile)
+		testutil.WriteString(t, f, fmt.Sprintf("line %d\n", i))
+		f.Close()
+		expected = append(expected, &logline.LogLine{Filename: logfile, Line: fmt.Sprintf("line %d", i)})
+	}
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 5)
+	ta, err := New(lines, w, OneShot, WithBackfillConcurrency(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "log*")))
+	testutil.FatalIfErr(t, ta.Close())
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	sort.Slice(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestDiscoveryConcurrency(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// Files modified longer ago the higher their number.
+	const n = 20
+	now := time.Now()
+	for i := 0; i < n; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log.%02d", i))
+		testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte(fmt.Sprintf("line %d\n", i)), 0600))
+		at := now.Add(-time.Duration(i) * time.Hour)
+		testutil.FatalIfErr(t, os.Chtimes(logfile, at, at))
+	}
+	pattern := filepath.Join(tmpDir, "log.*")
+
+	if _, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithDiscoveryConcurrency(0)); err == nil {
+		t.Error("expected an error for a discovery concurrency of 0")
+	}
+
+	// With one worker, the most recently modified file is read first.
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithDiscoveryConcurrency(1))
+	testutil.FatalIfErr(t, err)
+	done := make(chan error, 1)
+	go func() { done <- ta.AddPatternWithPolicy(pattern, Beginning) }()
+	result := testutil.CollectLines(t, lines, n, collectTimeout)
+	testutil.FatalIfErr(t, <-done)
+	var expected []*logline.LogLine
+	for i := 0; i < n; i++ {
+		expected = append(expected, &logline.LogLine{Filename: filepath.Join(tmpDir, fmt.Sprintf("log.%02d", i)), Line: fmt.Sprintf("line %d", i)})
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if diff := testutil.Diff(&DiscoveryState{Found: n, Opened: n}, ta.Stats().Discovery); diff != "" {
+		t.Errorf("discovery state didn't match:\n%s", diff)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	// With several, every file is read.
+	lines = make(chan *logline.LogLine, n)
+	ta, err = New(lines, watcher.NewFakeWatcher(), WithDiscoveryConcurrency(4))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.AddPatternWithPolicy(pattern, Beginning))
+	result = testutil.CollectLines(t, lines, n, collectTimeout)
+	sort.Slice(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if s := ta.Stats(); s.Handles != n {
+		t.Errorf("expected %d handles, got %d", n, s.Handles)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestDiscoveryClose(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log.%02d", i))
+		testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("line\n"), 0600))
+	}
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithDiscoveryConcurrency(2))
+	testutil.FatalIfErr(t, err)
+	done := make(chan error, 1)
+	go func() { done <- ta.AddPatternWithPolicy(filepath.Join(tmpDir, "log.*"), Beginning) }()
+
+	// Close part way through; the files being read finish.
+	testutil.CollectLines(t, lines, 2, collectTimeout)
+	go func() {
+		for range lines {
+		}
+	}()
+	testutil.FatalIfErr(t, ta.Close())
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected an error from a pattern abandoned by Close")
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("discovery didn't stop on Close")
+	}
+	if s := ta.Stats().Discovery; s.Found != n || s.Opened >= n || s.Remaining != n-s.Opened {
+		t.Errorf("expected discovery to be abandoned, got %+v", s)
+	}
+}
+
+func TestArchiveBackfill(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "app.log")
+	now := time.Now()
+	write := func(pathname, text string, age time.Duration) {
+		t.Helper()
+		var b bytes.Buffer
+		if strings.HasSuffix(pathname, ".gz") {
+			z := gzip.NewWriter(&b)
+			_, err := z.Write([]byte(text))
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, z.Close())
+		} else {
+			b.WriteString(text)
+		}
+		testutil.FatalIfErr(t, ioutil.WriteFile(pathname, b.Bytes(), 0600))
+		testutil.FatalIfErr(t, os.Chtimes(pathname, now.Add(-age), now.Add(-age)))
+	}
+	write(logfile, "live\n", 0)
+	write(logfile+".1", "one\n", time.Hour)
+	write(logfile+".2.gz", "two\nno newline", 2*time.Hour)
+	write(logfile+".3.gz", "three\n", 3*time.Hour)
+	write(filepath.Join(tmpDir, "app.logger"), "other\n", 0)
+
+	for _, opts := range [][]PatternOption{
+		{WithArchiveSuffixes(".[0-9]*")},
+		{WithArchiveBackfill(0, 0), WithArchiveSuffixes("[")},
+		{WithArchiveBackfill(-time.Second, 0)},
+	} {
+		ta, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher())
+		testutil.FatalIfErr(t, err)
+		if err := ta.TailPattern(logfile, opts...); err == nil {
+			t.Error("expected an error for invalid pattern options")
+		}
+		testutil.FatalIfErr(t, ta.Close())
+	}
+
+	for _, tc := range []struct {
+		name     string
+		opt      PatternOption
+		archives int
+		expected []*logline.LogLine
+	}{
+		{"newest two", WithArchiveBackfill(0, 2), 2, []*logline.LogLine{
+			{Filename: logfile, Line: "two"},
+			{Filename: logfile, Line: "no newline", Truncated: true},
+			{Filename: logfile, Line: "one", Generation: 1},
+			{Filename: logfile, Line: "live", Generation: 2},
+		}},
+		{"newer than 90m", WithArchiveBackfill(90*time.Minute, 0), 1, []*logline.LogLine{
+			{Filename: logfile, Line: "one"},
+			{Filename: logfile, Line: "live", Generation: 1},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := make(chan *logline.LogLine, 10)
+			events := make(chan FileEvent, 10)
+			ta, err := New(lines, watcher.NewFakeWatcher(), WithFileEvents(events))
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, ta.AddPatternWithPolicy(logfile, Beginning, tc.opt))
+			result := testutil.CollectLines(t, lines, len(tc.expected), collectTimeout)
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+			select {
+			case e := <-events:
+				// Every line but the live file's is from an archive.
+				expected := FileEvent{Type: ArchivesRead, Name: logfile, Pathname: logfile, Lines: int64(len(tc.expected) - 1), Archives: tc.archives}
+				if diff := testutil.Diff(expected, e); diff != "" {
+					t.Errorf("event didn't match:\n%s", diff)
+				}
+			case <-time.After(collectTimeout):
+				t.Fatal("no archives read event")
+			}
+			testutil.FatalIfErr(t, ta.Close())
+		})
+	}
+}
+
+func TestBackfillHandOver(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "old\n")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w, WithBackfillConcurrency(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// Wait for the worker to hand the file over to the event loop.
+	deadline := time.Now().Add(collectTimeout)
+	for s := ta.Stats(); s.Handles != 1 || s.BackfillQueued != 0 || s.BackfillActive != 0; s = ta.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("backfill didn't finish: %+v", ta.Stats())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	testutil.WriteString(t, f, "new\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "new"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestConcurrentHandleAccess(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 100)
+	ta, err := New(lines, w, Logger(log.DiscardingLogger))
+	testutil.FatalIfErr(t, err)
+	count := make(chan int)
+	go func() {
+		n := 0
+		for range lines {
+			n++
+		}
+		count <- n
+	}()
+
+	const files, writes = 10, 20
+	var wg sync.WaitGroup
+	for i := 0; i < files; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log%d", i))
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < writes; j++ {
+				if _, err := f.WriteString("line\n"); err != nil {
+					t.Error(err)
+				}
+				w.InjectUpdateAndWait(logfile)
+				// Already tailed, so this only looks up the handle.
+				if _, ok := ta.TailPath(logfile).(*ErrAlreadyTailed); !ok {
+					t.Error("expected an ErrAlreadyTailed")
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := ta.Gc(); err != nil {
+				t.Error(err)
+			}
+			if err := ta.WriteStatusHTML(ioutil.Discard); err != nil {
+				t.Error(err)
+			}
+			ta.Stats()
+		}
+	}()
+	wg.Wait()
+	close(done)
+	testutil.FatalIfErr(t, w.AwaitPending(collectTimeout))
+	testutil.FatalIfErr(t, ta.Close())
+	if n := <-count; n != files*writes {
+		t.Errorf("expected %d lines, got %d", files*writes, n)
+	}
+	if s := ta.Stats(); s.Handles != files {
+		t.Errorf("expected %d handles, got %v", files, s)
+	}
+}
+
+func TestPartialStats(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 10)
+	processed := make(chan struct{}, 1)
+	ta, err := New(lines, w, WithProcessedHook(func(watcher.Event) { processed <- struct{}{} }))
+	testutil.FatalIfErr(t, err)
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	for _, tc := range []struct {
+		write    string
+		expected PartialState
+	}{
+		{"abcdef", PartialState{Bytes: 6, HighWater: 6}},
+		{"gh", PartialState{Bytes: 8, HighWater: 8}},
+		{"\nij", PartialState{Bytes: 2, HighWater: 8}},
+	} {
+		testutil.WriteString(t, f, tc.write)
+		w.InjectUpdate(logfile)
+		<-processed
+		s := ta.Stats()
+		if p := s.Partials[logfile]; p != tc.expected {
+			t.Errorf("after writing %q, expected %+v, got %+v", tc.write, tc.expected, p)
+		}
+		if s.PartialBytes != tc.expected.Bytes {
+			t.Errorf("after writing %q, expected %d partial bytes, got %d", tc.write, tc.expected.Bytes, s.PartialBytes)
+		}
+	}
+
+	// The high water mark starts again with the new generation.
+	testutil.FatalIfErr(t, f.Truncate(0))
+	_, err = f.Seek(0, io.SeekStart)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "k")
+	w.InjectUpdate(logfile)
+	<-processed
+	if p := ta.Stats().Partials[logfile]; p.HighWater != 1 || p.Bytes != 1 {
+		t.Errorf("after truncation, expected a high water mark of 1, got %+v", p)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestPartialBufferBudget(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 10)
+	processed := make(chan struct{}, 1)
+	ta, err := New(lines, w, WithPartialBufferBudget(10), WithProcessedHook(func(watcher.Event) { processed <- struct{}{} }))
+	testutil.FatalIfErr(t, err)
+
+	var logfiles []string
+	for i, partial := range []string{"aaaaaa", "bbb", "cccc"} {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log%d", i))
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+		testutil.WriteString(t, f, partial)
+		w.InjectUpdate(logfile)
+		<-processed
+		if s := ta.Stats(); s.PartialBytes > 10 {
+			t.Errorf("partial buffers over budget after %q: %v", partial, s)
+		}
+		logfiles = append(logfiles, logfile)
+	}
+	// The largest partial line was flushed when the third file went over
+	// budget, leaving the others.
+	if s := ta.Stats(); s.PartialBytes != 7 {
+		t.Errorf("expected 7 partial bytes, got %v", s)
+	}
+	if p := ta.Stats().Partials[logfiles[0]]; p.Bytes != 0 || p.HighWater != 6 || p.Flushes != 1 {
+		t.Errorf("expected the flushed partial line in Stats, got %+v", p)
+	}
+	if n := ta.metrics.partialBytes.Value(); n != 7 {
+		t.Errorf("expected a gauge of 7 partial bytes, got %d", n)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: logfiles[0], Line: "aaaaaa", Truncated: true},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestPartialBufferBudgetCarriageReturns(t *testing.T) {
+	for _, mode := range []CarriageReturnMode{ReplaceOnCarriageReturn, SplitOnCarriageReturn} {
+		t.Run(mode.String(), func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			w := watcher.NewFakeWatcher()
+			lines := make(chan *logline.LogLine, 10)
+			ta, err := New(lines, w, WithPartialBufferBudget(100), WithCarriageReturns(mode))
+			testutil.FatalIfErr(t, err)
+
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+			// Each read ends in a carriage return, held back until the next.
+			for i := 1; i <= 5; i++ {
+				testutil.WriteString(t, f, fmt.Sprintf("progress %d%%\r", i*20))
+				w.InjectUpdate(logfile)
+				ta.WaitForEvents(context.Background())
+			}
+			testutil.WriteString(t, f, "done\n")
+			w.InjectUpdate(logfile)
+			n := 1
+			if mode == SplitOnCarriageReturn {
+				n = 6
+			}
+			testutil.CollectLines(t, lines, n, collectTimeout)
+			ta.WaitForEvents(context.Background())
+
+			ta.budget.mu.Lock()
+			used := ta.budget.used
+			ta.budget.mu.Unlock()
+			if used != 0 {
+				t.Errorf("expected an empty budget once the line ended, got %d bytes used", used)
+			}
+			testutil.FatalIfErr(t, ta.Close())
+		})
+	}
+}
+
+func TestDuplicateCollapseWindowQuiet(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	ta, lines, w, dir, cleanup := makeTestTail(t, WithClock(clk), WithDuplicateCollapse(time.Minute, 0))
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "a\na\na\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	ta.WaitForEvents(context.Background())
+
+	// Nothing more is read, but the summary is sent once the window passes.
+	clk.Advance(time.Minute)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "last message repeated 2 times"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match expected:\n%s", diff)
+	}
+}
+
+func TestMaxBytesPerRead(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1001)
+	ta, err := New(lines, w, WithMaxBytesPerRead(10))
+	testutil.FatalIfErr(t, err)
+
+	big := filepath.Join(tmpDir, "big")
+	fb := testutil.TestOpenFile(t, big)
+	defer fb.Close()
+	small := filepath.Join(tmpDir, "small")
+	fs := testutil.TestOpenFile(t, small)
+	defer fs.Close()
+	testutil.FatalIfErr(t, ta.TailPath(big))
+	testutil.FatalIfErr(t, ta.TailPath(small))
+
+	var expected []*logline.LogLine
+	for i := 0; i < 1000; i++ {
+		testutil.WriteString(t, fb, fmt.Sprintf("%04d\n", i))
+		expected = append(expected, &logline.LogLine{Filename: big, Line: fmt.Sprintf("%04d", i)})
+	}
+	testutil.WriteString(t, fs, "live\n")
+	w.InjectUpdate(big)
+	w.InjectUpdate(small)
+
+	result := testutil.CollectLines(t, lines, 1001, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+
+	var bigLines []*logline.LogLine
+	liveAt := -1
+	for i, l := range result {
+		if l.Filename == small {
+			liveAt = i
+			continue
+		}
+		bigLines = append(bigLines, l)
+	}
+	// Lines from the big file are still in order.
+	if diff := testutil.Diff(expected, bigLines); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	// The live line didn't wait for the big file to be read to the end.
+	if liveAt < 0 || liveAt == len(result)-1 {
+		t.Errorf("live line read at %d of %d", liveAt, len(result))
+	}
+}
+
+func TestPathByteRate(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, w, WithClock(clk), WithPathByteRate(logfile, 10))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// awaitThrottled waits until the tailer is waiting for the rate limit.
+	awaitThrottled := func() {
+		t.Helper()
+		deadline := time.Now().Add(collectTimeout)
+		for clk.Timers() == 0 || !ta.Stats().Throttles[logfile].Throttled {
+			if time.Now().After(deadline) {
+				t.Fatalf("not throttled: %v", ta.Stats())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	testutil.WriteString(t, f, "123456789\n123456789\n123456789\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	awaitThrottled()
+
+	clk.Advance(time.Second)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	awaitThrottled()
+
+	// Lifting the limit lets the rest be read on the next wake up.
+	testutil.FatalIfErr(t, ta.SetPathByteRate(logfile, 0))
+	if s := ta.Stats(); len(s.Throttles) != 0 {
+		t.Errorf("expected no throttles, got %v", s.Throttles)
+	}
+	clk.Advance(time.Second)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "123456789"},
+		{Filename: logfile, Line: "123456789"},
+		{Filename: logfile, Line: "123456789"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestGlobalByteRate(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 128)
+	processed := make(chan struct{}, 1)
+	ta, err := New(lines, w, WithGlobalByteRate(8192), WithClock(clk), WithProcessedHook(func(watcher.Event) { processed <- struct{}{} }))
+	testutil.FatalIfErr(t, err)
+
+	// Each file has four times its share of the limit to read.
+	backlog := strings.Repeat(strings.Repeat("x", 63)+"\n", 256)
+	var logfiles []string
+	for _, name := range []string{"a", "b"} {
+		logfile := filepath.Join(tmpDir, name)
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+		testutil.WriteString(t, f, backlog)
+		logfiles = append(logfiles, logfile)
+	}
+	requested, granted := ta.metrics.globalRateRequested.Value(), ta.metrics.globalRateGranted.Value()
+
+	// With nothing else to read, a uses the whole limit.
+	w.InjectUpdate(logfiles[0])
+	<-processed
+	if n := len(testutil.CollectLines(t, lines, 128, collectTimeout)); n != 128 {
+		t.Fatalf("expected 128 lines, got %d", n)
+	}
+	w.InjectUpdate(logfiles[1])
+	<-processed
+	if s := ta.Stats(); !s.Global.Throttled || s.Global.Available != 0 {
+		t.Errorf("expected global limit to be exhausted, got %+v", s.Global)
+	}
+
+	// Once both are waiting, they share it.
+	deadline := time.Now().Add(collectTimeout)
+	for {
+		var waiting int
+		testutil.FatalIfErr(t, ta.inRun(func() error {
+			for _, w := range ta.throttled {
+				if w.timer.Pending() {
+					waiting++
+				}
+			}
+			return nil
+		}))
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected both files to be waiting for the limit, got %d", waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	clk.Advance(time.Second)
+	counts := make(map[string]int)
+	for _, l := range testutil.CollectLines(t, lines, 128, collectTimeout) {
+		counts[l.Filename]++
+	}
+	expected := map[string]int{logfiles[0]: 64, logfiles[1]: 64}
+	if diff := testutil.Diff(expected, counts); diff != "" {
+		t.Errorf("lines per file didn't match:\n%s", diff)
+	}
+	if ta.metrics.globalRateRequested.Value()-requested <= ta.metrics.globalRateGranted.Value()-granted {
+		t.Errorf("expected some requests to be refused")
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestStartPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		policy   StartPolicy
+		expected []string
+	}{
+		{Beginning, []string{"one", "two", "three", "four"}},
+		{End, []string{"four"}},
+		{LastNBytes(6), []string{"three", "four"}},
+		{LastNBytes(8), []string{"three", "four"}},
+		{LastNBytes(100), []string{"one", "two", "three", "four"}},
+	} {
+		t.Run(tc.policy.String(), func(t *testing.T) {
+			ta, lines, w, dir, cleanup := makeTestTail(t)
+			defer cleanup()
+
+			logfile := filepath.Join(dir, "app.log")
+			f := testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.WriteString(t, f, "one\ntwo\nthree\n")
+
+			done := make(chan []*logline.LogLine)
+			go func() {
+				done <- testutil.CollectAllLines(t, lines, collectTimeout)
+			}()
+			testutil.FatalIfErr(t, ta.AddPatternWithPolicy(filepath.Join(dir, "*.log"), tc.policy))
+			testutil.WriteString(t, f, "four\n")
+			w.InjectUpdate(logfile)
+
+			// Files created later are read from the beginning.
+			newfile := filepath.Join(dir, "new.log")
+			nf := testutil.TestOpenFile(t, newfile)
+			defer nf.Close()
+			testutil.WriteString(t, nf, "new\n")
+			w.InjectCreate(newfile)
+			testutil.FatalIfErr(t, ta.Close())
+
+			var expected []*logline.LogLine
+			for _, l := range tc.expected {
+				expected = append(expected, &logline.LogLine{Filename: logfile, Line: l})
+			}
+			expected = append(expected, &logline.LogLine{Filename: newfile, Line: "new"})
+			if diff := testutil.Diff(expected, <-done); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCaughtUpEvent(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "one\ntwo\n")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	events := make(chan FileEvent, 1)
+	ta, err := New(lines, w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.AddPatternWithPolicy(logfile, Beginning))
+
+	expected := FileEvent{Type: CaughtUp, Name: logfile, Pathname: logfile}
+	select {
+	case e := <-events:
+		if diff := testutil.Diff(expected, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("no caught up event")
+	}
+	if s := ta.Stats(); len(s.Backfills) != 0 {
+		t.Errorf("expected no backfills, got %v", s.Backfills)
+	}
+
+	// A file that is already caught up doesn't send another event.
+	testutil.WriteString(t, f, "three\n")
+	w.InjectUpdateAndWait(logfile)
+	testutil.FatalIfErr(t, ta.Close())
+	select {
+	case e := <-events:
+		t.Errorf("unexpected event %v", e)
+	default:
+	}
+	if n := len(testutil.CollectAllLines(t, lines, collectTimeout)); n != 3 {
+		t.Errorf("expected 3 lines, got %d", n)
+	}
+}
+
+func TestDeleteMidRead(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent, 1)
+	ta, err := New(lines, w, WithMaxBytesPerRead(5), WithFileEvents(events), WithFlushOnDelete())
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	var expected []*logline.LogLine
+	for i := 0; i < 100; i++ {
+		testutil.WriteString(t, f, fmt.Sprintf("%04d\n", i))
+		expected = append(expected, &logline.LogLine{Filename: logfile, Line: fmt.Sprintf("%04d", i)})
+	}
+	testutil.WriteString(t, f, "partial")
+	expected = append(expected, &logline.LogLine{Filename: logfile, Line: "partial", Truncated: true})
+	testutil.FatalIfErr(t, f.Close())
+	w.InjectUpdate(logfile)
+
+	// Unlink the file while the tailer is part way through reading it.
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	w.InjectDelete(logfile)
+	result = append(result, testutil.CollectLines(t, lines, len(expected)-1, collectTimeout)...)
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	select {
+	case e := <-events:
+		if diff := testutil.Diff(FileEvent{Type: Deleted, Name: logfile, Pathname: logfile}, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("no deleted event")
+	}
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Errorf("expected no handles, got %d", s.Handles)
+	}
+
+	// A new file at the path is a new generation.
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "new\n")
+	w.InjectCreate(logfile)
+	result = testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+	expected = []*logline.LogLine{{Filename: logfile, Line: "new", Generation: 1}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestNonUTF8Filename(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// A Latin-1 name, which isn't valid UTF-8.
+	logfile := filepath.Join(tmpDir, "caf\xe9.log")
+	f, err := os.Create(logfile)
+	if err != nil {
+		t.Skipf("can't create a file with a name that isn't UTF-8: %s", err)
+	}
+	defer f.Close()
+	safe := filepath.Join(tmpDir, "caf%E9.log")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w)
+	testutil.FatalIfErr(t, err)
+	// The pattern matches the names as they are, both when it's given and
+	// when a file is created.
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.log")))
+	testutil.WriteString(t, f, "line\n")
+	w.InjectUpdate(logfile)
+	created := filepath.Join(tmpDir, "na\xefve.log")
+	g := testutil.TestOpenFile(t, created)
+	defer g.Close()
+	testutil.WriteString(t, g, "new\n")
+	w.InjectCreate(created)
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
+	expected := []*logline.LogLine{
+		{Filename: safe, RawFilename: []byte(logfile), Line: "line"},
+		{Filename: filepath.Join(tmpDir, "na%EFve.log"), RawFilename: []byte(created), Line: "new"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if got := result[0].RawName(); got != logfile {
+		t.Errorf("RawName = %q, expected %q", got, logfile)
+	}
+
+	s := ta.Stats()
+	if name, ok := s.Names[safe]; !ok || name != safe {
+		t.Errorf("expected %q named %q in stats, got %v", safe, safe, s.Names)
+	}
+	if got := s.RawPath(safe); got != logfile {
+		t.Errorf("RawPath(%q) = %q, expected %q", safe, got, logfile)
+	}
+	if got := s.RawPath(tmpDir); got != tmpDir {
+		t.Errorf("RawPath(%q) = %q, expected it unchanged", tmpDir, got)
+	}
+	b, err := json.Marshal(s)
+	testutil.FatalIfErr(t, err)
+	if strings.ContainsRune(string(b), utf8.RuneError) || !utf8.Valid(b) {
+		t.Errorf("stats JSON lost the name: %s", b)
+	}
+	if got := expvarInt(&ta.metrics.lineCount, safe); got != 1 {
+		t.Errorf("expected 1 line counted for %q, got %d", safe, got)
+	}
+	if !strings.Contains(ta.metrics.lineCount.String(), "caf%E9.log") {
+		t.Errorf("line count not keyed by the safe name: %s", ta.metrics.lineCount.String())
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestFollowRenames(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	events := make(chan FileEvent, 10)
+	ta, err := New(lines, w, WithFileEvents(events), WithFollowRenames())
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	rotated := filepath.Join(tmpDir, "log.1")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "one\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// The rename happens part way through a line.
+	testutil.WriteString(t, f, "part")
+	w.InjectUpdateAndWait(logfile)
+	testutil.FatalIfErr(t, os.Rename(logfile, rotated))
+	w.InjectRename(logfile, rotated)
+	for e := range events {
+		if e.Type == CaughtUp {
+			continue
+		}
+		if diff := testutil.Diff(FileEvent{Type: Renamed, Name: rotated, Pathname: rotated, Previous: logfile}, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+		break
+	}
+
+	// Late writes to the renamed file are read at its new path.
+	testutil.WriteString(t, f, "ial\n")
+	w.InjectUpdate(rotated)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+
+	// A new file at the old path is a new generation.
+	g := testutil.TestOpenFile(t, logfile)
+	defer g.Close()
+	testutil.WriteString(t, g, "new\n")
+	w.InjectCreate(logfile)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	if s := ta.Stats(); s.Handles != 2 {
+		t.Errorf("expected both files to be tailed, got %d handles", s.Handles)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "one"},
+		{Filename: rotated, Line: "partial"},
+		{Filename: logfile, Line: "new", Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestRenameWithoutFollowRenames(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	events := make(chan FileEvent, 1)
+	ta, err := New(lines, w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	rotated := filepath.Join(tmpDir, "log.1")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "one\n")
+	testutil.FatalIfErr(t, os.Rename(logfile, rotated))
+	w.InjectRename(logfile, rotated)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	if diff := testutil.Diff([]*logline.LogLine{{Filename: logfile, Line: "one"}}, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	select {
+	case e := <-events:
+		if diff := testutil.Diff(FileEvent{Type: Deleted, Name: logfile, Pathname: logfile}, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("no deleted event")
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Errorf("expected no handles, got %d", s.Handles)
+	}
+	for _, p := range w.WatchedPaths() {
+		if p.Pathname == rotated {
+			t.Errorf("renamed file is still watched: %v", w.WatchedPaths())
+		}
+	}
+}
+
+func TestTailLatest(t *testing.T) {
+	events := make(chan FileEvent, 2)
+	ta, lines, w, dir, cleanup := makeTestTail(t, WithFileEvents(events))
+	defer cleanup()
+
+	// openDay creates the log file in the directory for day.
+	openDay := func(day string) (string, *os.File) {
+		t.Helper()
+		testutil.FatalIfErr(t, os.Mkdir(filepath.Join(dir, day), 0700))
+		logfile := filepath.Join(dir, day, "app.log")
+		return logfile, testutil.TestOpenFile(t, logfile)
+	}
+	_, f1 := openDay("2024-05-31")
+	defer f1.Close()
+	day2, f2 := openDay("2024-06-01")
+	defer f2.Close()
+	testutil.FatalIfErr(t, ta.TailLatest(filepath.Join(dir, "*", "app.log"), LexicalOrder, 2))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected only the latest file to be tailed, got %d handles", s.Handles)
+	}
+
+	testutil.WriteString(t, f2, "today\n")
+	w.InjectUpdate(day2)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// Lines written to today's file before tomorrow's appears are still read.
+	testutil.WriteString(t, f2, "late\n")
+	testutil.FatalIfErr(t, os.Mkdir(filepath.Join(dir, "2024-06-02"), 0700))
+	day3 := filepath.Join(dir, "2024-06-02", "app.log")
+	f3 := testutil.TestOpenFile(t, day3)
+	defer f3.Close()
+	testutil.WriteString(t, f3, "tomorrow\n")
+	w.InjectCreate(filepath.Join(dir, "2024-06-02"))
+	w.InjectCreate(day3)
+	result = append(result, testutil.CollectLines(t, lines, 2, collectTimeout)...)
+	// The read of tomorrow's file reaches its end before the Tailer is
+	// closed, so it's caught up.
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+
+	expected := []*logline.LogLine{
+		{Filename: day2, Line: "today"},
+		{Filename: day2, Line: "late"},
+		{Filename: day3, Line: "tomorrow"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	close(events)
+	var got []FileEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	expectedEvents := []FileEvent{
+		{Type: Rotated, Name: day3, Pathname: day3, Previous: day2},
+		{Type: CaughtUp, Name: day3, Pathname: day3},
+	}
+	if diff := testutil.Diff(expectedEvents, got); diff != "" {
+		t.Errorf("events didn't match:\n%s", diff)
+	}
+
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected only the latest file to be tailed, got %d handles", s.Handles)
+	}
+	var dirs []string
+	for _, p := range w.WatchedPaths() {
+		if p.IsDir && p.Pathname != dir {
+			dirs = append(dirs, filepath.Base(p.Pathname))
+		}
+	}
+	if diff := testutil.Diff([]string{"2024-06-01", "2024-06-02"}, dirs); diff != "" {
+		t.Errorf("watched directories didn't match:\n%s", diff)
+	}
+}
+
+func TestTailSameFileTwice(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	link := filepath.Join(dir, "link")
+	testutil.FatalIfErr(t, os.Symlink(logfile, link))
+
+	pattern := filepath.Join(dir, "l*")
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	if _, ok := ta.TailPath(link).(*ErrAlreadyTailed); !ok {
+		t.Error("expected an ErrAlreadyTailed for a link to a path already tailed")
+	}
+	testutil.FatalIfErr(t, ta.TailPattern(pattern))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+
+	testutil.WriteString(t, f, "once\n")
+	w.InjectUpdate(logfile)
+	w.InjectUpdate(link)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// The pattern still refers to the file.
+	testutil.FatalIfErr(t, ta.Untail(link))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+	testutil.FatalIfErr(t, ta.RemovePattern(pattern))
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Errorf("expected no handles, got %d", s.Handles)
+	}
+	testutil.WriteString(t, f, "untailed\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
+
+	expected := []*logline.LogLine{{Filename: logfile, Line: "once"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestPatternThroughSymlinkLoop(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	// A link back at its own directory, so the file can be reached through
+	// any number of them.
+	testutil.FatalIfErr(t, os.Symlink(dir, filepath.Join(dir, "a")))
+
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "log")))
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "*", "log")))
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(dir, "*", "*", "*", "log")))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+
+	testutil.WriteString(t, f, "once\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "once"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestUntailDropsQueuedEvents(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	lines := make(chan *logline.LogLine, 1000)
+	w := watcher.NewFakeWatcher()
+	clk := testutil.NewFakeClock(time.Now())
+	ta, err := New(lines, w, WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	// New files matching the pattern are tailed, so an event for the file
+	// handled after it's untailed would tail it again.
+	testutil.FatalIfErr(t, ta.AddPattern(filepath.Join(tmpDir, "*")))
+	go func() {
+		for range lines {
+		}
+	}()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if _, err := f.WriteString("line\n"); err != nil {
+				t.Error(err)
+				return
+			}
+			w.InjectCreate(logfile)
+		}
+	}()
+	for i := 0; i < 200; i++ {
+		// TailPath reads the file as it opens it, so it's called in run to
+		// not race with the events for the file.
+		testutil.FatalIfErr(t, ta.inRun(func() error { return ta.TailPath(logfile) }))
+		testutil.FatalIfErr(t, ta.Untail(logfile))
+	}
+	close(done)
+	wg.Wait()
+	testutil.FatalIfErr(t, w.AwaitPending(collectTimeout))
+	for i := 0; i < 3; i++ {
+		w.InjectCreateAndWait(logfile)
+	}
+	// The request is handled once the events received before it have been.
+	if err := ta.ForceRead(logfile); err == nil {
+		t.Error("expected the untailed file not to be tailed again")
+	}
+	if dropped := ta.metrics.untailedDropped.Value(); dropped < 3 {
+		t.Errorf("expected at least 3 events dropped, got %d", dropped)
+	}
+
+	// Once the tombstone expires, the file is handled as usual.
+	clk.Advance(tombstoneTTL + time.Second)
+	testutil.FatalIfErr(t, ta.Gc())
+	ta.tombstonesMu.Lock()
+	if len(ta.tombstones) != 0 {
+		t.Errorf("expected no tombstones, got %v", ta.tombstones)
+	}
+	ta.tombstonesMu.Unlock()
+	w.InjectCreateAndWait(logfile)
+	if err := ta.ForceRead(logfile); err != nil {
+		t.Errorf("expected the pattern to tail the file again: %s", err)
+	}
+
+	// A new file at the path is handled as usual too.
+	testutil.FatalIfErr(t, ta.RemovePattern(filepath.Join(tmpDir, "*")))
+	testutil.FatalIfErr(t, ta.AddPattern(filepath.Join(tmpDir, "*")))
+	testutil.FatalIfErr(t, os.Remove(logfile))
+	g := testutil.TestOpenFile(t, logfile)
+	defer g.Close()
+	w.InjectCreateAndWait(logfile)
+	if err := ta.ForceRead(logfile); err != nil {
+		t.Errorf("expected the new file to be tailed: %s", err)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestSetOptionWhileRunning(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	lines := make(chan *logline.LogLine, 1000)
+	w := watcher.NewFakeWatcher()
+	ta, err := New(lines, w, WithSamplingSeed(0))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	for _, tc := range []struct {
+		name    string
+		options []Option
+		index   int
+	}{
+		{"static", []Option{WithFileEvents(make(chan FileEvent))}, 0},
+		{"static after dynamic", []Option{WithLogLevel(log.InfoLevel), WithClock(testutil.NewFakeClock(time.Now()))}, 1},
+	} {
+		err := ta.SetOption(tc.options...)
+		var static *ErrStaticOption
+		if !errors.As(err, &static) || static.Index != tc.index {
+			t.Errorf("%s: expected static option %d, got %v", tc.name, tc.index, err)
+		}
+	}
+	if err := ta.SetOption(WithGlobalByteRate(100)); err == nil {
+		t.Error("expected an error adding a global byte rate")
+	}
+	if err := ta.SetOption(WithMaxBytesPerRead(0)); err == nil {
+		t.Error("expected an error for an invalid option")
+	}
+
+	// Options are changed while lines are read.
+	const writes = 200
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				testutil.FatalIfErr(t, ta.SetOption(
+					WithDefaultByteRate(0),
+					WithPathByteRate(logfile, 0),
+					WithMaxBytesPerRead(int64(1+i%64)),
+					WithLagWarning(int64(i), time.Duration(i)*time.Second),
+					WithSampling(1),
+					WithPathSampling(logfile, 1),
+					WithLogLevel(log.InfoLevel),
+					WithExpiryInterval(time.Hour),
+				))
+			}
+		}(i)
+	}
+	for i := 0; i < writes; i++ {
+		testutil.WriteString(t, f, fmt.Sprintf("%d\n", i))
+		w.InjectUpdate(logfile)
+	}
+	got := testutil.CollectLines(t, lines, writes, collectTimeout)
+	close(done)
+	wg.Wait()
+	if len(got) != writes {
+		t.Fatalf("expected %d lines, got %d", writes, len(got))
+	}
+
+	// A changed setting applies from the next read.
+	testutil.FatalIfErr(t, ta.SetOption(WithMaxBytesPerRead(1<<20), WithPathSampling(logfile, 0.5)))
+	testutil.WriteString(t, f, "0\n1\n2\n3\n")
+	w.InjectUpdate(logfile)
+	var sampled []string
+	for _, l := range testutil.CollectLines(t, lines, 2, collectTimeout) {
+		sampled = append(sampled, l.Line)
+	}
+	if diff := testutil.Diff([]string{"0", "2"}, sampled); diff != "" {
+		t.Errorf("sampled lines didn't match:\n%s", diff)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestTailPathAlreadyTailed(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	testutil.WriteString(t, f, "a\nb\n")
+	f.Close()
+	key, err := canonicalPath(logfile)
+	testutil.FatalIfErr(t, err)
+
+	for _, tc := range []struct {
+		name   string
+		buffer int
+		opts   []Option
+	}{
+		{"opened", 2, nil},
+		// The worker is held up sending the first line, so the second call
+		// arrives while the file is pending.
+		{"backfilling", 0, []Option{WithBackfillConcurrency(1)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := make(chan *logline.LogLine, tc.buffer)
+			ta, err := New(lines, watcher.NewFakeWatcher(), tc.opts...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+
+			err = ta.TailPath(filepath.Join(tmpDir, ".", "log"))
+			expected := &ErrAlreadyTailed{Pathname: filepath.Join(tmpDir, ".", "log"), Key: key}
+			if diff := testutil.Diff(expected, err); diff != "" {
+				t.Errorf("error didn't match:\n%s", diff)
+			}
+			if s := ta.Stats(); s.Handles > 1 {
+				t.Errorf("expected at most 1 handle, got %d", s.Handles)
+			}
+			go func() {
+				for range lines {
+				}
+			}()
+			testutil.FatalIfErr(t, ta.Close())
+		})
+	}
+}
+
+func TestTailPathReplace(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "old\n")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 5)
+	ta, err := New(lines, w, WithReplaceOnRetail())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.WriteString(t, f, "new\n")
+	w.InjectUpdateAndWait(logfile)
+
+	// Reopened and read from the new policy.
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+	// Only the new handle reads this.
+	testutil.WriteString(t, f, "more\n")
+	w.InjectUpdateAndWait(logfile)
+	testutil.FatalIfErr(t, ta.Close())
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+
+	var got []string
+	for _, l := range result {
+		got = append(got, l.Line)
+	}
+	if diff := testutil.Diff([]string{"new", "old", "new", "more"}, got); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailPathReplaceDuringBackfill(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\n")
+
+	// Nothing is received yet, so the worker is held up sending a line.
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithReplaceOnRetail(), WithBackfillConcurrency(1))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	deadline := time.Now().Add(collectTimeout)
+	for s := ta.Stats(); s.BackfillActive != 1; s = ta.Stats() {
+		if time.Now().After(deadline) {
+			t.Fatalf("backfill didn't start: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	// The first backfill is finished, then the file is read again.
+	result := testutil.CollectLines(t, lines, 4, collectTimeout)
+
+	for s := ta.Stats(); s.Handles != 1 || s.BackfillQueued != 0 || s.BackfillActive != 0; s = ta.Stats() {
+		if s.Handles > 1 {
+			t.Fatalf("expected at most 1 handle, got %+v", s)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("backfill didn't finish: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan []*logline.LogLine)
+	go func() {
+		done <- testutil.CollectAllLines(t, lines, collectTimeout)
+	}()
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, <-done...)
+
+	var got []string
+	for _, l := range result {
+		got = append(got, l.Line)
+	}
+	if diff := testutil.Diff([]string{"a", "b", "a", "b"}, got); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestTailHardLink(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "app.log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	link := filepath.Join(dir, "app-current.log")
+	testutil.FatalIfErr(t, os.Link(logfile, link))
+
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.FatalIfErr(t, ta.TailPath(link))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+	testutil.WriteString(t, f, "once\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// After app.log is rotated, the link is to a different file.
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+	nf := testutil.TestOpenFile(t, logfile)
+	defer nf.Close()
+	w.InjectCreate(logfile)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+	if s := ta.Stats(); s.Handles != 2 {
+		t.Fatalf("link not tailed after rotation: %+v", s)
+	}
+	testutil.WriteString(t, f, "old\n")
+	testutil.WriteString(t, nf, "new\n")
+	w.InjectUpdate(link)
+	w.InjectUpdate(logfile)
+	result = append(result, testutil.CollectLines(t, lines, 2, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{
+		{Filename: logfile, Line: "once"},
+		{Filename: link, Line: "old"},
+		{Filename: logfile, Line: "new", Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestFilenameBase(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	testutil.FatalIfErr(t, os.Mkdir(filepath.Join(tmpDir, "nginx"), 0700))
+	logfile := filepath.Join(tmpDir, "nginx", "access.log")
+	f := testutil.TestOpenFile(t, logfile)
+	outside, rmOutside := testutil.TestTempDir(t)
+	defer rmOutside()
+	other := filepath.Join(outside, "other.log")
+	of := testutil.TestOpenFile(t, other)
+	defer of.Close()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, w, WithFilenameBase(tmpDir))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	testutil.FatalIfErr(t, ta.TailPath(other))
+
+	testutil.WriteString(t, f, "1\n")
+	w.InjectUpdate(logfile)
+	testutil.WriteString(t, of, "outside\n")
+	w.InjectUpdate(other)
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
+
+	// The new generation is reported under the same name.
+	testutil.FatalIfErr(t, f.Close())
+	testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+	f = testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	w.InjectCreate(logfile)
+	testutil.WriteString(t, f, "2\n")
+	w.InjectUpdate(logfile)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+
+	names := ta.Stats().Names
+	testutil.FatalIfErr(t, ta.Close())
+
+	sort.Slice(result[:2], func(i, j int) bool { return result[i].Line < result[j].Line })
+	expected := []*logline.LogLine{
+		{Filename: "nginx/access.log", Line: "1"},
+		{Filename: other, Line: "outside"},
+		{Filename: "nginx/access.log", Line: "2", Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	expectedNames := map[string]string{logfile: "nginx/access.log", other: other}
+	if diff := testutil.Diff(expectedNames, names); diff != "" {
+		t.Errorf("names didn't match:\n%s", diff)
+	}
+}
+
+func TestResolveSymlinks(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	dir, err := filepath.EvalSymlinks(tmpDir)
+	testutil.FatalIfErr(t, err)
+
+	first := filepath.Join(dir, "0.log")
+	f := testutil.TestOpenFile(t, first)
+	defer f.Close()
+	link := filepath.Join(dir, "x.log")
+	testutil.FatalIfErr(t, os.Symlink(first, link))
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, w, WithResolveSymlinks())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(link))
+
+	testutil.WriteString(t, f, "1\n")
+	w.InjectUpdate(link)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// Pointing the link at a new file is a rotation.  The rest of the old
+	// file is still reported under its name.
+	testutil.WriteString(t, f, "2\n")
+	second := filepath.Join(dir, "1.log")
+	nf := testutil.TestOpenFile(t, second)
+	defer nf.Close()
+	testutil.WriteString(t, nf, "3\n")
+	testutil.FatalIfErr(t, os.Symlink(second, link+".new"))
+	testutil.FatalIfErr(t, os.Rename(link+".new", link))
+	w.InjectUpdate(link)
+	result = append(result, testutil.CollectLines(t, lines, 2, collectTimeout)...)
+
+	testutil.FatalIfErr(t, ta.Close())
+	names := ta.Stats().Names
+
+	expected := []*logline.LogLine{
+		{Filename: first, Line: "1"},
+		{Filename: first, Line: "2"},
+		{Filename: second, Line: "3", Generation: 1},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if diff := testutil.Diff(map[string]string{second: second}, names); diff != "" {
+		t.Errorf("names didn't match:\n%s", diff)
+	}
+}
+
+// kubeletPod lays out the logs of a pod on a Kubernetes node under root, as
+// the kubelet does.
+type kubeletPod struct {
+	t                    *testing.T
+	root                 string
+	namespace, name, uid string
+}
+
+// start writes the log of a container of the pod after restarts restarts,
+// and links to it from the containers directory under the name for the
+// container with ID id, returning the link and the log.
+func (p kubeletPod) start(container, id string, restarts int) (string, *os.File) {
+	dir := filepath.Join(p.root, "pods", p.namespace+"_"+p.name+"_"+p.uid, container)
+	testutil.FatalIfErr(p.t, os.MkdirAll(dir, 0700))
+	f := testutil.TestOpenFile(p.t, filepath.Join(dir, fmt.Sprintf("%d.log", restarts)))
+	link := filepath.Join(p.root, "containers", p.name+"_"+p.namespace+"_"+container+"-"+id+".log")
+	// Replaced in one go, as the kubelet does.
+	testutil.FatalIfErr(p.t, os.Symlink(f.Name(), link+".tmp"))
+	testutil.FatalIfErr(p.t, os.Rename(link+".tmp", link))
+	return link, f
+}
+
+func TestKubernetesContainerLogs(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	testutil.FatalIfErr(t, os.Mkdir(filepath.Join(tmpDir, "containers"), 0700))
+	pod := kubeletPod{t, tmpDir, "shop", "web-7d4b9c-x2z8q", "0f1e2d3c-4b5a-6978-8a9b-0c1d2e3f4a5b"}
+	id1 := strings.Repeat("a1", 32)
+	id2 := strings.Repeat("b2", 32)
+	link, f := pod.start("nginx", id1, 0)
+	defer f.Close()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 10)
+	events := make(chan FileEvent, 10)
+	ta, err := New(lines, w, WithKubernetesLabels(), WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "containers", "*.log")))
+
+	testutil.WriteString(t, f, "first\n")
+	w.InjectUpdate(link)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// The container restarts, and the link is pointed at its new log.  The
+	// rest of the old log is read first.
+	testutil.WriteString(t, f, "last\n")
+	_, restarted := pod.start("nginx", id1, 1)
+	defer restarted.Close()
+	testutil.WriteString(t, restarted, "restarted\n")
+	w.InjectCreate(link)
+	result = append(result, testutil.CollectLines(t, lines, 2, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+
+	// The kubelet links to a restarted container under its new ID, and
+	// removes the old link.
+	newLink, again := pod.start("nginx", id2, 2)
+	defer again.Close()
+	testutil.WriteString(t, again, "again\n")
+	w.InjectCreate(newLink)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, os.Remove(link))
+	w.InjectDelete(link)
+	timeout := time.After(collectTimeout)
+	for deleted := false; !deleted; {
+		select {
+		case e := <-events:
+			deleted = e.Type == Deleted && e.Pathname == link
+		case <-timeout:
+			t.Fatal("timed out waiting for the old link to be deleted")
+		}
+	}
+	if s := ta.Stats(); s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	labels := func(id string) map[string]string {
+		return map[string]string{
+			KubernetesNamespace:   "shop",
+			KubernetesPod:         "web-7d4b9c-x2z8q",
+			KubernetesContainer:   "nginx",
+			KubernetesContainerID: id,
+		}
+	}
+	expected := []*logline.LogLine{
+		{Filename: link, Line: "first", Labels: labels(id1)},
+		{Filename: link, Line: "last", Labels: labels(id1)},
+		{Filename: link, Line: "restarted", Generation: 1, Labels: labels(id1)},
+		{Filename: newLink, Line: "again", Labels: labels(id2)},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestKubernetesLabels(t *testing.T) {
+	id := strings.Repeat("0123456789abcdef", 4)
+	for _, tc := range []struct {
+		pathname string
+		expected map[string]string
+	}{
+		{"/var/log/containers/web-7d4b9c-x2z8q_shop_nginx-" + id + ".log", map[string]string{
+			KubernetesPod: "web-7d4b9c-x2z8q", KubernetesNamespace: "shop", KubernetesContainer: "nginx", KubernetesContainerID: id,
+		}},
+		{"/var/log/containers/coredns-5d78c9869d-abcde_kube-system_coredns-" + id + ".log", map[string]string{
+			KubernetesPod: "coredns-5d78c9869d-abcde", KubernetesNamespace: "kube-system", KubernetesContainer: "coredns", KubernetesContainerID: id,
+		}},
+		{"/var/log/pods/shop_web-7d4b9c-x2z8q_0f1e2d3c-4b5a-6978-8a9b-0c1d2e3f4a5b/nginx/3.log", map[string]string{
+			KubernetesNamespace: "shop", KubernetesPod: "web-7d4b9c-x2z8q", KubernetesPodUID: "0f1e2d3c-4b5a-6978-8a9b-0c1d2e3f4a5b", KubernetesContainer: "nginx",
+		}},
+		{"/var/log/containers/web_shop_nginx.log", nil},
+		{"/var/log/containers/web_shop_nginx-notanid.log", nil},
+		{"/var/log/containers/web_shop-" + id + ".log", nil},
+		{"/var/log/pods/shop_web/nginx/0.log", nil},
+		{"/var/log/pods/shop_web_uid/nginx/current.log", nil},
+		{"/var/log/syslog", nil},
+	} {
+		labels, ok := KubernetesLabels(tc.pathname)
+		if ok != (tc.expected != nil) {
+			t.Errorf("%s: expected ok to be %v", tc.pathname, tc.expected != nil)
+		}
+		if diff := testutil.Diff(tc.expected, labels); diff != "" {
+			t.Errorf("%s: labels didn't match:\n%s", tc.pathname, diff)
+		}
+	}
+}
+
+func TestFileReplacedByDirectory(t *testing.T) {
+	// awaitEvent waits for an event of type typ, after any others.
+	awaitEvent := func(t *testing.T, events <-chan FileEvent, typ FileEventType) FileEvent {
+		t.Helper()
+		timeout := time.After(collectTimeout)
+		for {
+			select {
+			case e := <-events:
+				if e.Type == typ {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("timed out waiting for a %v event", typ)
+			}
+		}
+	}
+	for _, tc := range []struct {
+		name    string
+		deleted bool // The deletion of the file is seen before the directory
+	}{
+		{"replaced mid-tail", false},
+		{"deleted first", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			events := make(chan FileEvent, 10)
+			ta, lines, w, dir, cleanup := makeTestTail(t, WithFileEvents(events))
+			defer cleanup()
+			logfile := filepath.Join(dir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			testutil.FatalIfErr(t, ta.TailPath(logfile))
+			testutil.WriteString(t, f, "1\n")
+			w.InjectUpdate(logfile)
+			result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+			testutil.WriteString(t, f, "2\n")
+			testutil.FatalIfErr(t, f.Close())
+			testutil.FatalIfErr(t, os.Remove(logfile))
+			if tc.deleted {
+				w.InjectDelete(logfile)
+				result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+			}
+			testutil.FatalIfErr(t, os.Mkdir(logfile, 0700))
+			if tc.deleted {
+				w.InjectCreate(logfile)
+			} else {
+				w.InjectUpdate(logfile)
+				result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+			}
+			e := awaitEvent(t, events, WrongType)
+			if nerr, ok := e.Err.(*ErrNotRegularFile); !ok || e.Pathname != logfile || !nerr.Mode.IsDir() {
+				t.Errorf("unexpected event %+v", e)
+			}
+			// Further events on the directory are dropped, rather than failing.
+			w.InjectCreate(logfile)
+			testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+			s := ta.Stats()
+			if diff := testutil.Diff(map[string]os.FileMode{logfile: os.ModeDir}, s.WrongType); diff != "" {
+				t.Errorf("wrong type didn't match:\n%s", diff)
+			}
+			if s.Handles != 0 {
+				t.Errorf("expected no handles, got %d", s.Handles)
+			}
+			if got := expvarInt(&ta.metrics.wrongType, logfile); got != 1 {
+				t.Errorf("expected 1 wrong type, got %d", got)
+			}
+
+			// A file again, which is read from its start.
+			testutil.FatalIfErr(t, os.Remove(logfile))
+			f = testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.WriteString(t, f, "3\n")
+			w.InjectCreate(logfile)
+			result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+			if s := ta.Stats(); s.WrongType != nil || s.Handles != 1 {
+				t.Errorf("expected the file to be tailed again, got %+v", s)
+			}
+			testutil.FatalIfErr(t, ta.Close())
+
+			expected := []*logline.LogLine{
+				{Filename: logfile, Line: "1"},
+				{Filename: logfile, Line: "2"},
+				{Filename: logfile, Line: "3", Generation: 1},
+			}
+			if diff := testutil.Diff(expected, result); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("tailed as a directory", func(t *testing.T) {
+		ta, lines, w, dir, cleanup := makeTestTail(t, WithSpecialFiles())
+		defer cleanup()
+		logfile := filepath.Join(dir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+		testutil.FatalIfErr(t, f.Close())
+		testutil.FatalIfErr(t, os.Remove(logfile))
+		testutil.FatalIfErr(t, os.Mkdir(logfile, 0700))
+		w.InjectUpdate(logfile)
+		testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+
+		inner := filepath.Join(logfile, "inner")
+		g := testutil.TestOpenFile(t, inner)
+		defer g.Close()
+		testutil.WriteString(t, g, "inside\n")
+		w.InjectCreate(inner)
+		result := testutil.CollectLines(t, lines, 1, collectTimeout)
+		if s := ta.Stats(); s.WrongType != nil {
+			t.Errorf("expected no wrong types, got %v", s.WrongType)
+		}
+		testutil.FatalIfErr(t, ta.Close())
+		expected := []*logline.LogLine{{Filename: inner, Line: "inside"}}
+		if diff := testutil.Diff(expected, result); diff != "" {
+			t.Errorf("result didn't match:\n%s", diff)
+		}
+	})
+}
+
+func TestForceRead(t *testing.T) {
+	ta, lines, _, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// No event is injected for the write.
+	testutil.WriteString(t, f, "forced\n")
+	testutil.FatalIfErr(t, ta.ForceRead(logfile))
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	if err := ta.ForceRead(filepath.Join(dir, "unknown")); err == nil {
+		t.Error("expected an error for an unknown path")
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	if err := ta.ForceRead(logfile); err == nil {
+		t.Error("expected an error after Close")
+	}
+
+	expected := []*logline.LogLine{{Filename: logfile, Line: "forced"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestReopenAll(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 5)
+	events := make(chan FileEvent, 3)
+	ta, err := New(lines, w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+
+	same := filepath.Join(tmpDir, "same")
+	fs := testutil.TestOpenFile(t, same)
+	defer fs.Close()
+	rotated := filepath.Join(tmpDir, "rotated")
+	fr := testutil.TestOpenFile(t, rotated)
+	defer fr.Close()
+	gone := filepath.Join(tmpDir, "gone")
+	fg := testutil.TestOpenFile(t, gone)
+	defer fg.Close()
+	for _, p := range []string{same, rotated, gone} {
+		testutil.FatalIfErr(t, ta.TailPath(p))
+	}
+
+	// None of these changes are reported by the watcher.
+	testutil.WriteString(t, fs, "same\n")
+	testutil.WriteString(t, fr, "old\n")
+	testutil.FatalIfErr(t, os.Rename(rotated, rotated+".1"))
+	nf := testutil.TestOpenFile(t, rotated)
+	defer nf.Close()
+	testutil.WriteString(t, nf, "new\n")
+	testutil.WriteString(t, fg, "last\n")
+	testutil.FatalIfErr(t, os.Remove(gone))
+
+	testutil.FatalIfErr(t, ta.ReopenAll())
+	result := testutil.CollectLines(t, lines, 4, collectTimeout)
+	if s := ta.Stats(); s.Handles != 2 {
+		t.Errorf("expected 2 handles, got %d", s.Handles)
+	}
+
+	// The file that couldn't be reopened is tailed again when it's created.
+	fg = testutil.TestOpenFile(t, gone)
+	defer fg.Close()
+	testutil.WriteString(t, fg, "again\n")
+	w.InjectCreate(gone)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.Close())
+	close(events)
+
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Filename < result[j].Filename })
+	expected := []*logline.LogLine{
+		{Filename: gone, Line: "last"},
+		{Filename: gone, Line: "again", Generation: 1},
+		{Filename: rotated, Line: "old"},
+		{Filename: rotated, Line: "new", Generation: 1},
+		{Filename: same, Line: "same"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	var got []FileEvent
+	for e := range events {
+		got = append(got, e)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Type < got[j].Type })
+	expectedEvents := []FileEvent{
+		{Type: CaughtUp, Name: gone, Pathname: gone},
+		{Type: Deleted, Name: gone, Pathname: gone},
+		{Type: Rotated, Name: rotated, Pathname: rotated, Previous: rotated},
+	}
+	if diff := testutil.Diff(expectedEvents, got); diff != "" {
+		t.Errorf("events didn't match:\n%s", diff)
+	}
+}
+
+func TestTailerHealth(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w, err := watcher.NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w)
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	testutil.FatalIfErr(t, ta.Healthy())
+	h := ta.Health()
+	if !h.Running || h.Handles != 1 || h.Watcher == nil || !h.Watcher.FsnotifyAlive {
+		t.Errorf("unexpected health of a running tailer: %+v", h)
+	}
+
+	testutil.FatalIfErr(t, ta.Close())
+	if err := ta.Healthy(); err == nil {
+		t.Error("expected an error from Healthy after Close")
+	}
+	if h := ta.Health(); h.Running {
+		t.Error("expected tailer not to be running after Close")
+	}
+}
+
+func TestTailerHealthWatcherIdle(t *testing.T) {
+	clk := testutil.NewFakeClock(time.Now())
+	w, err := watcher.NewLogWatcher(time.Minute, false, watcher.WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	ta, err := New(make(chan *logline.LogLine), w, WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+
+	// Polling started when the watcher was created, and the first tick is
+	// yet to come.
+	clk.Advance(30 * time.Second)
+	if h := ta.Health(); h.WatcherIdle != 30*time.Second {
+		t.Errorf("expected the watcher to have been idle for 30s, got %+v", h)
+	}
+}
+
+func TestTailPathRejectedCleanup(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	ta, err := New(make(chan *logline.LogLine), w)
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+
+	// The path is watched while it doesn't exist, then turns out to be a directory.
+	pathname := filepath.Join(tmpDir, "log")
+	testutil.FatalIfErr(t, ta.TailPath(pathname))
+	testutil.FatalIfErr(t, os.Mkdir(pathname, 0700))
+	if _, ok := ta.TailPath(pathname).(*ErrNotRegularFile); !ok {
+		t.Fatal("expected an ErrNotRegularFile")
+	}
+	expected := []watcher.WatchedPath{{Pathname: tmpDir, IsDir: true}}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+}
+
+func TestWatchMode(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	polled := filepath.Join(tmpDir, "nfs")
+	notified := filepath.Join(tmpDir, "local")
+	testutil.FatalIfErr(t, os.Mkdir(polled, 0700))
+	testutil.FatalIfErr(t, os.Mkdir(notified, 0700))
+	logfile := filepath.Join(polled, "log")
+	testutil.TestOpenFile(t, logfile).Close()
+	match := filepath.Join(notified, "a.log")
+	testutil.TestOpenFile(t, match).Close()
+
+	w := watcher.NewFakeWatcher()
+	ta, err := New(make(chan *logline.LogLine, 10), w)
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile, WithWatchMode(watcher.ModePoll)))
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(notified, "*.log"), WithWatchMode(watcher.ModeFsnotify)))
+
+	// Files created later that match the pattern get its mode too.
+	later := filepath.Join(notified, "b.log")
+	testutil.TestOpenFile(t, later).Close()
+	w.InjectCreateAndWait(later)
+	testutil.FatalIfErr(t, ta.ForceRead(later))
+
+	expected := []watcher.WatchedPath{
+		{Pathname: notified, IsDir: true, Mode: watcher.ModeFsnotify},
+		{Pathname: match, Mode: watcher.ModeFsnotify},
+		{Pathname: later, Mode: watcher.ModeFsnotify},
+		{Pathname: polled, IsDir: true, Mode: watcher.ModePoll},
+		{Pathname: logfile, Mode: watcher.ModePoll},
+	}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+
+	if err := ta.TailPath(logfile, WithWatchMode(watcher.WatchMode(-1))); err == nil {
+		t.Error("expected an error for an invalid watch mode")
+	}
+	if err := ta.AddPattern(filepath.Join(tmpDir, "*"), WithArchiveBackfill(0, 1)); err == nil {
+		t.Error("expected an error for archive backfill on AddPattern")
+	}
+}
+
+func TestArchiveSkip(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "app.log")
+	rotated := filepath.Join(tmpDir, "app.log.1")
+	compressed := filepath.Join(tmpDir, "app.log.2.gz")
+	for _, p := range []string{logfile, rotated, compressed} {
+		testutil.TestOpenFile(t, p).Close()
+	}
+
+	w := watcher.NewFakeWatcher()
+	ta, err := New(make(chan *logline.LogLine, 10), w)
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "app.log*")))
+	if !ta.hasHandle(logfile) || ta.hasHandle(rotated) || ta.hasHandle(compressed) {
+		t.Fatal("expected only the live log to be tailed")
+	}
+
+	// Archives created later are skipped too.
+	later := filepath.Join(tmpDir, "app.log.3.zst")
+	testutil.TestOpenFile(t, later).Close()
+	w.InjectCreateAndWait(later)
+	testutil.FatalIfErr(t, ta.inRun(func() error { return nil }))
+	if ta.hasHandle(later) {
+		t.Errorf("expected %s to be skipped", later)
+	}
+	expected := []string{rotated, compressed, later}
+	if diff := testutil.Diff(expected, ta.Stats().SkippedArchives); diff != "" {
+		t.Errorf("skipped archives didn't match:\n%s", diff)
+	}
+
+	// One renamed to a name that doesn't look like an archive is tailed.
+	renamed := filepath.Join(tmpDir, "app.log.old")
+	testutil.FatalIfErr(t, os.Rename(later, renamed))
+	w.InjectRename(later, renamed)
+	testutil.FatalIfErr(t, w.AwaitPending(collectTimeout))
+	testutil.FatalIfErr(t, ta.inRun(func() error { return nil }))
+	if !ta.hasHandle(renamed) {
+		t.Errorf("expected %s to be tailed", renamed)
+	}
+	expected = []string{rotated, compressed}
+	if diff := testutil.Diff(expected, ta.Stats().SkippedArchives); diff != "" {
+		t.Errorf("skipped archives didn't match:\n%s", diff)
+	}
+
+	// A pattern can tail every match.
+	other := filepath.Join(tmpDir, "other")
+	testutil.FatalIfErr(t, os.Mkdir(other, 0700))
+	backup := filepath.Join(other, "db.log.1")
+	testutil.TestOpenFile(t, backup).Close()
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(other, "*"), WithArchiveSkip()))
+	if !ta.hasHandle(backup) {
+		t.Errorf("expected %s to be tailed", backup)
+	}
+
+	// So does a pattern that's just the name of an archive.
+	testutil.FatalIfErr(t, ta.TailPattern(rotated))
+	if !ta.hasHandle(rotated) {
+		t.Errorf("expected %s to be tailed", rotated)
+	}
+	if diff := testutil.Diff([]string{compressed}, ta.Stats().SkippedArchives); diff != "" {
+		t.Errorf("skipped archives didn't match:\n%s", diff)
+	}
+
+	if err := ta.TailPath(logfile, WithArchiveSkip()); err == nil {
+		t.Error("expected an error for archive skip patterns on TailPath")
+	}
+	if _, err := New(make(chan *logline.LogLine), w, WithDefaultArchiveSkip("[")); err == nil {
+		t.Error("expected an error for an invalid archive skip pattern")
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "app.log")
+	rotated := filepath.Join(tmpDir, "app.log.1")
+	other := filepath.Join(tmpDir, "other.txt")
+	for _, p := range []string{logfile, rotated, other} {
+		f := testutil.TestOpenFile(t, p)
+		testutil.WriteString(t, f, filepath.Base(p)+"\n")
+		f.Close()
+	}
+
+	lines := make(chan *logline.LogLine, 10)
+	ta, err := New(lines, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	pattern := filepath.Join(tmpDir, "app.log*")
+	cfg := TailConfig{
+		Patterns: []TailEntry{{Path: pattern, Policy: Beginning}},
+		Paths:    []TailEntry{{Path: other, Policy: Beginning}},
+	}
+	summary, err := ta.ApplyConfig(cfg)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff(ChangeSummary{Added: []string{pattern, other}}, summary); diff != "" {
+		t.Errorf("summary didn't match:\n%s", diff)
+	}
+	got := testutil.CollectLines(t, lines, 2, collectTimeout)
+	var text []string
+	for _, l := range got {
+		text = append(text, l.Line)
+	}
+	sort.Strings(text)
+	if diff := testutil.Diff([]string{"app.log", "other.txt"}, text); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+
+	// The same config changes nothing.
+	summary, err = ta.ApplyConfig(cfg)
+	testutil.FatalIfErr(t, err)
+	if !summary.Empty() {
+		t.Errorf("expected no changes, got %+v", summary)
+	}
+
+	// The pattern stops skipping archives, the path is dropped, and a bad
+	// pattern fails without stopping the rest.
+	bad := filepath.Join(tmpDir, "[")
+	summary, err = ta.ApplyConfig(TailConfig{Patterns: []TailEntry{
+		{Path: pattern, Policy: Beginning, Options: []PathOption{WithArchiveSkip()}},
+		{Path: bad},
+	}})
+	expected := ChangeSummary{Updated: []string{pattern}, Removed: []string{other}, Failed: []string{bad}}
+	if diff := testutil.Diff(expected, summary); diff != "" {
+		t.Errorf("summary didn't match:\n%s", diff)
+	}
+	if e, ok := err.(*ErrApplyConfig); !ok || len(e.Errors) != 1 || e.Errors[bad] == nil {
+		t.Errorf("expected an *ErrApplyConfig for the bad pattern, got %v", err)
+	}
+	if !ta.hasHandle(logfile) || !ta.hasHandle(rotated) || ta.hasHandle(other) {
+		t.Errorf("unexpected files tailed: %+v", ta.Stats())
+	}
+	// Only the archive is read; the file already tailed isn't read again.
+	got = testutil.CollectLines(t, lines, 1, collectTimeout)
+	if got[0].Line != "app.log.1" {
+		t.Errorf("expected the archive's line, got %q", got[0].Line)
+	}
+	select {
+	case l := <-lines:
+		t.Errorf("unexpected line %q", l.Line)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Changing the watch mode fails, leaving the pattern as it was.
+	summary, err = ta.ApplyConfig(TailConfig{Patterns: []TailEntry{
+		{Path: pattern, Options: []PathOption{WithArchiveSkip(), WithWatchMode(watcher.ModePoll)}},
+	}})
+	if err == nil || !ta.hasHandle(logfile) {
+		t.Errorf("expected changing the watch mode to fail, got %v", err)
+	}
+	if diff := testutil.Diff(ChangeSummary{Failed: []string{pattern}}, summary); diff != "" {
+		t.Errorf("summary didn't match:\n%s", diff)
+	}
+}
+
+func TestCaseFolding(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t, WithCaseFolding(true))
+	defer cleanup()
+	w.SetCaseFolding(true)
+
+	logfile := filepath.Join(dir, "Log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	if _, ok := ta.TailPath(filepath.Join(dir, "LOG")).(*ErrAlreadyTailed); !ok {
+		t.Error("expected an ErrAlreadyTailed for the path spelt in another case")
+	}
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(filepath.Join(dir, "log"))
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "a"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+
+	testutil.FatalIfErr(t, ta.AddPattern(filepath.Join(dir, "*.LOG")))
+	newfile := filepath.Join(dir, "New.log")
+	g := testutil.TestOpenFile(t, newfile)
+	defer g.Close()
+	testutil.WriteString(t, g, "b\n")
+	w.InjectCreate(newfile)
+	result = testutil.CollectLines(t, lines, 1, collectTimeout)
+	expected = []*logline.LogLine{{Filename: newfile, Line: "b"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	testutil.FatalIfErr(t, w.Close())
+}
+
+func TestControlRatio(t *testing.T) {
+	binary := ControlRatio(DefaultBinaryRatio)
+	for _, tc := range []struct {
+		sample   string
+		expected bool
+	}{
+		{"", false},
+		{"plain text\n", false},
+		{"\ttabs\r\nand \x1b[31mcolour\x1b[0m\n", false},
+		{"caf\xc3\xa9\n", false},
+		{"\x00\x00\x00\x00\n", true},
+		{"ELF\x02\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x00", true},
+	} {
+		if got := binary([]byte(tc.sample)); got != tc.expected {
+			t.Errorf("%q: binary = %v, expected %v", tc.sample, got, tc.expected)
+		}
+	}
+}
+
+func TestBinaryDetection(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	textfile := filepath.Join(tmpDir, "text.log")
+	f := testutil.TestOpenFile(t, textfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "text\n")
+	corefile := filepath.Join(tmpDir, "core.log")
+	c := testutil.TestOpenFile(t, corefile)
+	defer c.Close()
+	testutil.WriteString(t, c, "\x00\x00\x00\x00\x7fELF\x00\x00\n")
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, w, WithBinaryDetection(nil))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.AddPatternWithPolicy(filepath.Join(tmpDir, "*.log"), Beginning))
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	s := ta.Stats()
+	if s.Handles != 1 {
+		t.Errorf("expected 1 handle, got %d", s.Handles)
+	}
+	if diff := testutil.Diff([]string{corefile}, s.Binary); diff != "" {
+		t.Errorf("binary files didn't match:\n%s", diff)
+	}
+
+	// The binary file is tailed once it's rewritten with text.
+	testutil.FatalIfErr(t, c.Truncate(0))
+	_, err = c.Seek(0, io.SeekStart)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, c, "revived\n")
+	w.InjectUpdate(corefile)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, ta.Close())
+	if s := ta.Stats(); s.Handles != 2 || len(s.Binary) != 0 {
+		t.Errorf("expected both files tailed, got %d handles and binary files %v", s.Handles, s.Binary)
+	}
+	expected := []*logline.LogLine{
+		{Filename: textfile, Line: "text"},
+		{Filename: corefile, Line: "revived"},
+	}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestBinaryAllowed(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "\x00\x01\x02\x03\n")
+
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, watcher.NewFakeWatcher(), OneShot, WithBinaryDetection(nil), WithBinaryAllowed(logfile))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+	expected := []*logline.LogLine{{Filename: logfile, Line: "\x00\x01\x02\x03"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestMaxInitialFileSize(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		options  []Option
+		policy   StartPolicy
+		expected []string
+		tailed   bool
+	}{
+		{"from end", nil, Beginning, []string{"new"}, true},
+		{"skipped", []Option{WithSkipLargeFiles()}, Beginning, nil, false},
+		{"full", []Option{WithSkipLargeFiles()}, Full, []string{"old", "older", "new"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.WriteString(t, f, "old\nolder\n")
+
+			w := watcher.NewFakeWatcher()
+			lines := make(chan *logline.LogLine, 3)
+			ta, err := New(lines, w, append(tc.options, WithMaxInitialFileSize(5))...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, tc.policy))
+
+			// Growth past the limit once the file is tailed is read as usual.
+			testutil.WriteString(t, f, "new\n")
+			w.InjectUpdateAndWait(logfile)
+			testutil.FatalIfErr(t, ta.Close())
+			var result []string
+			for l := range lines {
+				result = append(result, l.Line)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("result didn't match:\n%s", diff)
+			}
+			s := ta.Stats()
+			if tailed := s.Handles == 1; tailed != tc.tailed {
+				t.Errorf("expected tailed %v, got %d handles", tc.tailed, s.Handles)
+			}
+			var large map[string]LargeFile
+			if tc.policy != Full {
+				large = map[string]LargeFile{logfile: {Size: 10, Skipped: !tc.tailed}}
+			}
+			if diff := testutil.Diff(large, s.LargeFiles); diff != "" {
+				t.Errorf("large files didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 6)
+	ta, err := New(lines, w, WithSequenceNumbers())
+	testutil.FatalIfErr(t, err)
+
+	for _, name := range []string{"a", "b"} {
+		logfile := filepath.Join(tmpDir, name)
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+		testutil.WriteString(t, f, name+"1\n"+name+"2\n"+name+"3\n")
+		w.InjectUpdateAndWait(logfile)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	var first, last uint64
+	for l := range lines {
+		if first == 0 {
+			first = l.Seq
+		} else if l.Seq <= last {
+			t.Errorf("%q: seq %d not after %d", l.Line, l.Seq, last)
+		}
+		last = l.Seq
+	}
+	// No other Tailer in this test emits lines, so there are no gaps.
+	if last-first != 5 {
+		t.Errorf("expected seq %d to %d, got %d to %d", first, first+5, first, last)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	// The header is long enough to fingerprint by content.
+	header := strings.Repeat("x", registryBlock)
+	for _, tc := range []struct {
+		key      RegistryKey
+		expected []string
+	}{
+		{RegistryByInode, []string{"b"}},
+		{RegistryByContent, []string{"b"}},
+		{RegistryByPath, []string{header, "a", "b"}},
+	} {
+		t.Run(tc.key.String(), func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			reg := filepath.Join(tmpDir, "registry")
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.WriteString(t, f, header+"\na\n")
+
+			tail := func(pathname string) []string {
+				lines := make(chan *logline.LogLine, 3)
+				ta, err := New(lines, watcher.NewFakeWatcher(), WithRegistry(reg, tc.key))
+				testutil.FatalIfErr(t, err)
+				testutil.FatalIfErr(t, ta.TailPathWithPolicy(pathname, Beginning))
+				testutil.FatalIfErr(t, ta.Close())
+				var result []string
+				for l := range lines {
+					result = append(result, l.Line)
+				}
+				return result
+			}
+			if diff := testutil.Diff([]string{header, "a"}, tail(logfile)); diff != "" {
+				t.Errorf("first read didn't match:\n%s", diff)
+			}
+
+			// Rename the file while nothing is tailing it.
+			testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+			testutil.WriteString(t, f, "b\n")
+			if diff := testutil.Diff(tc.expected, tail(logfile+".1")); diff != "" {
+				t.Errorf("read after rename didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRegistryCompaction(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := filepath.Join(tmpDir, "registry")
+	clk := testutil.NewFakeClock(time.Now())
+	lines := make(chan *logline.LogLine, 2)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithClock(clk), WithRegistry(reg, RegistryByPath), WithRegistryTTL(time.Hour))
+	testutil.FatalIfErr(t, err)
+	var names []string
+	for _, name := range []string{"open", "closed"} {
+		logfile := filepath.Join(tmpDir, name)
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, name+"\n")
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		names = append(names, logfile)
+	}
+	if s := ta.Stats(); s.Registry != 2 {
+		t.Errorf("expected 2 registry entries, got %d", s.Registry)
+	}
+	testutil.FatalIfErr(t, ta.Untail(names[1]))
+
+	// The idle open file is kept, and the closed file is dropped.
+	clk.Advance(2 * time.Hour)
+	testutil.FatalIfErr(t, ta.Close())
+	ta, err = New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithClock(clk), WithRegistry(reg, RegistryByPath))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	if s := ta.Stats(); s.Registry != 1 {
+		t.Errorf("expected 1 registry entry, got %d", s.Registry)
+	}
+}
+
+func TestRegistrySeed(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := filepath.Join(tmpDir, "registry")
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "shipped\nnew\n")
+
+	seed := map[checkpoint.Fingerprint]checkpoint.Offset{
+		checkpoint.Fingerprint(logfile): {Path: logfile, Offset: 8},
+	}
+	for _, expected := range [][]string{{"new"}, {}} {
+		// The seed is only applied to a registry without an entry for the file.
+		lines := make(chan *logline.LogLine, 2)
+		ta, err := New(lines, watcher.NewFakeWatcher(), WithRegistry(reg, RegistryByPath), WithRegistrySeed(seed))
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		testutil.FatalIfErr(t, ta.Close())
+		result := []string{}
+		for l := range lines {
+			result = append(result, l.Line)
+		}
+		if diff := testutil.Diff(expected, result); diff != "" {
+			t.Errorf("result didn't match:\n%s", diff)
+		}
+	}
+}
+
+// openTestRegistry opens the registry at path, keyed by path, with a TTL of
+// an hour.
+func openTestRegistry(t *testing.T, path string, clk clock.Clock) *registry {
+	t.Helper()
+	r, err := openRegistry(path, RegistryByPath, time.Hour, time.Hour, clk, log.NewLeveled(log.DiscardingLogger, log.InfoLevel))
+	testutil.FatalIfErr(t, err)
+	return r
+}
+
+// registryOffsets returns the offsets of the entries of r, by key.
+func registryOffsets(r *registry) map[string]int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	offsets := make(map[string]int64)
+	for key, e := range r.entries {
+		offsets[key] = e.Offset
+	}
+	return offsets
+}
+
+func TestRegistryJournal(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := filepath.Join(tmpDir, "registry")
+	clk := testutil.NewFakeClock(time.Now())
+	r := openTestRegistry(t, reg, clk)
+	snapshot, err := ioutil.ReadFile(reg)
+	testutil.FatalIfErr(t, err)
+
+	// The changes are appended to the journal, leaving the snapshot alone.
+	r.update("a", "a", 1, clk.Now())
+	r.update("b", "b", 2, clk.Now())
+	testutil.FatalIfErr(t, r.save())
+	b, err := ioutil.ReadFile(reg)
+	testutil.FatalIfErr(t, err)
+	if !bytes.Equal(snapshot, b) {
+		t.Errorf("expected the snapshot unchanged, got %q", b)
+	}
+	c, err := readRegistry(reg)
+	testutil.FatalIfErr(t, err)
+	if c.journal != 2 {
+		t.Errorf("expected 2 records in the journal, got %d", c.journal)
+	}
+
+	// An entry read again at the same offset isn't written again.
+	r.update("a", "a", 1, clk.Now())
+	testutil.FatalIfErr(t, r.save())
+	if c, err = readRegistry(reg); err != nil || c.journal != 2 {
+		t.Errorf("expected 2 records in the journal, got %d, %v", c.journal, err)
+	}
+
+	// Once the journal would be longer than a snapshot, one is written.
+	r.update("a", "a", 3, clk.Now())
+	testutil.FatalIfErr(t, r.save())
+	c, err = readRegistry(reg)
+	testutil.FatalIfErr(t, err)
+	if c.journal != 0 {
+		t.Errorf("expected an empty journal after a snapshot, got %d records", c.journal)
+	}
+	if diff := testutil.Diff(map[string]int64{"a": 3, "b": 2}, registryOffsets(&registry{entries: c.entries})); diff != "" {
+		t.Errorf("snapshot didn't match:\n%s", diff)
+	}
+
+	// A dropped entry is journaled as deleted, and the open files' entries
+	// are kept without being written again.
+	r.update("c", "c", 4, clk.Now())
+	r.bind(&File{}, "a")
+	r.bind(&File{}, "c")
+	clk.Advance(2 * time.Hour)
+	testutil.FatalIfErr(t, r.save())
+	c, err = readRegistry(reg)
+	testutil.FatalIfErr(t, err)
+	if c.journal != 2 {
+		t.Errorf("expected 2 records in the journal, got %d", c.journal)
+	}
+	if diff := testutil.Diff(map[string]int64{"a": 3, "c": 4}, registryOffsets(&registry{entries: c.entries})); diff != "" {
+		t.Errorf("registry didn't match:\n%s", diff)
+	}
+	testutil.FatalIfErr(t, r.close())
+}
+
+func TestRegistryRecovery(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// A snapshot of three entries, and a journal of two more.
+	reg := filepath.Join(tmpDir, "registry")
+	clk := testutil.NewFakeClock(time.Now())
+	r := openTestRegistry(t, reg, clk)
+	for i, key := range []string{"a", "b", "c"} {
+		r.update(key, key, int64(i), clk.Now())
+	}
+	testutil.FatalIfErr(t, r.close())
+	r = openTestRegistry(t, reg, clk)
+	r.update("d", "d", 3, clk.Now())
+	r.update("e", "e", 4, clk.Now())
+	testutil.FatalIfErr(t, r.save())
+	snapshot, err := ioutil.ReadFile(reg)
+	testutil.FatalIfErr(t, err)
+	journal, err := ioutil.ReadFile(reg + registryJournalSuffix)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, r.close())
+
+	// expected returns the offsets of the entries in the complete records of
+	// the first n bytes of file, after its header; none if the header isn't
+	// complete.
+	expected := func(file []byte, n int, offsets map[string]int64) map[string]int64 {
+		lines := bytes.SplitAfter(file, []byte("\n"))
+		end := len(lines[0])
+		if n < end {
+			return nil
+		}
+		complete := make(map[string]int64)
+		for _, line := range lines[1:] {
+			end += len(line)
+			if end > n || len(line) == 0 {
+				break
+			}
+			var e RegistryEntry
+			testutil.FatalIfErr(t, json.Unmarshal(line[9:], &e))
+			complete[e.Key] = offsets[e.Key]
+		}
+		return complete
+	}
+	final := map[string]int64{"a": 0, "b": 1, "c": 2, "d": 3, "e": 4}
+	merge := func(a, b map[string]int64) map[string]int64 {
+		m := make(map[string]int64)
+		for k, v := range a {
+			m[k] = v
+		}
+		for k, v := range b {
+			m[k] = v
+		}
+		return m
+	}
+	check := func(name string, s, j []byte, want map[string]int64) {
+		t.Helper()
+		dir := filepath.Join(tmpDir, "recover")
+		testutil.FatalIfErr(t, os.RemoveAll(dir))
+		testutil.FatalIfErr(t, os.Mkdir(dir, 0700))
+		path := filepath.Join(dir, "registry")
+		testutil.FatalIfErr(t, ioutil.WriteFile(path, s, 0600))
+		testutil.FatalIfErr(t, ioutil.WriteFile(path+registryJournalSuffix, j, 0600))
+		r, err := openRegistry(path, RegistryByPath, time.Hour, time.Hour, clk, log.NewLeveled(log.DiscardingLogger, log.InfoLevel))
+		if err != nil {
+			t.Fatalf("%s: expected the registry to be recovered, got %s", name, err)
+		}
+		defer r.close()
+		if want == nil {
+			want = map[string]int64{}
+		}
+		if diff := testutil.Diff(want, registryOffsets(r)); diff != "" {
+			t.Errorf("%s: entries didn't match:\n%s", name, diff)
+		}
+		// What was recovered has been saved again, undamaged.
+		c, err := readRegistry(path)
+		testutil.FatalIfErr(t, err)
+		if len(c.damage) != 0 || len(c.entries) != len(want) {
+			t.Errorf("%s: expected %d entries saved again, got %d, damage %+v", name, len(want), len(c.entries), c.damage)
+		}
+	}
+
+	for n := 0; n < len(snapshot); n++ {
+		// The journal follows the snapshot whose header it names.
+		want := expected(snapshot, n, final)
+		if want != nil {
+			want = merge(want, expected(journal, len(journal), final))
+		}
+		check(fmt.Sprintf("snapshot truncated at %d", n), snapshot[:n], journal, want)
+
+		damaged := append([]byte(nil), snapshot...)
+		if damaged[n] == '#' {
+			continue
+		}
+		damaged[n] = '#'
+		check(fmt.Sprintf("snapshot damaged at %d", n), damaged, journal, want)
+	}
+	for n := 0; n < len(journal); n++ {
+		want := merge(expected(snapshot, len(snapshot), final), expected(journal, n, final))
+		check(fmt.Sprintf("journal truncated at %d", n), snapshot, journal[:n], want)
+
+		damaged := append([]byte(nil), journal...)
+		if damaged[n] == '#' {
+			continue
+		}
+		damaged[n] = '#'
+		check(fmt.Sprintf("journal damaged at %d", n), snapshot, damaged, want)
+	}
+
+	// A copy of a damaged file is kept.
+	dir := filepath.Join(tmpDir, "recover")
+	if _, err := os.Stat(filepath.Join(dir, "registry"+registryJournalSuffix+registryCorruptSuffix)); err != nil {
+		t.Errorf("expected a copy of the damaged journal: %s", err)
+	}
+}
+
+func TestRegistryUpgrade(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// Time the Tailer wasn't running doesn't count towards the TTL.
+	last := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := testutil.NewFakeClock(last.Add(48 * time.Hour))
+	reg := filepath.Join(tmpDir, "registry")
+	old := `{"v":1,"entries":[` +
+		`{"key":"a","path":"a","offset":1,"first_seen":"2019-05-01T12:00:00Z","last_seen":"2019-05-01T12:00:00Z"},` +
+		`{"key":"b","path":"b","offset":2,"first_seen":"2019-05-01T10:00:00Z","last_seen":"2019-05-01T10:00:00Z"}]}`
+	testutil.FatalIfErr(t, ioutil.WriteFile(reg, []byte(old), 0600))
+	r := openTestRegistry(t, reg, clk)
+	if diff := testutil.Diff(map[string]int64{"a": 1}, registryOffsets(r)); diff != "" {
+		t.Errorf("entries didn't match:\n%s", diff)
+	}
+	c, err := readRegistry(reg)
+	testutil.FatalIfErr(t, err)
+	if c.upgraded || len(c.entries) != 1 {
+		t.Errorf("expected the registry saved in version %d, got %+v", registryVersion, c)
+	}
+	testutil.FatalIfErr(t, r.close())
+
+	// A damaged registry in the old format can't be partly recovered.
+	testutil.FatalIfErr(t, ioutil.WriteFile(reg, []byte(old[:len(old)/2]), 0600))
+	r = openTestRegistry(t, reg, clk)
+	if n := r.size(); n != 0 {
+		t.Errorf("expected no entries, got %d", n)
+	}
+	testutil.FatalIfErr(t, r.close())
+	if b, err := ioutil.ReadFile(reg + registryCorruptSuffix); err != nil || string(b) != old[:len(old)/2] {
+		t.Errorf("expected a copy of the damaged registry, got %q, %v", b, err)
+	}
+
+	// A registry of a later version isn't overwritten.
+	b, err := appendRecord(nil, registryHeader{Version: registryVersion + 1})
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ioutil.WriteFile(reg, b, 0600))
+	if _, err := openRegistry(reg, RegistryByPath, time.Hour, time.Hour, clk, log.NewLeveled(log.DiscardingLogger, log.InfoLevel)); err == nil {
+		t.Error("expected an error opening a registry of an unsupported version")
+	}
+}
+
+// pollOnlyInterval is the poll interval of the LogWatcher in the poll-only
+// tests, which is only reached when the test advances its clock.
+const pollOnlyInterval = time.Second
+
+// pollOnlyTailer is a Tailer on a LogWatcher without fsnotify, as used on
+// filesystems like NFS that don't send notifications.
+type pollOnlyTailer struct {
+	*Tailer
+	clk   *testutil.FakeClock
+	lines chan *logline.LogLine
+	mtime time.Time
+}
+
+func newPollOnlyTailer(t *testing.T) *pollOnlyTailer {
+	t.Helper()
+	clk := testutil.NewFakeClock(time.Now())
+	w, err := watcher.NewLogWatcher(pollOnlyInterval, false, watcher.WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	pt := &pollOnlyTailer{clk: clk, lines: make(chan *logline.LogLine, 10), mtime: time.Now()}
+	pt.Tailer, err = New(pt.lines, w)
+	testutil.FatalIfErr(t, err)
+	return pt
+}
+
+// touch moves the modification time of pathname forward, so that the next
+// poll sees the change however coarse the filesystem's timestamps.
+func (pt *pollOnlyTailer) touch(t *testing.T, pathname string) {
+	t.Helper()
+	pt.mtime = pt.mtime.Add(time.Second)
+	testutil.FatalIfErr(t, os.Chtimes(pathname, pt.mtime, pt.mtime))
+}
+
+// poll advances the clock a poll interval at a time until n lines are read.
+func (pt *pollOnlyTailer) poll(t *testing.T, n int) []string {
+	t.Helper()
+	var result []string
+	timeout := time.After(collectTimeout)
+	for len(result) < n {
+		pt.clk.Advance(pollOnlyInterval)
+		select {
+		case l := <-pt.lines:
+			result = append(result, l.Line)
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("read %q, expected %d lines", result, n)
+		}
+	}
+	return result
+}
+
+func TestTailPollOnly(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		change   func(t *testing.T, pt *pollOnlyTailer, logfile string, f *os.File) *os.File
+		expected []string
+	}{
+		{"update", func(t *testing.T, pt *pollOnlyTailer, logfile string, f *os.File) *os.File {
+			testutil.WriteString(t, f, "c\n")
+			return f
+		}, []string{"c"}},
+		{"truncate", func(t *testing.T, pt *pollOnlyTailer, logfile string, f *os.File) *os.File {
+			testutil.FatalIfErr(t, f.Truncate(0))
+			_, err := f.Seek(0, io.SeekStart)
+			testutil.FatalIfErr(t, err)
+			testutil.WriteString(t, f, "c\n")
+			return f
+		}, []string{"c"}},
+		{"rotate", func(t *testing.T, pt *pollOnlyTailer, logfile string, f *os.File) *os.File {
+			testutil.WriteString(t, f, "c\n")
+			f.Close()
+			testutil.FatalIfErr(t, os.Rename(logfile, logfile+".1"))
+			f = testutil.TestOpenFile(t, logfile)
+			testutil.WriteString(t, f, "d\n")
+			return f
+		}, []string{"c", "d"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			pt := newPollOnlyTailer(t)
+			testutil.FatalIfErr(t, pt.TailPath(logfile))
+			testutil.WriteString(t, f, "a\nb\n")
+			pt.touch(t, logfile)
+			if diff := testutil.Diff([]string{"a", "b"}, pt.poll(t, 2)); diff != "" {
+				t.Errorf("lines before the change didn't match:\n%s", diff)
+			}
+
+			f = tc.change(t, pt, logfile, f)
+			defer f.Close()
+			pt.touch(t, logfile)
+			if diff := testutil.Diff(tc.expected, pt.poll(t, len(tc.expected))); diff != "" {
+				t.Errorf("lines after the change didn't match:\n%s", diff)
+			}
+			testutil.FatalIfErr(t, pt.Close())
+		})
+	}
+}
+
+// tailOneShot reads each of contents from its own file with ta in OneShot
+// mode, then closes ta, as a LineIterator's consumer would see them.
+func tailOneShot(t *testing.T, ta *Tailer, dir string, contents ...string) {
+	t.Helper()
+	for i, c := range contents {
+		logfile := filepath.Join(dir, fmt.Sprintf("log%d", i))
+		testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte(c), 0600))
+		testutil.FatalIfErr(t, ta.TailPath(logfile))
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestLineIterator(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true})
+	testutil.FatalIfErr(t, err)
+	it := ta.Lines()
+	go tailOneShot(t, ta, tmpDir, "a\nb\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	var result []string
+	for {
+		l, err := it.Next(ctx)
+		if err == ErrClosed {
+			break
+		}
+		testutil.FatalIfErr(t, err)
+		result = append(result, l.Line)
+	}
+	if diff := testutil.Diff([]string{"a", "b"}, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	if _, err := it.Next(ctx); err != ErrClosed {
+		t.Errorf("expected ErrClosed after the end, got %v", err)
+	}
+}
+
+func TestLineIteratorCancel(t *testing.T) {
+	ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher()})
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	it := ta.Lines()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := it.Next(ctx); err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	testutil.FatalIfErr(t, it.Close())
+	if _, err := it.Next(context.Background()); err != ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestLineIteratorWithLinesChannel(t *testing.T) {
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	if _, err := ta.Lines().Next(context.Background()); err == nil || err == ErrClosed {
+		t.Errorf("expected an error iterating a Tailer with a lines channel, got %v", err)
+	}
+}
+
+func TestLineIteratorFanOut(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true, FanOut: true})
+	testutil.FatalIfErr(t, err)
+	its := []*LineIterator{ta.Lines(), ta.Lines()}
+	// A closed iterator doesn't hold back the others.
+	closed := ta.Lines()
+	testutil.FatalIfErr(t, closed.Close())
+	go tailOneShot(t, ta, tmpDir, "a\nb\n")
+
+	ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+	defer cancel()
+	results := make([][]string, len(its))
+	var wg sync.WaitGroup
+	for i, it := range its {
+		wg.Add(1)
+		go func(i int, it *LineIterator) {
+			defer wg.Done()
+			for {
+				l, err := it.Next(ctx)
+				if err != nil {
+					if err != ErrClosed {
+						t.Error(err)
+					}
+					return
+				}
+				results[i] = append(results[i], l.Line)
+			}
+		}(i, it)
+	}
+	wg.Wait()
+	for i, result := range results {
+		if diff := testutil.Diff([]string{"a", "b"}, result); diff != "" {
+			t.Errorf("lines from iterator %d didn't match:\n%s", i, diff)
+		}
+	}
+	if _, err := ta.Lines().Next(ctx); err != ErrClosed {
+		t.Errorf("expected ErrClosed from an iterator created after shutdown, got %v", err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []ReaderOption
+		expected string
+	}{
+		{"plain", nil, "a\nbb\na\n"},
+		{"filename", []ReaderOption{WithReaderFilename()}, "log0: a\nlog0: bb\nlog1: a\n"},
+		{"small buffer", []ReaderOption{WithReaderBuffer(2, OverflowBlock)}, "a\nbb\na\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true, Options: []Option{WithFilenameBase(tmpDir)}})
+			testutil.FatalIfErr(t, err)
+			r := NewReader(ta, tc.opts...)
+			defer r.Close()
+			go tailOneShot(t, ta, tmpDir, "a\nbb\n", "a\n")
+
+			b, err := ioutil.ReadAll(r)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, string(b)); diff != "" {
+				t.Errorf("stream didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReaderOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   OverflowPolicy
+		expected string
+	}{
+		{"drop newest", OverflowDropNewest, "1\n2\n"},
+		{"drop oldest", OverflowDropOldest, "3\n4\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true})
+			testutil.FatalIfErr(t, err)
+			dropped := ta.metrics.readerDropped.Value()
+			r := NewReader(ta, WithReaderBuffer(4, tc.policy))
+			defer r.Close()
+			tailOneShot(t, ta, tmpDir, "1\n2\n3\n4\n")
+			// Nothing is read until the drops have happened.
+			for deadline := time.Now().Add(collectTimeout); ta.metrics.readerDropped.Value()-dropped < 2; {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected 2 lines dropped, got %d", ta.metrics.readerDropped.Value()-dropped)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			b, err := ioutil.ReadAll(r)
+			testutil.FatalIfErr(t, err)
+			if diff := testutil.Diff(tc.expected, string(b)); diff != "" {
+				t.Errorf("stream didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestReaderDropMarker(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		policy   OverflowPolicy
+		expected string
+	}{
+		{"drop newest", OverflowDropNewest, "1\n2\n"},
+		{"drop oldest", OverflowDropOldest, "3\n4\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			clk := testutil.NewFakeClock(time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC))
+			ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true, Options: []Option{WithClock(clk)}})
+			testutil.FatalIfErr(t, err)
+			dropped := ta.metrics.readerDroppedBytes.Value()
+			r := NewReader(ta, WithReaderBuffer(4, tc.policy), WithReaderDropMarker("! "))
+			defer r.Close()
+			tailOneShot(t, ta, tmpDir, "1\n2\n3\n4\n")
+			// Wait for the reader to buffer the lines, and drop those that
+			// don't fit, before reading any.
+			deadline := time.Now().Add(collectTimeout)
+			for ta.metrics.readerDroppedBytes.Value()-dropped < 4 {
+				if time.Now().After(deadline) {
+					t.Fatalf("expected 4 bytes dropped, got %d", ta.metrics.readerDroppedBytes.Value()-dropped)
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			// The reader ends before it has room again, so the marker is last.
+			b, err := ioutil.ReadAll(r)
+			testutil.FatalIfErr(t, err)
+			expected := tc.expected + "! dropped 2 lines, 4 bytes from " + filepath.Join(tmpDir, "log0") + " between 2019-05-01T12:00:00Z and 2019-05-01T12:00:00Z\n"
+			if diff := testutil.Diff(expected, string(b)); diff != "" {
+				t.Errorf("stream didn't match:\n%s", diff)
+			}
+			if n := ta.metrics.readerDroppedBytes.Value() - dropped; n != 4 {
+				t.Errorf("expected 4 bytes dropped, got %d", n)
+			}
+		})
+	}
+}
+
+func TestReaderDropMarkerResumed(t *testing.T) {
+	start := time.Date(2019, 5, 1, 12, 0, 0, 0, time.UTC)
+	clk := testutil.NewFakeClock(start)
+	r := &reader{clock: clk, dropped: &expvar.Int{}, droppedBytes: &expvar.Int{}, size: 4, overflow: OverflowDropNewest, marker: "! "}
+	r.cond = sync.NewCond(&r.mu)
+	add := func(filename, line string) {
+		t.Helper()
+		if !r.add(queuedLine{b: []byte(line), filename: filename}) {
+			t.Fatal("reader closed")
+		}
+	}
+	read := func() string {
+		t.Helper()
+		b := make([]byte, 256)
+		n, err := r.Read(b)
+		testutil.FatalIfErr(t, err)
+		return string(b[:n])
+	}
+	add("a", "a1\n")
+	add("a", "a2\n")
+	clk.Advance(time.Second)
+	add("b", "b1\n")
+	add("a", "a3\n")
+	if got := read(); got != "a1\n" {
+		t.Errorf("expected only the first line, got %q", got)
+	}
+
+	// The markers come before the first line buffered once there's room.
+	add("b", "b2\n")
+	expected := "! dropped 2 lines, 6 bytes from a between 2019-05-01T12:00:00Z and 2019-05-01T12:00:01Z\n" +
+		"! dropped 1 lines, 3 bytes from b between 2019-05-01T12:00:01Z and 2019-05-01T12:00:01Z\n" +
+		"b2\n"
+	if diff := testutil.Diff(expected, read()); diff != "" {
+		t.Errorf("stream didn't match:\n%s", diff)
+	}
+	if n := r.dropped.Value(); n != 3 {
+		t.Errorf("expected 3 lines dropped, got %d", n)
+	}
+
+	// The oldest lines dropped to make room are reported too, and the
+	// marker isn't dropped itself.
+	r.overflow = OverflowDropOldest
+	add("a", "a4\n")
+	add("a", "a5\n")
+	add("a", "a6\n")
+	if got := read(); got != "a6\n" {
+		t.Errorf("expected only the newest line, got %q", got)
+	}
+	add("a", "a7\n")
+	add("a", "a8\n")
+	expected = "! dropped 2 lines, 6 bytes from a between 2019-05-01T12:00:01Z and 2019-05-01T12:00:01Z\n" + "a8\n"
+	if diff := testutil.Diff(expected, read()); diff != "" {
+		t.Errorf("stream didn't match:\n%s", diff)
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), OneShot: true, FanOut: true})
+	testutil.FatalIfErr(t, err)
+	closed := NewReader(ta)
+	r := NewReader(ta)
+	testutil.FatalIfErr(t, closed.Close())
+	if _, err := closed.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Errorf("expected io.ErrClosedPipe from a closed reader, got %v", err)
+	}
+	// The Tailer carries on for the other reader.
+	go tailOneShot(t, ta, tmpDir, "a\n")
+	b, err := ioutil.ReadAll(r)
+	testutil.FatalIfErr(t, err)
+	if diff := testutil.Diff("a\n", string(b)); diff != "" {
+		t.Errorf("stream didn't match:\n%s", diff)
+	}
+}
+
+// parseSeconds parses a line starting with a number of seconds since the
+// epoch, for ordered merge tests.
+func parseSeconds(line string) (time.Time, bool) {
+	s := strings.SplitN(line, " ", 2)[0]
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(n, 0), true
+}
+
+func TestOrderedMerge(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	files := map[string]string{
+		"a.log": "1 a\n4 a\n6 a\n",
+		"b.log": "2 b\n3 b\n7 b\n",
+		"c.log": "5 c\nno timestamp\n8 c\n",
+	}
+	for name, contents := range files {
+		testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(contents), 0600))
+	}
+	lines := make(chan *logline.LogLine, 10)
+	events := make(chan FileEvent, 2*len(files)) // CaughtUp and EOF
+	ta, err := New(lines, watcher.NewFakeWatcher(), OneShot, WithBackfillConcurrency(len(files)),
+		WithTimestampParser(parseSeconds), WithOrderedMerge(time.Hour), WithFileEvents(events), WithFilenameBase(tmpDir))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.log")))
+	testutil.FatalIfErr(t, ta.Close())
+	close(events)
+	var ended []string
+	for e := range events {
+		if e.Type == EOF && e.Lines == 3 {
+			ended = append(ended, e.Name)
+		}
+	}
+	sort.Strings(ended)
+	if diff := testutil.Diff([]string{"a.log", "b.log", "c.log"}, ended); diff != "" {
+		t.Errorf("EOF events didn't match:\n%s", diff)
+	}
+
+	var result []string
+	for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+		result = append(result, l.Line)
+	}
+	expected := []string{"1 a", "2 b", "3 b", "4 a", "5 c", "no timestamp", "6 a", "7 b", "8 c"}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines weren't merged in order:\n%s", diff)
+	}
+}
+
+func TestOrderedMergeSequenceNumbers(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	files := map[string]string{
+		"a.log": "1 a\n4 a\n6 a\n",
+		"b.log": "2 b\n3 b\n7 b\n",
+		"c.log": "5 c\n8 c\n",
+	}
+	for name, contents := range files {
+		testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(contents), 0600))
+	}
+	lines := make(chan *logline.LogLine, 10)
+	ta, err := New(lines, watcher.NewFakeWatcher(), OneShot, WithBackfillConcurrency(len(files)),
+		WithTimestampParser(parseSeconds), WithOrderedMerge(time.Hour), WithSequenceNumbers())
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.log")))
+	testutil.FatalIfErr(t, ta.Close())
+
+	// Numbered as the merge sends them, not as they're read.
+	var result []string
+	var last uint64
+	for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+		if l.Seq <= last {
+			t.Errorf("%q: seq %d not after %d", l.Line, l.Seq, last)
+		}
+		last = l.Seq
+		result = append(result, l.Line)
+	}
+	expected := []string{"1 a", "2 b", "3 b", "4 a", "5 c", "6 a", "7 b", "8 c"}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines weren't merged in order:\n%s", diff)
+	}
+}
+
+func TestOrderedMergeSkew(t *testing.T) {
+	in := make(chan *logline.LogLine)
+	out := make(chan *logline.LogLine, 10)
+	clk := testutil.NewFakeClock(time.Now())
+	m := newOrderedMerge(in, out, parseSeconds, 10*time.Second, clk, nil)
+	m.reading("a", true)
+	m.reading("b", true)
+	in <- &logline.LogLine{Filename: "a", Line: "100 a"}
+	in <- &logline.LogLine{Filename: "a", Line: "105 a"}
+	// b hasn't reached 100, but a is more than the skew past it.
+	in <- &logline.LogLine{Filename: "a", Line: "111 a"}
+	if l := <-out; l.Line != "100 a" {
+		t.Errorf("expected 100 a released by the skew, got %q", l.Line)
+	}
+	// The rest are released once they've been held for the skew.
+	clk.Advance(10 * time.Second)
+	for _, expected := range []string{"105 a", "111 a"} {
+		select {
+		case l := <-out:
+			if l.Line != expected {
+				t.Errorf("expected %q released by the timeout, got %q", expected, l.Line)
+			}
+		case <-time.After(collectTimeout):
+			t.Fatalf("%q wasn't released by the timeout", expected)
+		}
+	}
+	close(in)
+	if _, ok := <-out; ok {
+		t.Error("expected out closed")
+	}
+}
+
+func TestOrderedMergeNeedsParser(t *testing.T) {
+	if _, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithOrderedMerge(time.Second)); err == nil {
+		t.Error("expected an error for an ordered merge without a timestamp parser")
+	}
+}
+
+func TestOneShotEOF(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	contents := map[string]string{"a.log": "1\n2\n3\n", "b.log": "4\n"}
+	for name, c := range contents {
+		testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, name), []byte(c), 0600))
+	}
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	ta, err := New(lines, watcher.NewFakeWatcher(), OneShot, WithFileEvents(events), WithFilenameBase(tmpDir))
+	testutil.FatalIfErr(t, err)
+	go func() {
+		testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*.log")))
+		testutil.FatalIfErr(t, ta.Close())
+	}()
+
+	received := make(map[string]int64)
+	var ended []FileEvent
+	timeout := time.After(collectTimeout)
+	for lines != nil {
+		select {
+		case l, ok := <-lines:
+			if !ok {
+				lines = nil
+				continue
+			}
+			received[l.Filename]++
+		case e := <-events:
+			if e.Type != EOF {
+				continue
+			}
+			// Every line from the file has been received already.
+			if received[e.Name] != e.Lines {
+				t.Errorf("EOF for %s after %d of its %d lines", e.Name, received[e.Name], e.Lines)
+			}
+			e.Pathname = ""
+			ended = append(ended, e)
+		case <-timeout:
+			t.Fatal("timed out waiting for lines")
+		}
+	}
+	expected := []FileEvent{
+		{Type: EOF, Name: "a.log", Lines: 3, Bytes: 6},
+		{Type: EOF, Name: "b.log", Lines: 1, Bytes: 2},
+	}
+	if diff := testutil.Diff(expected, ended); diff != "" {
+		t.Errorf("EOF events didn't match:\n%s", diff)
+	}
+}
+
+func TestOneShotFailed(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("a\n"), 0600))
+	events := make(chan FileEvent, 2)
+	ta, err := New(make(chan *logline.LogLine, 1), watcher.NewFakeWatcher(), OneShot, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	f, err := ta.newFile(logfile, Beginning)
+	testutil.FatalIfErr(t, err)
+	defer f.Close()
+
+	failure := errors.New("read failed")
+	ta.endOneShot(f, failure)
+	ta.endOneShot(f, nil)
+	close(events)
+	var result []FileEvent
+	for e := range events {
+		if e.Err != failure {
+			t.Errorf("expected error %q, got %v", failure, e.Err)
+		}
+		e.Err = nil
+		result = append(result, e)
+	}
+	expected := []FileEvent{{Type: Failed, Name: logfile, Pathname: logfile}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("events didn't match, expected one Failed event:\n%s", diff)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{"max lines", []Option{WithMaxLines(2)}, []string{"aa", "bb"}},
+		{"max bytes", []Option{WithMaxBytes(7)}, []string{"aa", "bb"}},
+		{"both", []Option{WithMaxLines(2), WithMaxBytes(4)}, []string{"aa"}},
+		{"mmap", []Option{WithMaxLines(1), WithMmapBackfill()}, []string{"aa"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			logfile := filepath.Join(tmpDir, "log")
+			testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("aa\nbb\ncc\n"), 0600))
+			lines := make(chan *logline.LogLine, 3)
+			events := make(chan FileEvent, 3)
+			ta, err := New(lines, watcher.NewFakeWatcher(), append(tc.opts, OneShot, WithFileEvents(events))...)
+			testutil.FatalIfErr(t, err)
+			testutil.FatalIfErr(t, ta.TailPath(logfile))
+			testutil.FatalIfErr(t, ta.Close())
+
+			var result []string
+			for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+				result = append(result, l.Line)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+			close(events)
+			var types []FileEventType
+			for e := range events {
+				types = append(types, e.Type)
+			}
+			// The file is done once its quota is reached.
+			if diff := testutil.Diff([]FileEventType{QuotaReached, EOF}, types); diff != "" {
+				t.Errorf("events didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestQuotaReset(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		opts     []Option
+		expected []string
+	}{
+		{"no reset", nil, []string{"a"}},
+		{"reset", []Option{WithQuotaReset()}, []string{"a", "d"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			w := watcher.NewFakeWatcher()
+			lines := make(chan *logline.LogLine, 3)
+			ta, err := New(lines, w, append(tc.opts, WithMaxLines(1))...)
+			testutil.FatalIfErr(t, err)
+
+			logfile := filepath.Join(tmpDir, "log")
+			f := testutil.TestOpenFile(t, logfile)
+			defer f.Close()
+			testutil.WriteString(t, f, "a\nb\nc\n")
+			testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+			// Further updates are ignored.
+			testutil.WriteString(t, f, "x\n")
+			w.InjectUpdateAndWait(logfile)
+			testutil.FatalIfErr(t, w.AwaitPending(time.Second))
+
+			testutil.FatalIfErr(t, f.Truncate(0))
+			_, err = f.Seek(0, io.SeekStart)
+			testutil.FatalIfErr(t, err)
+			testutil.WriteString(t, f, "d\ne\n")
+			w.InjectUpdateAndWait(logfile)
+			testutil.FatalIfErr(t, w.AwaitPending(time.Second))
+			testutil.FatalIfErr(t, ta.Close())
+
+			var result []string
+			for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+				result = append(result, l.Line)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStopPattern(t *testing.T) {
+	stop := regexp.MustCompile(`^DONE`)
+	for _, tc := range []struct {
+		name     string
+		pattern  bool
+		opt      PathOption
+		opts     []Option
+		expected []string
+	}{
+		{"inclusive", false, WithStopPattern(stop, true), nil, []string{"aa", "DONE 0"}},
+		{"exclusive", false, WithStopPattern(stop, false), nil, []string{"aa"}},
+		{"pattern", true, WithStopPattern(stop, true), nil, []string{"aa", "DONE 0"}},
+		{"mmap", false, WithStopPattern(stop, false), []Option{WithMmapBackfill()}, []string{"aa"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tmpDir, rmTmpDir := testutil.TestTempDir(t)
+			defer rmTmpDir()
+
+			logfile := filepath.Join(tmpDir, "log")
+			testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("aa\nDONE 0\nbb\n"), 0600))
+			lines := make(chan *logline.LogLine, 3)
+			events := make(chan FileEvent, 3)
+			ta, err := New(lines, watcher.NewFakeWatcher(), append(tc.opts, OneShot, WithFileEvents(events))...)
+			testutil.FatalIfErr(t, err)
+			if tc.pattern {
+				testutil.FatalIfErr(t, ta.TailPattern(filepath.Join(tmpDir, "*"), tc.opt))
+			} else {
+				testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning, tc.opt))
+			}
+			if s := ta.Stats(); s.Handles != 0 {
+				t.Errorf("expected no handles once stopped, got %d", s.Handles)
+			}
+			testutil.FatalIfErr(t, ta.Close())
+
+			var result []string
+			for _, l := range testutil.CollectAllLines(t, lines, collectTimeout) {
+				result = append(result, l.Line)
+			}
+			if diff := testutil.Diff(tc.expected, result); diff != "" {
+				t.Errorf("lines didn't match:\n%s", diff)
+			}
+			close(events)
+			var types []FileEventType
+			for e := range events {
+				types = append(types, e.Type)
+			}
+			// The file is done once its stop line is read.
+			if diff := testutil.Diff([]FileEventType{EOF}, types); diff != "" {
+				t.Errorf("events didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestStopPatternFollowing(t *testing.T) {
+	events := make(chan FileEvent, 10)
+	ta, lines, w, dir, cleanup := makeTestTail(t, WithFileEvents(events))
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile, WithStopPattern(regexp.MustCompile(`^DONE`), true)))
+
+	testutil.WriteString(t, f, "aa\n")
+	w.InjectUpdate(logfile)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.WriteString(t, f, "DONE\nbb\n")
+	w.InjectUpdate(logfile)
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	timeout := time.After(collectTimeout)
+	for eof := false; !eof; {
+		select {
+		case e := <-events:
+			if e.Type != EOF {
+				continue
+			}
+			eof = true
+			if e.Lines != 2 {
+				t.Errorf("expected an EOF event after 2 lines, got %+v", e)
+			}
+		case <-timeout:
+			t.Fatal("no EOF event once the stop line was read")
+		}
+	}
+	testutil.FatalIfErr(t, ta.inRun(func() error { return nil }))
+	if s := ta.Stats(); s.Handles != 0 {
+		t.Errorf("expected no handles once stopped, got %d", s.Handles)
+	}
+
+	// Writes to the file after it's stopped aren't read.
+	testutil.WriteString(t, f, "cc\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "aa"}, {Filename: logfile, Line: "DONE"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+}
+
+func TestWaitForPattern(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer ta.Close()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "starting\nserver ready\nserving\n")
+
+	done := make(chan *logline.LogLine, 1)
+	go func() {
+		l, err := ta.WaitForPattern(context.Background(), logfile, regexp.MustCompile(`ready`))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- l
+	}()
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
+	select {
+	case l := <-done:
+		if l == nil || l.Line != "server ready" {
+			t.Errorf("expected the ready line, got %+v", l)
+		}
+	case <-time.After(collectTimeout):
+		t.Fatal("WaitForPattern didn't return")
+	}
+	expected := []*logline.LogLine{{Filename: logfile, Line: "starting"}, {Filename: logfile, Line: "server ready"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+
+	// The path is untailed, so it can be waited for again.
+	testutil.WriteString(t, f, "stopping\n")
+	w.InjectUpdate(logfile)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go func() {
+		for range lines {
+		}
+	}()
+	if _, err := ta.WaitForPattern(ctx, logfile, regexp.MustCompile(`never`)); err != context.DeadlineExceeded {
+		t.Errorf("expected the context's error, got %v", err)
+	}
+}
+
+func TestQuietShutdown(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, w, WithClock(clk), WithQuietShutdown(time.Minute), WithFlushOnDelete())
+	testutil.FatalIfErr(t, err)
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\n")
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+
+	// awaitCountdown waits until the countdown is waiting on the clock.
+	awaitCountdown := func() {
+		t.Helper()
+		deadline := time.Now().Add(collectTimeout)
+		for clk.Timers() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("countdown isn't waiting")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// A new line starts the countdown again.
+	awaitCountdown()
+	clk.Advance(30 * time.Second)
+	testutil.WriteString(t, f, "b\npartial")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+	awaitCountdown()
+	clk.Advance(45 * time.Second)
+	expected := &QuietState{Quiet: 45 * time.Second, Remaining: 15 * time.Second}
+	if diff := testutil.Diff(expected, ta.Stats().Quiet); diff != "" {
+		t.Errorf("quiet state didn't match:\n%s", diff)
+	}
+	if err := ta.Healthy(); err != nil {
+		t.Fatalf("tailer shut down early: %s", err)
+	}
+
+	awaitCountdown()
+	clk.Advance(15 * time.Second)
+	result := testutil.CollectAllLines(t, lines, collectTimeout)
+	want := []*logline.LogLine{
+		{Filename: logfile, Line: "a"},
+		{Filename: logfile, Line: "b"},
+		{Filename: logfile, Line: "partial", Truncated: true},
+	}
+	if diff := testutil.Diff(want, result); diff != "" {
+		t.Errorf("lines didn't match:\n%s", diff)
+	}
+	select {
+	case <-ta.runDone:
+	case <-time.After(collectTimeout):
+		t.Error("expected the tailer to have shut down")
+	}
+}
+
+func TestConsumerClosedLines(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, w)
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// The consumer takes a line and then closes the channel, before the
+	// next is sent.
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(logfile)
+	if l := <-lines; l.Line != "a" {
+		t.Errorf("expected line a, got %q", l.Line)
+	}
+	close(lines)
+	testutil.WriteString(t, f, "b\nc\n")
+	w.InjectUpdate(logfile)
+	deadline := time.Now().Add(collectTimeout)
+	for ta.Healthy() != ErrLinesClosed {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the tailer to find the lines channel closed, got %v", ta.Healthy())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Files aren't read any more, and closing the Tailer doesn't close the
+	// channel again.
+	testutil.WriteString(t, f, "d\n")
+	w.InjectUpdateAndWait(logfile)
+	if s := ta.Health().Consumer; !s.Closed || s.Pending != 0 {
+		t.Errorf("expected the consumer to be closed with nothing pending, got %+v", s)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestDrain(t *testing.T) {
+	t.Run("consumer keeps up", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		reg := filepath.Join(tmpDir, "registry")
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "a\nb\n")
+
+		w := watcher.NewFakeWatcher()
+		lines := make(chan *logline.LogLine, 10)
+		ta, err := New(lines, w, WithRegistry(reg, RegistryByPath))
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		var result []string
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for l := range lines {
+				result = append(result, l.Line)
+			}
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), collectTimeout)
+		defer cancel()
+		testutil.FatalIfErr(t, ta.Drain(ctx))
+		c, err := readRegistry(reg)
+		testutil.FatalIfErr(t, err)
+		if len(c.entries) != 1 || c.entries[logfile] == nil || c.entries[logfile].Offset != 4 {
+			t.Errorf("expected the offset checkpointed at 4, got %+v", c.entries)
+		}
+
+		// Nothing more is read once drained.
+		testutil.WriteString(t, f, "c\n")
+		w.InjectUpdateAndWait(logfile)
+		testutil.FatalIfErr(t, ta.Close())
+		<-done
+		if diff := testutil.Diff([]string{"a", "b"}, result); diff != "" {
+			t.Errorf("lines didn't match:\n%s", diff)
+		}
+	})
+
+	t.Run("consumer stalls", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "a\nb\nc\n")
+
+		lines := make(chan *logline.LogLine, 1)
+		ta, err := New(lines, watcher.NewFakeWatcher())
+		testutil.FatalIfErr(t, err)
+		tailed := make(chan error, 1)
+		go func() { tailed <- ta.TailPathWithPolicy(logfile, Beginning) }()
+		deadline := time.Now().Add(collectTimeout)
+		for ta.Stats().Consumer.Pending != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("expected a send to be waiting")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		err = ta.Drain(ctx)
+		var timeout *ErrDrainTimeout
+		if !errors.As(err, &timeout) {
+			t.Fatalf("expected a drain timeout, got %v", err)
+		}
+		// One line is in the channel's buffer, and one is being sent.
+		if timeout.Lines != 2 || timeout.Bytes != 1 || timeout.Err != context.DeadlineExceeded {
+			t.Errorf("expected 2 lines left, 1 byte of them being sent, got %+v", timeout)
+		}
+
+		// The read in progress finishes once the lines are taken.
+		result := testutil.CollectLines(t, lines, 3, collectTimeout)
+		testutil.FatalIfErr(t, <-tailed)
+		testutil.FatalIfErr(t, ta.Close())
+		var got []string
+		for _, l := range result {
+			got = append(got, l.Line)
+		}
+		if diff := testutil.Diff([]string{"a", "b", "c"}, got); diff != "" {
+			t.Errorf("lines didn't match:\n%s", diff)
+		}
+	})
+}
+
+// gatedWriter blocks its first Write until release is closed.
+type gatedWriter struct {
+	writing chan struct{} // Closed when the first Write starts
+	release chan struct{}
+	once    sync.Once
+	buf     bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.once.Do(func() {
+		close(w.writing)
+		<-w.release
+	})
+	return w.buf.Write(p)
+}
+
+// failingWriter fails every Write, counting them.
+type failingWriter struct {
+	writes int32
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	atomic.AddInt32(&w.writes, 1)
+	return 0, errors.New("disk full")
+}
+
+func TestMirrorWriter(t *testing.T) {
+	t.Run("copies lines", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "a\r\nb\n")
+
+		var mirrored bytes.Buffer
+		lines := make(chan *logline.LogLine, 10)
+		ta, err := New(lines, watcher.NewFakeWatcher(), WithMirrorWriter(&mirrored), WithMirrorFilename())
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		testutil.FatalIfErr(t, ta.Close())
+		// Close writes the lines buffered.
+		expected := logfile + ": a\r\n" + logfile + ": b\n"
+		if diff := testutil.Diff(expected, mirrored.String()); diff != "" {
+			t.Errorf("mirrored lines didn't match:\n%s", diff)
+		}
+	})
+
+	t.Run("slow writer", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "first\n")
+
+		w := &gatedWriter{writing: make(chan struct{}), release: make(chan struct{})}
+		lines := make(chan *logline.LogLine, 200)
+		ta, err := New(lines, watcher.NewFakeWatcher(), WithMirrorWriter(w))
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		<-w.writing
+
+		// Reading goes on while the writer is stuck, dropping the lines
+		// that don't fit in the buffer.
+		long := strings.Repeat("x", 1024)
+		for i := 0; i < 100; i++ {
+			testutil.WriteString(t, f, long+"\n")
+		}
+		testutil.FatalIfErr(t, ta.ForceRead(logfile))
+		testutil.CollectLines(t, lines, 101, collectTimeout)
+		fit := defaultMirrorBufferSize / (len(long) + 1)
+		if n := ta.metrics.mirrorDropped.Value(); n != int64(100-fit) {
+			t.Errorf("expected %d lines dropped, got %d", 100-fit, n)
+		}
+		close(w.release)
+		testutil.FatalIfErr(t, ta.Close())
+		if n := strings.Count(w.buf.String(), "\n"); n != 1+fit {
+			t.Errorf("expected %d lines mirrored, got %d", 1+fit, n)
+		}
+	})
+
+	t.Run("failing writer", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "a\nb\n")
+
+		w := &failingWriter{}
+		lines := make(chan *logline.LogLine, 10)
+		events := make(chan FileEvent, 10)
+		ta, err := New(lines, watcher.NewFakeWatcher(), WithMirrorWriter(w), WithFileEvents(events))
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		for failed := false; !failed; {
+			select {
+			case e := <-events:
+				if e.Type != MirrorFailed {
+					continue
+				}
+				if e.Err == nil {
+					t.Errorf("expected the write error, got %+v", e)
+				}
+				failed = true
+			case <-time.After(collectTimeout):
+				t.Fatal("expected a mirror failed event")
+			}
+		}
+
+		// The mirror is disabled, and lines are still sent.
+		testutil.WriteString(t, f, "c\n")
+		testutil.FatalIfErr(t, ta.ForceRead(logfile))
+		testutil.FatalIfErr(t, ta.Close())
+		if n := len(testutil.CollectAllLines(t, lines, collectTimeout)); n != 3 {
+			t.Errorf("expected 3 lines sent, got %d", n)
+		}
+		if n := atomic.LoadInt32(&w.writes); n != 1 {
+			t.Errorf("expected 1 write, got %d", n)
+		}
+		close(events)
+		for e := range events {
+			if e.Type == MirrorFailed {
+				t.Errorf("expected one mirror failed event, got another: %+v", e)
+			}
+		}
+	})
+}
+
+func TestReadPanic(t *testing.T) {
+	t.Run("recovers", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, "a\nboom\nb\n")
+
+		w := watcher.NewFakeWatcher()
+		lines := make(chan *logline.LogLine, 10)
+		events := make(chan FileEvent, 10)
+		ta, err := New(lines, w, WithFileEvents(events))
+		testutil.FatalIfErr(t, err)
+		defer ta.Close()
+		ta.transform = func(l *logline.LogLine) {
+			if l.Line == "boom" {
+				panic("boom")
+			}
+		}
+		// The first read panics while catching up, the second while following.
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		testutil.WriteString(t, f, "boom\nc\n")
+		w.InjectUpdate(logfile)
+		got := testutil.CollectLines(t, lines, 3, collectTimeout)
+		var text []string
+		for _, l := range got {
+			text = append(text, l.Line)
+		}
+		if diff := testutil.Diff([]string{"a", "b", "c"}, text); diff != "" {
+			t.Errorf("lines didn't match:\n%s", diff)
+		}
+		for panics := 0; panics < 2; {
+			select {
+			case e := <-events:
+				if e.Type != ReadPanicked {
+					continue
+				}
+				panics++
+				p, ok := e.Err.(*ErrReadPanic)
+				if !ok || p.Value != "boom" || p.Panics != 1 || p.GaveUp || len(p.Stack) == 0 {
+					t.Errorf("unexpected panic event: %+v", e)
+				}
+			case <-time.After(collectTimeout):
+				t.Fatal("expected a ReadPanicked event for each panic")
+			}
+		}
+		var n int64
+		ta.metrics.readPanics.Do(func(kv expvar.KeyValue) {
+			n += kv.Value.(*expvar.Int).Value()
+		})
+		if n != 2 {
+			t.Errorf("expected 2 panics counted, got %d", n)
+		}
+		if !ta.hasHandle(logfile) {
+			t.Error("expected the file to still be tailed")
+		}
+	})
+
+	t.Run("gives up", func(t *testing.T) {
+		tmpDir, rmTmpDir := testutil.TestTempDir(t)
+		defer rmTmpDir()
+		logfile := filepath.Join(tmpDir, "log")
+		f := testutil.TestOpenFile(t, logfile)
+		defer f.Close()
+		testutil.WriteString(t, f, strings.Repeat("boom\n", maxReadPanics+1))
+
+		clk := testutil.NewFakeClock(time.Now())
+		lines := make(chan *logline.LogLine, 10)
+		events := make(chan FileEvent, 10)
+		ta, err := New(lines, watcher.NewFakeWatcher(), WithClock(clk), WithFileEvents(events))
+		testutil.FatalIfErr(t, err)
+		defer ta.Close()
+		ta.transform = func(l *logline.LogLine) { panic(l.Line) }
+		done := make(chan error, 1)
+		go func() { done <- ta.TailPathWithPolicy(logfile, Beginning) }()
+		timeout := time.After(collectTimeout)
+		for panics := 0; panics < maxReadPanics; {
+			select {
+			case e := <-events:
+				if e.Type != ReadPanicked {
+					continue
+				}
+				panics++
+				if p := e.Err.(*ErrReadPanic); p.Panics != panics || p.GaveUp != (panics == maxReadPanics) {
+					t.Errorf("unexpected panic event: %+v", p)
+				}
+			case <-time.After(time.Millisecond):
+				clk.Advance(maxPanicRetryDelay)
+			case <-timeout:
+				t.Fatal("expected a ReadPanicked event for each panic")
+			}
+		}
+		if err := <-done; err == nil {
+			t.Error("expected an error tailing a file whose reads all panic")
+		}
+		if ta.hasHandle(logfile) {
+			t.Error("expected the file to stop being tailed")
+		}
+	})
+}
+
+func TestTailRetriesRefusedOpen(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\n")
+
+	lines := make(chan *logline.LogLine, 10)
+	ta, err := New(lines, watcher.NewFakeWatcher())
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	// Every try of the first open is refused, so it's tried again later.
+	restore := refuseOpens(4)
+	defer restore()
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	if ta.hasHandle(logfile) {
+		t.Fatal("expected the file not to be tailed yet")
+	}
+	got := testutil.CollectLines(t, lines, 1, collectTimeout)
+	if got[0].Line != "a" || !ta.hasHandle(logfile) {
+		t.Errorf("expected the file to be tailed once it could be opened, got %q", got[0].Line)
+	}
+}
+
+func TestConsumerStalled(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	if _, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithStallThreshold(0)); err == nil {
+		t.Error("expected an error for a zero stall threshold")
+	}
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent, 10)
+	ta, err := New(lines, w, WithClock(clk), WithStallThreshold(time.Minute), WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	testutil.WriteString(t, f, "a\n")
+	w.InjectUpdate(logfile)
+	deadline := time.Now().Add(collectTimeout)
+	for ta.Health().Consumer.Pending != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a send to be waiting")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := ta.Healthy(); err != nil {
+		t.Errorf("expected the tailer to be healthy before the threshold: %s", err)
+	}
+
+	awaitEvent := func(want FileEventType) FileEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != want {
+				t.Fatalf("expected a %s event, got %+v", want, e)
+			}
+			return e
+		case <-time.After(collectTimeout):
+			t.Fatalf("expected a %s event", want)
+		}
+		return FileEvent{}
+	}
+	clk.Advance(2 * time.Minute)
+	e := awaitEvent(ConsumerStalled)
+	var stalled *ErrConsumerStalled
+	if !errors.As(e.Err, &stalled) || stalled.Waiting <= time.Minute {
+		t.Errorf("expected the stall to be longer than a minute, got %v", e.Err)
+	}
+	if !errors.As(ta.Healthy(), &stalled) {
+		t.Errorf("expected the tailer to be unhealthy, got %v", ta.Healthy())
+	}
+	if s := ta.Stats().Consumer; !s.Stalled || s.Pending != 1 {
+		t.Errorf("expected a stalled send, got %+v", s)
+	}
+
+	// Taking the line ends the stall.
+	if l := <-lines; l.Line != "a" {
+		t.Errorf("expected line a, got %q", l.Line)
+	}
+	for ta.Health().Consumer.Pending != 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	clk.Advance(time.Minute)
+	awaitEvent(ConsumerResumed)
+	if err := ta.Healthy(); err != nil {
+		t.Errorf("expected the tailer to be healthy again: %s", err)
+	}
+	if n := ta.metrics.consumerStalls.Value(); n != 1 {
+		t.Errorf("expected 1 stall, got %d", n)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestReadErrorRetryAndReopen(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w, WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+	retried, reopened := expvarInt(&ta.metrics.readErrorRetried, logfile), expvarInt(&ta.metrics.readErrorReopened, logfile)
+
+	// Swap in a descriptor of the same file that can't be read, so that reads
+	// fail while the file looks fine.
+	testutil.FatalIfErr(t, ta.inRun(func() error {
+		fd, _ := ta.handleForPath(logfile)
+		wo, err := os.OpenFile(logfile, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		fd.file.Close()
+		fd.file = wo
+		return nil
+	}))
+	testutil.WriteString(t, f, "line\n")
+	w.InjectUpdateAndWait(logfile)
+
+	// awaitRetry waits until the tailer is waiting to read again.
+	awaitRetry := func() {
+		t.Helper()
+		deadline := time.Now().Add(collectTimeout)
+		for clk.Timers() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("not waiting to retry the read")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	awaitRetry()
+	clk.Advance(readRetryDelay)
+	awaitRetry()
+	// The third failure reopens the file, which reads the line.
+	clk.Advance(2 * readRetryDelay)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	testutil.FatalIfErr(t, ta.Close())
+
+	expected := []*logline.LogLine{{Filename: logfile, Line: "line"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if got := expvarInt(&ta.metrics.readErrorRetried, logfile) - retried; got != 2 {
+		t.Errorf("expected 2 retries, got %d", got)
+	}
+	if got := expvarInt(&ta.metrics.readErrorReopened, logfile) - reopened; got != 1 {
+		t.Errorf("expected 1 reopen, got %d", got)
+	}
+}
+
+func TestReadErrorStat(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+	defer w.Close()
+
+	gone := filepath.Join(dir, "gone")
+	f := testutil.TestOpenFile(t, gone)
+	f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(gone))
+	replaced := filepath.Join(dir, "replaced")
+	f = testutil.TestOpenFile(t, replaced)
+	f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(replaced))
+	deleted, rotated := expvarInt(&ta.metrics.readErrorDeleted, gone), expvarInt(&ta.metrics.readErrorRotated, replaced)
+
+	testutil.FatalIfErr(t, os.Remove(gone))
+	testutil.FatalIfErr(t, os.Rename(replaced, replaced+".1"))
+	f = testutil.TestOpenFile(t, replaced)
+	defer f.Close()
+	testutil.WriteString(t, f, "new\n")
+	testutil.FatalIfErr(t, ta.inRun(func() error {
+		for _, name := range []string{gone, replaced} {
+			fd, _ := ta.handleForPath(name)
+			ta.readFailed(fd, errors.New("read failed"))
+		}
+		return nil
+	}))
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	expected := []*logline.LogLine{{Filename: replaced, Line: "new", Generation: 1}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if ta.hasHandle(gone) {
+		t.Errorf("expected %q to be removed, got %+v", gone, ta.Stats())
+	}
+	if got := expvarInt(&ta.metrics.readErrorDeleted, gone) - deleted; got != 1 {
+		t.Errorf("expected 1 deleted read error, got %d", got)
+	}
+	if got := expvarInt(&ta.metrics.readErrorRotated, replaced) - rotated; got != 1 {
+		t.Errorf("expected 1 rotated read error, got %d", got)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	events := make(chan FileEvent, 10)
+	ta, err := New(lines, w, WithClock(clk), WithFileEvents(events), WithCircuitBreaker(2, time.Minute, 90*time.Second))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// Swap in a descriptor that can't be read, until it's reopened.
+	testutil.FatalIfErr(t, ta.inRun(func() error {
+		fd, _ := ta.handleForPath(logfile)
+		wo, err := os.OpenFile(logfile, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		fd.file.Close()
+		fd.file = wo
+		return nil
+	}))
+	testutil.WriteString(t, f, "line\n")
+	w.InjectUpdateAndWait(logfile)
+
+	awaitEvent := func(want FileEventType) FileEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Type != want || e.Pathname != logfile {
+				t.Fatalf("expected a %s event for %s, got %+v", want, logfile, e)
+			}
+			return e
+		case <-time.After(collectTimeout):
+			t.Fatalf("no %s event", want)
+		}
+		return FileEvent{}
+	}
+
+	// The second failed read, retried after a delay, opens the breaker.
+	deadline := time.Now().Add(collectTimeout)
+	for clk.Timers() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("not waiting to retry the read")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := ta.Stats().Breakers[logfile]; got.State != CircuitClosed || got.Op != "read" || got.Failures != 1 {
+		t.Errorf("after one failure, got breaker %+v", got)
+	}
+	clk.Advance(readRetryDelay)
+	if e := awaitEvent(BreakerOpen); e.Err == nil || !e.Retry.Equal(clk.Now().Add(time.Minute)) {
+		t.Errorf("expected an error and a retry in a minute, got %+v", e)
+	}
+
+	// Events are skipped while it's open.
+	w.InjectUpdateAndWait(logfile)
+	w.InjectUpdateAndWait(logfile)
+	deadline = time.Now().Add(collectTimeout)
+	for expvarInt(&ta.metrics.breakerSkipped, logfile) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	got := ta.Stats().Breakers[logfile]
+	if got.State != CircuitOpen || got.Failures != 2 || got.Trips != 1 || got.CoolOff != time.Minute || got.Skipped != 2 {
+		t.Errorf("while open, got breaker %+v", got)
+	}
+	if n := expvarInt(&ta.metrics.breakerSkipped, logfile); n != 2 {
+		t.Errorf("expected 2 skipped reads, got %d", n)
+	}
+
+	// After the cool-off, the read fails again and it's open for longer, up
+	// to the max.  That failure reopens the file.
+	clk.Advance(time.Minute)
+	awaitEvent(BreakerHalfOpen)
+	if e := awaitEvent(BreakerOpen); !e.Retry.Equal(clk.Now().Add(90 * time.Second)) {
+		t.Errorf("expected a retry in 90s, got %+v", e)
+	}
+	if got := ta.Stats().Breakers[logfile]; got.State != CircuitOpen || got.Trips != 2 || got.CoolOff != 90*time.Second {
+		t.Errorf("after failing half-open, got breaker %+v", got)
+	}
+
+	// Now the read succeeds, which closes it.
+	clk.Advance(90 * time.Second)
+	awaitEvent(BreakerHalfOpen)
+	awaitEvent(BreakerClosed)
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	expected := []*logline.LogLine{{Filename: logfile, Line: "line"}}
+	if diff := testutil.Diff(expected, result); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+	if got, ok := ta.Stats().Breakers[logfile]; ok {
+		t.Errorf("expected no breaker in Stats once closed, got %+v", got)
+	}
+	if n := expvarInt(&ta.metrics.breakerTrips, logfile); n != 2 {
+		t.Errorf("expected 2 trips, got %d", n)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+
+	if _, err := New(lines, w, WithCircuitBreaker(0, time.Second, time.Second)); err == nil {
+		t.Error("expected an error for a breaker that never opens")
+	}
+}
+
+func TestErrorHistory(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w := watcher.NewFakeWatcher()
+	lines := make(chan *logline.LogLine, 1)
+	ta, err := New(lines, w, WithClock(clk), WithErrorHistory(2))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// Swap in a descriptor that can't be read, until it's reopened.
+	testutil.FatalIfErr(t, ta.inRun(func() error {
+		fd, _ := ta.handleForPath(logfile)
+		wo, err := os.OpenFile(logfile, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		fd.file.Close()
+		fd.file = wo
+		return nil
+	}))
+	testutil.WriteString(t, f, "line\n")
+	start := clk.Now()
+	w.InjectUpdateAndWait(logfile)
+
+	// The read is retried twice before the file is reopened.
+	for _, delay := range []time.Duration{readRetryDelay, 2 * readRetryDelay} {
+		deadline := time.Now().Add(collectTimeout)
+		for clk.Timers() == 0 {
+			if time.Now().After(deadline) {
+				t.Fatal("not waiting to retry the read")
+			}
+			time.Sleep(time.Millisecond)
+		}
+		clk.Advance(delay)
+	}
+	testutil.CollectLines(t, lines, 1, collectTimeout)
+
+	// Only the last two of the three failures are kept.
+	errs := ta.Stats().Errors[logfile]
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got %+v", errs)
+	}
+	for i, at := range []time.Time{start.Add(readRetryDelay), start.Add(3 * readRetryDelay)} {
+		if !errs[i].Time.Equal(at) || errs[i].Op != "read" || errs[i].Err == nil {
+			t.Errorf("expected a read failure at %s, got %+v", at, errs[i])
+		}
+	}
+	var b bytes.Buffer
+	testutil.FatalIfErr(t, ta.WriteStatusHTML(&b))
+	if n := strings.Count(b.String(), " read: "); n != 2 {
+		t.Errorf("expected 2 errors in the status page, got %d:\n%s", n, b.String())
+	}
+
+	testutil.FatalIfErr(t, ta.ResetErrors(logfile))
+	if errs := ta.Stats().Errors[logfile]; errs != nil {
+		t.Errorf("expected no errors once reset, got %+v", errs)
+	}
+	if err := ta.ResetErrors(filepath.Join(tmpDir, "untailed")); err == nil {
+		t.Error("expected an error resetting a path that isn't tailed")
+	}
+}
+
+func TestErrorHistoryRing(t *testing.T) {
+	h := &errorHistory{size: 3}
+	if s := h.snapshot(); s != nil {
+		t.Errorf("expected no errors, got %+v", s)
+	}
+	for i := 0; i < 5; i++ {
+		h.add(FileError{Op: strconv.Itoa(i)})
+	}
+	var ops []string
+	for _, e := range h.snapshot() {
+		ops = append(ops, e.Op)
+	}
+	if diff := testutil.Diff([]string{"2", "3", "4"}, ops); diff != "" {
+		t.Errorf("errors didn't match:\n%s", diff)
+	}
+	if cap(h.errs) != 3 {
+		t.Errorf("expected the buffer to stay at 3, got %d", cap(h.errs))
+	}
+	h.reset()
+	h.add(FileError{Op: "5"})
+	if s := h.snapshot(); len(s) != 1 || s[0].Op != "5" {
+		t.Errorf("expected only the error since the reset, got %+v", s)
+	}
+	var none *errorHistory
+	none.add(FileError{})
+	none.reset()
+	if s := none.snapshot(); s != nil {
+		t.Errorf("expected no errors from a nil history, got %+v", s)
+	}
+}
+
+func TestShardedOutput(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	lines := make(chan *logline.LogLine)
+	if _, err := New(lines, watcher.NewFakeWatcher(), WithShardedOutput(2)); err == nil {
+		t.Error("expected an error sharding lines sent to a Lines channel")
+	}
+	if _, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), Options: []Option{WithShardedOutput(0)}}); err == nil {
+		t.Error("expected an error with no shards")
+	}
+
+	w := watcher.NewFakeWatcher()
+	ta, err := NewFromConfig(Config{Watcher: w, Options: []Option{WithShardedOutput(3)}})
+	testutil.FatalIfErr(t, err)
+	if ta.Shard(3) != nil {
+		t.Error("expected no channel for a shard out of range")
+	}
+	results := make([][]*logline.LogLine, 3)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for l := range ta.Shard(i) {
+				results[i] = append(results[i], l)
+			}
+		}(i)
+	}
+
+	var logfiles []string
+	for i := 0; i < 8; i++ {
+		logfile := filepath.Join(tmpDir, fmt.Sprintf("log%d", i))
+		f := testutil.TestOpenFile(t, logfile)
+		testutil.WriteString(t, f, "1\n2\n")
+		f.Close()
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		logfiles = append(logfiles, logfile)
+	}
+	shards := ta.Stats().Shards
+
+	// A rotated file keeps its shard.
+	testutil.FatalIfErr(t, os.Rename(logfiles[0], logfiles[0]+".1"))
+	f := testutil.TestOpenFile(t, logfiles[0])
+	testutil.WriteString(t, f, "3\n")
+	f.Close()
+	w.InjectUpdateAndWait(logfiles[0])
+	testutil.FatalIfErr(t, ta.Close())
+	wg.Wait()
+
+	for _, logfile := range logfiles {
+		key, err := canonicalPath(logfile)
+		testutil.FatalIfErr(t, err)
+		shard, ok := shards[key]
+		if !ok {
+			t.Fatalf("no shard for %q in %v", key, shards)
+		}
+		expected := []string{"1", "2"}
+		if logfile == logfiles[0] {
+			expected = append(expected, "3")
+		}
+		for i, result := range results {
+			got := []string{}
+			for _, l := range result {
+				if l.Filename == logfile {
+					got = append(got, l.Line)
+				}
+			}
+			want := expected
+			if i != shard {
+				want = []string{}
+			}
+			if diff := testutil.Diff(want, got); diff != "" {
+				t.Errorf("lines of %s on shard %d (of %d) didn't match:\n%s", logfile, i, shard, diff)
+			}
+		}
+	}
+}
+
+// plainWatcher hides the EventSequencer methods of the Watcher it wraps.
+type plainWatcher struct {
+	watcher.Watcher
+}
+
+func TestWaitForEvents(t *testing.T) {
+	ta, lines, w, dir, cleanup := makeTestTail(t)
+	defer cleanup()
+
+	logfile := filepath.Join(dir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.FatalIfErr(t, ta.TailPath(logfile))
+
+	// The line has been read by the time WaitForEvents returns.
+	testutil.WriteString(t, f, "waited\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+	if len(lines) != 1 {
+		t.Fatalf("expected the line to have been read")
+	}
+	<-lines
+
+	// Or by the time an injection returns, if it waits to be acknowledged.
+	w.SetAwaitAck(true)
+	testutil.WriteString(t, f, "acked\n")
+	w.InjectUpdate(logfile)
+	if len(lines) != 1 {
+		t.Fatalf("expected the line to have been read")
+	}
+	if l := <-lines; l.Line != "acked" {
+		t.Errorf("expected the line acked, got %q", l.Line)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	testutil.FatalIfErr(t, ta.WaitForEvents(context.Background()))
+
+	ta, err := New(make(chan *logline.LogLine), plainWatcher{watcher.NewFakeWatcher()})
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	if err := ta.WaitForEvents(context.Background()); err == nil {
+		t.Error("expected an error waiting on a watcher that doesn't count events")
+	}
+}
+
+func TestAckedOffsets(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := filepath.Join(tmpDir, "registry")
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\nc\n")
+	key, err := canonicalPath(logfile)
+	testutil.FatalIfErr(t, err)
+
+	if _, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithAckedOffsets(2)); err == nil {
+		t.Error("expected an error acknowledging offsets without a registry")
+	}
+
+	lines := make(chan *logline.LogLine, 3)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithRegistry(reg, RegistryByPath), WithAckedOffsets(2))
+	testutil.FatalIfErr(t, err)
+	tailed := make(chan error)
+	go func() {
+		tailed <- ta.TailPathWithPolicy(logfile, Beginning)
+	}()
+	result := testutil.CollectLines(t, lines, 2, collectTimeout)
+	if s := ta.Stats(); s.Unacked[key] != 2 {
+		t.Errorf("expected 2 lines unacknowledged, got %v", s.Unacked)
+	}
+
+	// The third line waits for the first to be acknowledged.
+	result[1].Ack()
+	select {
+	case l := <-lines:
+		t.Fatalf("line %q sent with the window full", l.Line)
+	case <-time.After(10 * time.Millisecond):
+	}
+	result[0].Ack()
+	result[0].Ack()
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, <-tailed)
+	testutil.FatalIfErr(t, ta.Close())
+
+	// The line not acknowledged is read again.
+	w := watcher.NewFakeWatcher()
+	lines = make(chan *logline.LogLine, 2)
+	ta, err = New(lines, w, WithRegistry(reg, RegistryByPath), WithAckedOffsets(1))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	// Closing doesn't wait for d to be acknowledged before sending it, and
+	// it's read again too.
+	testutil.WriteString(t, f, "d\n")
+	w.InjectUpdate(logfile)
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
+
+	lines = make(chan *logline.LogLine, 2)
+	ta, err = New(lines, watcher.NewFakeWatcher(), WithRegistry(reg, RegistryByPath))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	testutil.FatalIfErr(t, ta.Close())
+	result = append(result, testutil.CollectAllLines(t, lines, collectTimeout)...)
+	var got []string
+	for _, l := range result {
+		got = append(got, l.Line)
+	}
+	if diff := testutil.Diff([]string{"a", "b", "c", "c", "d", "c", "d"}, got); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestDeliveryModeValidation(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := WithRegistry(filepath.Join(tmpDir, "registry"), RegistryByPath)
+	for _, tc := range []struct {
+		name   string
+		config Config
+	}{
+		{"unknown mode", Config{Options: []Option{WithDeliveryMode(DeliveryMode(7))}}},
+		{"at most once without a registry", Config{Options: []Option{WithDeliveryMode(AtMostOnce)}}},
+		{"at least once without a registry", Config{Options: []Option{WithDeliveryMode(AtLeastOnce)}}},
+		{"at least once with fan out", Config{FanOut: true, Options: []Option{reg, WithDeliveryMode(AtLeastOnce)}}},
+		{"acked offsets at most once", Config{Options: []Option{reg, WithAckedOffsets(2), WithDeliveryMode(AtMostOnce)}}},
+		{"acked offsets best effort", Config{Options: []Option{reg, WithDeliveryMode(BestEffort), WithAckedOffsets(2)}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.config.Watcher = watcher.NewFakeWatcher()
+			if _, err := NewFromConfig(tc.config); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestAtMostOnce(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	reg := filepath.Join(tmpDir, "registry")
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\npart")
+
+	lines := make(chan *logline.LogLine)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithRegistry(reg, RegistryByPath), WithDeliveryMode(AtMostOnce))
+	testutil.FatalIfErr(t, err)
+	tailed := make(chan error)
+	go func() {
+		tailed <- ta.TailPathWithPolicy(logfile, Beginning)
+	}()
+
+	// The registry is saved past both lines before the first is received.
+	result := testutil.CollectLines(t, lines, 1, collectTimeout)
+	c, err := readRegistry(reg)
+	testutil.FatalIfErr(t, err)
+	if len(c.entries) != 1 || c.entries[logfile] == nil || c.entries[logfile].Offset != 4 {
+		t.Errorf("expected the registry saved at offset 4, got %+v", c.entries)
+	}
+	result = append(result, testutil.CollectLines(t, lines, 1, collectTimeout)...)
+	testutil.FatalIfErr(t, <-tailed)
+	testutil.FatalIfErr(t, ta.Close())
+	if diff := testutil.Diff([]string{"a", "b"}, []string{result[0].Line, result[1].Line}); diff != "" {
+		t.Errorf("result didn't match:\n%s", diff)
+	}
+}
+
+func TestAtLeastOnceReader(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\n")
+	key, err := canonicalPath(logfile)
+	testutil.FatalIfErr(t, err)
+
+	ta, err := NewFromConfig(Config{Watcher: watcher.NewFakeWatcher(), Options: []Option{WithRegistry(filepath.Join(tmpDir, "registry"), RegistryByPath), WithDeliveryMode(AtLeastOnce)}})
+	testutil.FatalIfErr(t, err)
+	dropping := NewReader(ta, WithReaderBuffer(4, OverflowDropNewest))
+	if _, err := dropping.Read(make([]byte, 4)); err == nil || err == io.EOF {
+		t.Errorf("expected an error from a reader that drops lines, got %v", err)
+	}
+	testutil.FatalIfErr(t, dropping.Close())
+
+	// Lines are acknowledged as they're read.
+	r := NewReader(ta)
+	testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+	b := make([]byte, 4)
+	_, err = io.ReadFull(r, b)
+	testutil.FatalIfErr(t, err)
+	if s := ta.Stats(); s.Unacked[key] != 0 {
+		t.Errorf("expected every line acknowledged, got %v", s.Unacked)
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	testutil.FatalIfErr(t, r.Close())
+	if string(b) != "a\nb\n" {
+		t.Errorf("expected %q, got %q", "a\nb\n", b)
+	}
+}
+
+// expvarRuns numbers the prefixes given by testExpvarPrefix.
+var expvarRuns int64
+
+// testExpvarPrefix returns a prefix to publish a test's expvars under that
+// no other run of it in the process has used.
+func testExpvarPrefix(t *testing.T) string {
+	return fmt.Sprintf("%s_%d_", t.Name(), atomic.AddInt64(&expvarRuns, 1))
+}
+
+func TestTailerExpvar(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "a\nb\n")
+
+	// Each Tailer counts its own lines, and only the one with WithExpvar
+	// publishes them.
+	prefix := testExpvarPrefix(t)
+	var tailers []*Tailer
+	for _, opts := range [][]Option{{WithExpvar(prefix)}, nil} {
+		lines := make(chan *logline.LogLine, 2)
+		ta, err := New(lines, watcher.NewFakeWatcher(), opts...)
+		testutil.FatalIfErr(t, err)
+		testutil.FatalIfErr(t, ta.TailPathWithPolicy(logfile, Beginning))
+		testutil.CollectLines(t, lines, 2, collectTimeout)
+		testutil.FatalIfErr(t, ta.Close())
+		tailers = append(tailers, ta)
+	}
+	for i, ta := range tailers {
+		if got := expvarInt(&ta.metrics.lineCount, logfile); got != 2 {
+			t.Errorf("tailer %d: expected 2 lines counted, got %d", i, got)
+		}
+	}
+	published, ok := expvar.Get(prefix + "log_lines_total").(*expvar.Map)
+	if !ok || published != &tailers[0].metrics.lineCount {
+		t.Errorf("expected the first tailer's lines published, got %v", expvar.Get(prefix+"log_lines_total"))
+	}
+
+	if _, err := New(make(chan *logline.LogLine), watcher.NewFakeWatcher(), WithExpvar(prefix)); err == nil {
+		t.Error("expected an error publishing the same names twice")
+	}
+}
+
+// collectSpooled receives lines and FileEvents from a spool until n EOF or
+// Failed events have been sent, and returns the lines.
+func collectSpooled(t *testing.T, lines <-chan *logline.LogLine, events <-chan FileEvent, n int) ([]string, []FileEvent) {
+	t.Helper()
+	var got []string
+	var ended []FileEvent
+	timeout := time.After(collectTimeout)
+	for len(ended) < n {
+		select {
+		case l := <-lines:
+			got = append(got, l.Line)
+		case e := <-events:
+			if e.Type == EOF || e.Type == Failed {
+				ended = append(ended, e)
+			}
+		case <-timeout:
+			t.Fatalf("timed out with lines %q and events %v", got, ended)
+		}
+	}
+	return got, ended
+}
+
+// awaitGone waits for pathname to be removed.
+func awaitGone(t *testing.T, pathname string) {
+	t.Helper()
+	deadline := time.Now().Add(collectTimeout)
+	for {
+		if _, err := os.Stat(pathname); os.IsNotExist(err) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q wasn't removed", pathname)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSpoolDirDeletes(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "a.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("1\n2\n3"), 0600))
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithQuiescence(10*time.Millisecond)))
+
+	got, ended := collectSpooled(t, lines, events, 1)
+	if diff := testutil.Diff([]string{"1", "2", "3"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	if ended[0].Type != EOF || ended[0].Lines != 3 {
+		t.Errorf("want an EOF event after 3 lines, got %+v", ended[0])
+	}
+	awaitGone(t, logfile)
+}
+
+func TestSpoolDirTempSuffix(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	w := watcher.NewFakeWatcher()
+	ta, err := New(lines, w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithTempSuffix(".tmp"), WithDoneDir("done"), WithQuiescence(10*time.Millisecond)))
+
+	tmp := filepath.Join(tmpDir, "a.log.tmp")
+	testutil.FatalIfErr(t, ioutil.WriteFile(tmp, []byte("1\n"), 0600))
+	w.InjectCreateAndWait(tmp)
+	select {
+	case l := <-lines:
+		t.Fatalf("read %q from a file with the temporary suffix", l.Line)
+	default:
+	}
+
+	logfile := filepath.Join(tmpDir, "a.log")
+	testutil.FatalIfErr(t, os.Rename(tmp, logfile))
+	w.InjectCreate(logfile)
+	got, _ := collectSpooled(t, lines, events, 1)
+	if diff := testutil.Diff([]string{"1"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	awaitGone(t, logfile)
+	b, err := ioutil.ReadFile(filepath.Join(tmpDir, "done", "a.log"))
+	testutil.FatalIfErr(t, err)
+	if string(b) != "1\n" {
+		t.Errorf("moved file has %q", b)
+	}
+}
+
+func TestSpoolDirFailureKeepsFile(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "a.bin")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("\x00\x01\x02\x03"), 0600))
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithFileEvents(events), WithBinaryDetection(nil))
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithQuiescence(10*time.Millisecond)))
+
+	_, ended := collectSpooled(t, lines, events, 1)
+	if ended[0].Type != Failed || ended[0].Err == nil {
+		t.Errorf("want a Failed event, got %+v", ended[0])
+	}
+	testutil.FatalIfErr(t, ta.Close())
+	if _, err := os.Stat(logfile); err != nil {
+		t.Errorf("file that failed to be read was removed: %s", err)
+	}
+}
+
+func TestSpoolDirRecovery(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	done := filepath.Join(tmpDir, "done.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(done, []byte("old\n"), 0600))
+	journal, err := json.Marshal(spoolJournal{Completed: map[string]int64{"done.log": 4}})
+	testutil.FatalIfErr(t, err)
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, spoolJournalName), journal, 0600))
+	pending := filepath.Join(tmpDir, "pending.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(pending, []byte("new\n"), 0600))
+
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithQuiescence(10*time.Millisecond)))
+
+	got, ended := collectSpooled(t, lines, events, 1)
+	if diff := testutil.Diff([]string{"new"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	if ended[0].Pathname != pending {
+		t.Errorf("want EOF for %q, got %+v", pending, ended[0])
+	}
+	awaitGone(t, done)
+	awaitGone(t, pending)
+}
+
+func TestSpoolDirDoneSuffix(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	logfile := filepath.Join(tmpDir, "a.log")
+	testutil.FatalIfErr(t, ioutil.WriteFile(logfile, []byte("1\n"), 0600))
+	testutil.FatalIfErr(t, ioutil.WriteFile(filepath.Join(tmpDir, "b.log.done"), []byte("old\n"), 0600))
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	ta, err := New(lines, watcher.NewFakeWatcher(), WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithDoneSuffix(".done"), WithQuiescence(10*time.Millisecond)))
+
+	got, _ := collectSpooled(t, lines, events, 1)
+	if diff := testutil.Diff([]string{"1"}, got); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	awaitGone(t, logfile)
+	if _, err := os.Stat(logfile + ".done"); err != nil {
+		t.Errorf("file wasn't marked done: %s", err)
+	}
+	testutil.FatalIfErr(t, ta.AddPatternWithPolicy(filepath.Join(tmpDir, "*"), Beginning))
+	if ta.hasHandle(logfile+".done") || ta.hasHandle(filepath.Join(tmpDir, "b.log.done")) {
+		t.Errorf("done files tailed as matches of a pattern: %+v", ta.Stats())
+	}
+	for name, want := range map[string]int64{"processed": 1, "renamed": 1, "skipped_done": 1} {
+		m := ta.metrics.vars()["log_spool_files_"+name+"_total"].(*expvar.Map)
+		if got := expvarInt(m, tmpDir); got != want {
+			t.Errorf("%s: got %d, want %d", name, got, want)
+		}
+	}
+}
+
+func TestSpoolDirStillWriting(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	lines := make(chan *logline.LogLine)
+	events := make(chan FileEvent)
+	w := watcher.NewFakeWatcher()
+	ta, err := New(lines, w, WithFileEvents(events))
+	testutil.FatalIfErr(t, err)
+	defer ta.Close()
+	testutil.FatalIfErr(t, ta.AddSpoolDir(tmpDir, WithTempSuffix(".tmp"), WithDoneSuffix(".done"), WithQuiescence(300*time.Millisecond)))
+
+	logfile := filepath.Join(tmpDir, "a.log")
+	f := testutil.TestOpenFile(t, logfile)
+	defer f.Close()
+	testutil.WriteString(t, f, "1\n")
+	w.InjectCreate(logfile)
+	got, _ := collectSpooled(t, lines, events, 1)
+	// The writer isn't done with it after all.
+	testutil.WriteString(t, f, "2\n")
+	w.InjectUpdate(logfile)
+	more, _ := collectSpooled(t, lines, events, 1)
+	if diff := testutil.Diff([]string{"1", "2"}, append(got, more...)); diff != "" {
+		t.Errorf("lines differ:\n%s", diff)
+	}
+	awaitGone(t, logfile)
+	b, err := ioutil.ReadFile(logfile + ".done")
+	testutil.FatalIfErr(t, err)
+	if string(b) != "1\n2\n" {
+		t.Errorf("done file has %q", b)
 	}
-	ta.handlesMu.RUnlock()
-	log.DefaultLogger.Info("good")
 }
@@ -0,0 +1,100 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// tombstoneTTL is how long the events for a file that has stopped being
+// tailed by Untail or RemovePattern are dropped.
+const tombstoneTTL = time.Minute
+
+// tombstone records a file that stopped being tailed by Untail or
+// RemovePattern.  Events for its path may already be queued in the watcher
+// or the Tailer when it's untailed; those are dropped while the file at the
+// path is still the one untailed, rather than being taken for a new file to
+// tail.  A new file at the path, the next generation, is handled as usual.
+type tombstone struct {
+	file       os.FileInfo // The file that was open
+	generation int         // Its generation
+	at         time.Time   // When it was untailed
+}
+
+// bury records a tombstone for fd, which is about to stop being tailed, and
+// forgets those that have expired.
+func (t *Tailer) bury(fd *File) {
+	fi, err := fd.file.Stat()
+	if err != nil {
+		return
+	}
+	now := t.clock.Now()
+	t.tombstonesMu.Lock()
+	defer t.tombstonesMu.Unlock()
+	for p, ts := range t.tombstones {
+		if now.Sub(ts.at) > tombstoneTTL {
+			delete(t.tombstones, p)
+		}
+	}
+	t.tombstones[fd.Pathname] = tombstone{fi, fd.generation, now}
+}
+
+// exhume forgets the tombstone for pathname, as it's being tailed again.
+func (t *Tailer) exhume(pathname string) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return
+	}
+	t.tombstonesMu.Lock()
+	delete(t.tombstones, absPath)
+	t.tombstonesMu.Unlock()
+}
+
+// buried indicates if an event for pathname, which has no handle, is for a
+// file that has been untailed, and so is to be dropped.  It is counted if
+// it is.  The tombstone is forgotten once it has expired or there's another
+// file at the path.
+func (t *Tailer) buried(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.tombstonesMu.Lock()
+	ts, ok := t.tombstones[absPath]
+	if ok && t.clock.Now().Sub(ts.at) > tombstoneTTL {
+		delete(t.tombstones, absPath)
+		ok = false
+	}
+	t.tombstonesMu.Unlock()
+	if !ok {
+		return false
+	}
+	// An event for a path that's gone is for the untailed file's removal.
+	if fi, err := watcher.StatExtended(absPath); err == nil && !os.SameFile(fi, ts.file) {
+		t.logger.With(map[string]interface{}{"path": absPath}).Debugf("New file at %s, untailed at generation %d", absPath, ts.generation)
+		t.tombstonesMu.Lock()
+		if cur, ok := t.tombstones[absPath]; ok && cur.at.Equal(ts.at) {
+			delete(t.tombstones, absPath)
+		}
+		t.tombstonesMu.Unlock()
+		return false
+	}
+	t.metrics.untailedDropped.Add(1)
+	return true
+}
+
+// expireTombstones forgets the tombstones of files untailed before cutoff.
+func (t *Tailer) expireTombstones(cutoff time.Time) {
+	t.tombstonesMu.Lock()
+	defer t.tombstonesMu.Unlock()
+	for p, ts := range t.tombstones {
+		if ts.at.Before(cutoff) {
+			delete(t.tombstones, p)
+		}
+	}
+}
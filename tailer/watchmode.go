@@ -0,0 +1,88 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"path/filepath"
+
+	"github.com/pkg/errors"
+
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// PathOption configures a path given to TailPath or TailPathWithPolicy, or
+// a pattern given to AddPattern, TailPattern or AddPatternWithPolicy.
+type PathOption func(*pathOptions) error
+
+// pathOptions are the settings of a path or pattern given PathOptions.
+type pathOptions struct {
+	archives *archiveBackfill  // Reads each match's archives before tailing it, if not nil
+	suffixes []string          // Archive name suffixes, if not the defaults
+	mode     watcher.WatchMode // How the watcher finds changes to the path
+	skip     []string          // Globs of the archives a pattern skips, if not the defaults
+	stop     *stopPattern      // Stops tailing at a matching line, if not nil
+}
+
+// WithWatchMode asks the watcher to find changes to the path, or the files
+// matching the pattern and the directory they're in, as mode says, such as
+// watcher.ModePoll for a path on an NFS mount.  The watcher returns an error
+// if it isn't using a source that mode needs.  A path that's already being
+// watched, such as a directory shared with another pattern, keeps the mode
+// it was first watched with.
+func WithWatchMode(mode watcher.WatchMode) PathOption {
+	return func(o *pathOptions) error {
+		if mode < watcher.ModeDefault || mode > watcher.ModeBoth {
+			return errors.Errorf("invalid watch mode %s", mode)
+		}
+		o.mode = mode
+		return nil
+	}
+}
+
+// newPathOptions applies opts, given for a path rather than a pattern.
+func newPathOptions(opts []PathOption) (*pathOptions, error) {
+	o := &pathOptions{}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.archives != nil || o.suffixes != nil {
+		return nil, errors.New("archive backfill can only be given to TailPattern and AddPatternWithPolicy")
+	}
+	if o.skip != nil {
+		return nil, errors.New("archive skip patterns can only be given for a pattern")
+	}
+	return o, nil
+}
+
+// setWatchMode records that the watches for absPath, and for the files in it
+// if it's a pattern's directory, are added with mode.
+func (t *Tailer) setWatchMode(absPath string, mode watcher.WatchMode) {
+	if mode == watcher.ModeDefault {
+		return
+	}
+	t.watchModesMu.Lock()
+	t.watchModes[absPath] = mode
+	t.watchModesMu.Unlock()
+}
+
+// watchOptions returns the options to watch pathname with: the mode given
+// for it, or else for the directory it's in.
+func (t *Tailer) watchOptions(pathname string) []watcher.AddOption {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return nil
+	}
+	t.watchModesMu.Lock()
+	defer t.watchModesMu.Unlock()
+	mode, ok := t.watchModes[absPath]
+	if !ok {
+		mode, ok = t.watchModes[filepath.Dir(absPath)]
+	}
+	if !ok {
+		return nil
+	}
+	return []watcher.AddOption{mode}
+}
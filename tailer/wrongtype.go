@@ -0,0 +1,112 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package tailer
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/sgtsquiggs/tail/logline"
+	"github.com/sgtsquiggs/tail/watcher"
+)
+
+// replaced stops tailing fd, whose path has been replaced by something of
+// type mode that isn't a file, such as a directory, once it's been read up
+// to its end.
+func (t *Tailer) replaced(fd *File, mode os.FileMode) {
+	t.removeDeleted(fd)
+	t.markWrongType(fd.Pathname, mode)
+}
+
+// markWrongType records that pathname, tailed as a file, is now something
+// of type mode, so that it isn't tailed until it's a file again, rather than
+// failing every time it's read.  With WithSpecialFiles, a directory that has
+// replaced a path given to TailPath is tailed as TailPath tails directories
+// instead.
+func (t *Tailer) markWrongType(pathname string, mode os.FileMode) {
+	mode &= os.ModeType
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		t.logger.Info(err)
+		return
+	}
+	logger := t.logger.With(map[string]interface{}{"path": absPath})
+	if t.specialFiles && mode.IsDir() && t.givenToTailPath(absPath) {
+		logger.Infof("%s has been replaced by a directory, tailing the files in it", absPath)
+		if err := t.tailDirectory(absPath); err != nil {
+			logger.Info(err)
+		}
+		return
+	}
+	t.wrongTypeMu.Lock()
+	_, was := t.wrongType[absPath]
+	t.wrongType[absPath] = mode
+	t.wrongTypeMu.Unlock()
+	if was {
+		return
+	}
+	t.metrics.wrongType.Add(logline.SafeFilename(absPath), 1)
+	logger.Warningf("Not tailing %s, which has been replaced by something that isn't a file (mode %v)", absPath, mode)
+	t.sendEvent(FileEvent{Type: WrongType, Name: t.reportedName(pathname, absPath), Pathname: absPath, Err: &ErrNotRegularFile{Pathname: absPath, Mode: mode}})
+}
+
+// givenToTailPath indicates if absPath is tailed for TailPath.
+func (t *Tailer) givenToTailPath(absPath string) bool {
+	key, err := t.pathKey(absPath)
+	if err != nil {
+		return false
+	}
+	t.refsMu.Lock()
+	defer t.refsMu.Unlock()
+	_, ok := t.refs[key][""]
+	return ok
+}
+
+// wasReplaced indicates if pathname isn't tailed because it was replaced by
+// something that isn't a file, and is still tailed for a pattern or
+// TailPath.
+func (t *Tailer) wasReplaced(pathname string) bool {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return false
+	}
+	t.wrongTypeMu.Lock()
+	_, ok := t.wrongType[absPath]
+	t.wrongTypeMu.Unlock()
+	if ok && !t.isRegistered(absPath) {
+		t.wrongTypeMu.Lock()
+		delete(t.wrongType, absPath)
+		t.wrongTypeMu.Unlock()
+		return false
+	}
+	return ok
+}
+
+// recheckType tails pathname, which was replaced by something that isn't a
+// file, from its start if it's now a file again.
+func (t *Tailer) recheckType(pathname string) {
+	absPath, err := filepath.Abs(pathname)
+	if err != nil {
+		return
+	}
+	fi, err := watcher.StatExtended(absPath)
+	if err == nil && !fi.Mode().IsRegular() {
+		t.wrongTypeMu.Lock()
+		t.wrongType[absPath] = fi.Mode() & os.ModeType
+		t.wrongTypeMu.Unlock()
+		t.logger.Debugf("%s still isn't a file", absPath)
+		return
+	}
+	t.wrongTypeMu.Lock()
+	delete(t.wrongType, absPath)
+	t.wrongTypeMu.Unlock()
+	if err != nil {
+		// Gone; it's tailed as a deleted file would be when it's created.
+		return
+	}
+	t.logger.With(map[string]interface{}{"path": absPath}).Infof("%s is a file again", absPath)
+	if err := t.openLogPath(absPath, Beginning); err != nil {
+		t.limitedLog("open", absPath).Infof("Failed to tail %q: %s", absPath, err)
+	}
+}
@@ -0,0 +1,118 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package testutil
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+)
+
+// FakeClock is a clock.Clock whose time only moves when Advance is called.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*fakeTimer
+	tickers []*fakeTicker
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	c        chan time.Time
+}
+
+type fakeTicker struct {
+	clock  *FakeClock
+	period time.Duration
+	next   time.Time
+	c      chan time.Time
+}
+
+// NewFakeClock returns a FakeClock set to now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the fake time.
+func (f *FakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// After returns a channel that receives the fake time once it has been
+// advanced by at least d.
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTimer{f.now.Add(d), make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- f.now
+		return t.c
+	}
+	f.timers = append(f.timers, t)
+	return t.c
+}
+
+// NewTicker returns a Ticker that ticks each time the fake time is advanced
+// past a multiple of d.  Like time.Ticker, ticks are dropped if the receiver
+// falls behind.
+func (f *FakeClock) NewTicker(d time.Duration) clock.Ticker {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t := &fakeTicker{f, d, f.now.Add(d), make(chan time.Time, 1)}
+	f.tickers = append(f.tickers, t)
+	return t
+}
+
+// Timers returns the number of timers created by After that haven't fired
+// yet, so that tests can wait for code under test to start waiting.
+func (f *FakeClock) Timers() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.timers)
+}
+
+// Advance moves the fake time forward by d, firing any timers and tickers
+// that fall due.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	timers := f.timers[:0]
+	for _, t := range f.timers {
+		if t.deadline.After(f.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.c <- f.now
+	}
+	f.timers = timers
+	for _, t := range f.tickers {
+		for !t.next.After(f.now) {
+			select {
+			case t.c <- f.now:
+			default:
+			}
+			t.next = t.next.Add(t.period)
+		}
+	}
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTicker) Stop() {
+	f := t.clock
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, c := range f.tickers {
+		if c == t {
+			f.tickers = append(f.tickers[:i], f.tickers[i+1:]...)
+			return
+		}
+	}
+}
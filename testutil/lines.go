@@ -0,0 +1,50 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package testutil
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sgtsquiggs/tail/logline"
+)
+
+// CollectLines receives exactly n lines from ch, failing the test if they
+// haven't all arrived within timeout or if the channel is closed first.
+func CollectLines(tb testing.TB, ch <-chan *logline.LogLine, n int, timeout time.Duration) []*logline.LogLine {
+	tb.Helper()
+	result := make([]*logline.LogLine, 0, n)
+	deadline := time.After(timeout)
+	for len(result) < n {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				tb.Fatalf("lines channel closed after %d of %d lines: %v", len(result), n, result)
+			}
+			result = append(result, line)
+		case <-deadline:
+			tb.Fatalf("received %d of %d lines before timeout of %s: %v", len(result), n, timeout, result)
+		}
+	}
+	return result
+}
+
+// CollectAllLines receives lines from ch until it is closed, failing the
+// test if that doesn't happen within timeout.
+func CollectAllLines(tb testing.TB, ch <-chan *logline.LogLine, timeout time.Duration) []*logline.LogLine {
+	tb.Helper()
+	var result []*logline.LogLine
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				return result
+			}
+			result = append(result, line)
+		case <-deadline:
+			tb.Fatalf("lines channel not closed before timeout of %s, received: %v", timeout, result)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package testutil
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/sgtsquiggs/tail/logger"
+)
+
+// LogEntry is a message recorded by a CaptureLogger.
+type LogEntry struct {
+	Level   string
+	Message string
+	Fields  map[string]interface{}
+}
+
+type captureLog struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+// CaptureLogger is a logger.FieldLogger that records every message, with its
+// fields, for inspection by tests.
+type CaptureLogger struct {
+	log    *captureLog
+	fields map[string]interface{}
+}
+
+// NewCaptureLogger returns a new, empty CaptureLogger.
+func NewCaptureLogger() *CaptureLogger {
+	return &CaptureLogger{log: &captureLog{}}
+}
+
+// Entries returns a copy of the messages recorded so far.
+func (c *CaptureLogger) Entries() []LogEntry {
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	return append([]LogEntry(nil), c.log.entries...)
+}
+
+// FindEntry returns the first recorded message starting with prefix that has
+// the field key set to value.
+func (c *CaptureLogger) FindEntry(prefix, key string, value interface{}) (LogEntry, bool) {
+	for _, e := range c.Entries() {
+		if strings.HasPrefix(e.Message, prefix) && e.Fields[key] == value {
+			return e, true
+		}
+	}
+	return LogEntry{}, false
+}
+
+func (c *CaptureLogger) record(level, msg string) {
+	c.log.mu.Lock()
+	defer c.log.mu.Unlock()
+	c.log.entries = append(c.log.entries, LogEntry{level, msg, c.fields})
+}
+
+func (c *CaptureLogger) WithFields(fields map[string]interface{}) logger.Logger {
+	merged := make(map[string]interface{}, len(c.fields)+len(fields))
+	for k, v := range c.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &CaptureLogger{log: c.log, fields: merged}
+}
+
+func (c *CaptureLogger) Debugf(format string, args ...interface{}) {
+	c.record("debug", fmt.Sprintf(format, args...))
+}
+func (c *CaptureLogger) Infof(format string, args ...interface{}) {
+	c.record("info", fmt.Sprintf(format, args...))
+}
+func (c *CaptureLogger) Warningf(format string, args ...interface{}) {
+	c.record("warning", fmt.Sprintf(format, args...))
+}
+func (c *CaptureLogger) Errorf(format string, args ...interface{}) {
+	c.record("error", fmt.Sprintf(format, args...))
+}
+func (c *CaptureLogger) Debug(args ...interface{}) {
+	c.record("debug", fmt.Sprint(args...))
+}
+func (c *CaptureLogger) Info(args ...interface{}) {
+	c.record("info", fmt.Sprint(args...))
+}
+func (c *CaptureLogger) Warning(args ...interface{}) {
+	c.record("warning", fmt.Sprint(args...))
+}
+func (c *CaptureLogger) Error(args ...interface{}) {
+	c.record("error", fmt.Sprint(args...))
+}
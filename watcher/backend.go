@@ -0,0 +1,195 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultPollInterval is how often paths are polled when fsnotify isn't
+	// available and no poll interval was given.
+	defaultPollInterval = 250 * time.Millisecond
+
+	// initialRestartDelay is how long to wait before the first attempt to
+	// restart a dead fsnotify backend.  Each further attempt waits twice as
+	// long, up to maxRestartDelay.
+	initialRestartDelay = 100 * time.Millisecond
+	maxRestartDelay     = 30 * time.Second
+
+	// maxRestarts is how many times the fsnotify backend is restarted without
+	// staying up for restartReset before falling back to polling.
+	maxRestarts  = 5
+	restartReset = time.Minute
+)
+
+// backend is the part of fsnotify.Watcher used by the LogWatcher, so that
+// tests can replace it.
+type backend interface {
+	Add(name string) error
+	Remove(name string) error
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// fsnotifyBackend is a backend using fsnotify.
+type fsnotifyBackend struct {
+	w *fsnotify.Watcher
+}
+
+func newFsnotifyBackend() (backend, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return fsnotifyBackend{w}, nil
+}
+
+func (b fsnotifyBackend) Add(name string) error         { return b.w.Add(name) }
+func (b fsnotifyBackend) Remove(name string) error      { return b.w.Remove(name) }
+func (b fsnotifyBackend) Close() error                  { return b.w.Close() }
+func (b fsnotifyBackend) Events() <-chan fsnotify.Event { return b.w.Events }
+func (b fsnotifyBackend) Errors() <-chan error          { return b.w.Errors }
+
+// withBackend creates the fsnotify backend with newBackend, instead of
+// fsnotify.NewWatcher.
+func withBackend(newBackend func() (backend, error)) Option {
+	return func(w *LogWatcher) error {
+		w.newBackend = newBackend
+		return nil
+	}
+}
+
+// isClosedErr indicates if err was returned by a backend that has been
+// closed.
+func isClosedErr(err error) bool {
+	return strings.Contains(err.Error(), "already closed")
+}
+
+// restartBackend waits before creating a new backend to replace one that
+// has died, with a longer wait for each attempt in a row.  It returns nil
+// if the LogWatcher is closed while waiting.
+func (w *LogWatcher) restartBackend(attempt int) (backend, error) {
+	delay := w.restartDelay << uint(attempt)
+	if delay > maxRestartDelay || delay <= 0 {
+		delay = maxRestartDelay
+	}
+	w.logger.Infof("Restarting the fsnotify backend in %s", delay)
+	select {
+	case <-w.clock.After(delay):
+	case <-w.stopEvents:
+		return nil, nil
+	}
+	b, err := w.newBackend()
+	if err != nil {
+		if lerr := limitError("", err); lerr != nil {
+			return nil, lerr
+		}
+		return nil, errors.Wrap(err, "failed to create an fsnotify backend")
+	}
+	w.watchedMu.Lock()
+	if w.closed {
+		w.watchedMu.Unlock()
+		return nil, b.Close()
+	}
+	w.fsnotifyWatches = 0
+	for _, watched := range w.watched {
+		if watched.mode == ModePoll {
+			continue
+		}
+		if err := b.Add(ExtendPath(watched.name)); err != nil {
+			if lerr := limitError(watched.name, err); lerr != nil {
+				err = lerr
+			}
+			w.logger.Debugf("Failed to watch %q again: %s", watched.name, err)
+			watched.sources &^= Fsnotify
+		} else {
+			watched.sources |= Fsnotify
+			w.fsnotifyWatches++
+		}
+	}
+	w.checkWatchLimitLocked()
+	w.watcher = b
+	paths := w.snapshotLocked()
+	w.watchedMu.Unlock()
+	w.metrics.restartCount.Add(1)
+	w.health.restarted()
+	w.logger.Infof("Restarted the fsnotify backend, watching %d paths", len(paths))
+	w.reconcile(paths)
+	return b, nil
+}
+
+// watchedPath is a path being watched, and where to send its events.
+type watchedPath struct {
+	name  string
+	c     chan Event
+	isDir bool
+}
+
+// snapshotLocked returns the paths being watched.  w.watchedMu must be
+// locked when called.
+func (w *LogWatcher) snapshotLocked() []watchedPath {
+	paths := make([]watchedPath, 0, len(w.watched))
+	for _, watched := range w.watched {
+		paths = append(paths, watchedPath{watched.name, watched.c, watched.isDir})
+	}
+	return paths
+}
+
+// reconcile sends the events that may have been missed while there was no
+// fsnotify backend: a delete for each path that is gone, an update for each
+// file, and a create for each file in a directory that isn't watched yet.
+// Subscribers already handle events for changes that didn't happen.
+func (w *LogWatcher) reconcile(paths []watchedPath) {
+	for _, p := range paths {
+		_, err := StatExtended(p.name)
+		switch {
+		case os.IsNotExist(err):
+			w.dispatch(p.c, Event{Op: Delete, Pathname: p.name}, Fsnotify, p.name)
+		case err != nil:
+			w.logger.Debug(err)
+		case p.isDir:
+			matches, err := GlobExtended(path.Join(p.name, "*"))
+			if err != nil {
+				w.logger.Debug(err)
+				continue
+			}
+			for _, match := range matches {
+				if !w.IsWatching(match) {
+					w.dispatch(p.c, Event{Op: Create, Pathname: match}, Fsnotify, p.name)
+				}
+			}
+		default:
+			w.dispatch(p.c, Event{Op: Update, Pathname: p.name}, Fsnotify, p.name)
+		}
+	}
+}
+
+// fallBackToPolling stops using fsnotify after it can't be restarted, and
+// polls every watched path instead.
+func (w *LogWatcher) fallBackToPolling() {
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	w.watcher = nil
+	if w.closed {
+		return
+	}
+	w.metrics.pollFallbackCount.Add(1)
+	w.logger.Warningf("Giving up on restarting the fsnotify backend, polling instead")
+	for _, watched := range w.watched {
+		watched.sources = Poll
+	}
+	w.fsnotifyWatches = 0
+	w.limitWarned = false
+	if w.pollTicker == nil {
+		w.startPolling(defaultPollInterval)
+	}
+}
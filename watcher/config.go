@@ -0,0 +1,36 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Config holds the settings of a LogWatcher created by NewFromConfig.
+type Config struct {
+	// PollInterval is how often watched paths are polled.  If it's 0, paths
+	// are only polled if fsnotify is unavailable, every 250ms.
+	PollInterval time.Duration
+	// EnableFsnotify watches paths with fsnotify as well as by polling.
+	EnableFsnotify bool
+
+	Options []Option
+}
+
+// Validate returns an error naming the first field of c that's out of
+// range.  It doesn't apply the Options, so it can be called before they're
+// ready.
+func (c Config) Validate() error {
+	if c.PollInterval < 0 {
+		return errors.Errorf("watcher.Config.PollInterval: can't be negative, got %s", c.PollInterval)
+	}
+	for i, o := range c.Options {
+		if o == nil {
+			return errors.Errorf("watcher.Config.Options[%d]: option is nil", i)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"expvar"
+	"path/filepath"
+	"sync"
+)
+
+// WithEventCountsByRoot also counts events in the expvar
+// log_watcher_events_by_root_total, published by WithExpvar, by the watched path they were found
+// through and then by type.  A directory's files are counted under the
+// directory, so the map grows with the paths watched rather than the files
+// in them.  A path's counts are dropped when it's removed.
+func WithEventCountsByRoot() Option {
+	return func(w *LogWatcher) error {
+		w.countByRoot = true
+		return nil
+	}
+}
+
+// EventCounts is the number of create and update events sent for a path.
+type EventCounts struct {
+	Create int64
+	Update int64
+}
+
+// counters counts the events sent for each path that still exists.
+type counters struct {
+	mu    sync.Mutex
+	paths map[string]*EventCounts
+}
+
+// count records that e has been sent, found through the watched path root.
+// The counts of a deleted path are dropped, so that the paths counted are
+// those whose events may still be handled.
+func (w *LogWatcher) count(e Event, root string) {
+	w.metrics.eventCount.Add(e.Op.String(), 1)
+	w.counts.mu.Lock()
+	defer w.counts.mu.Unlock()
+	if w.countByRoot {
+		m, ok := w.metrics.eventCountByRoot.Get(root).(*expvar.Map)
+		if !ok {
+			m = new(expvar.Map)
+			w.metrics.eventCountByRoot.Set(root, m)
+		}
+		m.Add(e.Op.String(), 1)
+	}
+	if e.Op == Delete {
+		delete(w.counts.paths, e.Pathname)
+		return
+	}
+	c, ok := w.counts.paths[e.Pathname]
+	if !ok {
+		c = &EventCounts{}
+		w.counts.paths[e.Pathname] = c
+	}
+	switch e.Op {
+	case Create:
+		c.Create++
+	case Update:
+		c.Update++
+	}
+}
+
+// forgetCounts drops the counts of pathname, which is no longer watched, and
+// of the files in it.
+func (w *LogWatcher) forgetCounts(pathname string) {
+	w.counts.mu.Lock()
+	defer w.counts.mu.Unlock()
+	for p := range w.counts.paths {
+		if p == pathname || filepath.Dir(p) == pathname {
+			delete(w.counts.paths, p)
+		}
+	}
+	if w.countByRoot {
+		w.metrics.eventCountByRoot.Delete(pathname)
+	}
+}
+
+// Counters returns the number of create and update events sent for each path
+// that hasn't since been deleted or removed from the LogWatcher.  It is
+// safe to call while the LogWatcher is running.
+func (w *LogWatcher) Counters() map[string]EventCounts {
+	w.counts.mu.Lock()
+	defer w.counts.mu.Unlock()
+	counts := make(map[string]EventCounts, len(w.counts.paths))
+	for p, c := range w.counts.paths {
+		counts[p] = *c
+	}
+	return counts
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Once a LogWatcher is running, SetOption only accepts the options that can
+// be changed safely under it: WithLogLevel and WithPollInterval.  The rest,
+// such as Logger, WithClock and WithInotify, shape how it's built and are
+// rejected with an *ErrStaticOption.  Each option given to a running
+// LogWatcher is first applied to a probe, a LogWatcher that is never
+// started, which passes those that can be changed on to the running one.
+
+// ErrStaticOption is returned by SetOption for an option that can only be
+// given when the LogWatcher is created.  The options before it have been
+// applied.
+type ErrStaticOption struct {
+	Index int // Position of the option in the call
+}
+
+func (e *ErrStaticOption) Error() string {
+	return fmt.Sprintf("option %d can only be given when the log watcher is created", e.Index)
+}
+
+// update applies fn, which sets an option that can be changed while the
+// LogWatcher is running, to the LogWatcher being created or, if w is a probe,
+// to the running LogWatcher.  fn must then be safe to call while it runs.
+func (w *LogWatcher) update(fn func(w *LogWatcher) error) error {
+	if w.probeOf == nil {
+		return fn(w)
+	}
+	w.dynamic = true
+	return fn(w.probeOf)
+}
+
+// setOptionRunning applies options to the running LogWatcher, or returns an
+// *ErrStaticOption for the first that can't be.
+func (w *LogWatcher) setOptionRunning(options []Option) error {
+	w.optionsMu.Lock()
+	defer w.optionsMu.Unlock()
+	for i, option := range options {
+		probe := newLogWatcher()
+		probe.probeOf = w
+		if err := option(probe); err != nil {
+			return err
+		}
+		if !probe.dynamic {
+			return &ErrStaticOption{Index: i}
+		}
+	}
+	return nil
+}
+
+// WithPollInterval polls the watched paths every d, as Config.PollInterval.
+// Given to a running LogWatcher, it changes how often the paths are polled,
+// from now; it returns an error if the LogWatcher isn't polling.
+func WithPollInterval(d time.Duration) Option {
+	return func(w *LogWatcher) error {
+		if d <= 0 {
+			return errors.Errorf("invalid poll interval %s", d)
+		}
+		return w.update(func(w *LogWatcher) error {
+			if !w.started {
+				w.pollInterval = d
+				return nil
+			}
+			return w.setPollInterval(d)
+		})
+	}
+}
+
+// setPollInterval replaces the poll ticker with one ticking every d.
+func (w *LogWatcher) setPollInterval(d time.Duration) error {
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	if w.closed {
+		return errors.New("log watcher is closed")
+	}
+	if w.pollTicker == nil {
+		return errors.New("log watcher isn't polling")
+	}
+	w.pollTicker.Stop()
+	w.pollTicker = w.sched.NewTicker(d)
+	w.pollInterval = d
+	select {
+	case w.pollReset <- struct{}{}:
+	default:
+	}
+	w.logger.Infof("Polling every %s", d)
+	return nil
+}
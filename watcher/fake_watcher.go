@@ -4,8 +4,13 @@
 package watcher
 
 import (
+	"expvar"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	log "github.com/sgtsquiggs/tail/logger"
 
@@ -16,12 +21,23 @@ import (
 type FakeWatcher struct {
 	watchesMu sync.RWMutex
 	watches   map[string]int
+	dirs      map[string]bool      // watches that are on directories
+	modes     map[string]WatchMode // WatchModes given to Add, if not ModeDefault
+	foldCase  bool                 // Injected paths match watches without regard to case
 
 	eventsMu sync.RWMutex // locks events and isClosed
 	events   []chan Event
 
 	isClosed bool
 
+	failMu     sync.Mutex
+	nextAddErr error         // returned by the next call to Add
+	eventDelay time.Duration // delay before delivering each injected event
+	awaitAck   bool          // wait for each injected event to be acknowledged
+
+	seq        *sequences // Counts the events sent to each subscriber
+	errorCount expvar.Int // Errors injected
+
 	logger log.Logger
 }
 
@@ -29,23 +45,61 @@ type FakeWatcher struct {
 func NewFakeWatcher() *FakeWatcher {
 	return &FakeWatcher{
 		watches: make(map[string]int),
+		dirs:    make(map[string]bool),
+		modes:   make(map[string]WatchMode),
 		logger:  log.DefaultLogger,
+		seq:     newSequences(),
 	}
 }
 
-// Add adds a watch to the FakeWatcher
-func (w *FakeWatcher) Add(name string, handle int) error {
+// Add adds a watch to the FakeWatcher.  If name is an existing directory,
+// the watch is recorded as a directory watch.  A WatchMode given in opts is
+// recorded, but doesn't change how events are injected.
+func (w *FakeWatcher) Add(name string, handle int, opts ...AddOption) error {
+	w.failMu.Lock()
+	err := w.nextAddErr
+	w.nextAddErr = nil
+	w.failMu.Unlock()
+	if err != nil {
+		if os.IsPermission(err) {
+			w.logger.Infof("Skipping permission denied error on adding a watch.")
+		} else if lerr := limitError(name, err); lerr != nil {
+			return lerr
+		} else {
+			return errors.Wrapf(err, "Failed to create a new watch on %q", name)
+		}
+	}
 	w.eventsMu.RLock()
-	if handle > len(w.events) {
+	if handle < 0 || handle >= len(w.events) {
+		w.eventsMu.RUnlock()
 		return errors.Errorf("no such event handle %d", handle)
 	}
+	fi, err := os.Stat(name)
 	w.watchesMu.Lock()
 	w.watches[name] = handle
+	if err == nil && fi.IsDir() {
+		w.dirs[name] = true
+	}
+	if o := newAddOptions(opts); o.mode != ModeDefault {
+		w.modes[name] = o.mode
+	}
 	w.watchesMu.Unlock()
 	w.eventsMu.RUnlock()
 	return nil
 }
 
+// WatchedPaths returns the paths being watched, sorted by pathname.
+func (w *FakeWatcher) WatchedPaths() []WatchedPath {
+	w.watchesMu.RLock()
+	defer w.watchesMu.RUnlock()
+	paths := make([]WatchedPath, 0, len(w.watches))
+	for name := range w.watches {
+		paths = append(paths, WatchedPath{Pathname: name, IsDir: w.dirs[name], Mode: w.modes[name]})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Pathname < paths[j].Pathname })
+	return paths
+}
+
 // Close closes down the FakeWatcher
 func (w *FakeWatcher) Close() error {
 	w.eventsMu.Lock()
@@ -57,6 +111,7 @@ func (w *FakeWatcher) Close() error {
 		close(c)
 	}
 	w.isClosed = true
+	w.seq.close()
 	return nil
 }
 
@@ -64,6 +119,8 @@ func (w *FakeWatcher) Close() error {
 func (w *FakeWatcher) Remove(name string) error {
 	w.watchesMu.Lock()
 	delete(w.watches, name)
+	delete(w.dirs, name)
+	delete(w.modes, name)
 	w.watchesMu.Unlock()
 	return nil
 }
@@ -81,19 +138,190 @@ func (w *FakeWatcher) Events() (int, <-chan Event) {
 	return handle, ch
 }
 
+// FailNextAdd causes the next call to Add to fail with err, for example
+// syscall.ENOSPC to simulate running out of inotify watches.
+func (w *FakeWatcher) FailNextAdd(err error) {
+	w.failMu.Lock()
+	w.nextAddErr = err
+	w.failMu.Unlock()
+}
+
+// InjectError lets a test inject an error from the watcher backend.  Like
+// the LogWatcher, the error is counted and logged, and does not stop the
+// delivery of events.
+func (w *FakeWatcher) InjectError(err error) {
+	w.errorCount.Add(1)
+	w.logger.Errorf("fsnotify error: %s\n", err)
+}
+
+// SetEventDelay delays the delivery of each subsequently injected event by d.
+func (w *FakeWatcher) SetEventDelay(d time.Duration) {
+	w.failMu.Lock()
+	w.eventDelay = d
+	w.failMu.Unlock()
+}
+
+// SetAwaitAck makes each subsequently injected event, if await is true,
+// block until its subscriber acknowledges handling it with AckEvents, as a
+// Tailer does once it has read the file.  A subscriber that never
+// acknowledges its events blocks the injection until Close is called.
+func (w *FakeWatcher) SetAwaitAck(await bool) {
+	w.failMu.Lock()
+	w.awaitAck = await
+	w.failMu.Unlock()
+}
+
+// EventsSent returns the number of events sent, or being sent, to the
+// subscriber with handle.
+func (w *FakeWatcher) EventsSent(handle int) uint64 {
+	return w.seq.sentOn(handle)
+}
+
+// AckEvents records that the subscriber with handle has handled the first
+// seq events sent to it.
+func (w *FakeWatcher) AckEvents(handle int, seq uint64) {
+	w.seq.ack(handle, seq)
+}
+
+// send delivers an event to the subscriber with handle h, after the
+// configured delay, and waits for it to be acknowledged if SetAwaitAck says
+// to.
+func (w *FakeWatcher) send(h int, e Event) {
+	w.failMu.Lock()
+	d, await := w.eventDelay, w.awaitAck
+	w.failMu.Unlock()
+	if d > 0 {
+		time.Sleep(d)
+	}
+	w.eventsMu.RLock()
+	seq := w.seq.next(h)
+	w.events[h] <- e
+	w.eventsMu.RUnlock()
+	if await {
+		w.seq.await(h, seq)
+	}
+}
+
+// AwaitPending blocks until every event injected so far has been received by
+// its subscriber, or returns an error if that hasn't happened within timeout.
+func (w *FakeWatcher) AwaitPending(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !w.drained(-1) {
+		if time.Now().After(deadline) {
+			return errors.Errorf("events still pending after %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil
+}
+
+// drained indicates if the subscriber with handle h, or all subscribers if h
+// is negative, have received all events sent to them.
+func (w *FakeWatcher) drained(h int) bool {
+	w.eventsMu.RLock()
+	defer w.eventsMu.RUnlock()
+	for i, c := range w.events {
+		if (h < 0 || i == h) && len(c) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SetCaseFolding makes the paths of injected events match the watches
+// without regard to case if fold is true, as the LogWatcher's do with
+// WithCaseFolding, so that a test can spell them differently.
+func (w *FakeWatcher) SetCaseFolding(fold bool) {
+	w.watchesMu.Lock()
+	w.foldCase = fold
+	w.watchesMu.Unlock()
+}
+
+// watchLocked returns the handle and name of the watch on name, which if
+// case folding is set may be spelt differently.  w.watchesMu must be held
+// when called.
+func (w *FakeWatcher) watchLocked(name string) (int, string, bool) {
+	if h, ok := w.watches[name]; ok {
+		return h, name, true
+	}
+	if !w.foldCase {
+		return 0, "", false
+	}
+	key := PathKey(name, true)
+	for n, h := range w.watches {
+		if PathKey(n, true) == key {
+			return h, n, true
+		}
+	}
+	return 0, "", false
+}
+
+// injectAndWait calls inject for name, then blocks until the subscriber
+// that the event was delivered to has received it.
+func (w *FakeWatcher) injectAndWait(name string, inject func(string)) {
+	w.watchesMu.RLock()
+	h, _, ok := w.watchLocked(name)
+	if !ok {
+		h, _, ok = w.watchLocked(path.Dir(name))
+	}
+	w.watchesMu.RUnlock()
+	inject(name)
+	if !ok {
+		return
+	}
+	for !w.drained(h) {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// InjectCreateAndWait injects a creation event and returns once the
+// subscriber has received it.
+func (w *FakeWatcher) InjectCreateAndWait(name string) {
+	w.injectAndWait(name, w.InjectCreate)
+}
+
+// InjectUpdateAndWait injects an update event and returns once the
+// subscriber has received it.
+func (w *FakeWatcher) InjectUpdateAndWait(name string) {
+	w.injectAndWait(name, w.InjectUpdate)
+}
+
+// InjectDeleteAndWait injects a deletion event and returns once the
+// subscriber has received it.
+func (w *FakeWatcher) InjectDeleteAndWait(name string) {
+	w.injectAndWait(name, w.InjectDelete)
+}
+
+// InjectCreateInDir lets a test inject a fake creation event for the file
+// name in the watched directory dir.  Like the LogWatcher, the event is
+// delivered to the directory's subscriber and the new file is then watched.
+func (w *FakeWatcher) InjectCreateInDir(dir, name string) {
+	w.watchesMu.RLock()
+	h, watched := w.watches[dir]
+	isDir := w.dirs[dir]
+	w.watchesMu.RUnlock()
+	if !watched || !isDir {
+		w.logger.Warningf("not watching directory %s to see %s", dir, name)
+		return
+	}
+	pathname := filepath.Join(dir, name)
+	w.send(h, Event{Op: Create, Pathname: pathname})
+	if err := w.Add(pathname, h); err != nil {
+		w.logger.Warning(err)
+	}
+}
+
 // InjectCreate lets a test inject a fake creation event.
 func (w *FakeWatcher) InjectCreate(name string) {
 	dirname := path.Dir(name)
 	w.watchesMu.RLock()
-	h, dirWatched := w.watches[dirname]
+	h, _, dirWatched := w.watchLocked(dirname)
 	w.watchesMu.RUnlock()
 	if !dirWatched {
 		w.logger.Warningf("not watching %s to see %s", dirname, name)
 		return
 	}
-	w.eventsMu.RLock()
-	w.events[h] <- Event{Create, name}
-	w.eventsMu.RUnlock()
+	w.send(h, Event{Op: Create, Pathname: name})
 	if err := w.Add(name, h); err != nil {
 		w.logger.Warning(err)
 	}
@@ -102,30 +330,44 @@ func (w *FakeWatcher) InjectCreate(name string) {
 // InjectUpdate lets a test inject a fake update event.
 func (w *FakeWatcher) InjectUpdate(name string) {
 	w.watchesMu.RLock()
-	h, watched := w.watches[name]
+	h, _, watched := w.watchLocked(name)
 	w.watchesMu.RUnlock()
 	if !watched {
 		w.logger.Warningf("can't update: not watching %s", name)
 		return
 	}
-	w.eventsMu.RLock()
-	w.events[h] <- Event{Update, name}
-	w.eventsMu.RUnlock()
+	w.send(h, Event{Op: Update, Pathname: name})
 }
 
 // InjectDelete lets a test inject a fake deletion event.
 func (w *FakeWatcher) InjectDelete(name string) {
 	w.watchesMu.RLock()
-	h, watched := w.watches[name]
+	h, watchedName, watched := w.watchLocked(name)
 	w.watchesMu.RUnlock()
 	if !watched {
 		w.logger.Warningf("can't delete: not watching %s", name)
 		return
 	}
-	w.eventsMu.RLock()
-	w.events[h] <- Event{Delete, name}
-	w.eventsMu.RUnlock()
-	if err := w.Remove(name); err != nil {
+	w.send(h, Event{Op: Delete, Pathname: name})
+	if err := w.Remove(watchedName); err != nil {
 		w.logger.Warning(err)
 	}
 }
+
+// InjectRename lets a test inject a fake rename event, as WithInotify's
+// LogWatcher sends when a file is renamed within its watched directories.
+// Like the LogWatcher, the watch on from moves to to.
+func (w *FakeWatcher) InjectRename(from, to string) {
+	w.watchesMu.Lock()
+	h, watched := w.watches[from]
+	if watched {
+		delete(w.watches, from)
+		w.watches[to] = h
+	}
+	w.watchesMu.Unlock()
+	if !watched {
+		w.logger.Warningf("can't rename: not watching %s", from)
+		return
+	}
+	w.send(h, Event{Op: Rename, Pathname: to, From: from})
+}
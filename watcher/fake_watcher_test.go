@@ -4,9 +4,15 @@
 package watcher
 
 import (
-	"github.com/sgtsquiggs/tail/testutil"
+	"errors"
+	"os"
+	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/sgtsquiggs/tail/testutil"
 )
 
 func TestFakeWatcher(t *testing.T) {
@@ -141,3 +147,147 @@ func TestNoSuchHandle(t *testing.T) {
 		t.Error("expecting error, got nil")
 	}
 }
+
+func TestFakeWatcherFailNextAdd(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	handle, _ := w.Events()
+
+	w.FailNextAdd(syscall.ENOSPC)
+	if err := w.Add("/tmp", handle); err == nil {
+		t.Error("expecting error, got nil")
+	}
+	if _, ok := w.watches["/tmp"]; ok {
+		t.Errorf("watching /tmp after failed add: %+#v", w.watches)
+	}
+	testutil.FatalIfErr(t, w.Add("/tmp", handle))
+	if _, ok := w.watches["/tmp"]; !ok {
+		t.Errorf("Not watching /tmp, w contains: %+#v", w.watches)
+	}
+
+	// Permission denied is not an error, same as the LogWatcher.
+	w.FailNextAdd(os.ErrPermission)
+	testutil.FatalIfErr(t, w.Add("/tmp/foo", handle))
+}
+
+func TestFakeWatcherInjectError(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	w.InjectError(errors.New("Injected error for test"))
+	if got := w.errorCount.Value(); got != 1 {
+		t.Errorf("expected 1 error counted, got %d", got)
+	}
+}
+
+func TestFakeWatcherEventDelay(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	handle, eventsChannel := w.Events()
+	testutil.FatalIfErr(t, w.Add("/tmp/foo", handle))
+
+	w.SetEventDelay(20 * time.Millisecond)
+	start := time.Now()
+	w.InjectUpdate("/tmp/foo")
+	<-eventsChannel
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("event delivered after %s, expected at least 20ms", elapsed)
+	}
+}
+
+func TestFakeWatcherInjectAndWait(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	handle, eventsChannel := w.Events()
+	testutil.FatalIfErr(t, w.Add("/tmp", handle))
+
+	received := make(chan Event, 3)
+	go func() {
+		for e := range eventsChannel {
+			received <- e
+		}
+	}()
+	w.InjectCreateAndWait("/tmp/log")
+	w.InjectUpdateAndWait("/tmp/log")
+	w.InjectDeleteAndWait("/tmp/log")
+	testutil.FatalIfErr(t, w.AwaitPending(time.Second))
+	for _, op := range []OpType{Create, Update, Delete} {
+		if e := <-received; e.Op != op || e.Pathname != "/tmp/log" {
+			t.Errorf("unexpected event %v, expecting %v", e, op)
+		}
+	}
+}
+
+func TestFakeWatcherAwaitAck(t *testing.T) {
+	w := NewFakeWatcher()
+	handle, eventsChannel := w.Events()
+	testutil.FatalIfErr(t, w.Add("/tmp/log", handle))
+	w.SetAwaitAck(true)
+
+	injected := make(chan struct{})
+	go func() {
+		w.InjectUpdate("/tmp/log")
+		close(injected)
+	}()
+	<-eventsChannel
+	if n := w.EventsSent(handle); n != 1 {
+		t.Errorf("expected 1 event sent, got %d", n)
+	}
+	select {
+	case <-injected:
+		t.Fatal("injection returned before the event was acknowledged")
+	case <-time.After(10 * time.Millisecond):
+	}
+	w.AckEvents(handle, 1)
+	<-injected
+
+	// Closing releases an injection that is never acknowledged.
+	unacked := make(chan struct{})
+	go func() {
+		w.InjectUpdate("/tmp/log")
+		close(unacked)
+	}()
+	<-eventsChannel
+	w.Close()
+	<-unacked
+}
+
+func TestFakeWatcherAwaitPendingTimeout(t *testing.T) {
+	w := NewFakeWatcher()
+	defer w.Close()
+	handle, _ := w.Events()
+	testutil.FatalIfErr(t, w.Add("/tmp/foo", handle))
+	w.InjectUpdate("/tmp/foo")
+	if err := w.AwaitPending(10 * time.Millisecond); err == nil {
+		t.Error("expecting error with no subscriber receiving, got nil")
+	}
+}
+
+func TestFakeWatcherDirectoryWatch(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w := NewFakeWatcher()
+	defer w.Close()
+	handle, eventsChannel := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+
+	w.InjectCreateInDir(tmpDir, "log")
+	e := <-eventsChannel
+	if e.Op != Create || e.Pathname != filepath.Join(tmpDir, "log") {
+		t.Errorf("unexpected event %v", e)
+	}
+	expected := []WatchedPath{
+		{Pathname: tmpDir, IsDir: true},
+		{Pathname: filepath.Join(tmpDir, "log")},
+	}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+
+	// A file watch doesn't receive creates for children.
+	w.InjectCreateInDir(filepath.Join(tmpDir, "log"), "child")
+	testutil.FatalIfErr(t, w.AwaitPending(time.Second))
+	if len(w.WatchedPaths()) != 2 {
+		t.Errorf("unexpected watch added: %v", w.WatchedPaths())
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// WithFSEvents watches paths with FSEvents instead of fsnotify's kqueue
+// backend.  FSEvents watches each directory, and everything below it, with a
+// single stream rather than an open file descriptor for every path, so it
+// scales to large trees of logs.  It is only available on macOS, in builds
+// with cgo.
+func WithFSEvents() Option {
+	return func(w *LogWatcher) error {
+		if !fseventsSupported {
+			return errors.New("FSEvents is only available on macOS, with cgo enabled")
+		}
+		w.newBackend = newFSEventsBackend
+		return nil
+	}
+}
+
+// statTracker confirms the changes reported by FSEvents by statting each
+// path.  FSEvents coalesces the changes made to a path close together into
+// one event, whose flags may describe changes that have since been undone, so
+// the flags are only a hint and the event sent depends on how the path
+// differs from when it was last seen.
+type statTracker struct {
+	mu      sync.Mutex
+	watched map[string]bool        // Paths added, whose children are also tracked
+	seen    map[string]os.FileInfo // The last state seen of each path tracked that exists
+}
+
+func newStatTracker() *statTracker {
+	return &statTracker{watched: make(map[string]bool), seen: make(map[string]os.FileInfo)}
+}
+
+// add starts tracking name and, if it's a directory, its entries.
+func (s *statTracker) add(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watched[name] = true
+	fi, err := os.Stat(name)
+	if err != nil {
+		return
+	}
+	s.seen[name] = fi
+	if !fi.IsDir() {
+		return
+	}
+	matches, _ := filepath.Glob(filepath.Join(name, "*"))
+	for _, match := range matches {
+		if fi, err := os.Stat(match); err == nil {
+			s.seen[match] = fi
+		}
+	}
+}
+
+// remove stops tracking name, and the entries of name that aren't watched
+// themselves.
+func (s *statTracker) remove(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.watched, name)
+	for p := range s.seen {
+		if p == name || (filepath.Dir(p) == name && !s.watched[p]) {
+			delete(s.seen, p)
+		}
+	}
+}
+
+// trackedLocked indicates if name is watched or is an entry of a watched
+// directory.  s.mu must be locked when called.
+func (s *statTracker) trackedLocked(name string) bool {
+	return s.watched[name] || s.watched[filepath.Dir(name)]
+}
+
+// confirm returns the events for the change to name, with hint the change
+// FSEvents reported.  Paths that aren't tracked are ignored.
+func (s *statTracker) confirm(name string, hint fsnotify.Op) []fsnotify.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.trackedLocked(name) {
+		return nil
+	}
+	return s.confirmLocked(name, hint)
+}
+
+func (s *statTracker) confirmLocked(name string, hint fsnotify.Op) []fsnotify.Event {
+	prev, known := s.seen[name]
+	fi, err := os.Stat(name)
+	if err != nil {
+		if !os.IsNotExist(err) || (!known && hint&(fsnotify.Remove|fsnotify.Rename) == 0) {
+			return nil
+		}
+		delete(s.seen, name)
+		return []fsnotify.Event{{Name: name, Op: fsnotify.Remove}}
+	}
+	s.seen[name] = fi
+	var op fsnotify.Op
+	switch {
+	case !known || !os.SameFile(prev, fi):
+		// Created, or replaced since the last event, as by a rotation.
+		op = fsnotify.Create
+	case fi.IsDir():
+		// The entries changed, which have their own events.
+		return nil
+	case fi.Size() != prev.Size() || !fi.ModTime().Equal(prev.ModTime()) || hint&fsnotify.Write != 0:
+		op = fsnotify.Write
+	case fi.Mode() != prev.Mode() || hint&fsnotify.Chmod != 0:
+		op = fsnotify.Chmod
+	default:
+		return nil
+	}
+	return []fsnotify.Event{{Name: name, Op: op}}
+}
+
+// rescan returns the events for every change to the paths tracked, for when
+// FSEvents has dropped events and only says that something below a
+// directory has changed.
+func (s *statTracker) rescan() []fsnotify.Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names := make(map[string]bool, len(s.seen))
+	for name := range s.seen {
+		if s.trackedLocked(name) {
+			names[name] = true
+		}
+	}
+	for name := range s.watched {
+		names[name] = true
+		matches, _ := filepath.Glob(filepath.Join(name, "*"))
+		for _, match := range matches {
+			names[match] = true
+		}
+	}
+	var events []fsnotify.Event
+	for name := range names {
+		events = append(events, s.confirmLocked(name, 0)...)
+	}
+	return events
+}
+
+// underRoot returns name with the prefix real replaced by root, if name is
+// real or below it.  FSEvents reports paths with symlinks resolved, such as
+// /private/tmp for /tmp, and they're routed by the paths that were added.
+func underRoot(name, root, real string) (string, bool) {
+	if name == real {
+		return root, true
+	}
+	if strings.HasPrefix(name, strings.TrimSuffix(real, "/")+"/") {
+		return filepath.Join(root, name[len(real):]), true
+	}
+	return "", false
+}
@@ -0,0 +1,67 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+#include "fsevents_darwin.h"
+#include "_cgo_export.h"
+
+static void callback(ConstFSEventStreamRef s, void *info, size_t n, void *paths,
+                     const FSEventStreamEventFlags flags[], const FSEventStreamEventId ids[]) {
+	fseventsCallback((uintptr_t)info, n, (char **)paths, (FSEventStreamEventFlags *)flags);
+}
+
+dispatch_queue_t fseventsNewQueue(void) {
+	return dispatch_queue_create("fsevents", DISPATCH_QUEUE_SERIAL);
+}
+
+void fseventsReleaseQueue(dispatch_queue_t q) {
+	dispatch_release(q);
+}
+
+// fseventsStart starts a stream of the file events below root, whose
+// callbacks are run on q with handle.  It returns NULL if it can't.
+FSEventStreamRef fseventsStart(dispatch_queue_t q, uintptr_t handle, const char *root, double latency) {
+	CFStringRef path = CFStringCreateWithCString(NULL, root, kCFStringEncodingUTF8);
+	if (path == NULL) {
+		return NULL;
+	}
+	CFArrayRef paths = CFArrayCreate(NULL, (const void **)&path, 1, &kCFTypeArrayCallBacks);
+	FSEventStreamContext ctx = {0, (void *)handle, NULL, NULL, NULL};
+	FSEventStreamRef s = FSEventStreamCreate(NULL, callback, &ctx, paths, kFSEventStreamEventIdSinceNow, latency,
+	                                         kFSEventStreamCreateFlagFileEvents | kFSEventStreamCreateFlagNoDefer |
+	                                             kFSEventStreamCreateFlagWatchRoot);
+	CFRelease(paths);
+	CFRelease(path);
+	if (s == NULL) {
+		return NULL;
+	}
+	FSEventStreamSetDispatchQueue(s, q);
+	if (!FSEventStreamStart(s)) {
+		FSEventStreamInvalidate(s);
+		FSEventStreamRelease(s);
+		return NULL;
+	}
+	return s;
+}
+
+static void stop(void *s) {
+	if (s == NULL) {
+		return;
+	}
+	FSEventStreamStop((FSEventStreamRef)s);
+	FSEventStreamInvalidate((FSEventStreamRef)s);
+	FSEventStreamRelease((FSEventStreamRef)s);
+}
+
+// fseventsStop stops and releases s on q, after any callbacks already queued,
+// waiting for it to be done if wait is set.  With s NULL, it only waits for
+// the queue to empty.
+void fseventsStop(dispatch_queue_t q, FSEventStreamRef s, int wait) {
+	if (wait) {
+		dispatch_sync_f(q, (void *)s, stop);
+	} else {
+		dispatch_async_f(q, (void *)s, stop);
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build darwin && cgo
+// +build darwin,cgo
+
+package watcher
+
+/*
+#cgo LDFLAGS: -framework CoreServices
+#include <stdlib.h>
+#include "fsevents_darwin.h"
+*/
+import "C"
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// fseventsSupported indicates if WithFSEvents can be used in this build.
+const fseventsSupported = true
+
+// fseventsLatency is how long FSEvents waits to coalesce the events for a
+// path before reporting them.
+const fseventsLatency = 50 * time.Millisecond
+
+const (
+	flagCreated  = uint32(C.kFSEventStreamEventFlagItemCreated)
+	flagRemoved  = uint32(C.kFSEventStreamEventFlagItemRemoved)
+	flagRenamed  = uint32(C.kFSEventStreamEventFlagItemRenamed)
+	flagModified = uint32(C.kFSEventStreamEventFlagItemModified)
+	flagMetaMod  = uint32(C.kFSEventStreamEventFlagItemInodeMetaMod | C.kFSEventStreamEventFlagItemChangeOwner | C.kFSEventStreamEventFlagItemXattrMod)
+
+	// flagRescan is set when events have been dropped, or a root has moved,
+	// so the paths below it have to be checked.
+	flagRescan = uint32(C.kFSEventStreamEventFlagMustScanSubDirs | C.kFSEventStreamEventFlagUserDropped | C.kFSEventStreamEventFlagKernelDropped | C.kFSEventStreamEventFlagRootChanged)
+)
+
+// The backends whose streams are running, by the handle passed to the
+// callback, as Go pointers can't be kept by C.
+var (
+	fseventsMu       sync.Mutex
+	fseventsBackends = make(map[uintptr]*fseventsBackend)
+	fseventsNext     uintptr
+)
+
+// fseventsStream is the FSEvents stream for a directory.
+type fseventsStream struct {
+	ref  C.FSEventStreamRef
+	real string // The directory with symlinks resolved, as FSEvents reports it
+	refs int    // Paths added in the directory
+}
+
+// fseventsBackend is a backend using FSEvents, with a stream for each
+// directory that has a path added, which is the path itself for a directory.
+// The events from FSEvents are confirmed by a statTracker before they're
+// sent, and the LogWatcher routes them to the paths they're for.
+type fseventsBackend struct {
+	handle  uintptr
+	queue   C.dispatch_queue_t // Runs the callbacks of every stream, one at a time
+	tracker *statTracker
+	events  chan fsnotify.Event
+	errors  chan error
+	done    chan struct{} // Closed by Close, to stop the callbacks blocking
+
+	mu      sync.Mutex
+	closed  bool
+	streams map[string]*fseventsStream // By directory
+	roots   map[string]string          // The directory of each path added
+}
+
+func newFSEventsBackend() (backend, error) {
+	b := &fseventsBackend{
+		queue:   C.fseventsNewQueue(),
+		tracker: newStatTracker(),
+		events:  make(chan fsnotify.Event),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+		streams: make(map[string]*fseventsStream),
+		roots:   make(map[string]string),
+	}
+	fseventsMu.Lock()
+	fseventsNext++
+	b.handle = fseventsNext
+	fseventsBackends[b.handle] = b
+	fseventsMu.Unlock()
+	return b, nil
+}
+
+func (b *fseventsBackend) Add(name string) error {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	root := name
+	if !fi.IsDir() {
+		root = filepath.Dir(name)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("FSEvents backend already closed")
+	}
+	if _, ok := b.roots[name]; ok {
+		return nil
+	}
+	s, ok := b.streams[root]
+	if !ok {
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			real = root
+		}
+		cs := C.CString(real)
+		defer C.free(unsafe.Pointer(cs))
+		ref := C.fseventsStart(b.queue, C.uintptr_t(b.handle), cs, C.double(fseventsLatency.Seconds()))
+		if ref == nil {
+			return errors.Errorf("failed to start an FSEvents stream for %q", root)
+		}
+		s = &fseventsStream{ref: ref, real: real}
+		b.streams[root] = s
+	}
+	s.refs++
+	b.roots[name] = root
+	b.tracker.add(name)
+	return nil
+}
+
+func (b *fseventsBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("FSEvents backend already closed")
+	}
+	root, ok := b.roots[name]
+	if !ok {
+		return errors.Errorf("can't remove non-existent FSEvents watch for %q", name)
+	}
+	delete(b.roots, name)
+	b.tracker.remove(name)
+	s := b.streams[root]
+	if s.refs--; s.refs == 0 {
+		delete(b.streams, root)
+		// Don't wait, as a callback may be blocked sending an event.
+		C.fseventsStop(b.queue, s.ref, 0)
+	}
+	return nil
+}
+
+func (b *fseventsBackend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	streams := b.streams
+	b.streams = nil
+	b.mu.Unlock()
+
+	close(b.done)
+	for _, s := range streams {
+		C.fseventsStop(b.queue, s.ref, 1)
+	}
+	fseventsMu.Lock()
+	delete(fseventsBackends, b.handle)
+	fseventsMu.Unlock()
+	// The streams are stopped once the queue is empty, so no more events can
+	// be sent.
+	C.fseventsStop(b.queue, nil, 1)
+	C.fseventsReleaseQueue(b.queue)
+	close(b.events)
+	close(b.errors)
+	return nil
+}
+
+func (b *fseventsBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *fseventsBackend) Errors() <-chan error          { return b.errors }
+
+// receive sends the events for the path name reported by FSEvents with
+// flags.
+func (b *fseventsBackend) receive(name string, flags uint32) {
+	b.mu.Lock()
+	for root, s := range b.streams {
+		if p, ok := underRoot(name, root, s.real); ok {
+			name = p
+			break
+		}
+	}
+	b.mu.Unlock()
+
+	var events []fsnotify.Event
+	if flags&flagRescan != 0 {
+		events = b.tracker.rescan()
+	} else {
+		events = b.tracker.confirm(name, fseventsOp(flags))
+	}
+	for _, e := range events {
+		select {
+		case b.events <- e:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// fseventsOp returns the changes described by flags.
+func fseventsOp(flags uint32) fsnotify.Op {
+	var op fsnotify.Op
+	if flags&flagCreated != 0 {
+		op |= fsnotify.Create
+	}
+	if flags&flagRemoved != 0 {
+		op |= fsnotify.Remove
+	}
+	if flags&flagRenamed != 0 {
+		op |= fsnotify.Rename
+	}
+	if flags&flagModified != 0 {
+		op |= fsnotify.Write
+	}
+	if flags&flagMetaMod != 0 {
+		op |= fsnotify.Chmod
+	}
+	return op
+}
+
+//export fseventsCallback
+func fseventsCallback(handle C.uintptr_t, n C.size_t, paths **C.char, flags *C.FSEventStreamEventFlags) {
+	fseventsMu.Lock()
+	b := fseventsBackends[uintptr(handle)]
+	fseventsMu.Unlock()
+	if b == nil {
+		return
+	}
+	names := (*[1 << 28]*C.char)(unsafe.Pointer(paths))[:n:n]
+	fl := (*[1 << 28]C.FSEventStreamEventFlags)(unsafe.Pointer(flags))[:n:n]
+	for i := range names {
+		b.receive(C.GoString(names[i]), uint32(fl[i]))
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+#include <CoreServices/CoreServices.h>
+#include <dispatch/dispatch.h>
+#include <stdint.h>
+
+dispatch_queue_t fseventsNewQueue(void);
+void fseventsReleaseQueue(dispatch_queue_t q);
+FSEventStreamRef fseventsStart(dispatch_queue_t q, uintptr_t handle, const char *root, double latency);
+void fseventsStop(dispatch_queue_t q, FSEventStreamRef s, int wait);
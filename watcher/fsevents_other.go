@@ -0,0 +1,16 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !darwin || !cgo
+// +build !darwin !cgo
+
+package watcher
+
+import "github.com/pkg/errors"
+
+// fseventsSupported indicates if WithFSEvents can be used in this build.
+const fseventsSupported = false
+
+func newFSEventsBackend() (backend, error) {
+	return nil, errors.New("FSEvents is not supported in this build")
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stalePolls is how many poll intervals may pass without a poll tick being
+// processed before the LogWatcher is considered unhealthy.
+const stalePolls = 3
+
+// Health describes whether a LogWatcher is still finding changes.
+type Health struct {
+	Fsnotify      bool      // The fsnotify backend was started
+	FsnotifyAlive bool      // The fsnotify backend is still delivering events
+	LastEvent     time.Time // When the last fsnotify event was processed, if any
+	Polling       bool      // Paths are polled for changes
+	LastPoll      time.Time // When the last poll tick was processed, or polling started
+	PollInterval  time.Duration
+	Restarts      int         // The number of times the fsnotify backend has been restarted
+	Watches       int         // The number of paths watched by fsnotify
+	WatchLimit    int         // The system's limit on fsnotify watches, or 0 if unknown
+	Limits        WatchLimits // The system's limits on inotify and the process's usage of them
+	Err           error       // The error that last stopped the fsnotify backend, if any
+	Closed        bool        // Close has been called
+
+	HeartbeatInterval time.Duration // How often heartbeats are sent, if WithHeartbeat is given
+	LastHeartbeat     time.Time     // When the last heartbeat was sent, if any
+}
+
+// LastActive returns when the LogWatcher last completed a poll tick or
+// processed an fsnotify event, whichever is later.  A LogWatcher that
+// hasn't been active for a while may have nothing to report, or be wedged.
+func (h Health) LastActive() time.Time {
+	if h.LastEvent.After(h.LastPoll) {
+		return h.LastEvent
+	}
+	return h.LastPoll
+}
+
+// HealthReporter is implemented by Watchers that can report their health.
+type HealthReporter interface {
+	Health() Health
+	Healthy() error
+}
+
+// health records the progress of a LogWatcher's backends.  The times are
+// set atomically, as they're set for every event and tick.
+type health struct {
+	lastEvent     int64 // In Unix nanoseconds, or 0 if never; accessed atomically
+	lastPoll      int64 // In Unix nanoseconds, or 0 if never; accessed atomically
+	lastHeartbeat int64 // In Unix nanoseconds, or 0 if never; accessed atomically
+
+	mu       sync.Mutex
+	alive    bool
+	restarts int
+	err      error
+}
+
+// loadTime returns the time stored atomically in t, or the zero time if
+// none has been.
+func loadTime(t *int64) time.Time {
+	if n := atomic.LoadInt64(t); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// event records that an fsnotify event was processed at now.
+func (h *health) event(now time.Time) {
+	atomic.StoreInt64(&h.lastEvent, now.UnixNano())
+}
+
+// poll records that a poll tick was processed at now.
+func (h *health) poll(now time.Time) {
+	atomic.StoreInt64(&h.lastPoll, now.UnixNano())
+}
+
+// heartbeat records that a heartbeat was sent at now.
+func (h *health) heartbeat(now time.Time) {
+	atomic.StoreInt64(&h.lastHeartbeat, now.UnixNano())
+}
+
+// stopped records that the fsnotify backend stopped unexpectedly with err.
+func (h *health) stopped(err error) {
+	h.mu.Lock()
+	h.alive = false
+	h.err = err
+	h.mu.Unlock()
+}
+
+// restarted records that a new fsnotify backend has been started.
+func (h *health) restarted() {
+	h.mu.Lock()
+	h.alive = true
+	h.restarts++
+	h.mu.Unlock()
+}
+
+// Health returns a snapshot of the LogWatcher's health.  It is safe to call
+// while the LogWatcher is running.
+func (w *LogWatcher) Health() Health {
+	h := Health{Limits: readWatchLimits()}
+	h.WatchLimit = h.Limits.MaxWatches
+	w.watchedMu.RLock()
+	h.Fsnotify = w.watcher != nil
+	h.Polling = w.pollTicker != nil
+	h.PollInterval = w.pollInterval
+	for _, watched := range w.watched {
+		if watched.sources&Fsnotify != 0 {
+			h.Watches++
+		}
+	}
+	h.Closed = w.closed
+	w.watchedMu.RUnlock()
+	h.LastEvent = loadTime(&w.health.lastEvent)
+	h.LastPoll = loadTime(&w.health.lastPoll)
+	h.HeartbeatInterval = w.heartbeatInterval
+	h.LastHeartbeat = loadTime(&w.health.lastHeartbeat)
+	w.health.mu.Lock()
+	h.FsnotifyAlive = w.health.alive
+	h.Restarts = w.health.restarts
+	h.Err = w.health.err
+	w.health.mu.Unlock()
+	return h
+}
+
+// Healthy returns an error if the LogWatcher has stopped finding changes:
+// it has been closed, the fsnotify backend is dead and not yet restarted,
+// it is using all the watches that the system allows, or the poll ticker
+// has stalled.  After the fsnotify backend can't be restarted the
+// LogWatcher is healthy while polling works.
+func (w *LogWatcher) Healthy() error {
+	h := w.Health()
+	switch {
+	case h.Closed:
+		return errors.New("log watcher is closed")
+	case h.Fsnotify && !h.FsnotifyAlive:
+		if h.Err != nil {
+			return errors.Wrap(h.Err, "fsnotify backend has stopped")
+		}
+		return errors.New("fsnotify backend has stopped")
+	case h.WatchLimit > 0 && h.Watches >= h.WatchLimit:
+		return errors.Errorf("using all %d fsnotify watches allowed", h.WatchLimit)
+	case h.Polling && w.clock.Now().Sub(h.LastPoll) > stalePolls*h.PollInterval:
+		return errors.Errorf("no poll tick processed since %s", h.LastPoll)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"time"
+
+	"github.com/sgtsquiggs/tail/clock"
+
+	"github.com/pkg/errors"
+)
+
+// WithHeartbeat sends a Heartbeat event every interval on the channels from
+// Events that ask for them with Heartbeats, so that their receivers can tell
+// a LogWatcher that has nothing to report from one that has stopped sending
+// events.  The time of the last heartbeat is in Health.
+func WithHeartbeat(interval time.Duration) Option {
+	return func(w *LogWatcher) error {
+		if interval <= 0 {
+			return errors.Errorf("invalid heartbeat interval %s", interval)
+		}
+		w.heartbeatInterval = interval
+		return nil
+	}
+}
+
+// Heartbeats asks for Heartbeat events to be sent on the channel with
+// handle.  Channels that don't ask aren't sent any.  It returns an error if
+// WithHeartbeat wasn't given.
+func (w *LogWatcher) Heartbeats(handle int) error {
+	if w.heartbeatInterval == 0 {
+		return errors.New("heartbeats aren't enabled; use WithHeartbeat")
+	}
+	w.eventsMu.Lock()
+	defer w.eventsMu.Unlock()
+	if handle < 0 || handle >= len(w.events) {
+		return errors.Errorf("no such event handle %d", handle)
+	}
+	w.heartbeats[handle] = true
+	return nil
+}
+
+// startHeartbeat starts sending heartbeats, if WithHeartbeat was given.
+func (w *LogWatcher) startHeartbeat() {
+	if w.heartbeatInterval == 0 {
+		return
+	}
+	w.stopHeartbeats = make(chan struct{})
+	w.heartbeatsDone = make(chan struct{})
+	go w.runHeartbeats(w.sched.NewTicker(w.heartbeatInterval))
+}
+
+// runHeartbeats sends a Heartbeat event on each channel that asked for them
+// every tick of ticker, until stopHeartbeats is closed.
+func (w *LogWatcher) runHeartbeats(ticker clock.Ticker) {
+	defer close(w.heartbeatsDone)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+		case <-w.stopHeartbeats:
+			return
+		}
+		w.health.heartbeat(w.clock.Now())
+		w.eventsMu.RLock()
+		var handles []int
+		for h := range w.events {
+			if w.heartbeats[h] {
+				handles = append(handles, h)
+			}
+		}
+		chans := w.events
+		w.eventsMu.RUnlock()
+		for _, h := range handles {
+			w.seq.next(h)
+			select {
+			case chans[h] <- Event{Op: Heartbeat}:
+			case <-w.stopHeartbeats:
+				return
+			}
+		}
+	}
+}
+
+// stopHeartbeat stops sending heartbeats, before the channels are closed.
+func (w *LogWatcher) stopHeartbeat() {
+	if w.stopHeartbeats != nil {
+		close(w.stopHeartbeats)
+		<-w.heartbeatsDone
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux
+// +build linux
+
+package watcher
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// inotifySupported indicates if WithInotify can be used in this build.
+const inotifySupported = true
+
+// inotifyMask is the events watched for on each path, as fsnotify watches.
+const inotifyMask = syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_CREATE | syscall.IN_ATTRIB |
+	syscall.IN_MODIFY | syscall.IN_MOVE_SELF | syscall.IN_DELETE | syscall.IN_DELETE_SELF
+
+// inotifyRaw is an event as read from inotify.
+type inotifyRaw struct {
+	wd     int
+	mask   uint32
+	cookie uint32
+	name   string // Name of the entry of a watched directory, if the event is for one
+}
+
+// inotifyBackend is a backend reading inotify directly, which pairs the
+// halves of renames by their cookies.
+type inotifyBackend struct {
+	fd int
+	f  *os.File // The inotify descriptor, read through the runtime's poller so that Close interrupts reads
+
+	mu        sync.Mutex // protects the fields below, and fd from being used after Close
+	closed    bool
+	watches   map[string]int // Watch descriptors, by path
+	paths     map[int]string // Paths, by watch descriptor
+	movedSelf map[int]bool   // Watches whose next IN_MOVE_SELF is already reported by a paired rename
+
+	events chan backendEvent
+	errors chan error
+	unused chan fsnotify.Event // Returned by Events, and closed with events
+	done   chan struct{}       // Closed by Close
+}
+
+func newInotifyBackend() (backend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	b := &inotifyBackend{
+		fd:        fd,
+		f:         os.NewFile(uintptr(fd), "inotify"),
+		watches:   make(map[string]int),
+		paths:     make(map[int]string),
+		movedSelf: make(map[int]bool),
+		events:    make(chan backendEvent),
+		errors:    make(chan error),
+		unused:    make(chan fsnotify.Event),
+		done:      make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+func (b *inotifyBackend) Add(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("inotify instance already closed")
+	}
+	wd, err := syscall.InotifyAddWatch(b.fd, name, inotifyMask)
+	if err != nil {
+		return err
+	}
+	if old, ok := b.watches[name]; ok && old != wd {
+		delete(b.paths, old)
+	}
+	b.watches[name] = wd
+	b.paths[wd] = name
+	return nil
+}
+
+func (b *inotifyBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errors.New("inotify instance already closed")
+	}
+	wd, ok := b.watches[name]
+	if !ok {
+		return errors.Errorf("can't remove non-existent inotify watch for %s", name)
+	}
+	delete(b.watches, name)
+	delete(b.paths, wd)
+	delete(b.movedSelf, wd)
+	if _, err := syscall.InotifyRmWatch(b.fd, uint32(wd)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (b *inotifyBackend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+	close(b.done)
+	return b.f.Close()
+}
+
+func (b *inotifyBackend) Events() <-chan fsnotify.Event     { return b.unused }
+func (b *inotifyBackend) PairedEvents() <-chan backendEvent { return b.events }
+func (b *inotifyBackend) Errors() <-chan error              { return b.errors }
+
+// run pairs the halves of renames in the events read from inotify, and sends
+// them until the backend is closed.
+func (b *inotifyBackend) run() {
+	defer close(b.unused)
+	defer close(b.errors)
+	defer close(b.events)
+	raw := make(chan []inotifyRaw)
+	go b.read(raw)
+	defer func() {
+		// Wait for read to stop before closing the channels it sends on.
+		for range raw {
+		}
+	}()
+	p := renamePairer{window: renamePairWindow}
+	var expiry <-chan time.Time
+	for {
+		var ready []backendEvent
+		select {
+		case batch, ok := <-raw:
+			if !ok {
+				return
+			}
+			now := time.Now()
+			for _, r := range batch {
+				if r.mask&syscall.IN_Q_OVERFLOW != 0 {
+					select {
+					case b.errors <- fsnotify.ErrEventOverflow:
+					case <-b.done:
+						return
+					}
+					continue
+				}
+				e, ok := b.convert(r)
+				if !ok {
+					continue
+				}
+				for _, e := range p.add(e, now) {
+					if e.From != "" {
+						b.renameWatches(e.From, e.Name)
+					}
+					ready = append(ready, e)
+				}
+			}
+		case now := <-expiry:
+			ready = p.expire(now)
+		}
+		for _, e := range ready {
+			select {
+			case b.events <- e:
+			case <-b.done:
+				return
+			}
+		}
+		expiry = nil
+		if at, ok := p.next(); ok {
+			expiry = time.After(time.Until(at))
+		}
+	}
+}
+
+// read sends the events read from inotify on raw, a read at a time, until
+// the backend is closed or a read fails.
+func (b *inotifyBackend) read(raw chan<- []inotifyRaw) {
+	defer close(raw)
+	buf := make([]byte, (syscall.SizeofInotifyEvent+syscall.NAME_MAX+1)*64)
+	for {
+		n, err := b.f.Read(buf)
+		if err != nil {
+			select {
+			case <-b.done:
+			case b.errors <- errors.Wrap(err, "failed to read inotify events"):
+			}
+			return
+		}
+		var batch []inotifyRaw
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			off += syscall.SizeofInotifyEvent
+			r := inotifyRaw{wd: int(ev.Wd), mask: ev.Mask, cookie: ev.Cookie}
+			if ev.Len > 0 {
+				r.name = string(bytes.TrimRight(buf[off:off+int(ev.Len)], "\x00"))
+				off += int(ev.Len)
+			}
+			batch = append(batch, r)
+		}
+		select {
+		case raw <- batch:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// convert returns the event for r, with the path of its watch, or false if
+// it isn't sent: its watch has been removed, or it's the IN_MOVE_SELF of a
+// watched file whose rename was paired.
+func (b *inotifyBackend) convert(r inotifyRaw) (rawEvent, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	name, ok := b.paths[r.wd]
+	if r.mask&syscall.IN_IGNORED != 0 {
+		if ok {
+			delete(b.paths, r.wd)
+			delete(b.movedSelf, r.wd)
+			if b.watches[name] == r.wd {
+				delete(b.watches, name)
+			}
+		}
+		return rawEvent{}, false
+	}
+	if !ok {
+		return rawEvent{}, false
+	}
+	if r.name != "" {
+		name = filepath.Join(name, r.name)
+	}
+	e := rawEvent{Event: fsnotify.Event{Name: name}}
+	switch {
+	case r.mask&syscall.IN_MOVED_FROM != 0:
+		e.Op, e.half, e.cookie = fsnotify.Rename, movedFrom, r.cookie
+	case r.mask&syscall.IN_MOVED_TO != 0:
+		e.Op, e.half, e.cookie = fsnotify.Create, movedTo, r.cookie
+	case r.mask&syscall.IN_CREATE != 0:
+		e.Op = fsnotify.Create
+	case r.mask&(syscall.IN_DELETE|syscall.IN_DELETE_SELF) != 0:
+		e.Op = fsnotify.Remove
+	case r.mask&syscall.IN_MOVE_SELF != 0:
+		if b.movedSelf[r.wd] {
+			delete(b.movedSelf, r.wd)
+			return rawEvent{}, false
+		}
+		e.Op = fsnotify.Rename
+	case r.mask&syscall.IN_MODIFY != 0:
+		e.Op = fsnotify.Write
+	case r.mask&syscall.IN_ATTRIB != 0:
+		e.Op = fsnotify.Chmod
+	default:
+		return rawEvent{}, false
+	}
+	return e, true
+}
+
+// renameWatches moves the watches on from, and on the paths below it, to
+// to, so that their later events are reported under the paths they've been
+// renamed to.
+func (b *inotifyBackend) renameWatches(from, to string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.watches {
+		if name == from || strings.HasPrefix(name, from+"/") {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		wd := b.watches[name]
+		moved := to + name[len(from):]
+		delete(b.watches, name)
+		b.watches[moved] = wd
+		b.paths[wd] = moved
+		if name == from {
+			b.movedSelf[wd] = true
+		}
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux
+// +build !linux
+
+package watcher
+
+import "github.com/pkg/errors"
+
+// inotifySupported indicates if WithInotify can be used in this build.
+const inotifySupported = false
+
+func newInotifyBackend() (backend, error) {
+	return nil, errors.New("inotify is not supported in this build")
+}
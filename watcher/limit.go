@@ -0,0 +1,141 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxWatchesSysctl   = "fs.inotify.max_user_watches"
+	maxInstancesSysctl = "fs.inotify.max_user_instances"
+)
+
+// defaultWatchLimitWarning is the fraction of the limit on inotify watches
+// that a LogWatcher may use before it warns, unless WithWatchLimitWarning
+// says otherwise.
+const defaultWatchLimitWarning = 0.8
+
+// WatchLimits describes the system's limits on inotify, and how much of
+// them the process is using.  The limits apply to all the processes of a
+// user, so other processes may be using some too.
+type WatchLimits struct {
+	Known        bool // The limits could be read, which is only on Linux
+	MaxWatches   int  // The value of fs.inotify.max_user_watches
+	MaxInstances int  // The value of fs.inotify.max_user_instances
+	Watches      int  // The inotify watches held by the process
+	Instances    int  // The inotify instances held by the process
+}
+
+func (l WatchLimits) String() string {
+	if !l.Known {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d of %d watches, %d of %d instances", l.Watches, l.MaxWatches, l.Instances, l.MaxInstances)
+}
+
+// WatchLimitError is returned when a path can't be watched because the limit
+// a sysctl sets on inotify has been reached, and says how to raise it.
+type WatchLimitError struct {
+	Path   string // The path that couldn't be watched, if any
+	Sysctl string // The sysctl setting the limit, such as fs.inotify.max_user_watches
+	Limit  int    // The value of the sysctl, or 0 if unknown
+	Err    error  // The error from inotify
+}
+
+func (e *WatchLimitError) Error() string {
+	what := fmt.Sprintf("watch %q", e.Path)
+	if e.Path == "" {
+		what = "create an inotify instance"
+	}
+	return fmt.Sprintf("Failed to %s: reached the limit of %d set by %s, which can be raised with sysctl: %s", what, e.Limit, e.Sysctl, e.Err)
+}
+
+// Cause returns the error from inotify, for errors.Cause.
+func (e *WatchLimitError) Cause() error {
+	return e.Err
+}
+
+// IsWatchLimit indicates if err, or the error it wraps, is a
+// WatchLimitError.
+func IsWatchLimit(err error) bool {
+	for err != nil {
+		if _, ok := err.(*WatchLimitError); ok {
+			return true
+		}
+		c, ok := err.(interface{ Cause() error })
+		if !ok {
+			return false
+		}
+		err = c.Cause()
+	}
+	return false
+}
+
+// limitError returns a WatchLimitError for err from watching path, or
+// creating an inotify instance if path is "", if err says a limit has been
+// reached, or nil.
+func limitError(path string, err error) error {
+	sysctl := limitSysctl(err)
+	if sysctl == "" {
+		return nil
+	}
+	e := &WatchLimitError{Path: path, Sysctl: sysctl, Err: errors.Cause(err)}
+	if l := readWatchLimits(); l.Known {
+		e.Limit = l.MaxWatches
+		if sysctl == maxInstancesSysctl {
+			e.Limit = l.MaxInstances
+		}
+	}
+	return e
+}
+
+// WithWatchLimitWarning logs a warning when the LogWatcher's fsnotify
+// watches reach fraction of fs.inotify.max_user_watches, rather than 0.8 of
+// it, so that the limit can be raised before watches start failing.  It's
+// logged again once the watches have dropped below fraction and reached it
+// again.
+func WithWatchLimitWarning(fraction float64) Option {
+	return func(w *LogWatcher) error {
+		if fraction <= 0 || fraction > 1 {
+			return errors.Errorf("watch limit warning must be a fraction in (0, 1], got %v", fraction)
+		}
+		w.limitWarning = fraction
+		return nil
+	}
+}
+
+// preflight reads the limits on inotify before the fsnotify backend is
+// created, and warns if the process is already near them.
+func (w *LogWatcher) preflight() {
+	w.limits = readWatchLimits()
+	w.logger.Infof("inotify usage: %s", w.limits)
+	if !w.limits.Known {
+		return
+	}
+	if w.limits.Instances+1 >= w.limits.MaxInstances {
+		w.logger.Warningf("Using %d of the %d inotify instances allowed; raise %s if the fsnotify backend can't start", w.limits.Instances, w.limits.MaxInstances, maxInstancesSysctl)
+	}
+	if float64(w.limits.Watches) >= w.limitWarning*float64(w.limits.MaxWatches) {
+		w.logger.Warningf("Using %d of the %d inotify watches allowed; raise %s", w.limits.Watches, w.limits.MaxWatches, maxWatchesSysctl)
+	}
+}
+
+// checkWatchLimitLocked warns once the fsnotify watches, with those the
+// process held before the LogWatcher was created, reach the fraction of the
+// limit given by WithWatchLimitWarning.  w.watchedMu must be locked when
+// called.
+func (w *LogWatcher) checkWatchLimitLocked() {
+	if !w.limits.Known {
+		return
+	}
+	used := w.limits.Watches + w.fsnotifyWatches
+	near := float64(used) >= w.limitWarning*float64(w.limits.MaxWatches)
+	if near && !w.limitWarned {
+		w.logger.Warningf("Using %d of the %d inotify watches allowed; raise %s before watches fail", used, w.limits.MaxWatches, maxWatchesSysctl)
+	}
+	w.limitWarned = near
+}
@@ -0,0 +1,82 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build linux
+// +build linux
+
+package watcher
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// readWatchLimits reads the limits on inotify from /proc/sys, and counts the
+// watches and instances the process holds from /proc/self/fdinfo.
+func readWatchLimits() WatchLimits {
+	var l WatchLimits
+	var err error
+	if l.MaxWatches, err = readSysctl(maxWatchesSysctl); err != nil {
+		return WatchLimits{}
+	}
+	if l.MaxInstances, err = readSysctl(maxInstancesSysctl); err != nil {
+		return WatchLimits{}
+	}
+	l.Known = true
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return l
+	}
+	for _, fd := range fds {
+		if target, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name())); err != nil || target != "anon_inode:inotify" {
+			continue
+		}
+		l.Instances++
+		b, err := ioutil.ReadFile(filepath.Join("/proc/self/fdinfo", fd.Name()))
+		if err != nil {
+			continue
+		}
+		s := bufio.NewScanner(bytes.NewReader(b))
+		for s.Scan() {
+			if strings.HasPrefix(s.Text(), "inotify wd:") {
+				l.Watches++
+			}
+		}
+	}
+	return l
+}
+
+// readSysctl returns the integer value of the sysctl name.
+func readSysctl(name string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc/sys", strings.Replace(name, ".", "/", -1)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to parse sysctl %s", name)
+	}
+	return n, nil
+}
+
+// limitSysctl returns the sysctl whose limit err, from inotify, says has
+// been reached, or "" if it isn't a limit.  inotify_add_watch fails with
+// ENOSPC when the user has all the watches allowed, and inotify_init with
+// EMFILE when the user has all the instances.
+func limitSysctl(err error) string {
+	switch errors.Cause(err) {
+	case syscall.ENOSPC:
+		return maxWatchesSysctl
+	case syscall.EMFILE:
+		return maxInstancesSysctl
+	}
+	return ""
+}
@@ -0,0 +1,19 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !linux
+// +build !linux
+
+package watcher
+
+// readWatchLimits returns limits that aren't Known, as the limits on watches
+// are only known on Linux.
+func readWatchLimits() WatchLimits {
+	return WatchLimits{}
+}
+
+// limitSysctl returns "", as errors are only attributed to inotify's limits
+// on Linux.
+func limitSysctl(err error) string {
+	return ""
+}
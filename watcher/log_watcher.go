@@ -4,39 +4,61 @@
 package watcher
 
 import (
-	"expvar"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
+	"github.com/sgtsquiggs/tail/clock"
+	"github.com/sgtsquiggs/tail/internal/expvars"
 	log "github.com/sgtsquiggs/tail/logger"
+	"github.com/sgtsquiggs/tail/schedule"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/pkg/errors"
 )
 
-var (
-	errorCount = expvar.NewInt("log_watcher_error_count")
+const (
+	// logRateInterval and logRateBurst limit the messages that may be
+	// repeated for every event, such as errors from fsnotify: logRateBurst
+	// may be logged at once, and then one every logRateInterval.
+	logRateInterval = 10 * time.Second
+	logRateBurst    = 3
 )
 
 type watch struct {
-	c  chan Event
-	fi os.FileInfo
+	name    string // The path watched, as given to Add or found by polling
+	c       chan Event
+	fi      os.FileInfo
+	isDir   bool
+	sources Source    // Where changes to the path are found
+	mode    WatchMode // The sources asked for when the path was added
 }
 
 // LogWatcher implements a Watcher for watching real filesystems.
 type LogWatcher struct {
-	watcher    *fsnotify.Watcher
-	pollTicker *time.Ticker
+	newBackend   func() (backend, error)
+	restartDelay time.Duration // How long to wait before first restarting a dead backend
+	stopEvents   chan struct{} // Channel to stop waiting to restart the backend.
+
+	watcher      backend       // The fsnotify backend, if in use; protected by watchedMu
+	pollTicker   clock.Ticker  // protected by watchedMu
+	pollInterval time.Duration // protected by watchedMu once running
+	pollReset    chan struct{} // Tells runTicks that pollTicker has been replaced
 
 	eventsMu sync.RWMutex
 	events   []chan Event
+	handles  map[chan Event]int // The handle of each channel in events
+	seq      *sequences         // Counts the events sent on each channel
+	replay   replay             // Copies the events to the channels from EventsWithReplay
 
-	watchedMu sync.RWMutex // protects `watched'
-	watched   map[string]*watch
+	watchedMu sync.RWMutex      // protects `watched', `closed', `watcher' and `pollTicker'
+	watched   map[string]*watch // By the key of the path
+	closed    bool              // Close has been called, so no more events can be sent
+	foldCase  bool              // Paths are compared without regard to case
 
 	stopTicks chan struct{} // Channel to notify ticker to stop.
 
@@ -45,7 +67,36 @@ type LogWatcher struct {
 
 	closeOnce sync.Once
 
-	logger log.Logger
+	merge merger // Drops events found by more than one source
+
+	counts  counters // Events sent for each path
+	metrics metrics  // The LogWatcher's counters
+
+	expvarPrefix  string // Prefix of the names metrics are published under
+	publishExpvar bool   // WithExpvar was given
+	countByRoot   bool   // Count events in expvar by the watched path they were found through
+
+	limits          WatchLimits // The limits on inotify when the LogWatcher was created
+	limitWarning    float64     // Fraction of the watch limit at which to warn
+	limitWarned     bool        // The watches have reached limitWarning; protected by watchedMu
+	fsnotifyWatches int         // Paths watched by the fsnotify backend; protected by watchedMu
+
+	health health
+
+	heartbeatInterval time.Duration // How often heartbeats are sent, if > 0
+	heartbeats        map[int]bool  // Handles of the channels that asked for heartbeats; protected by eventsMu
+	stopHeartbeats    chan struct{} // Closed to stop sending heartbeats
+	heartbeatsDone    chan struct{} // Closed when heartbeats have stopped
+
+	logger *log.Leveled
+	hotLog *log.RateLimitedLogger // Limits the messages that may be repeated for every event
+	clock  clock.Clock
+	sched  *schedule.Scheduler // Times the polls
+
+	started   bool        // NewFromConfig has returned, so SetOption only accepts dynamic options
+	optionsMu sync.Mutex  // serialises SetOption once started
+	probeOf   *LogWatcher // The running LogWatcher, if this is a probe of SetOption
+	dynamic   bool        // The option applied to this probe can be changed while running
 }
 
 // Option used to set trailer options.
@@ -54,49 +105,127 @@ type Option func(*LogWatcher) error
 // Logger defines the logger.
 func Logger(l log.Logger) Option {
 	return func(t *LogWatcher) error {
-		t.logger = l
+		t.logger = log.NewLeveled(l, t.logger.Level())
+		t.hotLog = log.RateLimited(t.logger, logRateInterval, logRateBurst)
 		return nil
 	}
 }
 
+// WithClock sets the clock used for the poll ticker, instead of the real
+// clock.
+func WithClock(c clock.Clock) Option {
+	return func(t *LogWatcher) error {
+		t.clock = c
+		return nil
+	}
+}
+
+// WithLogLevel sets the verbosity of the LogWatcher's logging.  Per-event
+// messages are logged at DebugLevel.
+func WithLogLevel(level log.Level) Option {
+	return func(w *LogWatcher) error {
+		return w.update(func(w *LogWatcher) error {
+			w.SetLogLevel(level)
+			return nil
+		})
+	}
+}
+
 // NewLogWatcher returns a new LogWatcher, or returns an error.
 func NewLogWatcher(pollInterval time.Duration, enableFsnotify bool, options ...Option) (*LogWatcher, error) {
-	var f *fsnotify.Watcher
-	var fsErr error
-	if enableFsnotify {
-		// if there is an error, log it after options are applied
-		f, fsErr = fsnotify.NewWatcher()
+	return NewFromConfig(Config{PollInterval: pollInterval, EnableFsnotify: enableFsnotify, Options: options})
+}
+
+// NewFromConfig returns a new LogWatcher with the settings in c, which is
+// validated first.
+func NewFromConfig(c Config) (*LogWatcher, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
 	}
-	if f == nil && pollInterval == 0 {
-		pollInterval = time.Millisecond * 250
+	w := newLogWatcher()
+	if err := w.SetOption(c.Options...); err != nil {
+		return nil, err
 	}
-	w := &LogWatcher{
-		watcher: f,
-		events:  make([]chan Event, 0),
-		watched: make(map[string]*watch),
-		logger:  log.DefaultLogger,
+	if w.publishExpvar {
+		if err := expvars.Publish(w.expvarPrefix, w.metrics.vars()); err != nil {
+			return nil, err
+		}
 	}
-	if err := w.SetOption(options...); err != nil {
-		return nil, err
+	w.sched = schedule.New(w.clock)
+	pollInterval := c.PollInterval
+	if w.pollInterval > 0 {
+		pollInterval = w.pollInterval
 	}
-	if fsErr != nil {
-		w.logger.Warning(fsErr)
+	var b backend
+	if c.EnableFsnotify {
+		w.preflight()
+		var err error
+		if b, err = w.newBackend(); err != nil {
+			if lerr := limitError("", err); lerr != nil {
+				err = lerr
+			}
+			w.logger.Warning(err)
+		}
+	}
+	if b == nil && pollInterval == 0 {
+		pollInterval = defaultPollInterval
 	}
 	if pollInterval > 0 {
-		w.pollTicker = time.NewTicker(pollInterval)
-		w.stopTicks = make(chan struct{})
-		w.ticksDone = make(chan struct{})
-		go w.runTicks()
+		w.startPolling(pollInterval)
 	}
-	if f != nil {
+	if b != nil {
+		w.watcher = b
+		w.health.alive = true
+		w.stopEvents = make(chan struct{})
 		w.eventsDone = make(chan struct{})
-		go w.runEvents()
+		go w.runEvents(b)
 	}
+	w.startHeartbeat()
+	w.started = true
 	return w, nil
 }
 
-// SetOption takes one or more option functions and applies them in order to Tailer.
+// newLogWatcher returns a LogWatcher with the default settings, before
+// options are applied.
+func newLogWatcher() *LogWatcher {
+	w := &LogWatcher{
+		newBackend:   newFsnotifyBackend,
+		restartDelay: initialRestartDelay,
+		events:       make([]chan Event, 0),
+		handles:      make(map[chan Event]int),
+		heartbeats:   make(map[int]bool),
+		seq:          newSequences(),
+		watched:      make(map[string]*watch),
+		merge:        merger{last: make(map[string]lastEvent)},
+		counts:       counters{paths: make(map[string]*EventCounts)},
+		logger:       log.NewLeveled(log.DefaultLogger, log.InfoLevel),
+		clock:        clock.Real,
+		limitWarning: defaultWatchLimitWarning,
+		pollReset:    make(chan struct{}, 1),
+		foldCase:     CaseInsensitivePaths,
+	}
+	w.hotLog = log.RateLimited(w.logger, logRateInterval, logRateBurst)
+	return w
+}
+
+// startPolling starts polling the watched paths every interval.
+func (w *LogWatcher) startPolling(interval time.Duration) {
+	w.pollInterval = interval
+	w.health.poll(w.clock.Now())
+	w.pollTicker = w.sched.NewTicker(interval)
+	w.stopTicks = make(chan struct{})
+	w.ticksDone = make(chan struct{})
+	go w.runTicks()
+}
+
+// SetOption takes one or more option functions and applies them in order to
+// the LogWatcher.  Once it's running, only WithLogLevel and WithPollInterval
+// can be given, and are safe to give while it runs; the others return an
+// *ErrStaticOption.
 func (w *LogWatcher) SetOption(options ...Option) error {
+	if w.started {
+		return w.setOptionRunning(options)
+	}
 	for _, option := range options {
 		if err := option(w); err != nil {
 			return err
@@ -105,62 +234,124 @@ func (w *LogWatcher) SetOption(options ...Option) error {
 	return nil
 }
 
+// SetLogLevel changes the verbosity of the LogWatcher's logging.  It is safe
+// to call while the LogWatcher is running.
+func (w *LogWatcher) SetLogLevel(level log.Level) {
+	w.logger.SetLevel(level)
+}
+
 // Events returns a new readable channel of events from this watcher.
 func (w *LogWatcher) Events() (int, <-chan Event) {
 	w.eventsMu.Lock()
 	handle := len(w.events)
 	ch := make(chan Event)
 	w.events = append(w.events, ch)
+	w.handles[ch] = handle
 	w.eventsMu.Unlock()
 	return handle, ch
 }
 
+// EventsSent returns the number of events sent, or being sent, on the
+// channel with handle.
+func (w *LogWatcher) EventsSent(handle int) uint64 {
+	return w.seq.sentOn(handle)
+}
+
+// AckEvents records that the receiver on the channel with handle has handled
+// the first seq events sent on it.
+func (w *LogWatcher) AckEvents(handle int, seq uint64) {
+	w.seq.ack(handle, seq)
+}
+
 func (w *LogWatcher) sendEvent(e Event) {
+	if watch, root, ok := w.watchFor(e.Pathname); ok {
+		w.dispatch(watch.c, e, Fsnotify, root)
+		return
+	}
+	if w.logger.Enabled(log.DebugLevel) {
+		w.logger.With(map[string]interface{}{"path": e.Pathname, "op": e.Op}).Debugf("No channel for path %q", e.Pathname)
+	}
+}
+
+// watchFor returns the watch whose channel the events for pathname are sent
+// on, and the watched path it was found through: pathname itself, or the
+// directory containing it.
+func (w *LogWatcher) watchFor(pathname string) (*watch, string, bool) {
 	w.watchedMu.RLock()
-	watch, ok := w.watched[e.Pathname]
-	w.watchedMu.RUnlock()
-	if !ok {
-		d := filepath.Dir(e.Pathname)
-		w.watchedMu.RLock()
-		watch, ok = w.watched[d]
-		w.watchedMu.RUnlock()
+	defer w.watchedMu.RUnlock()
+	if watch, ok := w.watched[w.key(pathname)]; ok {
+		return watch, watch.name, true
 	}
-	if ok {
-		watch.c <- e
-		return
+	watch, ok := w.watched[w.key(filepath.Dir(pathname))]
+	if !ok {
+		return nil, "", false
 	}
-	w.logger.Infof("No channel for path %q", e.Pathname)
+	return watch, watch.name, true
 }
 
 func (w *LogWatcher) runTicks() {
 	defer close(w.ticksDone)
 
-	if w.pollTicker == nil {
+	w.watchedMu.RLock()
+	ticker := w.pollTicker
+	w.watchedMu.RUnlock()
+	if ticker == nil {
 		return
 	}
 
 Exit:
 	for {
 		select {
-		case _ = <-w.pollTicker.C:
-			w.watchedMu.Lock()
-			for n, watched := range w.watched {
-				w.pollWatchedPathLocked(n, watched)
-			}
-			w.watchedMu.Unlock()
+		case <-w.pollReset:
+			// WithPollInterval replaced the ticker.
+			w.watchedMu.RLock()
+			ticker = w.pollTicker
+			w.watchedMu.RUnlock()
+		case _ = <-ticker.C():
+			w.safely("poll", w.pollWatched)
+			w.health.poll(w.clock.Now())
 		case <-w.stopTicks:
+			w.watchedMu.RLock()
 			w.pollTicker.Stop()
+			w.watchedMu.RUnlock()
 			break Exit
 		}
 	}
 }
 
+// pollWatched polls the watched paths polling is used for.
+func (w *LogWatcher) pollWatched() {
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	for _, watched := range w.watched {
+		if watched.sources&Poll != 0 {
+			w.pollWatchedPathLocked(watched.name, watched)
+		}
+	}
+}
+
+// PollNow checks all the watched paths for changes immediately, without
+// waiting for the next poll, and returns once the resulting events have been
+// sent.  It can be used whether or not polling is enabled, and returns an
+// error if the LogWatcher has been closed.
+func (w *LogWatcher) PollNow() error {
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	if w.closed {
+		return errors.New("log watcher is closed")
+	}
+	for _, watched := range w.watched {
+		w.pollWatchedPathLocked(watched.name, watched)
+	}
+	return nil
+}
+
 // pollWatchedPathLocked polls an already-watched path for updates.  w.watchedMu must be locked when called.
 func (w *LogWatcher) pollWatchedPathLocked(pathname string, watched *watch) {
-	w.logger.Info("stat")
-	fi, err := os.Stat(pathname)
+	w.logger.Debug("stat")
+	fi, err := StatExtended(pathname)
 	if err != nil {
-		w.logger.Info(err)
+		w.logger.Debug(err)
 		return
 	}
 
@@ -168,40 +359,46 @@ func (w *LogWatcher) pollWatchedPathLocked(pathname string, watched *watch) {
 	if fi.IsDir() {
 		w.pollDirectoryLocked(watched.c, pathname)
 	} else if watched.fi == nil || fi.ModTime().Sub(watched.fi.ModTime()) > 0 {
-		w.logger.Infof("sending update for %s", pathname)
-		watched.c <- Event{Update, pathname}
+		if w.logger.Enabled(log.DebugLevel) {
+			w.logger.With(map[string]interface{}{"path": pathname, "op": Update}).Debugf("sending update for %s", pathname)
+		}
+		w.dispatch(watched.c, Event{Op: Update, Pathname: pathname}, Poll, pathname)
 	}
 
-	w.logger.Info("Update fi")
+	w.logger.Debug("Update fi")
 	watched.fi = fi
 }
 
 func (w *LogWatcher) pollDirectoryLocked(c chan Event, pathname string) {
-	matches, err := filepath.Glob(path.Join(pathname, "*"))
+	matches, err := GlobExtended(path.Join(pathname, "*"))
 	if err != nil {
-		w.logger.Info(err)
+		w.logger.Debug(err)
 		return
 	}
 	// TODO(jaq): how do we avoid duplicate notifies for things that are already in the watch list?
 	for _, match := range matches {
-		fi, err := os.Stat(match)
+		fi, err := StatExtended(match)
 		if err != nil {
-			w.logger.Info(err)
+			w.logger.Debug(err)
 			continue
 		}
 
-		watched, ok := w.watched[match]
+		watched, ok := w.watched[w.key(match)]
 		switch {
 		case !ok:
-			w.logger.Infof("sending create for %s", match)
-			c <- Event{Create, match}
-			w.watched[match] = &watch{c: c, fi: fi}
+			if w.logger.Enabled(log.DebugLevel) {
+				w.logger.With(map[string]interface{}{"path": match, "op": Create}).Debugf("sending create for %s", match)
+			}
+			w.dispatch(c, Event{Op: Create, Pathname: match}, Poll, pathname)
+			w.watched[w.key(match)] = &watch{name: match, c: c, fi: fi, isDir: fi.IsDir(), sources: Poll}
 		case watched.fi != nil && fi.ModTime().Sub(watched.fi.ModTime()) > 0:
-			w.logger.Infof("sending update for %s", match)
-			c <- Event{Update, match}
-			w.watched[match].fi = fi
+			if w.logger.Enabled(log.DebugLevel) {
+				w.logger.With(map[string]interface{}{"path": match, "op": Update}).Debugf("sending update for %s", match)
+			}
+			w.dispatch(c, Event{Op: Update, Pathname: match}, Poll, pathname)
+			watched.fi = fi
 		default:
-			w.logger.Infof("No modtime change for %s, no send", match)
+			w.logger.Debugf("No modtime change for %s, no send", match)
 		}
 		if fi.IsDir() {
 			w.pollDirectoryLocked(c, match)
@@ -209,67 +406,157 @@ func (w *LogWatcher) pollDirectoryLocked(c chan Event, pathname string) {
 	}
 }
 
-// runEvents assumes that w.watcher is not nil
-func (w *LogWatcher) runEvents() {
+// runEvents sends the events from the fsnotify backend b, restarting it if
+// it stops before the LogWatcher is closed.
+func (w *LogWatcher) runEvents(b backend) {
 	defer close(w.eventsDone)
 
+	attempts := 0
+	for {
+		started := w.clock.Now()
+		w.receive(b)
+		if w.isClosed() {
+			w.logger.Infof("Shutting down log watcher.")
+			return
+		}
+		w.metrics.errorCount.Add(1)
+		w.logger.Errorf("fsnotify backend stopped unexpectedly")
+		w.health.stopped(errors.New("fsnotify events channel closed"))
+		if w.clock.Now().Sub(started) > restartReset {
+			attempts = 0
+		}
+		for b = nil; b == nil; attempts++ {
+			if attempts >= maxRestarts {
+				w.fallBackToPolling()
+				return
+			}
+			var err error
+			b, err = w.restartBackend(attempts)
+			if err != nil {
+				w.metrics.restartErrorCount.Add(1)
+				w.logger.Error(err)
+			} else if b == nil {
+				return
+			}
+		}
+	}
+}
+
+// isClosed indicates if Close has been called.
+func (w *LogWatcher) isClosed() bool {
+	w.watchedMu.RLock()
+	defer w.watchedMu.RUnlock()
+	return w.closed
+}
+
+// receive sends the events from the fsnotify backend b until it stops.
+func (w *LogWatcher) receive(b backend) {
 	// Suck out errors and dump them to the error log.
 	go func() {
-		for err := range w.watcher.Errors {
-			errorCount.Add(1)
-			w.logger.Errorf("fsnotify error: %s\n", err)
+		for err := range b.Errors() {
+			w.metrics.errorCount.Add(1)
+			w.hotLog.Key("fsnotify error").Errorf("fsnotify error: %s", err)
 		}
 	}()
 
-	for e := range w.watcher.Events {
-		w.logger.Infof("watcher event %v", e)
-		switch {
-		case e.Op&fsnotify.Create == fsnotify.Create:
-			w.sendEvent(Event{Create, e.Name})
-		case e.Op&fsnotify.Write == fsnotify.Write,
-			e.Op&fsnotify.Chmod == fsnotify.Chmod:
-			w.sendEvent(Event{Update, e.Name})
-		case e.Op&fsnotify.Remove == fsnotify.Remove:
-			w.sendEvent(Event{Delete, e.Name})
-		case e.Op&fsnotify.Rename == fsnotify.Rename:
-			// Rename is only issued on the original file path; the new name receives a Create event
-			w.sendEvent(Event{Delete, e.Name})
-		default:
-			panic(fmt.Sprintf("unknown op type %v", e.Op))
+	if pb, ok := b.(pairingBackend); ok {
+		for e := range pb.PairedEvents() {
+			w.safely("event dispatch", func() { w.handlePairedEvent(e) })
 		}
+		return
+	}
+	for e := range b.Events() {
+		w.safely("event dispatch", func() { w.handleBackendEvent(e) })
+	}
+}
+
+// handlePairedEvent sends the event for e, from a pairing fsnotify backend.
+func (w *LogWatcher) handlePairedEvent(e backendEvent) {
+	if e.From == "" {
+		w.handleBackendEvent(e.Event)
+		return
+	}
+	e.Name, e.From = TrimExtendedPath(e.Name), TrimExtendedPath(e.From)
+	if w.logger.Enabled(log.DebugLevel) {
+		w.logger.With(map[string]interface{}{"path": e.Name, "from": e.From}).Debugf("watcher rename of %s to %s", e.From, e.Name)
+	}
+	w.health.event(w.clock.Now())
+	w.renameWatched(e.From, e.Name)
+	w.sendRename(e.From, e.Name)
+}
+
+// handleBackendEvent sends the event for e, from the fsnotify backend.
+func (w *LogWatcher) handleBackendEvent(e fsnotify.Event) {
+	// The backend names what's below a watched path as it was added.
+	e.Name = TrimExtendedPath(e.Name)
+	if w.logger.Enabled(log.DebugLevel) {
+		w.logger.With(map[string]interface{}{"path": e.Name, "op": e.Op}).Debugf("watcher event %v", e)
+	}
+	w.health.event(w.clock.Now())
+	switch {
+	case e.Op&fsnotify.Create == fsnotify.Create:
+		w.sendEvent(Event{Op: Create, Pathname: e.Name})
+	case e.Op&fsnotify.Write == fsnotify.Write,
+		e.Op&fsnotify.Chmod == fsnotify.Chmod:
+		w.sendEvent(Event{Op: Update, Pathname: e.Name})
+	case e.Op&fsnotify.Remove == fsnotify.Remove:
+		w.sendEvent(Event{Op: Delete, Pathname: e.Name})
+	case e.Op&fsnotify.Rename == fsnotify.Rename:
+		// Rename is only issued on the original file path; the new name receives a Create event
+		w.sendEvent(Event{Op: Delete, Pathname: e.Name})
+	default:
+		panic(fmt.Sprintf("unknown op type %v", e.Op))
 	}
-	w.logger.Infof("Shutting down log watcher.")
 }
 
 // Close shuts down the LogWatcher.  It is safe to call this from multiple clients.
 func (w *LogWatcher) Close() (err error) {
 	w.closeOnce.Do(func() {
-		if w.watcher != nil {
-			err = w.watcher.Close()
+		w.watchedMu.Lock()
+		w.closed = true
+		b := w.watcher
+		w.watchedMu.Unlock()
+		if w.eventsDone != nil {
+			close(w.stopEvents)
+			if b != nil {
+				err = b.Close()
+			}
 			<-w.eventsDone
 		}
-		if w.pollTicker != nil {
+		// The events handler may have started polling, so check after it's done.
+		w.watchedMu.RLock()
+		polling := w.pollTicker != nil
+		w.watchedMu.RUnlock()
+		if polling {
 			close(w.stopTicks)
 			<-w.ticksDone
 		}
-		w.logger.Info("Closing events channels")
+		w.stopHeartbeat()
+		w.stopReplays()
+		w.sched.Close()
+		w.logger.Debug("Closing events channels")
 		w.eventsMu.Lock()
 		for _, c := range w.events {
 			close(c)
 		}
 		w.eventsMu.Unlock()
+		w.seq.close()
 	})
 	return nil
 }
 
 // Add adds a path to the list of watched items.
 // If the path is already being watched, then nothing is changed -- the new handle does not replace the old one.
-func (w *LogWatcher) Add(path string, handle int) error {
+// A WatchMode given in opts chooses how changes to the path are found; it's
+// an error if it needs a source the LogWatcher isn't using.
+func (w *LogWatcher) Add(path string, handle int, opts ...AddOption) error {
+	o := newAddOptions(opts)
 	w.eventsMu.RLock()
-	if handle > len(w.events) {
+	n := len(w.events)
+	w.eventsMu.RUnlock()
+	if handle < 0 || handle >= n {
 		return errors.Errorf("no such event handle %d", handle)
 	}
-	w.eventsMu.RUnlock()
 	if w.IsWatching(path) {
 		return nil
 	}
@@ -278,45 +565,97 @@ func (w *LogWatcher) Add(path string, handle int) error {
 		return errors.Wrapf(err, "Failed to lookup absolutepath of %q", path)
 	}
 	w.logger.Infof("Adding a watch on resolved path %q", absPath)
+	fi, err := StatExtended(absPath)
+	isDir := err == nil && fi.IsDir()
+	// Hold watchedMu while adding to the backend, so that a restart of the
+	// backend either sees this path or happens first.
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	var have Source
 	if w.watcher != nil {
-		err = w.watcher.Add(absPath)
-		if err != nil {
-			if os.IsPermission(err) {
-				w.logger.Infof("Skipping permission denied error on adding a watch.")
-			} else {
-				return errors.Wrapf(err, "Failed to create a new watch on %q", absPath)
+		have |= Fsnotify
+	}
+	if w.pollTicker != nil {
+		have |= Poll
+	}
+	want, err := o.mode.sources(have)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to watch %q", absPath)
+	}
+	var sources Source
+	if want&Fsnotify != 0 {
+		err = w.watcher.Add(ExtendPath(absPath))
+		switch {
+		case err == nil:
+			sources |= Fsnotify
+			w.fsnotifyWatches++
+			w.checkWatchLimitLocked()
+		case os.IsPermission(err):
+			w.logger.Infof("Skipping permission denied error on adding a watch.")
+		case isClosedErr(err):
+			// The backend has died, and adds this path when it's restarted.
+			w.logger.Infof("Deferring the watch on %q until the fsnotify backend restarts", absPath)
+		default:
+			if lerr := limitError(absPath, err); lerr != nil {
+				return lerr
 			}
+			return errors.Wrapf(err, "Failed to create a new watch on %q", absPath)
 		}
 	}
-	w.watchedMu.Lock()
+	if want&Poll != 0 {
+		sources |= Poll
+	}
 	w.eventsMu.RLock()
-	w.watched[absPath] = &watch{c: w.events[handle]}
+	w.watched[w.key(absPath)] = &watch{name: absPath, c: w.events[handle], isDir: isDir, sources: sources, mode: o.mode}
 	w.eventsMu.RUnlock()
-	w.watchedMu.Unlock()
 	return nil
 }
 
+// WatchedPaths returns the paths being watched, sorted by pathname.
+func (w *LogWatcher) WatchedPaths() []WatchedPath {
+	w.watchedMu.RLock()
+	defer w.watchedMu.RUnlock()
+	paths := make([]WatchedPath, 0, len(w.watched))
+	for _, watched := range w.watched {
+		paths = append(paths, WatchedPath{Pathname: watched.name, IsDir: watched.isDir, Sources: watched.sources, Mode: watched.mode})
+	}
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Pathname < paths[j].Pathname })
+	return paths
+}
+
 // IsWatching indicates if the path is being watched. It includes both
 // filenames and directories.
 func (w *LogWatcher) IsWatching(path string) bool {
 	absPath, err := filepath.Abs(path)
 	if err != nil {
-		w.logger.Infof("Couldn't resolve path %q: %s", absPath, err)
+		w.logger.Debugf("Couldn't resolve path %q: %s", absPath, err)
 		return false
 	}
-	w.logger.Infof("Resolved path for lookup %q", absPath)
+	w.logger.Debugf("Resolved path for lookup %q", absPath)
 	w.watchedMu.RLock()
-	_, ok := w.watched[absPath]
+	_, ok := w.watched[w.key(absPath)]
 	w.watchedMu.RUnlock()
 	return ok
 }
 
 func (w *LogWatcher) Remove(path string) error {
 	w.watchedMu.Lock()
-	delete(w.watched, path)
+	watched, ok := w.watched[w.key(path)]
+	if ok {
+		// The backend knows it by the spelling it was added with.
+		path = watched.name
+		if watched.sources&Fsnotify != 0 {
+			w.fsnotifyWatches--
+			w.checkWatchLimitLocked()
+		}
+	}
+	delete(w.watched, w.key(path))
+	b := w.watcher
 	w.watchedMu.Unlock()
-	if w.watcher != nil {
-		return w.watcher.Remove(path)
+	w.merge.forget(path)
+	w.forgetCounts(path)
+	if b != nil {
+		return b.Remove(ExtendPath(path))
 	}
 	return nil
 }
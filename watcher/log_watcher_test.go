@@ -13,12 +13,15 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
-	"strconv"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/sgtsquiggs/tail/testutil"
 )
 
@@ -220,6 +223,54 @@ func TestLogWatcherAddError(t *testing.T) {
 	}
 }
 
+func TestConfigValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		c     Config
+		field string
+	}{
+		{"valid", Config{PollInterval: time.Second, EnableFsnotify: true, Options: []Option{WithLogLevel(logger.InfoLevel)}}, ""},
+		{"zero", Config{}, ""},
+		{"poll interval", Config{PollInterval: -time.Second}, "PollInterval"},
+		{"nil option", Config{Options: []Option{nil}}, "Options[0]"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.c.Validate()
+			if tc.field == "" {
+				testutil.FatalIfErr(t, err)
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "watcher.Config."+tc.field+":") {
+				t.Errorf("expected an error naming %s, got %v", tc.field, err)
+			}
+		})
+	}
+	if _, err := NewLogWatcher(-time.Second, false); err == nil {
+		t.Error("expected an error for a negative poll interval")
+	}
+}
+
+func TestLogWatcherNoSuchHandle(t *testing.T) {
+	w, err := NewLogWatcher(time.Hour, false)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, _ := w.Events()
+	if err := w.Add(os.TempDir(), handle+1); err == nil {
+		t.Error("expecting error, got nil")
+	}
+	// The failed Add mustn't leave the events lock held.
+	done := make(chan struct{})
+	go func() {
+		w.Events()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(deadline):
+		t.Fatal("Events blocked after a failed Add")
+	}
+}
+
 func TestLogWatcherAddWhilePermissionDenied(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping log watcher test in short mode")
@@ -275,24 +326,50 @@ func TestWatcherErrors(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping log watcher test in short mode")
 	}
-	orig, err := strconv.ParseInt(expvar.Get("log_watcher_error_count").String(), 10, 64)
-	if err != nil {
-		t.Fatalf("couldn't convert expvar %q", expvar.Get("log_watcher_error_count").String())
-	}
 	w, err := NewLogWatcher(0, true)
 	if err != nil {
 		t.Fatalf("couldn't create a watcher")
 	}
-	w.watcher.Errors <- errors.New("Injected error for test")
+	w.watcher.(fsnotifyBackend).w.Errors <- errors.New("Injected error for test")
 	if err := w.Close(); err != nil {
 		t.Fatalf("watcher close failed: %q", err)
 	}
-	expected := strconv.FormatInt(orig+1, 10)
-	if diff := testutil.Diff(expected, expvar.Get("log_watcher_error_count").String()); diff != "" {
+	if diff := testutil.Diff("1", w.metrics.errorCount.String()); diff != "" {
 		t.Errorf("log watcher error count not increased:\n%s", diff)
 	}
 }
 
+// expvarRuns numbers the prefixes given by testExpvarPrefix.
+var expvarRuns int64
+
+// testExpvarPrefix returns a prefix to publish a test's expvars under that
+// no other run of it in the process has used.
+func testExpvarPrefix(t *testing.T) string {
+	return fmt.Sprintf("%s_%d_", t.Name(), atomic.AddInt64(&expvarRuns, 1))
+}
+
+func TestWatcherExpvar(t *testing.T) {
+	prefix := testExpvarPrefix(t)
+	w, err := NewLogWatcher(0, true, WithExpvar(prefix))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	if v := expvar.Get(prefix + "log_watcher_error_count"); v != &w.metrics.errorCount {
+		t.Errorf("expected the watcher's error count published, got %v", v)
+	}
+
+	// Another LogWatcher counts its own errors, and can't be published under
+	// the same names.
+	if _, err := NewLogWatcher(0, true, WithExpvar(prefix)); err == nil {
+		t.Error("expected an error publishing the same names twice")
+	}
+	other, err := NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	defer other.Close()
+	if &other.metrics.errorCount == &w.metrics.errorCount {
+		t.Error("expected another watcher to count its own errors")
+	}
+}
+
 func TestWatcherNewFile(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping log watcher test in short mode")
@@ -306,15 +383,16 @@ func TestWatcherNewFile(t *testing.T) {
 	}
 	for _, test := range tests {
 		t.Run(fmt.Sprintf("%s %v", test.d, test.b), func(t *testing.T) {
-			w, err := NewLogWatcher(test.d, test.b)
+			clk := testutil.NewFakeClock(time.Now())
+			w, err := NewLogWatcher(test.d, test.b, WithClock(clk))
 			testutil.FatalIfErr(t, err)
 			tmpDir, rmTmpDir := testutil.TestTempDir(t)
 			defer rmTmpDir()
 			handle, eventsChan := w.Events()
 			testutil.FatalIfErr(t, w.Add(tmpDir, handle))
 			result := []Event{}
+			received := make(chan struct{}, 10)
 			done := make(chan struct{})
-			wg := sync.WaitGroup{}
 			go func() {
 				for event := range eventsChan {
 					logger.DefaultLogger.Infof("Event: %v", event)
@@ -322,13 +400,18 @@ func TestWatcherNewFile(t *testing.T) {
 					if event.Op == Update && event.Pathname == tmpDir {
 						testutil.FatalIfErr(t, w.Add(path.Join(tmpDir, "log"), handle))
 					}
-					wg.Done()
+					received <- struct{}{}
 				}
 				close(done)
 			}()
-			wg.Add(2)
 			testutil.TestOpenFile(t, path.Join(tmpDir, "log"))
-			time.Sleep(250 * time.Millisecond)
+			// Polling happens only when the fake clock ticks.
+			clk.Advance(test.d)
+			select {
+			case <-received:
+			case <-time.After(deadline):
+				t.Errorf("didn't receive create message before timeout")
+			}
 			w.Close()
 			<-done
 			expected := []Event{{Op: Create, Pathname: path.Join(tmpDir, "log")}}
@@ -339,3 +422,1021 @@ func TestWatcherNewFile(t *testing.T) {
 		})
 	}
 }
+
+func TestLogWatcherWatchedPaths(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w, err := NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+
+	logFile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+
+	handle, _ := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	testutil.FatalIfErr(t, w.Add(logFile, handle))
+
+	expected := []WatchedPath{
+		{Pathname: tmpDir, IsDir: true, Sources: Fsnotify},
+		{Pathname: logFile, Sources: Fsnotify},
+	}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+}
+
+func TestLogWatcherPollNow(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	// Without fsnotify and with a long poll interval, only PollNow finds
+	// changes.
+	w, err := NewLogWatcher(time.Hour, false)
+	testutil.FatalIfErr(t, err)
+	logFile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+	handle, eventsChan := w.Events()
+	testutil.FatalIfErr(t, w.Add(logFile, handle))
+
+	received := make(chan Event, 1)
+	go func() {
+		for e := range eventsChan {
+			received <- e
+		}
+		close(received)
+	}()
+	testutil.WriteString(t, f, "line\n")
+	testutil.FatalIfErr(t, w.PollNow())
+	select {
+	case e := <-received:
+		if diff := testutil.Diff(Event{Op: Update, Pathname: logFile}, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+	case <-time.After(deadline):
+		t.Fatal("no event after PollNow")
+	}
+
+	testutil.FatalIfErr(t, w.Close())
+	if err := w.PollNow(); err == nil {
+		t.Error("expected an error from PollNow after Close")
+	}
+}
+
+func TestLogWatcherSources(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	for _, tc := range []struct {
+		pollInterval   time.Duration
+		enableFsnotify bool
+		expected       Source
+	}{
+		{0, true, Fsnotify},
+		{time.Hour, false, Poll},
+		{time.Hour, true, Fsnotify | Poll},
+	} {
+		t.Run(tc.expected.String(), func(t *testing.T) {
+			w, err := NewLogWatcher(tc.pollInterval, tc.enableFsnotify)
+			testutil.FatalIfErr(t, err)
+			defer w.Close()
+			handle, _ := w.Events()
+			testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+			expected := []WatchedPath{{Pathname: tmpDir, IsDir: true, Sources: tc.expected}}
+			if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+				t.Errorf("watched paths didn't match:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestLogWatcherWatchModes(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	dirs := map[WatchMode]string{}
+	for _, mode := range []WatchMode{ModeDefault, ModeFsnotify, ModePoll, ModeBoth} {
+		dirs[mode] = filepath.Join(tmpDir, mode.String())
+		testutil.FatalIfErr(t, os.Mkdir(dirs[mode], 0700))
+	}
+
+	w, err := NewLogWatcher(time.Hour, true)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(dirs[ModeDefault], handle))
+	for _, mode := range []WatchMode{ModeFsnotify, ModePoll, ModeBoth} {
+		testutil.FatalIfErr(t, w.Add(dirs[mode], handle, mode))
+	}
+	expected := []WatchedPath{
+		{Pathname: dirs[ModeBoth], IsDir: true, Sources: Fsnotify | Poll, Mode: ModeBoth},
+		{Pathname: dirs[ModeDefault], IsDir: true, Sources: Fsnotify | Poll},
+		{Pathname: dirs[ModeFsnotify], IsDir: true, Sources: Fsnotify, Mode: ModeFsnotify},
+		{Pathname: dirs[ModePoll], IsDir: true, Sources: Poll, Mode: ModePoll},
+	}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+
+	// A file created in the polled directory isn't found until it's polled.
+	polled := filepath.Join(dirs[ModePoll], "log")
+	f, err := os.Create(polled)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	notified := filepath.Join(dirs[ModeFsnotify], "log")
+	f, err = os.Create(notified)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	expectEvent(t, events, Event{Op: Create, Pathname: notified})
+	// PollNow polls every path, and sends its events before returning.
+	polls := make(chan error, 1)
+	go func() { polls <- w.PollNow() }()
+	found := false
+	for done := false; !done; {
+		select {
+		case e := <-events:
+			found = found || e == Event{Op: Create, Pathname: polled}
+		case err := <-polls:
+			testutil.FatalIfErr(t, err)
+			done = true
+		}
+	}
+	if !found {
+		t.Errorf("expected a create of %s when polled", polled)
+	}
+
+	// A mode needing a source the LogWatcher isn't using is an error.
+	nw, err := NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	defer nw.Close()
+	handle, _ = nw.Events()
+	for _, mode := range []WatchMode{ModePoll, ModeBoth} {
+		if err := nw.Add(dirs[mode], handle, mode); err == nil {
+			t.Errorf("expected an error adding a watch with mode %s and no polling", mode)
+		}
+	}
+	if len(nw.WatchedPaths()) != 0 {
+		t.Errorf("expected no paths watched, got %v", nw.WatchedPaths())
+	}
+}
+
+func TestLogWatcherReplay(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	logfile := filepath.Join(tmpDir, "log")
+	testutil.TestOpenFile(t, logfile).Close()
+
+	w, err := NewLogWatcher(time.Hour, false)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	// poll polls the watched paths, and returns the events sent.
+	poll := func() []Event {
+		t.Helper()
+		polls := make(chan error, 1)
+		go func() { polls <- w.PollNow() }()
+		var sent []Event
+		for {
+			select {
+			case e := <-events:
+				sent = append(sent, e)
+			case err := <-polls:
+				testutil.FatalIfErr(t, err)
+				return sent
+			}
+		}
+	}
+	poll()
+
+	// The first subscriber is sent the watched paths, as nothing has been
+	// recorded.
+	replayed, stop := w.EventsWithReplay(2)
+	expectEvent(t, replayed, Event{Op: Create, Pathname: tmpDir, Replayed: true})
+	expectEvent(t, replayed, Event{Op: Create, Pathname: logfile, Replayed: true})
+
+	// It's then copied every event.
+	later := time.Now().Add(time.Hour)
+	testutil.FatalIfErr(t, os.Chtimes(logfile, later, later))
+	testutil.TestOpenFile(t, filepath.Join(tmpDir, "new")).Close()
+	live := poll()
+	if len(live) < 2 {
+		t.Fatalf("expected at least 2 events, got %v", live)
+	}
+	for _, e := range live {
+		expectEvent(t, replayed, e)
+	}
+
+	// A later one is sent the last events, up to as many as are kept.
+	late, stopLate := w.EventsWithReplay(5)
+	for _, e := range live[len(live)-2:] {
+		e.Replayed = true
+		expectEvent(t, late, e)
+	}
+	testutil.TestOpenFile(t, filepath.Join(tmpDir, "newer")).Close()
+	for _, e := range poll() {
+		expectEvent(t, late, e)
+		expectEvent(t, replayed, e)
+	}
+
+	// Nothing is kept once there are no subscribers.
+	stop()
+	stopLate()
+	for range replayed {
+		t.Error("expected no more events once stopped")
+	}
+	w.replay.mu.Lock()
+	kept := w.replay.buf
+	w.replay.mu.Unlock()
+	if kept != nil {
+		t.Errorf("expected no events kept, got %v", kept)
+	}
+
+	// Close ends the subscriptions.
+	last, _ := w.EventsWithReplay(1)
+	<-last
+	testutil.FatalIfErr(t, w.Close())
+	for e := range last {
+		t.Errorf("expected no more events once closed, got %v", e)
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	m := merger{last: make(map[string]lastEvent)}
+	now := time.Now()
+	update := Event{Op: Update, Pathname: "log"}
+	for _, tc := range []struct {
+		name     string
+		e        Event
+		source   Source
+		at       time.Duration
+		expected bool
+	}{
+		{"first", update, Fsnotify, 0, true},
+		{"same change polled", update, Poll, time.Millisecond, false},
+		{"another write", update, Fsnotify, 2 * time.Millisecond, true},
+		{"later poll", update, Poll, time.Second, true},
+		{"different op", Event{Op: Delete, Pathname: "log"}, Fsnotify, time.Second + time.Millisecond, true},
+	} {
+		if got := m.admit(tc.e, tc.source, now.Add(tc.at)); got != tc.expected {
+			t.Errorf("%s: admit = %v, expected %v", tc.name, got, tc.expected)
+		}
+	}
+}
+
+func TestLogWatcherHealth(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w, err := NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, _ := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	testutil.FatalIfErr(t, w.Healthy())
+	h := w.Health()
+	if !h.Fsnotify || !h.FsnotifyAlive || h.Watches != 1 || h.Polling {
+		t.Errorf("unexpected health of a new watcher: %+v", h)
+	}
+
+	testutil.FatalIfErr(t, w.Close())
+	if err := w.Healthy(); err == nil {
+		t.Error("expected an error from Healthy after Close")
+	}
+}
+
+func TestLogWatcherSetOption(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	clk := testutil.NewFakeClock(time.Now())
+	w, err := NewLogWatcher(time.Hour, false, WithClock(clk))
+	testutil.FatalIfErr(t, err)
+	logFile := filepath.Join(tmpDir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+	handle, eventsChan := w.Events()
+	testutil.FatalIfErr(t, w.Add(logFile, handle))
+	updates := make(chan Event, 1)
+	go func() {
+		for e := range eventsChan {
+			select {
+			case updates <- e:
+			default:
+			}
+		}
+		close(updates)
+	}()
+
+	err = w.SetOption(WithLogLevel(logger.InfoLevel), WithInotify())
+	if e, ok := err.(*ErrStaticOption); !ok || e.Index != 1 {
+		t.Errorf("expected an ErrStaticOption for option 1, got %v", err)
+	}
+	if err := w.SetOption(WithPollInterval(0)); err == nil {
+		t.Error("expected an error for a zero poll interval")
+	}
+
+	// Change the poll interval while the paths are being polled.
+	done := make(chan struct{})
+	var polling sync.WaitGroup
+	polling.Add(1)
+	go func() {
+		defer polling.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			testutil.WriteString(t, f, "line\n")
+			clk.Advance(time.Minute)
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if err := w.SetOption(WithPollInterval(time.Duration(1+j%5)*time.Minute), WithLogLevel(logger.InfoLevel)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	polling.Wait()
+
+	testutil.FatalIfErr(t, w.SetOption(WithPollInterval(2*time.Minute)))
+	if h := w.Health(); h.PollInterval != 2*time.Minute {
+		t.Errorf("expected a poll interval of 2m, got %s", h.PollInterval)
+	}
+	for len(updates) > 0 {
+		<-updates
+	}
+	future := time.Now().Add(time.Hour)
+	testutil.FatalIfErr(t, os.Chtimes(logFile, future, future))
+	clk.Advance(2 * time.Minute)
+	select {
+	case <-updates:
+	case <-time.After(deadline):
+		t.Error("no update after the new poll interval")
+	}
+	testutil.FatalIfErr(t, w.Close())
+	if err := w.SetOption(WithPollInterval(time.Minute)); err == nil {
+		t.Error("expected an error from WithPollInterval after Close")
+	}
+
+	// Without polling, there's no interval to change.
+	w, err = NewLogWatcher(0, true)
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	if err := w.SetOption(WithPollInterval(time.Minute)); err == nil {
+		t.Error("expected an error from WithPollInterval without polling")
+	}
+}
+
+func TestLogWatcherHeartbeat(t *testing.T) {
+	if _, err := NewLogWatcher(time.Hour, false, WithHeartbeat(0)); err == nil {
+		t.Error("expected an error for a heartbeat interval of 0")
+	}
+	plain, err := NewLogWatcher(time.Hour, false)
+	testutil.FatalIfErr(t, err)
+	handle, _ := plain.Events()
+	if err := plain.Heartbeats(handle); err == nil {
+		t.Error("expected an error asking for heartbeats without WithHeartbeat")
+	}
+	testutil.FatalIfErr(t, plain.Close())
+
+	clk := testutil.NewFakeClock(time.Now())
+	w, err := NewLogWatcher(time.Hour, false, WithClock(clk), WithHeartbeat(time.Second))
+	testutil.FatalIfErr(t, err)
+	handle, beats := w.Events()
+	quietHandle, quiet := w.Events()
+	testutil.FatalIfErr(t, w.Heartbeats(handle))
+	if err := w.Heartbeats(quietHandle + 1); err == nil {
+		t.Error("expected an error asking for heartbeats on a missing handle")
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case e := <-beats:
+		if e.Op != Heartbeat || e.Pathname != "" {
+			t.Errorf("expected a heartbeat, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no heartbeat")
+	}
+	select {
+	case e := <-quiet:
+		t.Errorf("channel that didn't ask for heartbeats got %+v", e)
+	case <-time.After(10 * time.Millisecond):
+	}
+	if h := w.Health(); h.HeartbeatInterval != time.Second || !h.LastHeartbeat.Equal(clk.Now()) {
+		t.Errorf("unexpected heartbeat health %+v", h)
+	}
+	if n := w.EventsSent(handle); n != 1 {
+		t.Errorf("expected 1 event counted, got %d", n)
+	}
+
+	// Close stops heartbeats even while one can't be delivered.
+	clk.Advance(time.Second)
+	closed := make(chan struct{})
+	go func() {
+		w.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't return while a heartbeat was waiting to be received")
+	}
+}
+
+func TestEventCountCardinality(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	w, err := NewLogWatcher(time.Hour, false, WithEventCountsByRoot())
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	c := w.events[handle]
+	drained := make(chan struct{})
+	go func() {
+		for range events {
+		}
+		close(drained)
+	}()
+
+	// Churn through 10k temporary files, one of which is kept.
+	for i := 0; i < 10000; i++ {
+		name := filepath.Join(tmpDir, fmt.Sprintf("tmp.%d", i))
+		w.dispatch(c, Event{Op: Create, Pathname: name}, Poll, tmpDir)
+		w.dispatch(c, Event{Op: Update, Pathname: name}, Poll, tmpDir)
+		if i > 0 {
+			w.dispatch(c, Event{Op: Delete, Pathname: name}, Poll, tmpDir)
+		}
+	}
+	keys := 0
+	w.metrics.eventCount.Do(func(expvar.KeyValue) { keys++ })
+	if keys > 3 {
+		t.Errorf("expected at most 3 event types counted, got %s", &w.metrics.eventCount)
+	}
+	byRoot, ok := w.metrics.eventCountByRoot.Get(tmpDir).(*expvar.Map)
+	if !ok || byRoot.Get("delete").String() != "9999" {
+		t.Errorf("unexpected counts for %s: %s", tmpDir, &w.metrics.eventCountByRoot)
+	}
+	if n := len(w.metrics.eventCount.String()) + len(w.metrics.eventCountByRoot.String()); n > 1024 {
+		t.Errorf("expected the event counts to stay small, got %d bytes", n)
+	}
+	kept := filepath.Join(tmpDir, "tmp.0")
+	if diff := testutil.Diff(map[string]EventCounts{kept: {Create: 1, Update: 1}}, w.Counters()); diff != "" {
+		t.Errorf("counters didn't match:\n%s", diff)
+	}
+
+	testutil.FatalIfErr(t, w.Remove(tmpDir))
+	if len(w.Counters()) != 0 || w.metrics.eventCountByRoot.Get(tmpDir) != nil {
+		t.Errorf("counts kept after removal: %v, %s", w.Counters(), &w.metrics.eventCountByRoot)
+	}
+	testutil.FatalIfErr(t, w.Close())
+	<-drained
+}
+
+func TestWatchLimits(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	if _, err := NewLogWatcher(0, true, WithWatchLimitWarning(1.5)); err == nil {
+		t.Error("expected an error from a warning fraction above 1")
+	}
+	w, err := NewLogWatcher(0, true, WithWatchLimitWarning(0.5))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	go func() {
+		for range events {
+		}
+	}()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	h := w.Health()
+	if runtime.GOOS != "linux" {
+		if h.Limits.Known || h.Limits.String() != "unknown" {
+			t.Errorf("expected unknown limits, got %+v", h.Limits)
+		}
+		return
+	}
+	if !h.Limits.Known || h.Limits.MaxWatches == 0 || h.Limits.Instances < 1 || h.Limits.Watches < 1 {
+		t.Errorf("unexpected limits: %+v", h.Limits)
+	}
+	if h.WatchLimit != h.Limits.MaxWatches {
+		t.Errorf("expected WatchLimit %d, got %d", h.Limits.MaxWatches, h.WatchLimit)
+	}
+
+	// Reaching half of a limit of 4 watches warns until they drop below it.
+	w.watchedMu.Lock()
+	w.limits = WatchLimits{Known: true, MaxWatches: 4}
+	w.watchedMu.Unlock()
+	sub := filepath.Join(tmpDir, "sub")
+	testutil.FatalIfErr(t, os.Mkdir(sub, 0700))
+	testutil.FatalIfErr(t, w.Add(sub, handle))
+	w.watchedMu.RLock()
+	warned := w.limitWarned
+	w.watchedMu.RUnlock()
+	if !warned {
+		t.Error("expected a warning at half of the watch limit")
+	}
+	testutil.FatalIfErr(t, w.Remove(sub))
+	w.watchedMu.RLock()
+	warned = w.limitWarned
+	w.watchedMu.RUnlock()
+	if warned {
+		t.Error("expected the warning to be cleared below half of the watch limit")
+	}
+
+	if IsWatchLimit(errors.New("not a limit")) {
+		t.Error("expected an error that isn't a WatchLimitError")
+	}
+	err = limitError(sub, syscall.ENOSPC)
+	if !IsWatchLimit(err) {
+		t.Fatalf("expected a WatchLimitError, got %v", err)
+	}
+	if e := err.(*WatchLimitError); e.Sysctl != "fs.inotify.max_user_watches" || e.Limit != h.Limits.MaxWatches || !strings.Contains(e.Error(), e.Sysctl) {
+		t.Errorf("unexpected error: %+v", e)
+	}
+	if err := limitError(sub, syscall.EACCES); err != nil {
+		t.Errorf("unexpected limit error: %v", err)
+	}
+}
+
+// testBackends creates real fsnotify backends, which a test can kill to
+// simulate the backend dying.
+type testBackends struct {
+	mu      sync.Mutex
+	created []backend
+	fail    bool          // Creating a backend fails after the first
+	gate    chan struct{} // Creating a backend after the first waits for this to be closed, if not nil
+}
+
+func (bs *testBackends) new() (backend, error) {
+	bs.mu.Lock()
+	first := len(bs.created) == 0
+	fail, gate := bs.fail, bs.gate
+	bs.mu.Unlock()
+	if !first {
+		if fail {
+			return nil, errors.New("injected backend failure")
+		}
+		if gate != nil {
+			<-gate
+		}
+	}
+	b, err := newFsnotifyBackend()
+	if err != nil {
+		return nil, err
+	}
+	bs.mu.Lock()
+	bs.created = append(bs.created, b)
+	bs.mu.Unlock()
+	return b, nil
+}
+
+// kill closes the most recently created backend behind the LogWatcher's back.
+func (bs *testBackends) kill(t *testing.T) {
+	t.Helper()
+	bs.mu.Lock()
+	b := bs.created[len(bs.created)-1]
+	bs.mu.Unlock()
+	testutil.FatalIfErr(t, b.Close())
+}
+
+// awaitHealth blocks until the LogWatcher's health satisfies cond.
+func awaitHealth(t *testing.T, w *LogWatcher, cond func(Health) bool) {
+	t.Helper()
+	timeout := time.After(deadline)
+	for !cond(w.Health()) {
+		select {
+		case <-timeout:
+			t.Fatalf("health never changed: %+v", w.Health())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// expectEvent fails the test unless expected is the next event on events.
+func expectEvent(t *testing.T, events <-chan Event, expected Event) {
+	t.Helper()
+	select {
+	case e := <-events:
+		if diff := testutil.Diff(expected, e); diff != "" {
+			t.Errorf("event didn't match:\n%s", diff)
+		}
+	case <-time.After(deadline):
+		t.Fatalf("didn't receive %v", expected)
+	}
+}
+
+func TestLogWatcherRestart(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	bs := &testBackends{gate: make(chan struct{})}
+	w, err := NewLogWatcher(0, true, withBackend(bs.new))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	w.restartDelay = time.Millisecond
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+
+	bs.kill(t)
+	// This file is created while there is no backend, and is found by the
+	// reconciliation once the backend is restarted.
+	missed := filepath.Join(tmpDir, "missed")
+	f, err := os.Create(missed)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	close(bs.gate)
+	expectEvent(t, events, Event{Op: Create, Pathname: missed})
+
+	// Later changes are found by the restarted backend.
+	later := filepath.Join(tmpDir, "later")
+	f, err = os.Create(later)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	expectEvent(t, events, Event{Op: Create, Pathname: later})
+
+	testutil.FatalIfErr(t, w.Healthy())
+	if h := w.Health(); h.Restarts != 1 {
+		t.Errorf("expected 1 restart, got %d", h.Restarts)
+	}
+	if got := w.metrics.restartCount.Value(); got != 1 {
+		t.Errorf("expected restart count 1, got %d", got)
+	}
+	expected := []WatchedPath{{Pathname: tmpDir, IsDir: true, Sources: Fsnotify}}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+}
+
+func TestLogWatcherRestartFallback(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	bs := &testBackends{fail: true}
+	w, err := NewLogWatcher(0, true, withBackend(bs.new))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	w.restartDelay = time.Millisecond
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+
+	bs.kill(t)
+	awaitHealth(t, w, func(h Health) bool { return !h.Fsnotify && h.Polling })
+	testutil.FatalIfErr(t, w.Healthy())
+	if h := w.Health(); h.Err == nil {
+		t.Error("expected the error that stopped the backend to be reported")
+	}
+	if got := w.metrics.pollFallbackCount.Value(); got != 1 {
+		t.Errorf("expected poll fallback count 1, got %d", got)
+	}
+	expected := []WatchedPath{{Pathname: tmpDir, IsDir: true, Sources: Poll}}
+	if diff := testutil.Diff(expected, w.WatchedPaths()); diff != "" {
+		t.Errorf("watched paths didn't match:\n%s", diff)
+	}
+
+	logfile := filepath.Join(tmpDir, "log")
+	f, err := os.Create(logfile)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	go w.PollNow()
+	expectEvent(t, events, Event{Op: Create, Pathname: logfile})
+}
+
+// chanBackend is a backend whose events are sent by the test.
+type chanBackend struct {
+	events chan fsnotify.Event
+	errors chan error
+	once   sync.Once
+}
+
+func newChanBackend() *chanBackend {
+	return &chanBackend{events: make(chan fsnotify.Event), errors: make(chan error)}
+}
+
+func (b *chanBackend) Add(string) error              { return nil }
+func (b *chanBackend) Remove(string) error           { return nil }
+func (b *chanBackend) Events() <-chan fsnotify.Event { return b.events }
+func (b *chanBackend) Errors() <-chan error          { return b.errors }
+func (b *chanBackend) Close() error {
+	b.once.Do(func() {
+		close(b.events)
+		close(b.errors)
+	})
+	return nil
+}
+
+func TestLogWatcherRecoversPanic(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	b := newChanBackend()
+	w, err := NewLogWatcher(0, true, withBackend(func() (backend, error) { return b, nil }))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+
+	// An event with an unknown op panics, which mustn't stop the events
+	// after it being sent.
+	logfile := filepath.Join(tmpDir, "log")
+	b.events <- fsnotify.Event{Name: logfile}
+	b.events <- fsnotify.Event{Name: logfile, Op: fsnotify.Create}
+	expectEvent(t, events, Event{Op: Create, Pathname: logfile})
+	if got := w.metrics.panicCount.Value(); got != 1 {
+		t.Errorf("expected panic count 1, got %d", got)
+	}
+	if got := w.metrics.restartCount.Value(); got != 0 {
+		t.Errorf("expected no restarts, got %d", got)
+	}
+}
+
+func TestLogWatcherCaseFolding(t *testing.T) {
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+
+	b := newChanBackend()
+	w, err := NewLogWatcher(0, true, WithCaseFolding(true), withBackend(func() (backend, error) { return b, nil }))
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	if !w.IsWatching(strings.ToUpper(tmpDir)) {
+		t.Error("expected the directory spelt in upper case to be watched")
+	}
+
+	// The backend may report the directory spelt differently.
+	logfile := filepath.Join(strings.ToUpper(tmpDir), "Log")
+	b.events <- fsnotify.Event{Name: logfile, Op: fsnotify.Create}
+	expectEvent(t, events, Event{Op: Create, Pathname: logfile})
+
+	testutil.FatalIfErr(t, w.Remove(strings.ToUpper(tmpDir)))
+	if w.IsWatching(tmpDir) {
+		t.Error("expected the directory to be no longer watched")
+	}
+}
+
+func TestExtendedPath(t *testing.T) {
+	for _, tc := range []struct {
+		pathname, expected string
+	}{
+		{`C:\logs\app.log`, `\\?\C:\logs\app.log`},
+		{`c:/logs/./deep/../app.log`, `\\?\c:\logs\app.log`},
+		{`C:\`, `\\?\C:\`},
+		{`\\server\share\logs\app.log`, `\\?\UNC\server\share\logs\app.log`},
+		{`//server/share`, `\\?\UNC\server\share`},
+		{`\\?\C:\logs\app.log`, `\\?\C:\logs\app.log`},
+		{`\\?\UNC\server\share\app.log`, `\\?\UNC\server\share\app.log`},
+		{`\\.\pipe\logs`, `\\.\pipe\logs`},
+		{`\\server`, `\\server`},
+		{`logs\app.log`, `logs\app.log`},
+		{`C:app.log`, `C:app.log`},
+		{`/var/log/app.log`, `/var/log/app.log`},
+	} {
+		got := extendedPath(tc.pathname)
+		if got != tc.expected {
+			t.Errorf("extendedPath(%q) = %q, expected %q", tc.pathname, got, tc.expected)
+		}
+		if strings.HasPrefix(got, extendedPrefix) && !strings.HasPrefix(tc.pathname, extendedPrefix) {
+			if back := trimExtended(got); extendedPath(back) != got || strings.HasPrefix(back, extendedPrefix) {
+				t.Errorf("trimExtended(%q) = %q, which doesn't extend to it again", got, back)
+			}
+		}
+	}
+	if got := trimExtended(`\\?\UNC\server\share\app.log`); got != `\\server\share\app.log` {
+		t.Errorf("unexpected trimmed UNC path %q", got)
+	}
+	if got := trimExtended(`\\?\C:\logs\app.log`); got != `C:\logs\app.log` {
+		t.Errorf("unexpected trimmed path %q", got)
+	}
+}
+
+func TestWithFSEventsUnsupported(t *testing.T) {
+	if fseventsSupported {
+		t.Skip("FSEvents is supported in this build")
+	}
+	if _, err := NewLogWatcher(0, true, WithFSEvents()); err == nil {
+		t.Error("expected an error selecting FSEvents where it isn't supported")
+	}
+}
+
+func TestRenamePairer(t *testing.T) {
+	now := time.Now()
+	from := func(name string, cookie uint32) rawEvent {
+		return rawEvent{Event: fsnotify.Event{Name: name, Op: fsnotify.Rename}, half: movedFrom, cookie: cookie}
+	}
+	to := func(name string, cookie uint32) rawEvent {
+		return rawEvent{Event: fsnotify.Event{Name: name, Op: fsnotify.Create}, half: movedTo, cookie: cookie}
+	}
+	write := func(name string) rawEvent {
+		return rawEvent{Event: fsnotify.Event{Name: name, Op: fsnotify.Write}}
+	}
+	sent := func(name string, op fsnotify.Op) backendEvent {
+		return backendEvent{Event: fsnotify.Event{Name: name, Op: op}}
+	}
+	renamed := func(from, to string) backendEvent {
+		return backendEvent{Event: fsnotify.Event{Name: to, Op: fsnotify.Rename}, From: from}
+	}
+
+	p := renamePairer{window: time.Millisecond}
+	if got := p.add(from("/d/log", 1), now); len(got) != 0 {
+		t.Errorf("first half of a rename was sent before it was paired: %v", got)
+	}
+	if got := p.add(write("/d/other"), now); len(got) != 0 {
+		t.Errorf("event behind a pending rename was sent before it: %v", got)
+	}
+	if at, ok := p.next(); !ok || !at.Equal(now.Add(time.Millisecond)) {
+		t.Errorf("next = %v, %v, expected the rename's deadline", at, ok)
+	}
+	got := p.add(to("/d/log.1", 1), now)
+	if diff := testutil.Diff([]backendEvent{renamed("/d/log", "/d/log.1"), sent("/d/other", fsnotify.Write)}, got); diff != "" {
+		t.Errorf("paired rename didn't match:\n%s", diff)
+	}
+	if _, ok := p.next(); ok {
+		t.Error("events still pending after pairing")
+	}
+
+	// A rename out of the watched paths has no second half.
+	p.add(from("/d/log", 2), now)
+	if got := p.expire(now); len(got) != 0 {
+		t.Errorf("rename sent before its window passed: %v", got)
+	}
+	got = p.expire(now.Add(time.Millisecond))
+	if diff := testutil.Diff([]backendEvent{sent("/d/log", fsnotify.Rename)}, got); diff != "" {
+		t.Errorf("unpaired first half didn't match:\n%s", diff)
+	}
+
+	// A rename into the watched paths has no first half, and is a creation.
+	got = p.add(to("/d/new", 3), now)
+	if diff := testutil.Diff([]backendEvent{sent("/d/new", fsnotify.Create)}, got); diff != "" {
+		t.Errorf("unpaired second half didn't match:\n%s", diff)
+	}
+
+	// A second half whose first half expired isn't paired with another.
+	p.add(from("/d/a", 4), now)
+	p.add(from("/d/b", 5), now.Add(time.Millisecond))
+	got = p.expire(now.Add(time.Millisecond))
+	got = append(got, p.add(to("/d/a.1", 4), now.Add(time.Millisecond))...)
+	got = append(got, p.add(to("/d/b.1", 5), now.Add(time.Millisecond))...)
+	expected := []backendEvent{sent("/d/a", fsnotify.Rename), renamed("/d/b", "/d/b.1"), sent("/d/a.1", fsnotify.Create)}
+	if diff := testutil.Diff(expected, got); diff != "" {
+		t.Errorf("events didn't match:\n%s", diff)
+	}
+}
+
+func TestLogWatcherInotifyRename(t *testing.T) {
+	if !inotifySupported {
+		if _, err := NewLogWatcher(0, true, WithInotify()); err == nil {
+			t.Error("expected an error selecting inotify where it isn't supported")
+		}
+		t.Skip("inotify isn't supported in this build")
+	}
+	tmpDir, rmTmpDir := testutil.TestTempDir(t)
+	defer rmTmpDir()
+	outside, rmOutside := testutil.TestTempDir(t)
+	defer rmOutside()
+
+	w, err := NewLogWatcher(0, true, WithInotify())
+	testutil.FatalIfErr(t, err)
+	defer w.Close()
+	handle, events := w.Events()
+	testutil.FatalIfErr(t, w.Add(tmpDir, handle))
+	logfile := filepath.Join(tmpDir, "log")
+	f, err := os.Create(logfile)
+	testutil.FatalIfErr(t, err)
+	f.Close()
+	expectEvent(t, events, Event{Op: Create, Pathname: logfile})
+	testutil.FatalIfErr(t, w.Add(logfile, handle))
+
+	rotated := filepath.Join(tmpDir, "log.1")
+	testutil.FatalIfErr(t, os.Rename(logfile, rotated))
+	expectEvent(t, events, Event{Op: Rename, Pathname: rotated, From: logfile})
+	if !w.IsWatching(rotated) || w.IsWatching(logfile) {
+		t.Errorf("watch didn't move with the file: %v", w.WatchedPaths())
+	}
+
+	// Later events for the file are reported at its new path.
+	f, err = os.OpenFile(rotated, os.O_WRONLY|os.O_APPEND, 0)
+	testutil.FatalIfErr(t, err)
+	testutil.WriteString(t, f, "line\n")
+	f.Close()
+	expectEvent(t, events, Event{Op: Update, Pathname: rotated})
+
+	// A rename out of the watched directory can't be paired.  The write is
+	// also seen through the directory's watch.
+	testutil.FatalIfErr(t, os.Rename(rotated, filepath.Join(outside, "log.1")))
+	for {
+		select {
+		case e := <-events:
+			if e.Op == Update && e.Pathname == rotated {
+				continue
+			}
+			if diff := testutil.Diff(Event{Op: Delete, Pathname: rotated}, e); diff != "" {
+				t.Errorf("event didn't match:\n%s", diff)
+			}
+		case <-time.After(deadline):
+			t.Fatal("didn't receive the deletion")
+		}
+		break
+	}
+	// The file's own watch sees it renamed away too.
+	go func() {
+		for range events {
+		}
+	}()
+}
+
+func TestStatTracker(t *testing.T) {
+	workdir, rmWorkdir := testutil.TestTempDir(t)
+	defer rmWorkdir()
+	logFile := filepath.Join(workdir, "log")
+	f := testutil.TestOpenFile(t, logFile)
+	defer f.Close()
+
+	s := newStatTracker()
+	s.add(workdir)
+	confirm := func(name string, hint fsnotify.Op, want ...fsnotify.Op) {
+		t.Helper()
+		var got []fsnotify.Op
+		for _, e := range s.confirm(name, hint) {
+			if e.Name != name {
+				t.Errorf("event for %q, expected %q", e.Name, name)
+			}
+			got = append(got, e.Op)
+		}
+		if diff := testutil.Diff(want, got); diff != "" {
+			t.Errorf("confirm(%q, %v): diff:\n%s", name, hint, diff)
+		}
+	}
+
+	testutil.WriteString(t, f, "a\n")
+	confirm(logFile, 0, fsnotify.Write)
+	// A coalesced event repeating the change already seen.
+	confirm(logFile, 0)
+	confirm(logFile, fsnotify.Write, fsnotify.Write)
+
+	// Rotated between events.
+	testutil.FatalIfErr(t, os.Rename(logFile, logFile+".1"))
+	g := testutil.TestOpenFile(t, logFile)
+	defer g.Close()
+	confirm(logFile, fsnotify.Remove|fsnotify.Create, fsnotify.Create)
+	confirm(logFile+".1", fsnotify.Rename, fsnotify.Create)
+
+	testutil.FatalIfErr(t, os.Remove(logFile))
+	confirm(logFile, fsnotify.Remove, fsnotify.Remove)
+	// Created and removed again between events.
+	confirm(filepath.Join(workdir, "gone"), fsnotify.Create)
+	// Outside the paths added.
+	confirm(filepath.Join(os.TempDir(), "other"), fsnotify.Create)
+
+	// Events dropped, so everything is checked.
+	h := testutil.TestOpenFile(t, filepath.Join(workdir, "new"))
+	h.Close()
+	testutil.FatalIfErr(t, os.Remove(logFile+".1"))
+	got := make(map[string]fsnotify.Op)
+	for _, e := range s.rescan() {
+		got[e.Name] = e.Op
+	}
+	want := map[string]fsnotify.Op{
+		filepath.Join(workdir, "new"): fsnotify.Create,
+		logFile + ".1":                fsnotify.Remove,
+	}
+	if diff := testutil.Diff(want, got); diff != "" {
+		t.Errorf("rescan: diff:\n%s", diff)
+	}
+
+	s.remove(workdir)
+	confirm(filepath.Join(workdir, "new"), fsnotify.Write)
+}
+
+func TestUnderRoot(t *testing.T) {
+	for _, tc := range []struct {
+		name, root, real string
+		want             string
+		ok               bool
+	}{
+		{"/private/tmp/logs", "/tmp/logs", "/private/tmp/logs", "/tmp/logs", true},
+		{"/private/tmp/logs/a.log", "/tmp/logs", "/private/tmp/logs", "/tmp/logs/a.log", true},
+		{"/private/tmp/logs2/a.log", "/tmp/logs", "/private/tmp/logs", "", false},
+		{"/var/log/a.log", "/var/log", "/var/log", "/var/log/a.log", true},
+	} {
+		got, ok := underRoot(tc.name, tc.root, tc.real)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("underRoot(%q, %q, %q) = %q, %v, expected %q, %v", tc.name, tc.root, tc.real, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefixes of Windows paths in the extended-length form, which may be longer
+// than MAX_PATH.
+const (
+	extendedPrefix    = `\\?\`
+	extendedUNCPrefix = `\\?\UNC\`
+	devicePrefix      = `\\.\`
+)
+
+// ExtendPath returns the form of pathname to hand to the system: on Windows,
+// an absolute path in the extended-length \\?\ form, so that paths longer
+// than MAX_PATH, such as under deeply nested directories, can be opened,
+// stat'd and watched; elsewhere pathname unchanged.  The extended form is
+// only for calls to the system; paths are keyed, logged and reported in
+// their usual form.
+func ExtendPath(pathname string) string {
+	if !extendPaths {
+		return pathname
+	}
+	return extendedPath(pathname)
+}
+
+// TrimExtendedPath returns pathname in its usual form, if it's in the
+// extended-length form, as those found under an extended path are.
+func TrimExtendedPath(pathname string) string {
+	if !extendPaths {
+		return pathname
+	}
+	return trimExtended(pathname)
+}
+
+// StatExtended is os.Stat of the extended form of pathname.  An error names
+// pathname as given.
+func StatExtended(pathname string) (os.FileInfo, error) {
+	fi, err := os.Stat(ExtendPath(pathname))
+	if pe, ok := err.(*os.PathError); ok {
+		pe.Path = pathname
+	}
+	return fi, err
+}
+
+// GlobExtended is filepath.Glob of the extended form of pattern, so that
+// directories too deep for MAX_PATH are searched, returning the matches in
+// their usual form.
+func GlobExtended(pattern string) ([]string, error) {
+	matches, err := filepath.Glob(ExtendPath(pattern))
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range matches {
+		matches[i] = TrimExtendedPath(m)
+	}
+	return matches, nil
+}
+
+// extendedPath converts the absolute Windows path pathname to the
+// extended-length form: C:\dir becomes \\?\C:\dir, and the UNC path
+// \\server\share\dir becomes \\?\UNC\server\share\dir.  As the system doesn't
+// clean an extended path, its slashes are made backslashes and its . and ..
+// elements resolved.  Relative paths, and those already extended or naming
+// a device, are returned unchanged.
+func extendedPath(pathname string) string {
+	p := strings.Replace(pathname, "/", `\`, -1)
+	switch {
+	case strings.HasPrefix(p, extendedPrefix), strings.HasPrefix(p, devicePrefix):
+		return pathname
+	case strings.HasPrefix(p, `\\`):
+		// UNC: the server and share are the root.
+		parts := strings.SplitN(p[2:], `\`, 3)
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			return pathname
+		}
+		root := extendedUNCPrefix + parts[0] + `\` + parts[1]
+		if len(parts) < 3 {
+			return root
+		}
+		return root + cleanElems(parts[2])
+	case len(p) >= 3 && isDriveLetter(p[0]) && p[1] == ':' && p[2] == '\\':
+		return extendedPrefix + p[:2] + cleanElems(p[3:])
+	}
+	return pathname
+}
+
+// trimExtended undoes extendedPath.
+func trimExtended(pathname string) string {
+	switch {
+	case strings.HasPrefix(pathname, extendedUNCPrefix):
+		return `\\` + pathname[len(extendedUNCPrefix):]
+	case strings.HasPrefix(pathname, extendedPrefix):
+		return pathname[len(extendedPrefix):]
+	}
+	return pathname
+}
+
+// cleanElems returns the backslash separated elements of rel, below a root,
+// with empty and . elements dropped and .. elements resolved, each preceded
+// by a backslash.  A root alone is a backslash.
+func cleanElems(rel string) string {
+	var elems []string
+	for _, e := range strings.Split(rel, `\`) {
+		switch e {
+		case "", ".":
+		case "..":
+			if len(elems) > 0 {
+				elems = elems[:len(elems)-1]
+			}
+		default:
+			elems = append(elems, e)
+		}
+	}
+	return `\` + strings.Join(elems, `\`)
+}
+
+func isDriveLetter(c byte) bool {
+	return ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,11 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build !windows
+// +build !windows
+
+package watcher
+
+// extendPaths is true where paths are handed to the system in the
+// extended-length form.
+const extendPaths = false
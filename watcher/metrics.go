@@ -0,0 +1,52 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import "expvar"
+
+// metrics are the counters of a LogWatcher.  They belong to the LogWatcher
+// rather than the package, so that each LogWatcher in a process counts its
+// own, and are only published to expvar by WithExpvar.
+type metrics struct {
+	errorCount        expvar.Int // Errors from the fsnotify backend
+	restartCount      expvar.Int // Restarts of the fsnotify backend
+	restartErrorCount expvar.Int // Failed attempts to restart the fsnotify backend
+	pollFallbackCount expvar.Int // Times polling replaced an fsnotify backend that couldn't be restarted
+	panicCount        expvar.Int // Panics recovered from while handling events or polling
+
+	// eventCount counts the events sent by their type: create, update or
+	// delete.  Its keys don't depend on the paths watched, so it stays small
+	// however many files come and go; the counts for each path are given by
+	// LogWatcher.Counters instead.
+	eventCount expvar.Map
+	// eventCountByRoot counts the events sent with WithEventCountsByRoot, by
+	// the path given to Add that they were found through, then by type.
+	eventCountByRoot expvar.Map
+}
+
+// vars returns the counters by the names they're published under.
+func (m *metrics) vars() map[string]expvar.Var {
+	return map[string]expvar.Var{
+		"log_watcher_error_count":          &m.errorCount,
+		"log_watcher_restart_count":        &m.restartCount,
+		"log_watcher_restart_error_count":  &m.restartErrorCount,
+		"log_watcher_poll_fallback_count":  &m.pollFallbackCount,
+		"log_watcher_panic_count":          &m.panicCount,
+		"log_watcher_events_total":         &m.eventCount,
+		"log_watcher_events_by_root_total": &m.eventCountByRoot,
+	}
+}
+
+// WithExpvar publishes the LogWatcher's counters in expvar, such as
+// log_watcher_error_count, with their names prefixed by prefix.  Without it
+// they're only counted.  NewFromConfig returns an error if any of the names
+// are already published, which they stay for the life of the process, so
+// each LogWatcher published needs a prefix of its own.
+func WithExpvar(prefix string) Option {
+	return func(w *LogWatcher) error {
+		w.expvarPrefix = prefix
+		w.publishExpvar = true
+		return nil
+	}
+}
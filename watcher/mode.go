@@ -0,0 +1,79 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// WatchMode chooses which of a LogWatcher's sources find the changes to a
+// path given to Add, such as polling alone for a path on an NFS mount, where
+// fsnotify misses changes made by other hosts.
+type WatchMode int
+
+const (
+	// ModeDefault uses every source the LogWatcher has: fsnotify if it's
+	// enabled, and polling if it polls.
+	ModeDefault WatchMode = iota
+	// ModeFsnotify only uses fsnotify.
+	ModeFsnotify
+	// ModePoll only polls the path.
+	ModePoll
+	// ModeBoth uses fsnotify and polls the path, so that a change missed by
+	// one is found by the other.
+	ModeBoth
+)
+
+var watchModeNames = []string{"default", "fsnotify", "poll", "both"}
+
+func (m WatchMode) String() string {
+	if m < 0 || int(m) >= len(watchModeNames) {
+		return fmt.Sprintf("WatchMode(%d)", int(m))
+	}
+	return watchModeNames[m]
+}
+
+// AddOption configures a path given to Add.  A WatchMode is an AddOption.
+type AddOption interface {
+	applyAdd(o *addOptions)
+}
+
+// addOptions are the settings of a path given AddOptions.
+type addOptions struct {
+	mode WatchMode
+}
+
+func (m WatchMode) applyAdd(o *addOptions) { o.mode = m }
+
+func newAddOptions(opts []AddOption) addOptions {
+	var o addOptions
+	for _, opt := range opts {
+		opt.applyAdd(&o)
+	}
+	return o
+}
+
+// sources returns the Sources a path given m is watched with, from those
+// the LogWatcher has, or an error if m needs one it doesn't have.
+func (m WatchMode) sources(have Source) (Source, error) {
+	var want Source
+	switch m {
+	case ModeDefault:
+		return have, nil
+	case ModeFsnotify:
+		want = Fsnotify
+	case ModePoll:
+		want = Poll
+	case ModeBoth:
+		want = Fsnotify | Poll
+	default:
+		return 0, errors.Errorf("invalid watch mode %s", m)
+	}
+	if missing := want &^ have; missing != 0 {
+		return 0, errors.Errorf("watch mode %s needs %s, which the log watcher isn't using", m, missing)
+	}
+	return want, nil
+}
@@ -0,0 +1,22 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"runtime/debug"
+)
+
+// safely calls fn, which handles an event or a poll in the goroutine named
+// what, recovering from a panic in it so the goroutine can carry on with the
+// next rather than dying and leaving its paths unwatched.  The panic is
+// logged with its stack and counted in log_watcher_panic_count.
+func (w *LogWatcher) safely(what string, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			w.metrics.panicCount.Add(1)
+			w.logger.Errorf("Recovered from a panic in the %s: %v\n%s", what, r, debug.Stack())
+		}
+	}()
+	fn()
+}
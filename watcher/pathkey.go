@@ -0,0 +1,42 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// PathKey returns the form of pathname that it's compared by, so that
+// different spellings of the same path, such as those reported by fsnotify,
+// have the same key: with its separators the platform's own, and if fold is
+// true, folded to lower case, as names are on case-insensitive filesystems.
+func PathKey(pathname string, fold bool) string {
+	pathname = filepath.FromSlash(pathname)
+	if fold {
+		return strings.ToLower(pathname)
+	}
+	return pathname
+}
+
+// WithCaseFolding compares the paths watched without regard to case if fold
+// is true, or by their exact spelling if it's false.  By default they're
+// folded when CaseInsensitivePaths is true: on Windows and macOS, whose
+// filesystems are usually case-insensitive.
+func WithCaseFolding(fold bool) Option {
+	return func(w *LogWatcher) error {
+		w.foldCase = fold
+		return nil
+	}
+}
+
+// key returns the key pathname is watched under.
+func (w *LogWatcher) key(pathname string) string {
+	return PathKey(pathname, w.foldCase)
+}
+
+// hasPathPrefix indicates if pathname is dir or below it.
+func hasPathPrefix(pathname, dir string) bool {
+	return pathname == dir || strings.HasPrefix(pathname, dir+string(filepath.Separator))
+}
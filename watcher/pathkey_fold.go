@@ -0,0 +1,12 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+//go:build windows || darwin
+// +build windows darwin
+
+package watcher
+
+// CaseInsensitivePaths indicates if the filesystems of this platform usually
+// don't tell names apart by case, so that paths are compared folded to lower
+// case by default.
+const CaseInsensitivePaths = true
@@ -0,0 +1,169 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/pkg/errors"
+)
+
+// renamePairWindow is how long the first half of a rename waits for its
+// second half before it's sent on its own.  inotify queues the halves of a
+// rename together, so they're normally read at once.
+const renamePairWindow = 10 * time.Millisecond
+
+// WithInotify watches paths by reading inotify directly instead of through
+// fsnotify, so that a file renamed within or between watched directories
+// is reported as one Rename event, rather than as the deletion of its old
+// path and the creation of its new one.  Renames whose halves can't be
+// paired, because one of the directories isn't watched, are still reported
+// as a deletion or a creation.  It is only available on Linux.
+func WithInotify() Option {
+	return func(w *LogWatcher) error {
+		if !inotifySupported {
+			return errors.New("inotify is only available on Linux")
+		}
+		w.newBackend = newInotifyBackend
+		return nil
+	}
+}
+
+// backendEvent is an event from a backend that pairs the halves of renames.
+type backendEvent struct {
+	fsnotify.Event
+	From string // For a rename, the path the file was renamed from; Name is where it is now
+}
+
+// pairingBackend is a backend that reports a rename as one event.  Its
+// events are received from PairedEvents rather than Events.
+type pairingBackend interface {
+	backend
+	PairedEvents() <-chan backendEvent
+}
+
+// renameHalf is which half of a rename an event read from inotify is.
+type renameHalf int
+
+const (
+	notRenamed renameHalf = iota
+	movedFrom             // The old path; the event's Op is Rename
+	movedTo               // The new path; the event's Op is Create
+)
+
+// rawEvent is an event read from inotify, before renames are paired.
+type rawEvent struct {
+	fsnotify.Event
+	half   renameHalf
+	cookie uint32 // Shared by the halves of a rename
+}
+
+// pendingEvent is an event waiting to be sent.
+type pendingEvent struct {
+	e        backendEvent
+	cookie   uint32
+	deadline time.Time // For an unpaired first half of a rename, when to stop waiting for its second half; zero otherwise
+}
+
+// renamePairer pairs the halves of renames read from inotify by their
+// cookies.  Events are sent in the order they were read, so those read
+// after the first half of a rename wait with it until it's paired or its
+// window has passed.  A paired rename is sent in place of its first half.
+type renamePairer struct {
+	window time.Duration
+	queue  []pendingEvent
+}
+
+// add takes the next event read, at now, and returns the events now ready
+// to be sent.
+func (p *renamePairer) add(r rawEvent, now time.Time) []backendEvent {
+	if r.half == movedTo {
+		for i := range p.queue {
+			if q := &p.queue[i]; !q.deadline.IsZero() && q.cookie == r.cookie {
+				q.e = backendEvent{Event: fsnotify.Event{Name: r.Name, Op: fsnotify.Rename}, From: q.e.Name}
+				q.deadline = time.Time{}
+				return p.ready()
+			}
+		}
+	}
+	e := pendingEvent{e: backendEvent{Event: r.Event}}
+	if r.half == movedFrom {
+		e.cookie = r.cookie
+		e.deadline = now.Add(p.window)
+	}
+	p.queue = append(p.queue, e)
+	return p.ready()
+}
+
+// expire stops waiting, at now, for the second halves of the renames whose
+// window has passed, and returns the events now ready to be sent.
+func (p *renamePairer) expire(now time.Time) []backendEvent {
+	for i := range p.queue {
+		if d := p.queue[i].deadline; !d.IsZero() && !now.Before(d) {
+			p.queue[i].deadline = time.Time{}
+		}
+	}
+	return p.ready()
+}
+
+// ready removes and returns the events at the front of the queue that
+// aren't waiting.
+func (p *renamePairer) ready() []backendEvent {
+	var events []backendEvent
+	for len(p.queue) > 0 && p.queue[0].deadline.IsZero() {
+		events = append(events, p.queue[0].e)
+		p.queue = p.queue[1:]
+	}
+	return events
+}
+
+// next returns when expire should next be called, if any events are waiting.
+func (p *renamePairer) next() (time.Time, bool) {
+	if len(p.queue) == 0 {
+		return time.Time{}, false
+	}
+	return p.queue[0].deadline, true
+}
+
+// sendRename sends the rename of a file from one path to another.  If both
+// paths are watched for the same subscriber it's sent as a Rename;
+// otherwise each subscriber sees the deletion or creation in its paths.
+func (w *LogWatcher) sendRename(from, to string) {
+	fromWatch, fromRoot, fromOK := w.watchFor(from)
+	toWatch, toRoot, toOK := w.watchFor(to)
+	if fromOK && toOK && fromWatch.c == toWatch.c {
+		w.dispatch(toWatch.c, Event{Op: Rename, Pathname: to, From: from}, Fsnotify, toRoot)
+		return
+	}
+	if fromOK {
+		w.dispatch(fromWatch.c, Event{Op: Delete, Pathname: from}, Fsnotify, fromRoot)
+	}
+	if toOK {
+		w.dispatch(toWatch.c, Event{Op: Create, Pathname: to}, Fsnotify, toRoot)
+	}
+}
+
+// renameWatched moves the watches on from, and on the paths below it, to
+// to, as the backend has, so that removing the new path stops watching it.
+func (w *LogWatcher) renameWatched(from, to string) {
+	w.watchedMu.Lock()
+	defer w.watchedMu.Unlock()
+	var moved []*watch
+	for key, watched := range w.watched {
+		if hasPathPrefix(key, w.key(from)) {
+			moved = append(moved, watched)
+			delete(w.watched, key)
+		}
+	}
+	for _, watched := range moved {
+		// from may be spelt differently from the name it matched.
+		rel := ""
+		if len(watched.name) > len(from) {
+			rel = watched.name[len(from):]
+		}
+		watched.name = to + rel
+		w.watched[w.key(watched.name)] = watched
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"sort"
+	"sync"
+)
+
+// replayQueue is how many live events a replay subscriber may fall behind by
+// before more are dropped.
+const replayQueue = 1024
+
+// EventsWithReplay returns a new channel on which every event the LogWatcher
+// sends on any of its channels is copied, starting with the last n sent
+// before it was called, so that a subscriber attaching to a running
+// LogWatcher, such as a debug tool, can learn the current state.  If no other
+// replay subscriber was recording them, it starts with a Create for each
+// watched path that exists instead.  The events sent before it was called
+// are marked Replayed; every live event after them is newer.  Heartbeats
+// aren't copied.
+//
+// The LogWatcher keeps the last n events, for the largest n of the replay
+// subscribers, only while there are any.  A subscriber that falls more than
+// replayQueue events behind misses the rest until it catches up.  stop ends
+// the subscription and closes the channel, which Close does too.
+func (w *LogWatcher) EventsWithReplay(n int) (ch <-chan Event, stop func()) {
+	if n < 0 {
+		n = 0
+	}
+	s := &replaySub{
+		ch:      make(chan Event),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		size:    n,
+		limit:   n + replayQueue,
+	}
+	w.watchedMu.RLock()
+	closed := w.closed
+	r := &w.replay
+	r.mu.Lock()
+	if closed {
+		r.mu.Unlock()
+		w.watchedMu.RUnlock()
+		close(s.ch)
+		return s.ch, func() {}
+	}
+	if r.next == 0 && !r.full {
+		s.queue = w.snapshotCreatesLocked()
+	} else {
+		s.queue = r.last(n)
+	}
+	if r.subs == nil {
+		r.subs = make(map[*replaySub]struct{})
+	}
+	r.subs[s] = struct{}{}
+	r.resize()
+	r.mu.Unlock()
+	w.watchedMu.RUnlock()
+	w.logger.Infof("Replaying %d events to a new subscriber", len(s.queue))
+	go s.run()
+	return s.ch, func() { w.stopReplay(s) }
+}
+
+// snapshotCreatesLocked returns a replayed Create for each watched path that
+// exists, in order.  w.watchedMu must be held when called.
+func (w *LogWatcher) snapshotCreatesLocked() []Event {
+	var names []string
+	for _, watched := range w.watched {
+		if _, err := StatExtended(watched.name); err == nil {
+			names = append(names, watched.name)
+		}
+	}
+	sort.Strings(names)
+	events := make([]Event, 0, len(names))
+	for _, name := range names {
+		events = append(events, Event{Op: Create, Pathname: name, Replayed: true})
+	}
+	return events
+}
+
+// stopReplay ends the subscription of s, and waits for its channel to be
+// closed.
+func (w *LogWatcher) stopReplay(s *replaySub) {
+	r := &w.replay
+	r.mu.Lock()
+	if _, ok := r.subs[s]; ok {
+		delete(r.subs, s)
+		close(s.done)
+		r.resize()
+	}
+	r.mu.Unlock()
+	<-s.stopped
+}
+
+// stopReplays ends every replay subscription, when the LogWatcher is closed.
+func (w *LogWatcher) stopReplays() {
+	r := &w.replay
+	r.mu.Lock()
+	subs := r.subs
+	r.subs = nil
+	r.resize()
+	r.mu.Unlock()
+	for s := range subs {
+		close(s.done)
+		<-s.stopped
+	}
+}
+
+// replay holds the replay subscribers of a LogWatcher, and the events they
+// may be replayed.
+type replay struct {
+	mu   sync.Mutex
+	subs map[*replaySub]struct{}
+	buf  []Event // The last events sent, oldest first from next once full; empty if there are no subscribers
+	next int     // Where the next event goes in buf
+	full bool    // buf has wrapped around
+}
+
+// record keeps e to be replayed, and copies it to each subscriber.
+func (r *replay) record(e Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.subs) == 0 {
+		return
+	}
+	if len(r.buf) > 0 {
+		r.buf[r.next] = e
+		r.next++
+		if r.next == len(r.buf) {
+			r.next = 0
+			r.full = true
+		}
+	}
+	for s := range r.subs {
+		s.push(e)
+	}
+}
+
+// last returns up to the last n events kept, oldest first, marked Replayed.
+func (r *replay) last(n int) []Event {
+	var events []Event
+	if r.full {
+		events = append(events, r.buf[r.next:]...)
+	}
+	events = append(events, r.buf[:r.next]...)
+	if len(events) > n {
+		events = events[len(events)-n:]
+	}
+	for i := range events {
+		events[i].Replayed = true
+	}
+	return events
+}
+
+// resize keeps as many events as the subscriber wanting the most, or none
+// once there are no subscribers.
+func (r *replay) resize() {
+	size := 0
+	for s := range r.subs {
+		if s.size > size {
+			size = s.size
+		}
+	}
+	if len(r.subs) == 0 {
+		r.buf, r.next, r.full = nil, 0, false
+		return
+	}
+	if size == len(r.buf) {
+		return
+	}
+	kept := r.last(size)
+	for i := range kept {
+		kept[i].Replayed = false
+	}
+	r.buf = make([]Event, size)
+	r.next = copy(r.buf, kept)
+	r.full = false
+	if size > 0 && r.next == size {
+		r.next = 0
+		r.full = true
+	}
+}
+
+// replaySub is a replay subscriber.  Its events are queued, so that sending
+// them never waits for it.
+type replaySub struct {
+	ch      chan Event
+	ready   chan struct{} // Signalled when events are queued
+	done    chan struct{} // Closed to end the subscription
+	stopped chan struct{} // Closed once ch has been closed
+	size    int           // Events to keep for replaying to later subscribers
+	limit   int           // Most events queued
+
+	mu    sync.Mutex // protects `queue'
+	queue []Event
+}
+
+// push queues e, unless the subscriber is too far behind.
+func (s *replaySub) push(e Event) {
+	s.mu.Lock()
+	if len(s.queue) < s.limit {
+		s.queue = append(s.queue, e)
+	}
+	s.mu.Unlock()
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued events, in order, until the subscription ends.
+func (s *replaySub) run() {
+	defer close(s.stopped)
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		queue := s.queue
+		s.queue = nil
+		s.mu.Unlock()
+		for _, e := range queue {
+			select {
+			case s.ch <- e:
+			case <-s.done:
+				return
+			}
+		}
+		select {
+		case <-s.ready:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import "sync"
+
+// EventSequencer is implemented by Watchers that count the events they send
+// on each channel from Events, so that a receiver can tell when it has
+// handled every event sent so far.  The nth event received on a channel is
+// the nth counted, as each channel delivers its events in order.
+type EventSequencer interface {
+	// EventsSent returns the number of events sent, or being sent, on the
+	// channel with handle.
+	EventsSent(handle int) uint64
+	// AckEvents records that the receiver on the channel with handle has
+	// handled the first seq events sent on it.
+	AckEvents(handle int, seq uint64)
+}
+
+// sequences counts the events sent on each channel, and those the receiver
+// has acknowledged handling.
+type sequences struct {
+	mu     sync.Mutex
+	cond   *sync.Cond // Broadcast when an acknowledgment is received, or on close
+	sent   map[int]uint64
+	acked  map[int]uint64
+	closed bool
+}
+
+func newSequences() *sequences {
+	s := &sequences{sent: make(map[int]uint64), acked: make(map[int]uint64)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// next counts an event about to be sent on the channel with handle h, and
+// returns its sequence number.
+func (s *sequences) next(h int) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent[h]++
+	return s.sent[h]
+}
+
+func (s *sequences) sentOn(h int) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sent[h]
+}
+
+func (s *sequences) ack(h int, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.acked[h] {
+		s.acked[h] = seq
+		s.cond.Broadcast()
+	}
+}
+
+// await blocks until the event with seq on the channel with handle h has
+// been acknowledged, or close is called.
+func (s *sequences) await(h int, seq uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.acked[h] < seq && !s.closed {
+		s.cond.Wait()
+	}
+}
+
+// close releases the callers of await.
+func (s *sequences) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
@@ -0,0 +1,95 @@
+// Copyright 2019 Matthew Crenshaw. All Rights Reserved.
+// This file is available under the Apache license.
+
+package watcher
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sgtsquiggs/tail/logger"
+)
+
+// Source is a set of the ways that a LogWatcher finds changes to a path.
+type Source int
+
+const (
+	// Fsnotify sources are notified of changes by the kernel.
+	Fsnotify Source = 1 << iota
+	// Poll sources find changes by checking the path on each poll tick.
+	Poll
+)
+
+func (s Source) String() string {
+	var names []string
+	if s&Fsnotify != 0 {
+		names = append(names, "fsnotify")
+	}
+	if s&Poll != 0 {
+		names = append(names, "poll")
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "+")
+}
+
+// dedupWindow is how soon after one source finds a change to a path that the
+// same change found by a different source is dropped.
+const dedupWindow = 10 * time.Millisecond
+
+// lastEvent is the most recent event dispatched for a path.
+type lastEvent struct {
+	op     OpType
+	source Source
+	at     time.Time
+}
+
+// merger combines the events from the sources of each path, so that a change
+// found by more than one of them is dispatched once.
+type merger struct {
+	mu   sync.Mutex
+	last map[string]lastEvent // by pathname
+}
+
+// admit indicates if e, found by source at now, should be dispatched.
+func (m *merger) admit(e Event, source Source, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if l, ok := m.last[e.Pathname]; ok && l.op == e.Op && l.source != source && now.Sub(l.at) < dedupWindow {
+		return false
+	}
+	m.last[e.Pathname] = lastEvent{e.Op, source, now}
+	return true
+}
+
+// forget drops the record of events for pathname.
+func (m *merger) forget(pathname string) {
+	m.mu.Lock()
+	delete(m.last, pathname)
+	m.mu.Unlock()
+}
+
+// dispatch sends e, found by source through the watched path root, to the
+// subscriber c, unless another source has just found the same change.  It
+// gives up once the LogWatcher is closed, so a subscriber that has stopped
+// reading can't hold up Close.
+func (w *LogWatcher) dispatch(c chan Event, e Event, source Source, root string) {
+	if !w.merge.admit(e, source, w.clock.Now()) {
+		if w.logger.Enabled(log.DebugLevel) {
+			w.logger.With(map[string]interface{}{"path": e.Pathname, "op": e.Op}).Debugf("%s of %s from %s already found by another source", e.Op, e.Pathname, source)
+		}
+		return
+	}
+	w.count(e, root)
+	w.eventsMu.RLock()
+	h := w.handles[c]
+	w.eventsMu.RUnlock()
+	w.seq.next(h)
+	w.replay.record(e)
+	select {
+	case c <- e:
+	case <-w.stopEvents:
+	}
+}
@@ -5,6 +5,8 @@
 // notifying observers when they occur.
 package watcher
 
+import "fmt"
+
 type OpType int
 
 const (
@@ -12,17 +14,61 @@ const (
 	Create
 	Update
 	Delete
+	// Rename is sent when a file is renamed within or between watched
+	// directories, from From to Pathname, by a backend that can tell a
+	// rename from a deletion and a creation, such as WithInotify's.
+	Rename
+	// Heartbeat is sent every interval given to WithHeartbeat, with no
+	// Pathname, on the channels that ask for it with Heartbeats.
+	Heartbeat
 )
 
+func (o OpType) String() string {
+	switch o {
+	case Create:
+		return "create"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	case Rename:
+		return "rename"
+	case Heartbeat:
+		return "heartbeat"
+	}
+	return fmt.Sprintf("OpType(%d)", int(o))
+}
+
 // Event is a generalisation of events sent from the watcher to its listeners.
 type Event struct {
 	Op       OpType
 	Pathname string
+	From     string // For Rename, the path the file was renamed from
+	Replayed bool   // Sent before the channel from EventsWithReplay was created
+}
+
+func (e Event) String() string {
+	s := e.Op.String() + " " + e.Pathname
+	if e.Op == Rename {
+		s = e.Op.String() + " " + e.From + " to " + e.Pathname
+	}
+	if e.Replayed {
+		s += " (replayed)"
+	}
+	return s
+}
+
+// WatchedPath describes a path being watched.
+type WatchedPath struct {
+	Pathname string
+	IsDir    bool      // Events for files in the directory are also delivered
+	Sources  Source    // Where changes to the path are found, if known
+	Mode     WatchMode // The WatchMode given to Add
 }
 
 // Watcher describes an interface for filesystem watching.
 type Watcher interface {
-	Add(name string, handle int) error
+	Add(name string, handle int, opts ...AddOption) error
 	Close() error
 	Remove(name string) error
 	Events() (handle int, ch <-chan Event)